@@ -17,26 +17,45 @@
 package main
 
 import (
+	"crypto/rand"
 	"fmt"
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 
+	"github.com/grammarly/rocker/src/advisor"
+	"github.com/grammarly/rocker/src/attach"
 	"github.com/grammarly/rocker/src/build"
+	"github.com/grammarly/rocker/src/buildcmd"
+	"github.com/grammarly/rocker/src/cache"
+	"github.com/grammarly/rocker/src/clean"
+	"github.com/grammarly/rocker/src/cliutil"
 	"github.com/grammarly/rocker/src/debugtrap"
+	"github.com/grammarly/rocker/src/deps"
 	"github.com/grammarly/rocker/src/dockerclient"
-	"github.com/grammarly/rocker/src/storage/s3"
+	"github.com/grammarly/rocker/src/doctor"
+	"github.com/grammarly/rocker/src/features"
+	"github.com/grammarly/rocker/src/fragments"
+	"github.com/grammarly/rocker/src/i18n"
+	"github.com/grammarly/rocker/src/inspect"
+	"github.com/grammarly/rocker/src/redact"
+	"github.com/grammarly/rocker/src/release"
+	"github.com/grammarly/rocker/src/rotate"
+	"github.com/grammarly/rocker/src/selfupdate"
+	"github.com/grammarly/rocker/src/spill"
 	"github.com/grammarly/rocker/src/template"
 	"github.com/grammarly/rocker/src/textformatter"
+	"github.com/grammarly/rocker/src/theme"
 	"github.com/grammarly/rocker/src/util"
+	"github.com/grammarly/rocker/src/versioncheck"
+	"github.com/grammarly/rocker/src/workspace"
 
 	"github.com/codegangsta/cli"
 	"github.com/docker/docker/pkg/units"
 	"github.com/fatih/color"
-	"github.com/fsouza/go-dockerclient"
 
 	log "github.com/Sirupsen/logrus"
-	runconfigopts "github.com/docker/docker/runconfig/opts"
 )
 
 var (
@@ -52,10 +71,17 @@ var (
 	// BuildTime that is passed on compile time through -ldflags
 	BuildTime = "none"
 
+	// ReleaseKey is the public key self-update verifies the releases with,
+	// the base64 of its DER form, passed on compile time through -ldflags
+	ReleaseKey = ""
+
 	// HumanVersion is a human readable app version
 	HumanVersion = fmt.Sprintf("%s - %.7s (%s) %s", Version, GitCommit, GitBranch, BuildTime)
 )
 
+// checkUpdateURL is where the commands check for a newer release, empty without --check-update
+var checkUpdateURL string
+
 func init() {
 	log.SetOutput(os.Stdout)
 	log.SetLevel(log.InfoLevel)
@@ -63,6 +89,8 @@ func init() {
 }
 
 func main() {
+	cliutil.Version, cliutil.GitCommit = Version, GitCommit
+
 	app := cli.NewApp()
 
 	app.Name = "rocker"
@@ -89,426 +117,344 @@ func main() {
 		},
 		cli.BoolTFlag{
 			Name:  "colors",
-			Usage: "Make output colored",
+			Usage: "Make output colored, deprecated in favor of --color",
+		},
+		cli.StringFlag{
+			Name:   "color",
+			Value:  theme.ColorAuto,
+			EnvVar: "ROCKER_COLOR",
+			Usage:  "when to color the output: auto (on a terminal, unless NO_COLOR is set), always or never",
+		},
+		cli.StringFlag{
+			Name:   "theme",
+			Value:  "default",
+			EnvVar: "ROCKER_THEME",
+			Usage:  "output colors: default, colorblind, mono or a YAML file with the styles",
 		},
 		cli.BoolFlag{
 			Name:   "cmd, C",
 			EnvVar: "ROCKER_PRINT_COMMAND",
 			Usage:  "Print command-line that was used to exec",
 		},
-	}, dockerclient.GlobalCliParams()...)
-
-	buildFlags := []cli.Flag{
-		cli.StringFlag{
-			Name:  "file, f",
-			Value: "Rockerfile",
-			Usage: "rocker build file to execute",
+		cli.BoolFlag{
+			Name:   "check-update",
+			EnvVar: "ROCKER_CHECK_UPDATE",
+			Usage:  "Once a day check if there is a newer rocker release and warn if the current one is outdated",
 		},
 		cli.StringFlag{
-			Name:  "auth, a",
-			Value: "",
-			Usage: "Username and password in user:password format",
+			Name:   "build-id",
+			EnvVar: "ROCKER_BUILD_ID",
+			Usage:  "ID of this run for correlation across systems, e.g. the CI job id; generated if not given",
 		},
-		cli.StringSliceFlag{
-			Name:  "build-arg",
-			Value: &cli.StringSlice{},
-			Usage: "Set build-time variables, can pass multiple of those, format is key=value (default [])",
+		cli.StringFlag{
+			Name:   "check-update-url",
+			Value:  versioncheck.DefaultURL,
+			EnvVar: "ROCKER_CHECK_UPDATE_URL",
+			Usage:  "Endpoint that describes the latest release, point it to a mirror in airgapped environments",
 		},
-		cli.StringSliceFlag{
-			Name:  "var",
-			Value: &cli.StringSlice{},
-			Usage: "set variables to pass to build tasks, value is like \"key=value\"",
+		cli.StringFlag{
+			Name:   "telemetry-endpoint",
+			EnvVar: "ROCKER_TELEMETRY_ENDPOINT",
+			Usage:  "Opt-in: send anonymized usage stats (directives used, cache hit rate) of every build to this URL",
 		},
 		cli.StringSliceFlag{
-			Name:  "vars",
-			Value: &cli.StringSlice{},
-			Usage: "Load variables form a file, either JSON or YAML. Can pass multiple of this.",
-		},
-		cli.BoolFlag{
-			Name:  "no-cache",
-			Usage: "supresses cache for docker builds",
-		},
-		cli.BoolFlag{
-			Name:  "reload-cache",
-			Usage: "removes any cache that hit and save the new one",
-		},
-		cli.StringFlag{
-			Name:  "cache-dir",
-			Value: "~/.rocker_cache",
-			Usage: "Set the directory where the cache will be stored",
+			Name:   "redact-env",
+			Value:  &cli.StringSlice{},
+			EnvVar: "ROCKER_REDACT_ENV",
+			Usage:  "Name of an environment variable that holds a secret to mask in the logs; can pass multiple of this",
 		},
 		cli.BoolFlag{
-			Name:  "no-reuse",
-			Usage: "suppresses reuse for all the volumes in the build",
+			Name:   "unsafe-templates",
+			EnvVar: "ROCKER_UNSAFE_TEMPLATES",
+			Usage:  "Render the templates of Rockerfiles with the whole environment and any file, only for Rockerfiles you trust",
 		},
-		cli.BoolFlag{
-			Name:  "push",
-			Usage: "pushes all the images marked with push to docker hub",
+		cli.StringSliceFlag{
+			Name:   "template-env",
+			Value:  &cli.StringSlice{},
+			EnvVar: "ROCKER_TEMPLATE_ENV",
+			Usage:  "Name of an environment variable the templates can read as .Env; can pass multiple of this",
 		},
-		cli.BoolFlag{
-			Name:  "pull",
-			Usage: "always attempt to pull a newer version of the FROM images",
+		cli.DurationFlag{
+			Name:   "template-timeout",
+			Value:  template.DefaultSandboxTimeout,
+			EnvVar: "ROCKER_TEMPLATE_TIMEOUT",
+			Usage:  "Fail if the template of a Rockerfile takes longer than this to render, 0 for no limit",
 		},
-		cli.BoolFlag{
-			Name:  "attach",
-			Usage: "attach to a container in place of ATTACH command",
+		cli.StringSliceFlag{
+			Name:   "enable-feature",
+			Value:  &cli.StringSlice{},
+			EnvVar: "ROCKER_FEATURES",
+			Usage:  "Turn on an optional feature, see `rocker features` for the list; can pass multiple of this",
 		},
-		cli.BoolFlag{
-			Name:  "meta",
-			Usage: "add metadata to the tagged images, such as user, Rockerfile source, variables and git branch/sha",
+		cli.StringFlag{
+			Name:   "auth-url",
+			EnvVar: "ROCKER_AUTH_URL",
+			Usage:  "HTTP credentials service to get registry credentials from, GET <url>/<registry>",
 		},
-		cli.BoolFlag{
-			Name:  "print",
-			Usage: "just print the Rockerfile after template processing and stop",
+		cli.StringFlag{
+			Name:   "auth-token",
+			EnvVar: "ROCKER_AUTH_TOKEN",
+			Usage:  "bearer token for --auth-url",
 		},
-		cli.BoolFlag{
-			Name:  "demand-artifacts",
-			Usage: "fail if artifacts not found for {{ image }} helpers",
+		cli.IntFlag{
+			Name:   "pull-retry",
+			Value:  3,
+			EnvVar: "ROCKER_PULL_RETRY",
+			Usage:  "number of retries for image pulls refused by the registry rate limit, with growing delays",
 		},
 		cli.StringFlag{
-			Name:  "id",
-			Usage: "override the default id generation strategy for current build",
+			Name:   "pull-mirror",
+			EnvVar: "ROCKER_PULL_MIRROR",
+			Usage:  "registry mirror to pull Docker Hub images from when Docker Hub rate limits the pulls, e.g. mirror.gcr.io",
 		},
 		cli.StringFlag{
-			Name:  "artifacts-path",
-			Usage: "put artifacts (files with pushed images description) to the directory",
+			Name:   "lang",
+			EnvVar: "ROCKER_LANG",
+			Usage:  "language of the messages, e.g. uk; taken from LC_ALL, LC_MESSAGES or LANG by default",
 		},
-		cli.BoolFlag{
-			Name:  "no-garbage",
-			Usage: "remove the images from the tail if not tagged",
+		cli.StringFlag{
+			Name:   "locale-dir",
+			Value:  i18n.DefaultDir,
+			EnvVar: "ROCKER_LOCALE_DIR",
+			Usage:  "directory with the message catalogs <lang>.yml",
 		},
-		cli.IntFlag{
-			Name:  "push-retry",
-			Usage: "number of retries for failed image pushes",
+		cli.StringFlag{
+			Name:   "memory-budget",
+			Value:  "64MB",
+			EnvVar: "ROCKER_MEMORY_BUDGET",
+			Usage:  "memory the in-process buffers such as chart archives and published files may hold together, the rest goes to temp files",
 		},
-	}
+	}, dockerclient.GlobalCliParams()...)
 
 	app.Commands = []cli.Command{
-		{
-			Name:   "build",
-			Usage:  "launches a build for the specified Rockerfile",
-			Action: buildCommand,
-			Flags:  buildFlags,
-		},
-		{
-			Name:   "pull",
-			Usage:  "launches a pull of image (supports s3 storage driver)",
-			Action: pullCommand,
-			Flags: []cli.Flag{
-				cli.StringFlag{
-					Name:  "file, f",
-					Value: "Rockerfile",
-					Usage: "rocker build file to execute",
-				},
-				cli.StringFlag{
-					Name:  "auth, a",
-					Value: "",
-					Usage: "Username and password in user:password format",
-				},
-				cli.StringFlag{
-					Name:  "cache-dir",
-					Value: "~/.rocker_cache",
-					Usage: "Set the directory where the cache will be stored",
-				},
-			},
-		},
+		buildcmd.CommandSpec(),
+		buildcmd.PullCommandSpec(),
+		buildcmd.VerifyReproducibleCommandSpec(),
+		advisor.CommandSpec(),
 		dockerclient.InfoCommandSpec(),
+		inspect.VarsCommandSpec(),
+		inspect.ParseCommandSpec(),
+		inspect.GraphCommandSpec(),
+		deps.CommandSpec(),
+		deps.BuildAffectedCommandSpec(),
+		workspace.CommandSpec(),
+		features.CommandSpec(&cliutil.Features),
+		doctor.CommandSpec(),
+		clean.CommandSpec(),
+		cache.CommandSpec(),
+		rotate.CommandSpec(),
+		release.CommandSpec(),
+		fragments.GetCommandSpec(),
+		attach.CommandSpec(),
+		selfupdate.CommandSpec(ReleaseKey),
 	}
 
 	app.Before = func(c *cli.Context) error {
 		initLogs(c)
+		initBuildID(c)
+		initFeatures(c)
+		initRedact(c)
+		initMemoryBudget(c)
 
 		if c.GlobalBool("cmd") {
 			log.Infof("rocker %s | Cmd: %s\n", HumanVersion, strings.Join(os.Args, " "))
 		}
 
+		// The commands check for updates themselves, the state is kept in their --cache-dir
+		if c.GlobalBool("check-update") {
+			checkUpdateURL = c.GlobalString("check-update-url")
+		}
+
 		return nil
 	}
+	withUpdateCheck(app.Commands)
 
 	app.CommandNotFound = func(ctx *cli.Context, command string) {
 		fmt.Printf("Command not found: %v\n", command)
-		os.Exit(1)
-	}
-
-	if err := app.Run(os.Args); err != nil {
-		fmt.Printf(err.Error())
-		os.Exit(1)
-	}
-}
-
-func buildCommand(c *cli.Context) {
-
-	var (
-		rockerfile *build.Rockerfile
-		err        error
-	)
-
-	// We don't want info level for 'print' mode
-	// So log only errors unless 'debug' is on
-	if c.Bool("print") && log.StandardLogger().Level != log.DebugLevel {
-		log.StandardLogger().Level = log.ErrorLevel
+		os.Exit(build.ExitUser)
 	}
 
-	vars, err := template.VarsFromFileMulti(c.StringSlice("vars"))
-	if err != nil {
-		log.Fatal(err)
-		os.Exit(1)
-	}
+	err := app.Run(os.Args)
+	dockerclient.CloseSSHTunnels()
 
-	cliVars, err := template.VarsFromStrings(c.StringSlice("var"))
 	if err != nil {
-		log.Fatal(err)
+		fmt.Printf(err.Error())
+		os.Exit(build.ExitUser)
 	}
+}
 
-	vars = vars.Merge(cliVars)
-
-	if c.Bool("demand-artifacts") {
-		vars["DemandArtifacts"] = true
-	}
+func initLogs(ctx *cli.Context) {
+	logger := log.StandardLogger()
 
-	wd, err := os.Getwd()
-	if err != nil {
-		log.Fatal(err)
+	if ctx.GlobalBool("verbose") {
+		logger.Level = log.DebugLevel
 	}
 
-	configFilename := c.String("file")
-	contextDir := wd
-
-	if configFilename == "-" {
+	json := ctx.GlobalBool("json")
 
-		rockerfile, err = build.NewRockerfile(filepath.Base(wd), os.Stdin, vars, template.Funs{})
-		if err != nil {
-			log.Fatal(err)
+	mode := ctx.GlobalString("color")
+	if ctx.GlobalIsSet("colors") && !ctx.GlobalIsSet("color") {
+		mode = theme.ColorNever
+		if ctx.GlobalBool("colors") {
+			mode = theme.ColorAlways
 		}
-
-	} else {
-
-		if !filepath.IsAbs(configFilename) {
-			configFilename = filepath.Join(wd, configFilename)
-		}
-
-		rockerfile, err = build.NewRockerfileFromFile(configFilename, vars, template.Funs{})
-		if err != nil {
-			log.Fatal(err)
-		}
-
-		// Initialize context dir
-		contextDir = filepath.Dir(configFilename)
-	}
-
-	args := c.Args()
-	if len(args) > 0 {
-		contextDir = args[0]
-		if !filepath.IsAbs(contextDir) {
-			contextDir = filepath.Join(wd, args[0])
-		}
-	} else if contextDir != wd {
-		log.Warningf("Implicit context directory used: %s. You can override context directory using the last argument.", contextDir)
 	}
 
-	dir, err := os.Stat(contextDir)
+	useColors, err := theme.UseColors(mode, log.IsTerminal() && !json)
 	if err != nil {
-		log.Errorf("Problem with opening directory %s, error: %s", contextDir, err)
-		os.Exit(2)
+		cliutil.Exit(build.WithExitCode(build.ExitUser, err))
 	}
-	if !dir.IsDir() {
-		log.Errorf("Context directory %s is not a directory.", contextDir)
-		os.Exit(2)
 
+	if theme.Current, err = theme.Load(ctx.GlobalString("theme")); err != nil {
+		cliutil.Exit(build.WithExitCode(build.ExitUser, err))
 	}
-	log.Debugf("Context directory: %s", contextDir)
 
-	if c.Bool("print") {
-		fmt.Print(rockerfile.Content)
-		os.Exit(0)
-	}
+	color.NoColor = !useColors
 
-	dockerignore := []string{}
+	if json {
+		logger.Formatter = &log.JSONFormatter{}
+	} else {
+		formatter := &textformatter.TextFormatter{}
+		formatter.DisableColors = !useColors
+		formatter.ForceColors = useColors
 
-	dockerignoreFilename := filepath.Join(contextDir, ".dockerignore")
-	if _, err := os.Stat(dockerignoreFilename); err == nil {
-		if dockerignore, err = build.ReadDockerignoreFile(dockerignoreFilename); err != nil {
-			log.Fatal(err)
-		}
+		logger.Formatter = &i18n.Formatter{Formatter: formatter, Translator: initTranslator(ctx)}
 	}
 
-	var config *dockerclient.Config
-	config = dockerclient.NewConfigFromCli(c)
+	logger.Formatter = &redact.Formatter{Formatter: logger.Formatter, Redactor: cliutil.Redactor}
+}
 
-	dockerClient, err := dockerclient.NewFromConfig(config)
-	if err != nil {
-		log.Fatal(err)
+// initTranslator loads the message catalogs for the chosen language;
+// failing to load them is not fatal, messages just stay in English
+func initTranslator(c *cli.Context) *i18n.Translator {
+	lang := i18n.DetectLang(c.GlobalString("lang"))
+	if lang == i18n.DefaultLang {
+		return nil
 	}
 
-	cacheDir, err := util.MakeAbsolute(c.String("cache-dir"))
+	dir, err := util.MakeAbsolute(c.GlobalString("locale-dir"))
 	if err != nil {
-		log.Fatal(err)
-	}
-
-	var cache build.Cache
-	if !c.Bool("no-cache") {
-		cache = build.NewCacheFS(cacheDir)
+		dir = ""
 	}
 
-	var (
-		stdoutContainerFormatter log.Formatter = &log.JSONFormatter{}
-		stderrContainerFormatter log.Formatter = &log.JSONFormatter{}
-	)
-	if !c.GlobalBool("json") {
-		stdoutContainerFormatter = build.NewMonochromeContainerFormatter()
-		stderrContainerFormatter = build.NewColoredContainerFormatter()
+	translator, err := i18n.Load(lang, dir)
+	if err != nil {
+		log.Warnf("Failed to load the messages for %s, error: %s", lang, err)
+		return nil
 	}
+	return translator
+}
 
-	options := build.DockerClientOptions{
-		Client:                   dockerClient,
-		Auth:                     initAuth(c),
-		Log:                      log.StandardLogger(),
-		S3storage:                s3.New(dockerClient, cacheDir),
-		StdoutContainerFormatter: stdoutContainerFormatter,
-		StderrContainerFormatter: stderrContainerFormatter,
-		PushRetryCount:           c.Int("push-retry"),
-		Host:                     config.Host,
-		LogExactSizes:            c.GlobalBool("json"),
-	}
-	client := build.NewDockerClient(options)
-
-	builder := build.New(client, rockerfile, cache, build.Config{
-		InStream:      os.Stdin,
-		OutStream:     os.Stdout,
-		ContextDir:    contextDir,
-		Dockerignore:  dockerignore,
-		ArtifactsPath: c.String("artifacts-path"),
-		Pull:          c.Bool("pull"),
-		NoGarbage:     c.Bool("no-garbage"),
-		Attach:        c.Bool("attach"),
-		Verbose:       c.GlobalBool("verbose"),
-		ID:            c.String("id"),
-		NoCache:       c.Bool("no-cache"),
-		ReloadCache:   c.Bool("reload-cache"),
-		Push:          c.Bool("push"),
-		CacheDir:      cacheDir,
-		LogJSON:       c.GlobalBool("json"),
-		BuildArgs:     runconfigopts.ConvertKVStringsToMap(c.StringSlice("build-arg")),
-	})
-
-	plan, err := build.NewPlan(rockerfile.Commands(), true)
-	if err != nil {
-		log.Fatal(err)
+// initRedact registers the secrets known before any command starts
+func initRedact(c *cli.Context) {
+	for _, name := range append([]string{"AWS_SECRET_ACCESS_KEY", "AWS_SESSION_TOKEN"}, c.GlobalStringSlice("redact-env")...) {
+		if value := os.Getenv(name); value != "" {
+			cliutil.Redactor.Add(value)
+		}
 	}
+}
 
-	// Check the docker connection before we actually run
-	if err := dockerclient.Ping(dockerClient, 5000); err != nil {
-		log.Fatal(err)
+// initMemoryBudget sets the budget of the spill buffers from --memory-budget
+func initMemoryBudget(c *cli.Context) {
+	limit, err := units.RAMInBytes(c.GlobalString("memory-budget"))
+	if err != nil || limit < 0 {
+		cliutil.Exitf(build.ExitUser, "Invalid --memory-budget %q, expected a size such as 64MB", c.GlobalString("memory-budget"))
 	}
+	spill.Default.SetLimit(limit)
+}
 
-	if err := builder.Run(plan); err != nil {
-		log.Fatal(err)
+// initBuildID takes the build id from the command line or generates a new one;
+// in the JSON mode every log entry gets it as the build_id field
+func initBuildID(c *cli.Context) {
+	if cliutil.BuildID = c.GlobalString("build-id"); cliutil.BuildID == "" {
+		random := make([]byte, 4)
+		rand.Read(random)
+		cliutil.BuildID = fmt.Sprintf("%s-%x", time.Now().UTC().Format("20060102T150405"), random)
 	}
 
-	fields := log.Fields{}
 	if c.GlobalBool("json") {
-		fields["size"] = builder.VirtualSize
-		fields["delta"] = builder.ProducedSize
+		log.AddHook(buildIDHook(cliutil.BuildID))
 	}
-
-	size := fmt.Sprintf("final size %s (+%s from the base image)",
-		units.HumanSize(float64(builder.VirtualSize)),
-		units.HumanSize(float64(builder.ProducedSize)),
-	)
-
-	log.WithFields(fields).Infof("Successfully built %.12s | %s", builder.GetImageID(), size)
 }
 
-func pullCommand(c *cli.Context) {
-	args := c.Args()
-	if len(args) < 1 {
-		log.Fatal("rocker pull <image>")
-	}
+// initFeatures combines the features from the config file, ROCKER_FEATURES and --enable-feature
+func initFeatures(c *cli.Context) {
+	names := []string{}
 
-	dockerClient, err := dockerclient.NewFromCli(c)
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	cacheDir, err := util.MakeAbsolute(c.String("cache-dir"))
-	if err != nil {
-		log.Fatal(err)
+	if file, err := util.MakeAbsolute(features.DefaultConfigFile); err == nil {
+		if names, err = features.LoadFile(file); err != nil {
+			cliutil.Exitf(build.ExitUser, "Failed to read %s, error: %s", file, err)
+		}
 	}
 
-	options := build.DockerClientOptions{
-		Client:                   dockerClient,
-		Auth:                     initAuth(c),
-		Log:                      log.StandardLogger(),
-		S3storage:                s3.New(dockerClient, cacheDir),
-		StdoutContainerFormatter: log.StandardLogger().Formatter,
-		StderrContainerFormatter: log.StandardLogger().Formatter,
+	var err error
+	if cliutil.Features, err = features.Parse(append(names, c.GlobalStringSlice("enable-feature")...)); err != nil {
+		cliutil.Exit(build.WithExitCode(build.ExitUser, err))
 	}
-	client := build.NewDockerClient(options)
 
-	if err := client.PullImage(args[0]); err != nil {
-		log.Fatal(err)
+	for _, name := range cliutil.Features.Names() {
+		if f, _ := features.Lookup(name); f.Stability == features.Experimental || f.Stability == features.Deprecated {
+			log.Warnf("Feature %s is %s", f.Name, f.Stability)
+		}
 	}
 }
 
-func initAuth(c *cli.Context) (auth *docker.AuthConfigurations) {
-	var err error
-	if c.IsSet("auth") {
-		// Obtain auth configuration from cli params
-		authParam := c.String("auth")
-		if strings.Contains(authParam, ":") {
-			userPass := strings.Split(authParam, ":")
-			auth = &docker.AuthConfigurations{
-				Configs: map[string]docker.AuthConfiguration{
-					"*": docker.AuthConfiguration{
-						Username: userPass[0],
-						Password: userPass[1],
-					},
-				},
+// withUpdateCheck makes the commands check for a newer release before they run,
+// except self-update, which checks it anyway
+func withUpdateCheck(commands []cli.Command) {
+	for i := range commands {
+		withUpdateCheck(commands[i].Subcommands)
+		if action := commands[i].Action; action != nil && commands[i].Name != "self-update" {
+			commands[i].Action = func(c *cli.Context) {
+				if checkUpdateURL != "" {
+					checkUpdate(c)
+				}
+				action(c)
 			}
 		}
-		return
-	}
-	// Obtain auth configuration from .docker/config.json
-	if auth, err = docker.NewAuthConfigurationsFromDockerCfg(); err != nil && !os.IsNotExist(err) {
-		log.Fatal(err)
 	}
-	return
 }
 
-func initLogs(ctx *cli.Context) {
-	logger := log.StandardLogger()
-
-	if ctx.GlobalBool("verbose") {
-		logger.Level = log.DebugLevel
+// checkUpdate warns if the current rocker is outdated; it never fails the run
+func checkUpdate(c *cli.Context) {
+	cacheDir := c.String("cache-dir")
+	if cacheDir == "" {
+		cacheDir = "~/.rocker_cache"
+	}
+	stateFile, err := util.MakeAbsolute(filepath.Join(cacheDir, "version_check.json"))
+	if err != nil {
+		log.Debugf("Skip version check, error: %s", err)
+		return
 	}
 
-	var (
-		isTerm    = log.IsTerminal()
-		json      = ctx.GlobalBool("json")
-		useColors = isTerm && !json
-	)
-
-	if ctx.GlobalIsSet("colors") {
-		useColors = ctx.GlobalBool("colors")
+	latest, outdated, err := versioncheck.New(checkUpdateURL, stateFile).Check(Version)
+	if err != nil {
+		log.Debugf("Skip version check, error: %s", err)
+		return
 	}
 
-	color.NoColor = !useColors
+	if outdated {
+		log.Warnf("You are using rocker %s, the latest release is %s, see https://github.com/grammarly/rocker/releases", Version, latest)
+	}
+}
 
-	if json {
-		logger.Formatter = &log.JSONFormatter{}
-	} else {
-		formatter := &textformatter.TextFormatter{}
-		formatter.DisableColors = !useColors
+// buildIDHook adds the build id to log entries
+type buildIDHook string
 
-		logger.Formatter = formatter
+// Levels implements logrus.Hook
+func (h buildIDHook) Levels() []log.Level {
+	return []log.Level{
+		log.PanicLevel,
+		log.FatalLevel,
+		log.ErrorLevel,
+		log.WarnLevel,
+		log.InfoLevel,
+		log.DebugLevel,
 	}
 }
 
-func stringOr(args ...string) string {
-	for _, str := range args {
-		if str != "" {
-			return str
-		}
-	}
-	return ""
+// Fire implements logrus.Hook
+func (h buildIDHook) Fire(entry *log.Entry) error {
+	entry.Data["build_id"] = string(h)
+	return nil
 }
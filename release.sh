@@ -12,6 +12,19 @@ LAST_TAG=`git describe --abbrev=0 --tags 2>/dev/null`
 GITHUB_USER=grammarly
 GITHUB_REPO=rocker
 
+# `rocker self-update` refuses the binaries without a valid signature,
+# RELEASE_SIGNING_KEY is the EC private key of release.pub
+if [ -z "$RELEASE_SIGNING_KEY" ]; then
+  echo "RELEASE_SIGNING_KEY is not set" >&2
+  exit 1
+fi
+
+for PLATFORM in linux_amd64 darwin_amd64; do
+  openssl dgst -sha256 -sign $RELEASE_SIGNING_KEY \
+    -out ./dist/rocker_$PLATFORM.tar.gz.sig \
+    ./dist/rocker_$PLATFORM.tar.gz
+done
+
 docker run --rm -ti \
   -e GITHUB_TOKEN=$GITHUB_TOKEN \
   -v /etc/ssl/certs/ca-certificates.crt:/etc/ssl/certs/ca-certificates.crt \
@@ -23,24 +36,17 @@ docker run --rm -ti \
       --name $VERSION \
       --description "https://github.com/$GITHUB_USER/$GITHUB_REPO/compare/$LAST_TAG...$VERSION"
 
-docker run --rm -ti \
-  -e GITHUB_TOKEN=$GITHUB_TOKEN \
-  -v /etc/ssl/certs/ca-certificates.crt:/etc/ssl/certs/ca-certificates.crt \
-  -v `pwd`/dist:/dist \
-  dockerhub.grammarly.io/tools/github-release:master upload \
-      --user $GITHUB_USER \
-      --repo $GITHUB_REPO \
-      --tag $VERSION \
-      --name rocker-$VERSION-linux_amd64.tar.gz \
-      --file ./dist/rocker_linux_amd64.tar.gz
-
-docker run --rm -ti \
-  -e GITHUB_TOKEN=$GITHUB_TOKEN \
-  -v /etc/ssl/certs/ca-certificates.crt:/etc/ssl/certs/ca-certificates.crt \
-  -v `pwd`/dist:/dist \
-  dockerhub.grammarly.io/tools/github-release:master upload \
-      --user $GITHUB_USER \
-      --repo $GITHUB_REPO \
-      --tag $VERSION \
-      --name rocker-$VERSION-darwin_amd64.tar.gz \
-      --file ./dist/rocker_darwin_amd64.tar.gz
+for PLATFORM in linux_amd64 darwin_amd64; do
+  for EXT in tar.gz tar.gz.sig; do
+    docker run --rm -ti \
+      -e GITHUB_TOKEN=$GITHUB_TOKEN \
+      -v /etc/ssl/certs/ca-certificates.crt:/etc/ssl/certs/ca-certificates.crt \
+      -v `pwd`/dist:/dist \
+      dockerhub.grammarly.io/tools/github-release:master upload \
+          --user $GITHUB_USER \
+          --repo $GITHUB_REPO \
+          --tag $VERSION \
+          --name rocker-$VERSION-$PLATFORM.$EXT \
+          --file ./dist/rocker_$PLATFORM.$EXT
+  done
+done
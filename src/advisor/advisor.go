@@ -0,0 +1,186 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package advisor inspects the contents of an image and suggests
+// a smaller base image that is still compatible with it
+package advisor
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strings"
+)
+
+// Facts describes what was found in the image filesystem
+type Facts struct {
+	Libc           string
+	Interpreters   []string
+	CACerts        bool
+	Shell          bool
+	PackageManager string
+}
+
+// Advice is a single recommendation
+type Advice struct {
+	Base   string
+	Reason string
+}
+
+// String returns the human readable representation of the advice
+func (a Advice) String() string {
+	if a.Base == "" {
+		return a.Reason
+	}
+	return fmt.Sprintf("%s: %s", a.Base, a.Reason)
+}
+
+var (
+	interpreters = map[string]string{
+		"python":  "python",
+		"python2": "python",
+		"python3": "python",
+		"node":    "node",
+		"nodejs":  "node",
+		"java":    "java",
+		"ruby":    "ruby",
+		"php":     "php",
+	}
+
+	packageManagers = map[string]string{
+		"apt-get": "apt",
+		"apk":     "apk",
+		"yum":     "yum",
+		"dnf":     "dnf",
+	}
+
+	caBundles = map[string]bool{
+		"etc/ssl/certs/ca-certificates.crt": true,
+		"etc/pki/tls/certs/ca-bundle.crt":   true,
+		"etc/ssl/cert.pem":                  true,
+	}
+)
+
+// Scan collects facts from the tar stream of the image filesystem,
+// such as the one that is produced by exporting a container
+func Scan(in io.Reader) (facts Facts, err error) {
+	var (
+		tr    = tar.NewReader(in)
+		found = map[string]bool{}
+	)
+
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return facts, err
+		}
+
+		name := strings.TrimPrefix(path.Clean("/"+hdr.Name), "/")
+		dir, base := path.Split(name)
+
+		switch {
+		case strings.HasPrefix(base, "ld-musl-"):
+			facts.Libc = "musl"
+		case (base == "libc.so.6" || strings.HasPrefix(base, "ld-linux")) && facts.Libc == "":
+			facts.Libc = "glibc"
+		case caBundles[name]:
+			facts.CACerts = true
+		}
+
+		if !strings.HasSuffix(dir, "bin/") {
+			continue
+		}
+
+		if base == "sh" || base == "bash" {
+			facts.Shell = true
+		}
+		if pm, ok := packageManagers[base]; ok {
+			facts.PackageManager = pm
+		}
+		if lang, ok := interpreters[base]; ok && !found[lang] {
+			found[lang] = true
+			facts.Interpreters = append(facts.Interpreters, lang)
+		}
+	}
+
+	sort.Strings(facts.Interpreters)
+
+	return facts, nil
+}
+
+// Advise suggests base images that fit the facts
+func Advise(facts Facts) (advice []Advice) {
+	for _, lang := range facts.Interpreters {
+		switch lang {
+		case "python":
+			advice = append(advice, pick(facts, "gcr.io/distroless/python3", "python:3-alpine", "python runtime found"))
+		case "node":
+			advice = append(advice, pick(facts, "gcr.io/distroless/nodejs", "node:alpine", "node runtime found"))
+		case "java":
+			advice = append(advice, pick(facts, "gcr.io/distroless/java", "openjdk:8-jre-alpine", "java runtime found"))
+		case "ruby":
+			advice = append(advice, pick(facts, "ruby:slim", "ruby:alpine", "ruby runtime found"))
+		case "php":
+			advice = append(advice, pick(facts, "php:cli", "php:alpine", "php runtime found"))
+		}
+	}
+
+	if len(facts.Interpreters) == 0 {
+		switch facts.Libc {
+		case "glibc":
+			advice = append(advice, Advice{"gcr.io/distroless/base", "binaries link against glibc, no interpreter found"})
+		case "musl":
+			advice = append(advice, Advice{"alpine", "binaries link against musl, no interpreter found"})
+		default:
+			if facts.CACerts {
+				advice = append(advice, Advice{"gcr.io/distroless/static", "no libc found, binaries look static; it has CA certificates"})
+			} else {
+				advice = append(advice, Advice{"scratch", "no libc and no CA certificates found, binaries look static"})
+			}
+		}
+	}
+
+	if facts.PackageManager != "" {
+		advice = append(advice, Advice{"", fmt.Sprintf("package manager %s is shipped in the image; build in a separate FROM and copy only the results", facts.PackageManager)})
+	}
+
+	if facts.Shell && hasShellless(advice) {
+		advice = append(advice, Advice{"", "distroless and scratch images have no shell, so RUN, ATTACH and shell-form CMD will not work there"})
+	}
+
+	return advice
+}
+
+func hasShellless(advice []Advice) bool {
+	for _, a := range advice {
+		if a.Base == "scratch" || strings.HasPrefix(a.Base, "gcr.io/distroless/") {
+			return true
+		}
+	}
+	return false
+}
+
+func pick(facts Facts, glibc, musl, reason string) Advice {
+	if facts.Libc == "musl" {
+		return Advice{musl, reason + ", binaries link against musl"}
+	}
+	return Advice{glibc, reason}
+}
@@ -0,0 +1,89 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package advisor
+
+import (
+	"archive/tar"
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func makeTar(t *testing.T, names ...string) *bytes.Buffer {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, name := range names {
+		if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0755, Typeflag: tar.TypeReg}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tw.Close()
+	return &buf
+}
+
+func TestScan(t *testing.T) {
+	facts, err := Scan(makeTar(t,
+		"bin/sh",
+		"lib/x86_64-linux-gnu/libc.so.6",
+		"usr/bin/apt-get",
+		"usr/bin/python3",
+		"usr/local/bin/node",
+		"etc/ssl/certs/ca-certificates.crt",
+	))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, Facts{
+		Libc:           "glibc",
+		Interpreters:   []string{"node", "python"},
+		CACerts:        true,
+		Shell:          true,
+		PackageManager: "apt",
+	}, facts)
+}
+
+func TestScan_Musl(t *testing.T) {
+	facts, err := Scan(makeTar(t, "lib/ld-musl-x86_64.so.1", "lib/libc.musl-x86_64.so.1", "sbin/apk"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "musl", facts.Libc)
+	assert.Equal(t, "apk", facts.PackageManager)
+}
+
+func TestAdvise(t *testing.T) {
+	tests := []struct {
+		facts Facts
+		base  string
+	}{
+		{Facts{}, "scratch"},
+		{Facts{CACerts: true}, "gcr.io/distroless/static"},
+		{Facts{Libc: "glibc"}, "gcr.io/distroless/base"},
+		{Facts{Libc: "musl"}, "alpine"},
+		{Facts{Libc: "glibc", Interpreters: []string{"java"}}, "gcr.io/distroless/java"},
+		{Facts{Libc: "musl", Interpreters: []string{"python"}}, "python:3-alpine"},
+	}
+
+	for _, test := range tests {
+		advice := Advise(test.facts)
+		if assert.NotEmpty(t, advice) {
+			assert.Equal(t, test.base, advice[0].Base, "facts: %+v", test.facts)
+		}
+	}
+}
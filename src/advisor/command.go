@@ -0,0 +1,99 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package advisor
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/grammarly/rocker/src/build"
+	"github.com/grammarly/rocker/src/cliutil"
+	"github.com/grammarly/rocker/src/dockerclient"
+
+	"github.com/codegangsta/cli"
+	"github.com/fsouza/go-dockerclient"
+)
+
+// CommandSpec returns specifications of the optimize command for codegangsta/cli
+func CommandSpec() cli.Command {
+	return cli.Command{
+		Name:   "optimize",
+		Usage:  "inspects the contents of an image and suggests a smaller compatible base image",
+		Action: optimizeCommand,
+	}
+}
+
+// optimizeCommand implements 'optimize' command that scans the filesystem of the image
+// and prints the suggestions
+func optimizeCommand(c *cli.Context) {
+	args := c.Args()
+	if len(args) < 1 {
+		cliutil.Exitf(build.ExitUser, "rocker optimize <image>")
+	}
+
+	dockerClient, err := dockerclient.NewFromCli(c)
+	if err != nil {
+		cliutil.Exit(build.WithExitCode(build.ExitInfra, err))
+	}
+
+	// The container is never started, it is only needed to export the filesystem
+	container, err := dockerClient.CreateContainer(docker.CreateContainerOptions{
+		Config: &docker.Config{
+			Image: args[0],
+			Cmd:   []string{"/bin/sh", "-c", "#(nop) optimize"},
+		},
+	})
+	if err != nil {
+		cliutil.Exit(err)
+	}
+	defer dockerClient.RemoveContainer(docker.RemoveContainerOptions{ID: container.ID, Force: true})
+
+	pipeReader, pipeWriter := io.Pipe()
+	go func() {
+		pipeWriter.CloseWithError(dockerClient.ExportContainer(docker.ExportContainerOptions{
+			ID:           container.ID,
+			OutputStream: pipeWriter,
+		}))
+	}()
+
+	facts, err := Scan(pipeReader)
+	pipeReader.Close()
+	if err != nil {
+		cliutil.Exit(err)
+	}
+
+	fmt.Printf("Image: %s\n", args[0])
+	fmt.Printf("  libc: %s\n", stringOr(facts.Libc, "none"))
+	fmt.Printf("  interpreters: %s\n", stringOr(strings.Join(facts.Interpreters, ", "), "none"))
+	fmt.Printf("  CA certificates: %t\n", facts.CACerts)
+	fmt.Printf("  shell: %t\n", facts.Shell)
+	fmt.Printf("  package manager: %s\n", stringOr(facts.PackageManager, "none"))
+	fmt.Printf("Suggestions:\n")
+	for _, advice := range Advise(facts) {
+		fmt.Printf("  - %s\n", advice)
+	}
+}
+
+func stringOr(args ...string) string {
+	for _, str := range args {
+		if str != "" {
+			return str
+		}
+	}
+	return ""
+}
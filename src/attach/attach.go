@@ -0,0 +1,116 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+// Package attach implements the attach-artifact command, which pushes a file
+// that refers to an existing image, such as an SBOM, a signature or a scan result
+package attach
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/grammarly/rocker/src/build"
+	"github.com/grammarly/rocker/src/cliutil"
+	"github.com/grammarly/rocker/src/dockerclient"
+	"github.com/grammarly/rocker/src/imagename"
+	"github.com/grammarly/rocker/src/spill"
+
+	"github.com/codegangsta/cli"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// CommandSpec returns specifications of the attach-artifact command for codegangsta/cli
+func CommandSpec() cli.Command {
+	return cli.Command{
+		Name:   "attach-artifact",
+		Usage:  "pushes a file as an OCI artifact that refers to the image, so the referrers API of the registry lists it for the image",
+		Action: attachCommand,
+		Flags: []cli.Flag{
+			cli.StringFlag{
+				Name:  "artifact-type",
+				Value: dockerclient.DefaultArtifactType,
+				Usage: "type of the artifact, e.g. application/spdx+json",
+			},
+			cli.StringFlag{
+				Name:  "media-type",
+				Value: "application/octet-stream",
+				Usage: "media type of the file",
+			},
+			cli.StringSliceFlag{
+				Name:  "annotation",
+				Value: &cli.StringSlice{},
+				Usage: "add the key=value annotation to the manifest of the artifact; can pass multiple of this",
+			},
+			cli.StringFlag{
+				Name:  "auth, a",
+				Value: "",
+				Usage: "Username and password in user:password format",
+			},
+		},
+	}
+}
+
+// attachCommand implements 'attach-artifact' command that pushes the file with the image as its subject
+func attachCommand(c *cli.Context) {
+	if len(c.Args()) != 2 {
+		cliutil.Exitf(build.ExitUser, "rocker attach-artifact <image> <file>, e.g. quay.io/acme/app:1.0 sbom.json")
+	}
+
+	image, file := imagename.NewFromString(c.Args()[0]), c.Args()[1]
+
+	annotations, err := dockerclient.ParseAnnotations(c.StringSlice("annotation"))
+	if err != nil {
+		cliutil.Exit(build.WithExitCode(build.ExitUser, err))
+	}
+
+	content, err := readFile(file)
+	if err != nil {
+		cliutil.Exit(build.WithExitCode(build.ExitUser, err))
+	}
+	defer content.Close()
+
+	digest, err := dockerclient.RegistryAttachArtifact(image, cliutil.InitAuth(c), dockerclient.OCIArtifact{
+		Name:         filepath.Base(file),
+		Blob:         content,
+		MediaType:    c.String("media-type"),
+		ArtifactType: c.String("artifact-type"),
+		Annotations:  annotations,
+	})
+	if err != nil {
+		cliutil.Exit(err)
+	}
+
+	log.Infof("Attached %s to %s as %s@%s", file, image, image.NameWithRegistry(), digest)
+}
+
+// readFile reads the file to the buffer of the memory budget
+func readFile(file string) (*spill.Buffer, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	content := spill.NewBuffer()
+	if _, err := io.Copy(content, f); err != nil {
+		content.Close()
+		return nil, fmt.Errorf("Failed to read %s, error: %s", file, err)
+	}
+
+	return content, nil
+}
@@ -0,0 +1,210 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// AffectedTarget is a Rockerfile that needs to be rebuilt
+type AffectedTarget struct {
+	File string `json:"file"`
+	// Changed are the changed files of its context, empty if the Rockerfile
+	// is rebuilt only because it depends on another affected one
+	Changed []string `json:"changed,omitempty"`
+	// DependsOn are the affected Rockerfiles it depends on
+	DependsOn []string `json:"depends_on,omitempty"`
+}
+
+// GitChangedFiles lists the files changed in the working tree since the given
+// git ref, including the uncommitted changes; paths are relative to root
+func GitChangedFiles(root, since string) ([]string, error) {
+	cmd := exec.Command("git", "diff", "--name-only", "--relative", since, "--")
+	cmd.Dir = root
+
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to list the files changed since %s, error: %s %s", since, err, strings.TrimSpace(stderr.String()))
+	}
+
+	files := []string{}
+	for _, line := range strings.Split(string(out), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			files = append(files, line)
+		}
+	}
+
+	return files, nil
+}
+
+// Affected tells which Rockerfiles of the graph have to be rebuilt after the
+// given files changed: those whose context directory contains a changed file
+// that is not excluded by the .rockerignore or .dockerignore of the context, and those that
+// depend on the images of the affected ones. Targets come in the order they
+// can be built in; the rest of the Rockerfiles are returned as skipped.
+func Affected(graph *DepsGraph, root string, changed []string) (targets []*AffectedTarget, skipped []string, err error) {
+	nodes := map[string]*DepsNode{}
+	byFile := map[string]*AffectedTarget{}
+
+	for _, node := range graph.Rockerfiles {
+		nodes[node.File] = node
+
+		contextDir := path.Dir(node.File)
+
+		excludes, err := ReadContextIgnore(filepath.Join(root, filepath.FromSlash(contextDir)))
+		if err != nil {
+			return nil, nil, err
+		}
+
+		for _, file := range changed {
+			file = filepath.ToSlash(file)
+
+			rel, ok := relToContext(contextDir, file)
+			if !ok {
+				continue
+			}
+
+			// The Rockerfile itself is never ignored
+			if file != node.File {
+				ignored, err := contextIgnores(rel, excludes)
+				if err != nil {
+					return nil, nil, fmt.Errorf("Failed to match %s against the ignore file of %s, error: %s", file, node.File, err)
+				}
+				if ignored {
+					continue
+				}
+			}
+
+			if byFile[node.File] == nil {
+				byFile[node.File] = &AffectedTarget{File: node.File}
+			}
+			byFile[node.File].Changed = append(byFile[node.File].Changed, file)
+		}
+	}
+
+	// Whatever is built FROM an affected image needs to be rebuilt as well
+	order, err := depsOrder(graph)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for _, file := range order {
+		node := nodes[file]
+		for _, dep := range node.DependsOn {
+			if byFile[dep] == nil {
+				continue
+			}
+			if byFile[file] == nil {
+				byFile[file] = &AffectedTarget{File: file}
+			}
+			byFile[file].DependsOn = append(byFile[file].DependsOn, dep)
+		}
+	}
+
+	targets = []*AffectedTarget{}
+	skipped = []string{}
+
+	for _, file := range order {
+		if target := byFile[file]; target != nil {
+			targets = append(targets, target)
+		} else {
+			skipped = append(skipped, file)
+		}
+	}
+
+	return targets, skipped, nil
+}
+
+// depsOrder sorts the Rockerfiles of the graph so that each one goes after
+// the ones it depends on; otherwise the order is alphabetical
+func depsOrder(graph *DepsGraph) ([]string, error) {
+	var (
+		order = []string{}
+		state = map[string]int{} // 1 - visiting, 2 - done
+		nodes = map[string]*DepsNode{}
+		files = []string{}
+		visit func(file string, chain []string) error
+	)
+
+	for _, node := range graph.Rockerfiles {
+		nodes[node.File] = node
+		files = append(files, node.File)
+	}
+	sort.Strings(files)
+
+	visit = func(file string, chain []string) error {
+		switch state[file] {
+		case 1:
+			return fmt.Errorf("Rockerfiles depend on each other: %s", strings.Join(append(chain, file), " -> "))
+		case 2:
+			return nil
+		}
+		state[file] = 1
+		for _, dep := range nodes[file].DependsOn {
+			if err := visit(dep, append(chain, file)); err != nil {
+				return err
+			}
+		}
+		state[file] = 2
+		order = append(order, file)
+		return nil
+	}
+
+	for _, file := range files {
+		if err := visit(file, []string{}); err != nil {
+			return nil, err
+		}
+	}
+
+	return order, nil
+}
+
+// relToContext returns the path of the file relative to the context directory,
+// if the file is inside of it
+func relToContext(contextDir, file string) (string, bool) {
+	if contextDir == "." {
+		return file, true
+	}
+	if !strings.HasPrefix(file, contextDir+"/") {
+		return "", false
+	}
+	return strings.TrimPrefix(file, contextDir+"/"), true
+}
+
+// contextIgnores tells if the ignore patterns exclude the file from
+// the context, the same way COPY and ADD skip it
+func contextIgnores(file string, excludes []string) (bool, error) {
+	if len(excludes) == 0 {
+		return false, nil
+	}
+
+	ignore, err := newIgnoreMatcher(excludes)
+	if err != nil {
+		return false, err
+	}
+
+	return ignore.Matches(file)
+}
@@ -0,0 +1,82 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"os"
+	"testing"
+
+	"github.com/grammarly/rocker/src/template"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAffected(t *testing.T) {
+	tmpDir := makeTmpDir(t, map[string]string{
+		"base/Rockerfile":    "FROM ubuntu\nPUSH acme/base\n",
+		"base/.dockerignore": "*.md\n**/*.log\n",
+		"app/Rockerfile":     "FROM acme/base\nTAG acme/app\n",
+		"web/Rockerfile":     "FROM acme/app\n",
+		"cli/Rockerfile":     "FROM alpine\n",
+	})
+	defer os.RemoveAll(tmpDir)
+
+	graph, err := NewDepsGraph(tmpDir, template.Vars{}, template.Funs{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files := func(targets []*AffectedTarget) []string {
+		result := []string{}
+		for _, target := range targets {
+			result = append(result, target.File)
+		}
+		return result
+	}
+
+	// Ignored files do not count, the Rockerfile always does
+	targets, skipped, err := Affected(graph, tmpDir, []string{"base/README.md", "base/x/debug.log", "README.md"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []string{}, files(targets))
+	assert.Equal(t, []string{"base/Rockerfile", "app/Rockerfile", "cli/Rockerfile", "web/Rockerfile"}, skipped)
+
+	// Dependent Rockerfiles go after the ones they depend on
+	targets, skipped, err = Affected(graph, tmpDir, []string{"web/index.html", "base/Rockerfile"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []string{"base/Rockerfile", "app/Rockerfile", "web/Rockerfile"}, files(targets))
+	assert.Equal(t, []string{"base/Rockerfile"}, targets[0].Changed)
+	assert.Equal(t, []string{"base/Rockerfile"}, targets[1].DependsOn)
+	assert.Empty(t, targets[1].Changed)
+	assert.Equal(t, []string{"web/index.html"}, targets[2].Changed)
+	assert.Equal(t, []string{"app/Rockerfile"}, targets[2].DependsOn)
+	assert.Equal(t, []string{"cli/Rockerfile"}, skipped)
+}
+
+func TestAffected_Cycle(t *testing.T) {
+	graph := &DepsGraph{
+		Rockerfiles: []*DepsNode{
+			{File: "a/Rockerfile", DependsOn: []string{"b/Rockerfile"}},
+			{File: "b/Rockerfile", DependsOn: []string{"a/Rockerfile"}},
+		},
+	}
+
+	_, _, err := Affected(graph, ".", []string{"a/file"})
+	assert.EqualError(t, err, "Rockerfiles depend on each other: a/Rockerfile -> b/Rockerfile -> a/Rockerfile")
+}
@@ -0,0 +1,74 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+
+	"github.com/docker/docker/pkg/signal"
+	"github.com/fsouza/go-dockerclient"
+)
+
+// What to do on SIGINT while attached to a container
+const (
+	// AttachInterruptStopStep stops the container, so the step fails and the build stops
+	AttachInterruptStopStep = "stop-step"
+
+	// AttachInterruptForward passes SIGINT to the process in the container
+	AttachInterruptForward = "forward"
+)
+
+// forwardedSignals are passed to the process of an attached container;
+// SIGWINCH is handled separately by resizing the container TTY
+var forwardedSignals = []string{"TERM", "HUP", "QUIT", "USR1", "USR2"}
+
+// ParseAttachInterrupt validates the value of --attach-interrupt
+func ParseAttachInterrupt(value string) (string, error) {
+	switch value {
+	case "":
+		return AttachInterruptStopStep, nil
+	case AttachInterruptStopStep, AttachInterruptForward:
+		return value, nil
+	}
+	return "", fmt.Errorf("Invalid --attach-interrupt %q, expected %s or %s", value, AttachInterruptStopStep, AttachInterruptForward)
+}
+
+// attachSignals lists the signals supported by the platform that should be forwarded
+func attachSignals() (signals []os.Signal) {
+	for _, name := range forwardedSignals {
+		if sig, ok := signal.SignalMap[name]; ok {
+			signals = append(signals, sig)
+		}
+	}
+	return signals
+}
+
+// forwardSignal sends the signal received by rocker to the container
+func (c *DockerClient) forwardSignal(containerID string, sig os.Signal) {
+	s, ok := sig.(syscall.Signal)
+	if !ok {
+		return
+	}
+
+	c.log.Debugf("Forward signal %s to the container %.12s", sig, containerID)
+
+	if err := c.client.KillContainer(docker.KillContainerOptions{ID: containerID, Signal: docker.Signal(s)}); err != nil {
+		c.log.Errorf("Failed to send signal %s to the container %.12s, error: %s", sig, containerID, err)
+	}
+}
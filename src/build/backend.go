@@ -0,0 +1,114 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/grammarly/rocker/src/dockerclient"
+)
+
+// Backend makes the client a build runs its steps with
+type Backend func(options DockerClientOptions) (Client, error)
+
+// The builtin backends: docker runs every step in the containers of the daemon,
+// buildkit runs the RUN steps with BuildKit, see BuildKitClient, podman is docker
+// that talks to Podman even if the daemon does not tell it is Podman
+const (
+	BackendDocker   = "docker"
+	BackendBuildKit = "buildkit"
+	BackendPodman   = "podman"
+)
+
+var backends = map[string]Backend{
+	BackendDocker: func(options DockerClientOptions) (Client, error) {
+		return NewDockerClient(options), nil
+	},
+	BackendBuildKit: func(options DockerClientOptions) (Client, error) {
+		c, err := NewBuildKitClient(options)
+		if err != nil {
+			return nil, err
+		}
+		return c, nil
+	},
+	BackendPodman: func(options DockerClientOptions) (Client, error) {
+		return NewPodmanClient(options), nil
+	},
+}
+
+// RegisterBackend makes the backend available to NewClient under the name,
+// replacing the one that is registered under it already
+func RegisterBackend(name string, backend Backend) {
+	backends[name] = backend
+}
+
+// Backends returns the names of the known backends sorted
+func Backends() []string {
+	names := []string{}
+	for name := range backends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// NewClient makes the client of the named backend, the docker one if the name is empty.
+// Without options.Client it connects to options.Host with the TLS of the options
+func NewClient(backend string, options DockerClientOptions) (Client, error) {
+	if backend == "" {
+		backend = BackendDocker
+	}
+	newClient, ok := backends[backend]
+	if !ok {
+		return nil, fmt.Errorf("Unknown backend %q, the known ones are %s", backend, strings.Join(Backends(), ", "))
+	}
+
+	if options.Client == nil {
+		config := options.dockerConfig()
+		client, err := dockerclient.NewFromConfig(config)
+		if err != nil {
+			return nil, err
+		}
+		options.Client, options.Host = client, config.Host
+	}
+
+	return newClient(options)
+}
+
+// dockerConfig returns the connection the options give, the environment
+// gives the rest as it does to the docker CLI
+func (options DockerClientOptions) dockerConfig() *dockerclient.Config {
+	config := dockerclient.NewConfig()
+	if options.Host != "" {
+		config.Host = options.Host
+	}
+	if options.TLSVerify {
+		config.Tlsverify = true
+	}
+	if options.TLSCACert != "" {
+		config.Tlscacert = options.TLSCACert
+	}
+	if options.TLSCert != "" {
+		config.Tlscert = options.TLSCert
+	}
+	if options.TLSKey != "" {
+		config.Tlskey = options.TLSKey
+	}
+	return config
+}
@@ -17,14 +17,21 @@
 package build
 
 import (
+	"context"
 	"fmt"
 	"io"
+	"sort"
 	"strings"
+	"time"
 
+	"github.com/grammarly/rocker/src/dockerclient"
+	"github.com/grammarly/rocker/src/eol"
+	"github.com/grammarly/rocker/src/features"
 	"github.com/grammarly/rocker/src/imagename"
+	"github.com/grammarly/rocker/src/registrypolicy"
+	"github.com/grammarly/rocker/src/theme"
 
 	"github.com/docker/docker/pkg/units"
-	"github.com/fatih/color"
 
 	"github.com/fsouza/go-dockerclient"
 	"github.com/kr/pretty"
@@ -68,12 +75,61 @@ type Config struct {
 	CacheDir      string
 	LogJSON       bool
 	BuildArgs     map[string]string
+	Prefetch      bool
+	Labels        map[string]string
+	CacheFrom     []string
+	CacheTo       string
+	Contexts      map[string]string
+	PushRoutes    []PushRoute
+	PushAtomic    bool
+	BuildID       string
+	NoCacheFor    []NoCacheScope
+	Offline       bool
+	Features      features.Set
+	// SensitiveBuildArgs are kept out of the commits and the cache
+	SensitiveBuildArgs map[string]bool
+	// CheckpointFile is updated with the build progress after every command
+	CheckpointFile string
+	// ResumeFile is like CheckpointFile, it is removed when the build succeeds
+	ResumeFile string
+	// StepLogs captures the container output per step, it is shared with the client
+	StepLogs *StepLogs
+	// Deadline fails the build with ExitTimeout before a step that starts after it
+	Deadline time.Time
+	// ParallelStages runs the FROM sections that do not depend on each other in parallel
+	ParallelStages bool
+	// Platform is set when the build is one of the builds of `--daemon`; the images
+	// are pushed with the platform appended to the tag, to be merged into a manifest list
+	Platform dockerclient.Platform
+	// Reproducible normalizes the files COPY and ADD upload and the images the sections
+	// produce, so the same sources give the same layers; the times are pinned to SourceDateEpoch
+	Reproducible    bool
+	SourceDateEpoch time.Time
+	// EOL warns about the FROM images that are out of support or deprecated
+	EOL *eol.Checker
+	// DebugOnError opens a shell in what a failed RUN left before the build fails
+	DebugOnError bool
+	// RegistryPolicy restricts the registries and the namespaces of FROM and PUSH
+	RegistryPolicy *registrypolicy.Policy
+	// Annotations go to the manifests that rocker writes itself: the artifacts,
+	// the manifest lists and the images of the OCI layout
+	Annotations map[string]string
+}
+
+// BuiltStep describes the image that the build reached after a step
+type BuiltStep struct {
+	Step    string
+	ImageID string
 }
 
 // Build is the main object that processes build
 type Build struct {
 	ProducedSize int64
 	VirtualSize  int64
+	CacheHits    int
+	CacheMisses  int
+	Steps        []BuiltStep
+	Pushed       []imagename.Artifact
 
 	rockerfile *Rockerfile
 	cache      Cache
@@ -81,6 +137,10 @@ type Build struct {
 	client     Client
 	state      State
 
+	// log is the standard logger, or the one that prefixes the lines of a stage
+	// when the stages run in parallel
+	log *log.Logger
+
 	// A little hack to support cross-FROM cache for EXPORTS
 	// maybe rethink it later
 	exports []string
@@ -88,9 +148,55 @@ type Build struct {
 	currentExportContainerName string
 	prevExportContainerID      string
 
-	urlFetcher URLFetcher
+	urlFetcher    URLFetcher
+	prefetch      *prefetcher
+	fileHashes    *fileHashCache
+	fromImages    *fromImages
+	registryCache *registryCache
 
 	allowedBuildArgs map[string]bool
+
+	// noCacheStep disables the cache for the command that is being executed
+	noCacheStep bool
+
+	// events are sent to the subscribers, step is the step they are about
+	events *eventBus
+	step   stepInfo
+
+	// dryRun records what the commands would do, see DryRun
+	dryRun *dryRun
+
+	// progress is the step the last checkpoint continues from
+	progress int32
+
+	// planOffset is where the plan a fork runs starts in the whole plan
+	planOffset int
+
+	// Where the build is, for the --no-cache-for scopes
+	position buildPosition
+
+	// Named contexts declared with CONTEXT, used unless given from the command line
+	contextDefaults map[string]string
+
+	// States of the finished stages named with FROM image AS name, and the name
+	// of the current one, for COPY --from and FROM of a stage
+	stages map[string]State
+	stage  string
+
+	// fromImageID is the FROM image of the current section, SQUASH keeps its layers
+	fromImageID string
+
+	// The FROM image of the current section that is not pulled yet, and whether
+	// pulling it found a newer one, so the section has to start over
+	lazyFrom    *lazyFrom
+	fromChanged bool
+
+	// Images tagged with TAG, name to image ID, for SaveImage
+	tagged map[string]string
+
+	// ONBUILD triggers merged into the plan, and the checkpoint the build continues from
+	injections []Injection
+	restored   *Checkpoint
 }
 
 // New creates the new build object
@@ -100,8 +206,14 @@ func New(client Client, rockerfile *Rockerfile, cache Cache, cfg Config) *Build
 		cache:      cache,
 		cfg:        cfg,
 		client:     client,
+		log:        log.StandardLogger(),
+		events:     &eventBus{},
 		exports:    []string{},
 
+		contextDefaults: map[string]string{},
+		stages:          map[string]State{},
+		tagged:          map[string]string{},
+
 		// Build args allowed by Docker by default:
 		// https://docs.docker.com/engine/reference/builder/#/arg
 		allowedBuildArgs: map[string]bool{
@@ -117,9 +229,22 @@ func New(client Client, rockerfile *Rockerfile, cache Cache, cfg Config) *Build
 	}
 
 	b.urlFetcher = NewURLFetcherFS(cfg.CacheDir, cfg.NoCache, nil)
+	b.fileHashes = newFileHashCache(cfg.CacheDir)
+	b.fromImages = newFromImages(cfg.CacheDir)
+
+	if cache != nil && (len(cfg.CacheFrom) > 0 || cfg.CacheTo != "") {
+		b.registryCache = newRegistryCache(cache, client, cfg.CacheFrom, cfg.CacheTo)
+		b.cache = b.registryCache
+	}
 
 	b.state = NewState(b)
 
+	if c, ok := client.(interface {
+		onForceInterrupt(func())
+	}); ok {
+		c.onForceInterrupt(b.forceInterrupted)
+	}
+
 	if cfg.BuildArgs != nil {
 		b.state.NoCache.BuildArgs = cfg.BuildArgs
 	}
@@ -129,11 +254,125 @@ func New(client Client, rockerfile *Rockerfile, cache Cache, cfg Config) *Build
 
 // Run runs the build following the given Plan
 func (b *Build) Run(plan Plan) (err error) {
+	return b.RunContext(context.Background(), plan)
+}
+
+// RunContext runs the build following the given Plan until the context is done,
+// the deadline of the configuration passes or, if the client handles interrupts,
+// Ctrl+C is pressed; the pull, the push or the container the build waits for is
+// stopped then and the build cleans up as after any failed step
+func (b *Build) RunContext(ctx context.Context, plan Plan) (err error) {
+	if !b.cfg.Deadline.IsZero() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, b.cfg.Deadline)
+		defer cancel()
+	}
+	if c, ok := b.client.(interface {
+		interruptContext(context.Context) (context.Context, context.CancelFunc)
+	}); ok {
+		var cancel context.CancelFunc
+		ctx, cancel = c.interruptContext(ctx)
+		defer cancel()
+	}
+
+	started := time.Now()
+	b.emit(Event{Type: EventBuildStart})
+	defer func() { b.emitEnd(started, err) }()
+
+	if err = b.checkRegistryPolicy(plan); err != nil {
+		return err
+	}
+
+	if b.cfg.Offline {
+		if err = b.checkOffline(ctx, plan); err != nil {
+			return err
+		}
+	}
+
+	if err = b.checkCapabilities(plan); err != nil {
+		return err
+	}
+
+	if b.cfg.Prefetch && !b.cfg.Offline {
+		b.prefetchImages(ctx, plan)
+	}
+
+	if b.registryCache != nil && !b.cfg.Offline {
+		b.registryCache.Import(ctx)
+	}
+
+	for _, command := range plan {
+		if _, ok := command.(*CommandFrom); ok {
+			b.position.stages++
+		}
+	}
+
+	if stages := splitStages(plan); stages != nil && b.canRunParallel() {
+		err = b.runParallel(ctx, plan, stages)
+	} else {
+		err = b.runPlan(ctx, plan)
+	}
+	if err != nil {
+		return err
+	}
+
+	// check if there are any leftover build-args that were passed but not
+	// consumed during build. Return an error, if there are any.
+	leftoverArgs := []string{}
+	for arg := range b.cfg.BuildArgs {
+		if !b.allowedBuildArgs[arg] {
+			leftoverArgs = append(leftoverArgs, arg)
+		}
+	}
+	if len(leftoverArgs) > 0 {
+		return WithExitCode(ExitPolicy, fmt.Errorf("One or more build-args %v were not consumed, failing build.", leftoverArgs))
+	}
+
+	if b.registryCache != nil {
+		if err = b.registryCache.Export(ctx); err != nil {
+			return err
+		}
+	}
+
+	b.removeResumeFile()
+
+	return nil
+}
+
+// runPlan runs the commands of the plan one by one
+func (b *Build) runPlan(ctx context.Context, plan Plan) (err error) {
+	var section *sectionStart
 
 	for k := 0; k < len(plan); k++ {
 		command := plan[k]
+		position := b.position
+
+		switch command.(type) {
+		case *CommandCommit, *CommandCleanup:
+		case *CommandFrom:
+			b.position.stage++
+			b.position.step++
+		default:
+			b.position.step++
+		}
 
-		log.Debugf("Step %d: %# v", k+1, pretty.Formatter(command))
+		// Commands before the restored checkpoint are already done
+		if b.restored != nil && k < b.restored.Next {
+			for _, injection := range b.injections {
+				if injection.After == k {
+					if plan, err = injectCommands(plan, k, injection.Commands); err != nil {
+						return WithExitCode(ExitUser, err)
+					}
+				}
+			}
+			continue
+		}
+
+		b.log.Debugf("Step %d: %# v", b.planOffset+k+1, pretty.Formatter(command))
+
+		if err = b.checkCancelled(ctx, b.planOffset+k+1, command); err != nil {
+			return err
+		}
 
 		var doRun bool
 		if doRun, err = command.ShouldRun(b); err != nil {
@@ -145,50 +384,122 @@ func (b *Build) Run(plan Plan) (err error) {
 
 		// Replace env for the command if appropriate
 		if command, ok := command.(EnvReplacableCommand); ok {
-			command.ReplaceEnv(b.state.Config.Env)
+			command.ReplaceEnv(b.replaceEnv())
 		}
 
-		log.Infof("%s", color.New(color.FgWhite, color.Bold).SprintFunc()(command))
+		b.log.Infof("%s", theme.Current.Step.Sprint(command))
+
+		// Commits describe what is committed better than "Commit changes"
+		step := b.state.GetCommits()
+		if step == "" {
+			step = command.String()
+		}
+		prevImageID := b.state.ImageID
 
-		if b.state, err = command.Execute(b); err != nil {
+		b.cfg.StepLogs.Begin(k+1, command.String())
+
+		b.step = stepInfo{b.planOffset + k + 1, command.String(), time.Now(), prevImageID}
+		b.emitStep(EventStepStart, "", nil)
+
+		nc, ok := command.(noCacheCommand)
+		b.noCacheStep = ok && nc.noCache()
+
+		b.dryRun.begin(b.planOffset+k+1, command, b.state)
+
+		if _, ok := command.(*CommandFrom); ok {
+			section = b.markSection(k, plan, position)
+		}
+
+		// The FROM image that was not pulled is needed now, unless the
+		// command can take the step from the cache
+		if needsFromImage(command) {
+			err = b.pullLazyFrom(ctx, b.state.ImageID)
+		}
+		if err == nil {
+			b.state, err = command.Execute(ctx, b)
+		}
+
+		logLocation, logErr := b.cfg.StepLogs.End()
+		if err != nil && b.fromChanged && section != nil {
+			plan, k = section.restore(b)
+			k--
+			continue
+		}
+		if err != nil {
+			b.emitStep(EventStepFailed, "", err)
+			if logLocation != "" {
+				b.log.Infof("| Full output of the failed step is in %s", logLocation)
+			}
 			return err
 		}
+		if logErr != nil {
+			b.emitStep(EventStepFailed, "", logErr)
+			return logErr
+		}
 
-		log.Debugf("State after step %d: %# v", k+1, pretty.Formatter(b.state))
+		b.emitStep(EventStepDone, b.state.ImageID, nil)
+		b.dryRun.end(command, b.state)
+
+		if b.state.ImageID != "" && b.state.ImageID != prevImageID {
+			b.Steps = append(b.Steps, BuiltStep{step, b.state.ImageID})
+		}
+
+		b.log.Debugf("State after step %d: %# v", b.planOffset+k+1, pretty.Formatter(b.state))
 
 		// Here we need to inject ONBUILD commands on the fly,
 		// build sub plan and merge it with the main plan.
 		// Not very beautiful, because Run uses Plan as the argument
 		// and then it builds its own. But.
 		if len(b.state.InjectCommands) > 0 {
-			commands, err := parseOnbuildCommands(b.state.InjectCommands)
-			if err != nil {
-				return err
-			}
-			subPlan, err := NewPlan(commands, false)
-			if err != nil {
-				return err
+			if plan, err = injectCommands(plan, k, b.state.InjectCommands); err != nil {
+				return WithExitCode(ExitUser, err)
 			}
-			tail := append(subPlan, plan[k+1:]...)
-			plan = append(plan[:k+1], tail...)
+			b.injections = append(b.injections, Injection{k, b.state.InjectCommands})
 
 			b.state.InjectCommands = []string{}
 		}
+
+		if err = b.checkpoint(k + 1); err != nil {
+			return err
+		}
 	}
 
-	// check if there are any leftover build-args that were passed but not
-	// consumed during build. Return an error, if there are any.
-	leftoverArgs := []string{}
-	for arg := range b.cfg.BuildArgs {
-		if !b.allowedBuildArgs[arg] {
-			leftoverArgs = append(leftoverArgs, arg)
+	return nil
+}
+
+// replaceEnv returns the variables available for substitution in the commands:
+// the ARGs declared so far followed by the config ENV, which takes precedence
+// over an ARG of the same name, like in Docker. Sensitive build args are not
+// substituted, since the commits would reveal them
+func (b *Build) replaceEnv() []string {
+	names := []string{}
+	for name := range b.state.NoCache.BuildArgs {
+		if b.allowedBuildArgs[name] && !b.cfg.SensitiveBuildArgs[name] {
+			names = append(names, name)
 		}
 	}
-	if len(leftoverArgs) > 0 {
-		return fmt.Errorf("One or more build-args %v were not consumed, failing build.", leftoverArgs)
+	sort.Strings(names)
+
+	env := []string{}
+	for _, name := range names {
+		env = append(env, fmt.Sprintf("%s=%s", name, b.state.NoCache.BuildArgs[name]))
 	}
 
-	return nil
+	return append(env, b.state.Config.Env...)
+}
+
+// injectCommands merges the ONBUILD triggers into the plan after the k-th command
+func injectCommands(plan Plan, k int, triggers []string) (Plan, error) {
+	commands, err := parseOnbuildCommands(triggers)
+	if err != nil {
+		return nil, err
+	}
+	subPlan, err := NewPlan(commands, false)
+	if err != nil {
+		return nil, err
+	}
+	tail := append(subPlan, plan[k+1:]...)
+	return append(plan[:k+1], tail...), nil
 }
 
 // GetState returns current build state object
@@ -201,34 +512,79 @@ func (b *Build) GetImageID() string {
 	return b.state.ImageID
 }
 
-func (b *Build) probeCache(s State) (cachedState State, hit bool, err error) {
-	cachedState, hit, err = b.probeCacheAndPreserveCommits(s)
+// SaveImage writes the resulting image to w as a tar archive in the format of
+// `docker save`. The names the image was tagged with by TAG and PUSH are saved too,
+// so `docker load` on the other side restores them
+func (b *Build) SaveImage(w io.Writer) error {
+	if b.state.ImageID == "" {
+		return fmt.Errorf("There is no image to save")
+	}
+
+	names := []string{}
+	for name, imageID := range b.tagged {
+		if imageID == b.state.ImageID {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	if len(names) == 0 {
+		names = []string{b.state.ImageID}
+	}
+
+	return b.client.SaveImages(names, w)
+}
+
+func (b *Build) probeCache(ctx context.Context, s State) (cachedState State, hit bool, err error) {
+	cachedState, hit, err = b.probeCacheAndPreserveCommits(ctx, s)
 	if hit && err == nil {
 		cachedState.CleanCommits()
 	}
 	return
 }
 
-func (b *Build) probeCacheAndPreserveCommits(s State) (cachedState State, hit bool, err error) {
+func (b *Build) probeCacheAndPreserveCommits(ctx context.Context, s State) (cachedState State, hit bool, err error) {
+	// A miss needs a container, so the FROM image cannot wait any longer
+	defer func() {
+		if !hit && err == nil {
+			err = b.pullLazyFrom(ctx, s.ImageID)
+		}
+	}()
 
 	if b.cache == nil || s.NoCache.CacheBusted {
 		return s, false, nil
 	}
 
+	if b.noCacheStep {
+		s.NoCache.CacheBusted = true
+		b.CacheMisses++
+		b.log.Info(theme.Current.NotCached.Sprint("| Not cached, NOCACHE"))
+		return s, false, nil
+	}
+
+	if scope, ok := b.noCacheScope(s.Commits); ok {
+		s.NoCache.CacheBusted = true
+		b.CacheMisses++
+		b.log.Info(theme.Current.NotCached.Sprint("| Not cached, --no-cache-for " + scope.String()))
+		return s, false, nil
+	}
+
 	var s2 *State
 	if s2, err = b.cache.Get(s); err != nil {
 		return s, false, err
 	}
 	if s2 == nil {
 		s.NoCache.CacheBusted = true
-		log.Info(color.New(color.FgYellow).SprintFunc()("| Not cached"))
+		b.CacheMisses++
+		b.log.Info(theme.Current.NotCached.Sprint("| Not cached"))
 		return s, false, nil
 	}
 
 	if b.cfg.ReloadCache {
 		defer b.cache.Del(*s2)
 		s.NoCache.CacheBusted = true
-		log.Info(color.New(color.FgYellow).SprintFunc()("| Reload cache"))
+		b.CacheMisses++
+		b.log.Info(theme.Current.NotCached.Sprint("| Reload cache"))
 		return s, false, nil
 	}
 
@@ -239,7 +595,8 @@ func (b *Build) probeCacheAndPreserveCommits(s State) (cachedState State, hit bo
 	if img == nil {
 		defer b.cache.Del(*s2)
 		s.NoCache.CacheBusted = true
-		log.Info(color.New(color.FgYellow).SprintFunc()("| Not cached"))
+		b.CacheMisses++
+		b.log.Info(theme.Current.NotCached.Sprint("| Not cached"))
 		return s, false, nil
 	}
 
@@ -263,12 +620,15 @@ func (b *Build) probeCacheAndPreserveCommits(s State) (cachedState State, hit bo
 		fields["delta"] = s2.Size - s2.ParentSize
 	}
 
-	log.WithFields(fields).Infof(
-		color.New(color.FgGreen).SprintfFunc()("| Cached! Take image %.12s", s2.ImageID))
+	b.log.WithFields(fields).Infof(
+		theme.Current.Cached.Sprintf("| Cached! Take image %.12s", s2.ImageID))
+	b.dryRun.cached(s2.ImageID)
+	b.emitStep(EventStepCached, s2.ImageID, nil)
 
 	// Store some stuff to the build
 	b.ProducedSize += s2.Size - s2.ParentSize
 	b.VirtualSize = s2.Size
+	b.CacheHits++
 
 	// Keep items that should not be cached from the previous state
 	s2.NoCache = s.NoCache
@@ -276,7 +636,7 @@ func (b *Build) probeCacheAndPreserveCommits(s State) (cachedState State, hit bo
 	return *s2, true, nil
 }
 
-func (b *Build) getVolumeContainer(path string) (c *docker.Container, err error) {
+func (b *Build) getVolumeContainer(ctx context.Context, path string) (c *docker.Container, err error) {
 
 	name := b.mountsContainerName(path)
 
@@ -287,18 +647,18 @@ func (b *Build) getVolumeContainer(path string) (c *docker.Container, err error)
 		},
 	}
 
-	log.Debugf("Make MOUNT volume container %s with options %# v", name, config)
+	b.log.Debugf("Make MOUNT volume container %s with options %# v", name, config)
 
-	if _, err = b.client.EnsureContainer(name, config, nil, path); err != nil {
+	if _, err = b.client.EnsureContainer(ctx, name, config, nil, path); err != nil {
 		return nil, err
 	}
 
-	log.Infof("| Using container %s for %s", name, path)
+	b.log.Infof("| Using container %s for %s", name, path)
 
 	return b.client.InspectContainer(name)
 }
 
-func (b *Build) getExportsContainerWithBinds(name string, binds []string) (c *docker.Container, err error) {
+func (b *Build) getExportsContainerWithBinds(ctx context.Context, name string, binds []string) (c *docker.Container, err error) {
 
 	config := &docker.Config{
 		Image: RsyncImage,
@@ -318,46 +678,69 @@ func (b *Build) getExportsContainerWithBinds(name string, binds []string) (c *do
 		}
 	}
 
-	log.Debugf("Make EXPORT container %s with options %# v", name, config)
+	b.log.Debugf("Make EXPORT container %s with options %# v", name, config)
 
-	containerID, err := b.client.EnsureContainer(name, config, hostConfig, "exports")
+	containerID, err := b.client.EnsureContainer(ctx, name, config, hostConfig, "exports")
 	if err != nil {
 		return nil, err
 	}
 
-	log.Infof("| Using exports container %s", name)
+	b.log.Infof("| Using exports container %s", name)
 
 	return b.client.InspectContainer(containerID)
 }
 
-func (b *Build) getExportsContainerAndSync(currentName, previousName string) (c *docker.Container, err error) {
+func (b *Build) getExportsContainerAndSync(ctx context.Context, currentName, previousName string) (c *docker.Container, err error) {
 	//If it the first `EXPORT` in the file
 	//we don't need to sync data from previous container
 	if previousName == "" {
-		return b.getExportsContainer(currentName)
+		return b.getExportsContainer(ctx, currentName)
 	}
 
-	prevContainer, err := b.getExportsContainer(previousName)
+	prevContainer, err := b.getExportsContainer(ctx, previousName)
 	if err != nil {
 		return nil, err
 	}
 
 	binds := mountsToBinds(prevContainer.Mounts, "_source")
 
-	currContainer, err := b.getExportsContainerWithBinds(currentName, binds)
+	currContainer, err := b.getExportsContainerWithBinds(ctx, currentName, binds)
 	if err != nil {
 		return nil, err
 	}
 
-	log.Infof("| Running in %s: %s", currentName, strings.Join(currContainer.Config.Cmd, " "))
-	if err = b.client.RunContainer(currContainer.ID, false); err != nil {
+	b.log.Infof("| Running in %s: %s", currentName, strings.Join(currContainer.Config.Cmd, " "))
+	if err = b.client.RunContainer(ctx, currContainer.ID, false); err != nil {
 		return nil, err
 	}
 	return currContainer, nil
 }
 
-func (b *Build) getExportsContainer(name string) (c *docker.Container, err error) {
-	return b.getExportsContainerWithBinds(name, []string{})
+func (b *Build) getExportsContainer(ctx context.Context, name string) (c *docker.Container, err error) {
+	return b.getExportsContainerWithBinds(ctx, name, []string{})
+}
+
+// checkEOL warns if the FROM image is out of support, about to be, or deprecated
+func (b *Build) checkEOL(name string) {
+	if b.cfg.EOL == nil {
+		return
+	}
+	w := b.cfg.EOL.Check(name)
+	if w == nil {
+		return
+	}
+
+	fields := log.Fields{}
+	if b.cfg.LogJSON {
+		fields["image"] = w.Image
+		fields["status"] = w.Status
+		fields["eol"] = w.EOL
+		fields["days_left"] = w.DaysLeft
+		fields["replacement"] = w.Replacement
+	}
+	b.log.WithFields(fields).Warnf("| %s", w)
+
+	b.emit(Event{Type: EventBaseEOL, EOL: w})
 }
 
 // lookupImage looks up for the image by name and returns *docker.Image object (result of the inspect)
@@ -377,21 +760,26 @@ func (b *Build) getExportsContainer(name string) (c *docker.Container, err error
 // In case the given image has sha256 tag, it looks for it locally and pulls if it's not found.
 // No semver matching is done for sha256 tagged images.
 //
+// In `Offline` mode the remote registry is never checked and `Pull` is ignored.
+//
 // See also TestBuild_LookupImage_* test cases in build_test.go
-func (b *Build) lookupImage(name string) (img *docker.Image, err error) {
+func (b *Build) lookupImage(ctx context.Context, name string) (img *docker.Image, err error) {
 	var (
 		candidate, remoteCandidate *imagename.ImageName
 
 		imgName = imagename.NewFromString(name)
 		pull    = false
-		hub     = b.cfg.Pull
+		hub     = b.cfg.Pull && !b.cfg.Offline
 		isSha   = imgName.TagIsSha()
 	)
 
+	// Wait for the image if it is being pulled in the background
+	b.waitPrefetch(imgName.String())
+
 	// If hub is true, then there is no sense to inspect the local image
 	if !hub || isSha {
 		if isOld, warning := imagename.WarnIfOldS3ImageName(name); isOld {
-			log.Warn(warning)
+			b.log.Warn(warning)
 		}
 		// Try to inspect image as is, without version resolution
 		if img, err := b.client.InspectImage(imgName.String()); err != nil || img != nil {
@@ -399,6 +787,10 @@ func (b *Build) lookupImage(name string) (img *docker.Image, err error) {
 		}
 	}
 
+	if b.cfg.Offline && isSha {
+		return nil, fmt.Errorf("Image not found locally: %s (offline mode, the remote registry is not checked)", imgName)
+	}
+
 	if isSha {
 		// If we are still here and image not found locally, we want to pull it
 		candidate = imgName
@@ -418,8 +810,12 @@ func (b *Build) lookupImage(name string) (img *docker.Image, err error) {
 
 	// In case we want to include external images as well, pulling list of available
 	// images from the remote registry
+	if b.cfg.Offline && candidate == nil {
+		return nil, fmt.Errorf("Image not found locally: %s (offline mode, the remote registry is not checked)", imgName)
+	}
+
 	if hub || candidate == nil {
-		log.Debugf("Getting list of tags for %s from the registry", imgName)
+		b.log.Debugf("Getting list of tags for %s from the registry", imgName)
 
 		var remoteImages []*imagename.ImageName
 
@@ -446,14 +842,14 @@ func (b *Build) lookupImage(name string) (img *docker.Image, err error) {
 
 	if !isSha && imgName.GetTag() != candidate.GetTag() {
 		if remoteCandidate != nil {
-			log.Infof("Resolve %s --> %s (found remotely)", imgName, candidate.GetTag())
+			b.log.Infof("Resolve %s --> %s (found remotely)", imgName, candidate.GetTag())
 		} else {
-			log.Infof("Resolve %s --> %s", imgName, candidate.GetTag())
+			b.log.Infof("Resolve %s --> %s", imgName, candidate.GetTag())
 		}
 	}
 
 	if pull {
-		if err = b.client.PullImage(candidate.String()); err != nil {
+		if err = b.client.PullImage(ctx, candidate.String()); err != nil {
 			return
 		}
 	}
@@ -74,7 +74,7 @@ func runBuildInteg(t *testing.T, rockerfileContent string, cfg Config) (*Build,
 	pc, _, _, _ := runtime.Caller(1)
 	fn := runtime.FuncForPC(pc)
 
-	r, err := NewRockerfile(fn.Name(), strings.NewReader(rockerfileContent), template.Vars{}, template.Funs{})
+	r, err := NewRockerfile(fn.Name(), strings.NewReader(rockerfileContent), template.Vars{}, template.Funs{}, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
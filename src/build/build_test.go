@@ -17,12 +17,18 @@
 package build
 
 import (
+	"bytes"
+	"context"
+	"github.com/grammarly/rocker/src/dockerclient"
 	"github.com/grammarly/rocker/src/imagename"
+	"github.com/grammarly/rocker/src/spill"
 	"github.com/grammarly/rocker/src/template"
 	"io"
+	"os"
 	"runtime"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/fsouza/go-dockerclient"
 	"github.com/stretchr/testify/assert"
@@ -66,6 +72,143 @@ func TestBuild_ReplaceEnvVars(t *testing.T) {
 	c.AssertExpectations(t)
 }
 
+func TestBuild_ReplaceBuildArgs(t *testing.T) {
+	rockerfile := "FROM ubuntu\nARG VERSION=1.0\nARG HOME=/root\nENV APP=/app/$VERSION HOME=$HOME/app"
+
+	tests := []struct {
+		buildArgs map[string]string
+		expected  []string
+	}{
+		{nil, []string{"HOME=/home/app", "APP=/app/1.0"}},
+		{map[string]string{"VERSION": "2.0"}, []string{"HOME=/home/app", "APP=/app/2.0"}},
+	}
+
+	for _, tt := range tests {
+		b, c := makeBuild(t, rockerfile, Config{BuildArgs: tt.buildArgs})
+		plan := makePlan(t, rockerfile)
+
+		img := &docker.Image{
+			ID: "123",
+			Config: &docker.Config{
+				Env: []string{"HOME=/home"},
+			},
+		}
+
+		c.On("InspectImage", "ubuntu:latest").Return(img, nil).Once()
+
+		c.On("CreateContainer", mock.AnythingOfType("State")).Return("456", nil).Run(func(args mock.Arguments) {
+			arg := args.Get(0).(State)
+			assert.Equal(t, tt.expected, arg.Config.Env)
+		}).Once()
+
+		c.On("CommitContainer", mock.AnythingOfType("State")).Return(&docker.Image{ID: "789"}, nil).Once()
+
+		c.On("RemoveContainer", "456").Return(nil).Once()
+
+		if err := b.Run(plan); err != nil {
+			t.Fatal(err)
+		}
+
+		c.AssertExpectations(t)
+	}
+}
+
+func TestBuild_OnbuildTriggers(t *testing.T) {
+	rockerfile := "FROM base\nONBUILD RUN make test\nCMD [\"app\"]"
+	b, c := makeBuild(t, rockerfile, Config{})
+	plan := makePlan(t, rockerfile)
+
+	img := &docker.Image{
+		ID: "123",
+		Config: &docker.Config{
+			OnBuild: []string{"RUN make install"},
+		},
+	}
+
+	c.On("InspectImage", "base:latest").Return(img, nil).Once()
+
+	// The trigger of the base image runs right after FROM
+	c.On("CreateContainer", mock.AnythingOfType("State")).Return("456", nil).Run(func(args mock.Arguments) {
+		arg := args.Get(0).(State)
+		assert.Equal(t, []string{"/bin/sh", "-c", "make install"}, []string(arg.Config.Cmd))
+		assert.Empty(t, arg.Config.OnBuild)
+	}).Once()
+	c.On("RunContainer", "456", false).Return(nil).Once()
+	c.On("CommitContainer", mock.AnythingOfType("State")).Return(&docker.Image{ID: "789"}, nil).Once()
+	c.On("RemoveContainer", "456").Return(nil).Once()
+
+	// ONBUILD of the Rockerfile is committed to the config for the images built from it
+	c.On("CreateContainer", mock.AnythingOfType("State")).Return("654", nil).Once()
+	c.On("CommitContainer", mock.AnythingOfType("State")).Return(&docker.Image{ID: "987"}, nil).Run(func(args mock.Arguments) {
+		arg := args.Get(0).(State)
+		assert.Equal(t, []string{"RUN make test"}, arg.Config.OnBuild)
+		assert.Equal(t, "789", arg.ImageID)
+	}).Once()
+	c.On("RemoveContainer", "654").Return(nil).Once()
+
+	if err := b.Run(plan); err != nil {
+		t.Fatal(err)
+	}
+
+	c.AssertExpectations(t)
+	assert.Equal(t, "987", b.GetImageID())
+}
+
+func TestBuild_Steps(t *testing.T) {
+	rockerfile := "FROM ubuntu\nENV foo=bar\nTAG app"
+	b, c := makeBuild(t, rockerfile, Config{})
+	plan := makePlan(t, rockerfile)
+
+	c.On("InspectImage", "ubuntu:latest").Return(&docker.Image{ID: "123"}, nil).Once()
+	c.On("CreateContainer", mock.AnythingOfType("State")).Return("456", nil).Once()
+	c.On("CommitContainer", mock.AnythingOfType("State")).Return(&docker.Image{ID: "789"}, nil).Once()
+	c.On("RemoveContainer", "456").Return(nil).Once()
+	c.On("TagImage", "789", "app").Return(nil).Once()
+
+	if err := b.Run(plan); err != nil {
+		t.Fatal(err)
+	}
+
+	c.AssertExpectations(t)
+	assert.Equal(t, []BuiltStep{
+		{"FROM ubuntu", "123"},
+		{"ENV foo=bar", "789"},
+	}, b.Steps)
+}
+
+func TestBuild_SaveImage(t *testing.T) {
+	b, c := makeBuild(t, "", Config{})
+	b.state.ImageID = "789"
+	b.tagged["app:latest"] = "789"
+	b.tagged["app:1.0"] = "789"
+	b.tagged["base:latest"] = "123"
+
+	out := &bytes.Buffer{}
+	c.On("SaveImages", []string{"app:1.0", "app:latest"}, out).Return(nil).Once()
+
+	if err := b.SaveImage(out); err != nil {
+		t.Fatal(err)
+	}
+
+	c.AssertExpectations(t)
+}
+
+func TestBuild_SaveImage_Untagged(t *testing.T) {
+	b, c := makeBuild(t, "", Config{})
+
+	assert.EqualError(t, b.SaveImage(&bytes.Buffer{}), "There is no image to save")
+
+	b.state.ImageID = "789"
+	out := &bytes.Buffer{}
+	c.On("SaveImages", []string{"789"}, out).Return(nil).Once()
+
+	if err := b.SaveImage(out); err != nil {
+		t.Fatal(err)
+	}
+
+	c.AssertExpectations(t)
+}
+
 func TestBuild_LookupImage_ExactExistLocally(t *testing.T) {
 	var (
 		b, c        = makeBuild(t, "", Config{})
@@ -75,7 +218,7 @@ func TestBuild_LookupImage_ExactExistLocally(t *testing.T) {
 
 	c.On("InspectImage", name).Return(resultImage, nil).Once()
 
-	result, err := b.lookupImage(name)
+	result, err := b.lookupImage(context.Background(), name)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -105,7 +248,7 @@ func TestBuild_LookupImage_ExistLocally(t *testing.T) {
 	c.On("ListImages").Return(localImages, nil).Once()
 	c.On("InspectImage", name).Return(resultImage, nil).Once()
 
-	result, err := b.lookupImage(name)
+	result, err := b.lookupImage(context.Background(), name)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -139,7 +282,7 @@ func TestBuild_LookupImage_NotExistLocally(t *testing.T) {
 	c.On("PullImage", name).Return(nil).Once()
 	c.On("InspectImage", name).Return(resultImage, nil).Once()
 
-	result, err := b.lookupImage(name)
+	result, err := b.lookupImage(context.Background(), name)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -167,7 +310,7 @@ func TestBuild_LookupImage_PullAndExist(t *testing.T) {
 	c.On("PullImage", name).Return(nil).Once()
 	c.On("InspectImage", name).Return(resultImage, nil).Once()
 
-	result, err := b.lookupImage(name)
+	result, err := b.lookupImage(context.Background(), name)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -191,7 +334,7 @@ func TestBuild_LookupImage_PullAndNotExist(t *testing.T) {
 
 	c.On("ListImageTags", name).Return(remoteImages, nil).Once()
 
-	_, err := b.lookupImage(name)
+	_, err := b.lookupImage(context.Background(), name)
 	assert.EqualError(t, err, "Image not found: ubuntu:latest (also checked in the remote registry)")
 	c.AssertExpectations(t)
 }
@@ -208,7 +351,7 @@ func TestBuild_LookupImage_ShaExistLocally(t *testing.T) {
 
 		c.On("InspectImage", name).Return(resultImage, nil).Once()
 
-		result, err := b.lookupImage(name)
+		result, err := b.lookupImage(context.Background(), name)
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -234,7 +377,7 @@ func TestBuild_LookupImage_ShaNotExistLocally(t *testing.T) {
 		c.On("PullImage", name).Return(nil).Once()
 		c.On("InspectImage", name).Return(resultImage, nil).Once()
 
-		result, err := b.lookupImage(name)
+		result, err := b.lookupImage(context.Background(), name)
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -244,13 +387,84 @@ func TestBuild_LookupImage_ShaNotExistLocally(t *testing.T) {
 	}
 }
 
+func TestBuild_PrefetchImages(t *testing.T) {
+	rockerfile := `FROM ubuntu:14.04
+RUN make
+TAG myapp:build
+FROM golang:1.5.*
+FROM myapp:build
+FROM alpine:3.2
+FROM scratch`
+
+	b, c := makeBuild(t, rockerfile, Config{})
+	plan := makePlan(t, rockerfile)
+
+	c.On("PrefetchImage", "ubuntu:14.04").Return(nil).Once()
+	c.On("PrefetchImage", "alpine:3.2").Return(nil).Once()
+
+	b.prefetchImages(context.Background(), plan)
+
+	assert.Len(t, b.prefetch.pending, 2)
+
+	b.waitPrefetch("ubuntu:14.04")
+	b.waitPrefetch("alpine:3.2")
+
+	assert.Len(t, b.prefetch.pending, 0)
+	c.AssertExpectations(t)
+}
+
+func TestBuild_LookupImage_Offline(t *testing.T) {
+	var (
+		nilImage *docker.Image
+
+		b, c = makeBuild(t, "", Config{Offline: true, Pull: true})
+		name = "ubuntu:latest"
+	)
+
+	c.On("InspectImage", name).Return(nilImage, nil).Once()
+	c.On("ListImages").Return([]*imagename.ImageName{}, nil).Once()
+
+	_, err := b.lookupImage(context.Background(), name)
+	assert.Contains(t, err.Error(), "Image not found locally: ubuntu:latest")
+	c.AssertExpectations(t)
+}
+
+func TestBuild_OfflineReport(t *testing.T) {
+	rockerfile := `FROM ubuntu:14.04
+RUN make
+TAG myapp:build
+FROM myapp:build
+FROM alpine:3.2
+ADD https://example.com/tool.tgz /opt/
+FROM scratch`
+
+	var nilImage *docker.Image
+
+	cacheDir := makeTmpDir(t, map[string]string{})
+	defer os.RemoveAll(cacheDir)
+
+	b, c := makeBuild(t, rockerfile, Config{Offline: true, CacheDir: cacheDir})
+	plan := makePlan(t, rockerfile)
+
+	c.On("InspectImage", "ubuntu:14.04").Return(&docker.Image{ID: "123"}, nil).Once()
+	c.On("InspectImage", "alpine:3.2").Return(nilImage, nil).Once()
+	c.On("ListImages").Return([]*imagename.ImageName{}, nil).Once()
+
+	missing := b.offlineReport(context.Background(), plan)
+
+	assert.Len(t, missing, 2)
+	assert.Contains(t, missing[0], "FROM alpine:3.2")
+	assert.Equal(t, "ADD https://example.com/tool.tgz: not in the download cache", missing[1])
+	c.AssertExpectations(t)
+}
+
 // internal helpers
 
 func makeBuild(t *testing.T, rockerfileContent string, cfg Config) (*Build, *MockClient) {
 	pc, _, _, _ := runtime.Caller(1)
 	fn := runtime.FuncForPC(pc)
 
-	r, err := NewRockerfile(fn.Name(), strings.NewReader(rockerfileContent), template.Vars{}, template.Funs{})
+	r, err := NewRockerfile(fn.Name(), strings.NewReader(rockerfileContent), template.Vars{}, template.Funs{}, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -274,7 +488,12 @@ func (m *MockClient) InspectImage(name string) (*docker.Image, error) {
 	return args.Get(0).(*docker.Image), args.Error(1)
 }
 
-func (m *MockClient) PullImage(name string) error {
+func (m *MockClient) PullImage(ctx context.Context, name string) error {
+	args := m.Called(name)
+	return args.Error(0)
+}
+
+func (m *MockClient) PrefetchImage(ctx context.Context, name string) error {
 	args := m.Called(name)
 	return args.Error(0)
 }
@@ -299,7 +518,22 @@ func (m *MockClient) TagImage(imageID, imageName string) error {
 	return args.Error(0)
 }
 
-func (m *MockClient) PushImage(imageName string) (string, error) {
+func (m *MockClient) SquashImage(imageID string, keepLayers int) (*docker.Image, error) {
+	args := m.Called(imageID, keepLayers)
+	return args.Get(0).(*docker.Image), args.Error(1)
+}
+
+func (m *MockClient) NormalizeImage(imageID string, keepLayers int, epoch time.Time) (*docker.Image, error) {
+	args := m.Called(imageID, keepLayers, epoch)
+	return args.Get(0).(*docker.Image), args.Error(1)
+}
+
+func (m *MockClient) SaveImages(names []string, out io.Writer) error {
+	args := m.Called(names, out)
+	return args.Error(0)
+}
+
+func (m *MockClient) PushImage(ctx context.Context, imageName string) (string, error) {
 	args := m.Called(imageName)
 	return args.String(0), args.Error(1)
 }
@@ -309,11 +543,16 @@ func (m *MockClient) CreateContainer(state State) (string, error) {
 	return args.String(0), args.Error(1)
 }
 
-func (m *MockClient) RunContainer(containerID string, attach bool) error {
+func (m *MockClient) RunContainer(ctx context.Context, containerID string, attach bool) error {
 	args := m.Called(containerID, attach)
 	return args.Error(0)
 }
 
+func (m *MockClient) RunContainerWithIO(ctx context.Context, containerID string, in io.Reader, out io.Writer) error {
+	args := m.Called(containerID, in, out)
+	return args.Error(0)
+}
+
 func (m *MockClient) CommitContainer(state *State) (*docker.Image, error) {
 	args := m.Called(*state)
 	return args.Get(0).(*docker.Image), args.Error(1)
@@ -329,17 +568,57 @@ func (m *MockClient) UploadToContainer(containerID string, stream io.Reader, pat
 	return args.Error(0)
 }
 
+func (m *MockClient) ImportContainer(containerID, imageName string, exclude []string) (*docker.Image, error) {
+	args := m.Called(containerID, imageName, exclude)
+	return args.Get(0).(*docker.Image), args.Error(1)
+}
+
+func (m *MockClient) ReadFileFromContainer(containerID, path string) (*spill.Buffer, error) {
+	args := m.Called(containerID, path)
+	return args.Get(0).(*spill.Buffer), args.Error(1)
+}
+
+func (m *MockClient) DownloadFromContainer(containerID, path string, out io.Writer) error {
+	args := m.Called(containerID, path, out)
+	return args.Error(0)
+}
+
+func (m *MockClient) PushArtifact(imageName string, artifact dockerclient.OCIArtifact) (digest string, err error) {
+	args := m.Called(imageName, artifact)
+	return args.String(0), args.Error(1)
+}
+
+func (m *MockClient) AttachArtifact(imageName string, artifact dockerclient.OCIArtifact) (digest string, err error) {
+	args := m.Called(imageName, artifact)
+	return args.String(0), args.Error(1)
+}
+
+func (m *MockClient) PullArtifact(imageName string) (artifact dockerclient.OCIArtifact, err error) {
+	args := m.Called(imageName)
+	return args.Get(0).(dockerclient.OCIArtifact), args.Error(1)
+}
+
+func (m *MockClient) PushManifestList(imageName string, entries []dockerclient.ManifestListEntry, annotations map[string]string) (digest string, err error) {
+	args := m.Called(imageName, entries, annotations)
+	return args.String(0), args.Error(1)
+}
+
+func (m *MockClient) UnpushImage(imageName, digest string) error {
+	args := m.Called(imageName, digest)
+	return args.Error(0)
+}
+
 func (m *MockClient) ResolveHostPath(path string) (resultPath string, err error) {
 	args := m.Called(path)
 	return args.String(0), args.Error(1)
 }
 
-func (m *MockClient) EnsureImage(imageName string) error {
+func (m *MockClient) EnsureImage(ctx context.Context, imageName string) error {
 	args := m.Called(imageName)
 	return args.Error(0)
 }
 
-func (m *MockClient) EnsureContainer(containerName string, config *docker.Config, hostConfig *docker.HostConfig, purpose string) (containerID string, err error) {
+func (m *MockClient) EnsureContainer(ctx context.Context, containerName string, config *docker.Config, hostConfig *docker.HostConfig, purpose string) (containerID string, err error) {
 	args := m.Called(containerName, config, hostConfig, purpose)
 	return args.String(0), args.Error(1)
 }
@@ -0,0 +1,408 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/grammarly/rocker/src/spill"
+	"github.com/grammarly/rocker/src/textformatter"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/fsouza/go-dockerclient"
+)
+
+// BuildKitClient runs the RUN steps with BuildKit through `docker buildx build`,
+// so they benefit from its snapshotter and the steps of the parallel stages run
+// concurrently, and keeps everything else on the docker daemon: the images, the
+// cache, the commits and so the semantics of the Rockerfile stay the same.
+//
+// The container rocker creates for a step is a placeholder until the step needs
+// it: RUN builds a Dockerfile of the single command on top of the image of the
+// previous step, other uses of the container create it on the daemon, from the
+// result of RUN if there is one, and commit makes the image of the step from it
+// with the config of the state. The steps BuildKit cannot run the same way, such
+// as ATTACH or RUN with the volumes of MOUNT, EXPORT and IMPORT, run in the
+// containers of the daemon as with the docker backend
+type BuildKitClient struct {
+	*DockerClient
+
+	docker  string
+	builder string
+	host    string
+
+	// tls are the TLS flags of the docker CLI
+	tls []string
+
+	placeholders *buildkitPlaceholders
+
+	// run executes the docker CLI, it is replaced in tests
+	run func(ctx context.Context, args []string, env []string, stdout, stderr io.Writer) error
+}
+
+// buildkitContainer is the placeholder of a container of the step
+type buildkitContainer struct {
+	state State
+
+	// built is the temporary tag of the result of RUN
+	built   string
+	builtID string
+
+	// containerID is the container on the daemon, once the step needs it
+	containerID string
+}
+
+type buildkitPlaceholders struct {
+	mu         sync.Mutex
+	containers map[string]*buildkitContainer
+}
+
+// NewBuildKitClient makes the client of the buildkit backend, it needs the docker
+// CLI with the buildx plugin
+func NewBuildKitClient(options DockerClientOptions) (*BuildKitClient, error) {
+	docker, err := exec.LookPath("docker")
+	if err != nil {
+		return nil, fmt.Errorf("The buildkit backend needs the docker CLI with buildx, error: %s", err)
+	}
+
+	c := &BuildKitClient{
+		DockerClient: NewDockerClient(options),
+		docker:       docker,
+		builder:      options.BuildKitBuilder,
+		host:         options.Host,
+		placeholders: &buildkitPlaceholders{containers: map[string]*buildkitContainer{}},
+	}
+	c.run = c.runDocker
+
+	// The CLI connects to the daemon the same way as rocker does
+	if options.TLSVerify {
+		config := options.dockerConfig()
+		c.tls = []string{"--tlsverify", "--tlscacert", config.Tlscacert, "--tlscert", config.Tlscert, "--tlskey", config.Tlskey}
+	}
+
+	if err := c.run(context.Background(), []string{"buildx", "version"}, nil, ioutil.Discard, ioutil.Discard); err != nil {
+		return nil, fmt.Errorf("The buildkit backend needs the buildx plugin of the docker CLI, error: %s", err)
+	}
+
+	return c, nil
+}
+
+// runDocker runs the docker CLI against the daemon of the build
+func (c *BuildKitClient) runDocker(ctx context.Context, args []string, env []string, stdout, stderr io.Writer) error {
+	cmd := exec.CommandContext(ctx, c.docker, append(append([]string{}, c.tls...), args...)...)
+	cmd.Env = append(os.Environ(), env...)
+	if c.host != "" {
+		cmd.Env = append(cmd.Env, "DOCKER_HOST="+c.host)
+	}
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	return cmd.Run()
+}
+
+// buildkitUnsupported tells why BuildKit cannot run the container of the state
+// the way the daemon does, or returns an empty string if it can
+func buildkitUnsupported(s State) string {
+	switch {
+	case s.Config.Tty || s.Config.OpenStdin:
+		return "a TTY"
+	case len(s.NoCache.HostConfig.Binds) > 0:
+		return "volumes"
+	}
+	return ""
+}
+
+// buildkitDockerfile returns the Dockerfile of the RUN of the state on top of the base image
+func buildkitDockerfile(base string, s State) (string, error) {
+	lines := []string{"FROM " + base}
+
+	for _, env := range s.Config.Env {
+		parts := strings.SplitN(env, "=", 2)
+		if len(parts) < 2 {
+			parts = append(parts, "")
+		}
+		lines = append(lines, fmt.Sprintf("ENV %s=%s", parts[0], strconv.Quote(parts[1])))
+	}
+	if s.Config.WorkingDir != "" {
+		lines = append(lines, "WORKDIR "+s.Config.WorkingDir)
+	}
+	if s.Config.User != "" {
+		lines = append(lines, "USER "+s.Config.User)
+	}
+
+	cmd, err := json.Marshal(append(append([]string{}, s.Config.Entrypoint...), s.Config.Cmd...))
+	if err != nil {
+		return "", err
+	}
+	lines = append(lines, "RUN "+string(cmd))
+
+	return strings.Join(lines, "\n") + "\n", nil
+}
+
+// CreateContainer implements Client, it makes the placeholder of the container
+func (c *BuildKitClient) CreateContainer(s State) (string, error) {
+	if reason := buildkitUnsupported(s); reason != "" {
+		c.log.Debugf("BuildKit cannot run a container with %s, create it on the daemon", reason)
+		return c.DockerClient.CreateContainer(s)
+	}
+
+	n := atomic.AddInt32(c.containers, 1)
+	id := fmt.Sprintf("%x", sha256.Sum256([]byte(fmt.Sprintf("%s-%d-%d", c.buildID, n, time.Now().UnixNano()))))
+
+	c.placeholders.mu.Lock()
+	c.placeholders.containers[id] = &buildkitContainer{state: s}
+	c.placeholders.mu.Unlock()
+
+	return id, nil
+}
+
+func (c *BuildKitClient) placeholder(id string) *buildkitContainer {
+	c.placeholders.mu.Lock()
+	defer c.placeholders.mu.Unlock()
+	return c.placeholders.containers[id]
+}
+
+// container returns the container of the daemon for the id, it creates the
+// container of the placeholder from the result of RUN, if there is one
+func (c *BuildKitClient) container(id string) (string, error) {
+	p := c.placeholder(id)
+	if p == nil {
+		return id, nil
+	}
+	if p.containerID != "" {
+		return p.containerID, nil
+	}
+
+	s := p.state
+	if p.builtID != "" {
+		s.ImageID = p.builtID
+	}
+
+	var err error
+	p.containerID, err = c.DockerClient.CreateContainer(s)
+	return p.containerID, err
+}
+
+// RunContainer implements Client, it runs the command of the placeholder with BuildKit
+func (c *BuildKitClient) RunContainer(ctx context.Context, containerID string, attachStdin bool) error {
+	p := c.placeholder(containerID)
+	if p == nil || p.containerID != "" || p.builtID != "" || attachStdin {
+		id, err := c.container(containerID)
+		if err != nil {
+			return err
+		}
+		return c.DockerClient.RunContainer(ctx, id, attachStdin)
+	}
+
+	base := "scratch"
+	if p.state.ImageID != "" {
+		var err error
+		if base, err = c.baseName(p.state.ImageID); err != nil {
+			return err
+		}
+	}
+
+	dockerfile, err := buildkitDockerfile(base, p.state)
+	if err != nil {
+		return err
+	}
+
+	dir, err := ioutil.TempDir("", "rocker-buildkit")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "Dockerfile"), []byte(dockerfile), 0644); err != nil {
+		return err
+	}
+
+	built := fmt.Sprintf("rocker-buildkit:%.12s", containerID)
+
+	// rocker decides what is cached, BuildKit runs what it is asked to
+	args := []string{"buildx", "build", "--load", "--no-cache", "--progress", "plain", "--tag", built}
+	if c.builder != "" {
+		args = append(args, "--builder", c.builder)
+	}
+	args = append(args, dir)
+
+	var (
+		outLogger = &logrus.Logger{Out: c.log.Out, Formatter: c.stdoutContainerFormatter, Level: c.log.Level}
+		errLogger = &logrus.Logger{Out: c.log.Out, Formatter: c.stderrContainerFormatter, Level: c.log.Level}
+
+		outStream io.Writer = textformatter.LogWriter(outLogger)
+		errStream io.Writer = textformatter.LogWriter(errLogger)
+	)
+	if c.stepLogs != nil {
+		outStream = io.MultiWriter(outStream, c.stepLogs)
+		errStream = io.MultiWriter(errStream, c.stepLogs)
+	}
+
+	c.log.Infof("| Run with BuildKit on top of %s", base)
+	c.log.Debugf("BuildKit Dockerfile of %.12s:\n%s", containerID, dockerfile)
+
+	if err := c.run(ctx, args, nil, outStream, errStream); err != nil {
+		if ctx.Err() != nil {
+			return contextError(ctx, fmt.Sprintf("while BuildKit was running %.12s", containerID))
+		}
+		return WithExitCode(ExitStep, fmt.Errorf("RUN failed in BuildKit, error: %s", err))
+	}
+	p.built = built
+
+	img, err := c.DockerClient.InspectImage(built)
+	if err != nil {
+		return err
+	}
+	if img == nil {
+		return fmt.Errorf("BuildKit did not load the image %s to the daemon, check that the builder uses the docker driver", built)
+	}
+	p.builtID = img.ID
+
+	return nil
+}
+
+// baseName returns the name FROM of BuildKit takes for the image, which cannot be
+// an image ID. An image without tags, such as the result of a previous step, is
+// tagged, and the tag is kept: removing the only tag of an image removes the image
+// when nothing depends on it, and the images of BuildKit do not
+func (c *BuildKitClient) baseName(imageID string) (string, error) {
+	img, err := c.DockerClient.InspectImage(imageID)
+	if err != nil {
+		return "", err
+	}
+	if img == nil {
+		return "", fmt.Errorf("Image %.12s is not found", imageID)
+	}
+	for _, tag := range img.RepoTags {
+		if tag != "<none>:<none>" {
+			return tag, nil
+		}
+	}
+
+	name := fmt.Sprintf("rocker-buildkit-base:%.12s", strings.TrimPrefix(img.ID, "sha256:"))
+	if err := c.DockerClient.TagImage(img.ID, name); err != nil {
+		return "", err
+	}
+	return name, nil
+}
+
+// RunContainerWithIO implements Client
+func (c *BuildKitClient) RunContainerWithIO(ctx context.Context, containerID string, in io.Reader, out io.Writer) error {
+	id, err := c.container(containerID)
+	if err != nil {
+		return err
+	}
+	return c.DockerClient.RunContainerWithIO(ctx, id, in, out)
+}
+
+// CommitContainer implements Client, the image of the step is committed on the
+// daemon with the config of the state, on top of the result of RUN
+func (c *BuildKitClient) CommitContainer(s *State) (*docker.Image, error) {
+	placeholderID := s.NoCache.ContainerID
+
+	id, err := c.container(placeholderID)
+	if err != nil {
+		return nil, err
+	}
+
+	s.NoCache.ContainerID = id
+	img, err := c.DockerClient.CommitContainer(s)
+	s.NoCache.ContainerID = placeholderID
+
+	return img, err
+}
+
+// RemoveContainer implements Client, it removes the container of the placeholder
+// and the temporary tag of the result of RUN
+func (c *BuildKitClient) RemoveContainer(containerID string) error {
+	p := c.placeholder(containerID)
+	if p == nil {
+		return c.DockerClient.RemoveContainer(containerID)
+	}
+
+	c.placeholders.mu.Lock()
+	delete(c.placeholders.containers, containerID)
+	c.placeholders.mu.Unlock()
+
+	// The committed image depends on the result of RUN, so only the tag goes
+	if p.built != "" {
+		if err := c.client.RemoveImageExtended(p.built, docker.RemoveImageOptions{}); err != nil {
+			c.log.Debugf("Failed to remove the tag %s, error: %s", p.built, err)
+		}
+	}
+
+	if p.containerID != "" {
+		return c.DockerClient.RemoveContainer(p.containerID)
+	}
+	return nil
+}
+
+// UploadToContainer implements Client
+func (c *BuildKitClient) UploadToContainer(containerID string, stream io.Reader, path string) error {
+	id, err := c.container(containerID)
+	if err != nil {
+		return err
+	}
+	return c.DockerClient.UploadToContainer(id, stream, path)
+}
+
+// ImportContainer implements Client
+func (c *BuildKitClient) ImportContainer(containerID, imageName string, exclude []string) (*docker.Image, error) {
+	id, err := c.container(containerID)
+	if err != nil {
+		return nil, err
+	}
+	return c.DockerClient.ImportContainer(id, imageName, exclude)
+}
+
+// ReadFileFromContainer implements Client
+func (c *BuildKitClient) ReadFileFromContainer(containerID, path string) (*spill.Buffer, error) {
+	id, err := c.container(containerID)
+	if err != nil {
+		return nil, err
+	}
+	return c.DockerClient.ReadFileFromContainer(id, path)
+}
+
+// DownloadFromContainer implements Client
+func (c *BuildKitClient) DownloadFromContainer(containerID, path string, out io.Writer) error {
+	id, err := c.container(containerID)
+	if err != nil {
+		return err
+	}
+	return c.DockerClient.DownloadFromContainer(id, path, out)
+}
+
+// withLog returns a copy of the client that logs to the given logger, for the
+// parallel stages; the placeholders are shared
+func (c *BuildKitClient) withLog(l *logrus.Logger) Client {
+	c2 := *c
+	c2.DockerClient = c.DockerClient.withLog(l).(*DockerClient)
+	return &c2
+}
@@ -0,0 +1,158 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/fsouza/go-dockerclient"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewClient(t *testing.T) {
+	assert.Equal(t, []string{"buildkit", "docker", "podman"}, Backends())
+
+	c, err := NewClient("", DockerClientOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.IsType(t, &DockerClient{}, c)
+
+	_, err = NewClient("kaniko", DockerClientOptions{})
+	assert.EqualError(t, err, `Unknown backend "kaniko", the known ones are buildkit, docker, podman`)
+}
+
+func TestBuildKitDockerfile(t *testing.T) {
+	s := State{}
+	s.Config.Env = []string{"PATH=/usr/bin:/bin", "GREETING=say \"hi\""}
+	s.Config.WorkingDir = "/src"
+	s.Config.User = "app"
+	s.Config.Entrypoint = []string{}
+	s.Config.Cmd = []string{"/bin/sh", "-c", "make test"}
+
+	dockerfile, err := buildkitDockerfile("rocker-buildkit-base:123", s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, `FROM rocker-buildkit-base:123
+ENV PATH="/usr/bin:/bin"
+ENV GREETING="say \"hi\""
+WORKDIR /src
+USER app
+RUN ["/bin/sh","-c","make test"]
+`, dockerfile)
+}
+
+func TestBuildKitUnsupported(t *testing.T) {
+	s := State{}
+	assert.Equal(t, "", buildkitUnsupported(s))
+
+	s.NoCache.HostConfig = docker.HostConfig{Binds: []string{"/cache:/cache"}}
+	assert.Equal(t, "volumes", buildkitUnsupported(s))
+
+	s = State{}
+	s.Config.Tty = true
+	assert.Equal(t, "a TTY", buildkitUnsupported(s))
+}
+
+func newTestBuildKitClient(run func(args []string) error) *BuildKitClient {
+	log := logrus.New()
+	log.Out = ioutil.Discard
+
+	return &BuildKitClient{
+		DockerClient: NewDockerClient(DockerClientOptions{Log: log}),
+		builder:      "rocker",
+		placeholders: &buildkitPlaceholders{containers: map[string]*buildkitContainer{}},
+		run: func(ctx context.Context, args []string, env []string, stdout, stderr io.Writer) error {
+			return run(args)
+		},
+	}
+}
+
+func TestBuildKitClient_RunFailed(t *testing.T) {
+	var args []string
+	c := newTestBuildKitClient(func(a []string) error {
+		args = a
+		return fmt.Errorf("exit status 1")
+	})
+
+	s := State{}
+	s.Config.Cmd = []string{"/bin/sh", "-c", "false"}
+
+	id, err := c.CreateContainer(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = c.RunContainer(context.Background(), id, false)
+	assert.Equal(t, ExitStep, ExitCode(err))
+	assert.EqualError(t, err, "RUN failed in BuildKit, error: exit status 1")
+	assert.Equal(t, []string{"buildx", "build", "--load", "--no-cache", "--progress", "plain",
+		"--tag", "rocker-buildkit:" + id[:12], "--builder", "rocker"}, args[:len(args)-1])
+
+	// nothing was created on the daemon
+	assert.Nil(t, c.RemoveContainer(id))
+	assert.Nil(t, c.placeholder(id))
+}
+
+func TestBuildKitClient_RunCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	c := newTestBuildKitClient(func([]string) error {
+		cancel()
+		return fmt.Errorf("signal: killed")
+	})
+
+	id, err := c.CreateContainer(State{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = c.RunContainer(ctx, id, false)
+	assert.Equal(t, ExitCancelled, ExitCode(err))
+}
+
+func TestNewClient_TLS(t *testing.T) {
+	_, err := NewClient("", DockerClientOptions{
+		Host:      "tcp://build-02.example.com:2376",
+		TLSVerify: true,
+		TLSCACert: "/nonexistent/ca.pem",
+	})
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "Cannot use TLS to connect to tcp://build-02.example.com:2376, --tlscacert")
+	}
+
+	c, err := NewClient("", DockerClientOptions{Host: "tcp://build-02.example.com:2375"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "tcp://build-02.example.com:2375", c.(*DockerClient).client.Endpoint())
+	assert.True(t, c.(*DockerClient).isRemote)
+}
+
+func TestDockerClientOptions_DockerConfig(t *testing.T) {
+	config := DockerClientOptions{Host: "tcp://build:2376", TLSVerify: true, TLSCert: "/certs/me.pem"}.dockerConfig()
+	assert.Equal(t, "tcp://build:2376", config.Host)
+	assert.True(t, config.Tlsverify)
+	assert.Equal(t, "/certs/me.pem", config.Tlscert)
+	assert.True(t, strings.HasSuffix(config.Tlskey, "/key.pem"), config.Tlskey)
+}
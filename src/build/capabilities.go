@@ -0,0 +1,60 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import "github.com/grammarly/rocker/src/dockerclient"
+
+// checkCapabilities makes the pre-flight check of the features the plan needs
+// from the docker daemon, so a daemon that is too old fails the build before
+// running anything
+func (b *Build) checkCapabilities(plan Plan) error {
+	c, ok := b.client.(interface {
+		capabilities() *dockerclient.DaemonCapabilities
+	})
+	if !ok {
+		return nil
+	}
+
+	caps := c.capabilities()
+	for _, command := range plan {
+		for _, capability := range commandCapabilities(command) {
+			if err := caps.Require(capability); err != nil {
+				return WithExitCode(ExitInfra, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// commandCapabilities returns the features of the daemon the command needs
+func commandCapabilities(command Command) []dockerclient.Capability {
+	switch c := command.(type) {
+	case *CommandHealthcheck:
+		if _, ok := c.cfg.flags["start-period"]; ok {
+			return []dockerclient.Capability{dockerclient.CapHealthcheck, dockerclient.CapHealthcheckStartPeriod}
+		}
+		return []dockerclient.Capability{dockerclient.CapHealthcheck}
+	case *CommandShell:
+		return []dockerclient.Capability{dockerclient.CapShell}
+	case *CommandSquash:
+		return []dockerclient.Capability{dockerclient.CapSquash}
+	case *CommandNormalize:
+		return []dockerclient.Capability{dockerclient.CapReproducible}
+	}
+	return nil
+}
@@ -0,0 +1,59 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"testing"
+
+	"github.com/grammarly/rocker/src/dockerclient"
+
+	"github.com/fsouza/go-dockerclient"
+	"github.com/stretchr/testify/assert"
+)
+
+type capsMockClient struct {
+	*MockClient
+	caps *dockerclient.DaemonCapabilities
+}
+
+func (c *capsMockClient) capabilities() *dockerclient.DaemonCapabilities {
+	return c.caps
+}
+
+func TestBuild_CheckCapabilities(t *testing.T) {
+	rockerfile := "FROM ubuntu\nHEALTHCHECK --start-period=5s CMD true"
+	b, c := makeBuild(t, rockerfile, Config{})
+
+	v, _ := docker.NewAPIVersion("1.24")
+	b.client = &capsMockClient{c, &dockerclient.DaemonCapabilities{Version: "1.12.1", APIVersion: v}}
+
+	// fails before pulling or running anything
+	err := b.Run(makePlan(t, rockerfile))
+	assert.EqualError(t, err, "HEALTHCHECK --start-period needs docker with the remote API 1.29 or newer, the daemon is docker 1.12.1 with API 1.24; upgrade docker")
+	assert.Equal(t, ExitInfra, ExitCode(err))
+	c.AssertExpectations(t)
+}
+
+func TestCommandCapabilities(t *testing.T) {
+	plan := makePlan(t, "FROM ubuntu\nHEALTHCHECK CMD true\nSHELL [\"/bin/bash\", \"-c\"]\nRUN true")
+
+	needs := []dockerclient.Capability{}
+	for _, command := range plan {
+		needs = append(needs, commandCapabilities(command)...)
+	}
+	assert.Equal(t, []dockerclient.Capability{dockerclient.CapHealthcheck, dockerclient.CapShell}, needs)
+}
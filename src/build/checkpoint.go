@@ -0,0 +1,244 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+
+	"github.com/grammarly/rocker/src/imagename"
+	"github.com/grammarly/rocker/src/template"
+)
+
+// CheckpointVersion is increased whenever the checkpoint format changes incompatibly
+const CheckpointVersion = 1
+
+// Checkpoint is a snapshot of the build progress that can be written to a file
+// and restored by another process, possibly on another host, to continue the build
+// from the command that goes next. The images it refers to should be available to the
+// daemon of the restoring process, e.g. by pulling them from a shared cache.
+//
+// EXPORT data lives in containers on the original daemon; a build restored on
+// another host starts with empty exports.
+type Checkpoint struct {
+	Version        int
+	BuildID        string
+	Rockerfile     string
+	RockerfileHash string
+	Vars           template.Vars
+
+	// Next is the index of the plan command to continue from
+	Next       int
+	Injections []Injection
+	State      State
+
+	Exports                    []string
+	CurrentExportContainerName string
+	PrevExportContainerID      string
+	AllowedBuildArgs           map[string]bool
+	ContextDefaults            map[string]string
+	Stages                     map[string]State
+	Stage                      string
+
+	ProducedSize int64
+	VirtualSize  int64
+	CacheHits    int
+	CacheMisses  int
+	Steps        []BuiltStep
+	Pushed       []imagename.Artifact
+}
+
+// Injection records ONBUILD triggers that were merged into the plan after
+// the command with the given index, so the same plan can be rebuilt on restore
+type Injection struct {
+	After    int
+	Commands []string
+}
+
+// Checkpoint makes the snapshot of the build, to be continued from the plan command
+// with the given index. It fails while a container of an uncommitted step is pending,
+// since the container cannot be carried over.
+func (b *Build) Checkpoint(next int) (cp Checkpoint, err error) {
+	if b.state.NoCache.ContainerID != "" {
+		return cp, fmt.Errorf("Cannot checkpoint the build while container %.12s is not committed", b.state.NoCache.ContainerID)
+	}
+
+	cp = Checkpoint{
+		Version:                    CheckpointVersion,
+		BuildID:                    b.cfg.BuildID,
+		Rockerfile:                 b.rockerfile.Name,
+		RockerfileHash:             rockerfileHash(b.rockerfile),
+		Vars:                       b.rockerfile.Vars,
+		Next:                       next,
+		Injections:                 b.injections,
+		State:                      b.state,
+		Exports:                    b.exports,
+		CurrentExportContainerName: b.currentExportContainerName,
+		PrevExportContainerID:      b.prevExportContainerID,
+		AllowedBuildArgs:           b.allowedBuildArgs,
+		ContextDefaults:            b.contextDefaults,
+		Stages:                     b.stages,
+		Stage:                      b.stage,
+		ProducedSize:               b.ProducedSize,
+		VirtualSize:                b.VirtualSize,
+		CacheHits:                  b.CacheHits,
+		CacheMisses:                b.CacheMisses,
+		Steps:                      b.Steps,
+		Pushed:                     b.Pushed,
+	}
+
+	return cp, nil
+}
+
+// Restore loads the checkpoint into the build, so the following Run skips the commands
+// that were already done. The Rockerfile should be the same as the checkpointed one.
+func (b *Build) Restore(cp Checkpoint) error {
+	if cp.Version != CheckpointVersion {
+		return fmt.Errorf("Checkpoint version %d is not supported, expected %d", cp.Version, CheckpointVersion)
+	}
+	if hash := rockerfileHash(b.rockerfile); cp.RockerfileHash != hash {
+		return fmt.Errorf("Checkpoint was made for a different Rockerfile %s (or with different variables)", cp.Rockerfile)
+	}
+
+	b.restored = &cp
+
+	b.state = cp.State
+	b.injections = cp.Injections
+	b.exports = cp.Exports
+	b.currentExportContainerName = cp.CurrentExportContainerName
+	b.prevExportContainerID = cp.PrevExportContainerID
+	b.ProducedSize = cp.ProducedSize
+	b.VirtualSize = cp.VirtualSize
+	b.CacheHits = cp.CacheHits
+	b.CacheMisses = cp.CacheMisses
+	b.Steps = cp.Steps
+	b.Pushed = cp.Pushed
+
+	if cp.AllowedBuildArgs != nil {
+		b.allowedBuildArgs = cp.AllowedBuildArgs
+	}
+	if cp.ContextDefaults != nil {
+		b.contextDefaults = cp.ContextDefaults
+	}
+	if cp.Stages != nil {
+		b.stages = cp.Stages
+	}
+	b.stage = cp.Stage
+
+	// Build args given to this process win over the checkpointed ones
+	if b.cfg.BuildArgs != nil {
+		b.state.NoCache.BuildArgs = b.cfg.BuildArgs
+	}
+
+	return nil
+}
+
+// WriteCheckpoint atomically writes the checkpoint to the file as JSON
+func WriteCheckpoint(path string, cp Checkpoint) error {
+	data, err := json.MarshalIndent(cp, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".checkpoint")
+	if err != nil {
+		return err
+	}
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	tmp.Close()
+
+	return os.Rename(tmp.Name(), path)
+}
+
+// ReadCheckpoint reads the checkpoint written by WriteCheckpoint
+func ReadCheckpoint(path string) (cp Checkpoint, err error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return cp, err
+	}
+	if err := json.Unmarshal(data, &cp); err != nil {
+		return cp, fmt.Errorf("Failed to parse checkpoint %s, error: %s", path, err)
+	}
+	return cp, nil
+}
+
+// checkpoint writes the checkpoint to the configured file and the resume file, if any
+func (b *Build) checkpoint(next int) error {
+	if b.cfg.CheckpointFile == "" && b.cfg.ResumeFile == "" {
+		return nil
+	}
+
+	// Steps in between RUN and its commit are not checkpointed
+	if b.state.NoCache.ContainerID != "" {
+		return nil
+	}
+
+	cp, err := b.Checkpoint(next)
+	if err != nil {
+		return err
+	}
+
+	if b.cfg.CheckpointFile != "" {
+		if err := WriteCheckpoint(b.cfg.CheckpointFile, cp); err != nil {
+			return fmt.Errorf("Failed to write checkpoint %s, error: %s", b.cfg.CheckpointFile, err)
+		}
+	}
+
+	// The resume file is a convenience, the build goes on without it
+	if b.cfg.ResumeFile != "" {
+		if err := os.MkdirAll(filepath.Dir(b.cfg.ResumeFile), 0755); err != nil {
+			b.log.Warnf("Failed to write resume file %s, error: %s", b.cfg.ResumeFile, err)
+		} else if err := WriteCheckpoint(b.cfg.ResumeFile, cp); err != nil {
+			b.log.Warnf("Failed to write resume file %s, error: %s", b.cfg.ResumeFile, err)
+		}
+	}
+
+	atomic.StoreInt32(&b.progress, int32(next))
+
+	return nil
+}
+
+// ResumeFile returns the file in the cache directory where the progress of the
+// builds of the Rockerfile is kept, so a failed build can be continued with --resume
+func ResumeFile(cacheDir, contextDir, rockerfile string) string {
+	key := sha256.Sum256([]byte(contextDir + "\x00" + rockerfile))
+	return filepath.Join(cacheDir, "resume", fmt.Sprintf("%x.json", key[:8]))
+}
+
+// removeResumeFile forgets the progress of the build once it succeeded
+func (b *Build) removeResumeFile() {
+	if b.cfg.ResumeFile == "" {
+		return
+	}
+	if err := os.Remove(b.cfg.ResumeFile); err != nil && !os.IsNotExist(err) {
+		b.log.Warnf("Failed to remove resume file %s, error: %s", b.cfg.ResumeFile, err)
+	}
+}
+
+func rockerfileHash(r *Rockerfile) string {
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(r.Content)))
+}
@@ -0,0 +1,146 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/fsouza/go-dockerclient"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestBuild_CheckpointRestore(t *testing.T) {
+	rockerfile := "FROM ubuntu\nENV foo=bar\nTAG app"
+
+	dir := makeTmpDir(t, map[string]string{})
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "checkpoint.json")
+
+	b, c := makeBuild(t, rockerfile, Config{CheckpointFile: file, BuildID: "42"})
+	plan := makePlan(t, rockerfile)
+
+	c.On("InspectImage", "ubuntu:latest").Return(&docker.Image{ID: "123"}, nil).Once()
+	c.On("CreateContainer", mock.AnythingOfType("State")).Return("456", nil).Once()
+	c.On("CommitContainer", mock.AnythingOfType("State")).Return(&docker.Image{ID: "789"}, nil).Once()
+	c.On("RemoveContainer", "456").Return(nil).Once()
+	c.On("TagImage", "789", "app").Return(nil).Once()
+
+	if err := b.Run(plan); err != nil {
+		t.Fatal(err)
+	}
+	c.AssertExpectations(t)
+
+	cp, err := ReadCheckpoint(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, "42", cp.BuildID)
+	assert.Equal(t, len(plan), cp.Next)
+	assert.Equal(t, "789", cp.State.ImageID)
+	assert.Equal(t, b.Steps, cp.Steps)
+
+	// Continue another build from the TAG command
+	for k, command := range plan {
+		if _, ok := command.(*CommandTag); ok {
+			cp.Next = k
+		}
+	}
+
+	b2, c2 := makeBuild(t, rockerfile, Config{})
+	if err := b2.Restore(cp); err != nil {
+		t.Fatal(err)
+	}
+
+	c2.On("TagImage", "789", "app").Return(nil).Once()
+
+	if err := b2.Run(makePlan(t, rockerfile)); err != nil {
+		t.Fatal(err)
+	}
+	c2.AssertExpectations(t)
+	assert.Equal(t, b.Steps, b2.Steps)
+}
+
+func TestBuild_Checkpoint_Errors(t *testing.T) {
+	b, _ := makeBuild(t, "FROM ubuntu", Config{})
+
+	b.state.NoCache.ContainerID = "456"
+	_, err := b.Checkpoint(1)
+	assert.EqualError(t, err, "Cannot checkpoint the build while container 456 is not committed")
+
+	b.state.NoCache.ContainerID = ""
+	cp, err := b.Checkpoint(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b2, _ := makeBuild(t, "FROM debian", Config{})
+	assert.Error(t, b2.Restore(cp))
+
+	cp.Version = 0
+	assert.EqualError(t, b.Restore(cp), "Checkpoint version 0 is not supported, expected 1")
+}
+
+func TestBuild_ResumeFile(t *testing.T) {
+	rockerfile := "FROM ubuntu\nENV foo=bar\nTAG app"
+
+	dir := makeTmpDir(t, map[string]string{})
+	defer os.RemoveAll(dir)
+
+	file := ResumeFile(dir, "/src", "/src/Rockerfile")
+	assert.Equal(t, filepath.Join(dir, "resume"), filepath.Dir(file))
+	assert.NotEqual(t, file, ResumeFile(dir, "/src", "/src/Rockerfile.test"))
+
+	b, c := makeBuild(t, rockerfile, Config{ResumeFile: file})
+
+	c.On("InspectImage", "ubuntu:latest").Return(&docker.Image{ID: "123"}, nil).Once()
+	c.On("CreateContainer", mock.AnythingOfType("State")).Return("456", nil).Once()
+	c.On("CommitContainer", mock.AnythingOfType("State")).Return(&docker.Image{ID: "789"}, nil).Once()
+	c.On("RemoveContainer", "456").Return(nil).Once()
+	c.On("TagImage", "789", "app").Return(fmt.Errorf("daemon is gone")).Once()
+
+	assert.Error(t, b.Run(makePlan(t, rockerfile)))
+	c.AssertExpectations(t)
+
+	// The failed build left its progress
+	cp, err := ReadCheckpoint(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "789", cp.State.ImageID)
+
+	b2, c2 := makeBuild(t, rockerfile, Config{ResumeFile: file})
+	if err := b2.Restore(cp); err != nil {
+		t.Fatal(err)
+	}
+
+	c2.On("TagImage", "789", "app").Return(nil).Once()
+
+	if err := b2.Run(makePlan(t, rockerfile)); err != nil {
+		t.Fatal(err)
+	}
+	c2.AssertExpectations(t)
+
+	// The successful build forgets it
+	_, err = os.Stat(file)
+	assert.True(t, os.IsNotExist(err))
+}
@@ -0,0 +1,162 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"archive/tar"
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+
+	"github.com/grammarly/rocker/src/spill"
+)
+
+// owner is the numeric user and group that COPY --chown gives to the files
+type owner struct {
+	uid int
+	gid int
+}
+
+// chownFlag returns the --chown part of the commit message of COPY and ADD,
+// so the cache key changes together with the owner
+func chownFlag(spec string) string {
+	if spec == "" {
+		return ""
+	}
+	return " --chown=" + spec
+}
+
+// resolveChown turns user[:group] of --chown into numeric ids; names are looked up
+// in /etc/passwd and /etc/group of the given container. Like in Docker, the
+// group is the same number as the user if it is not specified
+func resolveChown(b *Build, containerID, spec string) (*owner, error) {
+	if spec == "" {
+		return nil, nil
+	}
+
+	parts := strings.SplitN(spec, ":", 2)
+	if parts[0] == "" || (len(parts) == 2 && parts[1] == "") {
+		return nil, fmt.Errorf("Invalid --chown value %q, expected user[:group]", spec)
+	}
+
+	uid, err := lookupID(b, containerID, "/etc/passwd", parts[0])
+	if err != nil {
+		return nil, err
+	}
+
+	gid := uid
+	if len(parts) == 2 {
+		if gid, err = lookupID(b, containerID, "/etc/group", parts[1]); err != nil {
+			return nil, err
+		}
+	}
+
+	return &owner{uid: uid, gid: gid}, nil
+}
+
+// lookupID returns the id of the name from a passwd or group formatted file of the container;
+// numbers are returned as is without reading the file
+func lookupID(b *Build, containerID, file, name string) (int, error) {
+	if id, err := strconv.Atoi(name); err == nil {
+		return id, nil
+	}
+
+	buf := spill.NewBuffer()
+	defer buf.Close()
+
+	if err := b.client.DownloadFromContainer(containerID, file, buf); err != nil {
+		return 0, fmt.Errorf("Failed to read %s to resolve --chown name %s, error: %s", file, name, err)
+	}
+
+	tr := tar.NewReader(buf.Reader())
+	if _, err := tr.Next(); err != nil {
+		return 0, fmt.Errorf("Failed to read %s to resolve --chown name %s, error: %s", file, name, err)
+	}
+
+	scanner := bufio.NewScanner(tr)
+	for scanner.Scan() {
+		// name:password:id:...
+		fields := strings.Split(scanner.Text(), ":")
+		if len(fields) < 3 || fields[0] != name {
+			continue
+		}
+		return strconv.Atoi(fields[2])
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, err
+	}
+
+	return 0, fmt.Errorf("No entry for %s in %s of the image", name, file)
+}
+
+// chownTar copies the tar archive from r to w making o the owner of every entry
+func chownTar(r io.Reader, w io.Writer, o owner) error {
+	var (
+		tr = tar.NewReader(r)
+		tw = tar.NewWriter(w)
+	)
+
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		hdr.Uid = o.uid
+		hdr.Gid = o.gid
+		// The names of the users of the context mean nothing inside the image
+		hdr.Uname = ""
+		hdr.Gname = ""
+
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if _, err := io.Copy(tw, tr); err != nil {
+			return err
+		}
+	}
+
+	return tw.Close()
+}
+
+// chownStream returns the archive of r with the entries owned by o,
+// or r itself if there is no owner to set
+func chownStream(r io.ReadCloser, o *owner) io.ReadCloser {
+	if o == nil {
+		return r
+	}
+
+	pipeReader, pipeWriter := io.Pipe()
+
+	go func() {
+		err := chownTar(r, pipeWriter, *o)
+		if err == nil {
+			// Drain the padding after the end of the archive so the writer does not block
+			_, err = io.Copy(ioutil.Discard, r)
+		}
+		r.Close()
+		pipeWriter.CloseWithError(err)
+	}()
+
+	return pipeReader
+}
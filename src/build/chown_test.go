@@ -0,0 +1,154 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"github.com/fsouza/go-dockerclient"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestResolveChown_Numeric(t *testing.T) {
+	b, c := makeBuild(t, "", Config{})
+
+	own, err := resolveChown(b, "123", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Nil(t, own)
+
+	own, err = resolveChown(b, "123", "1000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, &owner{uid: 1000, gid: 1000}, own)
+
+	own, err = resolveChown(b, "123", "1000:50")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, &owner{uid: 1000, gid: 50}, own)
+
+	_, err = resolveChown(b, "123", "1000:")
+	assert.EqualError(t, err, `Invalid --chown value "1000:", expected user[:group]`)
+
+	c.AssertExpectations(t)
+}
+
+func TestResolveChown_Names(t *testing.T) {
+	b, c := makeBuild(t, "", Config{})
+
+	c.On("DownloadFromContainer", "123", "/etc/passwd", mock.Anything).Return(nil).Run(func(args mock.Arguments) {
+		io.Copy(args.Get(2).(io.Writer), makeTarFile(t, "passwd", "root:x:0:0:root:/root:/bin/sh\napp:x:1000:1000::/home/app:/bin/sh\n"))
+	}).Once()
+	c.On("DownloadFromContainer", "123", "/etc/group", mock.Anything).Return(nil).Run(func(args mock.Arguments) {
+		io.Copy(args.Get(2).(io.Writer), makeTarFile(t, "group", "root:x:0:\nstaff:x:50:app\n"))
+	}).Once()
+
+	own, err := resolveChown(b, "123", "app:staff")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.AssertExpectations(t)
+	assert.Equal(t, &owner{uid: 1000, gid: 50}, own)
+}
+
+func TestResolveChown_NoSuchUser(t *testing.T) {
+	b, c := makeBuild(t, "", Config{})
+
+	c.On("DownloadFromContainer", "123", "/etc/passwd", mock.Anything).Return(nil).Run(func(args mock.Arguments) {
+		io.Copy(args.Get(2).(io.Writer), makeTarFile(t, "passwd", "root:x:0:0:root:/root:/bin/sh\n"))
+	}).Once()
+
+	_, err := resolveChown(b, "123", "app")
+	assert.EqualError(t, err, "No entry for app in /etc/passwd of the image")
+}
+
+func TestChownStream(t *testing.T) {
+	r := chownStream(ioutil.NopCloser(makeTar(t, []string{"app/", "app/main"})), &owner{uid: 1000, gid: 50})
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, 1000, hdr.Uid, hdr.Name)
+		assert.Equal(t, 50, hdr.Gid, hdr.Name)
+	}
+}
+
+func TestCommandCopy_FromChown(t *testing.T) {
+	b, c := makeBuild(t, "", Config{})
+	b.state.ImageID = "123"
+
+	cmd := NewCommand(ConfigCommand{
+		name:  "copy",
+		args:  []string{"/app/tool", "/usr/local/bin/"},
+		flags: map[string]string{"from": "builder:1", "chown": "1000:1000"},
+	})
+
+	c.On("InspectImage", "builder:1").Return(&docker.Image{ID: "999"}, nil).Once()
+	c.On("CreateContainer", mock.AnythingOfType("State")).Return("src", nil).Once()
+	c.On("CreateContainer", mock.AnythingOfType("State")).Return("dst", nil).Once()
+	c.On("DownloadFromContainer", "src", "/app/tool", mock.Anything).Return(nil).Run(func(args mock.Arguments) {
+		io.Copy(args.Get(2).(io.Writer), makeTar(t, []string{"tool"}))
+	}).Once()
+	c.On("UploadToContainer", "dst", mock.Anything, "/").Return(nil).Run(func(args mock.Arguments) {
+		hdr, err := tar.NewReader(args.Get(1).(io.Reader)).Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, "usr/local/bin/tool", hdr.Name)
+		assert.Equal(t, 1000, hdr.Uid)
+		assert.Equal(t, 1000, hdr.Gid)
+		io.Copy(ioutil.Discard, args.Get(1).(io.Reader))
+	}).Once()
+	c.On("RemoveContainer", "src").Return(nil).Once()
+
+	state, err := cmd.Execute(context.Background(), b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.AssertExpectations(t)
+	assert.Equal(t, "COPY --from=999 --chown=1000:1000 /app/tool to /usr/local/bin/", state.GetCommits())
+}
+
+func makeTarFile(t *testing.T, name, content string) io.Reader {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(content))}); err != nil {
+		t.Fatal(err)
+	}
+	tw.Write([]byte(content))
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return &buf
+}
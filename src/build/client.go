@@ -17,15 +17,20 @@
 package build
 
 import (
-	"bytes"
+	"archive/tar"
+	"context"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
 	"os/signal"
+	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/grammarly/rocker/src/dockerclient"
 	"github.com/grammarly/rocker/src/imagename"
+	"github.com/grammarly/rocker/src/spill"
 	"github.com/grammarly/rocker/src/storage/s3"
 	"github.com/grammarly/rocker/src/textformatter"
 	"net/url"
@@ -41,22 +46,37 @@ import (
 	"github.com/Sirupsen/logrus"
 )
 
-// Client interface
+// Client interface; the methods that wait for the network or for a container
+// take the context of the build and stop the pull, the push or the container
+// when it is done
 type Client interface {
 	InspectImage(name string) (*docker.Image, error)
-	PullImage(name string) error
+	PullImage(ctx context.Context, name string) error
+	PrefetchImage(ctx context.Context, name string) error
 	ListImages() (images []*imagename.ImageName, err error)
 	ListImageTags(name string) (images []*imagename.ImageName, err error)
 	RemoveImage(imageID string) error
 	TagImage(imageID, imageName string) error
-	PushImage(imageName string) (digest string, err error)
-	EnsureImage(imageName string) error
+	SaveImages(names []string, out io.Writer) error
+	PushImage(ctx context.Context, imageName string) (digest string, err error)
+	UnpushImage(imageName, digest string) error
+	EnsureImage(ctx context.Context, imageName string) error
 	CreateContainer(state State) (id string, err error)
-	RunContainer(containerID string, attachStdin bool) error
+	RunContainer(ctx context.Context, containerID string, attachStdin bool) error
+	RunContainerWithIO(ctx context.Context, containerID string, in io.Reader, out io.Writer) error
 	CommitContainer(state *State) (img *docker.Image, err error)
 	RemoveContainer(containerID string) error
 	UploadToContainer(containerID string, stream io.Reader, path string) error
-	EnsureContainer(containerName string, config *docker.Config, hostConfig *docker.HostConfig, purpose string) (containerID string, err error)
+	ImportContainer(containerID, imageName string, exclude []string) (img *docker.Image, err error)
+	SquashImage(imageID string, keepLayers int) (img *docker.Image, err error)
+	NormalizeImage(imageID string, keepLayers int, epoch time.Time) (img *docker.Image, err error)
+	ReadFileFromContainer(containerID, path string) (content *spill.Buffer, err error)
+	DownloadFromContainer(containerID, path string, out io.Writer) error
+	PushArtifact(imageName string, artifact dockerclient.OCIArtifact) (digest string, err error)
+	AttachArtifact(imageName string, artifact dockerclient.OCIArtifact) (digest string, err error)
+	PullArtifact(imageName string) (artifact dockerclient.OCIArtifact, err error)
+	PushManifestList(imageName string, entries []dockerclient.ManifestListEntry, annotations map[string]string) (digest string, err error)
+	EnsureContainer(ctx context.Context, containerName string, config *docker.Config, hostConfig *docker.HostConfig, purpose string) (containerID string, err error)
 	InspectContainer(containerName string) (*docker.Container, error)
 	ResolveHostPath(path string) (resultPath string, err error)
 }
@@ -65,31 +85,71 @@ type Client interface {
 type DockerClientOptions struct {
 	Client                   *docker.Client
 	Auth                     *docker.AuthConfigurations
+	AuthProvider             dockerclient.AuthProvider
 	Log                      *logrus.Logger
 	S3storage                *s3.StorageS3
 	StdoutContainerFormatter logrus.Formatter
 	StderrContainerFormatter logrus.Formatter
 	PushRetryCount           int
+	PullRetryCount           int
+	PullMirror               string
 	Host                     string
 	LogExactSizes            bool
+	BuildID                  string
+	Offline                  bool
+	NoCommitPause            bool
+	AttachInterrupt          string
+	StepLogs                 *StepLogs
+
+	// BuildKitBuilder is the buildx builder of the buildkit backend, the current one if empty
+	BuildKitBuilder string
+
+	// TLS of the connection to Host, see dockerclient.Config; when Client is not
+	// given, NewClient connects with them, DOCKER_HOST, DOCKER_TLS_VERIFY and
+	// DOCKER_CERT_PATH give the defaults
+	TLSVerify bool
+	TLSCACert string
+	TLSCert   string
+	TLSKey    string
+
+	// Capabilities of the daemon, nil if unknown
+	Capabilities *dockerclient.DaemonCapabilities
 }
 
 // DockerClient implements the client that works with a docker socket
 type DockerClient struct {
 	client                   *docker.Client
 	auth                     *docker.AuthConfigurations
+	authProvider             dockerclient.AuthProvider
 	log                      *logrus.Logger
 	s3storage                *s3.StorageS3
 	stdoutContainerFormatter logrus.Formatter
 	stderrContainerFormatter logrus.Formatter
 	pushRetryCount           int
+	pullRetryCount           int
+	pullMirror               string
+	pullThrottle             *pullThrottle
 	isUnixSocket             bool
 	unixSockPath             string
 	useHumanSize             bool
+	buildID                  string
+	containers               *int32
+	offline                  bool
+	noCommitPause            bool
+	attachInterrupt          string
+	stepLogs                 *StepLogs
+	interrupts               *interrupts
+	caps                     *dockerclient.DaemonCapabilities
+	isRootless               bool
+	podman                   bool
+	isRemote                 bool
 }
 
 var (
 	captureDigest = regexp.MustCompile("digest:\\s*(sha256:[a-f0-9]{64})")
+
+	// Docker allows only these characters in container names
+	containerNameInvalid = regexp.MustCompile("[^a-zA-Z0-9_.-]")
 )
 
 // NewDockerClient makes a new client that works with a docker socket
@@ -107,18 +167,42 @@ func NewDockerClient(options DockerClientOptions) *DockerClient {
 	isUnixSocket := ("unix" == u.Scheme)
 	unixSockPath := u.Path
 
-	return &DockerClient{
+	c := &DockerClient{
 		client:                   options.Client,
 		auth:                     options.Auth,
+		authProvider:             options.AuthProvider,
 		log:                      log,
 		s3storage:                options.S3storage,
 		stdoutContainerFormatter: options.StdoutContainerFormatter,
 		stderrContainerFormatter: options.StderrContainerFormatter,
 		pushRetryCount:           options.PushRetryCount,
+		pullRetryCount:           options.PullRetryCount,
+		pullMirror:               options.PullMirror,
+		pullThrottle:             newPullThrottle(),
 		isUnixSocket:             isUnixSocket,
 		unixSockPath:             unixSockPath,
 		useHumanSize:             !options.LogExactSizes,
+		buildID:                  containerNameInvalid.ReplaceAllString(options.BuildID, "-"),
+		containers:               new(int32),
+		offline:                  options.Offline,
+		noCommitPause:            options.NoCommitPause,
+		attachInterrupt:          options.AttachInterrupt,
+		stepLogs:                 options.StepLogs,
+		caps:                     options.Capabilities,
+		isRootless:               isUnixSocket && dockerclient.IsRootless(options.Host),
+		podman:                   options.Capabilities != nil && options.Capabilities.Podman,
+		isRemote:                 dockerclient.IsRemote(options.Host),
 	}
+
+	c.interrupts = newInterrupts(ForceInterruptWindow, log, func(containerID string) error {
+		return c.client.RemoveContainer(docker.RemoveContainerOptions{
+			ID:            containerID,
+			Force:         true,
+			RemoveVolumes: true,
+		})
+	})
+
+	return c
 }
 
 // InspectImage inspects docker image
@@ -132,7 +216,11 @@ func (c *DockerClient) InspectImage(name string) (img *docker.Image, err error)
 }
 
 // PullImage pulls docker image
-func (c *DockerClient) PullImage(name string) error {
+func (c *DockerClient) PullImage(ctx context.Context, name string) error {
+	if err := c.checkOnline("pull", name); err != nil {
+		return err
+	}
+
 	image := imagename.NewFromString(name)
 
 	// e.g. s3:bucket-name/image-name
@@ -144,6 +232,13 @@ func (c *DockerClient) PullImage(name string) error {
 		return c.s3storage.Pull(name)
 	}
 
+	return c.pullRateLimited(ctx, image, func(image *imagename.ImageName) error {
+		return c.pullImageInner(ctx, image)
+	})
+}
+
+// pullImageInner pulls the image from the registry and displays the progress
+func (c *DockerClient) pullImageInner(ctx context.Context, image *imagename.ImageName) error {
 	var (
 		pipeReader, pipeWriter = io.Pipe()
 		fdOut, isTerminalOut   = term.GetFdInfo(c.log.Out)
@@ -159,7 +254,7 @@ func (c *DockerClient) PullImage(name string) error {
 		Repository:    image.NameWithRegistry(),
 		Registry:      image.Registry,
 		Tag:           image.GetTag(),
-		OutputStream:  pipeWriter,
+		OutputStream:  &contextWriter{ctx: ctx, w: pipeWriter},
 		RawJSONStream: true,
 	}
 
@@ -170,17 +265,64 @@ func (c *DockerClient) PullImage(name string) error {
 		errch <- jsonmessage.DisplayJSONMessagesStream(pipeReader, out, fdOut, isTerminalOut)
 	}()
 
-	auth, err := dockerclient.GetAuthForRegistry(c.auth, image)
+	auth, err := c.registryAuth(image)
 	if err != nil {
 		return fmt.Errorf("Failed to authenticate registry %s, error: %s", image.Registry, err)
 	}
 
-	if err := c.client.PullImage(opts, auth); err != nil {
+	err = c.client.PullImage(opts, auth)
+	pipeWriter.Close()
+
+	// Errors of the registry, such as rate limits, may come in the stream
+	if streamErr := <-errch; err == nil {
+		err = streamErr
+	}
+	if err != nil && ctx.Err() != nil {
+		return contextError(ctx, fmt.Sprintf("while pulling %s", image))
+	}
+	return err
+}
+
+// PrefetchImage pulls docker image if it does not exist locally; unlike PullImage
+// it does not display the progress, since it is meant to run in the background
+func (c *DockerClient) PrefetchImage(ctx context.Context, name string) error {
+	if err := c.checkOnline("pull", name); err != nil {
 		return err
 	}
 
-	pipeWriter.Close()
-	return <-errch
+	image := imagename.NewFromString(name)
+
+	if img, err := c.InspectImage(image.String()); err != nil || img != nil {
+		return err
+	}
+
+	// S3 images are pulled through the storage driver that reports by itself
+	if image.Storage == imagename.StorageS3 {
+		return c.PullImage(ctx, name)
+	}
+
+	c.log.Infof("| Prefetch image %s", image)
+
+	return c.pullRateLimited(ctx, image, func(image *imagename.ImageName) error {
+		opts := docker.PullImageOptions{
+			Repository:   image.NameWithRegistry(),
+			Registry:     image.Registry,
+			Tag:          image.GetTag(),
+			OutputStream: &contextWriter{ctx: ctx, w: ioutil.Discard},
+		}
+
+		auth, err := c.registryAuth(image)
+		if err != nil {
+			return fmt.Errorf("Failed to authenticate registry %s, error: %s", image.Registry, err)
+		}
+
+		if err := c.client.PullImage(opts, auth); err != nil && ctx.Err() != nil {
+			return contextError(ctx, fmt.Sprintf("while prefetching %s", image))
+		} else if err != nil {
+			return err
+		}
+		return nil
+	})
 }
 
 // ListImages lists all pulled images in the local docker registry
@@ -203,6 +345,10 @@ func (c *DockerClient) ListImages() (images []*imagename.ImageName, err error) {
 
 // ListImageTags returns the list of images instances obtained from all tags existing in the registry
 func (c *DockerClient) ListImageTags(name string) (images []*imagename.ImageName, err error) {
+	if err = c.checkOnline("list tags of", name); err != nil {
+		return nil, err
+	}
+
 	img := imagename.NewFromString(name)
 	if img.Storage == imagename.StorageS3 {
 		return c.s3storage.ListTags(name)
@@ -226,16 +372,25 @@ func (c *DockerClient) CreateContainer(s State) (string, error) {
 
 	s.Config.Image = s.ImageID
 
-	// TODO: assign human readable name?
-
 	opts := docker.CreateContainerOptions{
 		Config:     &s.Config,
 		HostConfig: &s.NoCache.HostConfig,
 	}
 
+	// Name containers after the build, so they can be traced back to it
+	if c.buildID != "" {
+		opts.Name = fmt.Sprintf("rocker_%s_%d", c.buildID, atomic.AddInt32(c.containers, 1))
+	}
+
 	c.log.Debugf("Create container: %# v", pretty.Formatter(opts))
 
 	container, err := c.client.CreateContainer(opts)
+	if err == docker.ErrContainerAlreadyExists {
+		// Left from an earlier run with the same build id
+		c.log.Debugf("Container %s already exists, create an unnamed one", opts.Name)
+		opts.Name = ""
+		container, err = c.client.CreateContainer(opts)
+	}
 	if err != nil {
 		return "", err
 	}
@@ -246,12 +401,14 @@ func (c *DockerClient) CreateContainer(s State) (string, error) {
 	}
 
 	c.log.Infof("| Created container %.12s %s", container.ID, imageStr)
+	c.interrupts.track(container.ID, true)
 
 	return container.ID, nil
 }
 
-// RunContainer runs docker container and optionally attaches stdin
-func (c *DockerClient) RunContainer(containerID string, attachStdin bool) error {
+// RunContainer runs docker container and optionally attaches stdin; the container
+// is stopped once the context is done
+func (c *DockerClient) RunContainer(ctx context.Context, containerID string, attachStdin bool) error {
 
 	var (
 		success   = make(chan struct{})
@@ -276,10 +433,19 @@ func (c *DockerClient) RunContainer(containerID string, attachStdin bool) error
 		fdIn, isTerminalIn = term.GetFdInfo(in)
 	)
 
+	var (
+		outStream io.Writer = textformatter.LogWriter(outLogger)
+		errStream io.Writer = textformatter.LogWriter(errLogger)
+	)
+	if c.stepLogs != nil {
+		outStream = io.MultiWriter(outStream, c.stepLogs)
+		errStream = io.MultiWriter(errStream, c.stepLogs)
+	}
+
 	attachOpts := docker.AttachToContainerOptions{
 		Container:    containerID,
-		OutputStream: textformatter.LogWriter(outLogger),
-		ErrorStream:  textformatter.LogWriter(errLogger),
+		OutputStream: outStream,
+		ErrorStream:  errStream,
 		Stdout:       true,
 		Stderr:       true,
 		Stream:       true,
@@ -347,13 +513,28 @@ func (c *DockerClient) RunContainer(containerID string, attachStdin bool) error
 		}
 	}
 
-	// TODO: move signal handling to the builder?
+	// SIGINT cancels the build through the context, see interrupts,
+	// unless stdin is attached
+	done := ctx.Done()
+	if attachStdin {
+		done = nil
+
+		c.interrupts.attach(true)
+		defer c.interrupts.attach(false)
 
-	signal.Notify(sigch, os.Interrupt)
+		signal.Notify(sigch, os.Interrupt)
 
-	// Signal handler should be reset right after exit of this scope.
-	// We don't want this sighanler to stay alive and suppress default signal handler if any
-	defer signal.Stop(sigch)
+		// Signal handler should be reset right after exit of this scope.
+		// We don't want this sighanler to stay alive and suppress default signal handler if any
+		defer signal.Stop(sigch)
+	}
+
+	// While attached, other signals go to the process in the container
+	fwdch := make(chan os.Signal, 1)
+	if signals := attachSignals(); attachStdin && len(signals) > 0 {
+		signal.Notify(fwdch, signals...)
+		defer signal.Stop(fwdch)
+	}
 
 	go func() {
 		statusCode, err := c.client.WaitContainer(containerID)
@@ -361,31 +542,108 @@ func (c *DockerClient) RunContainer(containerID string, attachStdin bool) error
 		if err != nil {
 			errch <- err
 		} else if statusCode != 0 {
-			errch <- fmt.Errorf("Container %.12s exited with code %d", containerID, statusCode)
+			errch <- WithExitCode(ExitStep, fmt.Errorf("Container %.12s exited with code %d", containerID, statusCode))
 		}
 		errch <- nil
 		return
 	}()
 
-	select {
-	case err := <-errch:
-		// indicate 'finished' so the `attach` goroutine will not give any errors
-		finished <- struct{}{}
-		if err != nil {
+	for {
+		select {
+		case err := <-errch:
+			// indicate 'finished' so the `attach` goroutine will not give any errors
+			finished <- struct{}{}
 			return err
-		}
-	case err := <-attacherr:
-		if err != nil {
+		case err := <-attacherr:
 			return err
+		case sig := <-fwdch:
+			c.forwardSignal(containerID, sig)
+		case <-done:
+			// The step removes the container once it gets the error
+			c.log.Infof("| Stop the container %.12s", containerID)
+			if err := c.client.StopContainer(containerID, 10); err != nil {
+				c.log.Errorf("Failed to stop container: %s", err)
+			}
+			finished <- struct{}{}
+			return contextError(ctx, fmt.Sprintf("while container %.12s was running", containerID))
+		case sig := <-sigch:
+			if c.attachInterrupt == AttachInterruptForward {
+				c.forwardSignal(containerID, sig)
+				continue
+			}
+
+			// Stop the container, so the step fails with the exit code
+			c.log.Infof("Received SIGINT, stop the container %.12s", containerID)
+			if err := c.client.StopContainer(containerID, 10); err != nil {
+				c.log.Errorf("Failed to stop container: %s", err)
+			}
 		}
-	case <-sigch:
-		// TODO: Removing container twice for some reason
-		c.log.Infof("Received SIGINT, remove current container...")
-		if err := c.RemoveContainer(containerID); err != nil {
-			c.log.Errorf("Failed to remove container: %s", err)
+	}
+}
+
+// RunContainerWithIO runs the container with a TTY attached to the given
+// streams instead of the terminal, and waits until it exits
+func (c *DockerClient) RunContainerWithIO(ctx context.Context, containerID string, in io.Reader, out io.Writer) error {
+	var (
+		success   = make(chan struct{})
+		attacherr = make(chan error, 1)
+	)
+
+	attachOpts := docker.AttachToContainerOptions{
+		Container:    containerID,
+		InputStream:  in,
+		OutputStream: out,
+		ErrorStream:  out,
+		Stdin:        true,
+		Stdout:       true,
+		Stderr:       true,
+		Stream:       true,
+		RawTerminal:  true,
+		Success:      success,
+	}
+
+	go func() {
+		attacherr <- c.client.AttachToContainer(attachOpts)
+	}()
+
+	success <- <-success
+
+	if err := c.client.StartContainer(containerID, &docker.HostConfig{}); err != nil {
+		return err
+	}
+
+	type waitResult struct {
+		statusCode int
+		err        error
+	}
+	waitch := make(chan waitResult, 1)
+	go func() {
+		statusCode, err := c.client.WaitContainer(containerID)
+		waitch <- waitResult{statusCode, err}
+	}()
+
+	var statusCode int
+	select {
+	case res := <-waitch:
+		if res.err != nil {
+			return res.err
 		}
-		// TODO: send signal to builder.Run() and have a proper cleanup
-		os.Exit(2)
+		statusCode = res.statusCode
+	case <-ctx.Done():
+		c.log.Infof("| Stop the container %.12s", containerID)
+		if err := c.client.StopContainer(containerID, 10); err != nil {
+			c.log.Errorf("Failed to stop container: %s", err)
+		}
+		return contextError(ctx, fmt.Sprintf("while container %.12s was running", containerID))
+	}
+
+	// Let the rest of the output through
+	if err := <-attacherr; err != nil {
+		c.log.Debugf("Attach to container %.12s finished with error: %s", containerID, err)
+	}
+
+	if statusCode != 0 {
+		return WithExitCode(ExitStep, fmt.Errorf("Container %.12s exited with code %d", containerID, statusCode))
 	}
 
 	return nil
@@ -398,9 +656,32 @@ func (c *DockerClient) CommitContainer(s *State) (*docker.Image, error) {
 		Run:       &s.Config,
 	}
 
+	if err := c.checkCommitCapabilities(s); err != nil {
+		return nil, err
+	}
+
 	c.log.Debugf("Commit container: %# v", pretty.Formatter(commitOpts))
 
-	image, err := c.client.CommitContainer(commitOpts)
+	// HEALTHCHECK and SHELL are not supported by the client library either.
+	// Rootless daemons may not be able to pause containers, and Podman takes
+	// the config only as changes
+	commit := c.client.CommitContainer
+	noPause := c.noCommitPause || c.isRootless
+	if noPause || c.podman || s.Healthcheck != nil || len(s.Shell) > 0 {
+		commit = func(opts docker.CommitContainerOptions) (*docker.Image, error) {
+			extra := dockerclient.CommitOptions{
+				NoPause:     noPause,
+				Healthcheck: s.Healthcheck,
+				Shell:       s.Shell,
+			}
+			if c.podman {
+				extra.Changes = podmanChanges(s.Config)
+			}
+			return dockerclient.CommitContainerWithOptions(c.client, opts, extra)
+		}
+	}
+
+	image, err := commit(commitOpts)
 	if err != nil {
 		return nil, err
 	}
@@ -442,7 +723,12 @@ func (c *DockerClient) RemoveContainer(containerID string) error {
 		RemoveVolumes: true,
 	}
 
-	return c.client.RemoveContainer(opts)
+	if err := c.client.RemoveContainer(opts); err != nil {
+		return err
+	}
+	c.interrupts.track(containerID, false)
+
+	return nil
 }
 
 // UploadToContainer uploads files to a docker container
@@ -458,6 +744,60 @@ func (c *DockerClient) UploadToContainer(containerID string, stream io.Reader, p
 	return c.client.UploadToContainer(containerID, opts)
 }
 
+// ImportContainer exports the filesystem of a container and imports it back
+// as a new single layer image with the given name, leaving out the excluded
+// paths; the image has no config
+func (c *DockerClient) ImportContainer(containerID, imageName string, exclude []string) (*docker.Image, error) {
+	var (
+		img                    = imagename.NewFromString(imageName)
+		pipeReader, pipeWriter = io.Pipe()
+		errch                  = make(chan error, 1)
+	)
+
+	c.log.Infof("| Flatten container %.12s to %s", containerID, img)
+
+	go func() {
+		var err error
+		if len(exclude) == 0 {
+			err = c.client.ExportContainer(docker.ExportContainerOptions{
+				ID:           containerID,
+				OutputStream: pipeWriter,
+			})
+		} else {
+			exportReader, exportWriter := io.Pipe()
+			go func() {
+				exportWriter.CloseWithError(c.client.ExportContainer(docker.ExportContainerOptions{
+					ID:           containerID,
+					OutputStream: exportWriter,
+				}))
+			}()
+			err = excludeFromTar(exportReader, pipeWriter, exclude)
+			exportReader.CloseWithError(err)
+		}
+		pipeWriter.CloseWithError(err)
+		errch <- err
+	}()
+
+	importOpts := docker.ImportImageOptions{
+		Repository:   img.NameWithRegistry(),
+		Tag:          img.GetTag(),
+		Source:       "-",
+		InputStream:  pipeReader,
+		OutputStream: ioutil.Discard,
+	}
+
+	if err := c.client.ImportImage(importOpts); err != nil {
+		pipeReader.CloseWithError(err)
+		return nil, err
+	}
+
+	if err := <-errch; err != nil {
+		return nil, fmt.Errorf("Failed to export container %.12s, error: %s", containerID, err)
+	}
+
+	return c.client.InspectImage(img.String())
+}
+
 // TagImage adds tag to the image
 func (c *DockerClient) TagImage(imageID, imageName string) error {
 	img := imagename.NewFromString(imageName)
@@ -478,14 +818,244 @@ func (c *DockerClient) TagImage(imageID, imageName string) error {
 	return c.client.TagImage(imageID, opts)
 }
 
+// SquashImage merges the layers of the image above the first keepLayers ones into
+// a single layer: the image is saved, its layers are merged and it is loaded back
+func (c *DockerClient) SquashImage(imageID string, keepLayers int) (*docker.Image, error) {
+	c.log.Infof("| Squash image %.12s", imageID)
+
+	return c.rewriteImage(imageID, func(dir string) (string, []string, error) {
+		return squashSavedImage(dir, keepLayers, "SQUASH")
+	})
+}
+
+// NormalizeImage makes the layers of the image above the first keepLayers ones and
+// its config reproducible, see normalizeSavedImage
+func (c *DockerClient) NormalizeImage(imageID string, keepLayers int, epoch time.Time) (*docker.Image, error) {
+	c.log.Infof("| Normalize image %.12s", imageID)
+
+	return c.rewriteImage(imageID, func(dir string) (string, []string, error) {
+		return normalizeSavedImage(dir, keepLayers, epoch)
+	})
+}
+
+// rewriteImage saves the image to a temporary directory, lets rewrite change it
+// there and loads the files rewrite returns as the image with the returned id
+func (c *DockerClient) rewriteImage(imageID string, rewrite func(dir string) (newID string, files []string, err error)) (*docker.Image, error) {
+	dir, err := ioutil.TempDir("", "rocker-rewrite-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	pipeReader, pipeWriter := io.Pipe()
+	go func() {
+		pipeWriter.CloseWithError(c.client.ExportImages(docker.ExportImagesOptions{
+			Names:        []string{imageID},
+			OutputStream: pipeWriter,
+		}))
+	}()
+
+	err = extractSavedImage(pipeReader, dir)
+	pipeReader.CloseWithError(err)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to save image %.12s, error: %s", imageID, err)
+	}
+
+	newID, files, err := rewrite(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	loadReader, loadWriter := io.Pipe()
+	go func() {
+		loadWriter.CloseWithError(writeLoadArchive(dir, files, loadWriter))
+	}()
+
+	err = c.client.LoadImage(docker.LoadImageOptions{InputStream: loadReader})
+	loadReader.CloseWithError(err)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to load the rewritten image %.12s, error: %s", newID, err)
+	}
+
+	return c.client.InspectImage(newID)
+}
+
+// SaveImages writes the images to the stream as a tar archive in the format of `docker save`
+func (c *DockerClient) SaveImages(names []string, out io.Writer) error {
+	c.log.Infof("| Save %s", strings.Join(names, ", "))
+
+	return c.client.ExportImages(docker.ExportImagesOptions{
+		Names:        names,
+		OutputStream: out,
+	})
+}
+
+// ReadFileFromContainer reads a single regular file from the container filesystem,
+// the caller has to close the buffer
+func (c *DockerClient) ReadFileFromContainer(containerID, path string) (*spill.Buffer, error) {
+	var (
+		pipeReader, pipeWriter = io.Pipe()
+		errch                  = make(chan error, 1)
+	)
+
+	go func() {
+		err := c.client.DownloadFromContainer(containerID, docker.DownloadFromContainerOptions{
+			Path:         path,
+			OutputStream: pipeWriter,
+		})
+		pipeWriter.CloseWithError(err)
+		errch <- err
+	}()
+
+	content, err := readSingleFileFromTar(pipeReader)
+	pipeReader.CloseWithError(err)
+
+	if downloadErr := <-errch; downloadErr != nil {
+		if content != nil {
+			content.Close()
+		}
+		return nil, fmt.Errorf("Failed to read %s from container %.12s, error: %s", path, containerID, downloadErr)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read %s from container %.12s, error: %s", path, containerID, err)
+	}
+
+	return content, nil
+}
+
+// DownloadFromContainer writes the tar archive of the given path of the container
+// to out; the entries are named after the base name of the path
+func (c *DockerClient) DownloadFromContainer(containerID, path string, out io.Writer) error {
+	c.log.Debugf("Download %s from container %.12s", path, containerID)
+
+	err := c.client.DownloadFromContainer(containerID, docker.DownloadFromContainerOptions{
+		Path:         path,
+		OutputStream: out,
+	})
+	if err != nil {
+		return fmt.Errorf("Failed to download %s from container %.12s, error: %s", path, containerID, err)
+	}
+
+	return nil
+}
+
+// readSingleFileFromTar returns the content of the only entry of the tar stream,
+// which has to be a regular file; it goes to disk beyond the memory budget
+func readSingleFileFromTar(r io.Reader) (*spill.Buffer, error) {
+	tr := tar.NewReader(r)
+
+	hdr, err := tr.Next()
+	if err == io.EOF {
+		return nil, fmt.Errorf("archive is empty")
+	}
+	if err != nil {
+		return nil, err
+	}
+	if hdr.Typeflag != tar.TypeReg {
+		return nil, fmt.Errorf("%s is not a regular file", hdr.Name)
+	}
+
+	content := spill.NewBuffer()
+	if _, err := io.Copy(content, tr); err != nil {
+		content.Close()
+		return nil, err
+	}
+
+	// Drain the rest, so the writer is not blocked
+	io.Copy(ioutil.Discard, r)
+
+	return content, nil
+}
+
+// PushArtifact pushes a file as an OCI artifact with the given name
+func (c *DockerClient) PushArtifact(imageName string, artifact dockerclient.OCIArtifact) (digest string, err error) {
+	if err = c.checkOnline("push", imageName); err != nil {
+		return "", err
+	}
+
+	img := imagename.NewFromString(imageName)
+
+	if img.Storage == imagename.StorageS3 {
+		return "", fmt.Errorf("Artifacts can only be pushed to a docker registry, got %s", imageName)
+	}
+
+	c.log.Infof("| Push artifact %s (%s) to %s", artifact.Name, units.HumanSize(float64(artifact.Size())), img)
+
+	return dockerclient.RegistryPushArtifact(img, c.auth, artifact)
+}
+
+// AttachArtifact pushes a file as an OCI artifact that refers to the image,
+// to the repository of the image
+func (c *DockerClient) AttachArtifact(imageName string, artifact dockerclient.OCIArtifact) (digest string, err error) {
+	if err = c.checkOnline("push", imageName); err != nil {
+		return "", err
+	}
+
+	img := imagename.NewFromString(imageName)
+
+	if img.Storage == imagename.StorageS3 {
+		return "", fmt.Errorf("Artifacts can only be attached to images in a docker registry, got %s", imageName)
+	}
+
+	c.log.Infof("| Attach artifact %s (%s) to %s", artifact.Name, units.HumanSize(float64(artifact.Size())), img)
+
+	return dockerclient.RegistryAttachArtifact(img, c.auth, artifact)
+}
+
+// PullArtifact fetches the file of an OCI artifact with the given name
+func (c *DockerClient) PullArtifact(imageName string) (artifact dockerclient.OCIArtifact, err error) {
+	if err = c.checkOnline("pull", imageName); err != nil {
+		return artifact, err
+	}
+
+	img := imagename.NewFromString(imageName)
+
+	if img.Storage == imagename.StorageS3 {
+		return artifact, fmt.Errorf("Artifacts can only be pulled from a docker registry, got %s", imageName)
+	}
+
+	c.log.Infof("| Pull artifact %s", img)
+
+	return dockerclient.RegistryPullArtifact(img, c.auth)
+}
+
+// PushManifestList pushes the manifest list of the images that were pushed
+// to the same repository for different platforms
+func (c *DockerClient) PushManifestList(imageName string, entries []dockerclient.ManifestListEntry, annotations map[string]string) (digest string, err error) {
+	if err = c.checkOnline("push", imageName); err != nil {
+		return "", err
+	}
+
+	img := imagename.NewFromString(imageName)
+
+	if img.Storage == imagename.StorageS3 {
+		return "", fmt.Errorf("Manifest lists can only be pushed to a docker registry, got %s", imageName)
+	}
+
+	platforms := []string{}
+	for _, e := range entries {
+		platforms = append(platforms, e.Platform.String())
+	}
+	c.log.Infof("| Push manifest list %s of %s", img, strings.Join(platforms, ", "))
+
+	return dockerclient.RegistryPushManifestList(img, c.auth, entries, annotations)
+}
+
 // PushImage pushes the image, does retries if configured
-func (c *DockerClient) PushImage(imageName string) (digest string, err error) {
+func (c *DockerClient) PushImage(ctx context.Context, imageName string) (digest string, err error) {
+	if err = c.checkOnline("push", imageName); err != nil {
+		return "", err
+	}
+
 	n := 0
 
 	for {
-		if digest, err = c.pushImageInner(imageName); err == nil {
+		if digest, err = c.pushImageInner(ctx, imageName); err == nil {
 			return
 		}
+		if ctx.Err() != nil {
+			return "", contextError(ctx, fmt.Sprintf("while pushing %s", imageName))
+		}
 		if n == c.pushRetryCount {
 			if c.pushRetryCount > 0 {
 				c.log.Errorf("PUSH max retry count reached (%d), returning error", c.pushRetryCount)
@@ -501,8 +1071,23 @@ func (c *DockerClient) PushImage(imageName string) (digest string, err error) {
 	}
 }
 
+// UnpushImage deletes the pushed image from the registry by its digest
+func (c *DockerClient) UnpushImage(imageName, digest string) error {
+	if err := c.checkOnline("remove", imageName); err != nil {
+		return err
+	}
+
+	img := imagename.NewFromString(imageName)
+
+	if img.Storage == imagename.StorageS3 {
+		return fmt.Errorf("Removing images from S3 is not supported")
+	}
+
+	return dockerclient.RegistryDeleteManifest(img, c.auth, digest)
+}
+
 // pushImageInner pushes the image is the inner straightforward push without retries
-func (c *DockerClient) pushImageInner(imageName string) (digest string, err error) {
+func (c *DockerClient) pushImageInner(ctx context.Context, imageName string) (digest string, err error) {
 	img := imagename.NewFromString(imageName)
 
 	// Use direct S3 image pusher instead
@@ -514,9 +1099,10 @@ func (c *DockerClient) pushImageInner(imageName string) (digest string, err erro
 	}
 
 	var (
-		buf                    bytes.Buffer
+		digestOut              = &digestWriter{}
+		delta                  = newPushDelta()
 		pipeReader, pipeWriter = io.Pipe()
-		outStream              = io.MultiWriter(pipeWriter, &buf)
+		outStream              = &contextWriter{ctx: ctx, w: io.MultiWriter(pipeWriter, digestOut, delta)}
 		fdOut, isTerminalOut   = term.GetFdInfo(c.log.Out)
 		out                    = c.log.Out
 
@@ -543,7 +1129,7 @@ func (c *DockerClient) pushImageInner(imageName string) (digest string, err erro
 		errch <- jsonmessage.DisplayJSONMessagesStream(pipeReader, out, fdOut, isTerminalOut)
 	}()
 
-	auth, err := dockerclient.GetAuthForRegistry(c.auth, img)
+	auth, err := c.registryAuth(img)
 	if err != nil {
 		return "", fmt.Errorf("Failed to authenticate registry %s, error: %s", img.Registry, err)
 	}
@@ -557,22 +1143,116 @@ func (c *DockerClient) pushImageInner(imageName string) (digest string, err erro
 		return "", fmt.Errorf("Failed to process json stream, error %s", err)
 	}
 
+	if !delta.Empty() {
+		c.log.Infof("| Pushed %s: %s", img, delta)
+	}
+
 	// It is the best way to have pushed image digest so far
-	matches := captureDigest.FindStringSubmatch(buf.String())
-	if len(matches) > 0 {
-		digest = matches[1]
+	return digestOut.Digest(), nil
+}
+
+// digestWriter scans the push output stream line by line and only keeps
+// the digest, so the memory does not grow with the size of the output
+type digestWriter struct {
+	line   []byte
+	digest string
+}
+
+// maxDigestLine limits the length of a single buffered line of push output
+const maxDigestLine = 64 * 1024
+
+// Write implements io.Writer
+func (w *digestWriter) Write(p []byte) (int, error) {
+	for _, c := range p {
+		if c == '\n' {
+			w.flush()
+			continue
+		}
+		if len(w.line) < maxDigestLine {
+			w.line = append(w.line, c)
+		}
 	}
+	return len(p), nil
+}
 
-	return digest, nil
+// Digest returns the last digest seen in the stream
+func (w *digestWriter) Digest() string {
+	w.flush()
+	return w.digest
+}
+
+func (w *digestWriter) flush() {
+	if matches := captureDigest.FindSubmatch(w.line); len(matches) > 0 {
+		w.digest = string(matches[1])
+	}
+	w.line = w.line[:0]
+}
+
+// registryAuth returns the credentials for the registry of the image, taken
+// from the auth provider if there is one, or from the auth configurations
+func (c *DockerClient) registryAuth(image *imagename.ImageName) (docker.AuthConfiguration, error) {
+	if c.authProvider == nil {
+		return dockerclient.GetAuthForRegistry(c.auth, image)
+	}
+	creds, err := c.authProvider.GetCredentials(dockerclient.AuthRegistry(image))
+	return creds.AuthConfiguration, err
 }
 
 // ResolveHostPath proxy for the dockerclient.ResolveHostPath
 func (c *DockerClient) ResolveHostPath(path string) (resultPath string, err error) {
+	if c.isRemote {
+		c.log.Warnf("| MOUNT of %s binds the directory of the machine of the remote daemon, not of this one", path)
+	}
 	return dockerclient.ResolveHostPath(path, c.client, c.isUnixSocket, c.unixSockPath)
 }
 
+// withLog returns a copy of the client that logs to the given logger, and the
+// output of the containers with the same prefix, for the parallel stages
+func (c *DockerClient) withLog(l *logrus.Logger) Client {
+	c2 := *c
+	c2.log = l
+	if f, ok := l.Formatter.(*prefixFormatter); ok {
+		c2.stdoutContainerFormatter = &prefixFormatter{Formatter: c.stdoutContainerFormatter, prefix: f.prefix}
+		c2.stderrContainerFormatter = &prefixFormatter{Formatter: c.stderrContainerFormatter, prefix: f.prefix}
+	}
+	return &c2
+}
+
+// capabilities returns what the daemon supports, nil if unknown
+func (c *DockerClient) capabilities() *dockerclient.DaemonCapabilities {
+	return c.caps
+}
+
+// checkCommitCapabilities makes sure the daemon can store the config of the state
+func (c *DockerClient) checkCommitCapabilities(s *State) error {
+	if s.Healthcheck != nil {
+		if err := c.caps.Require(dockerclient.CapHealthcheck); err != nil {
+			return WithExitCode(ExitInfra, err)
+		}
+		if s.Healthcheck.StartPeriod != 0 {
+			if err := c.caps.Require(dockerclient.CapHealthcheckStartPeriod); err != nil {
+				return WithExitCode(ExitInfra, err)
+			}
+		}
+	}
+	if len(s.Shell) > 0 {
+		if err := c.caps.Require(dockerclient.CapShell); err != nil {
+			return WithExitCode(ExitInfra, err)
+		}
+	}
+	return nil
+}
+
+// checkOnline returns an error if the client is not allowed to touch the network
+func (c *DockerClient) checkOnline(action, imageName string) error {
+	if c.offline {
+		return fmt.Errorf("Cannot %s %s in offline mode", action, imageName)
+	}
+	return nil
+}
+
 // EnsureImage checks if the image exists and pulls if not
-func (c *DockerClient) EnsureImage(imageName string) (err error) {
+func (c *DockerClient) EnsureImage(ctx context.Context, imageName string) (err error) {
 
 	var img *docker.Image
 	if img, err = c.client.InspectImage(imageName); err != nil && err != docker.ErrNoSuchImage {
@@ -582,12 +1262,12 @@ func (c *DockerClient) EnsureImage(imageName string) (err error) {
 		return nil
 	}
 
-	return c.PullImage(imageName)
+	return c.PullImage(ctx, imageName)
 }
 
 // EnsureContainer checks if container with specified name exists
 // and creates it otherwise
-func (c *DockerClient) EnsureContainer(containerName string, config *docker.Config, hostConfig *docker.HostConfig, purpose string) (containerID string, err error) {
+func (c *DockerClient) EnsureContainer(ctx context.Context, containerName string, config *docker.Config, hostConfig *docker.HostConfig, purpose string) (containerID string, err error) {
 
 	// Check if container exists
 	container, err := c.client.InspectContainer(containerName)
@@ -601,7 +1281,7 @@ func (c *DockerClient) EnsureContainer(containerName string, config *docker.Conf
 
 	// No data volume container for this build, create it
 
-	if err := c.EnsureImage(config.Image); err != nil {
+	if err := c.EnsureImage(ctx, config.Image); err != nil {
 		return "", fmt.Errorf("Failed to check image %s, error: %s", config.Image, err)
 	}
 
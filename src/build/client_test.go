@@ -0,0 +1,81 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDigestWriter(t *testing.T) {
+	w := &digestWriter{}
+
+	stream := `{"status":"Pushing","progressDetail":{"current":512,"total":1024}}
+{"status":"latest: digest: sha256:` + strings.Repeat("ab", 32) + ` size: 1234"}
+{"status":"done"}
+`
+	// Feed in small chunks to make sure lines are joined across writes
+	for i := 0; i < len(stream); i += 7 {
+		end := i + 7
+		if end > len(stream) {
+			end = len(stream)
+		}
+		w.Write([]byte(stream[i:end]))
+	}
+
+	assert.Equal(t, "sha256:"+strings.Repeat("ab", 32), w.Digest())
+}
+
+func TestPushDelta(t *testing.T) {
+	d := newPushDelta()
+	assert.True(t, d.Empty())
+
+	d.Write([]byte(`{"status":"The push refers to a repository [quay.io/app]"}
+{"status":"Preparing","progressDetail":{},"id":"aaa"}
+{"status":"Preparing","progressDetail":{},"id":"bbb"}
+{"status":"Preparing","progressDetail":{},"id":"ccc"}
+{"status":"Layer already exists","progressDetail":{},"id":"aaa"}
+{"status":"Mounted from library/alpine","progressDetail":{},"id":"bbb"}
+{"status":"Pushing","progressDetail":{"current":512,"total":2000},"id":"ccc"}
+{"status":"Pushing","progressDetail":{"current":2000,"total":2000},"id":"ccc"}
+{"status":"Pushed","progressDetail":{},"id":"ccc"}
+`))
+
+	assert.False(t, d.Empty())
+	assert.Equal(t, "2 layers reused, 1 uploaded (2 kB)", d.String())
+}
+
+func TestParseAttachInterrupt(t *testing.T) {
+	for value, expected := range map[string]string{
+		"":          AttachInterruptStopStep,
+		"stop-step": AttachInterruptStopStep,
+		"forward":   AttachInterruptForward,
+	} {
+		result, err := ParseAttachInterrupt(value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, expected, result)
+	}
+
+	_, err := ParseAttachInterrupt("ignore")
+	assert.Error(t, err)
+
+	assert.NotEmpty(t, attachSignals())
+}
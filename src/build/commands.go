@@ -17,27 +17,29 @@
 package build
 
 import (
+	"context"
+	"crypto/sha256"
 	"fmt"
-	"io/ioutil"
 	"os"
 	"path"
 	"path/filepath"
 	"regexp"
 	"sort"
+	"strconv"
 	"strings"
 	"time"
 
-	"github.com/go-yaml/yaml"
+	"github.com/grammarly/rocker/src/dockerclient"
 	"github.com/grammarly/rocker/src/imagename"
 	"github.com/grammarly/rocker/src/shellparser"
 	"github.com/grammarly/rocker/src/util"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/docker/docker/pkg/nat"
+	"github.com/docker/docker/pkg/signal"
 	"github.com/docker/docker/pkg/units"
 	runconfigopts "github.com/docker/docker/runconfig/opts"
 	"github.com/fsouza/go-dockerclient"
-	"github.com/kr/pretty"
 )
 
 // ConfigCommand configuration parameters for any command
@@ -55,8 +57,10 @@ type Command interface {
 	// Execute does the command execution and returns modified state.
 	// Note that here we use State not by reference because we want
 	// it to be immutable. In future, it may encoded/decoded from json
-	// and passed to the external command implementations.
-	Execute(b *Build) (State, error)
+	// and passed to the external command implementations. The context is
+	// done when the build is cancelled or times out; the pulls, pushes and
+	// containers the command waits for are stopped then.
+	Execute(ctx context.Context, b *Build) (State, error)
 
 	// Returns true if the command should be executed
 	ShouldRun(b *Build) (bool, error)
@@ -101,6 +105,12 @@ func NewCommand(cfg ConfigCommand) (cmd Command) {
 		cmd = &CommandCmd{CommandBase{cfg}}
 	case "entrypoint":
 		cmd = &CommandEntrypoint{CommandBase{cfg}}
+	case "healthcheck":
+		cmd = &CommandHealthcheck{CommandBase{cfg}}
+	case "shell":
+		cmd = &CommandShell{CommandBase{cfg}}
+	case "stopsignal":
+		cmd = &CommandStopsignal{CommandBase{cfg}}
 	case "expose":
 		cmd = &CommandExpose{CommandBase{cfg}}
 	case "volume":
@@ -117,6 +127,20 @@ func NewCommand(cfg ConfigCommand) (cmd Command) {
 		cmd = &CommandImport{CommandBase{cfg}}
 	case "arg":
 		cmd = &CommandArg{CommandBase{cfg}}
+	case "flatten":
+		cmd = &CommandFlatten{CommandBase{cfg}}
+	case "remove":
+		cmd = &CommandRemove{CommandBase{cfg}}
+	case "squash":
+		cmd = &CommandSquash{CommandBase{cfg}}
+	case "normalize":
+		cmd = &CommandNormalize{CommandBase{cfg}}
+	case "context":
+		cmd = &CommandContext{CommandBase{cfg}}
+	case "publish":
+		cmd = &CommandPublish{CommandBase{cfg}}
+	case "helm_package":
+		cmd = &CommandHelmPackage{CommandBase{cfg}}
 	default:
 		panic(fmt.Sprintf("Unknown command: %s", cfg.name))
 	}
@@ -150,17 +174,24 @@ type CommandFrom struct {
 }
 
 // Execute runs the command
-func (c *CommandFrom) Execute(b *Build) (s State, err error) {
+func (c *CommandFrom) Execute(ctx context.Context, b *Build) (s State, err error) {
 	// TODO: for "scratch" image we may use /images/create
 
-	if len(c.cfg.args) != 1 {
-		return s, fmt.Errorf("FROM requires one argument")
+	name, stage, err := fromArgs(c.cfg.args)
+	if err != nil {
+		return s, err
 	}
 
-	var (
-		img  *docker.Image
-		name = c.cfg.args[0]
-	)
+	if stage != "" {
+		if _, ok := b.stages[stage]; ok || stage == b.stage {
+			return s, fmt.Errorf("FROM: duplicate stage name %s", stage)
+		}
+	}
+	b.stage = stage
+	b.fromImageID = ""
+	b.lazyFrom = nil
+
+	var img *docker.Image
 
 	if name == "scratch" {
 		s.NoBaseImage = true
@@ -171,7 +202,12 @@ func (c *CommandFrom) Execute(b *Build) (s State, err error) {
 		return s, nil
 	}
 
-	if img, err = b.lookupImage(name); err != nil {
+	// A previous stage can be the base of the following ones
+	if prev, ok := b.stages[strings.ToLower(name)]; ok && prev.ImageID != "" {
+		if img, err = b.client.InspectImage(prev.ImageID); err != nil {
+			return s, fmt.Errorf("FROM error: %s", err)
+		}
+	} else if img, err = b.fromImage(ctx, name); err != nil {
 		return s, fmt.Errorf("FROM error: %s", err)
 	}
 
@@ -179,13 +215,20 @@ func (c *CommandFrom) Execute(b *Build) (s State, err error) {
 		return s, fmt.Errorf("FROM: image %s not found", name)
 	}
 
+	if _, ok := b.stages[strings.ToLower(name)]; !ok {
+		b.checkEOL(name)
+	}
+
 	// We want to say the size of the FROM image. Better to do it
 	// from the client, but don't know how to do it better,
 	// without duplicating InspectImage calls and making unnecessary functions
 
 	s = b.state
 	s.ImageID = img.ID
+	b.fromImageID = img.ID
 	s.Config = docker.Config{}
+	s.Healthcheck = nil
+	s.Shell = nil
 
 	s.Size = img.VirtualSize
 
@@ -210,14 +253,18 @@ func (c *CommandFrom) Execute(b *Build) (s State, err error) {
 		fields["size"] = units.HumanSize(float64(img.VirtualSize))
 	}
 
-	log.WithFields(fields).Infof("| Image %.12s", img.ID)
+	if b.lazyFrom != nil {
+		b.log.WithFields(fields).Infof("| Image %.12s, not pulled until a step needs it", img.ID)
+	} else {
+		b.log.WithFields(fields).Infof("| Image %.12s", img.ID)
+	}
 
 	// If we don't have OnBuild triggers, then we are done
 	if len(s.Config.OnBuild) == 0 {
 		return s, nil
 	}
 
-	log.Infof("| Found %d ONBUILD triggers", len(s.Config.OnBuild))
+	b.log.Infof("| Found %d ONBUILD triggers", len(s.Config.OnBuild))
 
 	// Remove them from the config, since the config will be committed.
 	s.InjectCommands = s.Config.OnBuild
@@ -232,7 +279,7 @@ type CommandMaintainer struct {
 }
 
 // Execute runs the command
-func (c *CommandMaintainer) Execute(b *Build) (State, error) {
+func (c *CommandMaintainer) Execute(ctx context.Context, b *Build) (State, error) {
 	if len(c.cfg.args) != 1 {
 		return b.state, fmt.Errorf("MAINTAINER requires exactly one argument")
 	}
@@ -259,10 +306,14 @@ func (c *CommandCleanup) ShouldRun(b *Build) (bool, error) {
 }
 
 // Execute runs the command
-func (c *CommandCleanup) Execute(b *Build) (State, error) {
+func (c *CommandCleanup) Execute(ctx context.Context, b *Build) (State, error) {
 	s := b.state
 
-	if b.cfg.NoGarbage && !c.tagged && s.ImageID != "" && s.ProducedImage {
+	// Named stages are kept for COPY --from and FROM of the stage, also the images
+	if b.stage != "" {
+		b.stages[b.stage] = s
+		b.stage = ""
+	} else if b.cfg.NoGarbage && !c.tagged && s.ImageID != "" && s.ProducedImage {
 		if err := b.client.RemoveImage(s.ImageID); err != nil {
 			return s, err
 		}
@@ -279,12 +330,16 @@ func (c *CommandCleanup) Execute(b *Build) (State, error) {
 	if c.final {
 		s.ImageID = dirtyState.ImageID
 	} else {
-		log.Infof("====================================")
+		b.log.Infof("====================================")
 	}
 
 	return s, nil
 }
 
+// ImageLabel is stamped on every image rocker commits, whatever the flags are, so
+// rocker clean can tell them apart; the value never changes, so --reproducible keeps it
+const ImageLabel = "rocker.managed"
+
 // CommandCommit commits collected changes
 type CommandCommit struct{}
 
@@ -299,7 +354,7 @@ func (c *CommandCommit) ShouldRun(b *Build) (bool, error) {
 }
 
 // Execute runs the command
-func (c *CommandCommit) Execute(b *Build) (s State, err error) {
+func (c *CommandCommit) Execute(ctx context.Context, b *Build) (s State, err error) {
 	s = b.state
 
 	commits := s.GetCommits()
@@ -312,7 +367,7 @@ func (c *CommandCommit) Execute(b *Build) (s State, err error) {
 	}
 
 	// TODO: ?
-	// if len(commits) == 0 && s.NoCache.ContainerID == "" { log.Infof("| Skip")
+	// if len(commits) == 0 && s.NoCache.ContainerID == "" { b.log.Infof("| Skip")
 
 	// TODO: verify that we need to check cache in commit only for
 	//       a non-container actions
@@ -321,7 +376,7 @@ func (c *CommandCommit) Execute(b *Build) (s State, err error) {
 
 		// Check cache
 		var hit bool
-		s, hit, err = b.probeCache(s)
+		s, hit, err = b.probeCache(ctx, s)
 		if err != nil {
 			return s, err
 		}
@@ -342,10 +397,21 @@ func (c *CommandCommit) Execute(b *Build) (s State, err error) {
 	defer func(id string) {
 		s.CleanCommits()
 		if err := b.client.RemoveContainer(id); err != nil {
-			log.Errorf("Failed to remove temporary container %.12s, error: %s", id, err)
+			b.log.Errorf("Failed to remove temporary container %.12s, error: %s", id, err)
 		}
 	}(s.NoCache.ContainerID)
 
+	// Stamp the builder environment, it does not participate in the cache key
+	labels := map[string]string{}
+	for k, v := range s.Config.Labels {
+		labels[k] = v
+	}
+	for k, v := range b.cfg.Labels {
+		labels[k] = v
+	}
+	labels[ImageLabel] = "true"
+	s.Config.Labels = labels
+
 	var img *docker.Image
 	if img, err = b.client.CommitContainer(&s); err != nil {
 		return s, err
@@ -375,7 +441,7 @@ type CommandRun struct {
 }
 
 // Execute runs the command
-func (c *CommandRun) Execute(b *Build) (s State, err error) {
+func (c *CommandRun) Execute(ctx context.Context, b *Build) (s State, err error) {
 	s = b.state
 
 	if s.ImageID == "" && !s.NoBaseImage {
@@ -385,10 +451,11 @@ func (c *CommandRun) Execute(b *Build) (s State, err error) {
 	cmd := handleJSONArgs(c.cfg.args, c.cfg.attrs)
 
 	if !c.cfg.attrs["json"] {
-		cmd = append([]string{"/bin/sh", "-c"}, cmd...)
+		cmd = append(s.shell(), cmd...)
 	}
 
 	buildEnv := []string{}
+	saveEnv := []string{}
 	configEnv := runconfigopts.ConvertKVStringsToMap(s.Config.Env)
 	for key, val := range s.NoCache.BuildArgs {
 		if !b.allowedBuildArgs[key] {
@@ -401,6 +468,13 @@ func (c *CommandRun) Execute(b *Build) (s State, err error) {
 		}
 		if _, ok := configEnv[key]; !ok {
 			buildEnv = append(buildEnv, fmt.Sprintf("%s=%s", key, val))
+
+			// Commits end up in the cache files and in the logs, so sensitive
+			// values are kept there only as a hash that still busts the cache
+			if b.cfg.SensitiveBuildArgs[key] {
+				val = fmt.Sprintf("sha256:%x", sha256.Sum256([]byte(val)))
+			}
+			saveEnv = append(saveEnv, fmt.Sprintf("%s=%s", key, val))
 		}
 	}
 
@@ -412,16 +486,16 @@ func (c *CommandRun) Execute(b *Build) (s State, err error) {
 	// help ensure proper cache matches. We don't want a RUN command
 	// that starts with "foo=abc" to be considered part of a build-time env var.
 	saveCmd := cmd
-	if len(buildEnv) > 0 {
-		sort.Strings(buildEnv)
-		tmpEnv := append([]string{fmt.Sprintf("|%d", len(buildEnv))}, buildEnv...)
+	if len(saveEnv) > 0 {
+		sort.Strings(saveEnv)
+		tmpEnv := append([]string{fmt.Sprintf("|%d", len(saveEnv))}, saveEnv...)
 		saveCmd = append(tmpEnv, saveCmd...)
 	}
 
 	s.Commit("RUN %q", saveCmd)
 
 	// Check cache
-	s, hit, err := b.probeCache(s)
+	s, hit, err := b.probeCache(ctx, s)
 	if err != nil {
 		return s, err
 	}
@@ -441,7 +515,8 @@ func (c *CommandRun) Execute(b *Build) (s State, err error) {
 		return s, err
 	}
 
-	if err = b.client.RunContainer(s.NoCache.ContainerID, false); err != nil {
+	if err = b.client.RunContainer(ctx, s.NoCache.ContainerID, false); err != nil {
+		b.debugFailedRun(ctx, s, err)
 		b.client.RemoveContainer(s.NoCache.ContainerID)
 		return s, err
 	}
@@ -460,13 +535,29 @@ type CommandAttach struct {
 }
 
 // Execute runs the command
-func (c *CommandAttach) Execute(b *Build) (s State, err error) {
+func (c *CommandAttach) Execute(ctx context.Context, b *Build) (s State, err error) {
 	s = b.state
 
+	// Scripted ATTACH does not need a human, so it always runs
+	if script := c.cfg.flags["script"]; script != "" {
+		if s.ImageID == "" && !s.NoBaseImage {
+			return s, fmt.Errorf("Please provide a source image with `FROM` prior to ATTACH")
+		}
+
+		cmd := handleJSONArgs(c.cfg.args, c.cfg.attrs)
+		if len(cmd) == 0 {
+			cmd = []string{"/bin/sh"}
+		} else if !c.cfg.attrs["json"] {
+			cmd = append(s.shell(), cmd...)
+		}
+
+		return b.runAttachScript(ctx, s, cmd, script)
+	}
+
 	// simply ignore this command if we don't wanna attach
 	// TODO: skip via ShouldRun() ?
 	if !b.cfg.Attach {
-		log.Infof("Skip ATTACH; use --attach option to get inside")
+		b.log.Infof("Skip ATTACH; use --attach option to get inside")
 		// s.SkipCommit()
 		return s, nil
 	}
@@ -480,7 +571,7 @@ func (c *CommandAttach) Execute(b *Build) (s State, err error) {
 	if len(cmd) == 0 {
 		cmd = []string{"/bin/sh"}
 	} else if !c.cfg.attrs["json"] {
-		cmd = append([]string{"/bin/sh", "-c"}, cmd...)
+		cmd = append(s.shell(), cmd...)
 	}
 
 	// TODO: do s.commit unique
@@ -506,7 +597,7 @@ func (c *CommandAttach) Execute(b *Build) (s State, err error) {
 		return s, err
 	}
 
-	if err = b.client.RunContainer(s.NoCache.ContainerID, true); err != nil {
+	if err = b.client.RunContainer(ctx, s.NoCache.ContainerID, true); err != nil {
 		b.client.RemoveContainer(s.NoCache.ContainerID)
 		return s, err
 	}
@@ -525,7 +616,7 @@ func (c *CommandEnv) ReplaceEnv(env []string) error {
 }
 
 // Execute runs the command
-func (c *CommandEnv) Execute(b *Build) (s State, err error) {
+func (c *CommandEnv) Execute(ctx context.Context, b *Build) (s State, err error) {
 
 	s = b.state
 	args := c.cfg.args
@@ -561,7 +652,7 @@ func (c *CommandEnv) Execute(b *Build) (s State, err error) {
 		}
 	}
 
-	s.Commit(commitStr)
+	s.Commit("%s", commitStr)
 
 	return s, nil
 }
@@ -577,7 +668,7 @@ func (c *CommandLabel) ReplaceEnv(env []string) error {
 }
 
 // Execute runs the command
-func (c *CommandLabel) Execute(b *Build) (s State, err error) {
+func (c *CommandLabel) Execute(ctx context.Context, b *Build) (s State, err error) {
 
 	s = b.state
 	args := c.cfg.args
@@ -607,7 +698,7 @@ func (c *CommandLabel) Execute(b *Build) (s State, err error) {
 		j++
 	}
 
-	s.Commit(commitStr)
+	s.Commit("%s", commitStr)
 
 	return s, nil
 }
@@ -623,7 +714,7 @@ func (c *CommandWorkdir) ReplaceEnv(env []string) error {
 }
 
 // Execute runs the command
-func (c *CommandWorkdir) Execute(b *Build) (s State, err error) {
+func (c *CommandWorkdir) Execute(ctx context.Context, b *Build) (s State, err error) {
 
 	s = b.state
 
@@ -640,7 +731,7 @@ func (c *CommandWorkdir) Execute(b *Build) (s State, err error) {
 
 	s.Config.WorkingDir = workdir
 
-	s.Commit(fmt.Sprintf("WORKDIR %v", workdir))
+	s.Commit("WORKDIR %v", workdir)
 
 	return s, nil
 }
@@ -651,18 +742,18 @@ type CommandCmd struct {
 }
 
 // Execute runs the command
-func (c *CommandCmd) Execute(b *Build) (s State, err error) {
+func (c *CommandCmd) Execute(ctx context.Context, b *Build) (s State, err error) {
 	s = b.state
 
 	cmd := handleJSONArgs(c.cfg.args, c.cfg.attrs)
 
 	if !c.cfg.attrs["json"] {
-		cmd = append([]string{"/bin/sh", "-c"}, cmd...)
+		cmd = append(s.shell(), cmd...)
 	}
 
 	s.Config.Cmd = cmd
 
-	s.Commit(fmt.Sprintf("CMD %q", cmd))
+	s.Commit("CMD %q", cmd)
 
 	if len(c.cfg.args) != 0 {
 		s.NoCache.CmdSet = true
@@ -677,7 +768,7 @@ type CommandEntrypoint struct {
 }
 
 // Execute runs the command
-func (c *CommandEntrypoint) Execute(b *Build) (s State, err error) {
+func (c *CommandEntrypoint) Execute(ctx context.Context, b *Build) (s State, err error) {
 	s = b.state
 
 	parsed := handleJSONArgs(c.cfg.args, c.cfg.attrs)
@@ -691,10 +782,10 @@ func (c *CommandEntrypoint) Execute(b *Build) (s State, err error) {
 		s.Config.Entrypoint = []string{}
 	default:
 		// ENTRYPOINT echo hi
-		s.Config.Entrypoint = []string{"/bin/sh", "-c", parsed[0]}
+		s.Config.Entrypoint = append(s.shell(), parsed[0])
 	}
 
-	s.Commit(fmt.Sprintf("ENTRYPOINT %q", s.Config.Entrypoint))
+	s.Commit("ENTRYPOINT %q", s.Config.Entrypoint)
 
 	// TODO: test this
 	// when setting the entrypoint if a CMD was not explicitly set then
@@ -706,6 +797,112 @@ func (c *CommandEntrypoint) Execute(b *Build) (s State, err error) {
 	return s, nil
 }
 
+// CommandShell implements SHELL
+type CommandShell struct {
+	CommandBase
+}
+
+// Execute runs the command
+func (c *CommandShell) Execute(ctx context.Context, b *Build) (s State, err error) {
+	s = b.state
+
+	if !c.cfg.attrs["json"] {
+		return s, fmt.Errorf("SHELL requires the arguments to be in JSON form")
+	}
+
+	shell := handleJSONArgs(c.cfg.args, c.cfg.attrs)
+	if len(shell) == 0 {
+		return s, fmt.Errorf("SHELL requires at least one argument")
+	}
+
+	s.Shell = shell
+	s.Commit("SHELL %q", shell)
+
+	return s, nil
+}
+
+// CommandHealthcheck implements HEALTHCHECK
+type CommandHealthcheck struct {
+	CommandBase
+}
+
+// Execute runs the command
+func (c *CommandHealthcheck) Execute(ctx context.Context, b *Build) (s State, err error) {
+	s = b.state
+
+	if len(c.cfg.args) == 0 {
+		return s, fmt.Errorf("HEALTHCHECK requires an argument")
+	}
+
+	switch typ := strings.ToUpper(c.cfg.args[0]); typ {
+	case "NONE":
+		if len(c.cfg.args) != 1 {
+			return s, fmt.Errorf("HEALTHCHECK NONE takes no arguments")
+		}
+		if len(c.cfg.flags) > 0 {
+			return s, fmt.Errorf("HEALTHCHECK NONE takes no flags")
+		}
+		s.Healthcheck = &dockerclient.HealthConfig{Test: []string{typ}}
+
+	case "CMD":
+		cmd := handleJSONArgs(c.cfg.args[1:], c.cfg.attrs)
+		if len(cmd) == 0 {
+			return s, fmt.Errorf("HEALTHCHECK CMD requires a command")
+		}
+
+		health := &dockerclient.HealthConfig{}
+
+		if c.cfg.attrs["json"] {
+			health.Test = append([]string{"CMD"}, cmd...)
+		} else {
+			health.Test = append([]string{"CMD-SHELL"}, cmd...)
+		}
+
+		for name, value := range c.cfg.flags {
+			switch name {
+			case "interval":
+				health.Interval, err = parseHealthDuration(name, value)
+			case "timeout":
+				health.Timeout, err = parseHealthDuration(name, value)
+			case "start-period":
+				health.StartPeriod, err = parseHealthDuration(name, value)
+			case "retries":
+				if health.Retries, err = strconv.Atoi(value); err == nil && health.Retries < 0 {
+					err = fmt.Errorf("--retries cannot be negative (%d)", health.Retries)
+				}
+			default:
+				err = fmt.Errorf("Unknown flag --%s", name)
+			}
+			if err != nil {
+				return s, fmt.Errorf("HEALTHCHECK: %s", err)
+			}
+		}
+
+		s.Healthcheck = health
+
+	default:
+		return s, fmt.Errorf("Unknown type %q in HEALTHCHECK (try CMD)", c.cfg.args[0])
+	}
+
+	h := s.Healthcheck
+	s.Commit("HEALTHCHECK %q interval=%s timeout=%s start-period=%s retries=%d",
+		h.Test, h.Interval, h.Timeout, h.StartPeriod, h.Retries)
+
+	return s, nil
+}
+
+// parseHealthDuration parses the HEALTHCHECK durations, zero means the daemon default
+func parseHealthDuration(name, value string) (time.Duration, error) {
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid --%s %q, error: %s", name, value, err)
+	}
+	if d != 0 && d < time.Millisecond {
+		return 0, fmt.Errorf("--%s cannot be less than 1ms", name)
+	}
+	return d, nil
+}
+
 // CommandExpose implements EXPOSE
 type CommandExpose struct {
 	CommandBase
@@ -717,7 +914,7 @@ func (c *CommandExpose) ReplaceEnv(env []string) error {
 }
 
 // Execute runs the command
-func (c *CommandExpose) Execute(b *Build) (s State, err error) {
+func (c *CommandExpose) Execute(ctx context.Context, b *Build) (s State, err error) {
 
 	s = b.state
 
@@ -750,7 +947,7 @@ func (c *CommandExpose) Execute(b *Build) (s State, err error) {
 	sort.Strings(portList)
 
 	message := fmt.Sprintf("EXPOSE %s", strings.Join(portList, " "))
-	s.Commit(message)
+	s.Commit("%s", message)
 
 	return s, nil
 }
@@ -766,7 +963,7 @@ func (c *CommandVolume) ReplaceEnv(env []string) error {
 }
 
 // Execute runs the command
-func (c *CommandVolume) Execute(b *Build) (s State, err error) {
+func (c *CommandVolume) Execute(ctx context.Context, b *Build) (s State, err error) {
 
 	s = b.state
 
@@ -785,7 +982,7 @@ func (c *CommandVolume) Execute(b *Build) (s State, err error) {
 		s.Config.Volumes[v] = struct{}{}
 	}
 
-	s.Commit(fmt.Sprintf("VOLUME %v", c.cfg.args))
+	s.Commit("VOLUME %v", c.cfg.args)
 
 	return s, nil
 }
@@ -801,7 +998,7 @@ func (c *CommandUser) ReplaceEnv(env []string) error {
 }
 
 // Execute runs the command
-func (c *CommandUser) Execute(b *Build) (s State, err error) {
+func (c *CommandUser) Execute(ctx context.Context, b *Build) (s State, err error) {
 
 	s = b.state
 
@@ -811,7 +1008,37 @@ func (c *CommandUser) Execute(b *Build) (s State, err error) {
 
 	s.Config.User = c.cfg.args[0]
 
-	s.Commit(fmt.Sprintf("USER %v", c.cfg.args))
+	s.Commit("USER %v", c.cfg.args)
+
+	return s, nil
+}
+
+// CommandStopsignal implements STOPSIGNAL
+type CommandStopsignal struct {
+	CommandBase
+}
+
+// ReplaceEnv implements EnvReplacableCommand interface
+func (c *CommandStopsignal) ReplaceEnv(env []string) error {
+	return replaceEnv(c.cfg.args, env)
+}
+
+// Execute runs the command
+func (c *CommandStopsignal) Execute(ctx context.Context, b *Build) (s State, err error) {
+
+	s = b.state
+
+	if len(c.cfg.args) != 1 {
+		return s, fmt.Errorf("STOPSIGNAL requires exactly one argument")
+	}
+
+	if _, err := signal.ParseSignal(c.cfg.args[0]); err != nil {
+		return s, fmt.Errorf("STOPSIGNAL %s", err)
+	}
+
+	s.Config.StopSignal = c.cfg.args[0]
+
+	s.Commit("STOPSIGNAL %v", c.cfg.args)
 
 	return s, nil
 }
@@ -822,7 +1049,7 @@ type CommandOnbuild struct {
 }
 
 // Execute runs the command
-func (c *CommandOnbuild) Execute(b *Build) (s State, err error) {
+func (c *CommandOnbuild) Execute(ctx context.Context, b *Build) (s State, err error) {
 
 	s = b.state
 
@@ -841,7 +1068,7 @@ func (c *CommandOnbuild) Execute(b *Build) (s State, err error) {
 	orig := regexp.MustCompile(`(?i)^\s*ONBUILD\s*`).ReplaceAllString(c.cfg.original, "")
 
 	s.Config.OnBuild = append(s.Config.OnBuild, orig)
-	s.Commit(fmt.Sprintf("ONBUILD %s", orig))
+	s.Commit("ONBUILD %s", orig)
 
 	return s, nil
 }
@@ -852,7 +1079,7 @@ type CommandTag struct {
 }
 
 // Execute runs the command
-func (c *CommandTag) Execute(b *Build) (State, error) {
+func (c *CommandTag) Execute(ctx context.Context, b *Build) (State, error) {
 	if len(c.cfg.args) != 1 {
 		return b.state, fmt.Errorf("TAG requires exactly one argument")
 	}
@@ -865,6 +1092,8 @@ func (c *CommandTag) Execute(b *Build) (State, error) {
 		return b.state, err
 	}
 
+	b.tagged[imagename.NewFromString(c.cfg.args[0]).String()] = b.state.ImageID
+
 	return b.state, nil
 }
 
@@ -874,7 +1103,7 @@ type CommandPush struct {
 }
 
 // Execute runs the command
-func (c *CommandPush) Execute(b *Build) (State, error) {
+func (c *CommandPush) Execute(ctx context.Context, b *Build) (State, error) {
 	if len(c.cfg.args) != 1 {
 		return b.state, fmt.Errorf("PUSH requires exactly one argument")
 	}
@@ -883,55 +1112,12 @@ func (c *CommandPush) Execute(b *Build) (State, error) {
 		return b.state, fmt.Errorf("Cannot PUSH empty image")
 	}
 
-	if err := b.client.TagImage(b.state.ImageID, c.cfg.args[0]); err != nil {
+	names, err := ResolvePushTargets(b.cfg.PushRoutes, c.cfg.args[0])
+	if err != nil {
 		return b.state, err
 	}
 
-	image := imagename.NewFromString(c.cfg.args[0])
-	artifact := imagename.Artifact{
-		Name:      image,
-		Pushed:    b.cfg.Push,
-		Tag:       image.GetTag(),
-		ImageID:   b.state.ImageID,
-		BuildTime: time.Now(),
-	}
-
-	// push image and add some lines to artifacts
-	if b.cfg.Push {
-		digest, err := b.client.PushImage(image.String())
-		if err != nil {
-			return b.state, err
-		}
-		artifact.SetDigest(digest)
-	} else {
-		log.Infof("| Don't push. Pass --push flag to actually push to the registry")
-	}
-
-	// Publish artifact files
-	if b.cfg.ArtifactsPath != "" {
-		if err := os.MkdirAll(b.cfg.ArtifactsPath, 0755); err != nil {
-			return b.state, fmt.Errorf("Failed to create directory %s for the artifacts, error: %s", b.cfg.ArtifactsPath, err)
-		}
-
-		filePath := filepath.Join(b.cfg.ArtifactsPath, artifact.GetFileName())
-
-		artifacts := imagename.Artifacts{
-			RockerArtifacts: []imagename.Artifact{artifact},
-		}
-		content, err := yaml.Marshal(artifacts)
-		if err != nil {
-			return b.state, err
-		}
-
-		if err := ioutil.WriteFile(filePath, content, 0644); err != nil {
-			return b.state, fmt.Errorf("Failed to write artifact file %s, error: %s", filePath, err)
-		}
-
-		log.Infof("| Saved artifact file %s", filePath)
-		log.Debugf("Artifact properties: %# v", pretty.Formatter(artifact))
-	}
-
-	return b.state, nil
+	return b.state, pushImages(ctx, b, names)
 }
 
 // CommandCopy implements COPY
@@ -945,15 +1131,18 @@ func (c *CommandCopy) ReplaceEnv(env []string) error {
 }
 
 // Execute runs the command
-func (c *CommandCopy) Execute(b *Build) (State, error) {
+func (c *CommandCopy) Execute(ctx context.Context, b *Build) (State, error) {
 	if len(c.cfg.args) < 2 {
 		return b.state, fmt.Errorf("COPY requires at least two arguments")
 	}
-	return copyFiles(b, c.cfg.args, "COPY")
+	if from := c.cfg.flags["from"]; from != "" {
+		return copyFrom(ctx, b, c.cfg.args, from, c.cfg.flags["chown"])
+	}
+	return copyFiles(ctx, b, c.cfg.args, "COPY", c.cfg.flags["from-context"], c.cfg.flags["chown"])
 }
 
 // CommandAdd implements ADD
-// For now it is an alias of COPY, but later will add urls and archives to it
+// It is COPY that also downloads urls and unpacks local archives
 type CommandAdd struct {
 	CommandBase
 }
@@ -964,11 +1153,11 @@ func (c *CommandAdd) ReplaceEnv(env []string) error {
 }
 
 // Execute runs the command
-func (c *CommandAdd) Execute(b *Build) (State, error) {
+func (c *CommandAdd) Execute(ctx context.Context, b *Build) (State, error) {
 	if len(c.cfg.args) < 2 {
 		return b.state, fmt.Errorf("ADD requires at least two arguments")
 	}
-	return addFiles(b, c.cfg.args)
+	return addFiles(ctx, b, c.cfg.args, c.cfg.flags["chown"], c.cfg.flags["checksum"])
 }
 
 // CommandMount implements MOUNT
@@ -977,7 +1166,7 @@ type CommandMount struct {
 }
 
 // Execute runs the command
-func (c *CommandMount) Execute(b *Build) (s State, err error) {
+func (c *CommandMount) Execute(ctx context.Context, b *Build) (s State, err error) {
 
 	s = b.state
 
@@ -1023,7 +1212,7 @@ func (c *CommandMount) Execute(b *Build) (s State, err error) {
 			if !path.IsAbs(arg) {
 				return s, fmt.Errorf("Invalid volume destination path: '%s', mount path must be absolute..", arg)
 			}
-			c, err := b.getVolumeContainer(arg)
+			c, err := b.getVolumeContainer(ctx, arg)
 			if err != nil {
 				return s, err
 			}
@@ -1035,11 +1224,13 @@ func (c *CommandMount) Execute(b *Build) (s State, err error) {
 			s.NoCache.HostConfig.Binds = append(s.NoCache.HostConfig.Binds,
 				mountsToBinds(c.Mounts, "")...)
 
-			commitIds = append(commitIds, strings.TrimLeft(c.Name, "/")+":"+arg)
+			// The volume container name depends on the Rockerfile identity, leave it
+			// out of the commit so that the same MOUNT shares cache across Rockerfiles
+			commitIds = append(commitIds, arg)
 		}
 	}
 
-	s.Commit(fmt.Sprintf("MOUNT %q", commitIds))
+	s.Commit("MOUNT %q", commitIds)
 
 	return s, nil
 }
@@ -1050,7 +1241,7 @@ type CommandExport struct {
 }
 
 // Execute runs the command
-func (c *CommandExport) Execute(b *Build) (s State, err error) {
+func (c *CommandExport) Execute(ctx context.Context, b *Build) (s State, err error) {
 
 	s = b.state
 	args := c.cfg.args
@@ -1082,15 +1273,15 @@ func (c *CommandExport) Execute(b *Build) (s State, err error) {
 		return s, fmt.Errorf("Invalid EXPORT destination: %s", dest)
 	}
 
-	s, hit, err := b.probeCacheAndPreserveCommits(s)
+	s, hit, err := b.probeCacheAndPreserveCommits(ctx, s)
 	if err != nil {
 		return s, err
 	}
 	if hit {
 		b.prevExportContainerID = s.ExportsID
 		b.currentExportContainerName = exportsContainerName(s.ParentID, s.GetCommits())
-		log.Infof("| Export container: %s", b.currentExportContainerName)
-		log.Debugf("===EXPORT CONTAINER NAME: %s ('%s', '%s')", b.currentExportContainerName, s.ParentID, s.GetCommits())
+		b.log.Infof("| Export container: %s", b.currentExportContainerName)
+		b.log.Debugf("===EXPORT CONTAINER NAME: %s ('%s', '%s')", b.currentExportContainerName, s.ParentID, s.GetCommits())
 		s.CleanCommits()
 		return s, nil
 	}
@@ -1098,7 +1289,7 @@ func (c *CommandExport) Execute(b *Build) (s State, err error) {
 	prevExportContainerName := b.currentExportContainerName
 	b.currentExportContainerName = exportsContainerName(s.ImageID, s.GetCommits())
 
-	exportsContainer, err := b.getExportsContainerAndSync(b.currentExportContainerName, prevExportContainerName)
+	exportsContainer, err := b.getExportsContainerAndSync(ctx, b.currentExportContainerName, prevExportContainerName)
 	if err != nil {
 		return s, err
 	}
@@ -1133,9 +1324,9 @@ func (c *CommandExport) Execute(b *Build) (s State, err error) {
 	}
 	defer b.client.RemoveContainer(exportsID)
 
-	log.Infof("| Running in %.12s: %s", exportsID, strings.Join(cmd, " "))
+	b.log.Infof("| Running in %.12s: %s", exportsID, strings.Join(cmd, " "))
 
-	if err = b.client.RunContainer(exportsID, false); err != nil {
+	if err = b.client.RunContainer(ctx, exportsID, false); err != nil {
 		return s, err
 	}
 
@@ -1148,7 +1339,7 @@ type CommandImport struct {
 }
 
 // Execute runs the command
-func (c *CommandImport) Execute(b *Build) (s State, err error) {
+func (c *CommandImport) Execute(ctx context.Context, b *Build) (s State, err error) {
 	s = b.state
 	args := c.cfg.args
 
@@ -1168,12 +1359,12 @@ func (c *CommandImport) Execute(b *Build) (s State, err error) {
 		return s, fmt.Errorf("You have to EXPORT something first to do IMPORT")
 	}
 
-	exportsContainer, err := b.getExportsContainer(b.currentExportContainerName)
+	exportsContainer, err := b.getExportsContainer(ctx, b.currentExportContainerName)
 	if err != nil {
 		return s, err
 	}
 
-	log.Infof("| Import from %s (%.12s)", b.currentExportContainerName, exportsContainer.ID)
+	b.log.Infof("| Import from %s (%.12s)", b.currentExportContainerName, exportsContainer.ID)
 
 	// If only one argument was given to IMPORT, use the same path for destination
 	// IMPORT /my/dir/file.tar --> ADD ./EXPORT_VOLUME/my/dir/file.tar /my/dir/file.tar
@@ -1194,7 +1385,7 @@ func (c *CommandImport) Execute(b *Build) (s State, err error) {
 	s.Commit("IMPORT %q : %q %s", b.prevExportContainerID, src, dest)
 
 	// Check cache
-	s, hit, err := b.probeCache(s)
+	s, hit, err := b.probeCache(ctx, s)
 	if err != nil {
 		return s, err
 	}
@@ -1232,9 +1423,9 @@ func (c *CommandImport) Execute(b *Build) (s State, err error) {
 		return s, err
 	}
 
-	log.Infof("| Running in %.12s: %s", importID, strings.Join(cmd, " "))
+	b.log.Infof("| Running in %.12s: %s", importID, strings.Join(cmd, " "))
 
-	if err = b.client.RunContainer(importID, false); err != nil {
+	if err = b.client.RunContainer(ctx, importID, false); err != nil {
 		return s, err
 	}
 
@@ -1250,7 +1441,7 @@ type CommandArg struct {
 }
 
 // Execute runs the command
-func (c *CommandArg) Execute(b *Build) (s State, err error) {
+func (c *CommandArg) Execute(ctx context.Context, b *Build) (s State, err error) {
 	s = b.state
 	args := c.cfg.args
 
@@ -1296,6 +1487,340 @@ func (c *CommandArg) Execute(b *Build) (s State, err error) {
 	return s, nil
 }
 
+// CommandFlatten merges all layers of the current image into a single one;
+// it is not a Rockerfile directive, the plan gets it from --flatten-after
+type CommandFlatten struct {
+	CommandBase
+}
+
+// Execute runs the command
+func (c *CommandFlatten) Execute(ctx context.Context, b *Build) (s State, err error) {
+	s = b.state
+
+	if s.ImageID == "" {
+		return s, fmt.Errorf("Cannot flatten, there is no image yet")
+	}
+
+	s.Commit("FLATTEN")
+
+	var hit bool
+	if s, hit, err = b.probeCache(ctx, s); err != nil || hit {
+		return s, err
+	}
+
+	return flattenImage(b, s, nil)
+}
+
+// CommandRemove implements REMOVE
+type CommandRemove struct {
+	CommandBase
+}
+
+// Execute runs the command
+func (c *CommandRemove) Execute(ctx context.Context, b *Build) (s State, err error) {
+	s = b.state
+
+	if len(c.cfg.args) == 0 {
+		return s, fmt.Errorf("REMOVE requires at least one argument")
+	}
+
+	if s.ImageID == "" {
+		return s, fmt.Errorf("Please provide a source image with `from` prior to remove")
+	}
+
+	s.Commit("REMOVE %s", strings.Join(c.cfg.args, " "))
+
+	var hit bool
+	if s, hit, err = b.probeCache(ctx, s); err != nil || hit {
+		return s, err
+	}
+
+	if s, err = flattenImage(b, s, c.cfg.args); err != nil {
+		return s, err
+	}
+
+	b.log.Infof("| Removed files, saved %s", units.HumanSize(float64(s.ParentSize-s.Size)))
+
+	return s, nil
+}
+
+// CommandSquash implements SQUASH, which merges the layers the section added
+// on top of its FROM image into one; --squash adds it at the end of the sections
+type CommandSquash struct {
+	CommandBase
+}
+
+// Execute runs the command
+func (c *CommandSquash) Execute(ctx context.Context, b *Build) (s State, err error) {
+	s = b.state
+
+	if s.ImageID == "" {
+		return s, fmt.Errorf("Cannot squash, there is no image yet")
+	}
+
+	keep, err := sectionBaseLayers(b, s, "squash")
+	if err != nil {
+		return s, err
+	}
+
+	img, err := b.client.InspectImage(s.ImageID)
+	if err != nil {
+		return s, err
+	}
+	if layers := imageLayers(img); layers >= 0 && layers-keep < 2 {
+		b.log.Infof("| Nothing to squash, the section added %d layers", layers-keep)
+		return s, nil
+	}
+
+	s.Commit("SQUASH")
+
+	var hit bool
+	if s, hit, err = b.probeCache(ctx, s); err != nil || hit {
+		return s, err
+	}
+
+	before := s.Size
+	if s, err = squashImage(b, s, keep); err != nil {
+		return s, err
+	}
+
+	b.log.Infof("| Squashed, saved %s", units.HumanSize(float64(before-s.Size)))
+
+	return s, nil
+}
+
+// CommandNormalize makes the layers the section added on top of its FROM image
+// and the config of the image reproducible; --reproducible adds it at the end
+// of the sections, it is not an instruction of the Rockerfile
+type CommandNormalize struct {
+	CommandBase
+}
+
+// Execute runs the command
+func (c *CommandNormalize) Execute(ctx context.Context, b *Build) (s State, err error) {
+	s = b.state
+
+	if s.ImageID == "" {
+		return s, fmt.Errorf("Cannot normalize, there is no image yet")
+	}
+
+	keep, err := sectionBaseLayers(b, s, "normalize")
+	if err != nil {
+		return s, err
+	}
+
+	s.Commit("NORMALIZE %d", b.cfg.SourceDateEpoch.Unix())
+
+	var hit bool
+	if s, hit, err = b.probeCache(ctx, s); err != nil || hit {
+		return s, err
+	}
+
+	if s, err = normalizeImage(b, s, keep); err != nil {
+		return s, err
+	}
+
+	b.log.Infof("| Normalized to %.12s", s.ImageID)
+
+	return s, nil
+}
+
+// CommandContext implements CONTEXT
+type CommandContext struct {
+	CommandBase
+}
+
+// Execute runs the command
+func (c *CommandContext) Execute(ctx context.Context, b *Build) (State, error) {
+	if len(c.cfg.args) != 2 {
+		return b.state, fmt.Errorf("CONTEXT requires exactly two arguments: name and path")
+	}
+
+	name, dir := c.cfg.args[0], c.cfg.args[1]
+
+	if IsRemoteContext(dir) {
+		return b.state, fmt.Errorf("CONTEXT %s: default can only be a local path, pass URLs with --context %s=%s", name, name, dir)
+	}
+
+	if !filepath.IsAbs(dir) {
+		dir = filepath.Join(b.cfg.ContextDir, dir)
+	}
+
+	// Contexts given from the command line take precedence over the declared defaults
+	if given, ok := b.cfg.Contexts[name]; ok {
+		b.log.Infof("| Using %s from the command line", given)
+		return b.state, nil
+	}
+
+	b.contextDefaults[name] = dir
+
+	// The image is not changed, so there is nothing to commit
+	return b.state, nil
+}
+
+// CommandPublish implements PUBLISH
+type CommandPublish struct {
+	CommandBase
+}
+
+// Execute runs the command
+func (c *CommandPublish) Execute(ctx context.Context, b *Build) (s State, err error) {
+	s = b.state
+
+	// With --subject the artifact goes to the repository of the image it refers to
+	subject := c.cfg.flags["subject"]
+
+	if subject != "" && len(c.cfg.args) != 1 {
+		return s, fmt.Errorf("PUBLISH --subject requires exactly one argument: path")
+	}
+	if subject == "" && len(c.cfg.args) != 2 {
+		return s, fmt.Errorf("PUBLISH requires exactly two arguments: path and name")
+	}
+
+	if s.ImageID == "" {
+		return s, fmt.Errorf("Please provide a source image with `from` prior to publish")
+	}
+
+	src, name := c.cfg.args[0], subject
+	if subject == "" {
+		name = c.cfg.args[1]
+	}
+
+	if !b.cfg.Push {
+		b.log.Infof("| Don't publish. Pass --push flag to actually push to the registry")
+		return s, nil
+	}
+
+	if !filepath.IsAbs(src) {
+		src = filepath.Join(s.Config.WorkingDir, src)
+	}
+
+	containerID, err := b.client.CreateContainer(s)
+	if err != nil {
+		return s, err
+	}
+	defer func() {
+		if err := b.client.RemoveContainer(containerID); err != nil {
+			b.log.Errorf("Failed to remove temporary container %.12s, error: %s", containerID, err)
+		}
+	}()
+
+	content, err := b.client.ReadFileFromContainer(containerID, src)
+	if err != nil {
+		return s, err
+	}
+	defer content.Close()
+
+	artifact := dockerclient.OCIArtifact{
+		Name:         filepath.Base(src),
+		Blob:         content,
+		MediaType:    c.cfg.flags["media-type"],
+		ArtifactType: c.cfg.flags["artifact-type"],
+		Annotations:  b.cfg.Annotations,
+	}
+
+	var digest string
+	if subject != "" {
+		digest, err = b.client.AttachArtifact(subject, artifact)
+	} else {
+		digest, err = b.client.PushArtifact(name, artifact)
+	}
+	if err != nil {
+		return s, err
+	}
+
+	b.log.Infof("| Published %s@%s", imagename.NewFromString(name).NameWithRegistry(), digest)
+
+	// The image is not changed, so there is nothing to commit
+	return s, nil
+}
+
+// CommandHelmPackage implements HELM_PACKAGE
+type CommandHelmPackage struct {
+	CommandBase
+}
+
+// Execute runs the command
+func (c *CommandHelmPackage) Execute(ctx context.Context, b *Build) (s State, err error) {
+	s = b.state
+
+	// Flags given before the chart directory are taken by the parser
+	rawArgs := []string{}
+	for name, value := range c.cfg.flags {
+		rawArgs = append(rawArgs, "--"+name+"="+value)
+	}
+
+	args, err := parseHelmPackageArgs(append(rawArgs, c.cfg.args...))
+	if err != nil {
+		return s, err
+	}
+
+	dir := args.dir
+	if !filepath.IsAbs(dir) {
+		dir = filepath.Join(b.cfg.ContextDir, dir)
+	}
+
+	chart, err := packageHelmChart(dir, args.set, args.version)
+	if err != nil {
+		return s, err
+	}
+	defer chart.archive.Close()
+
+	// The plan does not leave files behind
+	if b.dryRun != nil {
+		return s, nil
+	}
+
+	outDir := b.cfg.ArtifactsPath
+	if outDir == "" {
+		outDir = b.cfg.ContextDir
+	}
+	if err := os.MkdirAll(outDir, 0755); err != nil {
+		return s, fmt.Errorf("Failed to create directory %s for the chart, error: %s", outDir, err)
+	}
+
+	fileName := fmt.Sprintf("%s-%s.tgz", chart.name, chart.version)
+	filePath := filepath.Join(outDir, fileName)
+
+	if err := writeChart(filePath, chart.archive.Reader()); err != nil {
+		return s, fmt.Errorf("Failed to write chart %s, error: %s", filePath, err)
+	}
+
+	b.log.Infof("| Packaged chart %s", filePath)
+
+	if args.push == "" {
+		return s, nil
+	}
+
+	if !b.cfg.Push {
+		b.log.Infof("| Don't push the chart. Pass --push flag to actually push to the registry")
+		return s, nil
+	}
+
+	config, err := chart.configJSON()
+	if err != nil {
+		return s, err
+	}
+
+	name := fmt.Sprintf("%s/%s:%s", strings.TrimSuffix(args.push, "/"), chart.name, chart.version)
+
+	digest, err := b.client.PushArtifact(name, dockerclient.OCIArtifact{
+		Name:            fileName,
+		Blob:            chart.archive,
+		MediaType:       helmChartMediaType,
+		Config:          config,
+		ConfigMediaType: helmConfigMediaType,
+		Annotations:     b.cfg.Annotations,
+	})
+	if err != nil {
+		return s, err
+	}
+
+	b.log.Infof("| Pushed chart %s@%s", imagename.NewFromString(name).NameWithRegistry(), digest)
+
+	return s, nil
+}
+
 // CommandOnbuildWrap wraps ONBUILD command
 type CommandOnbuildWrap struct {
 	cmd Command
@@ -1312,8 +1837,8 @@ func (c *CommandOnbuildWrap) ShouldRun(b *Build) (bool, error) {
 }
 
 // Execute runs the command
-func (c *CommandOnbuildWrap) Execute(b *Build) (State, error) {
-	return c.cmd.Execute(b)
+func (c *CommandOnbuildWrap) Execute(ctx context.Context, b *Build) (State, error) {
+	return c.cmd.Execute(ctx, b)
 }
 
 // ReplaceEnv implements EnvReplacableCommand interface
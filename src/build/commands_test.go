@@ -17,11 +17,17 @@
 package build
 
 import (
+	"context"
 	"fmt"
+	"io"
 	"reflect"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/grammarly/rocker/src/dockerclient"
 	"github.com/grammarly/rocker/src/imagename"
+	"github.com/grammarly/rocker/src/spill"
 
 	"github.com/kr/pretty"
 	"github.com/stretchr/testify/mock"
@@ -48,7 +54,7 @@ func TestCommandFrom_Existing(t *testing.T) {
 
 	c.On("InspectImage", "existing:latest").Return(img, nil).Once()
 
-	state, err := cmd.Execute(b)
+	state, err := cmd.Execute(context.Background(), b)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -72,7 +78,7 @@ func TestCommandFrom_NotExisting(t *testing.T) {
 	c.On("ListImages").Return(nilList, nil).Once()
 	c.On("ListImageTags", "not-existing:latest").Return(nilList, nil).Once()
 
-	_, err := cmd.Execute(b)
+	_, err := cmd.Execute(context.Background(), b)
 	c.AssertExpectations(t)
 	assert.Equal(t, "FROM error: Image not found: not-existing:latest (also checked in the remote registry)", err.Error())
 }
@@ -97,7 +103,7 @@ func TestCommandRun_Simple(t *testing.T) {
 
 	c.On("RunContainer", "456", false).Return(nil).Once()
 
-	state, err := cmd.Execute(b)
+	state, err := cmd.Execute(context.Background(), b)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -109,6 +115,41 @@ func TestCommandRun_Simple(t *testing.T) {
 	assert.Equal(t, "456", state.NoCache.ContainerID)
 }
 
+func TestCommandRun_DebugOnError(t *testing.T) {
+	b, c := makeBuild(t, "", Config{DebugOnError: true})
+	cmd := NewCommand(ConfigCommand{
+		name: "run",
+		args: []string{"make"},
+	})
+
+	b.state.ImageID = "123"
+	b.state.Config.WorkingDir = "/src"
+
+	runErr := WithExitCode(ExitStep, fmt.Errorf("Container 456 exited with code 2"))
+
+	c.On("CreateContainer", mock.AnythingOfType("State")).Return("456", nil).Once()
+	c.On("RunContainer", "456", false).Return(runErr).Once()
+	c.On("CommitContainer", mock.AnythingOfType("State")).Return(&docker.Image{ID: "789"}, nil).Run(func(args mock.Arguments) {
+		assert.Equal(t, "456", args.Get(0).(State).NoCache.ContainerID)
+	}).Once()
+	c.On("CreateContainer", mock.AnythingOfType("State")).Return("999", nil).Run(func(args mock.Arguments) {
+		arg := args.Get(0).(State)
+		assert.Equal(t, "789", arg.ImageID)
+		assert.Equal(t, []string{"/bin/sh"}, arg.Config.Cmd)
+		assert.Equal(t, "/src", arg.Config.WorkingDir)
+		assert.True(t, arg.Config.Tty)
+	}).Once()
+	c.On("RunContainer", "999", true).Return(nil).Once()
+	c.On("RemoveContainer", "999").Return(nil).Once()
+	c.On("RemoveImage", "789").Return(nil).Once()
+	c.On("RemoveContainer", "456").Return(nil).Once()
+
+	_, err := cmd.Execute(context.Background(), b)
+
+	c.AssertExpectations(t)
+	assert.Equal(t, runErr, err)
+}
+
 func TestCommandRun_ArgNoEnv(t *testing.T) {
 	b, c := makeBuild(t, "", Config{})
 	cmd := NewCommand(ConfigCommand{
@@ -127,7 +168,7 @@ func TestCommandRun_ArgNoEnv(t *testing.T) {
 
 	c.On("RunContainer", "456", false).Return(nil).Once()
 
-	state, err := cmd.Execute(b)
+	state, err := cmd.Execute(context.Background(), b)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -159,7 +200,7 @@ func TestCommandRun_ArgWithEnv(t *testing.T) {
 
 	c.On("RunContainer", "456", false).Return(nil).Once()
 
-	state, err := cmd.Execute(b)
+	state, err := cmd.Execute(context.Background(), b)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -169,6 +210,34 @@ func TestCommandRun_ArgWithEnv(t *testing.T) {
 	assert.Equal(t, []string{"foo=bar", "lopata=some_value"}, state.Config.Env)
 }
 
+func TestCommandRun_SensitiveArg(t *testing.T) {
+	b, c := makeBuild(t, "", Config{SensitiveBuildArgs: map[string]bool{"NPM_TOKEN": true}})
+	cmd := NewCommand(ConfigCommand{
+		name: "run",
+		args: []string{"npm install"},
+	})
+
+	b.state.ImageID = "123"
+	b.state.NoCache.BuildArgs = map[string]string{"NPM_TOKEN": "s3cr3t"}
+	b.allowedBuildArgs["NPM_TOKEN"] = true
+
+	c.On("CreateContainer", mock.AnythingOfType("State")).Return("456", nil).Run(func(args mock.Arguments) {
+		arg := args.Get(0).(State)
+		assert.Equal(t, []string{"NPM_TOKEN=s3cr3t"}, arg.Config.Env)
+	}).Once()
+
+	c.On("RunContainer", "456", false).Return(nil).Once()
+
+	state, err := cmd.Execute(context.Background(), b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.AssertExpectations(t)
+	assert.NotContains(t, state.GetCommits(), "s3cr3t")
+	assert.Contains(t, state.GetCommits(), `"NPM_TOKEN=sha256:`)
+}
+
 // =========== Testing COMMIT ===========
 
 func TestCommandCommit_Simple(t *testing.T) {
@@ -183,7 +252,7 @@ func TestCommandCommit_Simple(t *testing.T) {
 	c.On("CommitContainer", mock.AnythingOfType("State")).Return(resultImage, nil).Once()
 	c.On("RemoveContainer", "456").Return(nil).Once()
 
-	state, err := cmd.Execute(b)
+	state, err := cmd.Execute(context.Background(), b)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -212,7 +281,7 @@ func TestCommandCommit_NoContainer(t *testing.T) {
 	c.On("CommitContainer", mock.AnythingOfType("State")).Return(resultImage, nil).Once()
 	c.On("RemoveContainer", "456").Return(nil).Once()
 
-	state, err := cmd.Execute(b)
+	state, err := cmd.Execute(context.Background(), b)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -228,12 +297,305 @@ func TestCommandCommit_NoCommitMsgs(t *testing.T) {
 	b, _ := makeBuild(t, "", Config{})
 	cmd := &CommandCommit{}
 
-	_, err := cmd.Execute(b)
+	_, err := cmd.Execute(context.Background(), b)
 	assert.Nil(t, err)
 }
 
+func TestCommandCommit_ImageLabel(t *testing.T) {
+	// No builder labels, as with --reproducible and --no-builder-labels
+	b, c := makeBuild(t, "", Config{})
+	cmd := &CommandCommit{}
+
+	b.state.ImageID = "123"
+	b.state.NoCache.ContainerID = "456"
+	b.state.Commit("a")
+
+	c.On("CommitContainer", mock.AnythingOfType("State")).Return(&docker.Image{ID: "789"}, nil).Run(func(args mock.Arguments) {
+		arg := args.Get(0).(State)
+		assert.Equal(t, map[string]string{ImageLabel: "true"}, arg.Config.Labels)
+	}).Once()
+	c.On("RemoveContainer", "456").Return(nil).Once()
+
+	if _, err := cmd.Execute(context.Background(), b); err != nil {
+		t.Fatal(err)
+	}
+
+	c.AssertExpectations(t)
+}
+
+func TestCommandCommit_Labels(t *testing.T) {
+	b, c := makeBuild(t, "", Config{
+		Labels: map[string]string{"rocker.builder.os": "linux"},
+	})
+	cmd := &CommandCommit{}
+
+	resultImage := &docker.Image{ID: "789"}
+	b.state.ImageID = "123"
+	b.state.NoCache.ContainerID = "456"
+	b.state.Config.Labels = map[string]string{"foo": "bar"}
+	b.state.Commit("a")
+
+	c.On("CommitContainer", mock.AnythingOfType("State")).Return(resultImage, nil).Run(func(args mock.Arguments) {
+		arg := args.Get(0).(State)
+		assert.Equal(t, map[string]string{"foo": "bar", "rocker.builder.os": "linux", ImageLabel: "true"}, arg.Config.Labels)
+	}).Once()
+	c.On("RemoveContainer", "456").Return(nil).Once()
+
+	if _, err := cmd.Execute(context.Background(), b); err != nil {
+		t.Fatal(err)
+	}
+
+	c.AssertExpectations(t)
+	assert.Equal(t, map[string]string{"foo": "bar"}, b.state.Config.Labels)
+}
+
 // TODO: test skip commit
 
+// =========== Testing FLATTEN ===========
+
+func TestCommandFlatten_Simple(t *testing.T) {
+	b, c := makeBuild(t, "", Config{})
+	cmd := &CommandFlatten{}
+
+	b.state.ImageID = "123"
+	b.state.Config.Cmd = []string{"app"}
+
+	c.On("CreateContainer", mock.AnythingOfType("State")).Return("456", nil).Run(func(args mock.Arguments) {
+		arg := args.Get(0).(State)
+		assert.Equal(t, "123", arg.ImageID)
+	}).Once()
+
+	c.On("ImportContainer", "456", "rocker-flatten:456", []string(nil)).Return(&docker.Image{ID: "flat"}, nil).Once()
+
+	c.On("CreateContainer", mock.AnythingOfType("State")).Return("789", nil).Run(func(args mock.Arguments) {
+		arg := args.Get(0).(State)
+		assert.Equal(t, "flat", arg.ImageID)
+	}).Once()
+
+	c.On("CommitContainer", mock.AnythingOfType("State")).Return(&docker.Image{ID: "result"}, nil).Run(func(args mock.Arguments) {
+		arg := args.Get(0).(State)
+		assert.Equal(t, "789", arg.NoCache.ContainerID)
+		assert.Equal(t, []string{"app"}, arg.Config.Cmd)
+	}).Once()
+
+	c.On("RemoveImage", "rocker-flatten:456").Return(nil).Once()
+	c.On("RemoveContainer", "789").Return(nil).Once()
+	c.On("RemoveContainer", "456").Return(nil).Once()
+
+	state, err := cmd.Execute(context.Background(), b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.AssertExpectations(t)
+	assert.Equal(t, "result", state.ImageID)
+	assert.Equal(t, "123", state.ParentID)
+	assert.Equal(t, "", state.GetCommits())
+}
+
+// =========== Testing REMOVE ===========
+
+func TestCommandRemove_Simple(t *testing.T) {
+	b, c := makeBuild(t, "", Config{})
+	cmd := NewCommand(ConfigCommand{
+		name: "remove",
+		args: []string{"/src", "/tmp/*"},
+	})
+
+	b.state.ImageID = "123"
+
+	c.On("CreateContainer", mock.AnythingOfType("State")).Return("456", nil).Run(func(args mock.Arguments) {
+		arg := args.Get(0).(State)
+		assert.Equal(t, []string{"/bin/sh", "-c", "#(nop) REMOVE /src /tmp/*"}, arg.Config.Cmd)
+	}).Once()
+	c.On("ImportContainer", "456", "rocker-flatten:456", []string{"/src", "/tmp/*"}).Return(&docker.Image{ID: "flat"}, nil).Once()
+	c.On("CreateContainer", mock.AnythingOfType("State")).Return("789", nil).Once()
+	c.On("CommitContainer", mock.AnythingOfType("State")).Return(&docker.Image{ID: "result"}, nil).Once()
+	c.On("RemoveImage", "rocker-flatten:456").Return(nil).Once()
+	c.On("RemoveContainer", "789").Return(nil).Once()
+	c.On("RemoveContainer", "456").Return(nil).Once()
+
+	state, err := cmd.Execute(context.Background(), b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.AssertExpectations(t)
+	assert.Equal(t, "result", state.ImageID)
+}
+
+// =========== Testing SQUASH ===========
+
+func TestCommandSquash_Simple(t *testing.T) {
+	b, c := makeBuild(t, "", Config{})
+	cmd := NewCommand(ConfigCommand{name: "squash"})
+
+	b.fromImageID = "base"
+	b.state.ImageID = "123"
+	b.state.Size = 300
+
+	c.On("InspectImage", "base").Return(&docker.Image{ID: "base", RootFS: &docker.RootFS{Layers: []string{"l1", "l2"}}}, nil).Once()
+	c.On("InspectImage", "123").Return(&docker.Image{ID: "123", RootFS: &docker.RootFS{Layers: []string{"l1", "l2", "l3", "l4", "l5"}}}, nil).Once()
+	c.On("SquashImage", "123", 2).Return(&docker.Image{ID: "squashed", VirtualSize: 200}, nil).Once()
+
+	state, err := cmd.Execute(context.Background(), b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.AssertExpectations(t)
+	assert.Equal(t, "squashed", state.ImageID)
+	assert.Equal(t, "123", state.ParentID)
+	assert.Equal(t, int64(200), state.Size)
+	assert.Equal(t, "", state.GetCommits())
+}
+
+func TestCommandSquash_NothingToSquash(t *testing.T) {
+	b, c := makeBuild(t, "", Config{})
+	cmd := NewCommand(ConfigCommand{name: "squash"})
+
+	b.fromImageID = "base"
+	b.state.ImageID = "123"
+
+	c.On("InspectImage", "base").Return(&docker.Image{ID: "base", RootFS: &docker.RootFS{Layers: []string{"l1", "l2"}}}, nil).Once()
+	c.On("InspectImage", "123").Return(&docker.Image{ID: "123", RootFS: &docker.RootFS{Layers: []string{"l1", "l2", "l3"}}}, nil).Once()
+
+	state, err := cmd.Execute(context.Background(), b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.AssertExpectations(t)
+	assert.Equal(t, "123", state.ImageID)
+}
+
+func TestCommandNormalize_Simple(t *testing.T) {
+	epoch := time.Unix(1500000000, 0)
+	b, c := makeBuild(t, "", Config{Reproducible: true, SourceDateEpoch: epoch})
+	cmd := NewCommand(ConfigCommand{name: "normalize"})
+
+	b.fromImageID = "base"
+	b.state.ImageID = "123"
+
+	c.On("InspectImage", "base").Return(&docker.Image{ID: "base", RootFS: &docker.RootFS{Layers: []string{"l1", "l2"}}}, nil).Once()
+	c.On("NormalizeImage", "123", 2, epoch).Return(&docker.Image{ID: "normalized"}, nil).Once()
+
+	state, err := cmd.Execute(context.Background(), b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.AssertExpectations(t)
+	assert.Equal(t, "normalized", state.ImageID)
+	assert.Equal(t, "123", state.ParentID)
+}
+
+// =========== Testing CONTEXT ===========
+
+func TestCommandContext_Default(t *testing.T) {
+	b, _ := makeBuild(t, "", Config{
+		ContextDir: "/src",
+		Contexts:   map[string]string{"certs": "/etc/certs"},
+	})
+
+	for _, args := range [][]string{{"assets", "./frontend/dist"}, {"certs", "./certs"}} {
+		cmd := NewCommand(ConfigCommand{
+			name: "context",
+			args: args,
+		})
+		if _, err := cmd.Execute(context.Background(), b); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	dir, _, err := b.namedContext("assets")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "/src/frontend/dist", dir)
+
+	// The command line takes precedence over the default
+	dir, _, err = b.namedContext("certs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "/etc/certs", dir)
+}
+
+// =========== Testing PUBLISH ===========
+
+func TestCommandPublish_Simple(t *testing.T) {
+	b, c := makeBuild(t, "", Config{Push: true})
+	cmd := NewCommand(ConfigCommand{
+		name:  "publish",
+		args:  []string{"chart.tgz", "charts/app:1.0.0"},
+		flags: map[string]string{"media-type": "application/vnd.cncf.helm.chart.content.v1.tar+gzip"},
+	})
+
+	b.state.ImageID = "123"
+	b.state.Config.WorkingDir = "/out"
+
+	c.On("CreateContainer", mock.AnythingOfType("State")).Return("456", nil).Once()
+	content := spill.NewBuffer()
+	io.WriteString(content, "chart")
+
+	c.On("ReadFileFromContainer", "456", "/out/chart.tgz").Return(content, nil).Once()
+	c.On("PushArtifact", "charts/app:1.0.0", dockerclient.OCIArtifact{
+		Name:      "chart.tgz",
+		Blob:      content,
+		MediaType: "application/vnd.cncf.helm.chart.content.v1.tar+gzip",
+	}).Return("sha256:abc", nil).Once()
+	c.On("RemoveContainer", "456").Return(nil).Once()
+
+	state, err := cmd.Execute(context.Background(), b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.AssertExpectations(t)
+	assert.Equal(t, "123", state.ImageID)
+}
+
+func TestCommandPublish_Subject(t *testing.T) {
+	annotations := map[string]string{"org.opencontainers.image.revision": "abc"}
+
+	b, c := makeBuild(t, "", Config{Push: true, Annotations: annotations})
+	cmd := NewCommand(ConfigCommand{
+		name:  "publish",
+		args:  []string{"/sbom.json"},
+		flags: map[string]string{"subject": "quay.io/acme/app:1.0", "artifact-type": "application/spdx+json"},
+	})
+
+	b.state.ImageID = "123"
+
+	c.On("CreateContainer", mock.AnythingOfType("State")).Return("456", nil).Once()
+	content := spill.NewBuffer()
+	io.WriteString(content, "{}")
+
+	c.On("ReadFileFromContainer", "456", "/sbom.json").Return(content, nil).Once()
+	c.On("AttachArtifact", "quay.io/acme/app:1.0", dockerclient.OCIArtifact{
+		Name:         "sbom.json",
+		Blob:         content,
+		ArtifactType: "application/spdx+json",
+		Annotations:  annotations,
+	}).Return("sha256:abc", nil).Once()
+	c.On("RemoveContainer", "456").Return(nil).Once()
+
+	if _, err := cmd.Execute(context.Background(), b); err != nil {
+		t.Fatal(err)
+	}
+
+	c.AssertExpectations(t)
+
+	cmd = NewCommand(ConfigCommand{
+		name:  "publish",
+		args:  []string{"/sbom.json", "quay.io/acme/sbom:1.0"},
+		flags: map[string]string{"subject": "quay.io/acme/app:1.0"},
+	})
+	_, err := cmd.Execute(context.Background(), b)
+	assert.EqualError(t, err, "PUBLISH --subject requires exactly one argument: path")
+}
+
 // =========== Testing ENV ===========
 
 func TestCommandEnv_Simple(t *testing.T) {
@@ -243,7 +605,7 @@ func TestCommandEnv_Simple(t *testing.T) {
 		args: []string{"type", "web", "env", "prod"},
 	})
 
-	state, err := cmd.Execute(b)
+	state, err := cmd.Execute(context.Background(), b)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -261,7 +623,7 @@ func TestCommandEnv_Advanced(t *testing.T) {
 
 	b.state.Config.Env = []string{"env=dev", "version=1.2.3"}
 
-	state, err := cmd.Execute(b)
+	state, err := cmd.Execute(context.Background(), b)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -279,7 +641,7 @@ func TestCommandLabel_Simple(t *testing.T) {
 		args: []string{"type", "web", "env", "prod"},
 	})
 
-	state, err := cmd.Execute(b)
+	state, err := cmd.Execute(context.Background(), b)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -307,7 +669,7 @@ func TestCommandLabel_Advanced(t *testing.T) {
 		"version": "1.2.3",
 	}
 
-	state, err := cmd.Execute(b)
+	state, err := cmd.Execute(context.Background(), b)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -333,7 +695,7 @@ func TestCommandMaintainer_Simple(t *testing.T) {
 		args: []string{"terminator"},
 	})
 
-	state, err := cmd.Execute(b)
+	state, err := cmd.Execute(context.Background(), b)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -350,7 +712,7 @@ func TestCommandWorkdir_Simple(t *testing.T) {
 		args: []string{"/app"},
 	})
 
-	state, err := cmd.Execute(b)
+	state, err := cmd.Execute(context.Background(), b)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -367,7 +729,7 @@ func TestCommandWorkdir_Relative_HasRoot(t *testing.T) {
 
 	b.state.Config.WorkingDir = "/home"
 
-	state, err := cmd.Execute(b)
+	state, err := cmd.Execute(context.Background(), b)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -382,7 +744,7 @@ func TestCommandWorkdir_Relative_NoRoot(t *testing.T) {
 		args: []string{"www"},
 	})
 
-	state, err := cmd.Execute(b)
+	state, err := cmd.Execute(context.Background(), b)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -399,7 +761,7 @@ func TestCommandCmd_Simple(t *testing.T) {
 		args: []string{"apt-get", "install"},
 	})
 
-	state, err := cmd.Execute(b)
+	state, err := cmd.Execute(context.Background(), b)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -415,7 +777,7 @@ func TestCommandCmd_Json(t *testing.T) {
 		attrs: map[string]bool{"json": true},
 	})
 
-	state, err := cmd.Execute(b)
+	state, err := cmd.Execute(context.Background(), b)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -432,7 +794,7 @@ func TestCommandEntrypoint_Simple(t *testing.T) {
 		args: []string{"/bin/sh"},
 	})
 
-	state, err := cmd.Execute(b)
+	state, err := cmd.Execute(context.Background(), b)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -448,7 +810,7 @@ func TestCommandEntrypoint_Json(t *testing.T) {
 		attrs: map[string]bool{"json": true},
 	})
 
-	state, err := cmd.Execute(b)
+	state, err := cmd.Execute(context.Background(), b)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -465,7 +827,7 @@ func TestCommandEntrypoint_Remove(t *testing.T) {
 
 	b.state.Config.Entrypoint = []string{"/bin/sh", "-c"}
 
-	state, err := cmd.Execute(b)
+	state, err := cmd.Execute(context.Background(), b)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -473,6 +835,136 @@ func TestCommandEntrypoint_Remove(t *testing.T) {
 	assert.Equal(t, []string{}, state.Config.Entrypoint)
 }
 
+// =========== Testing SHELL ===========
+
+func TestCommandShell_Simple(t *testing.T) {
+	b, _ := makeBuild(t, "", Config{})
+	cmd := NewCommand(ConfigCommand{
+		name:  "shell",
+		args:  []string{"/bin/bash", "-c"},
+		attrs: map[string]bool{"json": true},
+	})
+
+	state, err := cmd.Execute(context.Background(), b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, []string{"/bin/bash", "-c"}, state.Shell)
+	assert.Equal(t, []string{`SHELL ["/bin/bash" "-c"]`}, state.Commits)
+}
+
+func TestCommandShell_NotJson(t *testing.T) {
+	b, _ := makeBuild(t, "", Config{})
+	cmd := NewCommand(ConfigCommand{
+		name: "shell",
+		args: []string{"/bin/bash -c"},
+	})
+
+	_, err := cmd.Execute(context.Background(), b)
+	assert.EqualError(t, err, "SHELL requires the arguments to be in JSON form")
+}
+
+func TestCommandShell_ShellForm(t *testing.T) {
+	b, c := makeBuild(t, "", Config{})
+	b.state.ImageID = "123"
+	b.state.Shell = []string{"powershell", "-Command"}
+
+	c.On("CreateContainer", mock.AnythingOfType("State")).Return("456", nil).Run(func(args mock.Arguments) {
+		arg := args.Get(0).(State)
+		assert.Equal(t, []string{"powershell", "-Command", "Write-Host hello"}, []string(arg.Config.Cmd))
+	}).Once()
+	c.On("RunContainer", "456", false).Return(nil).Once()
+
+	if _, err := NewCommand(ConfigCommand{name: "run", args: []string{"Write-Host hello"}}).Execute(context.Background(), b); err != nil {
+		t.Fatal(err)
+	}
+	c.AssertExpectations(t)
+
+	state, err := NewCommand(ConfigCommand{name: "cmd", args: []string{"app.exe"}}).Execute(context.Background(), b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []string{"powershell", "-Command", "app.exe"}, []string(state.Config.Cmd))
+
+	state, err = NewCommand(ConfigCommand{name: "entrypoint", args: []string{"app.exe"}}).Execute(context.Background(), b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []string{"powershell", "-Command", "app.exe"}, []string(state.Config.Entrypoint))
+	assert.Equal(t, []string{"powershell", "-Command"}, b.state.Shell)
+}
+
+// =========== Testing HEALTHCHECK ===========
+
+func TestCommandHealthcheck_Simple(t *testing.T) {
+	b, _ := makeBuild(t, "", Config{})
+	cmd := NewCommand(ConfigCommand{
+		name:  "healthcheck",
+		args:  []string{"CMD", "curl -f http://localhost/"},
+		flags: map[string]string{"interval": "30s", "retries": "3"},
+	})
+
+	state, err := cmd.Execute(context.Background(), b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, &dockerclient.HealthConfig{
+		Test:     []string{"CMD-SHELL", "curl -f http://localhost/"},
+		Interval: 30 * time.Second,
+		Retries:  3,
+	}, state.Healthcheck)
+	assert.Equal(t, []string{`HEALTHCHECK ["CMD-SHELL" "curl -f http://localhost/"] interval=30s timeout=0s start-period=0s retries=3`}, state.Commits)
+}
+
+func TestCommandHealthcheck_Json(t *testing.T) {
+	b, _ := makeBuild(t, "", Config{})
+	cmd := NewCommand(ConfigCommand{
+		name:  "healthcheck",
+		args:  []string{"CMD", "pg_isready", "-q"},
+		attrs: map[string]bool{"json": true},
+	})
+
+	state, err := cmd.Execute(context.Background(), b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, []string{"CMD", "pg_isready", "-q"}, state.Healthcheck.Test)
+}
+
+func TestCommandHealthcheck_None(t *testing.T) {
+	b, _ := makeBuild(t, "", Config{})
+	cmd := NewCommand(ConfigCommand{
+		name: "healthcheck",
+		args: []string{"none"},
+	})
+
+	state, err := cmd.Execute(context.Background(), b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, []string{"NONE"}, state.Healthcheck.Test)
+}
+
+func TestCommandHealthcheck_Invalid(t *testing.T) {
+	b, _ := makeBuild(t, "", Config{})
+
+	for _, cfg := range []ConfigCommand{
+		{name: "healthcheck", args: []string{"CURL", "localhost"}},
+		{name: "healthcheck", args: []string{"CMD"}},
+		{name: "healthcheck", args: []string{"NONE"}, flags: map[string]string{"interval": "5s"}},
+		{name: "healthcheck", args: []string{"CMD", "true"}, flags: map[string]string{"interval": "5"}},
+		{name: "healthcheck", args: []string{"CMD", "true"}, flags: map[string]string{"retries": "-1"}},
+		{name: "healthcheck", args: []string{"CMD", "true"}, flags: map[string]string{"period": "5s"}},
+	} {
+		_, err := NewCommand(cfg).Execute(context.Background(), b)
+		assert.Error(t, err, "%v %v", cfg.args, cfg.flags)
+	}
+}
+
 // =========== Testing EXPOSE ===========
 
 func TestCommandExpose_Simple(t *testing.T) {
@@ -482,7 +974,7 @@ func TestCommandExpose_Simple(t *testing.T) {
 		args: []string{"80"},
 	})
 
-	state, err := cmd.Execute(b)
+	state, err := cmd.Execute(context.Background(), b)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -505,7 +997,7 @@ func TestCommandExpose_Add(t *testing.T) {
 		docker.Port("80/tcp"): struct{}{},
 	}
 
-	state, err := cmd.Execute(b)
+	state, err := cmd.Execute(context.Background(), b)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -527,7 +1019,7 @@ func TestCommandVolume_Simple(t *testing.T) {
 		args: []string{"/data"},
 	})
 
-	state, err := cmd.Execute(b)
+	state, err := cmd.Execute(context.Background(), b)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -550,7 +1042,7 @@ func TestCommandVolume_Add(t *testing.T) {
 		"/data": struct{}{},
 	}
 
-	state, err := cmd.Execute(b)
+	state, err := cmd.Execute(context.Background(), b)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -572,7 +1064,7 @@ func TestCommandUser_Simple(t *testing.T) {
 		args: []string{"www"},
 	})
 
-	state, err := cmd.Execute(b)
+	state, err := cmd.Execute(context.Background(), b)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -580,6 +1072,35 @@ func TestCommandUser_Simple(t *testing.T) {
 	assert.Equal(t, "www", state.Config.User)
 }
 
+// =========== Testing STOPSIGNAL ===========
+
+func TestCommandStopsignal_Simple(t *testing.T) {
+	b, _ := makeBuild(t, "", Config{})
+	cmd := NewCommand(ConfigCommand{
+		name: "stopsignal",
+		args: []string{"SIGQUIT"},
+	})
+
+	state, err := cmd.Execute(context.Background(), b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, "SIGQUIT", state.Config.StopSignal)
+	assert.Equal(t, []string{"STOPSIGNAL [SIGQUIT]"}, state.Commits)
+}
+
+func TestCommandStopsignal_Invalid(t *testing.T) {
+	b, _ := makeBuild(t, "", Config{})
+	cmd := NewCommand(ConfigCommand{
+		name: "stopsignal",
+		args: []string{"SIGFOO"},
+	})
+
+	_, err := cmd.Execute(context.Background(), b)
+	assert.EqualError(t, err, "STOPSIGNAL Invalid signal: SIGFOO")
+}
+
 // =========== Testing ONBUILD ===========
 
 func TestCommandOnBuild_Simple(t *testing.T) {
@@ -590,7 +1111,7 @@ func TestCommandOnBuild_Simple(t *testing.T) {
 		original: "ONBUILD RUN make install",
 	})
 
-	state, err := cmd.Execute(b)
+	state, err := cmd.Execute(context.Background(), b)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -616,7 +1137,7 @@ func TestCommandCopy_Simple(t *testing.T) {
 
 	c.On("UploadToContainer", "456", mock.AnythingOfType("*io.PipeReader"), "/").Return(nil).Once()
 
-	state, err := cmd.Execute(b)
+	state, err := cmd.Execute(context.Background(), b)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -627,6 +1148,18 @@ func TestCommandCopy_Simple(t *testing.T) {
 	assert.Equal(t, "456", state.NoCache.ContainerID)
 }
 
+func TestCommandAdd_ChecksumNeedsURL(t *testing.T) {
+	b, _ := makeBuild(t, "", Config{})
+	cmd := NewCommand(ConfigCommand{
+		name:  "add",
+		args:  []string{"testdata/Rockerfile", "/Rockerfile"},
+		flags: map[string]string{"checksum": "sha256:" + strings.Repeat("0", 64)},
+	})
+
+	_, err := cmd.Execute(context.Background(), b)
+	assert.EqualError(t, err, "ADD --checksum can only be used with a single url source")
+}
+
 // =========== Testing TAG ===========
 
 func TestCommandTag_Simple(t *testing.T) {
@@ -640,7 +1173,7 @@ func TestCommandTag_Simple(t *testing.T) {
 
 	c.On("TagImage", "123", "docker.io/grammarly/rocker:1.0").Return(nil).Once()
 
-	_, err := cmd.Execute(b)
+	_, err := cmd.Execute(context.Background(), b)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -661,10 +1194,10 @@ func TestCommandTag_WrongArgsNumber(t *testing.T) {
 
 	b.state.ImageID = "123"
 
-	_, err := cmd.Execute(b)
+	_, err := cmd.Execute(context.Background(), b)
 	assert.EqualError(t, err, "TAG requires exactly one argument")
 
-	_, err2 := cmd2.Execute(b)
+	_, err2 := cmd2.Execute(context.Background(), b)
 	assert.EqualError(t, err2, "TAG requires exactly one argument")
 }
 
@@ -675,7 +1208,7 @@ func TestCommandTag_NoImage(t *testing.T) {
 		args: []string{"docker.io/grammarly/rocker:1.0"},
 	})
 
-	_, err := cmd.Execute(b)
+	_, err := cmd.Execute(context.Background(), b)
 	assert.EqualError(t, err, "Cannot TAG on empty image")
 }
 
@@ -694,12 +1227,100 @@ func TestCommandPush_Simple(t *testing.T) {
 	c.On("TagImage", "123", "docker.io/grammarly/rocker:1.0").Return(nil).Once()
 	c.On("PushImage", "docker.io/grammarly/rocker:1.0").Return("sha256:fafa", nil).Once()
 
-	_, err := cmd.Execute(b)
+	_, err := cmd.Execute(context.Background(), b)
 	if err != nil {
 		t.Fatal(err)
 	}
 
 	c.AssertExpectations(t)
+	assert.Len(t, b.Pushed, 1)
+	assert.Equal(t, "docker.io/grammarly/rocker@sha256:fafa", b.Pushed[0].Addressable)
+}
+
+func TestCommandPush_Routes(t *testing.T) {
+	b, c := makeBuild(t, "", Config{
+		Push: true,
+		PushRoutes: []PushRoute{{
+			Match: "app:*",
+			Targets: []PushTarget{
+				{Image: "quay.io/acme/app:{{ .Tag }}"},
+				{Image: "ghcr.io/acme/app:{{ .Tag }}"},
+			},
+		}},
+	})
+	cmd := NewCommand(ConfigCommand{
+		name: "push",
+		args: []string{"app:1.0"},
+	})
+
+	b.state.ImageID = "123"
+
+	for _, name := range []string{"quay.io/acme/app:1.0", "ghcr.io/acme/app:1.0"} {
+		c.On("TagImage", "123", name).Return(nil).Once()
+		c.On("PushImage", name).Return("sha256:fafa", nil).Once()
+	}
+
+	_, err := cmd.Execute(context.Background(), b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.AssertExpectations(t)
+	assert.Len(t, b.Pushed, 2)
+}
+
+func makePushRoutesBuild(t *testing.T, atomic bool) (*Build, *MockClient, Command) {
+	b, c := makeBuild(t, "", Config{
+		Push:       true,
+		PushAtomic: atomic,
+		PushRoutes: []PushRoute{{
+			Match: "app:*",
+			Targets: []PushTarget{
+				{Image: "quay.io/acme/app:{{ .Tag }}"},
+				{Image: "ghcr.io/acme/app:{{ .Tag }}"},
+			},
+		}},
+	})
+	cmd := NewCommand(ConfigCommand{
+		name: "push",
+		args: []string{"app:1.0"},
+	})
+
+	b.state.ImageID = "123"
+
+	c.On("TagImage", "123", "quay.io/acme/app:1.0").Return(nil).Once()
+	c.On("TagImage", "123", "ghcr.io/acme/app:1.0").Return(nil).Once()
+	c.On("PushImage", "quay.io/acme/app:1.0").Return("sha256:fafa", nil).Once()
+	c.On("PushImage", "ghcr.io/acme/app:1.0").Return("", fmt.Errorf("denied")).Once()
+
+	return b, c, cmd
+}
+
+func TestCommandPush_BestEffort(t *testing.T) {
+	b, c, cmd := makePushRoutesBuild(t, false)
+	b.cfg.BuildID = "ci-42"
+
+	_, err := cmd.Execute(context.Background(), b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.AssertExpectations(t)
+	assert.Len(t, b.Pushed, 1)
+	assert.Equal(t, "quay.io/acme/app@sha256:fafa", b.Pushed[0].Addressable)
+	assert.Equal(t, "ci-42", b.Pushed[0].BuildID)
+}
+
+func TestCommandPush_Atomic(t *testing.T) {
+	b, c, cmd := makePushRoutesBuild(t, true)
+
+	c.On("UnpushImage", "quay.io/acme/app:1.0", "sha256:fafa").Return(nil).Once()
+
+	_, err := cmd.Execute(context.Background(), b)
+	assert.EqualError(t, err, "Failed to push ghcr.io/acme/app:1.0")
+
+	c.AssertExpectations(t)
+	assert.Len(t, b.Pushed, 0)
 }
 
 func TestCommandPush_WrongArgsNumber(t *testing.T) {
@@ -715,10 +1336,10 @@ func TestCommandPush_WrongArgsNumber(t *testing.T) {
 
 	b.state.ImageID = "123"
 
-	_, err := cmd.Execute(b)
+	_, err := cmd.Execute(context.Background(), b)
 	assert.EqualError(t, err, "PUSH requires exactly one argument")
 
-	_, err2 := cmd2.Execute(b)
+	_, err2 := cmd2.Execute(context.Background(), b)
 	assert.EqualError(t, err2, "PUSH requires exactly one argument")
 }
 
@@ -729,7 +1350,7 @@ func TestCommandPush_NoImage(t *testing.T) {
 		args: []string{"docker.io/grammarly/rocker:1.0"},
 	})
 
-	_, err := cmd.Execute(b)
+	_, err := cmd.Execute(context.Background(), b)
 	assert.EqualError(t, err, "Cannot PUSH empty image")
 }
 
@@ -744,7 +1365,7 @@ func TestCommandMount_Simple(t *testing.T) {
 
 	c.On("ResolveHostPath", "/src").Return("/resolved/src", nil).Once()
 
-	state, err := cmd.Execute(b)
+	state, err := cmd.Execute(context.Background(), b)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -784,16 +1405,40 @@ func TestCommandMount_VolumeContainer(t *testing.T) {
 
 	c.On("InspectContainer", containerName).Return(cnt, nil)
 
-	state, err := cmd.Execute(b)
+	state, err := cmd.Execute(context.Background(), b)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	commitMsg := fmt.Sprintf("MOUNT [\"%s:/cache\"]", containerName)
-
 	c.AssertExpectations(t)
 	assert.Equal(t, []string{"/volumedir:/cache:ro"}, state.NoCache.HostConfig.Binds)
-	assert.Equal(t, commitMsg, state.GetCommits())
+	assert.Equal(t, `MOUNT ["/cache"]`, state.GetCommits())
+}
+
+func TestCommandMount_SharedCacheKey(t *testing.T) {
+	commits := []string{}
+
+	for _, id := range []string{"service-a", "service-b"} {
+		b, c := makeBuild(t, "", Config{ID: id})
+		cmd := NewCommand(ConfigCommand{
+			name: "mount",
+			args: []string{"/root/.m2"},
+		})
+
+		containerName := b.mountsContainerName("/root/.m2")
+
+		c.On("EnsureContainer", containerName, mock.AnythingOfType("*docker.Config"), mock.AnythingOfType("*docker.HostConfig"), "/root/.m2").Return("123", nil).Once()
+		c.On("InspectContainer", containerName).Return(&docker.Container{Name: "/" + containerName}, nil)
+
+		state, err := cmd.Execute(context.Background(), b)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		commits = append(commits, state.GetCommits())
+	}
+
+	assert.Equal(t, commits[0], commits[1])
 }
 
 // =========== Testing ARG ===========
@@ -805,7 +1450,7 @@ func TestCommandArg_Simple(t *testing.T) {
 		args: []string{"foo=bar"},
 	})
 
-	state, err := cmd.Execute(b)
+	state, err := cmd.Execute(context.Background(), b)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -822,7 +1467,7 @@ func TestCommandArg_Allow(t *testing.T) {
 		args: []string{"xxx"},
 	})
 
-	state, err := cmd.Execute(b)
+	state, err := cmd.Execute(context.Background(), b)
 	if err != nil {
 		t.Fatal(err)
 	}
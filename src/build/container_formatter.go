@@ -19,18 +19,20 @@ package build
 import (
 	"bytes"
 	"fmt"
-	log "github.com/Sirupsen/logrus"
 	"runtime"
+
+	"github.com/grammarly/rocker/src/theme"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/fatih/color"
 )
 
 type containerFormatter struct {
 	isColored bool
 }
 
-var isTerminal = log.IsTerminal()
-
 // NewColoredContainerFormatter Returns Formatter that makes your messages outputed without any log-related data.
-// Also, this formatter will make all messages colored (RED for now).
+// Also, this formatter will make all messages colored with the Stderr style of the theme.
 // Usefull when you want all stderr messages from container to become more noticible
 func NewColoredContainerFormatter() log.Formatter {
 	return &containerFormatter{
@@ -48,11 +50,11 @@ func NewMonochromeContainerFormatter() log.Formatter {
 func (f *containerFormatter) Format(entry *log.Entry) ([]byte, error) {
 	buffer := &bytes.Buffer{}
 
-	isColorTerminal := isTerminal && (runtime.GOOS != "windows")
-	isColored := isColorTerminal && f.isColored
+	// Whether to use colors at all is decided by --color, see initLogs
+	isColored := f.isColored && !color.NoColor && (runtime.GOOS != "windows")
 
 	if isColored {
-		fmt.Fprintf(buffer, "\x1b[31m%s\x1b[0m", entry.Message)
+		fmt.Fprintf(buffer, "%s", theme.Current.Stderr.Wrap(entry.Message))
 	} else {
 		fmt.Fprintf(buffer, "%s", entry.Message)
 	}
@@ -0,0 +1,269 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/grammarly/rocker/src/util"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// namedContext returns the directory and the ignore rules of a build
+// context that was passed by name, e.g. with --context name=path,
+// or declared in the Rockerfile with CONTEXT name path
+func (b *Build) namedContext(name string) (dir string, excludes []string, err error) {
+	dir, ok := b.cfg.Contexts[name]
+	if !ok {
+		dir, ok = b.contextDefaults[name]
+	}
+	if !ok {
+		return "", nil, fmt.Errorf("Unknown build context %q, pass it with --context %s=<path> or declare it with CONTEXT %s <path>", name, name, name)
+	}
+
+	if excludes, err = ReadContextIgnore(dir); err != nil {
+		return "", nil, err
+	}
+
+	return dir, excludes, nil
+}
+
+// OpenS3Func opens an object by its s3://bucket/key URL
+type OpenS3Func func(url string) (io.ReadCloser, error)
+
+// IsRemoteContext returns true if the build context is given as an URL of a tarball
+func IsRemoteContext(context string) bool {
+	return strings.HasPrefix(context, "s3://") ||
+		strings.HasPrefix(context, "http://") ||
+		strings.HasPrefix(context, "https://")
+}
+
+// TemplateDir returns the directory the templates of the Rockerfile may read files
+// from: the local context given on the command line, or else the directory of the
+// Rockerfile, relative to wd, which is the unpacked one for a remote context
+func TemplateDir(wd, localContext, rockerfile string) string {
+	if localContext != "" {
+		return localContext
+	}
+	if rockerfile == "-" {
+		return wd
+	}
+	if !filepath.IsAbs(rockerfile) {
+		rockerfile = filepath.Join(wd, rockerfile)
+	}
+	return filepath.Dir(rockerfile)
+}
+
+// FetchContext downloads a tarball (optionally gzipped) with the build context
+// and unpacks it to a new temporary directory while downloading. If checksum is
+// given, it is the expected hex sha256 of the downloaded file. The caller has
+// to remove the directory when done.
+func FetchContext(contextURL, checksum string, openS3 OpenS3Func) (dir string, err error) {
+	var body io.ReadCloser
+
+	if strings.HasPrefix(contextURL, "s3://") {
+		if body, err = openS3(contextURL); err != nil {
+			return "", err
+		}
+	} else {
+		log.Infof("| Download %s", contextURL)
+
+		resp, err := http.Get(contextURL)
+		if err != nil {
+			return "", err
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return "", fmt.Errorf("Failed to download context %s, status: %s", contextURL, resp.Status)
+		}
+		body = resp.Body
+	}
+	defer body.Close()
+
+	if dir, err = ioutil.TempDir("", "rocker_context_"); err != nil {
+		return "", err
+	}
+
+	hash := sha256.New()
+
+	if err := extractContext(io.TeeReader(body, hash), dir); err != nil {
+		os.RemoveAll(dir)
+		return "", fmt.Errorf("Failed to unpack context %s, error: %s", contextURL, err)
+	}
+
+	// Read the rest of the stream, e.g. tar padding, so the checksum is of the whole file
+	if _, err := io.Copy(hash, body); err != nil {
+		os.RemoveAll(dir)
+		return "", err
+	}
+
+	sum := hex.EncodeToString(hash.Sum(nil))
+	if checksum = strings.TrimPrefix(checksum, "sha256:"); checksum != "" && checksum != sum {
+		os.RemoveAll(dir)
+		return "", WithExitCode(ExitPolicy, fmt.Errorf("Checksum mismatch for context %s, expected sha256:%s, got sha256:%s", contextURL, checksum, sum))
+	}
+
+	log.Infof("| Unpacked context sha256:%s to %s", sum, dir)
+
+	return dir, nil
+}
+
+// extractContext unpacks a tar stream to the directory, the stream can be gzipped;
+// entries are not allowed to go outside of the directory
+func extractContext(in io.Reader, dir string) (err error) {
+	// The symlinks unpacked so far are resolved against the real path of dir
+	if dir, err = filepath.EvalSymlinks(dir); err != nil {
+		return err
+	}
+
+	var (
+		br = bufio.NewReader(in)
+		r  = io.Reader(br)
+	)
+
+	if magic, _ := br.Peek(2); len(magic) == 2 && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		r = gz
+	}
+
+	tr := tar.NewReader(r)
+
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		name := strings.TrimPrefix(filepath.Clean("/"+hdr.Name), "/")
+		if name == "" {
+			continue
+		}
+
+		dest, err := util.ResolvePath(dir, name)
+		if err != nil {
+			return err
+		}
+		// ResolvePath only checks the text of the path, an entry may still go
+		// through a symlink that was unpacked before it
+		if err := checkInside(dir, dest); err != nil {
+			return err
+		}
+
+		mode := os.FileMode(hdr.Mode).Perm()
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(dest, mode|0700); err != nil {
+				return err
+			}
+
+		case tar.TypeReg, tar.TypeRegA:
+			if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+				return err
+			}
+			f, err := os.OpenFile(dest, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, mode)
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(f, tr)
+			f.Close()
+			if err != nil {
+				return err
+			}
+
+		case tar.TypeSymlink:
+			if filepath.IsAbs(hdr.Linkname) {
+				return fmt.Errorf("Symlink %s points to an absolute path %s", hdr.Name, hdr.Linkname)
+			}
+			if target := filepath.Join(filepath.Dir(dest), hdr.Linkname); !isInside(dir, target) {
+				return fmt.Errorf("Symlink %s points outside of the context to %s", hdr.Name, hdr.Linkname)
+			}
+			if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+				return err
+			}
+			if err := os.Symlink(hdr.Linkname, dest); err != nil {
+				return err
+			}
+
+		case tar.TypeLink:
+			target, err := util.ResolvePath(dir, strings.TrimPrefix(filepath.Clean("/"+hdr.Linkname), "/"))
+			if err != nil {
+				return err
+			}
+			if err := checkInside(dir, target); err != nil {
+				return err
+			}
+			if err := os.Link(target, dest); err != nil {
+				return err
+			}
+
+		default:
+			log.Debugf("Skip %s from context, unsupported type %c", hdr.Name, hdr.Typeflag)
+		}
+	}
+
+	return nil
+}
+
+// checkInside returns an error if path, with the symlinks that exist on disk
+// resolved, is outside of dir; the part of the path that does not exist yet
+// is created by the caller, so it cannot be a symlink
+func checkInside(dir, path string) error {
+	existing := path
+	for {
+		if _, err := os.Lstat(existing); err == nil {
+			break
+		} else if !os.IsNotExist(err) {
+			return err
+		}
+		existing = filepath.Dir(existing)
+	}
+
+	resolved, err := filepath.EvalSymlinks(existing)
+	if err != nil {
+		return err
+	}
+	if !isInside(dir, resolved) {
+		return fmt.Errorf("%s goes outside of the context through a symlink", path)
+	}
+	return nil
+}
+
+// isInside returns true if path is dir or lies under it
+func isInside(dir, path string) bool {
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
@@ -0,0 +1,219 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func makeContextTarball(t *testing.T, files map[string]string) []byte {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	for name, content := range files {
+		if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(content))}); err != nil {
+			t.Fatal(err)
+		}
+		tw.Write([]byte(content))
+	}
+	tw.Close()
+	gz.Close()
+	return buf.Bytes()
+}
+
+func TestTemplateDir(t *testing.T) {
+	assert.Equal(t, "/src/app", TemplateDir("/home/me", "/src/app", "Rockerfile"))
+	assert.Equal(t, "/home/me/deploy", TemplateDir("/home/me", "", "deploy/Rockerfile"))
+	assert.Equal(t, "/etc/rocker", TemplateDir("/home/me", "", "/etc/rocker/Rockerfile"))
+	assert.Equal(t, "/home/me", TemplateDir("/home/me", "", "-"))
+
+	// a remote context is unpacked to wd, not to the current directory
+	assert.Equal(t, "/tmp/rocker-context-123", TemplateDir("/tmp/rocker-context-123", "", "Rockerfile"))
+}
+
+func TestFetchContext_HTTP(t *testing.T) {
+	tarball := makeContextTarball(t, map[string]string{
+		"Rockerfile":  "FROM ubuntu",
+		"src/main.go": "package main",
+	})
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(tarball)
+	}))
+	defer ts.Close()
+
+	checksum := fmt.Sprintf("%x", sha256.Sum256(tarball))
+
+	dir, err := FetchContext(ts.URL+"/context.tgz", checksum, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	content, err := ioutil.ReadFile(filepath.Join(dir, "src/main.go"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "package main", string(content))
+
+	_, err = FetchContext(ts.URL+"/context.tgz", "sha256:"+fmt.Sprintf("%x", sha256.Sum256([]byte("other"))), nil)
+	assert.Contains(t, err.Error(), "Checksum mismatch")
+}
+
+func TestExtractContext_OutsideDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rocker-context-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	tw.WriteHeader(&tar.Header{Name: "../../outside", Mode: 0644, Size: 1})
+	tw.Write([]byte("x"))
+	tw.Close()
+
+	if err := extractContext(&buf, dir); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = os.Stat(filepath.Join(dir, "outside"))
+	assert.NoError(t, err, "expected the entry to stay inside the context dir")
+}
+
+func TestFetchContext_SymlinkOutsideDir(t *testing.T) {
+	outside, err := ioutil.TempDir("", "rocker-context-outside")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(outside)
+
+	for _, linkname := range []string{outside, "../../../../../../../../" + outside} {
+		var buf bytes.Buffer
+		tw := tar.NewWriter(&buf)
+		tw.WriteHeader(&tar.Header{Name: "evil", Typeflag: tar.TypeSymlink, Linkname: linkname, Mode: 0777})
+		tw.WriteHeader(&tar.Header{Name: "evil/file", Mode: 0644, Size: 1})
+		tw.Write([]byte("x"))
+		tw.Close()
+
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write(buf.Bytes())
+		}))
+
+		_, err := FetchContext(ts.URL+"/context.tar", "", nil)
+		ts.Close()
+
+		assert.Error(t, err, "expected the symlink to %s to be rejected", linkname)
+
+		_, err = os.Stat(filepath.Join(outside, "file"))
+		assert.True(t, os.IsNotExist(err), "expected nothing to be written through the symlink to %s", linkname)
+	}
+}
+
+func TestExtractContext_ThroughSymlink(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rocker-context-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	outside, err := ioutil.TempDir("", "rocker-context-outside")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(outside)
+
+	// A symlink that was already on disk, e.g. from a previous entry that a check missed
+	if err := os.Symlink(outside, filepath.Join(dir, "evil")); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	tw.WriteHeader(&tar.Header{Name: "evil/sub/file", Mode: 0644, Size: 1})
+	tw.Write([]byte("x"))
+	tw.Close()
+
+	assert.Error(t, extractContext(&buf, dir))
+
+	_, err = os.Stat(filepath.Join(outside, "sub"))
+	assert.True(t, os.IsNotExist(err), "expected nothing to be created through the symlink")
+}
+
+func TestExtractContext_SymlinkInside(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rocker-context-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	tw.WriteHeader(&tar.Header{Name: "bin/", Typeflag: tar.TypeDir, Mode: 0755})
+	tw.WriteHeader(&tar.Header{Name: "bin/app", Mode: 0755, Size: 1})
+	tw.Write([]byte("x"))
+	tw.WriteHeader(&tar.Header{Name: "app", Typeflag: tar.TypeSymlink, Linkname: "bin/app", Mode: 0777})
+	tw.Close()
+
+	if err := extractContext(&buf, dir); err != nil {
+		t.Fatal(err)
+	}
+
+	content, err := ioutil.ReadFile(filepath.Join(dir, "app"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "x", string(content))
+}
+
+func TestBuild_NamedContext(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rocker-context-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := ioutil.WriteFile(filepath.Join(dir, ".dockerignore"), []byte("*.log\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	b, _ := makeBuild(t, "", Config{
+		Contexts: map[string]string{"assets": dir},
+	})
+
+	contextDir, excludes, err := b.namedContext("assets")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, dir, contextDir)
+	assert.Equal(t, []string{"*.log"}, excludes)
+
+	_, _, err = b.namedContext("config")
+	assert.Error(t, err)
+}
@@ -19,15 +19,15 @@ package build
 import (
 	"archive/tar"
 	"bufio"
+	"context"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
+	"time"
 
-	"github.com/docker/docker/pkg/fileutils"
-	"github.com/docker/docker/pkg/tarsum"
 	"github.com/docker/docker/pkg/units"
 	"github.com/kr/pretty"
 
@@ -42,15 +42,21 @@ type upload struct {
 	src   string
 	files []*uploadFile
 	dest  string
+
+	// epoch is set for --reproducible, see normalizeUploadHeader
+	epoch *time.Time
 }
 
 type uploadFile struct {
 	src  string
 	dest string
 	size int64
+
+	// a local archive ADD unpacks to the destination
+	extract bool
 }
 
-func addFiles(b *Build, args []string) (s State, err error) {
+func addFiles(ctx context.Context, b *Build, args []string, chown, checksum string) (s State, err error) {
 
 	s = b.state
 
@@ -77,6 +83,10 @@ func addFiles(b *Build, args []string) (s State, err error) {
 		}
 	}
 
+	if checksum != "" && (len(src) != 1 || !isURL(src[0])) {
+		return s, fmt.Errorf("ADD --checksum can only be used with a single url source")
+	}
+
 	uf := b.urlFetcher
 
 	for _, arg := range args {
@@ -84,16 +94,29 @@ func addFiles(b *Build, args []string) (s State, err error) {
 			continue
 		}
 
-		if _, err = uf.Get(arg); err != nil {
+		var info *URLInfo
+
+		// Offline builds can only use what was downloaded before
+		if b.cfg.Offline {
+			if info, err = uf.GetInfo(arg); err != nil {
+				return s, fmt.Errorf("Cannot download %s in offline mode, %s", arg, err)
+			}
+		} else if info, err = uf.Get(arg); err != nil {
 			return s, err
 		}
+
+		if checksum != "" {
+			if err = info.VerifyChecksum(checksum); err != nil {
+				return s, err
+			}
+		}
 	}
 
-	return copyFiles(b, args, "ADD")
+	return copyFiles(ctx, b, args, "ADD", "", chown)
 
 }
 
-func copyFiles(b *Build, args []string, cmdName string) (s State, err error) {
+func copyFiles(ctx context.Context, b *Build, args []string, cmdName, contextName, chown string) (s State, err error) {
 
 	s = b.state
 
@@ -102,13 +125,20 @@ func copyFiles(b *Build, args []string, cmdName string) (s State, err error) {
 	}
 
 	var (
-		tarSum   tarsum.TarSum
 		src      = args[0 : len(args)-1]
 		dest     = filepath.FromSlash(args[len(args)-1]) // last one is always the dest
 		u        *upload
 		excludes = s.NoCache.Dockerignore
+
+		contextDir = b.cfg.ContextDir
 	)
 
+	if contextName != "" {
+		if contextDir, excludes, err = b.namedContext(contextName); err != nil {
+			return s, err
+		}
+	}
+
 	// If destination is not a directory (no trailing slash)
 	hasTrailingSlash := strings.HasSuffix(dest, string(os.PathSeparator))
 	if !hasTrailingSlash && len(src) > 1 {
@@ -123,33 +153,38 @@ func copyFiles(b *Build, args []string, cmdName string) (s State, err error) {
 		}
 	}
 
-	if u, err = makeTarStream(b.cfg.ContextDir, dest, cmdName, src, excludes, b.urlFetcher); err != nil {
+	if u, err = makeUpload(contextDir, dest, cmdName, src, excludes, b.urlFetcher); err != nil {
 		return s, err
 	}
 
 	// skip COPY if no files matched
 	if len(u.files) == 0 {
-		log.Infof("| No files matched")
+		b.log.Infof("| No files matched")
 		return s, nil
 	}
 
-	log.Infof("| Calculating tarsum for %d files (%s total)", len(u.files), units.HumanSize(float64(u.size)))
-
-	if tarSum, err = tarsum.NewTarSum(u.tar, true, tarsum.Version1); err != nil {
-		return s, err
+	if b.cfg.Reproducible {
+		u.epoch = &b.cfg.SourceDateEpoch
+		sort.Stable(uploadFilesByDest(u.files))
 	}
-	if _, err = io.Copy(ioutil.Discard, tarSum); err != nil {
+
+	b.log.Infof("| Calculating checksum of %d files (%s total)", len(u.files), units.HumanSize(float64(u.size)))
+
+	digest, err := b.fileHashes.contentDigest(u)
+	if err != nil {
 		return s, err
 	}
-	u.tar.Close()
 
-	// TODO: useful commit comment?
+	message := fmt.Sprintf("%s%s %s to %s", cmdName, chownFlag(chown), digest, dest)
+	s.Commit("%s", message)
 
-	message := fmt.Sprintf("%s %s to %s", cmdName, tarSum.Sum(nil), dest)
-	s.Commit(message)
+	// The normalized files make a different layer, it is cached apart
+	if u.epoch != nil {
+		s.Commit("REPRODUCIBLE %d", u.epoch.Unix())
+	}
 
 	// Check cache
-	s, hit, err := b.probeCache(s)
+	s, hit, err := b.probeCache(ctx, s)
 	if err != nil {
 		return s, err
 	}
@@ -166,15 +201,21 @@ func copyFiles(b *Build, args []string, cmdName string) (s State, err error) {
 
 	s.Config.Cmd = origCmd
 
-	// We need to make a new tar stream, because the previous one has been
-	// read by the tarsum; maybe, optimize this in future
-	if u, err = makeTarStream(b.cfg.ContextDir, dest, cmdName, src, excludes, b.urlFetcher); err != nil {
+	// Names are resolved in the image the files are copied to
+	own, err := resolveChown(b, s.NoCache.ContainerID, chown)
+	if err != nil {
 		return s, err
 	}
+	if own == nil && isRootless(b.client) {
+		own = &owner{}
+	}
+
+	// The tar stream is only needed if there is no cache
+	u.startTar()
 
 	// Copy to "/" because we made the prefix inside the tar archive
 	// Do that because we are not able to reliably create directories inside the container
-	if err = b.client.UploadToContainer(s.NoCache.ContainerID, u.tar, "/"); err != nil {
+	if err = b.client.UploadToContainer(s.NoCache.ContainerID, chownStream(u.tar, own), "/"); err != nil {
 		return s, err
 	}
 
@@ -182,6 +223,17 @@ func copyFiles(b *Build, args []string, cmdName string) (s State, err error) {
 }
 
 func makeTarStream(srcPath, dest, cmdName string, includes, excludes []string, urlFetcher URLFetcher) (u *upload, err error) {
+	if u, err = makeUpload(srcPath, dest, cmdName, includes, excludes, urlFetcher); err != nil {
+		return u, err
+	}
+	if len(u.files) > 0 {
+		u.startTar()
+	}
+	return u, nil
+}
+
+// makeUpload lists the files to copy and how they are named in the tar stream
+func makeUpload(srcPath, dest, cmdName string, includes, excludes []string, urlFetcher URLFetcher) (u *upload, err error) {
 
 	u = &upload{
 		src:  srcPath,
@@ -228,7 +280,7 @@ func makeTarStream(srcPath, dest, cmdName string, includes, excludes []string, u
 		// e.g. COPY asd[/1,2] /lib  -->  /lib[/1,2]  but not /lib/asd[/1,2]
 		if itemIsDir {
 			stripDir = true
-		} else if !hasWildcards && !hasLeadingSlash {
+		} else if !hasWildcards && !hasLeadingSlash && !u.files[0].extract {
 			// If we've got a single file that was explicitly pointed in the source item
 			// we need to replace its name with the destination
 			// e.g. COPY src/foo.txt /app/bar.txt
@@ -258,6 +310,11 @@ func makeTarStream(srcPath, dest, cmdName string, includes, excludes []string, u
 		u.dest = u.dest[1:]
 	}
 
+	return u, nil
+}
+
+// startTar makes the tar stream of the upload files, written as it is read
+func (u *upload) startTar() {
 	log.Debugf("Making archive prefix=%s %# v", u.dest, pretty.Formatter(u))
 
 	pipeReader, pipeWriter := io.Pipe()
@@ -268,6 +325,7 @@ func makeTarStream(srcPath, dest, cmdName string, includes, excludes []string, u
 			TarWriter: tar.NewWriter(pipeWriter),
 			Buffer:    bufio.NewWriterSize(nil, buffer32K),
 			SeenFiles: make(map[uint64]string),
+			Epoch:     u.epoch,
 		}
 
 		defer func() {
@@ -281,13 +339,25 @@ func makeTarStream(srcPath, dest, cmdName string, includes, excludes []string, u
 
 		// write files to tar
 		for _, f := range u.files {
-			ta.addTarFile(f.src, u.dest+f.dest)
+			if !f.extract {
+				ta.addTarFile(f.src, u.dest+f.dest)
+				continue
+			}
+			if err := ta.addArchive(f.src, filepath.ToSlash(u.dest)); err != nil {
+				pipeWriter.CloseWithError(err)
+				return
+			}
 		}
 	}()
-
-	return u, nil
 }
 
+// uploadFilesByDest sorts the upload files by the name in the tar stream
+type uploadFilesByDest []*uploadFile
+
+func (a uploadFilesByDest) Len() int           { return len(a) }
+func (a uploadFilesByDest) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a uploadFilesByDest) Less(i, j int) bool { return a[i].dest < a[j].dest }
+
 func listFiles(srcPath string, includes, excludes []string, cmdName string, urlFetcher URLFetcher) ([]*uploadFile, error) {
 
 	log.Debugf("searching patterns, %# v\n", pretty.Formatter(includes))
@@ -295,16 +365,11 @@ func listFiles(srcPath string, includes, excludes []string, cmdName string, urlF
 	result := []*uploadFile{}
 	seen := map[string]struct{}{}
 
-	// TODO: support local archives (and maybe a remote archives as well)
-
-	excludes, patDirs, exceptions, err := fileutils.CleanPatterns(excludes)
+	ignore, err := newIgnoreMatcher(excludes)
 	if err != nil {
 		return nil, err
 	}
 
-	// TODO: here we remove some exclude patterns, how about patDirs?
-	excludes, nestedPatterns := findNestedPatterns(excludes)
-
 	for _, pattern := range includes {
 
 		if isURL(pattern) {
@@ -355,26 +420,20 @@ func listFiles(srcPath string, includes, excludes []string, cmdName string, urlF
 					return err
 				}
 
-				// TODO: ensure ignoring works correctly, maybe improve .dockerignore to work more like .gitignore?
-
 				skip := false
-				skipNested := false
 
 				// Here we want to keep files that are specified explicitly in the includes,
 				// no matter what. For example, .dockerignore can have some wildcard items
 				// specified, by in COPY we want explicitly add a file, that could be ignored
 				// otherwise using a wildcard or directory COPY
 				if pattern != relFilePath {
-					if skip, err = fileutils.OptimizedMatches(relFilePath, excludes, patDirs); err != nil {
-						return err
-					}
-					if skipNested, err = matchNested(relFilePath, nestedPatterns); err != nil {
+					if skip, err = ignore.Matches(relFilePath); err != nil {
 						return err
 					}
 				}
 
-				if skip || skipNested {
-					if !exceptions && info.IsDir() {
+				if skip {
+					if info.IsDir() && ignore.CanSkipDir(relFilePath) {
 						return filepath.SkipDir
 					}
 					return nil
@@ -413,10 +472,14 @@ func listFiles(srcPath string, includes, excludes []string, cmdName string, urlF
 					resultFilePath = filepath.Base(relFilePath)
 				}
 
+				// ADD unpacks archives given as sources, but not the ones inside given directories
+				extract := cmdName == "ADD" && !matchInfo.IsDir() && archiveKind(path) != archiveNone
+
 				result = append(result, &uploadFile{
-					src:  path,
-					dest: resultFilePath,
-					size: info.Size(),
+					src:     path,
+					dest:    resultFilePath,
+					size:    info.Size(),
+					extract: extract,
 				})
 
 				return nil
@@ -446,40 +509,3 @@ func containsWildcards(name string) bool {
 func splitPath(path string) []string {
 	return strings.Split(path, string(os.PathSeparator))
 }
-
-type nestedPattern struct {
-	prefix  string
-	pattern string
-}
-
-func (p nestedPattern) Match(path string) (bool, error) {
-	if !strings.HasPrefix(path, p.prefix) {
-		return false, nil
-	}
-	return filepath.Match(p.pattern, filepath.Base(path))
-}
-
-func matchNested(path string, patterns []nestedPattern) (bool, error) {
-	for _, p := range patterns {
-		if m, err := p.Match(path); err != nil || m {
-			return m, err
-		}
-	}
-	return false, nil
-}
-
-func findNestedPatterns(excludes []string) (newExcludes []string, nested []nestedPattern) {
-	newExcludes = []string{}
-	nested = []nestedPattern{}
-	for _, e := range excludes {
-		i := strings.Index(e, "**/")
-		// keep exclude
-		if i < 0 {
-			newExcludes = append(newExcludes, e)
-			continue
-		}
-		// make a nested pattern
-		nested = append(nested, nestedPattern{e[:i], e[i+3:]})
-	}
-	return newExcludes, nested
-}
@@ -380,6 +380,48 @@ func TestCopy_ListFiles_Excludes_FileInAnyDir(t *testing.T) {
 	}
 }
 
+func TestCopy_ListFiles_Excludes_ExceptionInDir(t *testing.T) {
+	tmpDir := makeTmpDir(t, map[string]string{
+		"a/test1.txt":   "hello",
+		"b/test2.txt":   "hello",
+		"b/keep.txt":    "hello",
+		"c/d/debug.log": "hello",
+		"c/d/build.log": "hello",
+	})
+	defer os.RemoveAll(tmpDir)
+
+	includes := []string{
+		".",
+	}
+	excludes := []string{
+		"b",
+		"!b/keep.txt",
+		"**/*.log",
+		"!**/build.log",
+	}
+
+	matches, err := listFiles(tmpDir, includes, excludes, "COPY", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Logf("includes: %# v", pretty.Formatter(includes))
+	t.Logf("excludes: %# v", pretty.Formatter(excludes))
+	t.Logf("matches: %# v", pretty.Formatter(matches))
+
+	assertions := [][2]string{
+		{tmpDir + "/a/test1.txt", "a/test1.txt"},
+		{tmpDir + "/b/keep.txt", "b/keep.txt"},
+		{tmpDir + "/c/d/build.log", "c/d/build.log"},
+	}
+
+	assert.Len(t, matches, len(assertions))
+	for i, a := range assertions {
+		assert.Equal(t, a[0], matches[i].src, "bad match src at index %d", i)
+		assert.Equal(t, a[1], matches[i].dest, "bad match dest at index %d", i)
+	}
+}
+
 func TestCopy_ListFiles_SymLink(t *testing.T) {
 	tmpDir, err := ioutil.TempDir("", "rocker-copy-test")
 	if err != nil {
@@ -0,0 +1,172 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Files modified more recently than this are hashed on every build
+const racyModTime = 2 * time.Second
+
+// fileHash is the content hash of a file along with what the file looked
+// like when it was hashed; it is reused while the file stays the same
+type fileHash struct {
+	Size    int64       `json:"size"`
+	ModTime int64       `json:"mtime"`
+	Mode    os.FileMode `json:"mode"`
+	Sum     string      `json:"sum"`
+}
+
+// fileHashCache remembers the content hashes of the files COPY and ADD
+// read, so an incremental build reads only the files that changed. It is
+// stored in <base>/file_hashes.json, or kept in memory if there is no base
+type fileHashCache struct {
+	file    string
+	hashes  map[string]fileHash
+	changed bool
+	mu      sync.Mutex
+}
+
+func newFileHashCache(base string) *fileHashCache {
+	c := &fileHashCache{hashes: map[string]fileHash{}}
+	if base == "" {
+		return c
+	}
+
+	c.file = filepath.Join(base, "file_hashes.json")
+
+	data, err := ioutil.ReadFile(c.file)
+	if err != nil {
+		return c
+	}
+	if err := json.Unmarshal(data, &c.hashes); err != nil {
+		log.Debugf("Ignore broken file hashes cache %s, error: %s", c.file, err)
+		c.hashes = map[string]fileHash{}
+	}
+
+	return c
+}
+
+// sum returns the sha256 of the file content, or of the link target for symlinks
+func (c *fileHashCache) sum(path string, info os.FileInfo) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	h, ok := c.hashes[path]
+	if ok && h.Size == info.Size() && h.ModTime == info.ModTime().UnixNano() && h.Mode == info.Mode() {
+		return h.Sum, nil
+	}
+
+	hash := sha256.New()
+
+	if info.Mode()&os.ModeSymlink != 0 {
+		link, err := os.Readlink(path)
+		if err != nil {
+			return "", err
+		}
+		io.WriteString(hash, link)
+	} else {
+		f, err := os.Open(path)
+		if err != nil {
+			return "", err
+		}
+		defer f.Close()
+
+		if _, err := io.Copy(hash, f); err != nil {
+			return "", fmt.Errorf("Failed to read %s, error: %s", path, err)
+		}
+	}
+
+	h = fileHash{
+		Size:    info.Size(),
+		ModTime: info.ModTime().UnixNano(),
+		Mode:    info.Mode(),
+		Sum:     fmt.Sprintf("%x", hash.Sum(nil)),
+	}
+
+	// A file changed right before it was hashed may change again within the
+	// resolution of the modification time, so such a hash is not kept
+	if time.Since(info.ModTime()) > racyModTime {
+		c.hashes[path] = h
+		c.changed = true
+	}
+
+	return h.Sum, nil
+}
+
+// save writes the hashes to the cache file if there are new ones
+func (c *fileHashCache) save() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.file == "" || !c.changed {
+		return nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(c.file), 0755); err != nil {
+		return err
+	}
+	data, err := json.Marshal(c.hashes)
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(c.file, data, 0644); err != nil {
+		return fmt.Errorf("Failed to write file hashes cache %s, error: %s", c.file, err)
+	}
+
+	c.changed = false
+	return nil
+}
+
+// contentDigest hashes what a COPY or ADD puts into the image: the name,
+// mode and content of every file as it goes to the tar stream. Unlike a
+// tarsum it does not need the stream, so a cache hit reads no files unless
+// they changed since the last build
+func (c *fileHashCache) contentDigest(u *upload) (string, error) {
+	hash := sha256.New()
+
+	fmt.Fprintf(hash, "%q\n", u.dest)
+
+	for _, f := range u.files {
+		info, err := os.Lstat(f.src)
+		if err != nil {
+			return "", err
+		}
+		sum, err := c.sum(f.src, info)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(hash, "%q %o %t %s\n", f.dest, info.Mode(), f.extract, sum)
+	}
+
+	if err := c.save(); err != nil {
+		log.Warnf("| %s", err)
+	}
+
+	return fmt.Sprintf("sha256:%x", hash.Sum(nil)), nil
+}
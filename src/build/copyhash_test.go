@@ -0,0 +1,112 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCopyHash_ContentDigest(t *testing.T) {
+	tmpDir := makeTmpDir(t, map[string]string{
+		"a/test1.txt": "hello",
+		"a/test2.txt": "world",
+	})
+	defer os.RemoveAll(tmpDir)
+
+	digest := func(dest string) string {
+		u, err := makeUpload(tmpDir, dest, "COPY", []string{"a"}, []string{}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		d, err := newFileHashCache("").contentDigest(u)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return d
+	}
+
+	d1 := digest("/app/")
+	assert.Equal(t, d1, digest("/app/"))
+	assert.NotEqual(t, d1, digest("/opt/"), "destination")
+
+	if err := ioutil.WriteFile(filepath.Join(tmpDir, "a/test2.txt"), []byte("there"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	d2 := digest("/app/")
+	assert.NotEqual(t, d1, d2, "content")
+
+	if err := os.Chmod(filepath.Join(tmpDir, "a/test2.txt"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	assert.NotEqual(t, d2, digest("/app/"), "mode")
+}
+
+func TestCopyHash_ReusesUnchangedFiles(t *testing.T) {
+	tmpDir := makeTmpDir(t, map[string]string{
+		"test.txt": "hello",
+	})
+	defer os.RemoveAll(tmpDir)
+
+	cacheDir, err := ioutil.TempDir("", "rocker-file-hashes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(cacheDir)
+
+	file := filepath.Join(tmpDir, "test.txt")
+	mtime := time.Now().Add(-time.Hour)
+	if err := os.Chtimes(file, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+
+	info, _ := os.Lstat(file)
+	c := newFileHashCache(cacheDir)
+	sum1, err := c.sum(file, info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.save(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Same size and mtime, the content is not read again
+	ioutil.WriteFile(file, []byte("HELLO"), 0644)
+	os.Chtimes(file, mtime, mtime)
+	info, _ = os.Lstat(file)
+
+	sum2, err := newFileHashCache(cacheDir).sum(file, info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, sum1, sum2)
+
+	// Touched files are hashed again
+	os.Chtimes(file, time.Now(), time.Now())
+	info, _ = os.Lstat(file)
+
+	sum3, err := newFileHashCache(cacheDir).sum(file, info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NotEqual(t, sum1, sum3)
+}
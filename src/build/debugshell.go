@@ -0,0 +1,71 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import "context"
+
+// debugFailedRun opens an interactive shell in what the failed RUN left behind,
+// for --debug-on-error. A stopped container cannot run anything, so the container
+// is committed to a temporary image and the shell runs in a container of it the
+// way ATTACH does, with the same environment, working directory and mounts as
+// the command had. The build fails with the error of RUN when the shell exits
+func (b *Build) debugFailedRun(ctx context.Context, s State, runErr error) {
+	if !b.cfg.DebugOnError || ExitCode(runErr) != ExitStep {
+		return
+	}
+
+	b.log.Warnf("| %s, open a shell in what it left to debug it; exit the shell to fail the build", runErr)
+
+	debug := s
+	img, err := b.client.CommitContainer(&debug)
+	if err != nil {
+		b.log.Errorf("| Failed to commit container %.12s for debugging, error: %s", s.NoCache.ContainerID, err)
+		return
+	}
+	defer func() {
+		if err := b.client.RemoveImage(img.ID); err != nil {
+			b.log.Errorf("Failed to remove the debug image %.12s, error: %s", img.ID, err)
+		}
+	}()
+
+	debug.ImageID = img.ID
+	debug.NoCache.ContainerID = ""
+	debug.Config.Cmd = s.shell()[:1]
+	debug.Config.Entrypoint = []string{}
+	debug.Config.Tty = true
+	debug.Config.OpenStdin = true
+	debug.Config.StdinOnce = true
+	debug.Config.AttachStdin = true
+	debug.Config.AttachStderr = true
+	debug.Config.AttachStdout = true
+
+	containerID, err := b.client.CreateContainer(debug)
+	if err != nil {
+		b.log.Errorf("| Failed to create the debug container, error: %s", err)
+		return
+	}
+	defer func() {
+		if err := b.client.RemoveContainer(containerID); err != nil {
+			b.log.Errorf("Failed to remove the debug container %.12s, error: %s", containerID, err)
+		}
+	}()
+
+	// The exit code of the shell is of no interest, the build fails anyway
+	if err := b.client.RunContainer(ctx, containerID, true); err != nil {
+		b.log.Debugf("Debug shell: %s", err)
+	}
+}
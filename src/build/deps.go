@@ -0,0 +1,232 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/grammarly/rocker/src/imagename"
+	"github.com/grammarly/rocker/src/template"
+)
+
+// DepsStage is a FROM section of a Rockerfile in the dependency graph
+type DepsStage struct {
+	From     string   `json:"from"`
+	Produces []string `json:"produces,omitempty"`
+	// ImportsFrom are the indexes of the stages whose EXPORT this stage IMPORTs,
+	// or which it copies files from or is based on
+	ImportsFrom []int `json:"imports_from,omitempty"`
+	// CopiesFrom are the images this stage copies files from with COPY --from
+	CopiesFrom []string `json:"copies_from,omitempty"`
+}
+
+// DepsNode is a Rockerfile in the dependency graph; From has the images
+// of both FROM and COPY --from
+type DepsNode struct {
+	File      string      `json:"file"`
+	From      []string    `json:"from"`
+	Produces  []string    `json:"produces"`
+	DependsOn []string    `json:"depends_on"`
+	Stages    []DepsStage `json:"stages"`
+	Error     string      `json:"error,omitempty"`
+}
+
+// DepsGraph tells which Rockerfiles of a directory tree depend on the images
+// produced by the others; images are matched by the repository, regardless
+// of the tag, since tags are usually given with variables
+type DepsGraph struct {
+	Rockerfiles []*DepsNode `json:"rockerfiles"`
+	// Images maps the produced repositories to the Rockerfiles producing them
+	Images map[string][]string `json:"images"`
+}
+
+// IsRockerfileName tells if the file looks like a Rockerfile:
+// Rockerfile, Rockerfile.<name> or <name>.Rockerfile
+func IsRockerfileName(name string) bool {
+	return name == "Rockerfile" || strings.HasPrefix(name, "Rockerfile.") || strings.HasSuffix(name, ".Rockerfile")
+}
+
+// FindRockerfiles returns the Rockerfiles in the directory tree, skipping
+// hidden directories and node_modules; paths are relative to the root
+func FindRockerfiles(root string) ([]string, error) {
+	files := []string{}
+
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			if path != root && (strings.HasPrefix(info.Name(), ".") || info.Name() == "node_modules") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if IsRockerfileName(info.Name()) {
+			rel, err := filepath.Rel(root, path)
+			if err != nil {
+				return err
+			}
+			files = append(files, filepath.ToSlash(rel))
+		}
+		return nil
+	})
+
+	return files, err
+}
+
+// NewDepsGraph reads the Rockerfiles of the directory tree with the given
+// variables and makes their dependency graph. A Rockerfile that fails to
+// render or parse gets the error in the graph instead of failing it all.
+// The templates are rendered in the sandbox if one is given.
+func NewDepsGraph(root string, vars template.Vars, funs template.Funs, sandbox *template.Sandbox) (*DepsGraph, error) {
+	files, err := FindRockerfiles(root)
+	if err != nil {
+		return nil, err
+	}
+
+	graph := &DepsGraph{
+		Rockerfiles: []*DepsNode{},
+		Images:      map[string][]string{},
+	}
+
+	for _, file := range files {
+		node := &DepsNode{
+			File:      file,
+			From:      []string{},
+			Produces:  []string{},
+			DependsOn: []string{},
+			Stages:    []DepsStage{},
+		}
+		graph.Rockerfiles = append(graph.Rockerfiles, node)
+
+		r, err := NewRockerfileFromFile(filepath.Join(root, filepath.FromSlash(file)), vars, funs, sandbox)
+		if err != nil {
+			node.Error = err.Error()
+			continue
+		}
+
+		node.Stages = rockerfileStages(r.Commands())
+
+		for _, stage := range node.Stages {
+			if stage.From != "" {
+				node.From = appendUnique(node.From, stage.From)
+			}
+			for _, image := range stage.CopiesFrom {
+				node.From = appendUnique(node.From, image)
+			}
+			for _, image := range stage.Produces {
+				node.Produces = appendUnique(node.Produces, image)
+				repo := repository(image)
+				graph.Images[repo] = appendUnique(graph.Images[repo], file)
+			}
+		}
+	}
+
+	for _, node := range graph.Rockerfiles {
+		for _, from := range node.From {
+			for _, producer := range graph.Images[repository(from)] {
+				if producer != node.File {
+					node.DependsOn = appendUnique(node.DependsOn, producer)
+				}
+			}
+		}
+		sort.Strings(node.DependsOn)
+	}
+
+	return graph, nil
+}
+
+// rockerfileStages splits the commands by FROM; IMPORT takes the data
+// of the latest EXPORT, which may be in one of the previous stages, while
+// COPY --from and FROM of a stage refer to the named stages
+func rockerfileStages(commands []ConfigCommand) []DepsStage {
+	var (
+		stages     = []DepsStage{}
+		lastExport = -1
+		named      = map[string]int{}
+	)
+
+	for _, cfg := range commands {
+		if cfg.name == "from" {
+			stage := DepsStage{}
+			name, as, err := fromArgs(cfg.args)
+			if i, ok := named[strings.ToLower(name)]; ok {
+				// FROM of a previous stage is not an image dependency
+				stage.ImportsFrom = []int{i}
+			} else if err == nil && name != NoBaseImageSpecifier {
+				stage.From = name
+			}
+			if as != "" {
+				named[as] = len(stages)
+			}
+			stages = append(stages, stage)
+			continue
+		}
+		if len(stages) == 0 {
+			continue
+		}
+		stage := &stages[len(stages)-1]
+
+		switch cfg.name {
+		case "copy":
+			from := cfg.flags["from"]
+			if i, ok := named[strings.ToLower(from)]; ok {
+				stage.ImportsFrom = appendUniqueInt(stage.ImportsFrom, i)
+			} else if from != "" {
+				stage.CopiesFrom = appendUnique(stage.CopiesFrom, from)
+			}
+		case "tag", "push":
+			if len(cfg.args) == 1 {
+				stage.Produces = appendUnique(stage.Produces, cfg.args[0])
+			}
+		case "export":
+			lastExport = len(stages) - 1
+		case "import":
+			if lastExport >= 0 && lastExport != len(stages)-1 {
+				stage.ImportsFrom = appendUniqueInt(stage.ImportsFrom, lastExport)
+			}
+		}
+	}
+
+	return stages
+}
+
+// repository returns the image name without the tag
+func repository(image string) string {
+	return imagename.NewFromString(image).NameWithRegistry()
+}
+
+func appendUnique(list []string, item string) []string {
+	for _, existing := range list {
+		if existing == item {
+			return list
+		}
+	}
+	return append(list, item)
+}
+
+func appendUniqueInt(list []int, item int) []int {
+	for _, existing := range list {
+		if existing == item {
+			return list
+		}
+	}
+	return append(list, item)
+}
@@ -0,0 +1,81 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/grammarly/rocker/src/template"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewDepsGraph(t *testing.T) {
+	tmpDir := makeTmpDir(t, map[string]string{
+		"base/Rockerfile":           "FROM ubuntu\nPUSH acme/base:{{ .Version }}\n",
+		"app/Rockerfile":            "FROM acme/base:1.0\nEXPORT /out\nFROM alpine\nIMPORT /out\nTAG acme/app:latest\n",
+		"tools/lint.Rockerfile":     "FROM acme/base\nFROM acme/app\n",
+		"broken/Rockerfile":         "FROM {{ .Nope\n",
+		".git/Rockerfile":           "FROM hidden\n",
+		"node_modules/x/Rockerfile": "FROM hidden\n",
+		"docs/README.md":            "FROM nothing\n",
+	})
+	defer os.RemoveAll(tmpDir)
+
+	graph, err := NewDepsGraph(tmpDir, template.Vars{"Version": "2"}, template.Funs{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files := []string{}
+	nodes := map[string]*DepsNode{}
+	for _, node := range graph.Rockerfiles {
+		files = append(files, node.File)
+		nodes[node.File] = node
+	}
+	assert.Equal(t, []string{"app/Rockerfile", "base/Rockerfile", "broken/Rockerfile", "tools/lint.Rockerfile"}, files)
+
+	assert.Equal(t, []string{"acme/base:2"}, nodes["base/Rockerfile"].Produces)
+	assert.Equal(t, []string{}, nodes["base/Rockerfile"].DependsOn)
+
+	app := nodes["app/Rockerfile"]
+	assert.Equal(t, []string{"acme/base:1.0", "alpine"}, app.From)
+	assert.Equal(t, []string{"base/Rockerfile"}, app.DependsOn)
+	assert.Equal(t, []int{0}, app.Stages[1].ImportsFrom)
+
+	assert.Equal(t, []string{"app/Rockerfile", "base/Rockerfile"}, nodes["tools/lint.Rockerfile"].DependsOn)
+	assert.NotEmpty(t, nodes["broken/Rockerfile"].Error)
+
+	assert.Equal(t, map[string][]string{
+		"acme/base": {"base/Rockerfile"},
+		"acme/app":  {"app/Rockerfile"},
+	}, graph.Images)
+}
+
+func TestRockerfileStages_Named(t *testing.T) {
+	r, err := NewRockerfile("test", strings.NewReader("FROM golang AS builder\nFROM builder AS test\nFROM alpine\nCOPY --from=builder /app /app\nCOPY --from=test /report /report\nCOPY --from=busybox /bin/sh /bin/sh\n"), template.Vars{}, template.Funs{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, []DepsStage{
+		{From: "golang"},
+		{ImportsFrom: []int{0}},
+		{From: "alpine", ImportsFrom: []int{0, 1}, CopiesFrom: []string{"busybox"}},
+	}, rockerfileStages(r.Commands()))
+}
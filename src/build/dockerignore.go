@@ -18,6 +18,7 @@ package build
 
 import (
 	"bufio"
+	"fmt"
 	"io"
 	"os"
 	"path/filepath"
@@ -25,12 +26,27 @@ import (
 	"strings"
 )
 
-// TODO: maybe move some stuff from copy.go here
-
 var (
 	dockerignoreCommentRegexp = regexp.MustCompile("\\s*#.*")
 )
 
+// Ignore files of a build context, the first one found is used
+var ignoreFileNames = []string{".rockerignore", ".dockerignore"}
+
+// ReadContextIgnore reads the patterns of the files to leave out of the build
+// context in dir: .rockerignore, or .dockerignore if there is none. A context
+// without both ignores nothing
+func ReadContextIgnore(dir string) ([]string, error) {
+	for _, name := range ignoreFileNames {
+		file := filepath.Join(dir, name)
+		if _, err := os.Stat(file); err != nil {
+			continue
+		}
+		return ReadDockerignoreFile(file)
+	}
+	return []string{}, nil
+}
+
 // ReadDockerignoreFile reads and parses .dockerignore file
 func ReadDockerignoreFile(file string) ([]string, error) {
 	fd, err := os.Open(file)
@@ -68,3 +84,137 @@ func ReadDockerignore(r io.Reader) ([]string, error) {
 
 	return result, nil
 }
+
+// ignorePattern is a single line of .dockerignore
+type ignorePattern struct {
+	pattern  string
+	dirs     []string
+	negative bool
+
+	// for **/ patterns, the pattern matches any path element under the prefix
+	nested bool
+	prefix string
+}
+
+// ignoreMatcher matches paths of the context against .dockerignore patterns.
+// Patterns apply in order and the last matching one wins, so a !pattern
+// brings back what the patterns above it excluded
+type ignoreMatcher struct {
+	patterns   []ignorePattern
+	exceptions bool
+}
+
+func newIgnoreMatcher(excludes []string) (*ignoreMatcher, error) {
+	m := &ignoreMatcher{}
+
+	for _, e := range excludes {
+		p := ignorePattern{}
+
+		if strings.HasPrefix(e, "!") {
+			p.negative = true
+			m.exceptions = true
+			e = e[1:]
+		}
+
+		e = filepath.ToSlash(filepath.Clean(e))
+		if e == "." || e == "" {
+			if p.negative {
+				return nil, fmt.Errorf("Illegal exclusion pattern: !")
+			}
+			continue
+		}
+
+		if i := strings.Index(e, "**/"); i >= 0 {
+			p.nested = true
+			p.prefix = e[:i]
+			e = e[i+3:]
+		}
+
+		if _, err := filepath.Match(e, ""); err != nil {
+			return nil, fmt.Errorf("Invalid ignore pattern %q, error: %s", e, err)
+		}
+
+		p.pattern = e
+		p.dirs = strings.Split(e, "/")
+		m.patterns = append(m.patterns, p)
+	}
+
+	return m, nil
+}
+
+// Matches tells if the path, relative to the context root, is excluded
+func (m *ignoreMatcher) Matches(file string) (bool, error) {
+	file = filepath.ToSlash(file)
+	matched := false
+
+	for _, p := range m.patterns {
+		match, err := p.match(file)
+		if err != nil {
+			return false, err
+		}
+		if match {
+			matched = !p.negative
+		}
+	}
+
+	return matched, nil
+}
+
+// CanSkipDir tells if an excluded directory can be left out as a whole,
+// that is when no !pattern can bring back anything inside of it
+func (m *ignoreMatcher) CanSkipDir(dir string) bool {
+	if !m.exceptions {
+		return true
+	}
+
+	dirs := strings.Split(filepath.ToSlash(dir), "/")
+
+	for _, p := range m.patterns {
+		if !p.negative {
+			continue
+		}
+		if p.nested {
+			prefix := strings.Join(dirs, "/") + "/"
+			if strings.HasPrefix(prefix, p.prefix) || strings.HasPrefix(p.prefix, prefix) {
+				return false
+			}
+			continue
+		}
+		if len(p.dirs) <= len(dirs) {
+			continue
+		}
+		if match, _ := filepath.Match(strings.Join(p.dirs[:len(dirs)], "/"), strings.Join(dirs, "/")); match {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (p ignorePattern) match(file string) (bool, error) {
+	if p.nested {
+		if !strings.HasPrefix(file, p.prefix) {
+			return false, nil
+		}
+		// any of the path elements under the prefix, so the files inside
+		// of a matched directory are matched as well
+		for _, name := range strings.Split(strings.TrimPrefix(file, p.prefix), "/") {
+			if match, err := filepath.Match(p.pattern, name); err != nil || match {
+				return match, err
+			}
+		}
+		return false, nil
+	}
+
+	if match, err := filepath.Match(p.pattern, file); err != nil || match {
+		return match, err
+	}
+
+	// The pattern may match one of the parent directories
+	parents := strings.Split(file, "/")
+	parents = parents[:len(parents)-1]
+	if len(p.dirs) > len(parents) {
+		return false, nil
+	}
+	return filepath.Match(p.pattern, strings.Join(parents[:len(p.dirs)], "/"))
+}
@@ -17,6 +17,9 @@
 package build
 
 import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 
@@ -53,3 +56,81 @@ a/b/../c  # inline commend
 
 	assert.Equal(t, expected, result)
 }
+
+func TestDockerignore_ReadContextIgnore(t *testing.T) {
+	tmpDir := makeTmpDir(t, map[string]string{
+		".dockerignore": "docker",
+	})
+	defer os.RemoveAll(tmpDir)
+
+	result, err := ReadContextIgnore(tmpDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []string{"docker"}, result)
+
+	// .rockerignore takes precedence
+	if err := ioutil.WriteFile(filepath.Join(tmpDir, ".rockerignore"), []byte("rocker"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	result, err = ReadContextIgnore(tmpDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []string{"rocker"}, result)
+
+	result, err = ReadContextIgnore(filepath.Join(tmpDir, "missing"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Empty(t, result)
+}
+
+func TestDockerignore_Matcher(t *testing.T) {
+	m, err := newIgnoreMatcher([]string{
+		"*.md",
+		"!README.md",
+		"docs",
+		"!docs/api",
+		"**/*.o",
+		"!lib/**/keep.o",
+		"README.md",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for file, ignored := range map[string]bool{
+		"CHANGES.md":      true,
+		"README.md":       true,
+		"main.go":         false,
+		"docs":            true,
+		"docs/index.html": true,
+		"docs/api":        false,
+		"docs/api/x.html": false,
+		"main.o":          true,
+		"src/a/b.o":       true,
+		"lib/a/keep.o":    false,
+		"src/a/keep.o":    true,
+	} {
+		result, err := m.Matches(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, ignored, result, "file %s", file)
+	}
+
+	assert.False(t, m.CanSkipDir("docs"))
+	assert.True(t, m.CanSkipDir("build"), "exceptions do not reach into build")
+}
+
+func TestDockerignore_Matcher_SkipDir(t *testing.T) {
+	m, err := newIgnoreMatcher([]string{"node_modules", ".git"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, m.CanSkipDir("node_modules"))
+
+	_, err = newIgnoreMatcher([]string{"!"})
+	assert.EqualError(t, err, "Illegal exclusion pattern: !")
+}
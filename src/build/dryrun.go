@@ -0,0 +1,298 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"github.com/grammarly/rocker/src/dockerclient"
+	"github.com/grammarly/rocker/src/imagename"
+	"github.com/grammarly/rocker/src/spill"
+
+	"github.com/fsouza/go-dockerclient"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Statuses of the steps of the plan
+const (
+	PlanRun    = "run"
+	PlanCached = "cached"
+	PlanPull   = "pull"
+)
+
+// PlanStep is a command of the plan and what the build would do for it:
+// run it, take it from the cache, pull the image, or nothing, for the commands
+// that do not change the image
+type PlanStep struct {
+	Step    int
+	Command string
+	Status  string
+	ImageID string
+}
+
+// DryRun goes through the plan as Run does, with a client that only reads from the
+// daemon and a cache that is not written, and tells what each command would do.
+// No containers are created and nothing is pushed. Once a command misses the cache,
+// the rest of its FROM section runs, as in a real build. The cache of --cache-from
+// is not consulted, since a hit there pulls the image.
+func (b *Build) DryRun(plan Plan) ([]PlanStep, error) {
+	d := &dryRun{}
+
+	b.dryRun = d
+	b.client = &dryRunClient{Client: b.client, run: d, tagged: map[string]string{}, pulled: map[string]bool{}}
+
+	if b.registryCache != nil {
+		b.cache = b.registryCache.Cache
+		b.registryCache = nil
+	}
+	if b.cache != nil {
+		b.cache = readOnlyCache{b.cache}
+	}
+
+	b.cfg.Push = false
+	b.cfg.Attach = false
+	b.cfg.Prefetch = false
+	b.cfg.ParallelStages = false
+	b.cfg.CheckpointFile = ""
+	b.cfg.ResumeFile = ""
+	b.cfg.ArtifactsPath = ""
+	b.cfg.StepLogs = nil
+
+	// The log of the build would tell about the containers that are not created
+	if b.log.Level < log.DebugLevel {
+		b.log = &log.Logger{Out: ioutil.Discard, Formatter: b.log.Formatter, Level: b.log.Level}
+	}
+
+	err := b.Run(plan)
+
+	return d.steps, err
+}
+
+// dryRun records what the commands of the plan would do
+type dryRun struct {
+	steps []PlanStep
+
+	// pending are the steps whose changes are committed by a following commit,
+	// which tells if they are cached
+	pending []int
+	commits int
+}
+
+func (d *dryRun) begin(n int, command Command, s State) {
+	if d == nil {
+		return
+	}
+	d.steps = append(d.steps, PlanStep{Step: n, Command: command.String()})
+	d.commits = len(s.Commits)
+}
+
+func (d *dryRun) end(command Command, s State) {
+	if d == nil {
+		return
+	}
+
+	k := len(d.steps) - 1
+	step := d.steps[k]
+
+	switch command.(type) {
+	case *CommandCommit:
+		for _, i := range d.pending {
+			if d.steps[i].Status == "" {
+				d.steps[i].Status, d.steps[i].ImageID = step.Status, step.ImageID
+			}
+		}
+		d.pending = nil
+		d.steps = d.steps[:k]
+	case *CommandCleanup:
+		d.steps = d.steps[:k]
+	default:
+		if len(s.Commits) > d.commits && step.Status == "" {
+			d.pending = append(d.pending, k)
+		}
+	}
+}
+
+// mark sets the status of the current step; running it is more than pulling an image
+func (d *dryRun) mark(status string) {
+	if d == nil || len(d.steps) == 0 {
+		return
+	}
+	step := &d.steps[len(d.steps)-1]
+	if step.Status == "" || (step.Status == PlanPull && status == PlanRun) {
+		step.Status = status
+	}
+}
+
+func (d *dryRun) cached(imageID string) {
+	if d == nil || len(d.steps) == 0 {
+		return
+	}
+	step := &d.steps[len(d.steps)-1]
+	step.Status, step.ImageID = PlanCached, imageID
+}
+
+// readOnlyCache does not change the cache it wraps
+type readOnlyCache struct {
+	Cache
+}
+
+func (c readOnlyCache) Put(s State) error { return nil }
+func (c readOnlyCache) Del(s State) error { return nil }
+
+// dryRunClient passes the reads to the daemon and pretends to do the rest
+type dryRunClient struct {
+	Client
+
+	run    *dryRun
+	n      int
+	tagged map[string]string
+	pulled map[string]bool
+}
+
+func (c *dryRunClient) fakeID(kind string) string {
+	c.n++
+	return fmt.Sprintf("dry-run-%s-%d", kind, c.n)
+}
+
+func (c *dryRunClient) InspectImage(name string) (*docker.Image, error) {
+	if id, ok := c.tagged[imagename.NewFromString(name).String()]; ok {
+		return &docker.Image{ID: id}, nil
+	}
+	if strings.HasPrefix(name, "dry-run-") {
+		return &docker.Image{ID: name}, nil
+	}
+
+	img, err := c.Client.InspectImage(name)
+	if err != nil || img != nil {
+		return img, err
+	}
+	if c.pulled[name] {
+		return &docker.Image{ID: c.fakeID("image")}, nil
+	}
+	return nil, nil
+}
+
+func (c *dryRunClient) PullImage(ctx context.Context, name string) error {
+	c.run.mark(PlanPull)
+	c.pulled[name] = true
+	return nil
+}
+
+func (c *dryRunClient) EnsureImage(ctx context.Context, name string) error {
+	img, err := c.InspectImage(name)
+	if err != nil || img != nil {
+		return err
+	}
+	return c.PullImage(ctx, name)
+}
+
+func (c *dryRunClient) PrefetchImage(ctx context.Context, name string) error {
+	return nil
+}
+
+func (c *dryRunClient) TagImage(imageID, name string) error {
+	c.tagged[imagename.NewFromString(name).String()] = imageID
+	return nil
+}
+
+func (c *dryRunClient) CreateContainer(s State) (string, error) {
+	c.run.mark(PlanRun)
+	return c.fakeID("container"), nil
+}
+
+func (c *dryRunClient) EnsureContainer(ctx context.Context, name string, config *docker.Config, hostConfig *docker.HostConfig, purpose string) (string, error) {
+	if container, err := c.Client.InspectContainer(name); err == nil && container != nil {
+		return container.ID, nil
+	}
+	c.run.mark(PlanRun)
+	return c.fakeID("container"), nil
+}
+
+func (c *dryRunClient) CommitContainer(s *State) (*docker.Image, error) {
+	c.run.mark(PlanRun)
+	return &docker.Image{ID: c.fakeID("image")}, nil
+}
+
+func (c *dryRunClient) ImportContainer(containerID, name string, exclude []string) (*docker.Image, error) {
+	c.run.mark(PlanRun)
+	return &docker.Image{ID: c.fakeID("image")}, nil
+}
+
+func (c *dryRunClient) SquashImage(imageID string, keepLayers int) (*docker.Image, error) {
+	c.run.mark(PlanRun)
+	return &docker.Image{ID: c.fakeID("image")}, nil
+}
+
+func (c *dryRunClient) NormalizeImage(imageID string, keepLayers int, epoch time.Time) (*docker.Image, error) {
+	c.run.mark(PlanRun)
+	return &docker.Image{ID: c.fakeID("image")}, nil
+}
+
+func (c *dryRunClient) UploadToContainer(containerID string, stream io.Reader, path string) error {
+	_, err := io.Copy(ioutil.Discard, stream)
+	return err
+}
+
+func (c *dryRunClient) RunContainer(ctx context.Context, containerID string, attachStdin bool) error {
+	return nil
+}
+
+func (c *dryRunClient) RunContainerWithIO(ctx context.Context, containerID string, in io.Reader, out io.Writer) error {
+	return nil
+}
+
+func (c *dryRunClient) RemoveContainer(containerID string) error {
+	return nil
+}
+
+func (c *dryRunClient) RemoveImage(imageID string) error {
+	return nil
+}
+
+func (c *dryRunClient) ReadFileFromContainer(containerID, path string) (*spill.Buffer, error) {
+	return spill.NewBuffer(), nil
+}
+
+func (c *dryRunClient) DownloadFromContainer(containerID, path string, out io.Writer) error {
+	return nil
+}
+
+func (c *dryRunClient) SaveImages(names []string, out io.Writer) error {
+	return nil
+}
+
+func (c *dryRunClient) PushImage(ctx context.Context, name string) (string, error) {
+	return "", nil
+}
+
+func (c *dryRunClient) UnpushImage(name, digest string) error {
+	return nil
+}
+
+func (c *dryRunClient) PushArtifact(name string, artifact dockerclient.OCIArtifact) (string, error) {
+	return "", nil
+}
+
+func (c *dryRunClient) AttachArtifact(name string, artifact dockerclient.OCIArtifact) (string, error) {
+	return "", nil
+}
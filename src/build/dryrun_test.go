@@ -0,0 +1,100 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"os"
+	"testing"
+
+	"github.com/grammarly/rocker/src/imagename"
+
+	"github.com/fsouza/go-dockerclient"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestBuild_DryRun(t *testing.T) {
+	tmpDir := cacheTestTmpDir(t)
+	defer os.RemoveAll(tmpDir)
+
+	// The first build fills the cache
+	rockerfile := "FROM ubuntu\nENV A=1\nRUN make"
+	b, c := makeBuild(t, rockerfile, Config{})
+	b.cache = NewCacheFS(tmpDir)
+
+	c.On("InspectImage", "ubuntu:latest").Return(&docker.Image{ID: "123"}, nil).Once()
+	c.On("CreateContainer", mock.AnythingOfType("State")).Return("456", nil).Twice()
+	c.On("CommitContainer", mock.AnythingOfType("State")).Return(&docker.Image{ID: "789"}, nil).Once()
+	c.On("CommitContainer", mock.AnythingOfType("State")).Return(&docker.Image{ID: "abc"}, nil).Once()
+	c.On("RunContainer", "456", false).Return(nil).Once()
+	c.On("RemoveContainer", "456").Return(nil).Twice()
+
+	if err := b.Run(makePlan(t, rockerfile)); err != nil {
+		t.Fatal(err)
+	}
+	c.AssertExpectations(t)
+
+	// The plan of a longer Rockerfile takes the same steps from the cache
+	rockerfile = "FROM ubuntu\nENV A=1\nRUN make\nRUN make test\nTAG app"
+	b2, c2 := makeBuild(t, rockerfile, Config{})
+	b2.cache = NewCacheFS(tmpDir)
+
+	c2.On("InspectImage", "ubuntu:latest").Return(&docker.Image{ID: "123"}, nil).Once()
+	c2.On("InspectImage", "789").Return(&docker.Image{ID: "789"}, nil).Once()
+	c2.On("InspectImage", "abc").Return(&docker.Image{ID: "abc"}, nil).Once()
+
+	steps, err := b2.DryRun(makePlan(t, rockerfile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c2.AssertExpectations(t)
+
+	statuses := []string{}
+	for _, step := range steps {
+		statuses = append(statuses, step.Status)
+	}
+	assert.Equal(t, []string{"", PlanCached, PlanCached, PlanRun, ""}, statuses)
+	assert.Equal(t, "ENV A=1", steps[1].Command)
+	assert.Equal(t, "789", steps[1].ImageID)
+	assert.Equal(t, "RUN make test", steps[3].Command)
+
+	// Nothing new is cached
+	s, err := NewCacheFS(tmpDir).Get(State{ImageID: "abc", Commits: []string{`RUN ["/bin/sh" "-c" "make test"]`}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Nil(t, s)
+}
+
+func TestBuild_DryRunPull(t *testing.T) {
+	rockerfile := "FROM ubuntu\nRUN make"
+	b, c := makeBuild(t, rockerfile, Config{})
+
+	c.On("InspectImage", "ubuntu:latest").Return((*docker.Image)(nil), nil)
+	c.On("ListImages").Return([]*imagename.ImageName{}, nil).Once()
+	c.On("ListImageTags", "ubuntu:latest").Return([]*imagename.ImageName{imagename.NewFromString("ubuntu:latest")}, nil).Once()
+
+	steps, err := b.DryRun(makePlan(t, rockerfile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.AssertExpectations(t)
+
+	assert.Len(t, steps, 2)
+	assert.Equal(t, PlanPull, steps[0].Status)
+	assert.Equal(t, PlanRun, steps[1].Status)
+}
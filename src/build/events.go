@@ -0,0 +1,163 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"sync"
+	"time"
+
+	"github.com/grammarly/rocker/src/eol"
+	"github.com/grammarly/rocker/src/imagename"
+)
+
+// EventType tells what happened in the build
+type EventType string
+
+// Types of the build events, the same things rocker reports with --json
+const (
+	EventBuildStart  EventType = "build_start"
+	EventStepStart   EventType = "step_start"
+	EventStepCached  EventType = "step_cached"
+	EventStepDone    EventType = "step_done"
+	EventStepFailed  EventType = "step_failed"
+	EventPush        EventType = "push"
+	EventBaseEOL     EventType = "base_eol"
+	EventBuildDone   EventType = "build_done"
+	EventBuildFailed EventType = "build_failed"
+)
+
+// Event is what the subscribers of the build receive
+type Event struct {
+	Type    EventType `json:"type"`
+	Time    time.Time `json:"time"`
+	BuildID string    `json:"build_id,omitempty"`
+
+	// Step is the number of the step in the plan, Stage is the name of the
+	// FROM section it belongs to, if any
+	Step    int    `json:"step,omitempty"`
+	Stage   string `json:"stage,omitempty"`
+	Command string `json:"command,omitempty"`
+
+	// ImageID is the image the step produced or took from the cache,
+	// or the final image of the build
+	ImageID  string        `json:"image_id,omitempty"`
+	Duration time.Duration `json:"duration,omitempty"`
+
+	// Size is the size of the image after the step of EventStepDone, SizeDelta
+	// is how much the step added if it produced a new image
+	Size      int64 `json:"size,omitempty"`
+	SizeDelta int64 `json:"size_delta,omitempty"`
+
+	// Artifact is the pushed image of EventPush
+	Artifact *imagename.Artifact `json:"artifact,omitempty"`
+
+	// EOL is the warning of EventBaseEOL about the FROM image of the section
+	EOL *eol.Warning `json:"eol,omitempty"`
+
+	// Error is the message of a failed step or build
+	Error string `json:"error,omitempty"`
+}
+
+// eventBus passes the events to the subscribers, it is shared by the forks
+// of the build that run the stages in parallel
+type eventBus struct {
+	mu          sync.Mutex
+	subscribers []chan<- Event
+}
+
+// stepInfo is the step that is being executed, for the events
+type stepInfo struct {
+	n       int
+	command string
+	started time.Time
+	// imageID is the image before the step
+	imageID string
+}
+
+// Subscribe makes the build send its events to the channel, for the tools that
+// embed rocker and drive their own UI or persistence. The build waits for the
+// channel to receive every event, so it should be buffered or drained by another
+// goroutine. The channel is closed when Run returns, after EventBuildDone or
+// EventBuildFailed
+func (b *Build) Subscribe(ch chan<- Event) {
+	b.events.mu.Lock()
+	defer b.events.mu.Unlock()
+	b.events.subscribers = append(b.events.subscribers, ch)
+}
+
+func (b *Build) emit(e Event) {
+	b.events.mu.Lock()
+	defer b.events.mu.Unlock()
+
+	if len(b.events.subscribers) == 0 {
+		return
+	}
+
+	e.Time = time.Now()
+	e.BuildID = b.cfg.BuildID
+	if e.Stage == "" {
+		e.Stage = b.stage
+	}
+
+	for _, ch := range b.events.subscribers {
+		ch <- e
+	}
+}
+
+// emitStep sends an event about the step that is being executed
+func (b *Build) emitStep(t EventType, imageID string, err error) {
+	e := Event{
+		Type:    t,
+		Step:    b.step.n,
+		Command: b.step.command,
+		ImageID: imageID,
+	}
+	if t == EventStepDone || t == EventStepFailed {
+		e.Duration = time.Since(b.step.started)
+	}
+	if t == EventStepDone {
+		e.Size = b.state.Size
+		if b.state.ImageID != b.step.imageID {
+			e.SizeDelta = b.state.Size - b.state.ParentSize
+		}
+	}
+	if err != nil {
+		e.Error = err.Error()
+	}
+	b.emit(e)
+}
+
+// emitEnd sends the result of the build and closes the channels of the subscribers
+func (b *Build) emitEnd(started time.Time, err error) {
+	e := Event{
+		Type:     EventBuildDone,
+		ImageID:  b.state.ImageID,
+		Duration: time.Since(started),
+	}
+	if err != nil {
+		e.Type = EventBuildFailed
+		e.Error = err.Error()
+	}
+	b.emit(e)
+
+	b.events.mu.Lock()
+	defer b.events.mu.Unlock()
+	for _, ch := range b.events.subscribers {
+		close(ch)
+	}
+	b.events.subscribers = nil
+}
@@ -0,0 +1,83 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/fsouza/go-dockerclient"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestBuild_Subscribe(t *testing.T) {
+	rockerfile := "FROM scratch\nENV A=1"
+	b, c := makeBuild(t, rockerfile, Config{BuildID: "42"})
+
+	c.On("CreateContainer", mock.AnythingOfType("State")).Return("456", nil).Once()
+	c.On("CommitContainer", mock.AnythingOfType("State")).Return(&docker.Image{ID: "123"}, nil).Once()
+	c.On("RemoveContainer", "456").Return(nil).Once()
+
+	events := make(chan Event, 100)
+	b.Subscribe(events)
+
+	if err := b.Run(makePlan(t, rockerfile)); err != nil {
+		t.Fatal(err)
+	}
+
+	types := []EventType{}
+	var last Event
+	for e := range events {
+		types = append(types, e.Type)
+		assert.Equal(t, "42", e.BuildID)
+		last = e
+	}
+
+	assert.Equal(t, []EventType{
+		EventBuildStart,
+		EventStepStart, EventStepDone, // FROM
+		EventStepStart, EventStepDone, // ENV
+		EventStepStart, EventStepDone, // commit
+		EventStepStart, EventStepDone, // cleanup
+		EventBuildDone,
+	}, types)
+	assert.Equal(t, "123", last.ImageID)
+}
+
+func TestBuild_SubscribeFailed(t *testing.T) {
+	rockerfile := "FROM scratch\nENV A=1"
+	b, c := makeBuild(t, rockerfile, Config{})
+
+	c.On("CreateContainer", mock.AnythingOfType("State")).Return("", fmt.Errorf("no space left on device")).Once()
+
+	events := make(chan Event, 100)
+	b.Subscribe(events)
+
+	assert.Error(t, b.Run(makePlan(t, rockerfile)))
+
+	all := []Event{}
+	for e := range events {
+		all = append(all, e)
+	}
+
+	failed := all[len(all)-2]
+	assert.Equal(t, EventStepFailed, failed.Type)
+	assert.Equal(t, 3, failed.Step)
+	assert.Equal(t, "no space left on device", failed.Error)
+	assert.Equal(t, EventBuildFailed, all[len(all)-1].Type)
+}
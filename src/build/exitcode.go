@@ -0,0 +1,96 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"net"
+	"net/url"
+	"os/exec"
+	"syscall"
+
+	"github.com/fsouza/go-dockerclient"
+)
+
+// Exit codes of rocker, so CI pipelines can tell why a build failed
+const (
+	// ExitFailure is any failure that is not classified below
+	ExitFailure = 1
+
+	// ExitUser is an invalid Rockerfile, command line or build context
+	ExitUser = 2
+
+	// ExitStep is a command of a step that failed, e.g. RUN exited with a non-zero code
+	ExitStep = 3
+
+	// ExitInfra is a failure of the docker daemon, a registry or the network
+	ExitInfra = 4
+
+	// ExitPolicy is a check that rocker enforces, such as a checksum mismatch
+	// or build args that were not consumed
+	ExitPolicy = 5
+
+	// ExitTimeout is a build that took longer than --timeout, as timeout(1) does
+	ExitTimeout = 124
+
+	// ExitCancelled is a build interrupted with SIGINT, as the shells report it
+	ExitCancelled = 130
+)
+
+// ExitError is an error that tells with which code rocker should exit
+type ExitError struct {
+	Code int
+	Err  error
+}
+
+// Error returns the message of the original error
+func (e *ExitError) Error() string {
+	return e.Err.Error()
+}
+
+// WithExitCode marks the error with the exit code; nil stays nil and an error
+// that is marked already keeps its code
+func WithExitCode(code int, err error) error {
+	if err == nil {
+		return nil
+	}
+	if _, ok := err.(*ExitError); ok {
+		return err
+	}
+	return &ExitError{Code: code, Err: err}
+}
+
+// ExitCode returns the exit code for the error: the marked code, ExitInfra
+// for the errors of the docker API and the network, the code of a rocker that
+// was run as a child process, or ExitFailure
+func ExitCode(err error) int {
+	switch e := err.(type) {
+	case nil:
+		return 0
+	case *ExitError:
+		return e.Code
+	case *docker.Error, *url.Error, net.Error:
+		return ExitInfra
+	case *exec.ExitError:
+		if status, ok := e.Sys().(syscall.WaitStatus); ok && status.Exited() && status.ExitStatus() > 0 {
+			return status.ExitStatus()
+		}
+	}
+	if err == docker.ErrConnectionRefused {
+		return ExitInfra
+	}
+	return ExitFailure
+}
@@ -0,0 +1,64 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"fmt"
+	"net/url"
+	"os/exec"
+	"testing"
+	"time"
+
+	"github.com/fsouza/go-dockerclient"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExitCode(t *testing.T) {
+	assert.Equal(t, 0, ExitCode(nil))
+	assert.Equal(t, ExitFailure, ExitCode(fmt.Errorf("something")))
+	assert.Equal(t, ExitStep, ExitCode(WithExitCode(ExitStep, fmt.Errorf("Container exited with code 1"))))
+	assert.Equal(t, ExitInfra, ExitCode(&docker.Error{Status: 500, Message: "server error"}))
+	assert.Equal(t, ExitInfra, ExitCode(docker.ErrConnectionRefused))
+	assert.Equal(t, ExitInfra, ExitCode(&url.Error{Op: "Get", URL: "https://quay.io", Err: fmt.Errorf("EOF")}))
+	assert.Equal(t, ExitStep, ExitCode(exec.Command("sh", "-c", "exit 3").Run()))
+}
+
+func TestWithExitCode(t *testing.T) {
+	assert.Nil(t, WithExitCode(ExitUser, nil))
+
+	err := WithExitCode(ExitPolicy, fmt.Errorf("Checksum mismatch"))
+	assert.Equal(t, "Checksum mismatch", err.Error())
+
+	// the first code is kept
+	assert.Equal(t, ExitPolicy, ExitCode(WithExitCode(ExitFailure, err)))
+}
+
+func TestBuild_ExitCodeUnusedBuildArgs(t *testing.T) {
+	rockerfile := "FROM scratch"
+	b, _ := makeBuild(t, rockerfile, Config{BuildArgs: map[string]string{"VERSION": "1.0"}})
+
+	err := b.Run(makePlan(t, rockerfile))
+	assert.Equal(t, ExitPolicy, ExitCode(err))
+}
+
+func TestBuild_ExitCodeTimeout(t *testing.T) {
+	rockerfile := "FROM scratch"
+	b, _ := makeBuild(t, rockerfile, Config{Deadline: time.Now().Add(-time.Second)})
+
+	err := b.Run(makePlan(t, rockerfile))
+	assert.Equal(t, ExitTimeout, ExitCode(err))
+}
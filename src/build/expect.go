@@ -0,0 +1,244 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// defaultExpectTimeout is how long `expect` waits for the output unless the script says otherwise
+const defaultExpectTimeout = 30 * time.Second
+
+// expectStep is a single line of the ATTACH script
+type expectStep struct {
+	line    int
+	action  string
+	text    string
+	re      *regexp.Regexp
+	timeout time.Duration
+}
+
+// expectScript drives an ATTACH container instead of a human, one step per line:
+//
+//	# comment
+//	timeout 60              seconds to wait for each of the following expects
+//	expect Accept? \[y/n\]  wait until the output matches the regular expression, fail otherwise
+//	send y                  type the text followed by a newline
+//	send "\x1b:wq\r"        a quoted text is sent as is, Go escapes are allowed
+type expectScript []expectStep
+
+// parseExpectScript reads the ATTACH script
+func parseExpectScript(r io.Reader) (script expectScript, err error) {
+	scanner := bufio.NewScanner(r)
+	timeout := defaultExpectTimeout
+
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		parts := strings.SplitN(line, " ", 2)
+		step := expectStep{line: n, action: parts[0]}
+		if len(parts) == 2 {
+			step.text = strings.TrimSpace(parts[1])
+		}
+
+		switch step.action {
+		case "timeout":
+			seconds, err := strconv.Atoi(step.text)
+			if err != nil || seconds < 1 {
+				return nil, fmt.Errorf("Line %d: timeout should be a positive number of seconds, got %q", n, step.text)
+			}
+			timeout = time.Duration(seconds) * time.Second
+			continue
+		case "expect":
+			if step.text == "" {
+				return nil, fmt.Errorf("Line %d: expect needs a pattern", n)
+			}
+			if step.re, err = regexp.Compile(step.text); err != nil {
+				return nil, fmt.Errorf("Line %d: bad pattern %q, %s", n, step.text, err)
+			}
+			step.timeout = timeout
+		case "send":
+			if strings.HasPrefix(step.text, `"`) {
+				if step.text, err = strconv.Unquote(step.text); err != nil {
+					return nil, fmt.Errorf("Line %d: bad quoted text, %s", n, err)
+				}
+			} else {
+				step.text += "\n"
+			}
+		default:
+			return nil, fmt.Errorf("Line %d: unknown action %q, expected expect, send or timeout", n, step.action)
+		}
+
+		script = append(script, step)
+	}
+
+	return script, scanner.Err()
+}
+
+// run plays the script against the output of the container and writes the
+// input to it; after the last step the rest of the output is read till the end
+func (script expectScript) run(out io.Reader, in io.Writer) error {
+	var (
+		chunks = make(chan []byte)
+		buf    []byte
+	)
+
+	// Keep reading if the script fails, so the container output is not blocked
+	defer func() {
+		go func() {
+			for range chunks {
+			}
+		}()
+	}()
+
+	go func() {
+		defer close(chunks)
+		for {
+			p := make([]byte, 4096)
+			n, err := out.Read(p)
+			if n > 0 {
+				chunks <- p[:n]
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	for _, step := range script {
+		if step.action == "send" {
+			if _, err := io.WriteString(in, step.text); err != nil {
+				return fmt.Errorf("Line %d: failed to send the input, %s", step.line, err)
+			}
+			continue
+		}
+
+		timeout := time.After(step.timeout)
+
+		for {
+			if loc := step.re.FindIndex(buf); loc != nil {
+				// Following expects look at the output after the match
+				buf = buf[loc[1]:]
+				break
+			}
+
+			select {
+			case chunk, ok := <-chunks:
+				if !ok {
+					return fmt.Errorf("Line %d: the container finished before the output matched %q", step.line, step.text)
+				}
+				buf = append(buf, chunk...)
+			case <-timeout:
+				return fmt.Errorf("Line %d: the output did not match %q in %s", step.line, step.text, step.timeout)
+			}
+		}
+	}
+
+	for range chunks {
+	}
+
+	return nil
+}
+
+// runAttachScript runs the ATTACH command driven by the script instead of a terminal;
+// unlike the interactive ATTACH the result is cached and committed the same way as RUN
+func (b *Build) runAttachScript(ctx context.Context, s State, cmd []string, scriptFile string) (State, error) {
+	content, err := ioutil.ReadFile(filepath.Join(b.cfg.ContextDir, scriptFile))
+	if err != nil {
+		return s, fmt.Errorf("Failed to read ATTACH script, error: %s", err)
+	}
+
+	script, err := parseExpectScript(strings.NewReader(string(content)))
+	if err != nil {
+		return s, fmt.Errorf("ATTACH script %s: %s", scriptFile, err)
+	}
+
+	s.Commit("ATTACH --script=%x %q", sha256.Sum256(content), cmd)
+
+	s, hit, err := b.probeCache(ctx, s)
+	if err != nil {
+		return s, err
+	}
+	if hit {
+		return s, nil
+	}
+
+	origConfig := s.Config
+
+	s.Config.Cmd = cmd
+	s.Config.Entrypoint = []string{}
+	s.Config.Tty = true
+	s.Config.OpenStdin = true
+	s.Config.StdinOnce = true
+	s.Config.AttachStdin = true
+	s.Config.AttachStderr = true
+	s.Config.AttachStdout = true
+
+	if s.NoCache.ContainerID, err = b.client.CreateContainer(s); err != nil {
+		return s, err
+	}
+
+	// Restore the config for the commit
+	s.Config = origConfig
+
+	var (
+		inReader, inWriter   = io.Pipe()
+		outReader, outWriter = io.Pipe()
+		scripterr            = make(chan error, 1)
+		output               = io.Writer(ioutil.Discard)
+	)
+
+	if b.cfg.OutStream != nil {
+		output = b.cfg.OutStream
+	}
+
+	go func() {
+		err := script.run(io.TeeReader(outReader, output), inWriter)
+		if err != nil {
+			// Nobody is going to answer, so the container has to go
+			b.client.RemoveContainer(s.NoCache.ContainerID)
+		}
+		inWriter.Close()
+		scripterr <- err
+	}()
+
+	err = b.client.RunContainerWithIO(ctx, s.NoCache.ContainerID, inReader, outWriter)
+	outWriter.Close()
+
+	if serr := <-scripterr; serr != nil {
+		return s, fmt.Errorf("ATTACH script %s failed at %s", scriptFile, serr)
+	}
+	if err != nil {
+		b.client.RemoveContainer(s.NoCache.ContainerID)
+		return s, err
+	}
+
+	return s, nil
+}
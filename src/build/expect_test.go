@@ -0,0 +1,121 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestParseExpectScript(t *testing.T) {
+	script, err := parseExpectScript(strings.NewReader(`# install
+timeout 5
+expect Accept\? \[y/n\]
+send y
+send "\x1b:wq\r"
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Len(t, script, 3)
+	assert.Equal(t, 5*time.Second, script[0].timeout)
+	assert.Equal(t, "y\n", script[1].text)
+	assert.Equal(t, "\x1b:wq\r", script[2].text)
+
+	for _, bad := range []string{"expect", "expect [", "timeout x", "type y", `send "unterminated`} {
+		_, err := parseExpectScript(strings.NewReader(bad))
+		assert.Error(t, err, bad)
+	}
+}
+
+func TestExpectScript_Run(t *testing.T) {
+	script, err := parseExpectScript(strings.NewReader("expect name:\nsend rocker\nexpect Hello, (\\w+)\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	outReader, outWriter := io.Pipe()
+	inReader, inWriter := io.Pipe()
+
+	// The "program" asks for the name and greets
+	go func() {
+		io.WriteString(outWriter, "Your name: ")
+		name, _ := bufio.NewReader(inReader).ReadString('\n')
+		io.WriteString(outWriter, "Hello, "+name)
+		outWriter.Close()
+	}()
+
+	assert.NoError(t, script.run(outReader, inWriter))
+}
+
+func TestExpectScript_RunFails(t *testing.T) {
+	script, err := parseExpectScript(strings.NewReader("expect password:"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = script.run(strings.NewReader("login:"), nil)
+	assert.EqualError(t, err, `Line 1: the container finished before the output matched "password:"`)
+}
+
+func TestCommandAttach_Script(t *testing.T) {
+	dir := makeTmpDir(t, map[string]string{
+		"install.expect": "expect continue\\?\nsend y\n",
+	})
+	defer os.RemoveAll(dir)
+
+	b, c := makeBuild(t, "", Config{ContextDir: dir})
+	cmd := NewCommand(ConfigCommand{
+		name:  "attach",
+		args:  []string{"/opt/install.sh"},
+		flags: map[string]string{"script": "install.expect"},
+	})
+
+	b.state.ImageID = "123"
+
+	c.On("CreateContainer", mock.AnythingOfType("State")).Return("456", nil).Run(func(args mock.Arguments) {
+		arg := args.Get(0).(State)
+		assert.Equal(t, []string{"/bin/sh", "-c", "/opt/install.sh"}, arg.Config.Cmd)
+		assert.True(t, arg.Config.Tty)
+	}).Once()
+
+	c.On("RunContainerWithIO", "456", mock.Anything, mock.Anything).Return(nil).Run(func(args mock.Arguments) {
+		in, out := args.Get(1).(io.Reader), args.Get(2).(io.Writer)
+		io.WriteString(out, "Install, continue? ")
+		answer, _ := bufio.NewReader(in).ReadString('\n')
+		assert.Equal(t, "y\n", answer)
+	}).Once()
+
+	state, err := cmd.Execute(context.Background(), b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.AssertExpectations(t)
+	assert.Equal(t, "456", state.NoCache.ContainerID)
+	assert.False(t, state.Config.Tty)
+	assert.Contains(t, state.GetCommits(), "ATTACH --script=")
+}
@@ -0,0 +1,186 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/docker/docker/pkg/archive"
+)
+
+// Kinds of local archives that ADD extracts
+const (
+	archiveNone = ""
+	archiveTar  = "tar"
+	archiveZip  = "zip"
+)
+
+var zipMagic = []byte("PK\x03\x04")
+
+// archiveKind tells if the file is an archive ADD should extract: a tar,
+// plain or compressed with gzip, bzip2 or xz, or a zip
+func archiveKind(file string) string {
+	f, err := os.Open(file)
+	if err != nil {
+		return archiveNone
+	}
+	defer f.Close()
+
+	magic := make([]byte, len(zipMagic))
+	if _, err := io.ReadFull(f, magic); err == nil && bytes.Equal(magic, zipMagic) {
+		return archiveZip
+	}
+
+	if archive.IsArchivePath(file) {
+		return archiveTar
+	}
+
+	return archiveNone
+}
+
+// addArchive writes the entries of the archive to the tar under the prefix
+func (ta *tarAppender) addArchive(file, prefix string) error {
+	switch archiveKind(file) {
+	case archiveTar:
+		return ta.addTarArchive(file, prefix)
+	case archiveZip:
+		return ta.addZipArchive(file, prefix)
+	}
+	return fmt.Errorf("%s is not an archive", file)
+}
+
+func (ta *tarAppender) addTarArchive(file, prefix string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r, err := archive.DecompressStream(f)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("Failed to extract %s, error: %s", file, err)
+		}
+
+		if hdr.Name = extractedName(prefix, hdr.Name); hdr.Name == "" {
+			continue
+		}
+		if hdr.Typeflag == tar.TypeLink {
+			hdr.Linkname = extractedName(prefix, hdr.Linkname)
+		}
+
+		if ta.Epoch != nil {
+			normalizeHeader(hdr, *ta.Epoch)
+		}
+
+		if err := ta.TarWriter.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if _, err := io.Copy(ta.TarWriter, tr); err != nil {
+			return err
+		}
+	}
+}
+
+func (ta *tarAppender) addZipArchive(file, prefix string) error {
+	zr, err := zip.OpenReader(file)
+	if err != nil {
+		return fmt.Errorf("Failed to extract %s, error: %s", file, err)
+	}
+	defer zr.Close()
+
+	for _, zf := range zr.File {
+		if err := ta.addZipFile(zf, prefix); err != nil {
+			return fmt.Errorf("Failed to extract %s, error: %s", file, err)
+		}
+	}
+
+	return nil
+}
+
+func (ta *tarAppender) addZipFile(zf *zip.File, prefix string) error {
+	fi := zf.FileInfo()
+
+	r, err := zf.Open()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	// zip keeps the target of a symlink as its content
+	link := ""
+	if fi.Mode()&os.ModeSymlink != 0 {
+		data, err := ioutil.ReadAll(r)
+		if err != nil {
+			return err
+		}
+		link = string(data)
+	}
+
+	hdr, err := tar.FileInfoHeader(fi, link)
+	if err != nil {
+		return err
+	}
+	if hdr.Name = extractedName(prefix, zf.Name); hdr.Name == "" {
+		return nil
+	}
+	if ta.Epoch != nil {
+		normalizeHeader(hdr, *ta.Epoch)
+	}
+
+	if err := ta.TarWriter.WriteHeader(hdr); err != nil {
+		return err
+	}
+	if hdr.Typeflag == tar.TypeReg {
+		_, err = io.Copy(ta.TarWriter, r)
+	}
+	return err
+}
+
+// extractedName puts the name of an archive entry under the prefix; entries
+// cannot point above the archive root, the same as with `tar -x`. The root
+// itself gets an empty name, it is skipped not to change the destination
+func extractedName(prefix, name string) string {
+	clean := path.Clean("/" + name)
+	if clean == "/" {
+		return ""
+	}
+
+	result := strings.TrimPrefix(path.Join("/"+prefix, clean), "/")
+	if strings.HasSuffix(name, "/") {
+		result += "/"
+	}
+	return result
+}
@@ -0,0 +1,179 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExtract_ArchiveKind(t *testing.T) {
+	tmpDir := makeTmpDir(t, map[string]string{
+		"plain.txt": "hello",
+	})
+	defer os.RemoveAll(tmpDir)
+
+	writeTestTgz(t, filepath.Join(tmpDir, "app.tgz"))
+	writeTestZip(t, filepath.Join(tmpDir, "app.zip"))
+
+	assert.Equal(t, archiveTar, archiveKind(filepath.Join(tmpDir, "app.tgz")))
+	assert.Equal(t, archiveZip, archiveKind(filepath.Join(tmpDir, "app.zip")))
+	assert.Equal(t, archiveNone, archiveKind(filepath.Join(tmpDir, "plain.txt")))
+	assert.Equal(t, archiveNone, archiveKind(filepath.Join(tmpDir, "missing")))
+}
+
+func TestExtract_MakeTarStream_Tgz(t *testing.T) {
+	tmpDir := makeTmpDir(t, map[string]string{})
+	defer os.RemoveAll(tmpDir)
+
+	writeTestTgz(t, filepath.Join(tmpDir, "app.tgz"))
+
+	u, err := makeTarStream(tmpDir, "/opt/app", "ADD", []string{"app.tgz"}, []string{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, map[string]string{
+		"opt/app/bin/":    "",
+		"opt/app/bin/run": "#!/bin/sh",
+		"opt/app/README":  "readme",
+	}, readTestTar(t, u.tar))
+}
+
+func TestExtract_MakeTarStream_Zip(t *testing.T) {
+	tmpDir := makeTmpDir(t, map[string]string{})
+	defer os.RemoveAll(tmpDir)
+
+	writeTestZip(t, filepath.Join(tmpDir, "app.zip"))
+
+	u, err := makeTarStream(tmpDir, "/opt/", "ADD", []string{"*.zip"}, []string{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, map[string]string{
+		"opt/lib/":        "",
+		"opt/lib/app.jar": "jar",
+	}, readTestTar(t, u.tar))
+}
+
+func TestExtract_ListFiles_CopyDoesNotExtract(t *testing.T) {
+	tmpDir := makeTmpDir(t, map[string]string{})
+	defer os.RemoveAll(tmpDir)
+
+	writeTestTgz(t, filepath.Join(tmpDir, "app.tgz"))
+
+	files, err := listFiles(tmpDir, []string{"app.tgz"}, []string{}, "COPY", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.False(t, files[0].extract)
+
+	files, err = listFiles(tmpDir, []string{"app.tgz"}, []string{}, "ADD", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, files[0].extract)
+}
+
+func TestExtract_ExtractedName(t *testing.T) {
+	assert.Equal(t, "opt/app/bin/run", extractedName("opt/app/", "./bin/run"))
+	assert.Equal(t, "opt/app/bin/", extractedName("opt/app/", "bin/"))
+	assert.Equal(t, "opt/app/etc/passwd", extractedName("opt/app/", "../../etc/passwd"))
+	assert.Equal(t, "bin/run", extractedName("", "/bin/run"))
+	assert.Equal(t, "", extractedName("opt/app/", "./"))
+}
+
+// helper functions
+
+func writeTestTgz(t *testing.T, file string) {
+	f, err := os.Create(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	gz := gzip.NewWriter(f)
+	tw := tar.NewWriter(gz)
+
+	for _, e := range []struct{ name, content string }{
+		{"./", ""},
+		{"./bin/", ""},
+		{"./bin/run", "#!/bin/sh"},
+		{"./README", "readme"},
+	} {
+		hdr := &tar.Header{Name: e.name, Mode: 0755, Typeflag: tar.TypeReg, Size: int64(len(e.content))}
+		if e.name[len(e.name)-1] == '/' {
+			hdr.Typeflag = tar.TypeDir
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		tw.Write([]byte(e.content))
+	}
+
+	tw.Close()
+	gz.Close()
+}
+
+func writeTestZip(t *testing.T, file string) {
+	f, err := os.Create(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	zw := zip.NewWriter(f)
+	if _, err := zw.Create("lib/"); err != nil {
+		t.Fatal(err)
+	}
+	w, err := zw.Create("lib/app.jar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte("jar"))
+	zw.Close()
+}
+
+func readTestTar(t *testing.T, r io.ReadCloser) map[string]string {
+	defer r.Close()
+
+	files := map[string]string{}
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return files
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := ioutil.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[hdr.Name] = string(data)
+	}
+}
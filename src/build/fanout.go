@@ -0,0 +1,153 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/grammarly/rocker/src/dockerclient"
+	"github.com/grammarly/rocker/src/imagename"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// ManifestList is an image name and the images pushed for it per platform
+type ManifestList struct {
+	Name    string
+	Entries []dockerclient.ManifestListEntry
+}
+
+// PlatformImageName returns the name the build for the platform pushes the image
+// under: the platform is appended to the tag, e.g. app:1.0-linux-arm64
+func PlatformImageName(name string, platform dockerclient.Platform) string {
+	image := imagename.NewFromString(name)
+	image.SetTag(image.GetTag() + "-" + platform.Tag())
+	return image.String()
+}
+
+// ForPlatform makes the build one of the builds of --daemon: the images are pushed
+// with the platform appended to the tag, and the log lines of the build and of its
+// containers are prefixed with the platform, as the builds run at the same time
+func (b *Build) ForPlatform(platform dockerclient.Platform) {
+	b.cfg.Platform = platform
+	b.log = prefixedLogger(b.log, platform.String())
+	if c, ok := b.client.(interface {
+		withLog(*log.Logger) Client
+	}); ok {
+		b.client = c.withLog(b.log)
+	}
+}
+
+// Platform returns the platform the build is for, empty unless it is one of the builds of --daemon
+func (b *Build) Platform() dockerclient.Platform {
+	return b.cfg.Platform
+}
+
+// RunPlatforms runs the builds of --daemon at the same time, every one with its
+// own plan, and returns the first error in the order of the builds
+func RunPlatforms(builds []*Build, plans []Plan) error {
+	var (
+		wg   sync.WaitGroup
+		errs = make([]error, len(builds))
+	)
+
+	for i := range builds {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = builds[i].Run(plans[i])
+		}(i)
+	}
+	wg.Wait()
+
+	for i, err := range errs {
+		if err != nil {
+			return WithExitCode(ExitCode(err), fmt.Errorf("Build for %s failed, error: %s", builds[i].cfg.Platform, err))
+		}
+	}
+	return nil
+}
+
+// ManifestLists groups the images that the builds of --daemon pushed by the names
+// they were pushed as, in the order of the first build. A name that some of the
+// builds did not push is an error, since the list would miss a platform
+func ManifestLists(builds []*Build) ([]ManifestList, error) {
+	var (
+		lists  = []ManifestList{}
+		byName = map[string]int{}
+	)
+
+	for _, b := range builds {
+		for _, artifact := range b.Pushed {
+			name := platformListName(artifact.Name, b.cfg.Platform)
+
+			i, ok := byName[name]
+			if !ok {
+				i = len(lists)
+				byName[name] = i
+				lists = append(lists, ManifestList{Name: name})
+			}
+
+			lists[i].Entries = append(lists[i].Entries, dockerclient.ManifestListEntry{
+				Digest:   artifact.Digest,
+				Platform: b.cfg.Platform,
+			})
+		}
+	}
+
+	for _, list := range lists {
+		if len(list.Entries) != len(builds) {
+			return nil, fmt.Errorf("Image %s was pushed for %d of %d platforms, the builds should push the same images", list.Name, len(list.Entries), len(builds))
+		}
+	}
+
+	return lists, nil
+}
+
+// platformListName is the name the image was pushed as before the platform was appended
+func platformListName(image *imagename.ImageName, platform dockerclient.Platform) string {
+	name := *image
+	name.SetTag(strings.TrimSuffix(name.GetTag(), "-"+platform.Tag()))
+	return name.String()
+}
+
+// PushManifestLists pushes the manifest lists with the client of the build and
+// returns them as the pushed artifacts, so the deploys refer to the lists
+func (b *Build) PushManifestLists(lists []ManifestList) (pushed []imagename.Artifact, err error) {
+	for _, list := range lists {
+		digest, err := b.client.PushManifestList(list.Name, list.Entries, b.cfg.Annotations)
+		if err != nil {
+			return pushed, fmt.Errorf("Failed to push manifest list %s, error: %s", list.Name, err)
+		}
+		b.log.Infof("| Pushed manifest list %s %s", list.Name, digest)
+
+		image := imagename.NewFromString(list.Name)
+		artifact := imagename.Artifact{
+			Name:      image,
+			Pushed:    true,
+			Tag:       image.GetTag(),
+			BuildTime: time.Now(),
+			BuildID:   b.cfg.BuildID,
+		}
+		artifact.SetDigest(digest)
+		pushed = append(pushed, artifact)
+	}
+	return pushed, nil
+}
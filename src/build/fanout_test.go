@@ -0,0 +1,103 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"context"
+	"testing"
+
+	"github.com/grammarly/rocker/src/dockerclient"
+	"github.com/grammarly/rocker/src/imagename"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var (
+	linuxAmd64 = dockerclient.Platform{OS: "linux", Architecture: "amd64"}
+	linuxArm64 = dockerclient.Platform{OS: "linux", Architecture: "arm64"}
+)
+
+func TestPlatformImageName(t *testing.T) {
+	assert.Equal(t, "quay.io/acme/app:1.0-linux-arm64", PlatformImageName("quay.io/acme/app:1.0", linuxArm64))
+	assert.Equal(t, "acme/app:latest-linux-amd64", PlatformImageName("acme/app", linuxAmd64))
+}
+
+func TestCommandPush_Platform(t *testing.T) {
+	b, c := makeBuild(t, "", Config{Push: true})
+	cmd := NewCommand(ConfigCommand{
+		name: "push",
+		args: []string{"quay.io/acme/app:1.0"},
+	})
+
+	b.ForPlatform(linuxArm64)
+	b.state.ImageID = "123"
+
+	c.On("TagImage", "123", "quay.io/acme/app:1.0").Return(nil).Once()
+	c.On("TagImage", "123", "quay.io/acme/app:1.0-linux-arm64").Return(nil).Once()
+	c.On("PushImage", "quay.io/acme/app:1.0-linux-arm64").Return("sha256:fafa", nil).Once()
+
+	if _, err := cmd.Execute(context.Background(), b); err != nil {
+		t.Fatal(err)
+	}
+
+	c.AssertExpectations(t)
+	assert.Len(t, b.Pushed, 1)
+	assert.Equal(t, "linux/arm64", b.Pushed[0].Platform)
+	assert.Equal(t, "quay.io/acme/app@sha256:fafa", b.Pushed[0].Addressable)
+}
+
+func TestManifestLists(t *testing.T) {
+	amd64, _ := makeBuild(t, "", Config{})
+	amd64.ForPlatform(linuxAmd64)
+	arm64, c := makeBuild(t, "", Config{})
+	arm64.ForPlatform(linuxArm64)
+
+	pushed := func(name, digest string) imagename.Artifact {
+		a := imagename.Artifact{Name: imagename.NewFromString(name)}
+		a.SetDigest(digest)
+		return a
+	}
+
+	amd64.Pushed = []imagename.Artifact{pushed("quay.io/acme/app:1.0-linux-amd64", "sha256:aaa")}
+	arm64.Pushed = []imagename.Artifact{pushed("quay.io/acme/app:1.0-linux-arm64", "sha256:bbb")}
+
+	lists, err := ManifestLists([]*Build{amd64, arm64})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	entries := []dockerclient.ManifestListEntry{
+		{Digest: "sha256:aaa", Platform: linuxAmd64},
+		{Digest: "sha256:bbb", Platform: linuxArm64},
+	}
+	assert.Equal(t, []ManifestList{{Name: "quay.io/acme/app:1.0", Entries: entries}}, lists)
+
+	c.On("PushManifestList", "quay.io/acme/app:1.0", entries, map[string]string(nil)).Return("sha256:ccc", nil).Once()
+
+	artifacts, err := arm64.PushManifestLists(lists)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.AssertExpectations(t)
+	assert.Equal(t, "quay.io/acme/app@sha256:ccc", artifacts[0].Addressable)
+
+	// an image that is pushed for one of the platforms only
+	arm64.Pushed = append(arm64.Pushed, pushed("quay.io/acme/tools:1.0-linux-arm64", "sha256:ddd"))
+
+	_, err = ManifestLists([]*Build{amd64, arm64})
+	assert.EqualError(t, err, "Image quay.io/acme/tools:1.0 was pushed for 1 of 2 platforms, the builds should push the same images")
+}
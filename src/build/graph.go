@@ -0,0 +1,220 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"fmt"
+	"io"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// Kinds of the nodes of the build graph
+const (
+	GraphStage    = "stage"
+	GraphImage    = "image"
+	GraphArtifact = "artifact"
+	GraphTag      = "tag"
+)
+
+// Graph is the dependency graph of a Rockerfile as `rocker graph` prints it:
+// the FROM sections, the images they are based on or copy from, the artifacts
+// passed between them with EXPORT and IMPORT, and the images they TAG and PUSH
+type Graph struct {
+	Nodes []GraphNode `json:"nodes"`
+	Edges []GraphEdge `json:"edges"`
+}
+
+// GraphNode is a stage, an image, an artifact or a tag
+type GraphNode struct {
+	ID    string `json:"id"`
+	Kind  string `json:"kind"`
+	Label string `json:"label"`
+}
+
+// GraphEdge tells how a node is used by another one: the instruction of the
+// Rockerfile that makes the dependency, such as FROM, COPY, EXPORT, IMPORT, TAG or PUSH
+type GraphEdge struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+	Via  string `json:"via"`
+}
+
+// graphBuilder keeps the ids of the nodes that were added already
+type graphBuilder struct {
+	graph *Graph
+	ids   map[string]string
+}
+
+// NewGraph makes the dependency graph of the commands of a Rockerfile
+func NewGraph(commands []ConfigCommand) *Graph {
+	g := &graphBuilder{
+		graph: &Graph{Nodes: []GraphNode{}, Edges: []GraphEdge{}},
+		ids:   map[string]string{},
+	}
+
+	var (
+		stage     string
+		n         int
+		named     = map[string]string{}
+		artifacts = []graphArtifact{}
+	)
+
+	for _, cfg := range commands {
+		if cfg.name == "from" {
+			n++
+			image, name, err := fromArgs(cfg.args)
+			label := name
+			if label == "" {
+				label = fmt.Sprintf("stage %d", n)
+			}
+			stage = g.node(GraphStage, fmt.Sprintf("%d", n), label)
+
+			if prev, ok := named[strings.ToLower(image)]; ok {
+				g.edge(prev, stage, "FROM")
+			} else if err == nil && image != NoBaseImageSpecifier {
+				g.edge(g.node(GraphImage, image, image), stage, "FROM")
+			}
+			if name != "" {
+				named[name] = stage
+			}
+			continue
+		}
+		if stage == "" {
+			continue
+		}
+
+		switch cfg.name {
+		case "copy":
+			from := cfg.flags["from"]
+			if prev, ok := named[strings.ToLower(from)]; ok {
+				g.edge(prev, stage, "COPY")
+			} else if from != "" {
+				g.edge(g.node(GraphImage, from, from), stage, "COPY")
+			}
+		case "tag", "push":
+			if len(cfg.args) == 1 {
+				g.edge(stage, g.node(GraphTag, cfg.args[0], cfg.args[0]), strings.ToUpper(cfg.name))
+			}
+		case "export":
+			if len(cfg.args) == 0 {
+				continue
+			}
+			id := g.node(GraphArtifact, fmt.Sprintf("%d", len(artifacts)+1), strings.Join(cfg.args, " "))
+			g.edge(stage, id, "EXPORT")
+			artifacts = append(artifacts, graphArtifact{id: id, paths: exportedPaths(cfg.args)})
+		case "import":
+			if len(cfg.args) == 0 || len(artifacts) == 0 {
+				continue
+			}
+			for _, id := range importedArtifacts(artifacts, cfg.args[0]) {
+				g.edge(id, stage, "IMPORT")
+			}
+		}
+	}
+
+	return g.graph
+}
+
+// node adds the node once and returns its id
+func (g *graphBuilder) node(kind, key, label string) string {
+	if id, ok := g.ids[kind+":"+key]; ok {
+		return id
+	}
+	id := fmt.Sprintf("%s%d", kind, len(g.graph.Nodes)+1)
+	g.ids[kind+":"+key] = id
+	g.graph.Nodes = append(g.graph.Nodes, GraphNode{ID: id, Kind: kind, Label: label})
+	return id
+}
+
+// edge adds the edge once
+func (g *graphBuilder) edge(from, to, via string) {
+	e := GraphEdge{From: from, To: to, Via: via}
+	for _, existing := range g.graph.Edges {
+		if existing == e {
+			return
+		}
+	}
+	g.graph.Edges = append(g.graph.Edges, e)
+}
+
+// graphArtifact is an EXPORT and the paths it puts to the exports volume
+type graphArtifact struct {
+	id    string
+	paths []string
+}
+
+// exportedPaths tells where EXPORT puts the files in the exports volume,
+// the same way the command does: EXPORT /my/dir puts /dir, EXPORT /my/dir
+// stuff/ puts /stuff/dir and EXPORT /my/dir stuff puts /stuff
+func exportedPaths(args []string) []string {
+	if len(args) < 2 {
+		args = []string{args[0], "/"}
+	}
+	src, dest := args[:len(args)-1], args[len(args)-1]
+
+	if len(src) == 1 && !strings.HasSuffix(dest, "/") {
+		return []string{path.Join("/", dest)}
+	}
+	paths := []string{}
+	for _, s := range src {
+		paths = append(paths, path.Join("/", dest, path.Base(s)))
+	}
+	return paths
+}
+
+// importedArtifacts returns the artifacts the IMPORT source is in, or the latest
+// one if it cannot be told, e.g. for a wildcard
+func importedArtifacts(artifacts []graphArtifact, src string) []string {
+	src = path.Join("/", src)
+	ids := []string{}
+	for _, a := range artifacts {
+		for _, p := range a.paths {
+			if src == p || strings.HasPrefix(src, p+"/") || strings.HasPrefix(p, strings.TrimSuffix(src, "/")+"/") {
+				ids = appendUnique(ids, a.id)
+			}
+		}
+	}
+	if len(ids) == 0 {
+		ids = append(ids, artifacts[len(artifacts)-1].id)
+	}
+	return ids
+}
+
+// graphShapes are how the kinds of nodes are drawn
+var graphShapes = map[string]string{
+	GraphStage:    "box",
+	GraphImage:    "ellipse",
+	GraphArtifact: "note",
+	GraphTag:      "cds",
+}
+
+// WriteDot writes the graph in the DOT language of Graphviz
+func (g *Graph) WriteDot(w io.Writer, name string) error {
+	lines := []string{fmt.Sprintf("digraph %s {", strconv.Quote(name)), "  rankdir=LR;"}
+	for _, n := range g.Nodes {
+		lines = append(lines, fmt.Sprintf("  %s [label=%s, shape=%s];", n.ID, strconv.Quote(n.Label), graphShapes[n.Kind]))
+	}
+	for _, e := range g.Edges {
+		lines = append(lines, fmt.Sprintf("  %s -> %s [label=%s];", e.From, e.To, strconv.Quote(e.Via)))
+	}
+	lines = append(lines, "}")
+
+	_, err := io.WriteString(w, strings.Join(lines, "\n")+"\n")
+	return err
+}
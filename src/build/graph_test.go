@@ -0,0 +1,103 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/grammarly/rocker/src/template"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewGraph(t *testing.T) {
+	r, err := NewRockerfile("test", strings.NewReader(strings.Join([]string{
+		"FROM golang AS builder",
+		"EXPORT /app/bin",
+		"EXPORT /app/docs share/",
+		"FROM alpine",
+		"IMPORT bin /usr/bin/",
+		"COPY --from=builder /src/README /",
+		"COPY --from=busybox /bin/sh /bin/sh",
+		"TAG acme/app:latest",
+		"FROM builder",
+		"IMPORT /share/docs",
+		"PUSH acme/app:latest",
+	}, "\n")), template.Vars{}, template.Funs{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	graph := NewGraph(r.Commands())
+
+	assert.Equal(t, []GraphNode{
+		{ID: "stage1", Kind: GraphStage, Label: "builder"},
+		{ID: "image2", Kind: GraphImage, Label: "golang"},
+		{ID: "artifact3", Kind: GraphArtifact, Label: "/app/bin"},
+		{ID: "artifact4", Kind: GraphArtifact, Label: "/app/docs share/"},
+		{ID: "stage5", Kind: GraphStage, Label: "stage 2"},
+		{ID: "image6", Kind: GraphImage, Label: "alpine"},
+		{ID: "image7", Kind: GraphImage, Label: "busybox"},
+		{ID: "tag8", Kind: GraphTag, Label: "acme/app:latest"},
+		{ID: "stage9", Kind: GraphStage, Label: "stage 3"},
+	}, graph.Nodes)
+
+	assert.Equal(t, []GraphEdge{
+		{From: "image2", To: "stage1", Via: "FROM"},
+		{From: "stage1", To: "artifact3", Via: "EXPORT"},
+		{From: "stage1", To: "artifact4", Via: "EXPORT"},
+		{From: "image6", To: "stage5", Via: "FROM"},
+		{From: "artifact3", To: "stage5", Via: "IMPORT"},
+		{From: "stage1", To: "stage5", Via: "COPY"},
+		{From: "image7", To: "stage5", Via: "COPY"},
+		{From: "stage5", To: "tag8", Via: "TAG"},
+		{From: "stage1", To: "stage9", Via: "FROM"},
+		{From: "artifact4", To: "stage9", Via: "IMPORT"},
+		{From: "stage9", To: "tag8", Via: "PUSH"},
+	}, graph.Edges)
+}
+
+func TestExportedPaths(t *testing.T) {
+	assert.Equal(t, []string{"/dir"}, exportedPaths([]string{"/my/dir"}))
+	assert.Equal(t, []string{"/stuff"}, exportedPaths([]string{"/my/dir", "stuff"}))
+	assert.Equal(t, []string{"/stuff/dir"}, exportedPaths([]string{"/my/dir", "/stuff/"}))
+	assert.Equal(t, []string{"/out/a", "/out/b"}, exportedPaths([]string{"/a", "/b", "/out"}))
+}
+
+func TestGraph_WriteDot(t *testing.T) {
+	graph := &Graph{
+		Nodes: []GraphNode{
+			{ID: "image1", Kind: GraphImage, Label: "alpine"},
+			{ID: "stage2", Kind: GraphStage, Label: "stage 1"},
+		},
+		Edges: []GraphEdge{{From: "image1", To: "stage2", Via: "FROM"}},
+	}
+
+	var buf bytes.Buffer
+	if err := graph.WriteDot(&buf, "Rockerfile"); err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, `digraph "Rockerfile" {
+  rankdir=LR;
+  image1 [label="alpine", shape=ellipse];
+  stage2 [label="stage 1", shape=box];
+  image1 -> stage2 [label="FROM"];
+}
+`, buf.String())
+}
@@ -0,0 +1,331 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/go-yaml/yaml"
+	"github.com/grammarly/rocker/src/spill"
+)
+
+// Media types of helm charts stored in OCI registries
+const (
+	helmConfigMediaType = "application/vnd.cncf.helm.config.v1+json"
+	helmChartMediaType  = "application/vnd.cncf.helm.chart.content.v1.tar+gzip"
+)
+
+// helmPackageArgs are the arguments of HELM_PACKAGE
+type helmPackageArgs struct {
+	dir     string
+	set     []string
+	version string
+	push    string
+}
+
+// helmChart is the packaged chart
+type helmChart struct {
+	name     string
+	version  string
+	metadata yaml.MapSlice
+	// archive is the .tgz, it has to be closed
+	archive *spill.Buffer
+}
+
+// parseHelmPackageArgs parses `./chart [--set key=value]... [--version v] [--push repo]`,
+// flags may be given both as `--flag value` and `--flag=value`
+func parseHelmPackageArgs(args []string) (result helmPackageArgs, err error) {
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+
+		if !strings.HasPrefix(arg, "--") {
+			if result.dir != "" {
+				return result, fmt.Errorf("HELM_PACKAGE takes exactly one chart directory, got %q and %q", result.dir, arg)
+			}
+			result.dir = arg
+			continue
+		}
+
+		name, value := strings.TrimPrefix(arg, "--"), ""
+		if eq := strings.Index(name, "="); eq >= 0 {
+			name, value = name[:eq], name[eq+1:]
+		} else if i+1 < len(args) {
+			i++
+			value = args[i]
+		} else {
+			return result, fmt.Errorf("HELM_PACKAGE flag --%s requires a value", name)
+		}
+
+		switch name {
+		case "set":
+			result.set = append(result.set, value)
+		case "version":
+			result.version = value
+		case "push":
+			result.push = value
+		default:
+			return result, fmt.Errorf("HELM_PACKAGE unknown flag --%s", name)
+		}
+	}
+
+	if result.dir == "" {
+		return result, fmt.Errorf("HELM_PACKAGE requires a chart directory")
+	}
+
+	return result, nil
+}
+
+// packageHelmChart makes a chart archive the same way `helm package` does,
+// with the values given in `set` written to values.yaml and the version
+// overridden if not empty
+func packageHelmChart(dir string, set []string, version string) (chart *helmChart, err error) {
+	chart = &helmChart{}
+
+	if err := readYAMLFile(filepath.Join(dir, "Chart.yaml"), &chart.metadata); err != nil {
+		return nil, err
+	}
+
+	if version != "" {
+		chart.metadata = setMapSliceKey(chart.metadata, "version", version)
+	}
+
+	for _, item := range chart.metadata {
+		switch item.Key {
+		case "name":
+			chart.name = fmt.Sprintf("%v", item.Value)
+		case "version":
+			chart.version = fmt.Sprintf("%v", item.Value)
+		}
+	}
+	if chart.name == "" || chart.version == "" {
+		return nil, fmt.Errorf("Chart.yaml in %s should have name and version", dir)
+	}
+
+	values := yaml.MapSlice{}
+	if _, err := os.Stat(filepath.Join(dir, "values.yaml")); err == nil {
+		if err := readYAMLFile(filepath.Join(dir, "values.yaml"), &values); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, kv := range set {
+		parts := strings.SplitN(kv, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("Invalid --set %q, expected key=value", kv)
+		}
+		values = setValue(values, strings.Split(parts[0], "."), parseValue(parts[1]))
+	}
+
+	ignore := []string{}
+	if _, err := os.Stat(filepath.Join(dir, ".helmignore")); err == nil {
+		if ignore, err = ReadDockerignoreFile(filepath.Join(dir, ".helmignore")); err != nil {
+			return nil, err
+		}
+	}
+
+	// Files that are rewritten are taken from memory, the rest as is
+	replace := map[string]interface{}{
+		"Chart.yaml":  chart.metadata,
+		"values.yaml": values,
+	}
+
+	var (
+		buf = spill.NewBuffer()
+		gz  = gzip.NewWriter(buf)
+		tw  = tar.NewWriter(gz)
+	)
+	defer func() {
+		if err != nil {
+			buf.Close()
+		}
+	}()
+
+	writeFile := func(name string, mode os.FileMode, size int64, content io.Reader) error {
+		hdr := &tar.Header{
+			Name:     chart.name + "/" + name,
+			Mode:     int64(mode.Perm()),
+			Size:     size,
+			Typeflag: tar.TypeReg,
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		_, err := io.Copy(tw, content)
+		return err
+	}
+
+	for _, name := range []string{"Chart.yaml", "values.yaml"} {
+		content, err := yaml.Marshal(replace[name])
+		if err != nil {
+			return nil, err
+		}
+		if err := writeFile(name, 0644, int64(len(content)), bytes.NewReader(content)); err != nil {
+			return nil, err
+		}
+	}
+
+	err = filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(dir, path)
+		if err != nil || rel == "." {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+
+		excluded, err := isExcludedPath(rel, ignore)
+		if err != nil {
+			return err
+		}
+		if excluded {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if _, ok := replace[rel]; ok || !info.Mode().IsRegular() {
+			return nil
+		}
+
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		return writeFile(rel, info.Mode(), info.Size(), f)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Failed to package chart %s, error: %s", dir, err)
+	}
+
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	if err := gz.Close(); err != nil {
+		return nil, err
+	}
+
+	chart.archive = buf
+
+	return chart, nil
+}
+
+// writeChart writes the chart archive to the file
+func writeChart(path string, archive io.Reader) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, archive); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// configJSON returns the chart metadata as the config of the chart's OCI manifest
+func (chart *helmChart) configJSON() ([]byte, error) {
+	return json.Marshal(mapSliceToJSON(chart.metadata))
+}
+
+func readYAMLFile(path string, out interface{}) error {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if err := yaml.Unmarshal(content, out); err != nil {
+		return fmt.Errorf("Failed to parse %s, error: %s", path, err)
+	}
+	return nil
+}
+
+// setValue sets the value by the path of keys, making the missing maps on the way
+func setValue(m yaml.MapSlice, path []string, value interface{}) yaml.MapSlice {
+	if len(path) == 1 {
+		return setMapSliceKey(m, path[0], value)
+	}
+
+	for i, item := range m {
+		if item.Key == path[0] {
+			nested, _ := item.Value.(yaml.MapSlice)
+			m[i].Value = setValue(nested, path[1:], value)
+			return m
+		}
+	}
+
+	return append(m, yaml.MapItem{Key: path[0], Value: setValue(yaml.MapSlice{}, path[1:], value)})
+}
+
+func setMapSliceKey(m yaml.MapSlice, key string, value interface{}) yaml.MapSlice {
+	for i, item := range m {
+		if item.Key == key {
+			m[i].Value = value
+			return m
+		}
+	}
+	return append(m, yaml.MapItem{Key: key, Value: value})
+}
+
+// parseValue makes bools and numbers typed, like `helm --set` does
+func parseValue(s string) interface{} {
+	switch s {
+	case "true":
+		return true
+	case "false":
+		return false
+	case "null":
+		return nil
+	}
+	if i, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return i
+	}
+	return s
+}
+
+// mapSliceToJSON converts the decoded YAML to the form encoding/json understands
+func mapSliceToJSON(v interface{}) interface{} {
+	switch v := v.(type) {
+	case yaml.MapSlice:
+		result := map[string]interface{}{}
+		for _, item := range v {
+			result[fmt.Sprintf("%v", item.Key)] = mapSliceToJSON(item.Value)
+		}
+		return result
+	case []interface{}:
+		result := make([]interface{}, len(v))
+		for i, item := range v {
+			result[i] = mapSliceToJSON(item)
+		}
+		return result
+	default:
+		return v
+	}
+}
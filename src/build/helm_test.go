@@ -0,0 +1,112 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseHelmPackageArgs(t *testing.T) {
+	args, err := parseHelmPackageArgs([]string{"./chart", "--set", "image.tag=1.0", "--set=replicas=2", "--push", "quay.io/acme/charts"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, "./chart", args.dir)
+	assert.Equal(t, []string{"image.tag=1.0", "replicas=2"}, args.set)
+	assert.Equal(t, "quay.io/acme/charts", args.push)
+
+	_, err = parseHelmPackageArgs([]string{"--set", "a=b"})
+	assert.Error(t, err)
+
+	_, err = parseHelmPackageArgs([]string{"./chart", "--values", "x.yaml"})
+	assert.Error(t, err)
+}
+
+func TestPackageHelmChart(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rocker-helm-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		"Chart.yaml":               "apiVersion: v2\nname: app\nversion: 0.1.0\n",
+		"values.yaml":              "image:\n  repository: acme/app\n  tag: latest\nreplicas: 1\n",
+		"templates/deployment.yml": "kind: Deployment\n",
+		"notes.txt":                "ignored\n",
+		".helmignore":              "*.txt\n",
+	}
+	for name, content := range files {
+		if err := os.MkdirAll(filepath.Dir(filepath.Join(dir, name)), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	chart, err := packageHelmChart(dir, []string{"image.tag=1.2.3", "replicas=3"}, "1.2.3")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer chart.archive.Close()
+
+	assert.Equal(t, "app", chart.name)
+	assert.Equal(t, "1.2.3", chart.version)
+
+	gz, err := gzip.NewReader(chart.archive.Reader())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result := map[string]string{}
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, _ := ioutil.ReadAll(tr)
+		result[hdr.Name] = string(content)
+	}
+
+	assert.Equal(t, map[string]string{
+		"app/Chart.yaml":               "apiVersion: v2\nname: app\nversion: 1.2.3\n",
+		"app/values.yaml":              "image:\n  repository: acme/app\n  tag: 1.2.3\nreplicas: 3\n",
+		"app/templates/deployment.yml": "kind: Deployment\n",
+		"app/.helmignore":              "*.txt\n",
+	}, result)
+
+	config, err := chart.configJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, `{"apiVersion":"v2","name":"app","version":"1.2.3"}`, string(config))
+}
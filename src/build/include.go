@@ -0,0 +1,235 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/grammarly/rocker/src/template"
+	"github.com/grammarly/rocker/src/util"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// IncludeCacheDir is where the fragments of INCLUDE are kept by their checksums,
+// so each one is downloaded once; empty downloads them every time
+var IncludeCacheDir = "~/.rocker_cache/includes"
+
+// IncludeOffline serves the fragments of INCLUDE from IncludeCacheDir only,
+// as --offline does; the ones that are not there fail the Rockerfile
+var IncludeOffline bool
+
+// includeClient downloads the fragments
+var includeClient = http.DefaultClient
+
+// maxIncludeDepth limits the fragments that include other fragments
+const maxIncludeDepth = 10
+
+var includeChecksum = regexp.MustCompile("^sha256:[a-fA-F0-9]{64}$")
+
+// errIncludeNotCached is returned by fetchInclude in the offline mode
+var errIncludeNotCached = errors.New("not in the INCLUDE cache")
+
+// offlineIncludesError lists all the fragments an offline build would have to
+// download, so they are reported at once like the pre-flight check does
+type offlineIncludesError struct {
+	urls []string
+}
+
+func (e *offlineIncludesError) Error() string {
+	missing := []string{}
+	for _, url := range e.urls {
+		missing = append(missing, fmt.Sprintf("INCLUDE %s: not in the cache", url))
+	}
+	return fmt.Sprintf("Cannot build in offline mode, %d dependencies are missing:\n  %s",
+		len(missing), strings.Join(missing, "\n  "))
+}
+
+// expandIncludes replaces the lines `INCLUDE <https url> sha256:<hex>` of the rendered
+// Rockerfile with the fragments they point to. A fragment is a piece of Rockerfile
+// that is rendered with the same variables and may include other fragments. The
+// checksum is mandatory, so what is built does not change with the remote file.
+// `INCLUDE <fragment>@<version>` takes the fragment `rocker get` put to the
+// fragments directory instead, checked against its lock file. With IncludeOffline
+// the fragments missing from the cache are all listed in one error
+func expandIncludes(content string, vars template.Vars, funs template.Funs, sandbox *template.Sandbox, fragmentsDir string, parents []string) (string, error) {
+	var (
+		lines        = strings.Split(content, "\n")
+		continuation bool
+		offline      = &offlineIncludesError{}
+	)
+
+	for i, line := range lines {
+		fields := strings.Fields(line)
+		isInclude := !continuation && len(fields) > 0 && strings.ToUpper(fields[0]) == "INCLUDE"
+		continuation = strings.HasSuffix(strings.TrimRight(line, " \t"), "\\")
+		if !isInclude {
+			continue
+		}
+
+		var (
+			url, checksum string
+			ref           FragmentRef
+			err           error
+		)
+		switch {
+		case len(fields) == 3 && strings.HasPrefix(fields[1], "https://") && includeChecksum.MatchString(fields[2]):
+			url, checksum = fields[1], strings.ToLower(fields[2])
+		case len(fields) == 2 && !strings.Contains(fields[1], "://"):
+			if ref, err = ParseFragmentRef(fields[1]); err != nil {
+				return "", fmt.Errorf("Invalid INCLUDE %q, error: %s", strings.TrimSpace(line), err)
+			}
+			url = ref.String()
+		default:
+			return "", fmt.Errorf("Invalid INCLUDE %q, expected INCLUDE https://<url> sha256:<hex> or INCLUDE <fragment>@<version>", strings.TrimSpace(line))
+		}
+
+		for _, parent := range parents {
+			if parent == url {
+				return "", fmt.Errorf("INCLUDE %s includes itself through %s", url, strings.Join(parents, " -> "))
+			}
+		}
+		if len(parents) >= maxIncludeDepth {
+			return "", fmt.Errorf("INCLUDE %s is nested deeper than %d fragments", url, maxIncludeDepth)
+		}
+
+		var data []byte
+		if checksum != "" {
+			data, err = fetchInclude(url, checksum)
+		} else {
+			data, err = readFragment(ref, fragmentsDir)
+		}
+		if err == errIncludeNotCached {
+			offline.urls = append(offline.urls, url)
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+
+		rendered, err := template.Process(url, bytes.NewReader(data), vars, funs, sandbox)
+		if err != nil {
+			return "", err
+		}
+
+		fragment, err := expandIncludes(rendered.String(), vars, funs, sandbox, fragmentsDir, append(append([]string{}, parents...), url))
+		if e, ok := err.(*offlineIncludesError); ok {
+			offline.urls = append(offline.urls, e.urls...)
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		lines[i] = strings.TrimRight(fragment, "\n")
+	}
+
+	if len(offline.urls) > 0 {
+		return "", offline
+	}
+
+	return strings.Join(lines, "\n"), nil
+}
+
+// fetchInclude returns the fragment from the cache, or downloads it and checks
+// the checksum before it is cached
+func fetchInclude(url, checksum string) ([]byte, error) {
+	var cacheFile string
+
+	if IncludeCacheDir != "" {
+		dir, err := util.MakeAbsolute(IncludeCacheDir)
+		if err != nil {
+			return nil, err
+		}
+		cacheFile = filepath.Join(dir, strings.TrimPrefix(checksum, "sha256:"))
+
+		// The name is the checksum, it is checked anyway in case the file was changed
+		if data, err := ioutil.ReadFile(cacheFile); err == nil && includeSum(data) == checksum {
+			log.Debugf("Include %s from the cache %s", url, cacheFile)
+			return data, nil
+		}
+	}
+
+	if IncludeOffline {
+		return nil, errIncludeNotCached
+	}
+
+	log.Infof("| Download INCLUDE %s", url)
+
+	resp, err := includeClient.Get(url)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to download INCLUDE %s, error: %s", url, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Failed to download INCLUDE %s, status: %s", url, resp.Status)
+	}
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to download INCLUDE %s, error: %s", url, err)
+	}
+
+	if sum := includeSum(data); sum != checksum {
+		return nil, WithExitCode(ExitPolicy, fmt.Errorf("Checksum mismatch for INCLUDE %s, expected %s, got %s", url, checksum, sum))
+	}
+
+	if cacheFile != "" {
+		if err := writeIncludeCache(cacheFile, data); err != nil {
+			log.Warnf("Failed to cache INCLUDE %s, error: %s", url, err)
+		}
+	}
+
+	return data, nil
+}
+
+func includeSum(data []byte) string {
+	sum := sha256.Sum256(data)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// writeIncludeCache writes the file through a temporary one, so the concurrent
+// builds never read a half written fragment
+func writeIncludeCache(file string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(file), ".include_")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), file)
+}
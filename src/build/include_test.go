@@ -0,0 +1,177 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/grammarly/rocker/src/template"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func serveIncludes(t *testing.T, files map[string]string) (*httptest.Server, func()) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		content, ok := files[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(content))
+	}))
+
+	tmpDir, err := ioutil.TempDir("", "rocker-include-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	prevClient, prevDir := includeClient, IncludeCacheDir
+	includeClient, IncludeCacheDir = server.Client(), tmpDir
+
+	return server, func() {
+		server.Close()
+		os.RemoveAll(tmpDir)
+		includeClient, IncludeCacheDir = prevClient, prevDir
+	}
+}
+
+func TestRockerfile_Include(t *testing.T) {
+	fragment := "RUN apk add --no-cache {{ .Packages }}\nENV LANG=C.UTF-8\n"
+	server, cleanup := serveIncludes(t, map[string]string{"/base.Rockerfile": fragment})
+	defer cleanup()
+
+	src := fmt.Sprintf("FROM alpine\nINCLUDE %s/base.Rockerfile %s\nCMD [\"/app\"]\n", server.URL, includeSum([]byte(fragment)))
+
+	r, err := NewRockerfile("test", strings.NewReader(src), template.Vars{"Packages": "curl"}, template.Funs{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "FROM alpine\nRUN apk add --no-cache curl\nENV LANG=C.UTF-8\nCMD [\"/app\"]\n", r.Content)
+	assert.Len(t, r.Commands(), 4)
+
+	// the cached fragment is used without the server
+	server.Close()
+	r, err = NewRockerfile("test", strings.NewReader(src), template.Vars{"Packages": "git"}, template.Funs{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Contains(t, r.Content, "RUN apk add --no-cache git\n")
+}
+
+func TestRockerfile_IncludeOffline(t *testing.T) {
+	var (
+		cached  = "RUN make\n"
+		missing = "RUN make test\n"
+		nested  = "RUN make install\n"
+		files   = map[string]string{"/cached.Rockerfile": cached}
+	)
+	server, cleanup := serveIncludes(t, files)
+	defer cleanup()
+
+	cachedLine := fmt.Sprintf("INCLUDE %s/cached.Rockerfile %s\n", server.URL, includeSum([]byte(cached)))
+	if _, err := NewRockerfile("test", strings.NewReader("FROM alpine\n"+cachedLine), template.Vars{}, template.Funs{}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// A fragment that is cached and includes one that is not
+	parent := fmt.Sprintf("INCLUDE %s/nested.Rockerfile %s\n", server.URL, includeSum([]byte(nested)))
+	files["/parent.Rockerfile"] = parent
+	if _, err := fetchInclude(server.URL+"/parent.Rockerfile", includeSum([]byte(parent))); err != nil {
+		t.Fatal(err)
+	}
+
+	IncludeOffline = true
+	defer func() { IncludeOffline = false }()
+	server.Close()
+
+	r, err := NewRockerfile("test", strings.NewReader("FROM alpine\n"+cachedLine), template.Vars{}, template.Funs{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "FROM alpine\nRUN make\n", r.Content)
+
+	src := fmt.Sprintf("FROM alpine\n%sINCLUDE %s/missing.Rockerfile %s\nINCLUDE %s/parent.Rockerfile %s\n",
+		cachedLine, server.URL, includeSum([]byte(missing)), server.URL, includeSum([]byte(parent)))
+
+	_, err = NewRockerfile("test", strings.NewReader(src), template.Vars{}, template.Funs{}, nil)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "Cannot build in offline mode, 2 dependencies are missing")
+		assert.Contains(t, err.Error(), "INCLUDE "+server.URL+"/missing.Rockerfile: not in the cache")
+		assert.Contains(t, err.Error(), "INCLUDE "+server.URL+"/nested.Rockerfile: not in the cache")
+		assert.NotContains(t, err.Error(), "cached.Rockerfile")
+	}
+}
+
+func TestRockerfile_IncludeChecksumMismatch(t *testing.T) {
+	server, cleanup := serveIncludes(t, map[string]string{"/base.Rockerfile": "RUN make\n"})
+	defer cleanup()
+
+	src := fmt.Sprintf("FROM alpine\nINCLUDE %s/base.Rockerfile %s\n", server.URL, includeSum([]byte("RUN make test\n")))
+
+	_, err := NewRockerfile("test", strings.NewReader(src), template.Vars{}, template.Funs{}, nil)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "Checksum mismatch for INCLUDE")
+		assert.Equal(t, ExitPolicy, ExitCode(err))
+	}
+}
+
+func TestRockerfile_IncludeInvalid(t *testing.T) {
+	sum := includeSum([]byte("RUN make\n"))
+
+	for _, line := range []string{
+		"INCLUDE https://example.com/base.Rockerfile",
+		"INCLUDE http://example.com/base.Rockerfile " + sum,
+		"INCLUDE base.Rockerfile " + sum,
+		"INCLUDE https://example.com/base.Rockerfile md5:1234",
+	} {
+		_, err := NewRockerfile("test", strings.NewReader("FROM alpine\n"+line+"\n"), template.Vars{}, template.Funs{}, nil)
+		if assert.Error(t, err, line) {
+			assert.Contains(t, err.Error(), "expected INCLUDE https://<url> sha256:<hex>", line)
+		}
+	}
+}
+
+func TestRockerfile_IncludeItself(t *testing.T) {
+	files := map[string]string{}
+	server, cleanup := serveIncludes(t, files)
+	defer cleanup()
+
+	// a fragment cannot pin its own checksum, so the loop goes through the variables
+	fragment := "INCLUDE {{ .URL }} {{ .Sum }}\n"
+	files["/loop.Rockerfile"] = fragment
+	vars := template.Vars{"URL": server.URL + "/loop.Rockerfile", "Sum": includeSum([]byte(fragment))}
+
+	_, err := NewRockerfile("test", strings.NewReader("FROM alpine\nINCLUDE {{ .URL }} {{ .Sum }}\n"), vars, template.Funs{}, nil)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "includes itself")
+	}
+}
+
+func TestExpandIncludes_Continuation(t *testing.T) {
+	content := "RUN echo \\\n  INCLUDE https://example.com/base.Rockerfile\n"
+	expanded, err := expandIncludes(content, template.Vars{}, template.Funs{}, nil, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, content, expanded)
+}
@@ -0,0 +1,242 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// ForceInterruptWindow is how soon after the first Ctrl+C a second one makes rocker
+// remove the containers of the build and exit, instead of waiting for the cleanup
+var ForceInterruptWindow = 5 * time.Second
+
+// interrupts handles SIGINT for the whole build. The first one cancels the context
+// of the build: the pull, the push or the running container is stopped, the step
+// fails and the build cleans up as after any failure. A second one within the window removes the containers the build
+// created and exits right away. While stdin is attached to a container, SIGINT
+// belongs to the container, see RunContainer
+type interrupts struct {
+	window time.Duration
+	log    *logrus.Logger
+	remove func(containerID string) error
+	exit   func(code int)
+
+	mu         sync.Mutex
+	cancelled  chan struct{}
+	last       time.Time
+	attached   int
+	containers map[string]bool
+	onForce    []func()
+}
+
+func newInterrupts(window time.Duration, log *logrus.Logger, remove func(string) error) *interrupts {
+	return &interrupts{
+		window:     window,
+		log:        log,
+		remove:     remove,
+		exit:       os.Exit,
+		cancelled:  make(chan struct{}),
+		containers: map[string]bool{},
+	}
+}
+
+// HandleInterrupts makes the client handle Ctrl+C for the build until the returned
+// function is called; without it SIGINT terminates rocker at once
+func (c *DockerClient) HandleInterrupts() (stop func()) {
+	sigch := make(chan os.Signal, 1)
+	signal.Notify(sigch, os.Interrupt)
+
+	go func() {
+		for range sigch {
+			c.interrupts.interrupt(time.Now())
+		}
+	}()
+
+	return func() {
+		signal.Stop(sigch)
+		close(sigch)
+	}
+}
+
+// interrupt cancels the build or, if it is cancelled already and the previous
+// interrupt was within the window, forces it to exit
+func (i *interrupts) interrupt(now time.Time) {
+	i.mu.Lock()
+
+	if i.attached > 0 {
+		i.mu.Unlock()
+		return
+	}
+
+	prev := i.last
+	i.last = now
+
+	select {
+	case <-i.cancelled:
+	default:
+		close(i.cancelled)
+		i.mu.Unlock()
+		i.log.Warnf("Received SIGINT, cancel the build and clean up; press Ctrl+C again within %s to force", i.window)
+		return
+	}
+
+	if now.Sub(prev) > i.window {
+		i.mu.Unlock()
+		i.log.Warnf("The build is being cancelled; press Ctrl+C twice within %s to force", i.window)
+		return
+	}
+
+	containers := []string{}
+	for id := range i.containers {
+		containers = append(containers, id)
+	}
+	hooks := i.onForce
+	i.mu.Unlock()
+
+	i.log.Warnf("Received SIGINT again, remove the containers of the build and exit")
+	for _, id := range containers {
+		if err := i.remove(id); err != nil {
+			i.log.Errorf("Failed to remove container %.12s: %s", id, err)
+		}
+	}
+	for _, hook := range hooks {
+		hook()
+	}
+
+	i.exit(ExitCancelled)
+}
+
+// isCancelled returns an error if the build was interrupted
+func (i *interrupts) isCancelled() error {
+	select {
+	case <-i.cancelled:
+		return WithExitCode(ExitCancelled, fmt.Errorf("Build cancelled"))
+	default:
+		return nil
+	}
+}
+
+// track remembers the containers of the build that are not removed yet
+func (i *interrupts) track(containerID string, created bool) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if created {
+		i.containers[containerID] = true
+	} else {
+		delete(i.containers, containerID)
+	}
+}
+
+// attach gives SIGINT to the container stdin is attached to, until detached
+func (i *interrupts) attach(attached bool) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if attached {
+		i.attached++
+	} else {
+		i.attached--
+	}
+}
+
+// context returns a context that is cancelled on the first SIGINT
+func (i *interrupts) context(parent context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(parent)
+	if i.isCancelled() != nil {
+		cancel()
+		return ctx, cancel
+	}
+	go func() {
+		select {
+		case <-i.cancelled:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
+// interruptContext returns the context of the build that Ctrl+C cancels
+func (c *DockerClient) interruptContext(parent context.Context) (context.Context, context.CancelFunc) {
+	return c.interrupts.context(parent)
+}
+
+// onForceInterrupt adds a function to be called before rocker exits on the second Ctrl+C
+func (c *DockerClient) onForceInterrupt(hook func()) {
+	c.interrupts.mu.Lock()
+	defer c.interrupts.mu.Unlock()
+	c.interrupts.onForce = append(c.interrupts.onForce, hook)
+}
+
+// checkCancelled returns an error if the build was interrupted or timed out
+// before the step; the commit of a RUN goes on after an interrupt, so its
+// container is not left behind
+func (b *Build) checkCancelled(ctx context.Context, step int, command Command) error {
+	switch ctx.Err() {
+	case nil:
+		return nil
+	case context.DeadlineExceeded:
+		return WithExitCode(ExitTimeout, fmt.Errorf("Build timed out before step %d: %s", step, command))
+	}
+	if b.state.NoCache.ContainerID != "" {
+		return nil
+	}
+	return WithExitCode(ExitCancelled, fmt.Errorf("Build cancelled"))
+}
+
+// contextError tells why the context stopped what the build was waiting for
+func contextError(ctx context.Context, what string) error {
+	if ctx.Err() == context.DeadlineExceeded {
+		return WithExitCode(ExitTimeout, fmt.Errorf("Build timed out %s", what))
+	}
+	return WithExitCode(ExitCancelled, fmt.Errorf("Build cancelled %s", what))
+}
+
+// contextWriter fails the writes once the context is done, which makes
+// the client drop the stream of a pull or a push and the daemon abort it
+type contextWriter struct {
+	ctx context.Context
+	w   io.Writer
+}
+
+func (w *contextWriter) Write(p []byte) (int, error) {
+	if err := w.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return w.w.Write(p)
+}
+
+// forceInterrupted tells where the progress of the build is kept when rocker
+// exits on the second Ctrl+C
+func (b *Build) forceInterrupted() {
+	next := atomic.LoadInt32(&b.progress)
+	switch {
+	case next == 0:
+	case b.cfg.ResumeFile != "":
+		b.log.Infof("The progress of the build up to step %d is kept, continue it with --resume", next)
+	case b.cfg.CheckpointFile != "":
+		b.log.Infof("The progress of the build up to step %d is kept, continue it with --restore %s", next, b.cfg.CheckpointFile)
+	}
+}
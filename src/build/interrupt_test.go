@@ -0,0 +1,166 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestInterrupts() (i *interrupts, removed *[]string, exited *int) {
+	removed, exited = &[]string{}, new(int)
+
+	i = newInterrupts(5*time.Second, &logrus.Logger{Out: ioutil.Discard, Formatter: &logrus.TextFormatter{}}, func(id string) error {
+		*removed = append(*removed, id)
+		return nil
+	})
+	i.exit = func(code int) {
+		*exited = code
+	}
+	return i, removed, exited
+}
+
+func TestInterrupts_Twice(t *testing.T) {
+	i, removed, exited := newTestInterrupts()
+
+	hooked := false
+	i.onForce = append(i.onForce, func() { hooked = true })
+
+	i.track("123", true)
+	i.track("456", true)
+	i.track("456", false)
+
+	now := time.Now()
+	assert.Nil(t, i.isCancelled())
+
+	i.interrupt(now)
+	assert.Equal(t, ExitCancelled, ExitCode(i.isCancelled()))
+	assert.Empty(t, *removed)
+	assert.Equal(t, 0, *exited)
+
+	i.interrupt(now.Add(time.Second))
+	assert.Equal(t, []string{"123"}, *removed)
+	assert.True(t, hooked)
+	assert.Equal(t, ExitCancelled, *exited)
+}
+
+func TestInterrupts_SecondTooLate(t *testing.T) {
+	i, _, exited := newTestInterrupts()
+
+	now := time.Now()
+	i.interrupt(now)
+	i.interrupt(now.Add(10 * time.Second))
+	assert.Equal(t, 0, *exited)
+
+	i.interrupt(now.Add(11 * time.Second))
+	assert.Equal(t, ExitCancelled, *exited)
+}
+
+func TestInterrupts_Attached(t *testing.T) {
+	i, _, _ := newTestInterrupts()
+
+	i.attach(true)
+	i.interrupt(time.Now())
+	assert.Nil(t, i.isCancelled())
+
+	i.attach(false)
+	i.interrupt(time.Now())
+	assert.Error(t, i.isCancelled())
+}
+
+func TestInterrupts_Context(t *testing.T) {
+	i, _, _ := newTestInterrupts()
+
+	ctx, cancel := i.context(context.Background())
+	defer cancel()
+	assert.Nil(t, ctx.Err())
+
+	i.interrupt(time.Now())
+
+	select {
+	case <-ctx.Done():
+	case <-time.After(time.Second):
+		t.Fatal("the context is not cancelled after the interrupt")
+	}
+	assert.Equal(t, ExitCancelled, ExitCode(contextError(ctx, "while pulling alpine")))
+}
+
+func TestContextWriter(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	out := &bytes.Buffer{}
+	w := &contextWriter{ctx: ctx, w: out}
+
+	_, err := w.Write([]byte("pulling"))
+	assert.Nil(t, err)
+
+	cancel()
+	_, err = w.Write([]byte("more"))
+	assert.Equal(t, context.Canceled, err)
+	assert.Equal(t, "pulling", out.String())
+}
+
+func TestBuild_RunContextCancelled(t *testing.T) {
+	rockerfile := "FROM scratch\nENV A=1"
+	b, c := makeBuild(t, rockerfile, Config{})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	err := b.RunContext(ctx, makePlan(t, rockerfile))
+	assert.Equal(t, ExitCancelled, ExitCode(err))
+	c.AssertExpectations(t)
+}
+
+func TestBuild_RunContextTimeout(t *testing.T) {
+	rockerfile := "FROM scratch\nENV A=1"
+	b, c := makeBuild(t, rockerfile, Config{})
+
+	ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+	defer cancel()
+
+	err := b.RunContext(ctx, makePlan(t, rockerfile))
+	assert.Equal(t, ExitTimeout, ExitCode(err))
+	c.AssertExpectations(t)
+}
+
+func TestBuild_Cancelled(t *testing.T) {
+	rockerfile := "FROM scratch\nENV A=1"
+	b, c := makeBuild(t, rockerfile, Config{})
+
+	i, _, _ := newTestInterrupts()
+	i.interrupt(time.Now())
+	b.client = interruptedClient{c, i}
+
+	err := b.Run(makePlan(t, rockerfile))
+	assert.Equal(t, ExitCancelled, ExitCode(err))
+	c.AssertExpectations(t)
+}
+
+type interruptedClient struct {
+	*MockClient
+	interrupts *interrupts
+}
+
+func (c interruptedClient) interruptContext(parent context.Context) (context.Context, context.CancelFunc) {
+	return c.interrupts.context(parent)
+}
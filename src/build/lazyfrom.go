@@ -0,0 +1,251 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/grammarly/rocker/src/imagename"
+
+	"github.com/fsouza/go-dockerclient"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// fromImages remembers the images FROM resolved to in the previous builds, so the
+// FROM image that is not here does not have to be pulled for the steps that are
+// all cached; the images are kept in the cache directory by the name of FROM
+type fromImages struct {
+	file   string
+	images map[string]*docker.Image
+	mu     sync.Mutex
+}
+
+func newFromImages(base string) *fromImages {
+	c := &fromImages{images: map[string]*docker.Image{}}
+	if base == "" {
+		return c
+	}
+
+	c.file = filepath.Join(base, "from_images.json")
+
+	data, err := ioutil.ReadFile(c.file)
+	if err != nil {
+		return c
+	}
+	if err := json.Unmarshal(data, &c.images); err != nil {
+		log.Debugf("Ignore broken FROM images cache %s, error: %s", c.file, err)
+		c.images = map[string]*docker.Image{}
+	}
+
+	return c
+}
+
+// get returns the image the name resolved to the last time, nil if it never did
+func (c *fromImages) get(name string) *docker.Image {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.images[imagename.NewFromString(name).String()]
+}
+
+// put remembers the image the name resolved to and writes the cache file if it changed
+func (c *fromImages) put(name string, img *docker.Image) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	name = imagename.NewFromString(name).String()
+	if prev, ok := c.images[name]; ok && prev.ID == img.ID {
+		return nil
+	}
+
+	// Only what FROM takes from the image is kept
+	c.images[name] = &docker.Image{
+		ID:          img.ID,
+		Config:      img.Config,
+		VirtualSize: img.VirtualSize,
+		RootFS:      img.RootFS,
+	}
+
+	if c.file == "" {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(c.file), 0755); err != nil {
+		return err
+	}
+	data, err := json.Marshal(c.images)
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(c.file, data, 0644); err != nil {
+		return fmt.Errorf("Failed to write FROM images cache %s, error: %s", c.file, err)
+	}
+	return nil
+}
+
+// lazyFrom is the FROM image of the section that is not pulled yet: the steps
+// are taken from the cache as long as they can be, and the image is pulled
+// when the first step that is not cached needs a container of it
+type lazyFrom struct {
+	name  string
+	image *docker.Image
+}
+
+// sectionStart is where the build was before the FROM of the section, for
+// starting the section over when its lazy FROM image turns out to have changed
+type sectionStart struct {
+	k            int
+	plan         Plan
+	position     buildPosition
+	state        State
+	steps        int
+	injections   int
+	cacheHits    int
+	cacheMisses  int
+	producedSize int64
+	virtualSize  int64
+}
+
+func (b *Build) markSection(k int, plan Plan, position buildPosition) *sectionStart {
+	return &sectionStart{
+		k:            k,
+		plan:         append(Plan{}, plan...),
+		position:     position,
+		state:        b.state,
+		steps:        len(b.Steps),
+		injections:   len(b.injections),
+		cacheHits:    b.CacheHits,
+		cacheMisses:  b.CacheMisses,
+		producedSize: b.ProducedSize,
+		virtualSize:  b.VirtualSize,
+	}
+}
+
+// restore brings the build back to the start of the section, it returns
+// the plan and the index of the FROM command to run again
+func (s *sectionStart) restore(b *Build) (Plan, int) {
+	b.position = s.position
+	b.state = s.state
+	b.Steps = b.Steps[:s.steps]
+	b.injections = b.injections[:s.injections]
+	b.CacheHits = s.cacheHits
+	b.CacheMisses = s.cacheMisses
+	b.ProducedSize = s.producedSize
+	b.VirtualSize = s.virtualSize
+	b.fromChanged = false
+	return append(Plan{}, s.plan...), s.k
+}
+
+// fromImage looks up the image of FROM and remembers what it resolved to. An image
+// that is not here but was resolved by a previous build is not pulled: FROM takes
+// what it remembers and the image is pulled when a step needs it, see pullLazyFrom.
+// With --pull the registry is always checked, as it asks for the newest image
+func (b *Build) fromImage(ctx context.Context, name string) (*docker.Image, error) {
+	if seen := b.fromImages.get(name); seen != nil && b.canDeferFrom() {
+		img, err := b.localImage(name)
+		if err != nil {
+			return nil, err
+		}
+		if img == nil {
+			b.lazyFrom = &lazyFrom{name: name, image: seen}
+			return seen, nil
+		}
+		return img, b.fromImages.put(name, img)
+	}
+
+	img, err := b.lookupImage(ctx, name)
+	if err != nil || img == nil {
+		return img, err
+	}
+	return img, b.fromImages.put(name, img)
+}
+
+// canDeferFrom tells if FROM can take the image a previous build resolved it to,
+// which is only of use to the steps taken from the cache
+func (b *Build) canDeferFrom() bool {
+	return b.cache != nil && !b.cfg.ReloadCache && (!b.cfg.Pull || b.cfg.Offline)
+}
+
+// localImage finds the image like lookupImage does, but only among the local
+// images; it returns nil if the image would have to be pulled
+func (b *Build) localImage(name string) (*docker.Image, error) {
+	imgName := imagename.NewFromString(name)
+
+	if img, err := b.client.InspectImage(imgName.String()); err != nil || img != nil || imgName.TagIsSha() {
+		return img, err
+	}
+
+	localImages, err := b.client.ListImages()
+	if err != nil {
+		return nil, err
+	}
+	if candidate := imgName.ResolveVersion(localImages, true); candidate != nil {
+		return b.client.InspectImage(candidate.String())
+	}
+	return nil, nil
+}
+
+// pullLazyFrom pulls the FROM image that was put off, if the image with the
+// given ID is the one. When the pulled image is not the one the previous build
+// resolved FROM to, the image changed since then and the section starts over
+func (b *Build) pullLazyFrom(ctx context.Context, imageID string) error {
+	l := b.lazyFrom
+	if l == nil || imageID != l.image.ID {
+		return nil
+	}
+	b.lazyFrom = nil
+
+	b.log.Infof("| Pull %s, the step needs the FROM image", l.name)
+
+	img, err := b.lookupImage(ctx, l.name)
+	if err != nil {
+		return fmt.Errorf("FROM error: %s", err)
+	}
+	if img == nil {
+		return fmt.Errorf("FROM: image %s not found", l.name)
+	}
+	if err := b.fromImages.put(l.name, img); err != nil {
+		return err
+	}
+
+	if img.ID != l.image.ID {
+		b.log.Infof("| Image %s changed since the last build, %.12s --> %.12s, start the section over", l.name, l.image.ID, img.ID)
+		b.fromChanged = true
+		return fmt.Errorf("FROM image %s changed during the build", l.name)
+	}
+
+	return nil
+}
+
+// needsFromImage tells if the command needs the image of the state to be
+// there; the rest only change the config or take the step from the cache
+// before they make a container, and pull the FROM image on a cache miss
+func needsFromImage(command Command) bool {
+	switch command.(type) {
+	case *CommandFrom, *CommandCommit, *CommandRun, *CommandCopy, *CommandAdd,
+		*CommandEnv, *CommandLabel, *CommandWorkdir, *CommandCmd, *CommandEntrypoint,
+		*CommandShell, *CommandHealthcheck, *CommandExpose, *CommandVolume, *CommandUser,
+		*CommandStopsignal, *CommandOnbuild, *CommandArg, *CommandMaintainer:
+		return false
+	}
+	return true
+}
@@ -0,0 +1,108 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/grammarly/rocker/src/imagename"
+
+	"github.com/fsouza/go-dockerclient"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFromImages_PutGet(t *testing.T) {
+	tmpDir := cacheTestTmpDir(t)
+	defer os.RemoveAll(tmpDir)
+
+	c := newFromImages(tmpDir)
+	assert.Nil(t, c.get("ubuntu"))
+
+	if err := c.put("ubuntu", &docker.Image{ID: "sha256:111", Size: 100}); err != nil {
+		t.Fatal(err)
+	}
+
+	img := newFromImages(tmpDir).get("ubuntu:latest")
+	if assert.NotNil(t, img) {
+		assert.Equal(t, "sha256:111", img.ID)
+		assert.EqualValues(t, 0, img.Size)
+	}
+}
+
+func TestBuild_LazyFromAllCached(t *testing.T) {
+	tmpDir := cacheTestTmpDir(t)
+	defer os.RemoveAll(tmpDir)
+
+	base := &docker.Image{ID: "sha256:base", Config: &docker.Config{Env: []string{"PATH=/bin"}}}
+	if err := newFromImages(tmpDir).put("ubuntu", base); err != nil {
+		t.Fatal(err)
+	}
+
+	rockerfile := "FROM ubuntu\nRUN make"
+	b, c := makeBuild(t, rockerfile, Config{CacheDir: tmpDir})
+	b.cache = NewCacheFS(filepath.Join(tmpDir, "build"))
+
+	cached := State{ParentID: "sha256:base", ImageID: "sha256:made", Commits: []string{`RUN ["/bin/sh" "-c" "make"]`}}
+	if err := b.cache.Put(cached); err != nil {
+		t.Fatal(err)
+	}
+
+	c.On("InspectImage", "ubuntu:latest").Return((*docker.Image)(nil), nil).Once()
+	c.On("ListImages").Return([]*imagename.ImageName{}, nil).Once()
+	c.On("InspectImage", "sha256:made").Return(&docker.Image{ID: "sha256:made"}, nil).Once()
+
+	if err := b.Run(makePlan(t, rockerfile)); err != nil {
+		t.Fatal(err)
+	}
+
+	// the image is never pulled
+	c.AssertExpectations(t)
+	assert.Equal(t, "sha256:made", b.GetImageID())
+	assert.Equal(t, 1, b.CacheHits)
+}
+
+func TestBuild_LazyFromChanged(t *testing.T) {
+	tmpDir := cacheTestTmpDir(t)
+	defer os.RemoveAll(tmpDir)
+
+	if err := newFromImages(tmpDir).put("ubuntu", &docker.Image{ID: "sha256:old"}); err != nil {
+		t.Fatal(err)
+	}
+
+	rockerfile := "FROM ubuntu\nTAG my/app"
+	b, c := makeBuild(t, rockerfile, Config{CacheDir: tmpDir})
+	b.cache = NewCacheFS(filepath.Join(tmpDir, "build"))
+
+	newer := &docker.Image{ID: "sha256:new"}
+
+	c.On("InspectImage", "ubuntu:latest").Return((*docker.Image)(nil), nil).Twice()
+	c.On("ListImages").Return([]*imagename.ImageName{}, nil).Twice()
+	c.On("ListImageTags", "ubuntu:latest").Return([]*imagename.ImageName{imagename.NewFromString("ubuntu:latest")}, nil).Once()
+	c.On("PullImage", "ubuntu:latest").Return(nil).Once()
+	c.On("InspectImage", "ubuntu:latest").Return(newer, nil).Twice()
+	c.On("TagImage", "sha256:new", "my/app").Return(nil).Once()
+
+	if err := b.Run(makePlan(t, rockerfile)); err != nil {
+		t.Fatal(err)
+	}
+
+	c.AssertExpectations(t)
+	assert.Equal(t, "sha256:new", b.GetImageID())
+	assert.Equal(t, "sha256:new", newFromImages(tmpDir).get("ubuntu").ID)
+}
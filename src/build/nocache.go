@@ -0,0 +1,120 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// noCacheCommands are the commands that look up the cache by themselves,
+// so NOCACHE and --no-cache can be given to them
+const noCacheCommands = "run attach add copy export import"
+
+// NoCacheScope disables the cache for a part of the build only, one of:
+//
+//	stage:N       the N-th FROM section, or stage:final for the last one
+//	from-step:N   the N-th instruction of the Rockerfile and everything after it
+//	directive:RUN every instruction of the kind
+type NoCacheScope struct {
+	kind  string
+	value string
+	n     int
+}
+
+// ParseNoCacheScope parses the scope given to --no-cache-for
+func ParseNoCacheScope(scope string) (s NoCacheScope, err error) {
+	parts := strings.SplitN(scope, ":", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return s, fmt.Errorf("Invalid cache scope %q, expected stage:N, stage:final, from-step:N or directive:NAME", scope)
+	}
+
+	s.kind, s.value = parts[0], parts[1]
+
+	switch s.kind {
+	case "stage":
+		if s.value == "final" {
+			return s, nil
+		}
+		fallthrough
+	case "from-step":
+		if s.n, err = strconv.Atoi(s.value); err != nil || s.n < 1 {
+			return s, fmt.Errorf("Invalid cache scope %q, %s should be a positive number", scope, s.kind)
+		}
+	case "directive":
+		s.value = strings.ToUpper(s.value)
+	default:
+		return s, fmt.Errorf("Invalid cache scope %q, unknown kind %s", scope, s.kind)
+	}
+
+	return s, nil
+}
+
+// String returns the scope as it was given
+func (s NoCacheScope) String() string {
+	return s.kind + ":" + s.value
+}
+
+// buildPosition tells where the build currently is, for the cache scopes
+type buildPosition struct {
+	step   int
+	stage  int
+	stages int
+}
+
+// matches returns true if the commits at the given position fall into the scope
+func (s NoCacheScope) matches(pos buildPosition, commits []string) bool {
+	switch s.kind {
+	case "stage":
+		if s.value == "final" {
+			return pos.stage == pos.stages
+		}
+		return pos.stage == s.n
+	case "from-step":
+		return pos.step >= s.n
+	case "directive":
+		for _, commit := range commits {
+			if strings.HasPrefix(commit, s.value+" ") || commit == s.value {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// noCacheScope returns the first of the configured scopes that disables
+// the cache for the commits, if any
+func (b *Build) noCacheScope(commits []string) (scope NoCacheScope, ok bool) {
+	for _, scope := range b.cfg.NoCacheFor {
+		if scope.matches(b.position, commits) {
+			return scope, true
+		}
+	}
+	return scope, false
+}
+
+// noCacheCommand is a command that can skip the cache with --no-cache
+type noCacheCommand interface {
+	noCache() bool
+}
+
+// noCache returns true if the command is given --no-cache or follows a NOCACHE line
+func (c *CommandBase) noCache() bool {
+	_, ok := c.cfg.flags["no-cache"]
+	return ok
+}
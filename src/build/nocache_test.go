@@ -0,0 +1,128 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"context"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/grammarly/rocker/src/template"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseNoCacheScope(t *testing.T) {
+	for _, arg := range []string{"stage:final", "stage:2", "from-step:12", "directive:RUN"} {
+		scope, err := ParseNoCacheScope(arg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, arg, scope.String())
+	}
+
+	scope, err := ParseNoCacheScope("directive:run")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "directive:RUN", scope.String())
+
+	for _, arg := range []string{"", "stage", "stage:", "stage:last", "from-step:0", "step:1"} {
+		_, err := ParseNoCacheScope(arg)
+		assert.Error(t, err, arg)
+	}
+}
+
+func TestNoCacheScope_Matches(t *testing.T) {
+	pos := buildPosition{step: 5, stage: 2, stages: 2}
+	commits := []string{`ENV FOO=bar`, `RUN ["/bin/sh" "-c" "make"]`}
+
+	tests := map[string]bool{
+		"stage:final":     true,
+		"stage:2":         true,
+		"stage:1":         false,
+		"from-step:5":     true,
+		"from-step:6":     false,
+		"directive:RUN":   true,
+		"directive:COPY":  false,
+		"directive:ENTRY": false,
+	}
+
+	for arg, expected := range tests {
+		scope, err := ParseNoCacheScope(arg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, expected, scope.matches(pos, commits), arg)
+	}
+}
+
+func TestPlan_NoCache(t *testing.T) {
+	p := makePlan(t, `
+FROM ubuntu
+NOCACHE
+RUN apt-get update
+RUN apt-get install -y curl
+COPY --no-cache . /src
+`)
+
+	assert.Len(t, p, 8)
+	assert.True(t, p[1].(*CommandRun).noCache())
+	assert.False(t, p[3].(*CommandRun).noCache())
+	assert.True(t, p[5].(*CommandCopy).noCache())
+}
+
+func TestPlan_NoCacheInvalid(t *testing.T) {
+	for _, content := range []string{
+		"FROM ubuntu\nENV --no-cache FOO=bar",
+		"FROM ubuntu\nNOCACHE\nTAG app",
+		"FROM ubuntu\nRUN make\nNOCACHE",
+	} {
+		r, err := NewRockerfile("test", strings.NewReader(content), template.Vars{}, template.Funs{}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = NewPlan(r.Commands(), true)
+		assert.Error(t, err, content)
+	}
+}
+
+func TestBuild_ProbeCacheNoCacheStep(t *testing.T) {
+	tmpDir := cacheTestTmpDir(t)
+	defer os.RemoveAll(tmpDir)
+
+	b, _ := makeBuild(t, "FROM ubuntu", Config{})
+	b.cache = NewCacheFS(tmpDir)
+
+	s := State{ImageID: "123", Commits: []string{"RUN apt-get update"}}
+	cached := s
+	cached.ParentID, cached.ImageID = "123", "456"
+	if err := b.cache.Put(cached); err != nil {
+		t.Fatal(err)
+	}
+
+	b.noCacheStep = true
+
+	s2, hit, err := b.probeCache(context.Background(), s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.False(t, hit)
+	assert.True(t, s2.NoCache.CacheBusted)
+	assert.Equal(t, 1, b.CacheMisses)
+}
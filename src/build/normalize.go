@@ -0,0 +1,214 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// normalizeHeader makes the tar entry the same in every build of the same files:
+// the times newer than the epoch are clamped to it, as SOURCE_DATE_EPOCH asks,
+// and the user and group names, which depend on the host, are dropped
+func normalizeHeader(hdr *tar.Header, epoch time.Time) {
+	if hdr.ModTime.After(epoch) {
+		hdr.ModTime = epoch
+	}
+	hdr.AccessTime = time.Time{}
+	hdr.ChangeTime = time.Time{}
+	hdr.Uname = ""
+	hdr.Gname = ""
+}
+
+// normalizeUploadHeader normalizes the entry of a file COPY or ADD uploads from the
+// host: the time is the epoch and the owner is root, as the checkouts and the users
+// of the build hosts differ; the archives ADD extracts keep their owners
+func normalizeUploadHeader(hdr *tar.Header, epoch time.Time) {
+	normalizeHeader(hdr, epoch)
+	hdr.ModTime = epoch
+	hdr.Uid = 0
+	hdr.Gid = 0
+}
+
+// normalizeImage makes the image of the state reproducible, see normalizeSavedImage
+func normalizeImage(b *Build, s State, keep int) (State, error) {
+	img, err := b.client.NormalizeImage(s.ImageID, keep, b.cfg.SourceDateEpoch)
+	if err != nil {
+		return s, err
+	}
+	return useRewrittenImage(b, s, img)
+}
+
+// normalizeSavedImage rewrites the image that `docker save` extracted to dir so
+// that two builds of the same sources give the same image: the entries of the
+// layers above the first keep ones get normalizeHeader, the creation times of the
+// image and its history are pinned to the epoch, and the metadata of the
+// containers the image was committed from is dropped. It returns the id of the
+// new image and the files of the archive to give to `docker load`
+func normalizeSavedImage(dir string, keep int, epoch time.Time) (imageID string, files []string, err error) {
+	var manifests []savedManifest
+	if err := readJSONFile(filepath.Join(dir, "manifest.json"), &manifests); err != nil {
+		return "", nil, fmt.Errorf("Failed to read the manifest of the saved image, error: %s", err)
+	}
+	if len(manifests) != 1 {
+		return "", nil, fmt.Errorf("Expected one image in the saved archive, found %d", len(manifests))
+	}
+	m := manifests[0]
+	if keep < 0 || keep > len(m.Layers) {
+		return "", nil, fmt.Errorf("Cannot keep %d layers of the image, it has %d", keep, len(m.Layers))
+	}
+
+	layers := append([]string{}, m.Layers[:keep]...)
+	diffIDs := []string{}
+
+	for i, layer := range m.Layers[keep:] {
+		name := fmt.Sprintf("normalized-%d.tar", i+1)
+
+		out, err := os.Create(filepath.Join(dir, name))
+		if err != nil {
+			return "", nil, err
+		}
+		digest := sha256.New()
+		err = normalizeLayer(filepath.Join(dir, filepath.FromSlash(layer)), io.MultiWriter(out, digest), epoch)
+		if closeErr := out.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return "", nil, fmt.Errorf("Failed to normalize layer %d, error: %s", keep+i+1, err)
+		}
+
+		layers = append(layers, name)
+		diffIDs = append(diffIDs, "sha256:"+hex.EncodeToString(digest.Sum(nil)))
+	}
+
+	config, err := normalizeConfig(filepath.Join(dir, filepath.FromSlash(m.Config)), keep, diffIDs, epoch)
+	if err != nil {
+		return "", nil, err
+	}
+	configSum := sha256.Sum256(config)
+	configFile := hex.EncodeToString(configSum[:]) + ".json"
+	if err := ioutil.WriteFile(filepath.Join(dir, configFile), config, 0644); err != nil {
+		return "", nil, err
+	}
+
+	manifest, err := json.Marshal([]savedManifest{{Config: configFile, Layers: layers}})
+	if err != nil {
+		return "", nil, err
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "manifest.json"), manifest, 0644); err != nil {
+		return "", nil, err
+	}
+
+	files = append([]string{"manifest.json", configFile}, layers...)
+	return "sha256:" + hex.EncodeToString(configSum[:]), files, nil
+}
+
+// normalizeLayer copies the layer with the normalized entries, in the same order
+func normalizeLayer(file string, out io.Writer, epoch time.Time) error {
+	tw := tar.NewWriter(out)
+
+	err := readLayer(file, func(hdr *tar.Header, r io.Reader) error {
+		normalizeHeader(hdr, epoch)
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		_, err := io.Copy(tw, r)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	return tw.Close()
+}
+
+// normalizeConfig replaces the layers above the first keep ones with the normalized
+// ones in the image config, pins the creation times and drops the container metadata
+func normalizeConfig(file string, keep int, diffIDs []string, epoch time.Time) ([]byte, error) {
+	var (
+		config    map[string]json.RawMessage
+		runConfig map[string]json.RawMessage
+		rootfs    struct {
+			Type    string   `json:"type"`
+			DiffIDs []string `json:"diff_ids"`
+		}
+		history []map[string]json.RawMessage
+	)
+
+	if err := readJSONFile(file, &config); err != nil {
+		return nil, fmt.Errorf("Failed to read the config of the saved image, error: %s", err)
+	}
+	if err := json.Unmarshal(config["rootfs"], &rootfs); err != nil {
+		return nil, fmt.Errorf("Failed to read the layers of the saved image, error: %s", err)
+	}
+	if keep+len(diffIDs) != len(rootfs.DiffIDs) {
+		return nil, fmt.Errorf("The saved image has %d layers, its config has %d", keep+len(diffIDs), len(rootfs.DiffIDs))
+	}
+	rootfs.DiffIDs = append(rootfs.DiffIDs[:keep], diffIDs...)
+
+	created, err := json.Marshal(epoch.UTC().Format(time.RFC3339Nano))
+	if err != nil {
+		return nil, err
+	}
+
+	if raw, ok := config["history"]; ok {
+		if err := json.Unmarshal(raw, &history); err != nil {
+			return nil, fmt.Errorf("Failed to read the history of the saved image, error: %s", err)
+		}
+	}
+	for _, entry := range history {
+		var t time.Time
+		if err := json.Unmarshal(entry["created"], &t); err != nil || t.After(epoch) {
+			entry["created"] = created
+		}
+	}
+
+	// The hostname is the id of the container the image was committed from
+	if raw, ok := config["config"]; ok && string(raw) != "null" {
+		if err := json.Unmarshal(raw, &runConfig); err != nil {
+			return nil, fmt.Errorf("Failed to read the config of the saved image, error: %s", err)
+		}
+		delete(runConfig, "Hostname")
+		if config["config"], err = json.Marshal(runConfig); err != nil {
+			return nil, err
+		}
+	}
+
+	delete(config, "container")
+	delete(config, "container_config")
+	delete(config, "docker_version")
+	config["created"] = created
+
+	if config["rootfs"], err = json.Marshal(rootfs); err != nil {
+		return nil, err
+	}
+	if history != nil {
+		if config["history"], err = json.Marshal(history); err != nil {
+			return nil, err
+		}
+	}
+
+	return json.Marshal(config)
+}
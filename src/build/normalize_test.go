@@ -0,0 +1,184 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNormalizeHeader(t *testing.T) {
+	epoch := time.Unix(1500000000, 0)
+
+	hdr := &tar.Header{
+		Name:       "app",
+		ModTime:    epoch.Add(time.Hour),
+		AccessTime: epoch.Add(time.Hour),
+		Uname:      "builder",
+		Uid:        1000,
+	}
+	normalizeHeader(hdr, epoch)
+	assert.True(t, hdr.ModTime.Equal(epoch))
+	assert.True(t, hdr.AccessTime.IsZero())
+	assert.Equal(t, "", hdr.Uname)
+	assert.Equal(t, 1000, hdr.Uid)
+
+	// older times are kept
+	old := &tar.Header{Name: "app", ModTime: epoch.Add(-time.Hour)}
+	normalizeHeader(old, epoch)
+	assert.True(t, old.ModTime.Equal(epoch.Add(-time.Hour)))
+
+	upload := &tar.Header{Name: "app", ModTime: epoch.Add(-time.Hour), Uid: 1000, Gid: 1000}
+	normalizeUploadHeader(upload, epoch)
+	assert.True(t, upload.ModTime.Equal(epoch))
+	assert.Equal(t, 0, upload.Uid)
+	assert.Equal(t, 0, upload.Gid)
+}
+
+// writeSavedImage writes an image of two layers as `docker save` does, the files
+// of the second layer and the image are created at the given time
+func writeSavedImage(t *testing.T, dir string, created time.Time) {
+	write := func(file string, mtime time.Time) {
+		var buf bytes.Buffer
+		tw := tar.NewWriter(&buf)
+		if err := tw.WriteHeader(&tar.Header{Name: "app", Mode: 0644, Size: 1, ModTime: mtime, Uname: "builder", Typeflag: tar.TypeReg}); err != nil {
+			t.Fatal(err)
+		}
+		tw.Write([]byte("1"))
+		tw.Close()
+		if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(file, buf.Bytes(), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(filepath.Join(dir, "base/layer.tar"), time.Unix(100, 0))
+	write(filepath.Join(dir, "run/layer.tar"), created)
+
+	ts := created.UTC().Format(time.RFC3339Nano)
+	config := `{"architecture":"amd64","os":"linux","created":"` + ts + `","docker_version":"1.12.1",` +
+		`"container":"` + ts + `","container_config":{"Hostname":"` + ts + `"},"config":{"Hostname":"` + ts + `","Cmd":["app"]},` +
+		`"rootfs":{"type":"layers","diff_ids":["sha256:base","sha256:run"]},` +
+		`"history":[{"created":"1970-01-01T00:01:40Z","created_by":"ADD base"},{"created":"` + ts + `","created_by":"RUN make"}]}`
+	manifest := `[{"Config":"old.json","RepoTags":null,"Layers":["base/layer.tar","run/layer.tar"]}]`
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "old.json"), []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "manifest.json"), []byte(manifest), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNormalizeSavedImage(t *testing.T) {
+	epoch := time.Unix(1500000000, 0)
+
+	ids := []string{}
+	for _, created := range []time.Time{epoch.Add(time.Hour), epoch.Add(2 * time.Hour)} {
+		tmpDir := makeTmpDir(t, map[string]string{})
+		defer os.RemoveAll(tmpDir)
+
+		writeSavedImage(t, tmpDir, created)
+
+		id, files, err := normalizeSavedImage(tmpDir, 1, epoch)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+		assert.Equal(t, []string{"manifest.json", files[1], "base/layer.tar", "normalized-1.tar"}, files)
+
+		var config map[string]interface{}
+		data, err := ioutil.ReadFile(filepath.Join(tmpDir, files[1]))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := json.Unmarshal(data, &config); err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, "2017-07-14T02:40:00Z", config["created"])
+		assert.NotContains(t, config, "container")
+		assert.NotContains(t, config, "container_config")
+		assert.NotContains(t, config, "docker_version")
+		assert.Equal(t, map[string]interface{}{"Cmd": []interface{}{"app"}}, config["config"])
+
+		history := config["history"].([]interface{})
+		assert.Equal(t, "1970-01-01T00:01:40Z", history[0].(map[string]interface{})["created"])
+		assert.Equal(t, "2017-07-14T02:40:00Z", history[1].(map[string]interface{})["created"])
+
+		layer, err := os.Open(filepath.Join(tmpDir, "normalized-1.tar"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		hdr, err := tar.NewReader(layer).Next()
+		layer.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.True(t, hdr.ModTime.Equal(epoch))
+		assert.Equal(t, "", hdr.Uname)
+	}
+
+	// the builds at different times give the same image
+	assert.Equal(t, ids[0], ids[1])
+}
+
+func TestCopy_ReproducibleTarStream(t *testing.T) {
+	tmpDir := makeTmpDir(t, map[string]string{
+		"b.txt": "b",
+		"a.txt": "a",
+	})
+	defer os.RemoveAll(tmpDir)
+
+	u, err := makeUpload(tmpDir, "/app/", "COPY", []string{"b.txt", "a.txt"}, []string{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	epoch := time.Unix(1500000000, 0)
+	u.epoch = &epoch
+	sort.Stable(uploadFilesByDest(u.files))
+	u.startTar()
+
+	data, err := ioutil.ReadAll(u.tar)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	names := []string{}
+	tr := tar.NewReader(bytes.NewReader(data))
+	for {
+		hdr, err := tr.Next()
+		if err != nil {
+			break
+		}
+		names = append(names, hdr.Name)
+		assert.True(t, hdr.ModTime.Equal(epoch), "mtime of %s", hdr.Name)
+		assert.Equal(t, 0, hdr.Uid)
+		assert.Equal(t, 0, hdr.Gid)
+	}
+	assert.Equal(t, []string{"app/a.txt", "app/b.txt"}, names)
+}
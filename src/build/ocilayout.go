@@ -0,0 +1,265 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Formats of the image written by `rocker build --output`
+const (
+	OutputFormatDocker = "docker"
+	OutputFormatOCI    = "oci"
+)
+
+const (
+	ociManifestMediaType = "application/vnd.oci.image.manifest.v1+json"
+	ociConfigMediaType   = "application/vnd.oci.image.config.v1+json"
+	ociLayerMediaType    = "application/vnd.oci.image.layer.v1.tar"
+	ociRefNameAnnotation = "org.opencontainers.image.ref.name"
+)
+
+// dockerSaveManifest is an entry of manifest.json in the `docker save` archive
+type dockerSaveManifest struct {
+	Config   string
+	RepoTags []string
+	Layers   []string
+}
+
+type ociDescriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Size        int64             `json:"size"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+type ociManifest struct {
+	SchemaVersion int               `json:"schemaVersion"`
+	MediaType     string            `json:"mediaType,omitempty"`
+	Config        ociDescriptor     `json:"config"`
+	Layers        []ociDescriptor   `json:"layers"`
+	Annotations   map[string]string `json:"annotations,omitempty"`
+}
+
+type ociIndex struct {
+	SchemaVersion int             `json:"schemaVersion"`
+	Manifests     []ociDescriptor `json:"manifests"`
+}
+
+// ConvertToOCILayout reads the archive made by `docker save` and writes
+// the same images to out as a tar archive of an OCI image layout, with
+// the annotations in the manifests of the images.
+// Manifest.json has no fixed place in the archive, so it is unpacked
+// to a temporary directory first
+func ConvertToOCILayout(in io.Reader, out io.Writer, annotations map[string]string) error {
+	dir, err := ioutil.TempDir("", "rocker-oci-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	if err := untarFiles(in, dir); err != nil {
+		return fmt.Errorf("Failed to read the image archive, error: %s", err)
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, "manifest.json"))
+	if err != nil {
+		return fmt.Errorf("The image archive has no manifest.json, the docker daemon is too old to save OCI layouts")
+	}
+
+	manifests := []dockerSaveManifest{}
+	if err := json.Unmarshal(data, &manifests); err != nil {
+		return fmt.Errorf("Failed to parse manifest.json of the image archive, error: %s", err)
+	}
+
+	tw := tar.NewWriter(out)
+
+	// blobs are shared by images, write each one only once
+	written := map[string]bool{}
+
+	writeBlob := func(mediaType, file string) (d ociDescriptor, err error) {
+		if d, err = fileDescriptor(mediaType, filepath.Join(dir, file)); err != nil {
+			return d, err
+		}
+		if written[d.Digest] {
+			return d, nil
+		}
+		written[d.Digest] = true
+		return d, tarFile(tw, blobPath(d.Digest), filepath.Join(dir, file))
+	}
+
+	index := ociIndex{SchemaVersion: 2, Manifests: []ociDescriptor{}}
+
+	for _, m := range manifests {
+		manifest := ociManifest{
+			SchemaVersion: 2,
+			MediaType:     ociManifestMediaType,
+			Layers:        []ociDescriptor{},
+			Annotations:   annotations,
+		}
+
+		if manifest.Config, err = writeBlob(ociConfigMediaType, m.Config); err != nil {
+			return err
+		}
+		for _, layer := range m.Layers {
+			d, err := writeBlob(ociLayerMediaType, layer)
+			if err != nil {
+				return err
+			}
+			manifest.Layers = append(manifest.Layers, d)
+		}
+
+		data, err := json.Marshal(manifest)
+		if err != nil {
+			return err
+		}
+		d := bytesDescriptor(ociManifestMediaType, data)
+		if !written[d.Digest] {
+			written[d.Digest] = true
+			if err := tarBytes(tw, blobPath(d.Digest), data); err != nil {
+				return err
+			}
+		}
+
+		if len(m.RepoTags) == 0 {
+			index.Manifests = append(index.Manifests, d)
+			continue
+		}
+		for _, name := range m.RepoTags {
+			tagged := d
+			tagged.Annotations = map[string]string{ociRefNameAnnotation: name}
+			index.Manifests = append(index.Manifests, tagged)
+		}
+	}
+
+	if data, err = json.Marshal(index); err != nil {
+		return err
+	}
+	if err := tarBytes(tw, "index.json", data); err != nil {
+		return err
+	}
+	if err := tarBytes(tw, "oci-layout", []byte(`{"imageLayoutVersion":"1.0.0"}`)); err != nil {
+		return err
+	}
+
+	return tw.Close()
+}
+
+// untarFiles unpacks the regular files of the archive to dir
+func untarFiles(in io.Reader, dir string) error {
+	tr := tar.NewReader(in)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if hdr.Typeflag != tar.TypeReg && hdr.Typeflag != tar.TypeRegA {
+			continue
+		}
+
+		name := filepath.Clean(hdr.Name)
+		if filepath.IsAbs(name) || strings.HasPrefix(name, "..") {
+			return fmt.Errorf("Unexpected file %s in the archive", hdr.Name)
+		}
+
+		file := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+			return err
+		}
+		f, err := os.Create(file)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(f, tr)
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func fileDescriptor(mediaType, file string) (d ociDescriptor, err error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return d, err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	size, err := io.Copy(h, f)
+	if err != nil {
+		return d, err
+	}
+
+	return ociDescriptor{
+		MediaType: mediaType,
+		Digest:    "sha256:" + hex.EncodeToString(h.Sum(nil)),
+		Size:      size,
+	}, nil
+}
+
+func bytesDescriptor(mediaType string, data []byte) ociDescriptor {
+	sum := sha256.Sum256(data)
+	return ociDescriptor{
+		MediaType: mediaType,
+		Digest:    "sha256:" + hex.EncodeToString(sum[:]),
+		Size:      int64(len(data)),
+	}
+}
+
+func blobPath(digest string) string {
+	return "blobs/" + strings.Replace(digest, ":", "/", 1)
+}
+
+func tarFile(tw *tar.Writer, name, file string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0444, Size: info.Size()}); err != nil {
+		return err
+	}
+	_, err = io.Copy(tw, f)
+	return err
+}
+
+func tarBytes(tw *tar.Writer, name string, data []byte) error {
+	if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0444, Size: int64(len(data))}); err != nil {
+		return err
+	}
+	_, err := tw.Write(data)
+	return err
+}
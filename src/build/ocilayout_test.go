@@ -0,0 +1,101 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConvertToOCILayout(t *testing.T) {
+	var in, out bytes.Buffer
+
+	tw := tar.NewWriter(&in)
+	for _, f := range []struct{ name, content string }{
+		{"abc/layer.tar", "layer1"},
+		{"def/layer.tar", "layer2"},
+		{"123.json", `{"os":"linux"}`},
+		{"manifest.json", `[{"Config":"123.json","RepoTags":["app:1.0","app:latest"],"Layers":["abc/layer.tar","def/layer.tar"]}]`},
+	} {
+		if err := tw.WriteHeader(&tar.Header{Name: f.name, Mode: 0644, Size: int64(len(f.content))}); err != nil {
+			t.Fatal(err)
+		}
+		tw.Write([]byte(f.content))
+	}
+	tw.Close()
+
+	if err := ConvertToOCILayout(&in, &out, map[string]string{"org.opencontainers.image.version": "1.0"}); err != nil {
+		t.Fatal(err)
+	}
+
+	files := map[string]string{}
+	tr := tar.NewReader(&out)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := ioutil.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[hdr.Name] = string(data)
+	}
+
+	assert.Equal(t, `{"imageLayoutVersion":"1.0.0"}`, files["oci-layout"])
+
+	index := ociIndex{}
+	if err := json.Unmarshal([]byte(files["index.json"]), &index); err != nil {
+		t.Fatal(err)
+	}
+	assert.Len(t, index.Manifests, 2)
+	assert.Equal(t, "app:1.0", index.Manifests[0].Annotations[ociRefNameAnnotation])
+	assert.Equal(t, "app:latest", index.Manifests[1].Annotations[ociRefNameAnnotation])
+	assert.Equal(t, index.Manifests[0].Digest, index.Manifests[1].Digest)
+
+	manifest := ociManifest{}
+	if err := json.Unmarshal([]byte(files[blobPath(index.Manifests[0].Digest)]), &manifest); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, `{"os":"linux"}`, files[blobPath(manifest.Config.Digest)])
+	assert.Len(t, manifest.Layers, 2)
+	assert.Equal(t, "layer1", files[blobPath(manifest.Layers[0].Digest)])
+	assert.Equal(t, "layer2", files[blobPath(manifest.Layers[1].Digest)])
+	assert.Equal(t, int64(6), manifest.Layers[1].Size)
+
+	// manifest, config, two layers, index.json and oci-layout
+	assert.Len(t, files, 6)
+}
+
+func TestConvertToOCILayout_NoManifest(t *testing.T) {
+	var in, out bytes.Buffer
+
+	tw := tar.NewWriter(&in)
+	tw.Close()
+
+	assert.EqualError(t, ConvertToOCILayout(&in, &out, nil),
+		"The image archive has no manifest.json, the docker daemon is too old to save OCI layouts")
+}
@@ -0,0 +1,108 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/grammarly/rocker/src/imagename"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// offlineReport statically walks the plan and lists everything an offline build
+// would need to get from the network: FROM and COPY --from images that are not
+// available locally and ADD urls that were never downloaded before
+func (b *Build) offlineReport(ctx context.Context, plan Plan) (missing []string) {
+	// Images that are produced by the Rockerfile itself are not expected to exist yet
+	produced := map[string]bool{}
+	checked := map[string]bool{}
+
+	checkImage := func(instruction, name string) {
+		if name == NoBaseImageSpecifier || produced[strings.ToLower(name)] {
+			return
+		}
+
+		name = imagename.NewFromString(name).String()
+		if produced[name] || checked[name] {
+			return
+		}
+		checked[name] = true
+
+		// FROM does not need the image as long as the steps are cached
+		if instruction == "FROM" && b.canDeferFrom() && b.fromImages.get(name) != nil {
+			return
+		}
+
+		if _, err := b.lookupImage(ctx, name); err != nil {
+			missing = append(missing, fmt.Sprintf("%s %s: %s", instruction, name, err))
+		}
+	}
+
+	for _, command := range plan {
+		switch c := command.(type) {
+		case *CommandTag:
+			if len(c.cfg.args) == 1 {
+				produced[imagename.NewFromString(c.cfg.args[0]).String()] = true
+			}
+		case *CommandFrom:
+			name, stage, err := fromArgs(c.cfg.args)
+			if stage != "" {
+				produced[stage] = true
+			}
+			if err == nil {
+				checkImage("FROM", name)
+			}
+		case *CommandCopy:
+			if from := c.cfg.flags["from"]; from != "" {
+				checkImage("COPY --from", from)
+			}
+		case *CommandAdd:
+			for _, arg := range c.cfg.args {
+				if !isURL(arg) || checked[arg] {
+					continue
+				}
+				checked[arg] = true
+
+				if _, err := b.urlFetcher.GetInfo(arg); err != nil {
+					missing = append(missing, fmt.Sprintf("ADD %s: not in the download cache", arg))
+				}
+			}
+		}
+	}
+
+	return missing
+}
+
+// checkOffline makes the pre-flight check of an offline build and fails
+// before running anything if some of the dependencies are missing
+func (b *Build) checkOffline(ctx context.Context, plan Plan) error {
+	missing := b.offlineReport(ctx, plan)
+	if len(missing) == 0 {
+		log.Infof("| Offline mode, all images and downloads are available locally")
+		return nil
+	}
+
+	for _, m := range missing {
+		log.Errorf("| Missing %s", m)
+	}
+
+	return fmt.Errorf("Cannot build in offline mode, %d dependencies are missing:\n  %s",
+		len(missing), strings.Join(missing, "\n  "))
+}
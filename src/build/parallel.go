@@ -0,0 +1,371 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/grammarly/rocker/src/imagename"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// planStage is a FROM section of the plan
+type planStage struct {
+	n          int // the number of the section, from 1
+	name       string
+	start, end int // the commands of the section are plan[start:end]
+
+	// deps are the indexes of the earlier sections this one needs the results of
+	deps []int
+
+	uses     []string // stage names and images of FROM and COPY --from
+	produces []string // images of TAG and PUSH
+	exports  bool     // EXPORT, which continues the exports of the previous one
+	imports  bool
+	mounts   bool
+	context  bool
+}
+
+// label is how the log lines of the section are prefixed
+func (s *planStage) label() string {
+	if s.name != "" {
+		return s.name
+	}
+	return fmt.Sprintf("stage %d", s.n)
+}
+
+// splitStages splits the plan to FROM sections and finds the ones each section
+// depends on: a section waits for the stages and the images it uses in FROM and
+// COPY --from, for the previous EXPORT if it has EXPORT or IMPORT, for the previous
+// MOUNT if it mounts too, since the volume containers are shared, and for CONTEXT.
+// It returns nil if the plan has less than two sections or the sections cannot be
+// told apart, so the plan runs sequentially
+func splitStages(plan Plan) []*planStage {
+	if len(plan) == 0 {
+		return nil
+	}
+	if _, ok := plan[0].(*CommandFrom); !ok {
+		return nil
+	}
+
+	stages := []*planStage{}
+	names := map[string]bool{}
+
+	for k, command := range plan {
+		if from, ok := command.(*CommandFrom); ok {
+			image, name, err := fromArgs(from.cfg.args)
+			if err != nil || (name != "" && names[name]) {
+				return nil
+			}
+			names[name] = true
+
+			if len(stages) > 0 {
+				stages[len(stages)-1].end = k
+			}
+			stages = append(stages, &planStage{
+				n:     len(stages) + 1,
+				name:  name,
+				start: k,
+				uses:  []string{stageRef(image)},
+			})
+			continue
+		}
+
+		s := stages[len(stages)-1]
+
+		switch c := command.(type) {
+		case *CommandCopy:
+			if from := c.cfg.flags["from"]; from != "" {
+				s.uses = append(s.uses, stageRef(from))
+			}
+		case *CommandTag:
+			if len(c.cfg.args) > 0 {
+				s.produces = append(s.produces, stageRef(c.cfg.args[0]))
+			}
+		case *CommandPush:
+			if len(c.cfg.args) > 0 {
+				s.produces = append(s.produces, stageRef(c.cfg.args[0]))
+			}
+		case *CommandExport:
+			s.exports = true
+		case *CommandImport:
+			s.imports = true
+		case *CommandMount:
+			s.mounts = true
+		case *CommandContext:
+			s.context = true
+		}
+	}
+
+	if len(stages) < 2 {
+		return nil
+	}
+	stages[len(stages)-1].end = len(plan)
+
+	for j, s := range stages {
+		for i, prev := range stages[:j] {
+			if s.dependsOn(prev) {
+				s.deps = append(s.deps, i)
+			}
+		}
+	}
+
+	return stages
+}
+
+func (s *planStage) dependsOn(prev *planStage) bool {
+	if prev.context {
+		return true
+	}
+	if prev.exports && (s.exports || s.imports) {
+		return true
+	}
+	if prev.mounts && s.mounts {
+		return true
+	}
+	for _, use := range s.uses {
+		if prev.name != "" && use == prev.name {
+			return true
+		}
+		for _, image := range prev.produces {
+			if use == image {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// stageRef normalizes a stage name or an image name, so they can be compared
+func stageRef(name string) string {
+	if stageNameRegexp.MatchString(strings.ToLower(name)) && !strings.ContainsAny(name, "/:@") {
+		return strings.ToLower(name)
+	}
+	return imagename.NewFromString(name).String()
+}
+
+// canRunParallel tells if the configuration allows the sections of the plan
+// to run in parallel
+func (b *Build) canRunParallel() bool {
+	if !b.cfg.ParallelStages {
+		return false
+	}
+
+	var reason string
+	switch {
+	case b.cfg.Attach:
+		reason = "--attach"
+	case b.cfg.DebugOnError:
+		reason = "--debug-on-error"
+	case b.cfg.CheckpointFile != "" || b.restored != nil:
+		reason = "checkpoints"
+	case b.cfg.StepLogs != nil && b.cfg.StepLogs.Dir != "":
+		reason = "--step-logs"
+	default:
+		return true
+	}
+
+	b.log.Infof("| Run the stages one by one, parallel stages do not work with %s", reason)
+	return false
+}
+
+// runParallel runs every section of the plan as soon as the sections it depends on
+// are done, each on a fork of the build that prefixes its log lines with the name
+// of the section. The results of the forks are joined to the build in the order
+// of the plan, so the build ends up the same as if the sections ran one by one
+func (b *Build) runParallel(ctx context.Context, plan Plan, stages []*planStage) error {
+	var (
+		mu    sync.Mutex
+		wg    sync.WaitGroup
+		done  = make([]chan struct{}, len(stages))
+		forks = make([]*Build, len(stages))
+		errs  = make([]error, len(stages))
+	)
+
+	b.log.Infof("| Run %d stages in parallel where they do not depend on each other", len(stages))
+
+	for i := range stages {
+		done[i] = make(chan struct{})
+	}
+
+	for i, s := range stages {
+		wg.Add(1)
+		go func(i int, s *planStage) {
+			defer wg.Done()
+			defer close(done[i])
+
+			for _, d := range s.deps {
+				<-done[d]
+				if errs[d] != nil {
+					errs[i] = errStageSkipped
+					return
+				}
+			}
+
+			mu.Lock()
+			f := b.fork(plan, s)
+			mu.Unlock()
+
+			err := f.runPlan(ctx, plan[s.start:s.end])
+
+			mu.Lock()
+			b.joinShared(f)
+			forks[i], errs[i] = f, err
+			mu.Unlock()
+		}(i, s)
+	}
+
+	wg.Wait()
+
+	for i, err := range errs {
+		if err != nil && err != errStageSkipped {
+			return err
+		}
+		b.joinResults(forks[i])
+	}
+
+	return nil
+}
+
+var errStageSkipped = fmt.Errorf("skipped, a stage it depends on failed")
+
+// fork makes a build that runs a section of the plan on its own state and logger;
+// the caller holds the lock of the shared results
+func (b *Build) fork(plan Plan, s *planStage) *Build {
+	f := *b
+
+	f.log = prefixedLogger(b.log, s.label())
+	if c, ok := b.client.(interface {
+		withLog(*log.Logger) Client
+	}); ok {
+		f.client = c.withLog(f.log)
+	}
+
+	f.cfg.StepLogs = nil
+	// a section alone cannot be resumed from
+	f.cfg.ResumeFile = ""
+	f.planOffset = s.start
+
+	// The state is what the cleanup of the previous section leaves
+	if s.n > 1 {
+		f.state = NewState(b)
+		f.state.ExportsID = b.state.ExportsID
+	}
+
+	f.position.stage = s.n - 1
+	f.position.step = 0
+	for _, command := range plan[:s.start] {
+		switch command.(type) {
+		case *CommandCommit, *CommandCleanup:
+		default:
+			f.position.step++
+		}
+	}
+
+	f.ProducedSize, f.VirtualSize = 0, 0
+	f.CacheHits, f.CacheMisses = 0, 0
+	f.Steps, f.Pushed = nil, nil
+	f.exports = append([]string{}, b.exports...)
+
+	f.stages = map[string]State{}
+	for name, state := range b.stages {
+		f.stages[name] = state
+	}
+	f.tagged = map[string]string{}
+	for name, id := range b.tagged {
+		f.tagged[name] = id
+	}
+	f.contextDefaults = map[string]string{}
+	for name, dir := range b.contextDefaults {
+		f.contextDefaults[name] = dir
+	}
+	f.allowedBuildArgs = map[string]bool{}
+	for name := range b.allowedBuildArgs {
+		f.allowedBuildArgs[name] = true
+	}
+
+	return &f
+}
+
+// joinShared makes what the fork produced visible to the forks that start
+// after it; the caller holds the lock
+func (b *Build) joinShared(f *Build) {
+	for name, state := range f.stages {
+		b.stages[name] = state
+	}
+	for name, id := range f.tagged {
+		b.tagged[name] = id
+	}
+	for name, dir := range f.contextDefaults {
+		b.contextDefaults[name] = dir
+	}
+	for name := range f.allowedBuildArgs {
+		b.allowedBuildArgs[name] = true
+	}
+
+	// Sections with EXPORT run one after another, so the last one to finish
+	// is the one the following sections continue from
+	if f.prevExportContainerID != b.prevExportContainerID || f.currentExportContainerName != b.currentExportContainerName {
+		b.exports = f.exports
+		b.prevExportContainerID = f.prevExportContainerID
+		b.currentExportContainerName = f.currentExportContainerName
+		b.state.ExportsID = f.state.ExportsID
+	}
+}
+
+// joinResults adds the results of the fork in the order of the plan,
+// the last one also gives the final state of the build
+func (b *Build) joinResults(f *Build) {
+	b.Steps = append(b.Steps, f.Steps...)
+	b.Pushed = append(b.Pushed, f.Pushed...)
+	b.CacheHits += f.CacheHits
+	b.CacheMisses += f.CacheMisses
+
+	b.state = f.state
+	b.stage = f.stage
+	b.ProducedSize = f.ProducedSize
+	b.VirtualSize = f.VirtualSize
+	b.position = f.position
+}
+
+// prefixedLogger returns a logger that writes to the same output as the given
+// one, with the lines prefixed by [label]
+func prefixedLogger(l *log.Logger, label string) *log.Logger {
+	return &log.Logger{
+		Out:       l.Out,
+		Hooks:     l.Hooks,
+		Level:     l.Level,
+		Formatter: &prefixFormatter{Formatter: l.Formatter, prefix: "[" + label + "] "},
+	}
+}
+
+// prefixFormatter prefixes the message of every entry
+type prefixFormatter struct {
+	log.Formatter
+	prefix string
+}
+
+// Format implements logrus.Formatter
+func (f *prefixFormatter) Format(entry *log.Entry) ([]byte, error) {
+	e := *entry
+	e.Message = f.prefix + entry.Message
+	return f.Formatter.Format(&e)
+}
@@ -0,0 +1,96 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/fsouza/go-dockerclient"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestSplitStages(t *testing.T) {
+	p := makePlan(t, `
+FROM golang AS build
+RUN make
+TAG me/app:build
+FROM node AS assets
+RUN npm run build
+EXPORT /dist
+FROM alpine
+COPY --from=build /app /app
+IMPORT /dist
+FROM me/app:build
+RUN make test
+`)
+
+	stages := splitStages(p)
+	assert.Len(t, stages, 4)
+
+	assert.Equal(t, "build", stages[0].label())
+	assert.Equal(t, "stage 3", stages[2].label())
+
+	assert.Empty(t, stages[0].deps)
+	assert.Empty(t, stages[1].deps)
+	assert.Equal(t, []int{0, 1}, stages[2].deps)
+	assert.Equal(t, []int{0}, stages[3].deps)
+
+	// the sections cover the whole plan
+	assert.Equal(t, 0, stages[0].start)
+	for i := 1; i < len(stages); i++ {
+		assert.Equal(t, stages[i-1].end, stages[i].start)
+	}
+	assert.Equal(t, len(p), stages[3].end)
+
+	assert.Nil(t, splitStages(makePlan(t, "FROM alpine\nRUN make")))
+}
+
+func TestBuild_RunParallel(t *testing.T) {
+	rockerfile := "FROM scratch AS a\nENV A=1\nFROM scratch AS b\nENV B=2\nFROM a\nENV C=3"
+	b, c := makeBuild(t, rockerfile, Config{ParallelStages: true})
+	plan := makePlan(t, rockerfile)
+
+	out := &bytes.Buffer{}
+	b.log = &log.Logger{Out: out, Formatter: &log.TextFormatter{DisableColors: true}, Level: log.InfoLevel}
+
+	img := &docker.Image{ID: "123"}
+
+	c.On("CreateContainer", mock.AnythingOfType("State")).Return("456", nil)
+	c.On("CommitContainer", mock.AnythingOfType("State")).Return(img, nil)
+	c.On("RemoveContainer", "456").Return(nil)
+	c.On("InspectImage", "123").Return(img, nil).Once()
+
+	if err := b.Run(plan); err != nil {
+		t.Fatal(err)
+	}
+
+	c.AssertExpectations(t)
+
+	// the steps are in the order of the Rockerfile, whichever stage finished first
+	assert.Len(t, b.Steps, 3)
+	assert.Contains(t, b.Steps[0].Step, "A=1")
+	assert.Contains(t, b.Steps[1].Step, "B=2")
+	assert.Equal(t, "123", b.GetImageID())
+
+	assert.True(t, strings.Contains(out.String(), "[a] "), out.String())
+	assert.True(t, strings.Contains(out.String(), "[b] "), out.String())
+	assert.True(t, strings.Contains(out.String(), "[stage 3] "), out.String())
+}
@@ -0,0 +1,117 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"strings"
+
+	"github.com/grammarly/rocker/src/parser"
+)
+
+// ParsedRockerfile is the Rockerfile as `rocker parse` prints it, for the tools
+// that generate or analyze Rockerfiles
+type ParsedRockerfile struct {
+	Name      string           `json:"name"`
+	Variables []ParsedVariable `json:"variables"`
+	Commands  []ParsedCommand  `json:"commands"`
+}
+
+// ParsedCommand is an instruction of the Rockerfile. The lines are the ones of
+// the Rockerfile after the template is rendered
+type ParsedCommand struct {
+	Name      string            `json:"name"`
+	Args      []string          `json:"args"`
+	Flags     map[string]string `json:"flags"`
+	JSON      bool              `json:"json"`
+	Original  string            `json:"original"`
+	StartLine int               `json:"start_line"`
+	EndLine   int               `json:"end_line"`
+
+	// Trigger is the instruction of ONBUILD
+	Trigger *ParsedCommand `json:"trigger,omitempty"`
+}
+
+// ParsedVariable is a template variable or an ARG the Rockerfile references,
+// the same as `rocker vars` lists
+type ParsedVariable struct {
+	Name     string   `json:"name"`
+	Kind     string   `json:"kind"`
+	Default  *string  `json:"default"`
+	Required bool     `json:"required"`
+	Used     []string `json:"used"`
+}
+
+// Parsed returns the instructions of the Rockerfile and the variables its source references
+func (r *Rockerfile) Parsed() (*ParsedRockerfile, error) {
+	vars, err := RockerfileVariables(r.Name, r.Source, r.Funs)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &ParsedRockerfile{
+		Name:      r.Name,
+		Variables: []ParsedVariable{},
+		Commands:  []ParsedCommand{},
+	}
+
+	for _, v := range vars {
+		pv := ParsedVariable{
+			Name:     v.Name,
+			Kind:     v.Kind,
+			Required: v.Required,
+			Used:     v.Used,
+		}
+		if v.HasDefault {
+			def := v.Default
+			pv.Default = &def
+		}
+		if pv.Used == nil {
+			pv.Used = []string{}
+		}
+		p.Variables = append(p.Variables, pv)
+	}
+
+	for _, node := range r.rootNode.Children {
+		p.Commands = append(p.Commands, parsedCommand(node))
+	}
+
+	return p, nil
+}
+
+func parsedCommand(node *parser.Node) ParsedCommand {
+	cfg := parseCommand(node, false)
+
+	c := ParsedCommand{
+		Name:      strings.ToUpper(cfg.name),
+		Args:      cfg.args,
+		Flags:     cfg.flags,
+		JSON:      cfg.attrs["json"],
+		Original:  cfg.original,
+		StartLine: node.StartLine,
+		EndLine:   node.EndLine,
+	}
+
+	// ONBUILD keeps its instruction as a child node instead of the args
+	if cfg.name == "onbuild" && node.Next != nil && len(node.Next.Children) > 0 {
+		trigger := parsedCommand(node.Next.Children[0])
+		trigger.StartLine, trigger.EndLine = c.StartLine, c.EndLine
+		c.Trigger = &trigger
+		c.Args = []string{}
+	}
+
+	return c
+}
@@ -0,0 +1,67 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/grammarly/rocker/src/template"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRockerfile_Parsed(t *testing.T) {
+	src := `FROM {{ or .BaseImage "ubuntu" }}
+ARG VERSION
+RUN --no-cache apt-get update && \
+  apt-get install -y curl
+ONBUILD COPY --chown=app . /src
+CMD ["app"]`
+
+	r, err := NewRockerfile("Rockerfile", strings.NewReader(src), template.Vars{}, template.Funs{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := r.Parsed()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Len(t, p.Variables, 2)
+	assert.Equal(t, "BaseImage", p.Variables[0].Name)
+	assert.Equal(t, "ubuntu", *p.Variables[0].Default)
+	assert.Equal(t, "VERSION", p.Variables[1].Name)
+	assert.Nil(t, p.Variables[1].Default)
+
+	assert.Len(t, p.Commands, 5)
+	assert.Equal(t, []string{"ubuntu"}, p.Commands[0].Args)
+
+	run := p.Commands[2]
+	assert.Equal(t, "RUN", run.Name)
+	assert.Equal(t, map[string]string{"no-cache": ""}, run.Flags)
+	assert.Equal(t, 3, run.StartLine)
+	assert.Equal(t, 4, run.EndLine)
+
+	onbuild := p.Commands[3]
+	assert.Equal(t, "COPY", onbuild.Trigger.Name)
+	assert.Equal(t, map[string]string{"chown": "app"}, onbuild.Trigger.Flags)
+
+	assert.True(t, p.Commands[4].JSON)
+	assert.Equal(t, []string{"app"}, p.Commands[4].Args)
+}
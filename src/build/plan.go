@@ -16,7 +16,11 @@
 
 package build
 
-import "strings"
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
 
 // Plan is the list of commands to be executed sequentially by a build process
 type Plan []Command
@@ -39,13 +43,27 @@ func NewPlan(commands []ConfigCommand, finalCleanup bool) (plan Plan, err error)
 		})
 	}
 
-	alwaysCommitBefore := "run attach add copy tag push export import"
+	alwaysCommitBefore := "run attach add copy tag push export import flatten remove squash normalize publish"
 	alwaysCommitAfter := "run attach add copy export import"
-	neverCommitAfter := "from maintainer tag push"
+	neverCommitAfter := "from maintainer tag push flatten remove squash normalize context publish helm_package"
 
 	for i := 0; i < len(commands); i++ {
 		cfg := commands[i]
 
+		// NOCACHE is the same as --no-cache of the command that follows
+		if cfg.name == "nocache" {
+			if i == len(commands)-1 {
+				return nil, fmt.Errorf("NOCACHE should be followed by one of %s", strings.ToUpper(noCacheCommands))
+			}
+			commands[i+1].flags["no-cache"] = ""
+			continue
+		}
+
+		if _, ok := cfg.flags["no-cache"]; ok && !strings.Contains(noCacheCommands, cfg.name) {
+			return nil, fmt.Errorf("%s cannot be run without the cache, NOCACHE and --no-cache work with %s only",
+				strings.ToUpper(cfg.name), strings.ToUpper(noCacheCommands))
+		}
+
 		cmd := NewCommand(cfg)
 
 		// We want to reset the collected state between FROM instructions
@@ -90,3 +108,109 @@ func NewPlan(commands []ConfigCommand, finalCleanup bool) (plan Plan, err error)
 
 	return plan, err
 }
+
+// InsertFlatten adds a FLATTEN step to the list of commands at the point
+// described by spec, which is either a number of the Rockerfile instruction
+// ("5") or the number of a FROM section ("stage:2"); for a section FLATTEN goes
+// before its trailing TAG and PUSH instructions so they get the flat image
+func InsertFlatten(commands []ConfigCommand, spec string) ([]ConfigCommand, error) {
+	var (
+		pos   int
+		stage = strings.HasPrefix(spec, "stage:")
+	)
+
+	n, err := strconv.Atoi(strings.TrimPrefix(spec, "stage:"))
+	if err != nil || n < 1 {
+		return nil, fmt.Errorf("Invalid flatten point %q, expected step number or stage:<number>", spec)
+	}
+
+	if !stage {
+		if n > len(commands) {
+			return nil, fmt.Errorf("Cannot flatten after step %d, there are only %d steps", n, len(commands))
+		}
+		pos = n
+	} else {
+		from := 0
+		pos = -1
+		for i, cfg := range commands {
+			if cfg.name == "from" {
+				from++
+				if from == n+1 {
+					pos = i
+					break
+				}
+			}
+		}
+		if from < n {
+			return nil, fmt.Errorf("Cannot flatten after stage %d, there are only %d stages", n, from)
+		}
+		if pos == -1 {
+			pos = len(commands)
+		}
+		for pos > 0 && (commands[pos-1].name == "tag" || commands[pos-1].name == "push") {
+			pos--
+		}
+	}
+
+	flatten := ConfigCommand{
+		name:     "flatten",
+		args:     []string{},
+		original: "FLATTEN",
+	}
+
+	result := append([]ConfigCommand{}, commands[:pos]...)
+	result = append(result, flatten)
+	result = append(result, commands[pos:]...)
+
+	return result, nil
+}
+
+// InsertSquash adds SQUASH for --squash to the end of every FROM section that
+// tags or pushes its image, and of the last one, before their trailing TAG and
+// PUSH instructions so they get the squashed image
+func InsertSquash(commands []ConfigCommand) []ConfigCommand {
+	return insertBeforeTags(commands, ConfigCommand{name: "squash", original: "SQUASH"})
+}
+
+// InsertNormalize adds the step of --reproducible, which normalizes the image, to
+// the same places as InsertSquash; it goes after SQUASH, so the squashed layer is
+// normalized too
+func InsertNormalize(commands []ConfigCommand) []ConfigCommand {
+	return insertBeforeTags(commands, ConfigCommand{name: "normalize", original: "NORMALIZE"})
+}
+
+// insertBeforeTags adds the command to the end of every FROM section that tags or
+// pushes its image, and of the last one, before the trailing TAG and PUSH
+func insertBeforeTags(commands []ConfigCommand, command ConfigCommand) []ConfigCommand {
+	var (
+		result = []ConfigCommand{}
+		start  = 0
+	)
+
+	insert := func(section []ConfigCommand, last bool) {
+		pos := len(section)
+		for pos > 0 && (section[pos-1].name == "tag" || section[pos-1].name == "push") {
+			pos--
+		}
+		if pos == len(section) && !last {
+			result = append(result, section...)
+			return
+		}
+		c := command
+		c.args = []string{}
+		c.flags = map[string]string{}
+		result = append(result, section[:pos]...)
+		result = append(result, c)
+		result = append(result, section[pos:]...)
+	}
+
+	for i, cfg := range commands {
+		if cfg.name == "from" && i > 0 {
+			insert(commands[start:i], false)
+			start = i
+		}
+	}
+	insert(commands[start:], true)
+
+	return result
+}
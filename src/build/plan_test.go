@@ -332,6 +332,115 @@ FROM alpine
 
 // internal helpers
 
+func TestPlan_FlattenAfterStep(t *testing.T) {
+	b, _ := makeBuild(t, `
+FROM ubuntu
+RUN apt-get update
+ENV foo=bar
+RUN make
+`, Config{})
+
+	commands, err := InsertFlatten(b.rockerfile.Commands(), "2")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := NewPlan(commands, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []Command{
+		&CommandFrom{},
+		&CommandRun{},
+		&CommandCommit{},
+		&CommandFlatten{},
+		&CommandEnv{},
+		&CommandCommit{},
+		&CommandRun{},
+		&CommandCommit{},
+		&CommandCleanup{},
+	}
+
+	assert.Len(t, p, len(expected))
+	for i, c := range expected {
+		assert.IsType(t, c, p[i])
+	}
+}
+
+func TestPlan_FlattenAfterStage(t *testing.T) {
+	b, _ := makeBuild(t, `
+FROM ubuntu
+RUN apt-get update
+TAG base
+PUSH base
+FROM base
+RUN make
+`, Config{})
+
+	commands, err := InsertFlatten(b.rockerfile.Commands(), "stage:1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	names := []string{}
+	for _, c := range commands {
+		names = append(names, c.name)
+	}
+
+	assert.Equal(t, []string{"from", "run", "flatten", "tag", "push", "from", "run"}, names)
+
+	_, err = InsertFlatten(b.rockerfile.Commands(), "stage:3")
+	assert.Error(t, err)
+
+	_, err = InsertFlatten(b.rockerfile.Commands(), "foo")
+	assert.Error(t, err)
+}
+
+func TestPlan_Squash(t *testing.T) {
+	b, _ := makeBuild(t, `
+FROM golang AS builder
+RUN make
+FROM ubuntu
+RUN apt-get update
+TAG base
+PUSH base
+FROM base
+RUN make
+TAG app
+`, Config{})
+
+	names := []string{}
+	for _, c := range InsertSquash(b.rockerfile.Commands()) {
+		names = append(names, c.name)
+	}
+
+	assert.Equal(t, []string{"from", "run", "from", "run", "squash", "tag", "push", "from", "run", "squash", "tag"}, names)
+
+	p, err := NewPlan(InsertSquash(b.rockerfile.Commands()), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.IsType(t, &CommandCommit{}, p[6])
+	assert.IsType(t, &CommandSquash{}, p[7])
+	assert.IsType(t, &CommandTag{}, p[8])
+}
+
+func TestPlan_Normalize(t *testing.T) {
+	b, _ := makeBuild(t, `
+FROM ubuntu
+RUN make
+TAG app
+`, Config{})
+
+	names := []string{}
+	for _, c := range InsertNormalize(InsertSquash(b.rockerfile.Commands())) {
+		names = append(names, c.name)
+	}
+
+	assert.Equal(t, []string{"from", "run", "squash", "normalize", "tag"}, names)
+}
+
 func makePlan(t *testing.T, rockerfileContent string) Plan {
 	b, _ := makeBuild(t, rockerfileContent, Config{})
 
@@ -0,0 +1,116 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"encoding/json"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/fsouza/go-dockerclient"
+)
+
+// NewPodmanClient makes the client of the docker API of Podman: the commits pass
+// the image config as changes, since Podman ignores the config in the body of the
+// request. The docker backend does the same when the daemon tells it is Podman
+func NewPodmanClient(options DockerClientOptions) *DockerClient {
+	c := NewDockerClient(options)
+	c.podman = true
+	return c
+}
+
+// rootless tells that the daemon runs as a user, the files uploaded to it
+// keep the ids of the users of the host only if they are mapped to its user
+// namespace, so they are owned by root, as COPY of docker does
+func (c *DockerClient) rootless() bool {
+	return c.isRootless
+}
+
+// isRootless tells if the client talks to a rootless daemon
+func isRootless(client Client) bool {
+	r, ok := client.(interface {
+		rootless() bool
+	})
+	return ok && r.rootless()
+}
+
+// podmanChanges returns the image config as the Dockerfile instructions the
+// commit applies to the image
+func podmanChanges(config docker.Config) []string {
+	changes := []string{}
+
+	for _, env := range config.Env {
+		parts := strings.SplitN(env, "=", 2)
+		if len(parts) == 2 {
+			changes = append(changes, "ENV "+parts[0]+"="+strconv.Quote(parts[1]))
+		}
+	}
+
+	labels := []string{}
+	for name := range config.Labels {
+		labels = append(labels, name)
+	}
+	sort.Strings(labels)
+	for _, name := range labels {
+		changes = append(changes, "LABEL "+strconv.Quote(name)+"="+strconv.Quote(config.Labels[name]))
+	}
+
+	ports := []string{}
+	for port := range config.ExposedPorts {
+		ports = append(ports, string(port))
+	}
+	sort.Strings(ports)
+	for _, port := range ports {
+		changes = append(changes, "EXPOSE "+port)
+	}
+
+	volumes := []string{}
+	for volume := range config.Volumes {
+		volumes = append(volumes, volume)
+	}
+	sort.Strings(volumes)
+	for _, volume := range volumes {
+		changes = append(changes, "VOLUME "+jsonArray([]string{volume}))
+	}
+
+	if config.WorkingDir != "" {
+		changes = append(changes, "WORKDIR "+config.WorkingDir)
+	}
+	if config.User != "" {
+		changes = append(changes, "USER "+config.User)
+	}
+	if config.StopSignal != "" {
+		changes = append(changes, "STOPSIGNAL "+config.StopSignal)
+	}
+	for _, trigger := range config.OnBuild {
+		changes = append(changes, "ONBUILD "+trigger)
+	}
+	if len(config.Entrypoint) > 0 {
+		changes = append(changes, "ENTRYPOINT "+jsonArray(config.Entrypoint))
+	}
+	if len(config.Cmd) > 0 {
+		changes = append(changes, "CMD "+jsonArray(config.Cmd))
+	}
+
+	return changes
+}
+
+func jsonArray(args []string) string {
+	data, _ := json.Marshal(args)
+	return string(data)
+}
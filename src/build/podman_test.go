@@ -0,0 +1,148 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"archive/tar"
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/grammarly/rocker/src/dockerclient"
+
+	"github.com/fsouza/go-dockerclient"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestNewClient_Podman(t *testing.T) {
+	c, err := NewClient(BackendPodman, DockerClientOptions{Host: "unix:///run/podman/podman.sock"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, c.(*DockerClient).podman)
+	assert.False(t, isRootless(c))
+
+	// the docker backend finds out by the version of the daemon
+	c, err = NewClient(BackendDocker, DockerClientOptions{
+		Host:         "unix:///run/user/1000/podman/podman.sock",
+		Capabilities: &dockerclient.DaemonCapabilities{Podman: true},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, c.(*DockerClient).podman)
+	assert.True(t, isRootless(c))
+}
+
+func TestPodmanChanges(t *testing.T) {
+	config := docker.Config{
+		Env:          []string{"PATH=/usr/bin:/bin", `GREETING=say "hi"`},
+		Labels:       map[string]string{"version": "1.0", "maintainer": "me"},
+		ExposedPorts: map[docker.Port]struct{}{"8080/tcp": {}, "53/udp": {}},
+		Volumes:      map[string]struct{}{"/data": {}},
+		WorkingDir:   "/app",
+		User:         "app",
+		StopSignal:   "SIGTERM",
+		OnBuild:      []string{"RUN make"},
+		Entrypoint:   []string{"/entrypoint.sh"},
+		Cmd:          []string{"serve", "--port", "8080"},
+	}
+
+	assert.Equal(t, []string{
+		`ENV PATH="/usr/bin:/bin"`,
+		`ENV GREETING="say \"hi\""`,
+		`LABEL "maintainer"="me"`,
+		`LABEL "version"="1.0"`,
+		`EXPOSE 53/udp`,
+		`EXPOSE 8080/tcp`,
+		`VOLUME ["/data"]`,
+		`WORKDIR /app`,
+		`USER app`,
+		`STOPSIGNAL SIGTERM`,
+		`ONBUILD RUN make`,
+		`ENTRYPOINT ["/entrypoint.sh"]`,
+		`CMD ["serve","--port","8080"]`,
+	}, podmanChanges(config))
+
+	assert.Equal(t, []string{}, podmanChanges(docker.Config{}))
+}
+
+type rootlessMockClient struct {
+	*MockClient
+}
+
+func (c rootlessMockClient) rootless() bool {
+	return true
+}
+
+func TestCommandCopy_RootlessOwner(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "rocker-rootless-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	file := filepath.Join(tmpDir, "tool")
+	if err := ioutil.WriteFile(file, []byte("#!/bin/sh\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Lchown(file, 123456, 123456); err != nil {
+		t.Skipf("Cannot give the file an owner, error: %s", err)
+	}
+
+	b, c := makeBuild(t, "", Config{ContextDir: tmpDir})
+	b.client = rootlessMockClient{c}
+
+	cmd := NewCommand(ConfigCommand{
+		name: "copy",
+		args: []string{"tool", "/usr/local/bin/"},
+	})
+
+	c.On("CreateContainer", mock.AnythingOfType("State")).Return("456", nil).Once()
+	c.On("UploadToContainer", "456", mock.Anything, "/").Return(nil).Run(func(args mock.Arguments) {
+		tr := tar.NewReader(args.Get(1).(io.Reader))
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.Equal(t, 0, hdr.Uid, hdr.Name)
+			assert.Equal(t, 0, hdr.Gid, hdr.Name)
+		}
+	}).Once()
+
+	if _, err := cmd.Execute(context.Background(), b); err != nil {
+		t.Fatal(err)
+	}
+	c.AssertExpectations(t)
+}
+
+func TestIsRootless_XDGRuntimeDir(t *testing.T) {
+	defer os.Setenv("XDG_RUNTIME_DIR", os.Getenv("XDG_RUNTIME_DIR"))
+	os.Setenv("XDG_RUNTIME_DIR", "/tmp/runtime-me")
+
+	assert.True(t, isRootless(NewDockerClient(DockerClientOptions{Host: "unix:///tmp/runtime-me/docker.sock"})))
+	assert.False(t, isRootless(NewDockerClient(DockerClientOptions{Host: "unix:///var/run/docker.sock"})))
+	assert.False(t, isRootless(&MockClient{}))
+}
@@ -0,0 +1,119 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"context"
+	"strings"
+	"sync"
+
+	"github.com/grammarly/rocker/src/imagename"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// prefetcher keeps track of FROM images that are being pulled in the background
+type prefetcher struct {
+	mu      sync.Mutex
+	pending map[string]chan error
+}
+
+// prefetchImages statically extracts FROM and COPY --from references from the plan
+// and starts pulling them in the background, so the network work overlaps with
+// the steps that go before the corresponding FROM
+func (b *Build) prefetchImages(ctx context.Context, plan Plan) {
+	b.prefetch = &prefetcher{
+		pending: map[string]chan error{},
+	}
+
+	// Images that are produced by the Rockerfile itself cannot be prefetched
+	produced := map[string]bool{}
+
+	prefetch := func(name string) {
+		if name == NoBaseImageSpecifier || produced[strings.ToLower(name)] {
+			return
+		}
+
+		img := imagename.NewFromString(name)
+
+		// Fuzzy versions need to be resolved by lookupImage first
+		if !img.IsStrict() && !img.TagIsSha() {
+			return
+		}
+
+		name = img.String()
+		if produced[name] {
+			return
+		}
+		if _, ok := b.prefetch.pending[name]; ok {
+			return
+		}
+
+		errch := make(chan error, 1)
+		b.prefetch.pending[name] = errch
+
+		go func(name string) {
+			errch <- b.client.PrefetchImage(ctx, name)
+		}(name)
+	}
+
+	for _, command := range plan {
+		switch c := command.(type) {
+		case *CommandTag:
+			if len(c.cfg.args) == 1 {
+				produced[imagename.NewFromString(c.cfg.args[0]).String()] = true
+			}
+		case *CommandPush:
+			if len(c.cfg.args) == 1 {
+				produced[imagename.NewFromString(c.cfg.args[0]).String()] = true
+			}
+		case *CommandFrom:
+			name, stage, err := fromArgs(c.cfg.args)
+			if stage != "" {
+				produced[stage] = true
+			}
+			if err == nil {
+				prefetch(name)
+			}
+		case *CommandCopy:
+			if from := c.cfg.flags["from"]; from != "" {
+				prefetch(from)
+			}
+		}
+	}
+}
+
+// waitPrefetch blocks until the background pull of the given image is finished,
+// if there is one; errors are not fatal since lookupImage will try again
+func (b *Build) waitPrefetch(name string) {
+	if b.prefetch == nil {
+		return
+	}
+
+	b.prefetch.mu.Lock()
+	errch, ok := b.prefetch.pending[name]
+	delete(b.prefetch.pending, name)
+	b.prefetch.mu.Unlock()
+
+	if !ok {
+		return
+	}
+
+	if err := <-errch; err != nil {
+		log.Debugf("Prefetch of %s failed, will try again: %s", name, err)
+	}
+}
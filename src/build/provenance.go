@@ -0,0 +1,81 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+
+	"github.com/grammarly/rocker/src/template"
+)
+
+const (
+	// ProvenanceBuildArgPrefix prefixes the labels of the build args
+	ProvenanceBuildArgPrefix = "rocker.build-arg."
+
+	// ProvenanceVarPrefix prefixes the labels of the template variables
+	ProvenanceVarPrefix = "rocker.var."
+)
+
+// ProvenanceLabels returns the labels that record how the image was parameterized:
+// rocker.build-arg.<name> for the build args and rocker.var.<name> for the template
+// variables whose names match one of the allowed patterns, e.g. "VERSION" or "APP_*".
+// Sensitive build args are never recorded. Variables that are not strings are
+// recorded as JSON
+func ProvenanceLabels(allow []string, buildArgs map[string]string, sensitive map[string]bool, vars template.Vars) (map[string]string, error) {
+	labels := map[string]string{}
+
+	for _, pattern := range allow {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("Invalid provenance label pattern %q, error: %s", pattern, err)
+		}
+	}
+
+	allowed := func(name string) bool {
+		for _, pattern := range allow {
+			if match, _ := path.Match(pattern, name); match {
+				return true
+			}
+		}
+		return false
+	}
+
+	for name, value := range buildArgs {
+		if allowed(name) && !sensitive[name] {
+			labels[ProvenanceBuildArgPrefix+name] = value
+		}
+	}
+
+	for name, value := range vars {
+		if !allowed(name) {
+			continue
+		}
+		if s, ok := value.(string); ok {
+			labels[ProvenanceVarPrefix+name] = s
+			continue
+		}
+		// Maps read from YAML cannot be JSON, so they are printed as Go does
+		if data, err := json.Marshal(value); err == nil {
+			labels[ProvenanceVarPrefix+name] = string(data)
+		} else {
+			labels[ProvenanceVarPrefix+name] = fmt.Sprintf("%v", value)
+		}
+	}
+
+	return labels, nil
+}
@@ -0,0 +1,48 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"testing"
+
+	"github.com/grammarly/rocker/src/template"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProvenanceLabels(t *testing.T) {
+	labels, err := ProvenanceLabels(
+		[]string{"VERSION", "APP_*", "TOKEN"},
+		map[string]string{"VERSION": "1.2", "TOKEN": "secret", "HTTP_PROXY": "http://proxy"},
+		map[string]bool{"TOKEN": true},
+		template.Vars{"APP_ENV": "prod", "APP_PORTS": []interface{}{80, 443}, "Other": "x"},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, map[string]string{
+		"rocker.build-arg.VERSION": "1.2",
+		"rocker.var.APP_ENV":       "prod",
+		"rocker.var.APP_PORTS":     "[80,443]",
+	}, labels)
+}
+
+func TestProvenanceLabels_InvalidPattern(t *testing.T) {
+	_, err := ProvenanceLabels([]string{"APP_["}, nil, nil, nil)
+	assert.EqualError(t, err, `Invalid provenance label pattern "APP_[", error: syntax error in pattern`)
+}
@@ -0,0 +1,182 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/grammarly/rocker/src/dockerclient"
+	"github.com/grammarly/rocker/src/imagename"
+
+	"github.com/fsouza/go-dockerclient"
+)
+
+const (
+	minPullBackoff = 5 * time.Second
+	maxPullBackoff = 5 * time.Minute
+)
+
+// pullThrottle spaces out the pulls of a client once a registry said there
+// were too many requests: every pull waits until the backoff is over, the
+// backoff doubles on every refusal and goes down again after successful pulls,
+// so the parallel pulls of a build do not keep hitting the limit
+type pullThrottle struct {
+	mu    sync.Mutex
+	delay time.Duration
+	until time.Time
+
+	// now and sleep are replaced in tests
+	now   func() time.Time
+	sleep func(time.Duration)
+}
+
+func newPullThrottle() *pullThrottle {
+	return &pullThrottle{
+		now:   time.Now,
+		sleep: time.Sleep,
+	}
+}
+
+// wait blocks until the backoff is over
+func (t *pullThrottle) wait() {
+	t.mu.Lock()
+	d := t.until.Sub(t.now())
+	t.mu.Unlock()
+
+	if d > 0 {
+		t.sleep(d)
+	}
+}
+
+// throttled makes the backoff longer and returns it
+func (t *pullThrottle) throttled() time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.delay *= 2
+	if t.delay < minPullBackoff {
+		t.delay = minPullBackoff
+	}
+	if t.delay > maxPullBackoff {
+		t.delay = maxPullBackoff
+	}
+	t.until = t.now().Add(t.delay)
+
+	return t.delay
+}
+
+// succeeded makes the backoff shorter
+func (t *pullThrottle) succeeded() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.delay /= 2; t.delay < minPullBackoff {
+		t.delay = 0
+	}
+}
+
+// isRateLimited tells if the registry refused the pull because of too many requests
+func isRateLimited(err error) bool {
+	if err == nil {
+		return false
+	}
+	msg := strings.ToLower(err.Error())
+	return strings.Contains(msg, "toomanyrequests") ||
+		strings.Contains(msg, "too many requests") ||
+		strings.Contains(msg, "rate limit")
+}
+
+// pullRateLimited runs the pull and waits out the rate limits of the registry:
+// it warns with the quota the registry reports, pulls Docker Hub images from the
+// mirror if there is one, and retries with the backoff of the throttle
+func (c *DockerClient) pullRateLimited(ctx context.Context, image *imagename.ImageName, pull func(*imagename.ImageName) error) (err error) {
+	for n := 0; ; n++ {
+		c.pullThrottle.wait()
+
+		if ctx.Err() != nil {
+			return contextError(ctx, fmt.Sprintf("before pulling %s", image))
+		}
+
+		if err = pull(image); err == nil {
+			c.pullThrottle.succeeded()
+			return nil
+		}
+		if !isRateLimited(err) {
+			return err
+		}
+
+		c.warnRateLimit(image)
+
+		if mirror := hubMirrorImage(image, c.pullMirror); mirror != nil {
+			c.log.Warnf("| Pull %s from the mirror %s", image, c.pullMirror)
+
+			if err = pull(mirror); err == nil {
+				return c.client.TagImage(mirror.String(), docker.TagImageOptions{
+					Repo:  image.NameWithRegistry(),
+					Tag:   image.GetTag(),
+					Force: true,
+				})
+			}
+			if !isRateLimited(err) {
+				return err
+			}
+		}
+
+		delay := c.pullThrottle.throttled()
+
+		if n >= c.pullRetryCount {
+			return fmt.Errorf("Failed to pull %s, the registry is rate limited, error: %s", image, err)
+		}
+
+		c.log.Warnf("| Retry %d/%d after %s", n+1, c.pullRetryCount, delay)
+	}
+}
+
+// warnRateLimit tells how much of the pull quota is left, if the registry reports it
+func (c *DockerClient) warnRateLimit(image *imagename.ImageName) {
+	limit, err := dockerclient.RegistryRateLimit(image, c.auth)
+	if err != nil || !limit.Known() {
+		c.log.Warnf("| Registry %s: too many requests", dockerclient.AuthRegistry(image))
+		return
+	}
+	c.log.Warnf("| Registry %s: too many requests, %s", dockerclient.AuthRegistry(image), limit)
+}
+
+// hubMirrorImage returns the name of the Docker Hub image in the mirror, or nil if
+// there is no mirror or the image is from another registry
+func hubMirrorImage(image *imagename.ImageName, mirror string) *imagename.ImageName {
+	if mirror == "" || image.Storage == imagename.StorageS3 {
+		return nil
+	}
+
+	switch image.Registry {
+	case "", "docker.io", "index.docker.io", "registry-1.docker.io":
+	default:
+		return nil
+	}
+
+	name := image.Name
+	if !strings.Contains(name, "/") {
+		name = "library/" + name
+	}
+
+	return imagename.New(strings.TrimSuffix(mirror, "/")+"/"+name, image.GetTag())
+}
@@ -0,0 +1,105 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/grammarly/rocker/src/imagename"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPullThrottle_Backoff(t *testing.T) {
+	now := time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)
+	slept := []time.Duration{}
+
+	p := newPullThrottle()
+	p.now = func() time.Time { return now }
+	p.sleep = func(d time.Duration) { slept = append(slept, d) }
+
+	p.wait()
+	assert.Empty(t, slept)
+
+	assert.Equal(t, 5*time.Second, p.throttled())
+	assert.Equal(t, 10*time.Second, p.throttled())
+
+	p.wait()
+	assert.Equal(t, []time.Duration{10 * time.Second}, slept)
+
+	for i := 0; i < 10; i++ {
+		p.throttled()
+	}
+	assert.Equal(t, maxPullBackoff, p.delay)
+
+	p.succeeded()
+	assert.Equal(t, maxPullBackoff/2, p.delay)
+
+	p.delay = 8 * time.Second
+	p.succeeded()
+	assert.Equal(t, time.Duration(0), p.delay)
+}
+
+func TestPullThrottle_IsRateLimited(t *testing.T) {
+	assert.True(t, isRateLimited(fmt.Errorf("toomanyrequests: You have reached your pull rate limit")))
+	assert.True(t, isRateLimited(fmt.Errorf("Error response from daemon: 429 Too Many Requests")))
+	assert.False(t, isRateLimited(fmt.Errorf("manifest unknown")))
+	assert.False(t, isRateLimited(nil))
+}
+
+func TestPullThrottle_HubMirrorImage(t *testing.T) {
+	assert.Equal(t, "mirror.gcr.io/library/ubuntu:16.04",
+		hubMirrorImage(imagename.NewFromString("ubuntu:16.04"), "mirror.gcr.io").String())
+	assert.Equal(t, "mirror.local:5000/grammarly/rocker:1.0",
+		hubMirrorImage(imagename.NewFromString("docker.io/grammarly/rocker:1.0"), "mirror.local:5000/").String())
+	assert.Nil(t, hubMirrorImage(imagename.NewFromString("quay.io/app:1"), "mirror.gcr.io"))
+	assert.Nil(t, hubMirrorImage(imagename.NewFromString("ubuntu"), ""))
+}
+
+func TestPullThrottle_Retries(t *testing.T) {
+	log := logrus.New()
+	log.Out = ioutil.Discard
+
+	c := NewDockerClient(DockerClientOptions{Log: log, PullRetryCount: 2})
+	c.pullThrottle.sleep = func(time.Duration) {}
+
+	image := imagename.NewFromString("127.0.0.1:1/app:1")
+
+	calls := 0
+	err := c.pullRateLimited(context.Background(), image, func(*imagename.ImageName) error {
+		calls++
+		if calls < 3 {
+			return fmt.Errorf("toomanyrequests: slow down")
+		}
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 3, calls)
+
+	calls = 0
+	err = c.pullRateLimited(context.Background(), image, func(*imagename.ImageName) error {
+		calls++
+		return fmt.Errorf("toomanyrequests: slow down")
+	})
+	assert.EqualError(t, err, "Failed to pull 127.0.0.1:1/app:1, the registry is rate limited, error: toomanyrequests: slow down")
+	assert.Equal(t, 3, calls)
+}
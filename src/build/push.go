@@ -0,0 +1,197 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-yaml/yaml"
+	"github.com/grammarly/rocker/src/imagename"
+	"github.com/kr/pretty"
+)
+
+// pushResult is the outcome of pushing to a single target
+type pushResult struct {
+	name   string
+	digest string
+	err    error
+}
+
+// pushImages tags the current image with all the names and, if asked to,
+// pushes them concurrently. In the atomic mode a failed push fails the build
+// and the pushes that succeeded are removed from the registries where
+// possible; otherwise the build only fails if all the pushes failed.
+func pushImages(ctx context.Context, b *Build, names []string) error {
+	for _, name := range names {
+		if err := b.client.TagImage(b.state.ImageID, name); err != nil {
+			return err
+		}
+		b.tagged[imagename.NewFromString(name).String()] = b.state.ImageID
+	}
+
+	if !b.cfg.Push {
+		b.log.Infof("| Don't push. Pass --push flag to actually push to the registry")
+
+		for _, name := range names {
+			if err := saveArtifact(b, newArtifact(b, name)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	// The builds of --daemon push every platform under its own tag
+	if b.cfg.Platform.OS != "" {
+		platformNames := make([]string, len(names))
+		for i, name := range names {
+			platformNames[i] = PlatformImageName(name, b.cfg.Platform)
+			if err := b.client.TagImage(b.state.ImageID, platformNames[i]); err != nil {
+				return err
+			}
+		}
+		names = platformNames
+	}
+
+	var (
+		results = make([]pushResult, len(names))
+		wg      sync.WaitGroup
+	)
+
+	for i, name := range names {
+		wg.Add(1)
+		go func(i int, name string) {
+			defer wg.Done()
+			digest, err := b.client.PushImage(ctx, name)
+			results[i] = pushResult{name: name, digest: digest, err: err}
+		}(i, name)
+	}
+	wg.Wait()
+
+	failed := []string{}
+	for _, r := range results {
+		if r.err != nil {
+			failed = append(failed, r.name)
+		}
+	}
+
+	if len(names) > 1 {
+		for _, r := range results {
+			if r.err != nil {
+				b.log.Errorf("| Push %s failed, error: %s", r.name, r.err)
+			} else {
+				b.log.Infof("| Pushed %s %s", r.name, r.digest)
+			}
+		}
+	}
+
+	if len(failed) > 0 && (b.cfg.PushAtomic || len(failed) == len(names)) {
+		if b.cfg.PushAtomic {
+			unpush(b, results)
+		}
+		if len(names) == 1 {
+			return results[0].err
+		}
+		return fmt.Errorf("Failed to push %s", strings.Join(failed, ", "))
+	}
+
+	for _, r := range results {
+		if r.err != nil {
+			continue
+		}
+
+		artifact := newArtifact(b, r.name)
+		artifact.SetDigest(r.digest)
+		b.Pushed = append(b.Pushed, artifact)
+		b.emit(Event{Type: EventPush, ImageID: artifact.ImageID, Artifact: &artifact})
+
+		if err := saveArtifact(b, artifact); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// unpush removes the images that were pushed successfully, so an atomic
+// push leaves nothing behind; registries may not allow deletes, so it
+// only reports the failures
+func unpush(b *Build, results []pushResult) {
+	for _, r := range results {
+		if r.err != nil || r.digest == "" {
+			continue
+		}
+		if err := b.client.UnpushImage(r.name, r.digest); err != nil {
+			b.log.Errorf("| Failed to remove %s@%s from the registry, remove it manually, error: %s", r.name, r.digest, err)
+			continue
+		}
+		b.log.Infof("| Removed %s@%s from the registry", r.name, r.digest)
+	}
+}
+
+func newArtifact(b *Build, name string) imagename.Artifact {
+	image := imagename.NewFromString(name)
+	artifact := imagename.Artifact{
+		Name:      image,
+		Pushed:    b.cfg.Push,
+		Tag:       image.GetTag(),
+		ImageID:   b.state.ImageID,
+		BuildTime: time.Now(),
+		BuildID:   b.cfg.BuildID,
+		Logs:      b.cfg.StepLogs.Locations(),
+	}
+	if b.cfg.Platform.OS != "" {
+		artifact.Platform = b.cfg.Platform.String()
+	}
+	return artifact
+}
+
+// saveArtifact writes the artifact file, if the artifacts path is given
+func saveArtifact(b *Build, artifact imagename.Artifact) error {
+	if b.cfg.ArtifactsPath == "" {
+		return nil
+	}
+
+	if err := os.MkdirAll(b.cfg.ArtifactsPath, 0755); err != nil {
+		return fmt.Errorf("Failed to create directory %s for the artifacts, error: %s", b.cfg.ArtifactsPath, err)
+	}
+
+	filePath := filepath.Join(b.cfg.ArtifactsPath, artifact.GetFileName())
+
+	artifacts := imagename.Artifacts{
+		RockerArtifacts: []imagename.Artifact{artifact},
+	}
+	content, err := yaml.Marshal(artifacts)
+	if err != nil {
+		return err
+	}
+
+	if err := ioutil.WriteFile(filePath, content, 0644); err != nil {
+		return fmt.Errorf("Failed to write artifact file %s, error: %s", filePath, err)
+	}
+
+	b.log.Infof("| Saved artifact file %s", filePath)
+	b.log.Debugf("Artifact properties: %# v", pretty.Formatter(artifact))
+
+	return nil
+}
@@ -0,0 +1,97 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/docker/docker/pkg/jsonmessage"
+	"github.com/docker/docker/pkg/units"
+)
+
+// pushDelta scans the push output stream of the daemon and counts the layers
+// the registry already had against the ones that were uploaded. The daemon
+// checks the blobs in the registry and uploads the missing layers in parallel
+// by itself, so the stream is the only place to learn what was sent
+type pushDelta struct {
+	line     []byte
+	reused   map[string]bool
+	uploaded map[string]int64
+}
+
+func newPushDelta() *pushDelta {
+	return &pushDelta{
+		reused:   map[string]bool{},
+		uploaded: map[string]int64{},
+	}
+}
+
+// Write implements io.Writer
+func (d *pushDelta) Write(p []byte) (int, error) {
+	for _, c := range p {
+		if c == '\n' {
+			d.flush()
+			continue
+		}
+		if len(d.line) < maxDigestLine {
+			d.line = append(d.line, c)
+		}
+	}
+	return len(p), nil
+}
+
+func (d *pushDelta) flush() {
+	defer func() { d.line = d.line[:0] }()
+
+	msg := jsonmessage.JSONMessage{}
+	if err := json.Unmarshal(d.line, &msg); err != nil || msg.ID == "" {
+		return
+	}
+
+	switch {
+	case msg.Status == "Layer already exists", strings.HasPrefix(msg.Status, "Mounted from"):
+		d.reused[msg.ID] = true
+	case msg.Status == "Pushing":
+		if msg.Progress != nil && int64(msg.Progress.Total) > d.uploaded[msg.ID] {
+			d.uploaded[msg.ID] = int64(msg.Progress.Total)
+		}
+	case msg.Status == "Pushed":
+		if _, ok := d.uploaded[msg.ID]; !ok {
+			d.uploaded[msg.ID] = 0
+		}
+	}
+}
+
+// Empty tells if no layers were seen in the stream
+func (d *pushDelta) Empty() bool {
+	d.flush()
+	return len(d.reused) == 0 && len(d.uploaded) == 0
+}
+
+// String returns the summary of the push, e.g. "5 layers reused, 2 uploaded (12.3 MB)"
+func (d *pushDelta) String() string {
+	d.flush()
+
+	var size int64
+	for _, n := range d.uploaded {
+		size += n
+	}
+
+	return fmt.Sprintf("%d layers reused, %d uploaded (%s)", len(d.reused), len(d.uploaded), units.HumanSize(float64(size)))
+}
@@ -0,0 +1,184 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"text/template"
+
+	"github.com/fsouza/go-dockerclient"
+	"github.com/go-yaml/yaml"
+	"github.com/grammarly/rocker/src/imagename"
+)
+
+// PushRoute sends the images that match the pattern to a set of targets
+// instead of the name given to PUSH
+type PushRoute struct {
+	// Match is a glob pattern of the image name, with the tag if it has a colon,
+	// e.g. "app:*" or "acme/*"
+	Match   string       `yaml:"match"`
+	Targets []PushTarget `yaml:"targets"`
+}
+
+// PushTarget is a retag template, e.g. "ghcr.io/acme/{{ .Repository }}:{{ .Tag }}",
+// and optionally the credentials for its registry; $VARS in the credentials
+// are taken from the environment
+type PushTarget struct {
+	Image    string `yaml:"image"`
+	Username string `yaml:"username,omitempty"`
+	Password string `yaml:"password,omitempty"`
+}
+
+// pushTargetData is what the target templates can refer to
+type pushTargetData struct {
+	Name       string
+	Registry   string
+	Repository string
+	Tag        string
+}
+
+// LoadPushRoutes reads the routing rules from a YAML file of the form
+//
+//	routes:
+//	  - match: "app:*"
+//	    targets:
+//	      - image: "123456789012.dkr.ecr.us-east-1.amazonaws.com/app:{{ .Tag }}"
+//	      - image: "ghcr.io/acme/app:{{ .Tag }}"
+//	        username: acme-ci
+//	        password: $GHCR_TOKEN
+func LoadPushRoutes(file string) (routes []PushRoute, err error) {
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	var config struct {
+		Routes []PushRoute `yaml:"routes"`
+	}
+	if err := yaml.Unmarshal(content, &config); err != nil {
+		return nil, fmt.Errorf("Failed to parse push routes %s, error: %s", file, err)
+	}
+
+	for _, route := range config.Routes {
+		if _, err := path.Match(route.Match, ""); err != nil || route.Match == "" {
+			return nil, fmt.Errorf("Invalid push route match %q in %s", route.Match, file)
+		}
+		if len(route.Targets) == 0 {
+			return nil, fmt.Errorf("Push route %q in %s has no targets", route.Match, file)
+		}
+		for _, target := range route.Targets {
+			if _, err := template.New("").Parse(target.Image); err != nil || target.Image == "" {
+				return nil, fmt.Errorf("Invalid push target %q in %s", target.Image, file)
+			}
+		}
+	}
+
+	return config.Routes, nil
+}
+
+// AddPushRoutesAuth adds the credentials of the push targets to the auth
+// configurations, so they are used for the target registries
+func AddPushRoutesAuth(auth *docker.AuthConfigurations, routes []PushRoute) (*docker.AuthConfigurations, error) {
+	if auth == nil {
+		auth = &docker.AuthConfigurations{}
+	}
+	if auth.Configs == nil {
+		auth.Configs = map[string]docker.AuthConfiguration{}
+	}
+
+	given := map[string]string{}
+
+	for _, route := range routes {
+		for _, target := range route.Targets {
+			if target.Username == "" {
+				continue
+			}
+
+			registry := targetRegistry(target.Image)
+			username := os.ExpandEnv(target.Username)
+			if prev, ok := given[registry]; ok && prev != username {
+				return nil, fmt.Errorf("Push targets have different credentials for registry %s", registry)
+			}
+			given[registry] = username
+
+			auth.Configs[registry] = docker.AuthConfiguration{
+				Username:      username,
+				Password:      os.ExpandEnv(target.Password),
+				ServerAddress: registry,
+			}
+		}
+	}
+
+	return auth, nil
+}
+
+// targetRegistry returns the registry of the target template, which is the part
+// before the first slash if it looks like a host, the same way docker tells it
+func targetRegistry(image string) string {
+	parts := strings.SplitN(image, "/", 2)
+	if len(parts) == 2 && !strings.Contains(parts[0], "{{") &&
+		(strings.ContainsAny(parts[0], ".:") || parts[0] == "localhost") {
+		return parts[0]
+	}
+	return "index.docker.io"
+}
+
+// ResolvePushTargets returns the names the image given to PUSH is pushed to:
+// the targets of the first matching route, or the name itself
+func ResolvePushTargets(routes []PushRoute, name string) (names []string, err error) {
+	img := imagename.NewFromString(name)
+
+	for _, route := range routes {
+		subject := img.NameWithRegistry()
+		if strings.Contains(route.Match, ":") {
+			subject += ":" + img.GetTag()
+		}
+
+		if ok, _ := path.Match(route.Match, subject); !ok {
+			continue
+		}
+
+		data := pushTargetData{
+			Name:       img.NameWithRegistry(),
+			Registry:   img.Registry,
+			Repository: img.Name,
+			Tag:        img.GetTag(),
+		}
+
+		for _, target := range route.Targets {
+			tpl, err := template.New("").Parse(target.Image)
+			if err != nil {
+				return nil, err
+			}
+
+			buf := &bytes.Buffer{}
+			if err := tpl.Execute(buf, data); err != nil {
+				return nil, fmt.Errorf("Failed to render push target %q for %s, error: %s", target.Image, name, err)
+			}
+			names = append(names, buf.String())
+		}
+
+		return names, nil
+	}
+
+	return []string{name}, nil
+}
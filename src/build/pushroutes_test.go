@@ -0,0 +1,105 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadPushRoutes(t *testing.T) {
+	f, err := ioutil.TempFile("", "rocker-push-routes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+
+	f.WriteString(`
+routes:
+  - match: "app:*"
+    targets:
+      - image: "123456789012.dkr.ecr.us-east-1.amazonaws.com/app:{{ .Tag }}"
+      - image: "ghcr.io/acme/{{ .Repository }}:{{ .Tag }}"
+        username: acme-ci
+        password: $ROCKER_TEST_GHCR_TOKEN
+`)
+	f.Close()
+
+	routes, err := LoadPushRoutes(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Len(t, routes, 1)
+
+	os.Setenv("ROCKER_TEST_GHCR_TOKEN", "secret")
+	defer os.Unsetenv("ROCKER_TEST_GHCR_TOKEN")
+
+	auth, err := AddPushRoutesAuth(nil, routes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "acme-ci", auth.Configs["ghcr.io"].Username)
+	assert.Equal(t, "secret", auth.Configs["ghcr.io"].Password)
+	assert.Len(t, auth.Configs, 1)
+}
+
+func TestResolvePushTargets(t *testing.T) {
+	routes := []PushRoute{
+		{
+			Match: "app:*",
+			Targets: []PushTarget{
+				{Image: "123456789012.dkr.ecr.us-east-1.amazonaws.com/app:{{ .Tag }}"},
+				{Image: "ghcr.io/acme/{{ .Repository }}:{{ .Tag }}"},
+			},
+		},
+		{
+			Match:   "acme/*",
+			Targets: []PushTarget{{Image: "quay.io/{{ .Name }}:{{ .Tag }}"}},
+		},
+	}
+
+	names, err := ResolvePushTargets(routes, "app:1.2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []string{
+		"123456789012.dkr.ecr.us-east-1.amazonaws.com/app:1.2",
+		"ghcr.io/acme/app:1.2",
+	}, names)
+
+	names, err = ResolvePushTargets(routes, "acme/web:latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []string{"quay.io/acme/web:latest"}, names)
+
+	names, err = ResolvePushTargets(routes, "other/app:1.2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []string{"other/app:1.2"}, names)
+}
+
+func TestTargetRegistry(t *testing.T) {
+	assert.Equal(t, "ghcr.io", targetRegistry("ghcr.io/acme/app:{{ .Tag }}"))
+	assert.Equal(t, "localhost:5000", targetRegistry("localhost:5000/app"))
+	assert.Equal(t, "index.docker.io", targetRegistry("acme/app:{{ .Tag }}"))
+	assert.Equal(t, "index.docker.io", targetRegistry("{{ .Name }}:latest"))
+}
@@ -0,0 +1,306 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/grammarly/rocker/src/dockerclient"
+	"github.com/grammarly/rocker/src/imagename"
+	"github.com/grammarly/rocker/src/spill"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	// RegistryCacheTag is the tag of the cache artifact, unless given in --cache-to
+	RegistryCacheTag = "rocker-cache"
+
+	registryCacheMediaType    = "application/vnd.rocker.cache.v1+json"
+	registryCacheArtifactType = "application/vnd.rocker.cache.v1"
+)
+
+// registryCacheEntry is a cached step along with the image to pull for it
+type registryCacheEntry struct {
+	State State  `json:"state"`
+	Image string `json:"image"`
+}
+
+type registryCacheIndex struct {
+	Entries []registryCacheEntry `json:"entries"`
+}
+
+// registryCache shares the cache of the steps through a registry, so CI runners
+// with an empty local cache still get hits. --cache-to pushes the images of the
+// steps of the build as <repo>:cache-<image id> and the index of the steps as an
+// OCI artifact <repo>:rocker-cache; --cache-from reads the index and pulls the
+// image of a step when it is not in the local cache. The local cache is always
+// asked first and keeps what came from the registry
+type registryCache struct {
+	Cache
+
+	client Client
+	from   []*imagename.ImageName
+	to     *imagename.ImageName
+
+	// ctx is the context of the build the images of the cache are pulled in
+	ctx context.Context
+
+	mu       sync.Mutex
+	imported []registryCacheEntry
+	used     map[string]State
+}
+
+func newRegistryCache(local Cache, client Client, from []string, to string) *registryCache {
+	c := &registryCache{
+		Cache:  local,
+		client: client,
+		used:   map[string]State{},
+		ctx:    context.Background(),
+	}
+	for _, name := range from {
+		c.from = append(c.from, registryCacheName(name))
+	}
+	if to != "" {
+		c.to = registryCacheName(to)
+	}
+	return c
+}
+
+// registryCacheName adds the default tag to the cache repository name
+func registryCacheName(name string) *imagename.ImageName {
+	img := imagename.NewFromString(name)
+	if !img.HasTag() {
+		img.SetTag(RegistryCacheTag)
+	}
+	return img
+}
+
+// Import reads the cache indexes of --cache-from; a missing or broken one is
+// only a warning, e.g. when the cache has never been exported yet
+func (c *registryCache) Import(ctx context.Context) {
+	c.ctx = ctx
+
+	for _, img := range c.from {
+		index, err := c.pullIndex(img)
+		if err != nil {
+			log.Warnf("| Skip cache %s, error: %s", img, err)
+			continue
+		}
+
+		log.Infof("| Imported %d cached steps from %s", len(index.Entries), img)
+
+		c.mu.Lock()
+		c.imported = append(c.imported, index.Entries...)
+		c.mu.Unlock()
+	}
+}
+
+// SeedCache pulls the images of the cache exported with --cache-to to the given
+// name and puts their steps into the local cache, so the first build on a new
+// machine hits the cache without --cache-from. An image that fails to pull is
+// only a warning; returns the number of the steps that were put
+func SeedCache(ctx context.Context, client Client, local Cache, name string) (seeded int, err error) {
+	c := newRegistryCache(local, client, []string{name}, "")
+	c.ctx = ctx
+
+	index, err := c.pullIndex(c.from[0])
+	if err != nil {
+		return 0, err
+	}
+
+	for _, e := range index.Entries {
+		if err := c.ensureImage(e); err != nil {
+			if ctx.Err() != nil {
+				return seeded, ctx.Err()
+			}
+			log.Warnf("| Skip cached image %s, error: %s", e.Image, err)
+			continue
+		}
+
+		if err := local.Put(e.State); err != nil {
+			return seeded, err
+		}
+		seeded++
+	}
+
+	return seeded, nil
+}
+
+// pullIndex reads the cache index from the registry
+func (c *registryCache) pullIndex(img *imagename.ImageName) (index registryCacheIndex, err error) {
+	artifact, err := c.client.PullArtifact(img.String())
+	if err != nil {
+		return index, err
+	}
+	defer artifact.Close()
+
+	if err := json.NewDecoder(artifact.Reader()).Decode(&index); err != nil {
+		return index, fmt.Errorf("Failed to parse the cache index %s, error: %s", img, err)
+	}
+	return index, nil
+}
+
+// Get implements Cache, it pulls the image of the step from the registry
+// if the step is cached there but not locally
+func (c *registryCache) Get(s State) (*State, error) {
+	s2, err := c.Cache.Get(s)
+	if err != nil {
+		return nil, err
+	}
+	if s2 != nil {
+		c.use(*s2)
+		return s2, nil
+	}
+
+	c.mu.Lock()
+	imported := c.imported
+	c.mu.Unlock()
+
+	for _, e := range imported {
+		if e.State.ParentID != s.ImageID || !s.Equals(e.State) {
+			continue
+		}
+
+		if err := c.ensureImage(e); err != nil {
+			log.Warnf("| Skip cached image %s, error: %s", e.Image, err)
+			continue
+		}
+
+		if err := c.Cache.Put(e.State); err != nil {
+			return nil, err
+		}
+
+		c.use(e.State)
+		s2 := e.State
+		return &s2, nil
+	}
+
+	return nil, nil
+}
+
+// Put implements Cache
+func (c *registryCache) Put(s State) error {
+	if err := c.Cache.Put(s); err != nil {
+		return err
+	}
+	c.use(s)
+	return nil
+}
+
+// Del implements Cache
+func (c *registryCache) Del(s State) error {
+	c.mu.Lock()
+	delete(c.used, s.ImageID)
+	c.mu.Unlock()
+
+	return c.Cache.Del(s)
+}
+
+// Export pushes the images of the steps the build went through and then the
+// index of them to --cache-to
+func (c *registryCache) Export(ctx context.Context) error {
+	if c.to == nil {
+		return nil
+	}
+
+	c.mu.Lock()
+	ids := []string{}
+	for id := range c.used {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	states := []State{}
+	for _, id := range ids {
+		states = append(states, c.used[id])
+	}
+	c.mu.Unlock()
+
+	index := registryCacheIndex{Entries: []registryCacheEntry{}}
+
+	for _, s := range states {
+		img := imagename.New(c.to.NameWithRegistry(), "cache-"+strings.TrimPrefix(s.ImageID, "sha256:"))
+
+		if err := c.client.TagImage(s.ImageID, img.String()); err != nil {
+			return err
+		}
+		if _, err := c.client.PushImage(ctx, img.String()); err != nil {
+			return err
+		}
+
+		index.Entries = append(index.Entries, registryCacheEntry{State: s, Image: img.String()})
+	}
+
+	// The index grows with the number of steps, so it is encoded to the budget
+	content := spill.NewBuffer()
+	defer content.Close()
+
+	if err := json.NewEncoder(content).Encode(index); err != nil {
+		return err
+	}
+
+	if _, err := c.client.PushArtifact(c.to.String(), dockerclient.OCIArtifact{
+		Name:         "rocker-cache.json",
+		Blob:         content,
+		MediaType:    registryCacheMediaType,
+		ArtifactType: registryCacheArtifactType,
+	}); err != nil {
+		return fmt.Errorf("Failed to export the cache to %s, error: %s", c.to, err)
+	}
+
+	log.Infof("| Exported %d cached steps to %s", len(index.Entries), c.to)
+
+	return nil
+}
+
+// ensureImage pulls the image of the cache entry unless it is there already
+func (c *registryCache) ensureImage(e registryCacheEntry) error {
+	if img, err := c.client.InspectImage(e.State.ImageID); err != nil || img != nil {
+		return err
+	}
+
+	if err := c.client.PullImage(c.ctx, e.Image); err != nil {
+		return err
+	}
+
+	// The image ID is the digest of its config, so it survives push and pull
+	img, err := c.client.InspectImage(e.Image)
+	if err != nil {
+		return err
+	}
+	if img == nil || img.ID != e.State.ImageID {
+		return fmt.Errorf("the pulled image is not %.19s", e.State.ImageID)
+	}
+
+	return nil
+}
+
+func (c *registryCache) use(s State) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// The build args and host config of the runner do not belong to the
+	// cache, and the build args may be secrets
+	s.NoCache = StateNoCache{}
+	c.used[s.ImageID] = s
+}
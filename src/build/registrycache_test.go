@@ -0,0 +1,171 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/grammarly/rocker/src/dockerclient"
+
+	"github.com/fsouza/go-dockerclient"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestRegistryCacheName(t *testing.T) {
+	assert.Equal(t, "quay.io/me/cache:rocker-cache", registryCacheName("quay.io/me/cache").String())
+	assert.Equal(t, "quay.io/me/cache:main", registryCacheName("quay.io/me/cache:main").String())
+}
+
+func TestRegistryCache_GetImported(t *testing.T) {
+	tmpDir := cacheTestTmpDir(t)
+	defer os.RemoveAll(tmpDir)
+
+	c := &MockClient{}
+	rc := newRegistryCache(NewCacheFS(tmpDir), c, []string{"quay.io/me/cache"}, "")
+
+	cached := State{ParentID: "sha256:111", ImageID: "sha256:222", Commits: []string{"RUN make"}}
+	index, _ := json.Marshal(registryCacheIndex{Entries: []registryCacheEntry{
+		{State: cached, Image: "quay.io/me/cache:cache-222"},
+	}})
+
+	c.On("PullArtifact", "quay.io/me/cache:rocker-cache").Return(dockerclient.OCIArtifact{Content: index}, nil).Once()
+	c.On("InspectImage", "sha256:222").Return((*docker.Image)(nil), nil).Once()
+	c.On("PullImage", "quay.io/me/cache:cache-222").Return(nil).Once()
+	c.On("InspectImage", "quay.io/me/cache:cache-222").Return(&docker.Image{ID: "sha256:222"}, nil).Once()
+
+	rc.Import(context.Background())
+
+	miss, err := rc.Get(State{ImageID: "sha256:111", Commits: []string{"RUN make test"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Nil(t, miss)
+
+	res, err := rc.Get(State{ImageID: "sha256:111", Commits: []string{"RUN make"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.AssertExpectations(t)
+	assert.Equal(t, "sha256:222", res.ImageID)
+
+	// the local cache keeps what came from the registry
+	local, err := NewCacheFS(tmpDir).Get(State{ImageID: "sha256:111", Commits: []string{"RUN make"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "sha256:222", local.ImageID)
+}
+
+func TestSeedCache(t *testing.T) {
+	tmpDir := cacheTestTmpDir(t)
+	defer os.RemoveAll(tmpDir)
+
+	c := &MockClient{}
+
+	local := State{ParentID: "sha256:111", ImageID: "sha256:222", Commits: []string{"RUN make"}}
+	pulled := State{ParentID: "sha256:222", ImageID: "sha256:333", Commits: []string{"RUN make test"}}
+	missing := State{ParentID: "sha256:222", ImageID: "sha256:444", Commits: []string{"RUN make lint"}}
+
+	index, _ := json.Marshal(registryCacheIndex{Entries: []registryCacheEntry{
+		{State: local, Image: "quay.io/me/cache:cache-222"},
+		{State: pulled, Image: "quay.io/me/cache:cache-333"},
+		{State: missing, Image: "quay.io/me/cache:cache-444"},
+	}})
+
+	c.On("PullArtifact", "quay.io/me/cache:rocker-cache").Return(dockerclient.OCIArtifact{Content: index}, nil).Once()
+	c.On("InspectImage", "sha256:222").Return(&docker.Image{ID: "sha256:222"}, nil).Once()
+	c.On("InspectImage", "sha256:333").Return((*docker.Image)(nil), nil).Once()
+	c.On("PullImage", "quay.io/me/cache:cache-333").Return(nil).Once()
+	c.On("InspectImage", "quay.io/me/cache:cache-333").Return(&docker.Image{ID: "sha256:333"}, nil).Once()
+	c.On("InspectImage", "sha256:444").Return((*docker.Image)(nil), nil).Once()
+	c.On("PullImage", "quay.io/me/cache:cache-444").Return(fmt.Errorf("manifest unknown")).Once()
+
+	seeded, err := SeedCache(context.Background(), c, NewCacheFS(tmpDir), "quay.io/me/cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.AssertExpectations(t)
+	assert.Equal(t, 2, seeded)
+
+	for _, s := range []State{local, pulled} {
+		res, err := NewCacheFS(tmpDir).Get(State{ImageID: s.ParentID, Commits: s.Commits})
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, s.ImageID, res.ImageID)
+	}
+
+	res, err := NewCacheFS(tmpDir).Get(State{ImageID: missing.ParentID, Commits: missing.Commits})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Nil(t, res)
+}
+
+func TestSeedCache_NoIndex(t *testing.T) {
+	c := &MockClient{}
+	c.On("PullArtifact", "quay.io/me/cache:main").Return(dockerclient.OCIArtifact{}, fmt.Errorf("manifest unknown")).Once()
+
+	_, err := SeedCache(context.Background(), c, NewCacheFS(os.TempDir()), "quay.io/me/cache:main")
+	assert.EqualError(t, err, "manifest unknown")
+}
+
+func TestRegistryCache_Export(t *testing.T) {
+	tmpDir := cacheTestTmpDir(t)
+	defer os.RemoveAll(tmpDir)
+
+	c := &MockClient{}
+	rc := newRegistryCache(NewCacheFS(tmpDir), c, nil, "quay.io/me/cache")
+
+	s := State{ParentID: "sha256:111", ImageID: "sha256:222", Commits: []string{"RUN make"}}
+	s.NoCache.BuildArgs = map[string]string{"TOKEN": "secret"}
+	if err := rc.Put(s); err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		artifact dockerclient.OCIArtifact
+		index    registryCacheIndex
+	)
+
+	c.On("TagImage", "sha256:222", "quay.io/me/cache:cache-222").Return(nil).Once()
+	c.On("PushImage", "quay.io/me/cache:cache-222").Return("sha256:abc", nil).Once()
+	c.On("PushArtifact", "quay.io/me/cache:rocker-cache", mock.AnythingOfType("dockerclient.OCIArtifact")).Return("sha256:def", nil).Run(func(args mock.Arguments) {
+		// The index is only readable until Export returns
+		artifact = args.Get(1).(dockerclient.OCIArtifact)
+		if err := json.NewDecoder(artifact.Reader()).Decode(&index); err != nil {
+			t.Fatal(err)
+		}
+	}).Once()
+
+	if err := rc.Export(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	c.AssertExpectations(t)
+
+	assert.Equal(t, registryCacheMediaType, artifact.MediaType)
+	assert.Len(t, index.Entries, 1)
+	assert.Equal(t, "quay.io/me/cache:cache-222", index.Entries[0].Image)
+	assert.Equal(t, "sha256:222", index.Entries[0].State.ImageID)
+	assert.Nil(t, index.Entries[0].State.NoCache.BuildArgs)
+}
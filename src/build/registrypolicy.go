@@ -0,0 +1,114 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/grammarly/rocker/src/imagename"
+	"github.com/grammarly/rocker/src/registrypolicy"
+)
+
+// checkRegistryPolicy makes the pre-flight check of the images the plan pulls
+// and pushes against the registry policy of the organization, so a build that
+// is not allowed fails before running anything
+func (b *Build) checkRegistryPolicy(plan Plan) error {
+	policy := b.cfg.RegistryPolicy
+	if policy == nil {
+		return nil
+	}
+
+	var (
+		violations = []*registrypolicy.Violation{}
+		checked    = map[string]bool{}
+
+		// Stages and images the Rockerfile tags are not pulled from anywhere
+		produced = map[string]bool{}
+	)
+
+	local := func(name string) bool {
+		return produced[strings.ToLower(name)] || produced[imagename.NewFromString(name).String()]
+	}
+
+	add := func(v *registrypolicy.Violation) {
+		if v == nil || checked[v.Error()] {
+			return
+		}
+		checked[v.Error()] = true
+		violations = append(violations, v)
+	}
+
+	for _, command := range plan {
+		switch c := command.(type) {
+		case *CommandTag:
+			if len(c.cfg.args) == 1 {
+				produced[imagename.NewFromString(c.cfg.args[0]).String()] = true
+			}
+		case *CommandFrom:
+			name, stage, err := fromArgs(c.cfg.args)
+			if err != nil {
+				break
+			}
+			if name != NoBaseImageSpecifier && !local(name) {
+				add(policy.CheckPull("FROM", name))
+			}
+			if stage != "" {
+				produced[stage] = true
+			}
+		case *CommandCopy:
+			if from := c.cfg.flags["from"]; from != "" && !local(from) {
+				add(policy.CheckPull("COPY --from", from))
+			}
+		case *CommandPush:
+			if !b.cfg.Push || len(c.cfg.args) != 1 {
+				break
+			}
+			names, err := ResolvePushTargets(b.cfg.PushRoutes, c.cfg.args[0])
+			if err != nil {
+				break
+			}
+			for _, name := range names {
+				add(policy.CheckPush(name))
+			}
+		}
+	}
+
+	if len(violations) == 0 {
+		return nil
+	}
+
+	if !policy.Enforced() {
+		for _, v := range violations {
+			b.log.Warnf("| The %s rule of the %s does not allow %s", v.Rule, policy.Name(), v)
+		}
+		return nil
+	}
+
+	lines := []string{}
+	for _, v := range violations {
+		b.log.Errorf("| Not allowed by the %s rule: %s", v.Rule, v)
+		lines = append(lines, v.Error())
+	}
+
+	msg := fmt.Sprintf("The %s does not allow %d images:\n  %s",
+		policy.Name(), len(violations), strings.Join(lines, "\n  "))
+	if policy.Contact != "" {
+		msg += fmt.Sprintf("\nAsk %s to approve more registries", policy.Contact)
+	}
+	return WithExitCode(ExitPolicy, fmt.Errorf("%s", msg))
+}
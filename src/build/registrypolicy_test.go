@@ -0,0 +1,75 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/grammarly/rocker/src/registrypolicy"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBuild_CheckRegistryPolicy(t *testing.T) {
+	rockerfile := `FROM golang:1.22 AS builder
+RUN make
+FROM quay.io/acme/base:1.0
+COPY --from=builder /app /app
+COPY --from=busybox /bin/sh /bin/sh
+TAG app:build
+FROM app:build
+PUSH docker.io/acme/app:1.0
+PUSH quay.io/acme/app:1.0`
+
+	policy := &registrypolicy.Policy{
+		Mode:       registrypolicy.ModeEnforce,
+		Registries: []string{"quay.io"},
+		Contact:    "#security",
+		Source:     "/etc/rocker/registry-policy.yml",
+	}
+
+	b, c := makeBuild(t, rockerfile, Config{RegistryPolicy: policy, Push: true})
+
+	err := b.Run(makePlan(t, rockerfile))
+	assert.Equal(t, ExitPolicy, ExitCode(err))
+	assert.Equal(t, `The registry policy /etc/rocker/registry-policy.yml does not allow 3 images:
+  FROM golang:1.22: docker.io is not an approved registry, use an image of quay.io
+  COPY --from busybox: docker.io is not an approved registry, use an image of quay.io
+  PUSH docker.io/acme/app:1.0: docker.io is not an approved registry, push to quay.io instead
+Ask #security to approve more registries`, err.Error())
+	c.AssertExpectations(t)
+}
+
+func TestBuild_CheckRegistryPolicyWarn(t *testing.T) {
+	rockerfile := "FROM alpine:3.20\nPUSH acme/app:1.0"
+
+	b, _ := makeBuild(t, rockerfile, Config{RegistryPolicy: &registrypolicy.Policy{
+		Mode:       registrypolicy.ModeWarn,
+		Registries: []string{"quay.io"},
+		Namespaces: []string{"quay.io/acme"},
+		Source:     "https://policy.example.com/registry-policy.yml",
+	}, Push: true})
+
+	var out bytes.Buffer
+	b.log = &log.Logger{Out: &out, Formatter: &log.TextFormatter{DisableColors: true}, Level: log.WarnLevel}
+
+	assert.Nil(t, b.checkRegistryPolicy(makePlan(t, rockerfile)))
+	assert.Contains(t, out.String(), "| The registries rule of the registry policy https://policy.example.com/registry-policy.yml does not allow FROM alpine:3.20: docker.io is not an approved registry, use an image of quay.io")
+	assert.Contains(t, out.String(), "| The registries rule of the registry policy https://policy.example.com/registry-policy.yml does not allow PUSH acme/app:1.0: docker.io is not an approved registry, push to quay.io instead")
+}
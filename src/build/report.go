@@ -0,0 +1,181 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"time"
+
+	"github.com/grammarly/rocker/src/eol"
+	"github.com/grammarly/rocker/src/imagename"
+)
+
+// Statuses of the steps and of the build in the report
+const (
+	ReportDone    = "done"
+	ReportCached  = "cached"
+	ReportFailed  = "failed"
+	ReportRunning = "running"
+)
+
+// Report is the machine-readable summary of a build that --report writes,
+// for the CI dashboards that should not parse the logs
+type Report struct {
+	BuildID     string               `json:"build_id,omitempty"`
+	Status      string               `json:"status"`
+	Error       string               `json:"error,omitempty"`
+	ImageID     string               `json:"image_id,omitempty"`
+	Started     time.Time            `json:"started"`
+	Duration    float64              `json:"duration_seconds"`
+	CacheHits   int                  `json:"cache_hits"`
+	CacheMisses int                  `json:"cache_misses"`
+	Steps       []ReportStep         `json:"steps"`
+	Pushed      []imagename.Artifact `json:"pushed"`
+	EOL         []eol.Warning        `json:"eol_warnings"`
+}
+
+// ReportStep is a command of the plan that ran; the commits of the changes
+// and the cleanups of the sections are steps of their own
+type ReportStep struct {
+	Step     int     `json:"step"`
+	Stage    string  `json:"stage,omitempty"`
+	Command  string  `json:"command"`
+	Status   string  `json:"status"`
+	Duration float64 `json:"duration_seconds"`
+	ImageID  string  `json:"image_id,omitempty"`
+	// Size is the size of the image after the step, SizeDelta is what the step added
+	Size      int64  `json:"size"`
+	SizeDelta int64  `json:"size_delta"`
+	Error     string `json:"error,omitempty"`
+}
+
+// CollectReport subscribes to the events of the build, the returned channel
+// receives the report when Run returns
+func (b *Build) CollectReport() <-chan *Report {
+	events := make(chan Event, 100)
+	b.Subscribe(events)
+
+	result := make(chan *Report, 1)
+	go func() {
+		r := collectReport(events)
+		// Run has returned when the events are closed
+		r.CacheHits, r.CacheMisses = b.CacheHits, b.CacheMisses
+		result <- r
+	}()
+
+	return result
+}
+
+// collectReport makes the report out of the events until the channel is closed
+func collectReport(events <-chan Event) *Report {
+	r := &Report{
+		Status: ReportRunning,
+		Steps:  []ReportStep{},
+		Pushed: []imagename.Artifact{},
+		EOL:    []eol.Warning{},
+	}
+	eolSeen := map[string]bool{}
+	steps := map[string]int{}
+
+	for e := range events {
+		key := fmt.Sprintf("%s/%d", e.Stage, e.Step)
+
+		switch e.Type {
+		case EventBuildStart:
+			r.BuildID = e.BuildID
+			r.Started = e.Time
+
+		case EventStepStart:
+			steps[key] = len(r.Steps)
+			r.Steps = append(r.Steps, ReportStep{
+				Step:    e.Step,
+				Stage:   e.Stage,
+				Command: e.Command,
+				Status:  ReportRunning,
+			})
+
+		case EventStepCached, EventStepDone, EventStepFailed:
+			i, ok := steps[key]
+			if !ok {
+				continue
+			}
+			s := &r.Steps[i]
+
+			switch e.Type {
+			case EventStepCached:
+				s.Status = ReportCached
+			case EventStepDone:
+				if s.Status != ReportCached {
+					s.Status = ReportDone
+				}
+				s.ImageID = e.ImageID
+				s.Size = e.Size
+				s.SizeDelta = e.SizeDelta
+			case EventStepFailed:
+				s.Status = ReportFailed
+				s.Error = e.Error
+			}
+			s.Duration = e.Duration.Seconds()
+
+		case EventPush:
+			if e.Artifact != nil {
+				r.Pushed = append(r.Pushed, *e.Artifact)
+			}
+
+		case EventBaseEOL:
+			if e.EOL != nil && !eolSeen[e.EOL.Image] {
+				eolSeen[e.EOL.Image] = true
+				r.EOL = append(r.EOL, *e.EOL)
+			}
+
+		case EventBuildDone, EventBuildFailed:
+			r.Status = ReportDone
+			if e.Type == EventBuildFailed {
+				r.Status = ReportFailed
+			}
+			r.Error = e.Error
+			r.ImageID = e.ImageID
+			r.Duration = e.Duration.Seconds()
+		}
+	}
+
+	// The stages that ran in parallel are reported in the order of the plan
+	sort.Stable(reportStepsByNumber(r.Steps))
+
+	return r
+}
+
+// WriteFile writes the report as indented JSON
+func (r *Report) WriteFile(file string) error {
+	content, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(file, append(content, '\n'), 0644); err != nil {
+		return fmt.Errorf("Failed to write the build report to %s, error: %s", file, err)
+	}
+	return nil
+}
+
+type reportStepsByNumber []ReportStep
+
+func (a reportStepsByNumber) Len() int           { return len(a) }
+func (a reportStepsByNumber) Less(i, j int) bool { return a[i].Step < a[j].Step }
+func (a reportStepsByNumber) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
@@ -0,0 +1,148 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/grammarly/rocker/src/eol"
+
+	"github.com/fsouza/go-dockerclient"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestBuild_CollectReport(t *testing.T) {
+	rockerfile := "FROM scratch\nENV A=1"
+	b, c := makeBuild(t, rockerfile, Config{BuildID: "42"})
+
+	c.On("CreateContainer", mock.AnythingOfType("State")).Return("456", nil).Once()
+	c.On("CommitContainer", mock.AnythingOfType("State")).Return(&docker.Image{ID: "123"}, nil).Once()
+	c.On("RemoveContainer", "456").Return(nil).Once()
+
+	reports := b.CollectReport()
+	if err := b.Run(makePlan(t, rockerfile)); err != nil {
+		t.Fatal(err)
+	}
+	r := <-reports
+
+	assert.Equal(t, "42", r.BuildID)
+	assert.Equal(t, ReportDone, r.Status)
+	assert.Equal(t, "123", r.ImageID)
+	assert.Len(t, r.Steps, 4)
+
+	commit := r.Steps[2]
+	assert.Equal(t, 3, commit.Step)
+	assert.Equal(t, ReportDone, commit.Status)
+	assert.Equal(t, "123", commit.ImageID)
+}
+
+func TestBuild_CollectReportFailed(t *testing.T) {
+	rockerfile := "FROM scratch\nENV A=1"
+	b, c := makeBuild(t, rockerfile, Config{})
+
+	c.On("CreateContainer", mock.AnythingOfType("State")).Return("", fmt.Errorf("no space left on device")).Once()
+
+	reports := b.CollectReport()
+	assert.Error(t, b.Run(makePlan(t, rockerfile)))
+	r := <-reports
+
+	assert.Equal(t, ReportFailed, r.Status)
+	assert.Contains(t, r.Error, "no space left on device")
+
+	failed := r.Steps[len(r.Steps)-1]
+	assert.Equal(t, 3, failed.Step)
+	assert.Equal(t, ReportFailed, failed.Status)
+	assert.Contains(t, failed.Error, "no space left on device")
+}
+
+func TestBuild_CollectReportEOL(t *testing.T) {
+	rockerfile := "FROM ubuntu:16.04 AS base\nFROM base\nFROM ubuntu:xenial"
+	checker, err := eol.New(nil, eol.DefaultWarnBefore)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, c := makeBuild(t, rockerfile, Config{EOL: checker})
+
+	img := &docker.Image{ID: "123"}
+	c.On("InspectImage", "ubuntu:16.04").Return(img, nil).Once()
+	c.On("InspectImage", "123").Return(img, nil).Once()
+	c.On("InspectImage", "ubuntu:xenial").Return(img, nil).Once()
+
+	reports := b.CollectReport()
+	if err := b.Run(makePlan(t, rockerfile)); err != nil {
+		t.Fatal(err)
+	}
+	r := <-reports
+
+	c.AssertExpectations(t)
+	if assert.Len(t, r.EOL, 2) {
+		assert.Equal(t, "ubuntu:16.04", r.EOL[0].Image)
+		assert.Equal(t, eol.StatusEOL, r.EOL[0].Status)
+		assert.Equal(t, "ubuntu:xenial", r.EOL[1].Image)
+	}
+}
+
+func TestCollectReport(t *testing.T) {
+	events := make(chan Event, 100)
+	for _, e := range []Event{
+		{Type: EventBuildStart, BuildID: "42"},
+		{Type: EventStepStart, Step: 5, Stage: "app", Command: "RUN make"},
+		{Type: EventStepStart, Step: 2, Stage: "tools", Command: "COPY . /src"},
+		{Type: EventStepCached, Step: 2, Stage: "tools", ImageID: "222"},
+		{Type: EventStepDone, Step: 2, Stage: "tools", ImageID: "222", Size: 300, SizeDelta: 100, Duration: time.Second},
+		{Type: EventStepDone, Step: 5, Stage: "app", ImageID: "555", Size: 1000, SizeDelta: 600, Duration: 2 * time.Second},
+		{Type: EventBuildDone, ImageID: "555", Duration: 3 * time.Second},
+	} {
+		events <- e
+	}
+	close(events)
+
+	r := collectReport(events)
+
+	assert.Equal(t, ReportDone, r.Status)
+	assert.Equal(t, 3.0, r.Duration)
+	assert.Equal(t, []ReportStep{
+		{Step: 2, Stage: "tools", Command: "COPY . /src", Status: ReportCached, Duration: 1, ImageID: "222", Size: 300, SizeDelta: 100},
+		{Step: 5, Stage: "app", Command: "RUN make", Status: ReportDone, Duration: 2, ImageID: "555", Size: 1000, SizeDelta: 600},
+	}, r.Steps)
+
+	tmpDir := makeTmpDir(t, map[string]string{})
+	defer os.RemoveAll(tmpDir)
+
+	file := filepath.Join(tmpDir, "report.json")
+	if err := r.WriteFile(file); err != nil {
+		t.Fatal(err)
+	}
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var parsed map[string]interface{}
+	if err := json.Unmarshal(content, &parsed); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "42", parsed["build_id"])
+	assert.Len(t, parsed["steps"], 2)
+}
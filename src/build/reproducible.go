@@ -0,0 +1,110 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/fsouza/go-dockerclient"
+)
+
+// StepDiff describes the first step where two builds of the same Rockerfile diverged
+type StepDiff struct {
+	Index  int
+	Step   string
+	Reason string
+}
+
+// String returns the human readable representation of the difference
+func (d *StepDiff) String() string {
+	return fmt.Sprintf("Step %d %s: %s", d.Index+1, d.Step, d.Reason)
+}
+
+// DiffBuilds compares the images produced by two builds step by step, by their
+// configs and layer digests, and returns the first difference; it returns nil
+// if the builds are identical. Both builds should be run without cache.
+func DiffBuilds(a, b *Build) (*StepDiff, error) {
+	for i := 0; i < len(a.Steps) && i < len(b.Steps); i++ {
+		stepA, stepB := a.Steps[i], b.Steps[i]
+
+		if stepA.Step != stepB.Step {
+			return &StepDiff{i, stepA.Step, fmt.Sprintf("the other build ran %s instead", stepB.Step)}, nil
+		}
+
+		imgA, err := a.client.InspectImage(stepA.ImageID)
+		if err != nil {
+			return nil, err
+		}
+		imgB, err := b.client.InspectImage(stepB.ImageID)
+		if err != nil {
+			return nil, err
+		}
+		if imgA == nil || imgB == nil {
+			return nil, fmt.Errorf("Image of step %d %s is not found, was it removed by --no-garbage?", i+1, stepA.Step)
+		}
+
+		if reason := diffImages(imgA, imgB); reason != "" {
+			return &StepDiff{i, stepA.Step, reason}, nil
+		}
+	}
+
+	if len(a.Steps) != len(b.Steps) {
+		return &StepDiff{len(a.Steps), "", fmt.Sprintf("the builds have %d and %d steps", len(a.Steps), len(b.Steps))}, nil
+	}
+
+	return nil, nil
+}
+
+func diffImages(a, b *docker.Image) string {
+	if a.RootFS == nil || b.RootFS == nil {
+		return "docker daemon does not report layer digests, need docker 1.10 or newer"
+	}
+
+	layersA, layersB := a.RootFS.Layers, b.RootFS.Layers
+	for i := 0; i < len(layersA) && i < len(layersB); i++ {
+		if layersA[i] != layersB[i] {
+			return fmt.Sprintf("layer %d differs: %s != %s", i+1, layersA[i], layersB[i])
+		}
+	}
+	if len(layersA) != len(layersB) {
+		return fmt.Sprintf("images have %d and %d layers", len(layersA), len(layersB))
+	}
+
+	if a.Config != nil && b.Config != nil {
+		// Builder labels describe the environment and differ between daemons by design
+		configA, configB := *a.Config, *b.Config
+		configA.Labels = withoutBuilderLabels(configA.Labels)
+		configB.Labels = withoutBuilderLabels(configB.Labels)
+
+		if !CompareConfigs(configA, configB) {
+			return "image configs differ"
+		}
+	}
+
+	return ""
+}
+
+func withoutBuilderLabels(labels map[string]string) map[string]string {
+	result := map[string]string{}
+	for k, v := range labels {
+		if !strings.HasPrefix(k, "rocker.builder.") {
+			result[k] = v
+		}
+	}
+	return result
+}
@@ -0,0 +1,77 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"testing"
+
+	"github.com/fsouza/go-dockerclient"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDiffBuilds(t *testing.T) {
+	a, ca := makeBuild(t, "", Config{})
+	b, cb := makeBuild(t, "", Config{})
+
+	a.Steps = []BuiltStep{{"FROM ubuntu", "1"}, {"RUN make", "2"}, {"ENV foo=bar", "3"}}
+	b.Steps = []BuiltStep{{"FROM ubuntu", "1"}, {"RUN make", "20"}, {"ENV foo=bar", "30"}}
+
+	image := func(config *docker.Config, layers ...string) *docker.Image {
+		return &docker.Image{Config: config, RootFS: &docker.RootFS{Layers: layers}}
+	}
+
+	ca.On("InspectImage", "1").Return(image(&docker.Config{}, "base"), nil).Once()
+	cb.On("InspectImage", "1").Return(image(&docker.Config{}, "base"), nil).Once()
+	ca.On("InspectImage", "2").Return(image(&docker.Config{}, "base", "make"), nil).Once()
+	cb.On("InspectImage", "20").Return(image(&docker.Config{}, "base", "make"), nil).Once()
+	ca.On("InspectImage", "3").Return(image(&docker.Config{Env: []string{"foo=bar"}}, "base", "make", "empty"), nil).Once()
+	cb.On("InspectImage", "30").Return(image(&docker.Config{Env: []string{"foo=baz"}}, "base", "make", "empty"), nil).Once()
+
+	diff, err := DiffBuilds(a, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ca.AssertExpectations(t)
+	cb.AssertExpectations(t)
+
+	if assert.NotNil(t, diff) {
+		assert.Equal(t, 2, diff.Index)
+		assert.Equal(t, "ENV foo=bar", diff.Step)
+		assert.Equal(t, "image configs differ", diff.Reason)
+	}
+}
+
+func TestDiffImages_Layers(t *testing.T) {
+	a := &docker.Image{RootFS: &docker.RootFS{Layers: []string{"base", "make1"}}}
+	b := &docker.Image{RootFS: &docker.RootFS{Layers: []string{"base", "make2"}}}
+
+	assert.Equal(t, "layer 2 differs: make1 != make2", diffImages(a, b))
+}
+
+func TestDiffImages_IgnoreBuilderLabels(t *testing.T) {
+	a := &docker.Image{
+		Config: &docker.Config{Labels: map[string]string{"rocker.builder.docker-version": "1.10.3"}},
+		RootFS: &docker.RootFS{},
+	}
+	b := &docker.Image{
+		Config: &docker.Config{Labels: map[string]string{"rocker.builder.docker-version": "1.12.0"}},
+		RootFS: &docker.RootFS{},
+	}
+
+	assert.Equal(t, "", diffImages(a, b))
+}
@@ -24,6 +24,7 @@ import (
 	"io"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"strings"
 )
 
@@ -39,18 +40,19 @@ type Rockerfile struct {
 }
 
 // NewRockerfileFromFile reads and parses Rockerfile from a file
-func NewRockerfileFromFile(name string, vars template.Vars, funs template.Funs) (r *Rockerfile, err error) {
+func NewRockerfileFromFile(name string, vars template.Vars, funs template.Funs, sandbox *template.Sandbox) (r *Rockerfile, err error) {
 	fd, err := os.Open(name)
 	if err != nil {
 		return nil, err
 	}
 	defer fd.Close()
 
-	return NewRockerfile(name, fd, vars, funs)
+	return NewRockerfile(name, fd, vars, funs, sandbox)
 }
 
-// NewRockerfile reads parses Rockerfile from an io.Reader
-func NewRockerfile(name string, in io.Reader, vars template.Vars, funs template.Funs) (r *Rockerfile, err error) {
+// NewRockerfile reads parses Rockerfile from an io.Reader, the template is
+// rendered in the sandbox if one is given
+func NewRockerfile(name string, in io.Reader, vars template.Vars, funs template.Funs, sandbox *template.Sandbox) (r *Rockerfile, err error) {
 	r = &Rockerfile{
 		Name: name,
 		Vars: vars,
@@ -68,15 +70,17 @@ func NewRockerfile(name string, in io.Reader, vars template.Vars, funs template.
 
 	r.Source = string(source)
 
-	if content, err = template.Process(name, bytes.NewReader(source), vars, funs); err != nil {
+	if content, err = template.Process(name, bytes.NewReader(source), vars, funs, sandbox); err != nil {
 		return nil, err
 	}
 
-	r.Content = content.String()
+	if r.Content, err = expandIncludes(content.String(), vars, funs, sandbox, filepath.Join(filepath.Dir(name), FragmentsDir), nil); err != nil {
+		return nil, err
+	}
 
 	// TODO: update parser from Docker
 
-	if r.rootNode, err = parser.Parse(content); err != nil {
+	if r.rootNode, err = parser.Parse(strings.NewReader(r.Content)); err != nil {
 		return nil, err
 	}
 
@@ -94,6 +98,15 @@ func (r *Rockerfile) Commands() []ConfigCommand {
 	return commands
 }
 
+// Directives counts how many times each directive is used in the Rockerfile
+func (r *Rockerfile) Directives() map[string]int {
+	directives := map[string]int{}
+	for _, c := range r.Commands() {
+		directives[strings.ToUpper(c.name)]++
+	}
+	return directives
+}
+
 func handleJSONArgs(args []string, attributes map[string]bool) []string {
 	if len(args) == 0 {
 		return []string{}
@@ -27,7 +27,7 @@ import (
 func TestNewRockerfile_Base(t *testing.T) {
 	src := `FROM {{ .BaseImage }}`
 	vars := template.Vars{"BaseImage": "ubuntu"}
-	r, err := NewRockerfile("test", strings.NewReader(src), vars, template.Funs{})
+	r, err := NewRockerfile("test", strings.NewReader(src), vars, template.Funs{}, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -37,7 +37,7 @@ func TestNewRockerfile_Base(t *testing.T) {
 }
 
 func TestNewRockerfileFromFile(t *testing.T) {
-	r, err := NewRockerfileFromFile("testdata/Rockerfile", template.Vars{}, template.Funs{})
+	r, err := NewRockerfileFromFile("testdata/Rockerfile", template.Vars{}, template.Funs{}, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -47,7 +47,7 @@ func TestNewRockerfileFromFile(t *testing.T) {
 
 func TestRockerfileCommands(t *testing.T) {
 	src := `FROM ubuntu`
-	r, err := NewRockerfile("test", strings.NewReader(src), template.Vars{}, template.Funs{})
+	r, err := NewRockerfile("test", strings.NewReader(src), template.Vars{}, template.Funs{}, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -58,6 +58,16 @@ func TestRockerfileCommands(t *testing.T) {
 	assert.Equal(t, "ubuntu", commands[0].args[0])
 }
 
+func TestRockerfileDirectives(t *testing.T) {
+	src := "FROM ubuntu\nRUN make\nRUN make install\nTAG app"
+	r, err := NewRockerfile("test", strings.NewReader(src), template.Vars{}, template.Funs{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, map[string]int{"FROM": 1, "RUN": 2, "TAG": 1}, r.Directives())
+}
+
 func TestRockerfileParseOnbuildCommands(t *testing.T) {
 	triggers := []string{
 		"RUN make",
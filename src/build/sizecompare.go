@@ -0,0 +1,186 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/docker/docker/pkg/units"
+	"github.com/fsouza/go-dockerclient"
+)
+
+// DefaultSizeWarnGrowth is how much the image may grow since the previous release
+// before rocker warns about it, when --size-regression-limit is not given
+var DefaultSizeWarnGrowth = SizeLimit{Percent: 10}
+
+// SizeLimit is how much the image may grow since the previous release, either
+// in percent of the previous size or in bytes
+type SizeLimit struct {
+	Percent float64
+	Bytes   int64
+}
+
+// ParseSizeLimit parses the value of --size-regression-limit, e.g. 10% or 50MB
+func ParseSizeLimit(s string) (l SizeLimit, err error) {
+	if strings.HasSuffix(s, "%") {
+		if l.Percent, err = strconv.ParseFloat(strings.TrimSuffix(s, "%"), 64); err != nil || l.Percent < 0 {
+			return l, fmt.Errorf("Invalid size limit %q, expected a percent such as 10%% or a size such as 50MB", s)
+		}
+		return l, nil
+	}
+	if l.Bytes, err = units.FromHumanSize(s); err != nil || l.Bytes < 0 {
+		return l, fmt.Errorf("Invalid size limit %q, expected a percent such as 10%% or a size such as 50MB", s)
+	}
+	return l, nil
+}
+
+// String returns the limit as it is given on the command line
+func (l SizeLimit) String() string {
+	if l.Bytes > 0 {
+		return units.HumanSize(float64(l.Bytes))
+	}
+	return strconv.FormatFloat(l.Percent, 'f', -1, 64) + "%"
+}
+
+// Exceeded tells if the image grew more than the limit allows
+func (l SizeLimit) Exceeded(cmp *ImageComparison) bool {
+	growth := cmp.Size - cmp.PreviousSize
+	if l.Bytes > 0 {
+		return growth > l.Bytes
+	}
+	return cmp.Growth() > l.Percent
+}
+
+// ImageComparison is how the built image differs from the image of a previous release
+type ImageComparison struct {
+	Previous     string
+	PreviousSize int64
+	Size         int64
+
+	// Layers is the number of layers of the image, SharedLayers the ones it
+	// shares with the previous image
+	Layers       int
+	SharedLayers int
+
+	// Added are the steps of the history of the image that the previous image
+	// does not have, Removed the ones it had; both are sorted by size, largest first
+	Added   []HistoryEntry
+	Removed []HistoryEntry
+}
+
+// HistoryEntry is a step of the history of an image that produced a layer
+type HistoryEntry struct {
+	CreatedBy string
+	Size      int64
+}
+
+// Command returns the command of the step, shortened for the log
+func (e HistoryEntry) Command() string {
+	cmd := strings.TrimSpace(strings.TrimPrefix(e.CreatedBy, "/bin/sh -c #(nop) "))
+	if len(cmd) > 100 {
+		cmd = cmd[:97] + "..."
+	}
+	return cmd
+}
+
+// Growth returns how much the image grew in percent of the previous size
+func (c *ImageComparison) Growth() float64 {
+	if c.PreviousSize == 0 {
+		return 0
+	}
+	return float64(c.Size-c.PreviousSize) * 100 / float64(c.PreviousSize)
+}
+
+// String summarizes the comparison in a line
+func (c *ImageComparison) String() string {
+	delta := c.Size - c.PreviousSize
+	sign := "+"
+	if delta < 0 {
+		sign, delta = "-", -delta
+	}
+	return fmt.Sprintf("Compared with %s: %s -> %s (%s%s, %+.1f%%), %d of %d layers are the same",
+		c.Previous,
+		units.HumanSize(float64(c.PreviousSize)),
+		units.HumanSize(float64(c.Size)),
+		sign, units.HumanSize(float64(delta)),
+		c.Growth(),
+		c.SharedLayers, c.Layers,
+	)
+}
+
+// CompareImages compares the image with the previous one by the size, the layers
+// and the steps of the history that produced data; the steps are told apart by
+// the command and the size, since the ids of the history of pulled images are unknown
+func CompareImages(previousName string, previous, img *docker.Image, previousHistory, history []docker.ImageHistory) *ImageComparison {
+	c := &ImageComparison{
+		Previous:     previousName,
+		PreviousSize: previous.VirtualSize,
+		Size:         img.VirtualSize,
+	}
+
+	if img.RootFS != nil {
+		c.Layers = len(img.RootFS.Layers)
+		if previous.RootFS != nil {
+			shared := map[string]bool{}
+			for _, layer := range previous.RootFS.Layers {
+				shared[layer] = true
+			}
+			for _, layer := range img.RootFS.Layers {
+				if shared[layer] {
+					c.SharedLayers++
+				}
+			}
+		}
+	}
+
+	c.Added = historyDiff(history, previousHistory)
+	c.Removed = historyDiff(previousHistory, history)
+
+	return c
+}
+
+// historyDiff returns the entries of a with data that b does not have
+func historyDiff(a, b []docker.ImageHistory) []HistoryEntry {
+	seen := map[HistoryEntry]int{}
+	for _, h := range b {
+		seen[HistoryEntry{h.CreatedBy, h.Size}]++
+	}
+
+	diff := []HistoryEntry{}
+	for _, h := range a {
+		e := HistoryEntry{h.CreatedBy, h.Size}
+		if seen[e] > 0 {
+			seen[e]--
+			continue
+		}
+		if e.Size > 0 {
+			diff = append(diff, e)
+		}
+	}
+
+	sort.Stable(historyBySize(diff))
+	return diff
+}
+
+type historyBySize []HistoryEntry
+
+func (a historyBySize) Len() int           { return len(a) }
+func (a historyBySize) Less(i, j int) bool { return a[i].Size > a[j].Size }
+func (a historyBySize) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
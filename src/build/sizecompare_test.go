@@ -0,0 +1,77 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"testing"
+
+	"github.com/fsouza/go-dockerclient"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseSizeLimit(t *testing.T) {
+	l, err := ParseSizeLimit("10%")
+	assert.NoError(t, err)
+	assert.Equal(t, SizeLimit{Percent: 10}, l)
+	assert.Equal(t, "10%", l.String())
+
+	l, err = ParseSizeLimit("50MB")
+	assert.NoError(t, err)
+	assert.Equal(t, SizeLimit{Bytes: 50000000}, l)
+
+	for _, s := range []string{"", "ten%", "-5%", "big"} {
+		_, err := ParseSizeLimit(s)
+		assert.Error(t, err, s)
+	}
+}
+
+func TestCompareImages(t *testing.T) {
+	previous := &docker.Image{VirtualSize: 1000, RootFS: &docker.RootFS{Layers: []string{"base", "deps", "app1"}}}
+	img := &docker.Image{VirtualSize: 1150, RootFS: &docker.RootFS{Layers: []string{"base", "deps", "tools", "app2"}}}
+
+	previousHistory := []docker.ImageHistory{
+		{CreatedBy: "/bin/sh -c #(nop) COPY dir:111 in /app", Size: 100},
+		{CreatedBy: "/bin/sh -c #(nop) CMD [\"app\"]"},
+		{CreatedBy: "/bin/sh -c apt-get install -y curl", Size: 300},
+		{CreatedBy: "/bin/sh -c #(nop) ADD file:base in /", Size: 600},
+	}
+	history := []docker.ImageHistory{
+		{CreatedBy: "/bin/sh -c #(nop) COPY dir:222 in /app", Size: 110},
+		{CreatedBy: "/bin/sh -c apt-get install -y imagemagick", Size: 140},
+		{CreatedBy: "/bin/sh -c #(nop) CMD [\"app\"]"},
+		{CreatedBy: "/bin/sh -c apt-get install -y curl", Size: 300},
+		{CreatedBy: "/bin/sh -c #(nop) ADD file:base in /", Size: 600},
+	}
+
+	cmp := CompareImages("app:1.0", previous, img, previousHistory, history)
+
+	assert.Equal(t, 4, cmp.Layers)
+	assert.Equal(t, 2, cmp.SharedLayers)
+	assert.Equal(t, 15.0, cmp.Growth())
+	assert.Equal(t, []HistoryEntry{
+		{"/bin/sh -c apt-get install -y imagemagick", 140},
+		{"/bin/sh -c #(nop) COPY dir:222 in /app", 110},
+	}, cmp.Added)
+	assert.Equal(t, []HistoryEntry{{"/bin/sh -c #(nop) COPY dir:111 in /app", 100}}, cmp.Removed)
+	assert.Equal(t, "COPY dir:222 in /app", cmp.Added[1].Command())
+	assert.Equal(t, "Compared with app:1.0: 1 kB -> 1.15 kB (+150 B, +15.0%), 2 of 4 layers are the same", cmp.String())
+
+	assert.True(t, SizeLimit{Percent: 10}.Exceeded(cmp))
+	assert.False(t, SizeLimit{Percent: 20}.Exceeded(cmp))
+	assert.True(t, SizeLimit{Bytes: 100}.Exceeded(cmp))
+	assert.False(t, SizeLimit{Bytes: 200}.Exceeded(cmp))
+}
@@ -0,0 +1,459 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/fsouza/go-dockerclient"
+)
+
+// The whiteout files of the layers, as docker marks the deleted paths
+const (
+	whiteoutPrefix = ".wh."
+	whiteoutOpaque = ".wh..wh..opq"
+)
+
+// squashedLayerFile is the name of the merged layer in the archive for `docker load`
+const squashedLayerFile = "squashed.tar"
+
+// squashImage merges the layers the section added on top of its FROM image
+// into a single one and makes it the image of the state
+func squashImage(b *Build, s State, keep int) (State, error) {
+	img, err := b.client.SquashImage(s.ImageID, keep)
+	if err != nil {
+		return s, err
+	}
+	return useRewrittenImage(b, s, img)
+}
+
+// useRewrittenImage makes the image that replaced the one of the state
+// the image of the state, and caches it
+func useRewrittenImage(b *Build, s State, img *docker.Image) (State, error) {
+	s.CleanCommits()
+	s.ParentID = s.ImageID
+	s.ImageID = img.ID
+	s.ProducedImage = true
+	s.ParentSize = s.Size
+	s.Size = img.VirtualSize
+
+	if b.cache != nil {
+		if err := b.cache.Put(s); err != nil {
+			return s, err
+		}
+	}
+
+	b.ProducedSize += s.Size - s.ParentSize
+	b.VirtualSize = s.Size
+
+	return s, nil
+}
+
+// sectionBaseLayers returns the number of layers of the FROM image of the section,
+// the ones a rewrite of the image the section built keeps as they are
+func sectionBaseLayers(b *Build, s State, what string) (int, error) {
+	if s.NoBaseImage {
+		return 0, nil
+	}
+	if b.fromImageID == "" {
+		return 0, fmt.Errorf("Cannot %s, the FROM image of the section is not known; it needs FROM to run in the same build", what)
+	}
+
+	var (
+		base *docker.Image
+		err  error
+	)
+	// The FROM image that is not pulled yet is known well enough
+	if b.lazyFrom != nil && b.lazyFrom.image.ID == b.fromImageID {
+		base = b.lazyFrom.image
+	} else if base, err = b.client.InspectImage(b.fromImageID); err != nil {
+		return 0, err
+	}
+	keep := imageLayers(base)
+	if keep < 0 {
+		return 0, fmt.Errorf("Cannot %s, the docker daemon does not tell the layers of image %.12s", what, b.fromImageID)
+	}
+	return keep, nil
+}
+
+// imageLayers returns the number of layers of the image, -1 if the daemon does not tell
+func imageLayers(img *docker.Image) int {
+	if img == nil || img.RootFS == nil {
+		return -1
+	}
+	return len(img.RootFS.Layers)
+}
+
+// savedManifest is an image of manifest.json of `docker save`
+type savedManifest struct {
+	Config   string
+	RepoTags []string
+	Layers   []string
+}
+
+// squashSavedImage rewrites the image that `docker save` extracted to dir so
+// that the layers above the first keep ones are merged into one. It returns
+// the id of the new image and the files of the archive to give to `docker load`
+func squashSavedImage(dir string, keep int, createdBy string) (imageID string, files []string, err error) {
+	var manifests []savedManifest
+	if err := readJSONFile(filepath.Join(dir, "manifest.json"), &manifests); err != nil {
+		return "", nil, fmt.Errorf("Failed to read the manifest of the saved image, error: %s", err)
+	}
+	if len(manifests) != 1 {
+		return "", nil, fmt.Errorf("Expected one image in the saved archive, found %d", len(manifests))
+	}
+	m := manifests[0]
+	if keep < 0 || keep > len(m.Layers) {
+		return "", nil, fmt.Errorf("Cannot keep %d layers of the image, it has %d", keep, len(m.Layers))
+	}
+
+	layers := []string{}
+	for _, layer := range m.Layers[keep:] {
+		layers = append(layers, filepath.Join(dir, filepath.FromSlash(layer)))
+	}
+
+	out, err := os.Create(filepath.Join(dir, squashedLayerFile))
+	if err != nil {
+		return "", nil, err
+	}
+	digest := sha256.New()
+	err = squashLayers(layers, io.MultiWriter(out, digest))
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return "", nil, fmt.Errorf("Failed to squash the layers, error: %s", err)
+	}
+	diffID := "sha256:" + hex.EncodeToString(digest.Sum(nil))
+
+	config, err := squashConfig(filepath.Join(dir, filepath.FromSlash(m.Config)), keep, diffID, createdBy)
+	if err != nil {
+		return "", nil, err
+	}
+	configSum := sha256.Sum256(config)
+	configFile := hex.EncodeToString(configSum[:]) + ".json"
+	if err := ioutil.WriteFile(filepath.Join(dir, configFile), config, 0644); err != nil {
+		return "", nil, err
+	}
+
+	squashed := savedManifest{Config: configFile, Layers: append(append([]string{}, m.Layers[:keep]...), squashedLayerFile)}
+	manifest, err := json.Marshal([]savedManifest{squashed})
+	if err != nil {
+		return "", nil, err
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "manifest.json"), manifest, 0644); err != nil {
+		return "", nil, err
+	}
+
+	files = append([]string{"manifest.json", configFile}, squashed.Layers...)
+	return "sha256:" + hex.EncodeToString(configSum[:]), files, nil
+}
+
+// squashConfig replaces the layers above the first keep ones with the squashed
+// one in the image config, and their history with a single entry
+func squashConfig(file string, keep int, diffID, createdBy string) ([]byte, error) {
+	var (
+		config map[string]json.RawMessage
+		rootfs struct {
+			Type    string   `json:"type"`
+			DiffIDs []string `json:"diff_ids"`
+		}
+		history []json.RawMessage
+	)
+
+	if err := readJSONFile(file, &config); err != nil {
+		return nil, fmt.Errorf("Failed to read the config of the saved image, error: %s", err)
+	}
+	if err := json.Unmarshal(config["rootfs"], &rootfs); err != nil {
+		return nil, fmt.Errorf("Failed to read the layers of the saved image, error: %s", err)
+	}
+	if raw, ok := config["history"]; ok {
+		if err := json.Unmarshal(raw, &history); err != nil {
+			return nil, fmt.Errorf("Failed to read the history of the saved image, error: %s", err)
+		}
+	}
+	if keep > len(rootfs.DiffIDs) {
+		return nil, fmt.Errorf("Cannot keep %d layers of the image, its config has %d", keep, len(rootfs.DiffIDs))
+	}
+
+	rootfs.DiffIDs = append(rootfs.DiffIDs[:keep], diffID)
+
+	// The history of the kept layers goes on until the entry of the next layer
+	kept, layers := 0, 0
+	for ; kept < len(history); kept++ {
+		var entry struct {
+			EmptyLayer bool `json:"empty_layer"`
+		}
+		json.Unmarshal(history[kept], &entry)
+		if !entry.EmptyLayer {
+			if layers == keep {
+				break
+			}
+			layers++
+		}
+	}
+
+	squashed, err := json.Marshal(map[string]string{
+		"created":    time.Now().UTC().Format(time.RFC3339Nano),
+		"created_by": createdBy,
+		"comment":    fmt.Sprintf("rocker squashed %d layers", len(history)-kept),
+	})
+	if err != nil {
+		return nil, err
+	}
+	history = append(history[:kept], squashed)
+
+	if config["rootfs"], err = json.Marshal(rootfs); err != nil {
+		return nil, err
+	}
+	if config["history"], err = json.Marshal(history); err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(config)
+}
+
+// squashLayers writes the layers, given from the bottom one, as a single layer.
+// The first pass finds the layer each path ends up from, following the whiteouts,
+// the second one copies the entries. Whiteouts are kept since the deleted paths
+// may come from the layers below the squashed ones
+func squashLayers(layers []string, out io.Writer) error {
+	var (
+		entries   = map[string]int{}
+		whiteouts = map[string]int{}
+		// parents are the directories anything was seen in, so most
+		// files do not need to look for the entries below them
+		parents = map[string]bool{}
+	)
+
+	// removeUnder forgets what the layers below the given one have in the directory
+	removeUnder := func(dir string, layer int) {
+		if dir != "" && !parents[dir] {
+			return
+		}
+		prefix := dir + "/"
+		for _, m := range []map[string]int{entries, whiteouts} {
+			for name, l := range m {
+				if l < layer && (dir == "" || strings.HasPrefix(name, prefix)) {
+					delete(m, name)
+				}
+			}
+		}
+	}
+
+	for k, layer := range layers {
+		err := readLayer(layer, func(hdr *tar.Header, r io.Reader) error {
+			name := cleanLayerPath(hdr.Name)
+			if name == "" {
+				return nil
+			}
+			dir, base := path.Split(name)
+			dir = strings.TrimSuffix(dir, "/")
+			for p := dir; p != "" && !parents[p]; p = path.Dir(p) {
+				parents[p] = true
+				if !strings.Contains(p, "/") {
+					break
+				}
+			}
+
+			switch {
+			case base == whiteoutOpaque:
+				removeUnder(dir, k)
+				whiteouts[name] = k
+			case strings.HasPrefix(base, whiteoutPrefix):
+				target := path.Join(dir, strings.TrimPrefix(base, whiteoutPrefix))
+				delete(entries, target)
+				removeUnder(target, k)
+				whiteouts[name] = k
+			default:
+				if hdr.Typeflag != tar.TypeDir {
+					removeUnder(name, k)
+				}
+				entries[name] = k
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	tw := tar.NewWriter(out)
+
+	for k, layer := range layers {
+		err := readLayer(layer, func(hdr *tar.Header, r io.Reader) error {
+			name := cleanLayerPath(hdr.Name)
+			if l, ok := entries[name]; !ok || l != k {
+				if l, ok := whiteouts[name]; !ok || l != k {
+					return nil
+				}
+			}
+			if err := tw.WriteHeader(hdr); err != nil {
+				return err
+			}
+			_, err := io.Copy(tw, r)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return tw.Close()
+}
+
+// readLayer calls fn for every entry of the layer tar, which may be gzipped
+func readLayer(file string, fn func(hdr *tar.Header, r io.Reader) error) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var (
+		br           = bufio.NewReader(f)
+		in io.Reader = br
+	)
+	if magic, err := br.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		in = gz
+	}
+
+	tr := tar.NewReader(in)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("Failed to read layer %s, error: %s", filepath.Base(file), err)
+		}
+		if err := fn(hdr, tr); err != nil {
+			return err
+		}
+	}
+}
+
+// cleanLayerPath makes the paths of the layer entries comparable: ./a/b/ is a/b
+func cleanLayerPath(name string) string {
+	return strings.Trim(path.Clean("/"+name), "/")
+}
+
+// extractSavedImage unpacks the archive of `docker save` to dir
+func extractSavedImage(in io.Reader, dir string) error {
+	tr := tar.NewReader(in)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		name := cleanLayerPath(hdr.Name)
+		if name == "" {
+			continue
+		}
+		dest := filepath.Join(dir, filepath.FromSlash(name))
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(dest, 0755); err != nil {
+				return err
+			}
+		case tar.TypeReg, tar.TypeRegA:
+			if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+				return err
+			}
+			f, err := os.Create(dest)
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(f, tr)
+			if closeErr := f.Close(); err == nil {
+				err = closeErr
+			}
+			if err != nil {
+				return err
+			}
+		case tar.TypeSymlink:
+			// Older versions of docker link the layers shared by several images
+			target := path.Join(path.Dir(name), hdr.Linkname)
+			if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+				return err
+			}
+			if err := os.Symlink(filepath.Join(dir, filepath.FromSlash(cleanLayerPath(target))), dest); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// writeLoadArchive writes the files of dir as the archive for `docker load`
+func writeLoadArchive(dir string, files []string, out io.Writer) error {
+	tw := tar.NewWriter(out)
+
+	for _, name := range files {
+		f, err := os.Open(filepath.Join(dir, filepath.FromSlash(name)))
+		if err != nil {
+			return err
+		}
+		info, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return err
+		}
+		hdr := &tar.Header{Name: name, Mode: 0644, Size: info.Size(), ModTime: info.ModTime(), Typeflag: tar.TypeReg}
+		if err := tw.WriteHeader(hdr); err != nil {
+			f.Close()
+			return err
+		}
+		_, err = io.Copy(tw, f)
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	return tw.Close()
+}
+
+func readJSONFile(file string, v interface{}) error {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
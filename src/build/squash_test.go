@@ -0,0 +1,179 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type layerEntry struct {
+	name, content string
+}
+
+func writeTestLayer(t *testing.T, file string, entries ...layerEntry) {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, e := range entries {
+		hdr := &tar.Header{Name: e.name, Mode: 0644, Size: int64(len(e.content)), Typeflag: tar.TypeReg}
+		if e.name[len(e.name)-1] == '/' {
+			hdr = &tar.Header{Name: e.name, Mode: 0755, Typeflag: tar.TypeDir}
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(e.content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(file, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readTestLayer(t *testing.T, data []byte) (names []string, contents map[string]string) {
+	contents = map[string]string{}
+	tr := tar.NewReader(bytes.NewReader(data))
+	for {
+		hdr, err := tr.Next()
+		if err != nil {
+			break
+		}
+		content, _ := ioutil.ReadAll(tr)
+		names = append(names, hdr.Name)
+		contents[hdr.Name] = string(content)
+	}
+	return names, contents
+}
+
+func TestSquashLayers(t *testing.T) {
+	tmpDir := makeTmpDir(t, map[string]string{})
+	defer os.RemoveAll(tmpDir)
+
+	l1, l2 := filepath.Join(tmpDir, "l1.tar"), filepath.Join(tmpDir, "l2.tar")
+
+	writeTestLayer(t, l1,
+		layerEntry{"a/", ""},
+		layerEntry{"a/x", "1"},
+		layerEntry{"b", "b"},
+		layerEntry{"c/", ""},
+		layerEntry{"c/y", "y"},
+		layerEntry{"tmp/", ""},
+		layerEntry{"tmp/junk", "junk"},
+	)
+	writeTestLayer(t, l2,
+		layerEntry{"a/x", "2"},
+		layerEntry{".wh.b", ""},
+		layerEntry{"c/.wh..wh..opq", ""},
+		layerEntry{"c/z", "z"},
+		layerEntry{".wh.tmp", ""},
+		layerEntry{"etc/.wh.base.conf", ""},
+	)
+
+	var buf bytes.Buffer
+	if err := squashLayers([]string{l1, l2}, &buf); err != nil {
+		t.Fatal(err)
+	}
+
+	names, contents := readTestLayer(t, buf.Bytes())
+	assert.Equal(t, []string{"a/", "c/", "a/x", ".wh.b", "c/.wh..wh..opq", "c/z", ".wh.tmp", "etc/.wh.base.conf"}, names)
+	assert.Equal(t, "2", contents["a/x"])
+}
+
+func TestSquashSavedImage(t *testing.T) {
+	tmpDir := makeTmpDir(t, map[string]string{})
+	defer os.RemoveAll(tmpDir)
+
+	writeTestLayer(t, filepath.Join(tmpDir, "base/layer.tar"), layerEntry{"bin/sh", "sh"})
+	writeTestLayer(t, filepath.Join(tmpDir, "run1/layer.tar"), layerEntry{"app", "1"})
+	writeTestLayer(t, filepath.Join(tmpDir, "run2/layer.tar"), layerEntry{"app", "2"})
+
+	config := `{"architecture":"amd64","config":{"Cmd":["app"]},"os":"linux",` +
+		`"rootfs":{"type":"layers","diff_ids":["sha256:base","sha256:run1","sha256:run2"]},` +
+		`"history":[{"created_by":"ADD base"},{"created_by":"CMD sh","empty_layer":true},{"created_by":"RUN 1"},{"created_by":"RUN 2"}]}`
+	manifest := `[{"Config":"old.json","RepoTags":null,"Layers":["base/layer.tar","run1/layer.tar","run2/layer.tar"]}]`
+
+	if err := ioutil.WriteFile(filepath.Join(tmpDir, "old.json"), []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(tmpDir, "manifest.json"), []byte(manifest), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	id, files, err := squashSavedImage(tmpDir, 1, "SQUASH")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	newConfig, err := ioutil.ReadFile(filepath.Join(tmpDir, files[1]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(newConfig)
+	assert.Equal(t, "sha256:"+hex.EncodeToString(sum[:]), id)
+	assert.Equal(t, []string{"manifest.json", files[1], "base/layer.tar", squashedLayerFile}, files)
+
+	var parsed struct {
+		Config struct{ Cmd []string }
+		RootFS struct {
+			DiffIDs []string `json:"diff_ids"`
+		} `json:"rootfs"`
+		History []struct {
+			CreatedBy  string `json:"created_by"`
+			EmptyLayer bool   `json:"empty_layer"`
+		}
+	}
+	if err := json.Unmarshal(newConfig, &parsed); err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, []string{"app"}, parsed.Config.Cmd)
+	assert.Len(t, parsed.RootFS.DiffIDs, 2)
+	assert.Equal(t, "sha256:base", parsed.RootFS.DiffIDs[0])
+
+	createdBy := []string{}
+	for _, h := range parsed.History {
+		createdBy = append(createdBy, h.CreatedBy)
+	}
+	assert.Equal(t, []string{"ADD base", "CMD sh", "SQUASH"}, createdBy)
+
+	squashed, err := ioutil.ReadFile(filepath.Join(tmpDir, squashedLayerFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	layerSum := sha256.Sum256(squashed)
+	assert.Equal(t, "sha256:"+hex.EncodeToString(layerSum[:]), parsed.RootFS.DiffIDs[1])
+
+	names, contents := readTestLayer(t, squashed)
+	assert.Equal(t, []string{"app"}, names)
+	assert.Equal(t, "2", contents["app"])
+}
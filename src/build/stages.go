@@ -0,0 +1,258 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"archive/tar"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+var stageNameRegexp = regexp.MustCompile(`^[a-z][a-z0-9_.-]*$`)
+
+// fromArgs splits the arguments of "FROM image [AS name]" into the image
+// and the stage name, which is empty for unnamed stages
+func fromArgs(args []string) (image, stage string, err error) {
+	switch {
+	case len(args) == 1:
+		return args[0], "", nil
+	case len(args) == 3 && strings.EqualFold(args[1], "as"):
+		stage = strings.ToLower(args[2])
+		if !stageNameRegexp.MatchString(stage) {
+			return "", "", fmt.Errorf("FROM: invalid stage name %q, it should start with a letter and contain only letters, digits, '_', '-' and '.'", args[2])
+		}
+		return args[0], stage, nil
+	}
+	return "", "", fmt.Errorf("FROM requires one argument, or three in the form of FROM image AS name")
+}
+
+// copyFrom implements COPY --from: the files are taken from the image of
+// a previous named stage, or from any image, instead of the context
+func copyFrom(ctx context.Context, b *Build, args []string, from, chown string) (s State, err error) {
+
+	s = b.state
+
+	source, err := b.copySource(ctx, from)
+	if err != nil {
+		return s, err
+	}
+
+	var (
+		src  = append([]string{}, args[0:len(args)-1]...)
+		dest = filepath.FromSlash(args[len(args)-1]) // last one is always the dest
+	)
+
+	// If destination is not a directory (no trailing slash)
+	hasTrailingSlash := strings.HasSuffix(dest, string(os.PathSeparator))
+	if !hasTrailingSlash && len(src) > 1 {
+		return s, fmt.Errorf("When using COPY with more than one source file, the destination must be a directory and end with a /")
+	}
+
+	if !filepath.IsAbs(dest) {
+		dest = filepath.Join(s.Config.WorkingDir, dest)
+		// Add the trailing slash back if we had it before
+		if hasTrailingSlash {
+			dest += string(os.PathSeparator)
+		}
+	}
+
+	for i, p := range src {
+		if containsWildcards(p) {
+			return s, fmt.Errorf("COPY --from does not support wildcards, got %s", p)
+		}
+		// Like in Docker, the paths are relative to the root of the image
+		src[i] = filepath.Join("/", p)
+	}
+
+	// The image is the content, so it is what the cache key depends on
+	message := fmt.Sprintf("COPY --from=%s%s %s to %s", source.ImageID, chownFlag(chown), strings.Join(src, " "), dest)
+	s.Commit("%s", message)
+
+	// Check cache
+	s, hit, err := b.probeCache(ctx, s)
+	if err != nil {
+		return s, err
+	}
+	if hit {
+		return s, nil
+	}
+
+	b.log.Infof("| Copy from %s (image %.12s)", from, source.ImageID)
+
+	// The container is never started, but images without CMD and ENTRYPOINT
+	// cannot be created without a command
+	source.Config.Cmd = []string{"/bin/sh", "-c", "#(nop) " + message}
+
+	srcContainerID, err := b.client.CreateContainer(source)
+	if err != nil {
+		return s, err
+	}
+	defer func() {
+		if err := b.client.RemoveContainer(srcContainerID); err != nil {
+			b.log.Errorf("Failed to remove temporary container %.12s, error: %s", srcContainerID, err)
+		}
+	}()
+
+	origCmd := s.Config.Cmd
+	s.Config.Cmd = []string{"/bin/sh", "-c", "#(nop) " + message}
+
+	if s.NoCache.ContainerID, err = b.client.CreateContainer(s); err != nil {
+		return s, err
+	}
+
+	s.Config.Cmd = origCmd
+
+	// Names are resolved in the image the files are copied to
+	own, err := resolveChown(b, s.NoCache.ContainerID, chown)
+	if err != nil {
+		return s, err
+	}
+
+	for _, p := range src {
+		pipeReader, pipeWriter := io.Pipe()
+		errch := make(chan error, 1)
+
+		go func(p string) {
+			err := b.client.DownloadFromContainer(srcContainerID, p, pipeWriter)
+			pipeWriter.CloseWithError(err)
+			errch <- err
+		}(p)
+
+		// Entries are renamed to the destination, so the upload goes to "/",
+		// the same way as COPY from the context does
+		uploadReader, uploadWriter := io.Pipe()
+		go func() {
+			uploadWriter.CloseWithError(retargetTar(pipeReader, uploadWriter, dest))
+		}()
+
+		err = b.client.UploadToContainer(s.NoCache.ContainerID, chownStream(uploadReader, own), "/")
+		uploadReader.CloseWithError(err)
+		pipeReader.CloseWithError(err)
+
+		if downloadErr := <-errch; downloadErr != nil {
+			return s, downloadErr
+		}
+		if err != nil {
+			return s, err
+		}
+	}
+
+	return s, nil
+}
+
+// copySource returns the state to take the files of COPY --from from: either
+// a previous named stage, or an image, which is pulled if needed
+func (b *Build) copySource(ctx context.Context, name string) (State, error) {
+	if stage, ok := b.stages[strings.ToLower(name)]; ok {
+		if stage.ImageID == "" {
+			return stage, fmt.Errorf("COPY --from: stage %s has no image to copy from", name)
+		}
+		return stage, nil
+	}
+
+	img, err := b.lookupImage(ctx, name)
+	if err != nil {
+		return State{}, fmt.Errorf("COPY --from: %s", err)
+	}
+	if img == nil {
+		return State{}, fmt.Errorf("COPY --from: there is no stage or image named %s", name)
+	}
+
+	s := State{ImageID: img.ID}
+	if img.Config != nil {
+		s.Config = *img.Config
+	}
+
+	return s, nil
+}
+
+// retargetTar rewrites the archive of a path downloaded from a container,
+// whose entries start with the base name of the path, so that they land at
+// dest: a directory is copied into dest, a file either into dest if it ends
+// with a slash, or as dest itself
+func retargetTar(r io.Reader, w io.Writer, dest string) error {
+	var (
+		tr      = tar.NewReader(r)
+		tw      = tar.NewWriter(w)
+		destDir = strings.HasSuffix(dest, "/")
+		base    string
+		isDir   bool
+	)
+
+	dest = path.Clean(filepath.ToSlash(dest))
+
+	rename := func(name string) string {
+		name = strings.TrimSuffix(name, "/")
+
+		rel := ""
+		if i := strings.Index(name, "/"); i >= 0 {
+			rel = name[i+1:]
+		}
+
+		target := dest
+		switch {
+		case isDir:
+			target = path.Join(dest, rel)
+		case destDir:
+			target = path.Join(dest, base)
+		}
+
+		return strings.TrimPrefix(target, "/")
+	}
+
+	for i := 0; ; i++ {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		if i == 0 {
+			base = strings.TrimSuffix(hdr.Name, "/")
+			isDir = hdr.Typeflag == tar.TypeDir
+		}
+
+		hdr.Name = rename(hdr.Name)
+		if hdr.Name == "" {
+			// The directory is copied into the root, which is there already
+			continue
+		}
+		if hdr.Typeflag == tar.TypeDir {
+			hdr.Name += "/"
+		}
+		if hdr.Typeflag == tar.TypeLink {
+			hdr.Linkname = rename(hdr.Linkname)
+		}
+
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if _, err := io.Copy(tw, tr); err != nil {
+			return err
+		}
+	}
+
+	return tw.Close()
+}
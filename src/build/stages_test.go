@@ -0,0 +1,235 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"io"
+	"testing"
+
+	"github.com/grammarly/rocker/src/imagename"
+
+	"github.com/fsouza/go-dockerclient"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestFromArgs(t *testing.T) {
+	tests := []struct {
+		args  []string
+		image string
+		stage string
+		err   bool
+	}{
+		{[]string{"ubuntu"}, "ubuntu", "", false},
+		{[]string{"golang:1.7", "AS", "builder"}, "golang:1.7", "builder", false},
+		{[]string{"golang:1.7", "as", "Build-1.x"}, "golang:1.7", "build-1.x", false},
+		{[]string{"golang:1.7", "AS", "1st"}, "", "", true},
+		{[]string{"golang:1.7", "builder"}, "", "", true},
+		{[]string{}, "", "", true},
+	}
+
+	for _, tt := range tests {
+		image, stage, err := fromArgs(tt.args)
+		if tt.err {
+			assert.Error(t, err, "%v", tt.args)
+			continue
+		}
+		assert.NoError(t, err, "%v", tt.args)
+		assert.Equal(t, tt.image, image)
+		assert.Equal(t, tt.stage, stage)
+	}
+}
+
+func TestRetargetTar(t *testing.T) {
+	tests := []struct {
+		entries  []string
+		dest     string
+		expected []string
+	}{
+		{[]string{"dist/", "dist/a", "dist/sub/", "dist/sub/b"}, "/srv", []string{"srv/", "srv/a", "srv/sub/", "srv/sub/b"}},
+		{[]string{"dist/", "dist/a"}, "/", []string{"a"}},
+		{[]string{"tool"}, "/usr/local/bin/", []string{"usr/local/bin/tool"}},
+		{[]string{"tool"}, "/usr/local/bin/app", []string{"usr/local/bin/app"}},
+	}
+
+	for _, tt := range tests {
+		var out bytes.Buffer
+		if err := retargetTar(makeTar(t, tt.entries), &out, tt.dest); err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, tt.expected, tarNames(t, &out), "%v to %s", tt.entries, tt.dest)
+	}
+}
+
+func TestCommandFrom_Stage(t *testing.T) {
+	b, c := makeBuild(t, "", Config{})
+	b.stages["builder"] = State{ImageID: "111"}
+
+	cmd := NewCommand(ConfigCommand{
+		name: "from",
+		args: []string{"builder", "AS", "test"},
+	})
+
+	c.On("InspectImage", "111").Return(&docker.Image{ID: "111"}, nil).Once()
+
+	state, err := cmd.Execute(context.Background(), b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.AssertExpectations(t)
+	assert.Equal(t, "111", state.ImageID)
+	assert.Equal(t, "test", b.stage)
+
+	// The stage is saved when it is over
+	b.state = state
+	b.state.ImageID = "222"
+	if _, err := (&CommandCleanup{}).Execute(context.Background(), b); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "222", b.stages["test"].ImageID)
+	assert.Equal(t, "", b.stage)
+
+	_, err = NewCommand(ConfigCommand{name: "from", args: []string{"alpine", "AS", "test"}}).Execute(context.Background(), b)
+	assert.EqualError(t, err, "FROM: duplicate stage name test")
+}
+
+func TestCommandCopy_FromStage(t *testing.T) {
+	b, c := makeBuild(t, "", Config{})
+	b.stages["builder"] = State{ImageID: "111"}
+	b.state.ImageID = "123"
+
+	cmd := NewCommand(ConfigCommand{
+		name:  "copy",
+		args:  []string{"app/tool", "/usr/local/bin/"},
+		flags: map[string]string{"from": "builder"},
+	})
+
+	c.On("CreateContainer", mock.AnythingOfType("State")).Return("src", nil).Once()
+	c.On("CreateContainer", mock.AnythingOfType("State")).Return("dst", nil).Once()
+	c.On("DownloadFromContainer", "src", "/app/tool", mock.Anything).Return(nil).Run(func(args mock.Arguments) {
+		io.Copy(args.Get(2).(io.Writer), makeTar(t, []string{"tool"}))
+	}).Once()
+	c.On("UploadToContainer", "dst", mock.Anything, "/").Return(nil).Run(func(args mock.Arguments) {
+		assert.Equal(t, []string{"usr/local/bin/tool"}, tarNames(t, args.Get(1).(io.Reader)))
+	}).Once()
+	c.On("RemoveContainer", "src").Return(nil).Once()
+
+	state, err := cmd.Execute(context.Background(), b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.AssertExpectations(t)
+	assert.Equal(t, "COPY --from=111 /app/tool to /usr/local/bin/", state.GetCommits())
+	assert.Equal(t, "dst", state.NoCache.ContainerID)
+}
+
+func TestCommandCopy_FromImage(t *testing.T) {
+	b, c := makeBuild(t, "", Config{})
+	b.state.ImageID = "123"
+
+	cmd := NewCommand(ConfigCommand{
+		name:  "copy",
+		args:  []string{"/bin/", "/opt/busybox"},
+		flags: map[string]string{"from": "busybox:1.25"},
+	})
+
+	c.On("InspectImage", "busybox:1.25").Return(&docker.Image{ID: "999"}, nil).Once()
+	c.On("CreateContainer", mock.AnythingOfType("State")).Return("src", nil).Run(func(args mock.Arguments) {
+		assert.Equal(t, "999", args.Get(0).(State).ImageID)
+	}).Once()
+	c.On("CreateContainer", mock.AnythingOfType("State")).Return("dst", nil).Once()
+	c.On("DownloadFromContainer", "src", "/bin", mock.Anything).Return(nil).Run(func(args mock.Arguments) {
+		io.Copy(args.Get(2).(io.Writer), makeTar(t, []string{"bin/", "bin/sh"}))
+	}).Once()
+	c.On("UploadToContainer", "dst", mock.Anything, "/").Return(nil).Run(func(args mock.Arguments) {
+		assert.Equal(t, []string{"opt/busybox/", "opt/busybox/sh"}, tarNames(t, args.Get(1).(io.Reader)))
+	}).Once()
+	c.On("RemoveContainer", "src").Return(nil).Once()
+
+	state, err := cmd.Execute(context.Background(), b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.AssertExpectations(t)
+	assert.Equal(t, "COPY --from=999 /bin to /opt/busybox", state.GetCommits())
+}
+
+func TestCommandCopy_FromNotFound(t *testing.T) {
+	var (
+		nilImage *docker.Image
+
+		b, c = makeBuild(t, "", Config{})
+	)
+
+	cmd := NewCommand(ConfigCommand{
+		name:  "copy",
+		args:  []string{"/app", "/app"},
+		flags: map[string]string{"from": "builder"},
+	})
+
+	c.On("InspectImage", "builder:latest").Return(nilImage, nil).Once()
+	c.On("ListImages").Return([]*imagename.ImageName{}, nil).Once()
+	c.On("ListImageTags", "builder:latest").Return([]*imagename.ImageName{}, nil).Once()
+
+	_, err := cmd.Execute(context.Background(), b)
+	assert.EqualError(t, err, "COPY --from: Image not found: builder:latest (also checked in the remote registry)")
+}
+
+func makeTar(t *testing.T, names []string) io.Reader {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, name := range names {
+		hdr := &tar.Header{Name: name, Mode: 0644, Typeflag: tar.TypeReg, Size: int64(len(name))}
+		if name[len(name)-1] == '/' {
+			hdr.Typeflag = tar.TypeDir
+			hdr.Mode = 0755
+			hdr.Size = 0
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if hdr.Typeflag == tar.TypeReg {
+			tw.Write([]byte(name))
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return &buf
+}
+
+func tarNames(t *testing.T, r io.Reader) []string {
+	names := []string{}
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, hdr.Name)
+	}
+	return names
+}
@@ -21,6 +21,8 @@ import (
 	"sort"
 	"strings"
 
+	"github.com/grammarly/rocker/src/dockerclient"
+
 	"github.com/fsouza/go-dockerclient"
 )
 
@@ -39,6 +41,14 @@ type State struct {
 	ParentSize int64
 	Size       int64
 
+	// Healthcheck is set by HEALTHCHECK, it belongs to the image config
+	// but the client library does not support it
+	Healthcheck *dockerclient.HealthConfig
+
+	// Shell is set by SHELL for the shell form of RUN, CMD and ENTRYPOINT,
+	// it is a part of the image config unknown to the client library too
+	Shell []string
+
 	NoCache StateNoCache
 }
 
@@ -78,6 +88,15 @@ func (s State) GetCommits() string {
 	return strings.Join(s.Commits, "; ")
 }
 
+// shell returns the shell of the shell form commands, a new slice
+// so the command can be appended to it
+func (s State) shell() []string {
+	if len(s.Shell) == 0 {
+		return []string{"/bin/sh", "-c"}
+	}
+	return append([]string{}, s.Shell...)
+}
+
 // Equals returns true if the two states are equal
 // NOTE: we identify unique commands by commits, so state uniqueness is simply a commit
 func (s State) Equals(s2 State) bool {
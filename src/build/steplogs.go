@@ -0,0 +1,252 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// DefaultStepLogLimit is the amount of the step output kept in memory
+const DefaultStepLogLimit = 64 * 1024
+
+// StepLogUploader stores the step logs that go to a remote location,
+// the S3 storage driver implements it
+type StepLogUploader interface {
+	Upload(url string, r io.Reader) error
+}
+
+// StepLogRecord describes the captured output of a single step
+type StepLogRecord struct {
+	Step      string
+	Location  string
+	Size      int64
+	Tail      []byte
+	Truncated bool
+}
+
+// StepLogs captures the output of the containers step by step. Only the last
+// Limit bytes of every step stay in memory, so massive output of tests does not
+// blow up the memory; the full output is streamed to a file in Dir if it is set.
+// Dir may also be an s3://bucket/prefix url, then the file is uploaded when
+// the step is finished.
+type StepLogs struct {
+	Dir      string
+	Limit    int
+	Uploader StepLogUploader
+	Redact   func(string) string
+
+	mu      sync.Mutex
+	current *stepLog
+	records []StepLogRecord
+}
+
+type stepLog struct {
+	n         int
+	step      string
+	file      *os.File
+	size      int64
+	tail      []byte
+	truncated bool
+	err       error
+}
+
+// Begin starts capturing the output of the n-th step
+func (l *StepLogs) Begin(n int, step string) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.current = &stepLog{n: n, step: step}
+}
+
+// Write captures the container output of the current step; the output
+// that comes between the steps is not captured
+func (l *StepLogs) Write(p []byte) (int, error) {
+	if l == nil {
+		return len(p), nil
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	s := l.current
+	if s == nil {
+		return len(p), nil
+	}
+
+	data := p
+	if l.Redact != nil {
+		data = []byte(l.Redact(string(p)))
+	}
+
+	// Failing to save the log should not break the container output,
+	// the error is reported by End
+	if l.Dir != "" && s.err == nil {
+		if s.file == nil {
+			s.file, s.err = l.createFile(s)
+		}
+		if s.err == nil {
+			if _, err := s.file.Write(data); err != nil {
+				s.err = fmt.Errorf("Failed to write the log of step %d, error: %s", s.n, err)
+			}
+		}
+	}
+
+	s.size += int64(len(data))
+
+	if l.Limit > 0 {
+		s.tail = append(s.tail, data...)
+		// Trim lazily to not move the tail around on every write
+		if len(s.tail) > 2*l.Limit {
+			s.tail = append(s.tail[:0], s.tail[len(s.tail)-l.Limit:]...)
+			s.truncated = true
+		}
+	}
+
+	return len(p), nil
+}
+
+// End finishes capturing the current step and returns the location
+// of its full log, if the step produced any output and it was saved
+func (l *StepLogs) End() (location string, err error) {
+	if l == nil {
+		return "", nil
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	s := l.current
+	l.current = nil
+
+	if s == nil || s.size == 0 {
+		return "", nil
+	}
+	if s.err != nil {
+		if s.file != nil {
+			s.file.Close()
+			if l.isRemote() {
+				os.Remove(s.file.Name())
+			}
+		}
+		return "", s.err
+	}
+
+	record := StepLogRecord{
+		Step:      s.step,
+		Size:      s.size,
+		Tail:      s.tail,
+		Truncated: s.truncated,
+	}
+	if l.Limit > 0 && len(s.tail) > l.Limit {
+		record.Tail = s.tail[len(s.tail)-l.Limit:]
+		record.Truncated = true
+	}
+
+	if s.file != nil {
+		if record.Location, err = l.finishFile(s); err != nil {
+			return "", err
+		}
+	}
+
+	l.records = append(l.records, record)
+
+	return record.Location, nil
+}
+
+// Records returns the captured steps that produced any output
+func (l *StepLogs) Records() []StepLogRecord {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]StepLogRecord{}, l.records...)
+}
+
+// Locations returns where the full logs of the steps are saved
+func (l *StepLogs) Locations() []string {
+	var locations []string
+	for _, record := range l.Records() {
+		if record.Location != "" {
+			locations = append(locations, record.Location)
+		}
+	}
+	return locations
+}
+
+func (l *StepLogs) isRemote() bool {
+	return strings.HasPrefix(l.Dir, "s3://")
+}
+
+func (l *StepLogs) fileName(s *stepLog) string {
+	return fmt.Sprintf("step-%03d.log", s.n)
+}
+
+func (l *StepLogs) createFile(s *stepLog) (*os.File, error) {
+	if l.isRemote() {
+		f, err := ioutil.TempFile("", "rocker-step-log-")
+		if err != nil {
+			return nil, fmt.Errorf("Failed to create a temporary file for the log of step %d, error: %s", s.n, err)
+		}
+		return f, nil
+	}
+
+	if err := os.MkdirAll(l.Dir, 0755); err != nil {
+		return nil, fmt.Errorf("Failed to create directory %s for the step logs, error: %s", l.Dir, err)
+	}
+
+	f, err := os.Create(filepath.Join(l.Dir, l.fileName(s)))
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create the log of step %d, error: %s", s.n, err)
+	}
+	return f, nil
+}
+
+func (l *StepLogs) finishFile(s *stepLog) (string, error) {
+	if !l.isRemote() {
+		if err := s.file.Close(); err != nil {
+			return "", err
+		}
+		return s.file.Name(), nil
+	}
+
+	defer os.Remove(s.file.Name())
+	defer s.file.Close()
+
+	if l.Uploader == nil {
+		return "", fmt.Errorf("Cannot upload the log of step %d to %s, no uploader configured", s.n, l.Dir)
+	}
+
+	if _, err := s.file.Seek(0, 0); err != nil {
+		return "", err
+	}
+
+	url := strings.TrimSuffix(l.Dir, "/") + "/" + l.fileName(s)
+	if err := l.Uploader.Upload(url, s.file); err != nil {
+		return "", err
+	}
+
+	return url, nil
+}
@@ -0,0 +1,131 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type testUploader map[string]string
+
+func (u testUploader) Upload(url string, r io.Reader) error {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	u[url] = string(data)
+	return nil
+}
+
+func TestStepLogs_File(t *testing.T) {
+	tmpDir := makeTmpDir(t, map[string]string{})
+	defer os.RemoveAll(tmpDir)
+
+	logs := &StepLogs{Dir: filepath.Join(tmpDir, "logs"), Limit: 4}
+
+	// Output between the steps is not captured
+	fmt.Fprint(logs, "lost\n")
+
+	logs.Begin(1, "FROM ubuntu")
+	location, err := logs.End()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "", location, "step without output has no log")
+
+	logs.Begin(2, "RUN make test")
+	for i := 0; i < 10; i++ {
+		fmt.Fprintf(logs, "line %d\n", i)
+	}
+	if location, err = logs.End(); err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, filepath.Join(tmpDir, "logs", "step-002.log"), location)
+
+	content, err := ioutil.ReadFile(location)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 70, len(content))
+	assert.True(t, strings.HasPrefix(string(content), "line 0\n"))
+
+	records := logs.Records()
+	assert.Len(t, records, 1)
+	assert.Equal(t, "RUN make test", records[0].Step)
+	assert.Equal(t, int64(70), records[0].Size)
+	assert.Equal(t, "e 9\n", string(records[0].Tail))
+	assert.True(t, records[0].Truncated)
+
+	assert.Equal(t, []string{location}, logs.Locations())
+}
+
+func TestStepLogs_S3(t *testing.T) {
+	uploader := testUploader{}
+	logs := &StepLogs{
+		Dir:      "s3://bucket/logs/",
+		Limit:    DefaultStepLogLimit,
+		Uploader: uploader,
+		Redact: func(s string) string {
+			return strings.Replace(s, "secret", "******", -1)
+		},
+	}
+
+	logs.Begin(3, "RUN make")
+	fmt.Fprint(logs, "token is secret\n")
+	location, err := logs.End()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, "s3://bucket/logs/step-003.log", location)
+	assert.Equal(t, "token is ******\n", uploader[location])
+	assert.False(t, logs.Records()[0].Truncated)
+	assert.Equal(t, "token is ******\n", string(logs.Records()[0].Tail))
+}
+
+func TestStepLogs_MemoryOnly(t *testing.T) {
+	logs := &StepLogs{Limit: 8}
+
+	logs.Begin(1, "RUN make")
+	io.Copy(logs, bytes.NewReader(bytes.Repeat([]byte("x"), 1000)))
+	location, err := logs.End()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, "", location)
+	assert.Len(t, logs.Records()[0].Tail, 8)
+	assert.Nil(t, logs.Locations())
+
+	// A build without step logs does not capture anything
+	var none *StepLogs
+	none.Begin(1, "RUN make")
+	fmt.Fprint(none, "output")
+	location, err = none.End()
+	assert.Equal(t, "", location)
+	assert.Nil(t, err)
+}
@@ -14,6 +14,7 @@ import (
 	"io"
 	"os"
 	"strings"
+	"time"
 
 	"github.com/docker/docker/pkg/system"
 )
@@ -24,6 +25,9 @@ type tarAppender struct {
 
 	// for hardlink mapping
 	SeenFiles map[uint64]string
+
+	// Epoch is set for --reproducible, the entries are normalized with it
+	Epoch *time.Time
 }
 
 // canonicalTarName provides a platform-independent and consistent posix-style
@@ -91,6 +95,10 @@ func (ta *tarAppender) addTarFile(path, name string) error {
 		hdr.Xattrs["security.capability"] = string(capability)
 	}
 
+	if ta.Epoch != nil {
+		normalizeUploadHeader(hdr, *ta.Epoch)
+	}
+
 	if err := ta.TarWriter.WriteHeader(hdr); err != nil {
 		return err
 	}
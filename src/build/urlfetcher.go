@@ -26,6 +26,10 @@ import (
 	"net/url"
 	"os"
 	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/pkg/units"
 
 	log "github.com/Sirupsen/logrus"
 )
@@ -221,11 +225,20 @@ func (info *URLInfo) download() (err error) {
 	}
 	defer f.Close()
 
-	n, err := io.Copy(f, response.Body)
+	progress := &downloadProgress{
+		reader: response.Body,
+		url:    info.URL,
+		total:  response.ContentLength,
+		last:   time.Now(),
+	}
+
+	n, err := io.Copy(f, progress)
 	if err != nil {
 		return err
 	}
 
+	log.Infof("| Downloaded %s (%s)", info.URL, units.HumanSize(float64(n)))
+
 	info.Size = n
 
 	if etag := response.Header.Get("Etag"); etag != "" {
@@ -243,6 +256,32 @@ func (info *URLInfo) download() (err error) {
 	return nil
 }
 
+// VerifyChecksum checks the downloaded file against the checksum in the
+// form of sha256:<hex>, as given to ADD --checksum
+func (info *URLInfo) VerifyChecksum(checksum string) error {
+	parts := strings.SplitN(checksum, ":", 2)
+	if len(parts) != 2 || parts[0] != "sha256" || len(parts[1]) != sha256.Size*2 {
+		return WithExitCode(ExitUser, fmt.Errorf("Invalid checksum %s, expected sha256:<hex>", checksum))
+	}
+
+	f, err := os.Open(info.FileName)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return err
+	}
+
+	if actual := fmt.Sprintf("%x", h.Sum(nil)); actual != strings.ToLower(parts[1]) {
+		return WithExitCode(ExitPolicy, fmt.Errorf("Checksum mismatch for %s: expected %s, got sha256:%s", info.URL, checksum, actual))
+	}
+
+	return nil
+}
+
 func (info *URLInfo) load() (ok bool, err error) {
 	fileName := info.getInfoFileName()
 
@@ -279,3 +318,35 @@ func (info *URLInfo) dump() (data string, err error) {
 	data0, err := json.Marshal(info)
 	return string(data0), err
 }
+
+// downloadProgressInterval is how often the progress of a download is reported
+var downloadProgressInterval = 5 * time.Second
+
+// downloadProgress reports how much of the url is downloaded while it is read
+type downloadProgress struct {
+	reader io.Reader
+	url    string
+	total  int64
+	done   int64
+	last   time.Time
+}
+
+func (p *downloadProgress) Read(data []byte) (n int, err error) {
+	n, err = p.reader.Read(data)
+	p.done += int64(n)
+
+	if time.Since(p.last) >= downloadProgressInterval && err == nil {
+		p.last = time.Now()
+		log.Infof("| Downloading %s %s", p.url, p.String())
+	}
+
+	return n, err
+}
+
+func (p *downloadProgress) String() string {
+	done := units.HumanSize(float64(p.done))
+	if p.total <= 0 {
+		return done
+	}
+	return fmt.Sprintf("%s of %s (%d%%)", done, units.HumanSize(float64(p.total)), p.done*100/p.total)
+}
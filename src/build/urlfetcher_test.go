@@ -25,9 +25,18 @@ import (
 	"net/http/httptest"
 	"net/url"
 	"os"
+	"strings"
 	"testing"
 )
 
+func TestURLFetcher_DownloadProgress(t *testing.T) {
+	p := &downloadProgress{total: 2000, done: 500}
+	assert.Equal(t, "500 B of 2 kB (25%)", p.String())
+
+	p = &downloadProgress{total: -1, done: 500}
+	assert.Equal(t, "500 B", p.String())
+}
+
 func TestURLFetcher_Get_Basic(t *testing.T) {
 
 	tf := makeTempFetcher(t, false)
@@ -57,6 +66,30 @@ func TestURLFetcher_Get_Basic(t *testing.T) {
 	assert.Equal(t, ui1.Etag, "AAA", "stored info etag should match that of downloaded url")
 }
 
+func TestURLFetcher_VerifyChecksum(t *testing.T) {
+	tf := makeTempFetcher(t, false)
+	defer tf.cleanup()
+
+	tf.files["/install.sh"] = func(r *http.Request) respTuple {
+		return respTuple{200, HM{}, "hello"}
+	}
+
+	ui, err := tf.fetcher.Get("http://someurl/install.sh")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// sha256 of "hello"
+	sum := "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824"
+
+	assert.NoError(t, ui.VerifyChecksum("sha256:"+sum))
+	assert.NoError(t, ui.VerifyChecksum("sha256:"+strings.ToUpper(sum)))
+	assert.EqualError(t, ui.VerifyChecksum("sha256:"+strings.Repeat("0", 64)),
+		"Checksum mismatch for http://someurl/install.sh: expected sha256:"+strings.Repeat("0", 64)+", got sha256:"+sum)
+	assert.EqualError(t, ui.VerifyChecksum("md5:5d41402abc4b2a76b9719d911017c592"),
+		"Invalid checksum md5:5d41402abc4b2a76b9719d911017c592, expected sha256:<hex>")
+}
+
 func TestURLFetcher_Get_CacheHit(t *testing.T) {
 	tf := makeTempFetcher(t, false)
 	defer tf.cleanup()
@@ -0,0 +1,74 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/grammarly/rocker/src/template"
+)
+
+var argDefinition = regexp.MustCompile(`(?i)^\s*ARG\s+([A-Za-z_][A-Za-z0-9_]*)(=(.*))?$`)
+
+// RockerfileVariables lists the template variables and the ARGs that the
+// Rockerfile source references, for documenting parameterized builds. ARGs
+// are found in the source as is, since the template may need the variables;
+// they are never required, an ARG without a default is just empty.
+func RockerfileVariables(name, source string, funs template.Funs) ([]*template.Variable, error) {
+	vars, err := template.Variables(name, source, funs)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		args = []*template.Variable{}
+		refs = map[*template.Variable]*regexp.Regexp{}
+	)
+
+	for i, line := range strings.Split(source, "\n") {
+		location := fmt.Sprintf("%s:%d", name, i+1)
+
+		if match := argDefinition.FindStringSubmatch(strings.TrimSpace(line)); match != nil {
+			var arg *template.Variable
+			for _, a := range args {
+				if a.Name == match[1] {
+					arg = a
+				}
+			}
+			if arg == nil {
+				arg = &template.Variable{Name: match[1], Kind: template.KindArg}
+				args = append(args, arg)
+				refs[arg] = regexp.MustCompile(`\$\{?` + arg.Name + `\b`)
+			}
+			if match[2] != "" && !arg.HasDefault {
+				arg.Default, arg.HasDefault = strings.Trim(strings.TrimSpace(match[3]), `"'`), true
+			}
+			arg.Used = append(arg.Used, location)
+			continue
+		}
+
+		for _, arg := range args {
+			if refs[arg].MatchString(line) {
+				arg.Used = append(arg.Used, location)
+			}
+		}
+	}
+
+	return append(vars, args...), nil
+}
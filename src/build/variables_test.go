@@ -0,0 +1,58 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package build
+
+import (
+	"testing"
+
+	"github.com/grammarly/rocker/src/template"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRockerfileVariables(t *testing.T) {
+	source := `FROM {{ .BaseImage }}
+ARG VERSION=1.0
+ARG TOKEN
+RUN echo $VERSION && curl -H "Authorization: ${TOKEN}" http://example.com
+FROM alpine
+ARG VERSION="2.0"
+RUN echo $VERSIONS
+`
+	vars, err := RockerfileVariables("Rockerfile", source, template.Funs{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Len(t, vars, 3)
+
+	assert.Equal(t, "BaseImage", vars[0].Name)
+	assert.Equal(t, template.KindVar, vars[0].Kind)
+
+	assert.Equal(t, &template.Variable{
+		Name:       "VERSION",
+		Kind:       template.KindArg,
+		Default:    "1.0",
+		HasDefault: true,
+		Used:       []string{"Rockerfile:2", "Rockerfile:4", "Rockerfile:6"},
+	}, vars[1])
+
+	assert.Equal(t, &template.Variable{
+		Name: "TOKEN",
+		Kind: template.KindArg,
+		Used: []string{"Rockerfile:3", "Rockerfile:4"},
+	}, vars[2])
+}
@@ -0,0 +1,300 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package buildcmd implements the commands that build Rockerfiles and pull the
+// images they need: build, verify-reproducible and pull
+package buildcmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"runtime"
+	"time"
+
+	"github.com/grammarly/rocker/src/build"
+	"github.com/grammarly/rocker/src/cliutil"
+	"github.com/grammarly/rocker/src/dockerclient"
+	"github.com/grammarly/rocker/src/spill"
+	"github.com/grammarly/rocker/src/telemetry"
+
+	"github.com/codegangsta/cli"
+	"github.com/docker/docker/pkg/units"
+	"github.com/kr/pretty"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// CommandSpec returns specifications of the build command for codegangsta/cli
+func CommandSpec() cli.Command {
+	return cli.Command{
+		Name:   "build",
+		Usage:  "launches a build for the specified Rockerfile",
+		Action: buildCommand,
+		Flags:  Flags(),
+	}
+}
+
+// VerifyReproducibleCommandSpec returns specifications of the verify-reproducible command for codegangsta/cli
+func VerifyReproducibleCommandSpec() cli.Command {
+	return cli.Command{
+		Name:   "verify-reproducible",
+		Usage:  "builds the Rockerfile twice without cache and reports the first step where the results differ",
+		Action: verifyReproducibleCommand,
+		Flags: append([]cli.Flag{
+			cli.StringFlag{
+				Name:  "second-host",
+				Usage: "docker daemon to run the second build on, by default both builds run on the same one",
+			},
+		}, Flags()...),
+	}
+}
+
+// PullCommandSpec returns specifications of the pull command for codegangsta/cli
+func PullCommandSpec() cli.Command {
+	return cli.Command{
+		Name:   "pull",
+		Usage:  "launches a pull of image (supports s3 storage driver)",
+		Action: pullCommand,
+		Flags: []cli.Flag{
+			cli.StringFlag{
+				Name:  "file, f",
+				Value: "Rockerfile",
+				Usage: "rocker build file to execute",
+			},
+			cli.StringFlag{
+				Name:  "auth, a",
+				Value: "",
+				Usage: "Username and password in user:password format",
+			},
+			cli.StringFlag{
+				Name:  "cache-dir",
+				Value: "~/.rocker_cache",
+				Usage: "Set the directory where the cache will be stored",
+			},
+		},
+	}
+}
+
+// buildCommand implements 'build' command that builds the Rockerfile
+func buildCommand(c *cli.Context) {
+	// Failed builds report the memory too, they exit through cliutil.Exit
+	cliutil.OnExit(logPeakMemory)
+	defer logPeakMemory()
+
+	if c.Bool("offline") {
+		checkOfflineFlags(c)
+	}
+
+	output := c.String("output")
+	if output != "" {
+		checkOutputFlags(c)
+	}
+	if output == "-" {
+		// stdout is taken by the image, everything else goes to stderr
+		log.SetOutput(os.Stderr)
+	}
+
+	rockerfile, contextDir, dockerignore, cleanup := initRockerfile(c)
+	defer cleanup()
+
+	contexts, cleanupContexts := initContexts(c)
+	defer cleanupContexts()
+
+	targets := parseDeployTargets(c)
+	sizeLimit := parseSizeLimit(c)
+
+	if daemons := c.StringSlice("daemon"); len(daemons) > 0 {
+		pushed := buildOnDaemons(c, daemons, rockerfile, contextDir, dockerignore, contexts)
+		deployPushed(c, pushed, targets)
+		return
+	}
+
+	config := dockerclient.NewConfigFromCli(c)
+	builder := newBuilder(c, rockerfile, contextDir, dockerignore, contexts, config, c.Bool("no-cache"), c.Bool("push"))
+	plan := newPlan(c, rockerfile)
+
+	if file := c.String("restore"); file != "" {
+		cp, err := build.ReadCheckpoint(file)
+		if err != nil {
+			cliutil.Exit(build.WithExitCode(build.ExitUser, err))
+		}
+		if err := builder.Restore(cp); err != nil {
+			cliutil.Exit(build.WithExitCode(build.ExitUser, err))
+		}
+		log.Infof("Continue build %s from step %d of %s", cp.BuildID, cp.Next+1, file)
+	}
+
+	if c.Bool("resume") {
+		resume(c, builder, rockerfile, contextDir)
+	}
+
+	if c.Bool("plan") {
+		printPlan(builder, plan)
+		return
+	}
+
+	var reports <-chan *build.Report
+	if c.String("report") != "" {
+		reports = builder.CollectReport()
+	}
+
+	started := time.Now()
+	err := builder.Run(plan)
+
+	// The report is written for the failed builds too, it tells which step failed
+	if reports != nil {
+		if err := (<-reports).WriteFile(c.String("report")); err != nil {
+			log.Error(err)
+		}
+	}
+
+	if endpoint := c.GlobalString("telemetry-endpoint"); endpoint != "" && !c.Bool("offline") {
+		sendTelemetry(endpoint, c.String("backend"), rockerfile, builder, err == nil, time.Since(started))
+	}
+
+	if err != nil {
+		cliutil.Exit(err)
+	}
+
+	fields := log.Fields{}
+	if c.GlobalBool("json") {
+		fields["size"] = builder.VirtualSize
+		fields["delta"] = builder.ProducedSize
+	}
+
+	size := fmt.Sprintf("final size %s (+%s from the base image)",
+		units.HumanSize(float64(builder.VirtualSize)),
+		units.HumanSize(float64(builder.ProducedSize)),
+	)
+
+	log.WithFields(fields).Infof("Successfully built %.12s | %s", builder.GetImageID(), size)
+
+	if previous := c.String("compare-with"); previous != "" {
+		compareWithRelease(c, config, previous, builder.GetImageID(), sizeLimit)
+	}
+
+	if output != "" {
+		saveOutput(builder, output, c.String("output-format"), parseAnnotations(c))
+	}
+
+	deployPushed(c, builder.Pushed, targets)
+}
+
+// verifyReproducibleCommand implements 'verify-reproducible' command that builds the Rockerfile
+// twice and compares the results
+func verifyReproducibleCommand(c *cli.Context) {
+	rockerfile, contextDir, dockerignore, cleanup := initRockerfile(c)
+	defer cleanup()
+
+	contexts, cleanupContexts := initContexts(c)
+	defer cleanupContexts()
+
+	configs := []*dockerclient.Config{
+		dockerclient.NewConfigFromCli(c),
+		dockerclient.NewConfigFromCli(c),
+	}
+	if host := c.String("second-host"); host != "" {
+		configs[1].Host = host
+	}
+
+	builders := make([]*build.Build, len(configs))
+
+	for i, config := range configs {
+		log.Infof("Build %d of %d on %s", i+1, len(configs), config.Host)
+
+		builder := newBuilder(c, rockerfile, contextDir, dockerignore, contexts, config, true, false)
+
+		if err := builder.Run(newPlan(c, rockerfile)); err != nil {
+			cliutil.Exit(err)
+		}
+
+		builders[i] = builder
+	}
+
+	diff, err := build.DiffBuilds(builders[0], builders[1])
+	if err != nil {
+		cliutil.Exit(err)
+	}
+
+	if diff != nil {
+		cliutil.Exitf(build.ExitPolicy, "Builds are not reproducible. %s", diff)
+	}
+
+	log.Infof("Builds are identical, compared %d steps", len(builders[0].Steps))
+}
+
+// pullCommand implements 'pull' command that pulls the image with the registry credentials of rocker
+func pullCommand(c *cli.Context) {
+	args := c.Args()
+	if len(args) < 1 {
+		cliutil.Exitf(build.ExitUser, "rocker pull <image>")
+	}
+
+	dockerClient, err := dockerclient.NewFromCli(c)
+	if err != nil {
+		cliutil.Exit(build.WithExitCode(build.ExitInfra, err))
+	}
+
+	client := cliutil.NewCommandClient(c, dockerClient, cliutil.InitAuth(c))
+
+	if err := client.PullImage(context.Background(), args[0]); err != nil {
+		cliutil.Exit(err)
+	}
+}
+
+// logPeakMemory reports how much memory the build took at most and how much
+// of the budget the buffers used
+func logPeakMemory() {
+	// Sys never shrinks, so it is the peak of what the process has taken from the OS
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+
+	budget := spill.Default.Stats()
+
+	log.WithFields(log.Fields{
+		"memory":        mem.Sys,
+		"buffers_peak":  budget.Peak,
+		"buffers_limit": budget.Limit,
+		"spilled":       budget.Spilled,
+	}).Debugf("Peak memory %s, buffers %s of the %s budget, %s spilled to disk",
+		units.BytesSize(float64(mem.Sys)),
+		units.BytesSize(float64(budget.Peak)),
+		units.BytesSize(float64(budget.Limit)),
+		units.BytesSize(float64(budget.Spilled)),
+	)
+}
+
+// sendTelemetry reports anonymized build stats, failures are only logged
+func sendTelemetry(endpoint, backend string, rockerfile *build.Rockerfile, builder *build.Build, success bool, duration time.Duration) {
+	report := telemetry.Report{
+		Version:     cliutil.Version,
+		OS:          runtime.GOOS,
+		Arch:        runtime.GOARCH,
+		Backend:     backend,
+		Directives:  rockerfile.Directives(),
+		CacheHits:   builder.CacheHits,
+		CacheMisses: builder.CacheMisses,
+		Success:     success,
+		Duration:    duration.Seconds(),
+	}
+
+	log.Debugf("Send telemetry report to %s: %# v", endpoint, pretty.Formatter(report))
+
+	if err := telemetry.Send(endpoint, report); err != nil {
+		log.Debugf("Failed to send telemetry report, error: %s", err)
+	}
+}
@@ -0,0 +1,359 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package buildcmd
+
+import (
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/grammarly/rocker/src/build"
+	"github.com/grammarly/rocker/src/cliutil"
+	"github.com/grammarly/rocker/src/dockerclient"
+	"github.com/grammarly/rocker/src/eol"
+	"github.com/grammarly/rocker/src/features"
+	"github.com/grammarly/rocker/src/redact"
+	"github.com/grammarly/rocker/src/registrypolicy"
+	"github.com/grammarly/rocker/src/storage/s3"
+	"github.com/grammarly/rocker/src/util"
+
+	"github.com/codegangsta/cli"
+	"github.com/fsouza/go-dockerclient"
+
+	log "github.com/Sirupsen/logrus"
+	runconfigopts "github.com/docker/docker/runconfig/opts"
+)
+
+// parseAnnotations reads --annotation, it exits if one is not key=value
+func parseAnnotations(c *cli.Context) map[string]string {
+	annotations, err := dockerclient.ParseAnnotations(c.StringSlice("annotation"))
+	if err != nil {
+		cliutil.Exit(build.WithExitCode(build.ExitUser, err))
+	}
+	return annotations
+}
+
+// newBuilder makes a builder that works with the given docker daemon, it exits
+// if the daemon cannot be reached or is too old. The rest of the options are
+// taken from the command line
+func newBuilder(c *cli.Context, rockerfile *build.Rockerfile, contextDir string, dockerignore []string, contexts map[string]string, config *dockerclient.Config, noCache, push bool) *build.Build {
+	log.Infof("Build ID %s", cliutil.BuildID)
+
+	dockerClient, err := dockerclient.NewFromConfig(config)
+	if err != nil {
+		cliutil.Exit(build.WithExitCode(build.ExitUser, err))
+	}
+
+	// Check the docker connection and agree on the API version before we actually run
+	if err := dockerclient.CheckConnection(dockerClient, config, 5000); err != nil {
+		cliutil.Exit(build.WithExitCode(build.ExitInfra, err))
+	}
+	caps, err := dockerclient.Negotiate(dockerClient)
+	if err != nil {
+		cliutil.Exit(build.WithExitCode(build.ExitInfra, err))
+	}
+	log.Debugf("Docker %s, speak the remote API %s", caps.Version, caps.APIVersion)
+	if caps.Podman {
+		log.Debugf("The daemon is Podman, commits pass the image config as changes")
+	}
+	if dockerclient.IsRootless(config.Host) {
+		log.Debugf("The daemon is rootless, commits do not pause the containers and the files of the context are owned by root")
+	}
+
+	if dockerClient, err = dockerclient.NewVersionedFromConfig(config, caps.APIVersion.String()); err != nil {
+		cliutil.Exit(build.WithExitCode(build.ExitInfra, err))
+	}
+
+	cacheDir, err := util.MakeAbsolute(c.String("cache-dir"))
+	if err != nil {
+		cliutil.Exit(build.WithExitCode(build.ExitUser, err))
+	}
+
+	var routes []build.PushRoute
+	if file := c.String("push-routes"); file != "" {
+		if routes, err = build.LoadPushRoutes(file); err != nil {
+			cliutil.Exit(build.WithExitCode(build.ExitUser, err))
+		}
+	}
+
+	auth, err := build.AddPushRoutesAuth(cliutil.InitAuth(c), routes)
+	if err != nil {
+		cliutil.Exit(build.WithExitCode(build.ExitUser, err))
+	}
+	cliutil.RedactAuth(auth)
+
+	buildArgs := runconfigopts.ConvertKVStringsToMap(c.StringSlice("build-arg"))
+	sensitiveBuildArgs := map[string]bool{}
+	for _, name := range c.StringSlice("sensitive-build-arg") {
+		sensitiveBuildArgs[name] = true
+		if value := buildArgs[name]; value != "" {
+			cliutil.Redactor.Add(value)
+		}
+	}
+
+	labels := builderLabels(c, dockerClient)
+	if allow := c.StringSlice("provenance-label"); len(allow) > 0 {
+		provenance, err := build.ProvenanceLabels(allow, buildArgs, sensitiveBuildArgs, rockerfile.Vars)
+		if err != nil {
+			cliutil.Exit(build.WithExitCode(build.ExitUser, err))
+		}
+		for k, v := range provenance {
+			labels[k] = v
+		}
+	}
+
+	noCacheFor := []build.NoCacheScope{}
+	for _, arg := range c.StringSlice("no-cache-for") {
+		scope, err := build.ParseNoCacheScope(arg)
+		if err != nil {
+			cliutil.Exit(build.WithExitCode(build.ExitUser, err))
+		}
+		noCacheFor = append(noCacheFor, scope)
+	}
+
+	attachInterrupt, err := build.ParseAttachInterrupt(c.String("attach-interrupt"))
+	if err != nil {
+		cliutil.Exit(build.WithExitCode(build.ExitUser, err))
+	}
+
+	var cache build.Cache
+	if !noCache {
+		cache = build.NewCacheFS(cacheDir)
+	}
+
+	var (
+		stdoutContainerFormatter log.Formatter = &log.JSONFormatter{}
+		stderrContainerFormatter log.Formatter = &log.JSONFormatter{}
+	)
+	if !c.GlobalBool("json") {
+		stdoutContainerFormatter = build.NewMonochromeContainerFormatter()
+		stderrContainerFormatter = build.NewColoredContainerFormatter()
+	}
+	stdoutContainerFormatter = &redact.Formatter{Formatter: stdoutContainerFormatter, Redactor: cliutil.Redactor}
+	stderrContainerFormatter = &redact.Formatter{Formatter: stderrContainerFormatter, Redactor: cliutil.Redactor}
+
+	s3storage := s3.New(dockerClient, cacheDir)
+
+	stepLogs := &build.StepLogs{
+		Dir:      c.String("step-logs"),
+		Limit:    c.Int("step-log-limit"),
+		Uploader: s3storage,
+		Redact:   cliutil.Redactor.String,
+	}
+	if stepLogs.Dir != "" && !strings.HasPrefix(stepLogs.Dir, "s3://") {
+		if stepLogs.Dir, err = util.MakeAbsolute(stepLogs.Dir); err != nil {
+			cliutil.Exit(build.WithExitCode(build.ExitUser, err))
+		}
+	}
+
+	var deadline time.Time
+	if timeout := c.Duration("timeout"); timeout > 0 {
+		deadline = time.Now().Add(timeout)
+	}
+
+	options := build.DockerClientOptions{
+		Client:                   dockerClient,
+		Auth:                     auth,
+		AuthProvider:             cliutil.NewAuthProvider(c, auth),
+		Log:                      log.StandardLogger(),
+		S3storage:                s3storage,
+		StdoutContainerFormatter: stdoutContainerFormatter,
+		StderrContainerFormatter: stderrContainerFormatter,
+		PushRetryCount:           c.Int("push-retry"),
+		PullRetryCount:           c.GlobalInt("pull-retry"),
+		PullMirror:               c.GlobalString("pull-mirror"),
+		Host:                     config.Host,
+		LogExactSizes:            c.GlobalBool("json"),
+		BuildID:                  cliutil.BuildID,
+		Offline:                  c.Bool("offline"),
+		NoCommitPause:            c.Bool("no-commit-pause"),
+		AttachInterrupt:          attachInterrupt,
+		StepLogs:                 stepLogs,
+		BuildKitBuilder:          c.String("buildkit-builder"),
+		TLSVerify:                config.Tlsverify,
+		TLSCACert:                config.Tlscacert,
+		TLSCert:                  config.Tlscert,
+		TLSKey:                   config.Tlskey,
+		Capabilities:             caps,
+	}
+	client, err := build.NewClient(c.String("backend"), options)
+	if err != nil {
+		cliutil.Exit(build.WithExitCode(build.ExitUser, err))
+	}
+
+	// Ctrl+C cancels the build, twice removes its containers and exits; rocker
+	// exits after the build, so the handler is never stopped
+	if h, ok := client.(interface {
+		HandleInterrupts() (stop func())
+	}); ok {
+		h.HandleInterrupts()
+	}
+
+	return build.New(client, rockerfile, cache, build.Config{
+		InStream:           os.Stdin,
+		OutStream:          log.StandardLogger().Out,
+		ContextDir:         contextDir,
+		Contexts:           contexts,
+		PushRoutes:         routes,
+		PushAtomic:         c.Bool("push-atomic"),
+		BuildID:            cliutil.BuildID,
+		Dockerignore:       dockerignore,
+		ArtifactsPath:      c.String("artifacts-path"),
+		Pull:               c.Bool("pull"),
+		NoGarbage:          c.Bool("no-garbage"),
+		Attach:             c.Bool("attach"),
+		DebugOnError:       c.Bool("debug-on-error"),
+		Verbose:            c.GlobalBool("verbose"),
+		ID:                 c.String("id"),
+		NoCache:            noCache,
+		NoCacheFor:         noCacheFor,
+		Offline:            c.Bool("offline"),
+		ReloadCache:        c.Bool("reload-cache"),
+		Push:               push,
+		CacheDir:           cacheDir,
+		LogJSON:            c.GlobalBool("json"),
+		BuildArgs:          buildArgs,
+		SensitiveBuildArgs: sensitiveBuildArgs,
+		Prefetch:           c.Bool("prefetch") || cliutil.Features.Enabled("prefetch"),
+		ParallelStages:     c.Bool("parallel-stages") || cliutil.Features.Enabled("parallel-stages"),
+		Features:           cliutil.Features,
+		Annotations:        parseAnnotations(c),
+		CheckpointFile:     c.String("checkpoint"),
+		ResumeFile:         resumeFile(c, rockerfile, contextDir),
+		StepLogs:           stepLogs,
+		Labels:             labels,
+		CacheFrom:          c.StringSlice("cache-from"),
+		CacheTo:            c.String("cache-to"),
+		Deadline:           deadline,
+		Reproducible:       c.Bool("reproducible"),
+		SourceDateEpoch:    sourceDateEpoch(c),
+		EOL:                eolChecker(c),
+		RegistryPolicy:     registryPolicy(c),
+	})
+}
+
+// registryPolicy loads the allowlist of the registries of the organization;
+// the default file is optional, the one that is asked for explicitly is not
+func registryPolicy(c *cli.Context) *registrypolicy.Policy {
+	source := c.String("registry-policy")
+	if source == "" {
+		return nil
+	}
+	if source == registrypolicy.DefaultFile {
+		if _, err := os.Stat(source); os.IsNotExist(err) {
+			return nil
+		}
+	}
+
+	policy, err := registrypolicy.Load(source)
+	if err != nil {
+		cliutil.Exit(build.WithExitCode(build.ExitUser, err))
+	}
+	log.Debugf("Registry policy %s, mode %s", policy.Source, policy.Mode)
+	return policy
+}
+
+// eolChecker loads the support windows of the base images for the warnings of FROM;
+// the urls of --eol-data are skipped in the offline mode
+func eolChecker(c *cli.Context) *eol.Checker {
+	if c.Bool("no-eol-check") {
+		return nil
+	}
+
+	sources := []string{}
+	for _, source := range c.StringSlice("eol-data") {
+		if c.Bool("offline") && (strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://")) {
+			log.Warnf("Skip EOL data %s in the offline mode", source)
+			continue
+		}
+		sources = append(sources, source)
+	}
+
+	checker, err := eol.New(sources, time.Duration(c.Int("eol-warn-days"))*24*time.Hour)
+	if err != nil {
+		cliutil.Exit(build.WithExitCode(build.ExitUser, err))
+	}
+	return checker
+}
+
+// sourceDateEpoch returns the time of $SOURCE_DATE_EPOCH, in seconds since the unix
+// epoch as https://reproducible-builds.org/specs/source-date-epoch/ defines it, for
+// --reproducible; without the variable the times are pinned to the unix epoch
+func sourceDateEpoch(c *cli.Context) time.Time {
+	value := os.Getenv("SOURCE_DATE_EPOCH")
+	if !c.Bool("reproducible") || value == "" {
+		return time.Unix(0, 0).UTC()
+	}
+	seconds, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || seconds < 0 {
+		cliutil.Exitf(build.ExitUser, "SOURCE_DATE_EPOCH must be a number of seconds, got %q", value)
+	}
+	return time.Unix(seconds, 0).UTC()
+}
+
+// builderLabels describes the environment the image is built in,
+// so images built on different machines can be compared
+func builderLabels(c *cli.Context, dockerClient *docker.Client) map[string]string {
+	// The build id ties the image to the logs and artifacts of the build,
+	// so it is there even with --no-builder-labels
+	labels := map[string]string{
+		"rocker.builder.build-id": cliutil.BuildID,
+	}
+
+	if !c.Bool("no-builder-labels") {
+		for k, v := range environmentLabels(c, dockerClient) {
+			labels[k] = v
+		}
+	}
+
+	// The build id and the daemon differ from build to build
+	if c.Bool("reproducible") {
+		delete(labels, "rocker.builder.build-id")
+		delete(labels, "rocker.builder.docker-version")
+	}
+
+	return labels
+}
+
+// environmentLabels are the labels of the versions and the platform of the builder
+func environmentLabels(c *cli.Context, dockerClient *docker.Client) map[string]string {
+	dockerVersion := "unknown"
+	if env, err := dockerClient.Version(); err != nil {
+		log.Debugf("Failed to get docker version, error: %s", err)
+	} else {
+		dockerVersion = env.Get("Version")
+	}
+
+	enabled := features.Set{}
+	for name := range cliutil.Features {
+		enabled[name] = true
+	}
+	if c.Bool("prefetch") {
+		enabled["prefetch"] = true
+	}
+
+	return map[string]string{
+		"rocker.builder.version":        cliutil.Version,
+		"rocker.builder.commit":         cliutil.GitCommit,
+		"rocker.builder.docker-version": dockerVersion,
+		"rocker.builder.os":             runtime.GOOS,
+		"rocker.builder.arch":           runtime.GOARCH,
+		"rocker.builder.features":       strings.Join(enabled.Names(), ","),
+	}
+}
@@ -0,0 +1,121 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package buildcmd
+
+import (
+	"fmt"
+
+	"github.com/grammarly/rocker/src/build"
+	"github.com/grammarly/rocker/src/cliutil"
+	"github.com/grammarly/rocker/src/dockerclient"
+	"github.com/grammarly/rocker/src/imagename"
+
+	"github.com/codegangsta/cli"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// buildOnDaemons runs the build on every daemon of --daemon at the same time, each
+// one for the platform of the daemon, and pushes the manifest lists of the images
+// the builds pushed; it returns the lists as the pushed images
+func buildOnDaemons(c *cli.Context, daemons []string, rockerfile *build.Rockerfile, contextDir string, dockerignore []string, contexts map[string]string) []imagename.Artifact {
+	checkDaemonFlags(c)
+
+	var (
+		builders  = make([]*build.Build, len(daemons))
+		plans     = make([]build.Plan, len(daemons))
+		platforms = map[string]string{}
+	)
+
+	for i, spec := range daemons {
+		host, platform, err := dockerclient.ParseDaemon(spec)
+		if err != nil {
+			cliutil.Exit(build.WithExitCode(build.ExitUser, err))
+		}
+
+		config := dockerclient.NewConfigFromCli(c)
+		config.Host = host
+
+		builder := newBuilder(c, rockerfile, contextDir, dockerignore, contexts, config, c.Bool("no-cache"), c.Bool("push"))
+
+		if platform.OS == "" {
+			if platform, err = daemonPlatform(config); err != nil {
+				cliutil.Exit(build.WithExitCode(build.ExitInfra, err))
+			}
+		}
+		if other, ok := platforms[platform.String()]; ok {
+			cliutil.Exitf(build.ExitUser, "Daemons %s and %s both build for %s, give the platform explicitly, e.g. --daemon linux/arm64=%s", other, host, platform, host)
+		}
+		platforms[platform.String()] = host
+
+		log.Infof("Build for %s on %s", platform, host)
+
+		builder.ForPlatform(platform)
+		builders[i], plans[i] = builder, newPlan(c, rockerfile)
+	}
+
+	if err := build.RunPlatforms(builders, plans); err != nil {
+		cliutil.Exit(err)
+	}
+
+	for _, builder := range builders {
+		log.Infof("Successfully built %.12s for %s", builder.GetImageID(), builder.Platform())
+	}
+
+	if !c.Bool("push") {
+		log.Infof("Don't push the manifest lists. Pass --push flag to actually push to the registry")
+		return nil
+	}
+
+	lists, err := build.ManifestLists(builders)
+	if err != nil {
+		cliutil.Exit(build.WithExitCode(build.ExitFailure, err))
+	}
+
+	pushed, err := builders[0].PushManifestLists(lists)
+	if err != nil {
+		cliutil.Exit(err)
+	}
+	return pushed
+}
+
+// checkDaemonFlags fails on the flags that need a single build
+func checkDaemonFlags(c *cli.Context) {
+	for _, flag := range []string{"plan", "attach", "debug-on-error", "resume"} {
+		if c.Bool(flag) {
+			cliutil.Exitf(build.ExitUser, "--daemon cannot be used with --%s", flag)
+		}
+	}
+	for _, flag := range []string{"output", "checkpoint", "restore", "step-logs", "report", "compare-with"} {
+		if c.String(flag) != "" {
+			cliutil.Exitf(build.ExitUser, "--daemon cannot be used with --%s", flag)
+		}
+	}
+}
+
+// daemonPlatform asks the daemon which platform it runs on
+func daemonPlatform(config *dockerclient.Config) (platform dockerclient.Platform, err error) {
+	client, err := dockerclient.NewFromConfig(config)
+	if err != nil {
+		return platform, err
+	}
+	info, err := client.Info()
+	if err != nil {
+		return platform, fmt.Errorf("Failed to get the platform of %s, error: %s", config.Host, err)
+	}
+	return dockerclient.DaemonPlatform(info), nil
+}
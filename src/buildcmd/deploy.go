@@ -0,0 +1,285 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package buildcmd
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/grammarly/rocker/src/build"
+	"github.com/grammarly/rocker/src/cliutil"
+	"github.com/grammarly/rocker/src/deploy"
+	"github.com/grammarly/rocker/src/dockerclient"
+	"github.com/grammarly/rocker/src/imagename"
+	"github.com/grammarly/rocker/src/kubepatch"
+
+	"github.com/codegangsta/cli"
+	"github.com/docker/docker/pkg/units"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// parseSizeLimit reads --size-regression-limit before the build starts, nil if not given
+func parseSizeLimit(c *cli.Context) *build.SizeLimit {
+	value := c.String("size-regression-limit")
+	if value == "" {
+		return nil
+	}
+	if c.String("compare-with") == "" {
+		cliutil.Exitf(build.ExitUser, "--size-regression-limit needs --compare-with, the image of the previous release")
+	}
+	limit, err := build.ParseSizeLimit(value)
+	if err != nil {
+		cliutil.Exit(build.WithExitCode(build.ExitUser, err))
+	}
+	return &limit
+}
+
+// compareWithRelease compares the built image with the image of the previous release,
+// pulling it if needed, and warns or, with --size-regression-limit, fails the build if
+// the image grew too much. A previous release that cannot be found is only a warning,
+// so the first release of an image can be built
+func compareWithRelease(c *cli.Context, config *dockerclient.Config, previous, imageID string, limit *build.SizeLimit) {
+	dockerClient, err := dockerclient.NewFromConfig(config)
+	if err != nil {
+		cliutil.Exit(build.WithExitCode(build.ExitInfra, err))
+	}
+	client := cliutil.NewCommandClient(c, dockerClient, cliutil.InitAuth(c))
+
+	prev, err := client.InspectImage(previous)
+	if err == nil && prev == nil && !c.Bool("offline") {
+		if err = client.PullImage(context.Background(), previous); err == nil {
+			prev, err = client.InspectImage(previous)
+		}
+	}
+	if err == nil && prev == nil {
+		err = fmt.Errorf("the image is not found")
+	}
+	if err != nil {
+		log.Warnf("Cannot compare with %s, %s", previous, err)
+		return
+	}
+
+	img, err := client.InspectImage(imageID)
+	if err != nil {
+		cliutil.Exit(err)
+	}
+	prevHistory, err := dockerClient.ImageHistory(prev.ID)
+	if err != nil {
+		cliutil.Exit(err)
+	}
+	history, err := dockerClient.ImageHistory(imageID)
+	if err != nil {
+		cliutil.Exit(err)
+	}
+
+	cmp := build.CompareImages(previous, prev, img, prevHistory, history)
+
+	log.Info(cmp)
+	for i, e := range cmp.Added {
+		if i == 5 {
+			log.Infof("| ... and %d more new layers", len(cmp.Added)-i)
+			break
+		}
+		log.Infof("| +%s %s", units.HumanSize(float64(e.Size)), e.Command())
+	}
+	for i, e := range cmp.Removed {
+		if i == 5 {
+			log.Infof("| ... and %d more removed layers", len(cmp.Removed)-i)
+			break
+		}
+		log.Infof("| -%s %s", units.HumanSize(float64(e.Size)), e.Command())
+	}
+
+	switch {
+	case limit != nil && limit.Exceeded(cmp):
+		cliutil.Exit(build.WithExitCode(build.ExitPolicy, fmt.Errorf("The image grew by %.1f%% since %s, more than --size-regression-limit %s", cmp.Growth(), previous, limit)))
+	case limit == nil && build.DefaultSizeWarnGrowth.Exceeded(cmp):
+		log.Warnf("The image grew by %.1f%% since %s, check the new layers above", cmp.Growth(), previous)
+	}
+}
+
+// deployTargets are where the pushed image goes after the build
+type deployTargets struct {
+	k8sSpecs    []kubepatch.Spec
+	ecsTarget   *deploy.ECSTarget
+	nomadTarget *deploy.NomadTarget
+}
+
+func (t deployTargets) empty() bool {
+	return len(t.k8sSpecs) == 0 && t.ecsTarget == nil && t.nomadTarget == nil
+}
+
+// parseDeployTargets reads --k8s-set, --ecs-task and --nomad-job before the build
+// starts, so a mistake in them does not waste a build
+func parseDeployTargets(c *cli.Context) (t deployTargets) {
+	for _, spec := range c.StringSlice("k8s-set") {
+		s, err := kubepatch.ParseSpec(spec)
+		if err != nil {
+			cliutil.Exit(build.WithExitCode(build.ExitUser, err))
+		}
+		t.k8sSpecs = append(t.k8sSpecs, s)
+	}
+	if c.Bool("k8s-apply") && len(t.k8sSpecs) == 0 {
+		cliutil.Exitf(build.ExitUser, "--k8s-apply has nothing to apply without --k8s-set")
+	}
+
+	if task := c.String("ecs-task"); task != "" {
+		target, err := deploy.ParseECSTarget(task, c.String("ecs-service"))
+		if err != nil {
+			cliutil.Exit(build.WithExitCode(build.ExitUser, err))
+		}
+		t.ecsTarget = &target
+	} else if c.String("ecs-service") != "" {
+		cliutil.Exitf(build.ExitUser, "--ecs-service needs --ecs-task")
+	}
+	if job := c.String("nomad-job"); job != "" {
+		target, err := deploy.ParseNomadTarget(job)
+		if err != nil {
+			cliutil.Exit(build.WithExitCode(build.ExitUser, err))
+		}
+		t.nomadTarget = &target
+	}
+
+	if !t.empty() && !c.Bool("push") {
+		cliutil.Exitf(build.ExitUser, "--k8s-set, --ecs-task and --nomad-job need the image to be pushed, pass --push as well")
+	}
+
+	return t
+}
+
+// deployPushed syncs the registry descriptions and updates the deploy targets
+// with the last pushed image
+func deployPushed(c *cli.Context, pushed []imagename.Artifact, t deployTargets) {
+	if c.Bool("push") && (c.String("registry-readme") != "" || c.String("registry-description") != "") {
+		syncDescriptions(c, pushed)
+	}
+
+	if t.empty() {
+		return
+	}
+
+	image := lastPushed(pushed)
+
+	if len(t.k8sSpecs) > 0 {
+		patchManifests(t.k8sSpecs, image, c.Bool("k8s-apply"))
+	}
+	if t.ecsTarget != nil {
+		if _, err := deploy.UpdateECS(*t.ecsTarget, image.Addressable, c.String("ecs-region")); err != nil {
+			cliutil.Exit(build.WithExitCode(build.ExitInfra, err))
+		}
+	}
+	if t.nomadTarget != nil {
+		cliutil.Redactor.Add(c.String("nomad-token"))
+		if err := deploy.UpdateNomad(c.String("nomad-addr"), c.String("nomad-token"), *t.nomadTarget, image.Addressable); err != nil {
+			cliutil.Exit(build.WithExitCode(build.ExitInfra, err))
+		}
+	}
+}
+
+// syncDescriptions updates the descriptions of the repositories the build pushed to;
+// failures are only reported, since the images are already pushed
+func syncDescriptions(c *cli.Context, pushed []imagename.Artifact) {
+	var readme string
+	if file := c.String("registry-readme"); file != "" {
+		content, err := ioutil.ReadFile(file)
+		if err != nil {
+			cliutil.Exit(build.WithExitCode(build.ExitUser, err))
+		}
+		readme = string(content)
+	}
+
+	auth := cliutil.InitAuth(c)
+	seen := map[string]bool{}
+
+	for _, artifact := range pushed {
+		name := artifact.Name.NameWithRegistry()
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+
+		if artifact.Name.Registry == "ghcr.io" {
+			log.Infof("GHCR takes the description of %s from the org.opencontainers.image.description and org.opencontainers.image.source labels, set them with LABEL", name)
+			continue
+		}
+		if !dockerclient.IsDockerHub(artifact.Name) {
+			log.Warnf("Cannot update the description of %s, only Docker Hub is supported", name)
+			continue
+		}
+
+		if err := dockerclient.HubUpdateDescription(artifact.Name, auth, c.String("registry-description"), readme); err != nil {
+			log.Errorf("Failed to update the description of %s, error: %s", name, err)
+		}
+	}
+}
+
+// lastPushed returns the image of the last PUSH, which post-push integrations
+// deploy; it has to be addressable by digest
+func lastPushed(pushed []imagename.Artifact) imagename.Artifact {
+	if len(pushed) == 0 {
+		cliutil.Exitf(build.ExitUser, "Nothing to deploy, the Rockerfile has no PUSH")
+	}
+
+	image := pushed[len(pushed)-1]
+	if !strings.HasPrefix(image.Digest, "sha256:") {
+		cliutil.Exitf(build.ExitInfra, "Cannot deploy %s, the registry did not return its digest", image.Name)
+	}
+
+	return image
+}
+
+// patchManifests sets the pushed image in the given files and optionally
+// applies them with kubectl; apply only runs once all files are patched
+func patchManifests(specs []kubepatch.Spec, image imagename.Artifact, apply bool) {
+	files := []string{}
+	seen := map[string]bool{}
+
+	for _, spec := range specs {
+		value := spec.Value(image.Name.NameWithRegistry(), image.Digest)
+
+		if err := kubepatch.PatchFile(spec.File, spec.Path, value); err != nil {
+			cliutil.Exit(build.WithExitCode(build.ExitUser, err))
+		}
+		log.Infof("Set %s to %s in %s", spec.Path, value, spec.File)
+
+		if !seen[spec.File] {
+			seen[spec.File] = true
+			files = append(files, spec.File)
+		}
+	}
+
+	if !apply {
+		return
+	}
+
+	for _, file := range files {
+		log.Infof("Apply %s", file)
+
+		cmd := exec.Command("kubectl", "apply", "-f", file)
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+
+		if err := cmd.Run(); err != nil {
+			cliutil.Exitf(build.ExitInfra, "kubectl apply -f %s failed, error: %s", file, err)
+		}
+	}
+}
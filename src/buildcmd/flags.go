@@ -0,0 +1,332 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package buildcmd
+
+import (
+	"github.com/grammarly/rocker/src/build"
+	"github.com/grammarly/rocker/src/deploy"
+	"github.com/grammarly/rocker/src/eol"
+	"github.com/grammarly/rocker/src/registrypolicy"
+
+	"github.com/codegangsta/cli"
+)
+
+// Flags are the flags of the build command, verify-reproducible takes them too
+func Flags() []cli.Flag {
+	return []cli.Flag{
+		cli.StringFlag{
+			Name:  "file, f",
+			Value: "Rockerfile",
+			Usage: "rocker build file to execute",
+		},
+		cli.StringFlag{
+			Name:  "auth, a",
+			Value: "",
+			Usage: "Username and password in user:password format",
+		},
+		cli.StringSliceFlag{
+			Name:  "build-arg",
+			Value: &cli.StringSlice{},
+			Usage: "Set build-time variables, can pass multiple of those, format is key=value (default [])",
+		},
+		cli.StringSliceFlag{
+			Name:  "sensitive-build-arg",
+			Value: &cli.StringSlice{},
+			Usage: "Name of a build arg that holds a secret: it is masked in the logs and kept out of the cache; can pass multiple of this",
+		},
+		cli.StringSliceFlag{
+			Name:  "var",
+			Value: &cli.StringSlice{},
+			Usage: "set variables to pass to build tasks, value is like \"key=value\"",
+		},
+		cli.StringSliceFlag{
+			Name:  "vars",
+			Value: &cli.StringSlice{},
+			Usage: "Load variables form a file, either JSON or YAML. Can pass multiple of this.",
+		},
+		cli.BoolFlag{
+			Name:  "no-cache",
+			Usage: "supresses cache for docker builds",
+		},
+		cli.StringSliceFlag{
+			Name:  "no-cache-for",
+			Value: &cli.StringSlice{},
+			Usage: "supresses cache for a part of the build: stage:N, stage:final, from-step:N or directive:NAME; can pass multiple of this",
+		},
+		cli.BoolFlag{
+			Name:  "reload-cache",
+			Usage: "removes any cache that hit and save the new one",
+		},
+		cli.StringFlag{
+			Name:  "cache-dir",
+			Value: "~/.rocker_cache",
+			Usage: "Set the directory where the cache will be stored",
+		},
+		cli.StringSliceFlag{
+			Name:  "cache-from",
+			Value: &cli.StringSlice{},
+			Usage: "registry repository to take the cache of the steps from when it is not in the local cache, e.g. quay.io/me/app-cache; can pass multiple of this",
+		},
+		cli.StringFlag{
+			Name:  "cache-to",
+			Usage: "registry repository to push the cache of the steps to after the build, for --cache-from",
+		},
+		cli.DurationFlag{
+			Name:  "timeout",
+			Usage: "fail the build with exit code 124 if it takes longer, e.g. 30m; the running RUN is killed",
+		},
+		cli.BoolFlag{
+			Name:  "no-reuse",
+			Usage: "suppresses reuse for all the volumes in the build",
+		},
+		cli.BoolFlag{
+			Name:  "push",
+			Usage: "pushes all the images marked with push to docker hub",
+		},
+		cli.BoolFlag{
+			Name:  "pull",
+			Usage: "always attempt to pull a newer version of the FROM images",
+		},
+		cli.BoolFlag{
+			Name:  "parallel-stages",
+			Usage: "run the FROM sections that do not use each other's images or exports in parallel, with the log lines prefixed by the stage",
+		},
+		cli.BoolFlag{
+			Name:  "prefetch",
+			Usage: "start pulling all FROM images in the background before the build reaches them",
+		},
+		cli.StringFlag{
+			Name:  "checkpoint",
+			Usage: "keep the build progress in this file after every step, so the build can be continued with --restore",
+		},
+		cli.StringFlag{
+			Name:  "restore",
+			Usage: "continue the build from the checkpoint file, possibly made on another host",
+		},
+		cli.BoolFlag{
+			Name:  "resume",
+			Usage: "continue the last failed build of the Rockerfile from the step that failed, even without the cache",
+		},
+		cli.StringFlag{
+			Name:  "step-logs",
+			Usage: "save the full output of every step to this directory or s3://bucket/prefix, the artifacts refer to the files",
+		},
+		cli.StringFlag{
+			Name:  "compare-with",
+			Usage: "compare the size and the layers of the built image with the image of the previous release, e.g. quay.io/acme/app:latest",
+		},
+		cli.StringFlag{
+			Name:  "size-regression-limit",
+			Usage: "with --compare-with, fail if the image grew more than this since the previous release, e.g. 10% or 50MB",
+		},
+		cli.StringSliceFlag{
+			Name:  "eol-data",
+			Value: &cli.StringSlice{},
+			Usage: "file or http(s) url of a YAML list of base image support windows, taken before the builtin ones; can be passed multiple times",
+		},
+		cli.IntFlag{
+			Name:  "eol-warn-days",
+			Value: int(eol.DefaultWarnBefore.Hours() / 24),
+			Usage: "warn about the FROM images that reach their end of life in less than this many days",
+		},
+		cli.BoolFlag{
+			Name:  "no-eol-check",
+			Usage: "do not warn about the FROM images that are out of support or deprecated",
+		},
+		cli.StringFlag{
+			Name:   "registry-policy",
+			Value:  registrypolicy.DefaultFile,
+			Usage:  "file or http(s) url of the YAML allowlist of the registries and namespaces FROM and PUSH may use; the default one applies if it exists",
+			EnvVar: "ROCKER_REGISTRY_POLICY",
+		},
+		cli.StringFlag{
+			Name:  "report",
+			Usage: "write a JSON report of the build to this file: every step with its duration, cache status, image and size delta",
+		},
+		cli.IntFlag{
+			Name:  "step-log-limit",
+			Value: build.DefaultStepLogLimit,
+			Usage: "how many bytes of the output of every step to keep in memory",
+		},
+		cli.BoolFlag{
+			Name:  "offline",
+			Usage: "forbid all network operations, use only local images and previously downloaded files",
+		},
+		cli.StringFlag{
+			Name:  "context-sha256",
+			Usage: "expected sha256 of the context tarball when the context is given as an s3:// or http(s):// URL",
+		},
+		cli.StringSliceFlag{
+			Name:  "context",
+			Value: &cli.StringSlice{},
+			Usage: "add a named build context for COPY --from-context, name=path or name=s3://|http(s):// tarball",
+		},
+		cli.StringFlag{
+			Name:  "flatten-after",
+			Usage: "merge all layers up to the given point into one, either a step number or stage:<number> of a FROM section",
+		},
+		cli.StringSliceFlag{
+			Name:  "daemon",
+			Value: &cli.StringSlice{},
+			Usage: "build on these docker hosts instead of --host, each one for its platform, [os/arch=]host; the pushed images are merged into manifest lists",
+		},
+		cli.BoolFlag{
+			Name:  "squash",
+			Usage: "merge the layers each FROM section adds on top of its base image into one, for the sections that tag or push and the last one",
+		},
+		cli.BoolFlag{
+			Name:  "reproducible",
+			Usage: "normalize the times, owners and order of the files COPY and ADD upload and the layers and config of the produced images, with the times pinned to $SOURCE_DATE_EPOCH",
+		},
+		cli.StringSliceFlag{
+			Name:  "k8s-set",
+			Value: &cli.StringSlice{},
+			Usage: "after push, set the pushed image in a Kubernetes manifest or kustomize file, file:path[=image|name|digest]",
+		},
+		cli.BoolFlag{
+			Name:  "k8s-apply",
+			Usage: "run `kubectl apply -f` for the files patched with --k8s-set",
+		},
+		cli.StringFlag{
+			Name:   "push-routes",
+			Usage:  "YAML file with the rules that route PUSH names to other registries, see README",
+			EnvVar: "ROCKER_PUSH_ROUTES",
+		},
+		cli.BoolFlag{
+			Name:  "push-atomic",
+			Usage: "fail the build if any of the pushes of a PUSH fails and remove the ones that succeeded; by default it only fails if all of them fail",
+		},
+		cli.StringFlag{
+			Name:  "registry-readme",
+			Usage: "after push, set the file as the full description of the pushed Docker Hub repositories",
+		},
+		cli.StringFlag{
+			Name:  "registry-description",
+			Usage: "after push, set the short description of the pushed Docker Hub repositories",
+		},
+		cli.StringFlag{
+			Name:  "ecs-task",
+			Usage: "after push, register a new revision of the ECS task definition with the pushed image, family[:container]",
+		},
+		cli.StringFlag{
+			Name:  "ecs-service",
+			Usage: "point the ECS service to the new task definition revision, cluster/service",
+		},
+		cli.StringFlag{
+			Name:   "ecs-region",
+			Usage:  "AWS region of the ECS cluster, taken from the AWS environment by default",
+			EnvVar: "AWS_REGION",
+		},
+		cli.StringFlag{
+			Name:  "nomad-job",
+			Usage: "after push, update the docker task of the Nomad job with the pushed image, job[:group/task]",
+		},
+		cli.StringFlag{
+			Name:   "nomad-addr",
+			Value:  deploy.DefaultNomadAddr,
+			Usage:  "address of the Nomad HTTP API",
+			EnvVar: "NOMAD_ADDR",
+		},
+		cli.StringFlag{
+			Name:   "nomad-token",
+			Usage:  "Nomad ACL token",
+			EnvVar: "NOMAD_TOKEN",
+		},
+		cli.StringSliceFlag{
+			Name:  "annotation",
+			Value: &cli.StringSlice{},
+			Usage: "add the key=value annotation to the manifests rocker writes: PUBLISH and HELM_PACKAGE artifacts, the manifest lists of --daemon and the images of --output-format oci; can pass multiple of this",
+		},
+		cli.StringSliceFlag{
+			Name:  "provenance-label",
+			Value: &cli.StringSlice{},
+			Usage: "record the build args and variables whose names match the pattern, e.g. VERSION or 'APP_*', as rocker.build-arg.* and rocker.var.* labels; sensitive build args are never recorded; can pass multiple of this",
+		},
+		cli.BoolFlag{
+			Name:  "no-builder-labels",
+			Usage: "do not stamp rocker.builder.* labels with the builder environment on produced images; the build id is stamped anyway",
+		},
+		cli.BoolFlag{
+			Name:  "attach",
+			Usage: "attach to a container in place of ATTACH command",
+		},
+		cli.BoolFlag{
+			Name:  "debug-on-error",
+			Usage: "when RUN fails, open a shell in what the command left to debug it, the build fails after the shell exits",
+		},
+		cli.StringFlag{
+			Name:   "backend",
+			Value:  build.BackendDocker,
+			Usage:  "what runs the steps: docker runs them in the containers of the daemon, buildkit runs RUN with BuildKit through docker buildx, podman is docker for the docker API of Podman",
+			EnvVar: "ROCKER_BACKEND",
+		},
+		cli.StringFlag{
+			Name:  "buildkit-builder",
+			Usage: "the buildx builder of --backend buildkit, it should use the docker driver; the current one by default",
+		},
+		cli.StringFlag{
+			Name:  "attach-interrupt",
+			Value: build.AttachInterruptStopStep,
+			Usage: "what SIGINT does while attached: stop-step stops the container, forward passes it to the process in the container",
+		},
+		cli.BoolFlag{
+			Name:  "meta",
+			Usage: "add metadata to the tagged images, such as user, Rockerfile source, variables and git branch/sha",
+		},
+		cli.BoolFlag{
+			Name:  "print",
+			Usage: "just print the Rockerfile after template processing and stop",
+		},
+		cli.BoolFlag{
+			Name:  "plan",
+			Usage: "print the commands and whether each would run or be taken from the cache, without creating containers",
+		},
+		cli.BoolFlag{
+			Name:  "demand-artifacts",
+			Usage: "fail if artifacts not found for {{ image }} helpers",
+		},
+		cli.StringFlag{
+			Name:  "id",
+			Usage: "override the default id generation strategy for current build",
+		},
+		cli.StringFlag{
+			Name:  "artifacts-path",
+			Usage: "put artifacts (files with pushed images description) to the directory",
+		},
+		cli.StringFlag{
+			Name:  "output, o",
+			Usage: "save the resulting image as a tar archive to the file, - streams it to stdout and moves the build output to stderr",
+		},
+		cli.StringFlag{
+			Name:  "output-format",
+			Value: build.OutputFormatDocker,
+			Usage: "format of the archive written by --output: docker (as docker save) or oci (OCI image layout)",
+		},
+		cli.BoolFlag{
+			Name:  "no-garbage",
+			Usage: "remove the images from the tail if not tagged",
+		},
+		cli.IntFlag{
+			Name:  "push-retry",
+			Usage: "number of retries for failed image pushes",
+		},
+		cli.BoolFlag{
+			Name:  "no-commit-pause",
+			Usage: "do not pause containers while committing them; faster for big containers, but files written by processes that are still running may be captured half written",
+		},
+	}
+}
@@ -0,0 +1,371 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package buildcmd
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/grammarly/rocker/src/build"
+	"github.com/grammarly/rocker/src/cliutil"
+	"github.com/grammarly/rocker/src/storage/s3"
+	"github.com/grammarly/rocker/src/template"
+	"github.com/grammarly/rocker/src/util"
+
+	"github.com/codegangsta/cli"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// initRockerfile reads the Rockerfile, the context directory and the .rockerignore or .dockerignore
+// according to the command line; in 'print' mode it prints the Rockerfile and exits.
+// The returned cleanup removes the context if it was downloaded.
+func initRockerfile(c *cli.Context) (rockerfile *build.Rockerfile, contextDir string, dockerignore []string, cleanup func()) {
+	var err error
+
+	cleanup = func() {}
+
+	// We don't want info level for 'print' mode
+	// So log only errors unless 'debug' is on
+	if c.Bool("print") && log.StandardLogger().Level != log.DebugLevel {
+		log.StandardLogger().Level = log.ErrorLevel
+	}
+
+	vars, err := template.VarsFromFileMulti(c.StringSlice("vars"))
+	if err != nil {
+		cliutil.Exit(build.WithExitCode(build.ExitUser, err))
+	}
+
+	cliVars, err := template.VarsFromStrings(c.StringSlice("var"))
+	if err != nil {
+		cliutil.Exit(build.WithExitCode(build.ExitUser, err))
+	}
+
+	vars = vars.Merge(cliVars)
+
+	if c.Bool("demand-artifacts") {
+		vars["DemandArtifacts"] = true
+	}
+
+	wd, err := os.Getwd()
+	if err != nil {
+		cliutil.Exit(err)
+	}
+
+	args := c.Args()
+
+	// Remote context is unpacked to a temporary directory and the Rockerfile is taken from there
+	remote := len(args) > 0 && build.IsRemoteContext(args[0])
+	if remote {
+		if wd, err = build.FetchContext(args[0], c.String("context-sha256"), s3.New(nil, "").Open); err != nil {
+			cliutil.Exit(err)
+		}
+		cleanup = func() { os.RemoveAll(wd) }
+	}
+
+	// The fragments of INCLUDE are cached together with the build cache,
+	// an offline build takes them from there only
+	if cacheDir := c.String("cache-dir"); cacheDir != "" {
+		build.IncludeCacheDir = filepath.Join(cacheDir, "includes")
+	}
+	build.IncludeOffline = c.Bool("offline")
+
+	configFilename := c.String("file")
+	contextDir = wd
+
+	// The templates may read the files of the context only
+	localContext := ""
+	if len(args) > 0 && !remote {
+		localContext = args[0]
+	}
+	sandbox := cliutil.TemplateSandbox(c, build.TemplateDir(wd, localContext, configFilename))
+
+	if configFilename == "-" {
+
+		rockerfile, err = build.NewRockerfile(filepath.Base(wd), os.Stdin, vars, template.Funs{}, sandbox)
+		if err != nil {
+			cliutil.Exit(build.WithExitCode(build.ExitUser, err))
+		}
+
+	} else {
+
+		if !filepath.IsAbs(configFilename) {
+			configFilename = filepath.Join(wd, configFilename)
+		}
+
+		rockerfile, err = build.NewRockerfileFromFile(configFilename, vars, template.Funs{}, sandbox)
+		if err != nil {
+			cliutil.Exit(build.WithExitCode(build.ExitUser, err))
+		}
+
+		// Initialize context dir
+		contextDir = filepath.Dir(configFilename)
+	}
+
+	if len(args) > 0 && !remote {
+		contextDir = args[0]
+		if !filepath.IsAbs(contextDir) {
+			contextDir = filepath.Join(wd, args[0])
+		}
+	} else if contextDir != wd {
+		log.Warningf("Implicit context directory used: %s. You can override context directory using the last argument.", contextDir)
+	}
+
+	dir, err := os.Stat(contextDir)
+	if err != nil {
+		cliutil.Exitf(build.ExitUser, "Problem with opening directory %s, error: %s", contextDir, err)
+	}
+	if !dir.IsDir() {
+		cliutil.Exitf(build.ExitUser, "Context directory %s is not a directory.", contextDir)
+	}
+	log.Debugf("Context directory: %s", contextDir)
+
+	if c.Bool("print") {
+		fmt.Print(rockerfile.Content)
+		os.Exit(0)
+	}
+
+	dockerignore, err = build.ReadContextIgnore(contextDir)
+	if err != nil {
+		cliutil.Exit(build.WithExitCode(build.ExitUser, err))
+	}
+
+	return rockerfile, contextDir, dockerignore, cleanup
+}
+
+// checkOfflineFlags fails if --offline is combined with something that needs the network
+func checkOfflineFlags(c *cli.Context) {
+	for _, flag := range []string{"push", "pull"} {
+		if c.Bool(flag) {
+			cliutil.Exitf(build.ExitUser, "--offline cannot be used with --%s", flag)
+		}
+	}
+
+	if c.String("cache-to") != "" {
+		cliutil.Exitf(build.ExitUser, "--offline cannot be used with --cache-to")
+	}
+
+	if strings.HasPrefix(c.String("step-logs"), "s3://") {
+		cliutil.Exitf(build.ExitUser, "--offline cannot be used with the remote step logs %s", c.String("step-logs"))
+	}
+
+	if args := c.Args(); len(args) > 0 && build.IsRemoteContext(args[0]) {
+		cliutil.Exitf(build.ExitUser, "--offline cannot be used with the remote context %s", args[0])
+	}
+
+	for _, spec := range c.StringSlice("context") {
+		if parts := strings.SplitN(spec, "=", 2); len(parts) == 2 && build.IsRemoteContext(parts[1]) {
+			cliutil.Exitf(build.ExitUser, "--offline cannot be used with the remote build context %s", spec)
+		}
+	}
+}
+
+// checkOutputFlags fails if --output cannot be written the way it is asked
+func checkOutputFlags(c *cli.Context) {
+	if format := c.String("output-format"); format != build.OutputFormatDocker && format != build.OutputFormatOCI {
+		cliutil.Exitf(build.ExitUser, "Invalid --output-format %q, expected %s or %s", format, build.OutputFormatDocker, build.OutputFormatOCI)
+	}
+
+	if c.String("output") != "-" {
+		return
+	}
+
+	if log.IsTerminal() {
+		cliutil.Exitf(build.ExitUser, "Refusing to write the image archive to a terminal, redirect stdout or give a file to --output")
+	}
+	for _, flag := range []string{"attach", "debug-on-error"} {
+		if c.Bool(flag) {
+			cliutil.Exitf(build.ExitUser, "--%s cannot be used with --output -, stdout is taken by the image", flag)
+		}
+	}
+}
+
+// saveOutput writes the resulting image to the file or to stdout for "-";
+// the annotations go to the manifests of the OCI layout
+func saveOutput(builder *build.Build, output, format string, annotations map[string]string) {
+	var out io.Writer = os.Stdout
+
+	if output != "-" {
+		f, err := os.Create(output)
+		if err != nil {
+			cliutil.Exit(build.WithExitCode(build.ExitUser, err))
+		}
+		defer f.Close()
+		out = f
+	}
+
+	if format == build.OutputFormatDocker {
+		if err := builder.SaveImage(out); err != nil {
+			cliutil.Exit(err)
+		}
+	} else {
+		pr, pw := io.Pipe()
+		go func() {
+			pw.CloseWithError(builder.SaveImage(pw))
+		}()
+		if err := build.ConvertToOCILayout(pr, out, annotations); err != nil {
+			cliutil.Exit(err)
+		}
+	}
+
+	if output != "-" {
+		log.Infof("Saved the image to %s", output)
+	}
+}
+
+// initContexts resolves the named contexts given with --context name=path|url;
+// local paths are made absolute, remote ones are downloaded to temporary
+// directories that are removed by the returned cleanup
+func initContexts(c *cli.Context) (contexts map[string]string, cleanup func()) {
+	var dirs []string
+
+	cleanup = func() {
+		for _, dir := range dirs {
+			os.RemoveAll(dir)
+		}
+	}
+
+	contexts = map[string]string{}
+
+	for _, spec := range c.StringSlice("context") {
+		parts := strings.SplitN(spec, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			cliutil.Exitf(build.ExitUser, "Invalid --context %q, expected name=path|url", spec)
+		}
+
+		name, value := parts[0], parts[1]
+
+		if _, ok := contexts[name]; ok {
+			cliutil.Exitf(build.ExitUser, "Build context %q is given more than once", name)
+		}
+
+		if build.IsRemoteContext(value) {
+			dir, err := build.FetchContext(value, "", s3.New(nil, "").Open)
+			if err != nil {
+				cleanup()
+				cliutil.Exit(err)
+			}
+			dirs = append(dirs, dir)
+			contexts[name] = dir
+			continue
+		}
+
+		dir, err := util.MakeAbsolute(value)
+		if err != nil {
+			cliutil.Exit(build.WithExitCode(build.ExitUser, err))
+		}
+		contexts[name] = dir
+	}
+
+	return contexts, cleanup
+}
+
+// newPlan makes the build plan out of the Rockerfile and the command line options
+func newPlan(c *cli.Context, rockerfile *build.Rockerfile) build.Plan {
+	var err error
+
+	commands := rockerfile.Commands()
+	if flattenAfter := c.String("flatten-after"); flattenAfter != "" {
+		if commands, err = build.InsertFlatten(commands, flattenAfter); err != nil {
+			cliutil.Exit(build.WithExitCode(build.ExitUser, err))
+		}
+	}
+	if c.Bool("squash") {
+		commands = build.InsertSquash(commands)
+	}
+	if c.Bool("reproducible") {
+		commands = build.InsertNormalize(commands)
+	}
+
+	plan, err := build.NewPlan(commands, true)
+	if err != nil {
+		cliutil.Exit(build.WithExitCode(build.ExitUser, err))
+	}
+
+	return plan
+}
+
+// printPlan prints what the build would do for every command of the plan
+func printPlan(builder *build.Build, plan build.Plan) {
+	steps, err := builder.DryRun(plan)
+
+	run, cached := 0, 0
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "STEP\tSTATUS\tCOMMAND\tIMAGE")
+	for _, step := range steps {
+		status := step.Status
+		switch status {
+		case build.PlanRun:
+			run++
+		case build.PlanCached:
+			cached++
+		case "":
+			status = "-"
+		}
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%.12s\n", step.Step, status, step.Command, step.ImageID)
+	}
+	tw.Flush()
+
+	if err != nil {
+		cliutil.Exit(err)
+	}
+
+	log.Infof("%d steps would run, %d are cached", run, cached)
+}
+
+// resumeFile returns the file that keeps the progress of the builds of the Rockerfile
+func resumeFile(c *cli.Context, rockerfile *build.Rockerfile, contextDir string) string {
+	cacheDir, err := util.MakeAbsolute(c.String("cache-dir"))
+	if err != nil {
+		cliutil.Exit(build.WithExitCode(build.ExitUser, err))
+	}
+	name, err := filepath.Abs(rockerfile.Name)
+	if err != nil {
+		cliutil.Exit(err)
+	}
+	return build.ResumeFile(cacheDir, contextDir, name)
+}
+
+// resume restores the progress of the last failed build of the Rockerfile; when
+// there is none, or the Rockerfile changed since, the build starts from the beginning
+func resume(c *cli.Context, builder *build.Build, rockerfile *build.Rockerfile, contextDir string) {
+	if c.String("restore") != "" {
+		cliutil.Exitf(build.ExitUser, "--resume and --restore cannot be used together")
+	}
+
+	file := resumeFile(c, rockerfile, contextDir)
+
+	cp, err := build.ReadCheckpoint(file)
+	if os.IsNotExist(err) {
+		log.Infof("Nothing to resume, the last build of %s succeeded or did not start", rockerfile.Name)
+		return
+	}
+	if err != nil {
+		cliutil.Exit(build.WithExitCode(build.ExitUser, err))
+	}
+
+	if err := builder.Restore(cp); err != nil {
+		log.Warnf("Cannot resume, build from the beginning: %s", err)
+		return
+	}
+	log.Infof("Resume build %s from step %d", cp.BuildID, cp.Next+1)
+}
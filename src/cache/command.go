@@ -0,0 +1,86 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+// Package cache implements the cache command, which manages the local cache
+// of the build steps outside of a build
+package cache
+
+import (
+	"context"
+
+	"github.com/grammarly/rocker/src/build"
+	"github.com/grammarly/rocker/src/cliutil"
+	"github.com/grammarly/rocker/src/dockerclient"
+	"github.com/grammarly/rocker/src/util"
+
+	"github.com/codegangsta/cli"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// CommandSpec returns specifications of the cache command for codegangsta/cli
+func CommandSpec() cli.Command {
+	return cli.Command{
+		Name:  "cache",
+		Usage: "manages the local cache of the build steps",
+		Subcommands: []cli.Command{
+			{
+				Name:   "seed",
+				Usage:  "pulls the images of the cache that `rocker build --cache-to` exported, e.g. quay.io/acme/app, and puts their steps into the local cache",
+				Action: seedCommand,
+				Flags: []cli.Flag{
+					cli.StringFlag{
+						Name:  "cache-dir",
+						Value: "~/.rocker_cache",
+						Usage: "Set the directory where the cache will be stored",
+					},
+					cli.StringFlag{
+						Name:  "auth, a",
+						Value: "",
+						Usage: "Username and password in user:password format",
+					},
+				},
+			},
+		},
+	}
+}
+
+// seedCommand implements 'cache seed' command that warms up the local cache from the registry
+func seedCommand(c *cli.Context) {
+	if len(c.Args()) == 0 {
+		cliutil.Exitf(build.ExitUser, "rocker cache seed <cache>..., e.g. quay.io/acme/app or quay.io/acme/app:rocker-cache")
+	}
+
+	dockerClient, err := dockerclient.NewFromCli(c)
+	if err != nil {
+		cliutil.Exit(build.WithExitCode(build.ExitInfra, err))
+	}
+
+	cacheDir, err := util.MakeAbsolute(c.String("cache-dir"))
+	if err != nil {
+		cliutil.Exit(build.WithExitCode(build.ExitUser, err))
+	}
+
+	client := cliutil.NewCommandClient(c, dockerClient, cliutil.InitAuth(c))
+	local := build.NewCacheFS(cacheDir)
+
+	for _, name := range c.Args() {
+		seeded, err := build.SeedCache(context.Background(), client, local, name)
+		if err != nil {
+			cliutil.Exit(err)
+		}
+		log.Infof("Seeded %d cached steps from %s to %s", seeded, name, cacheDir)
+	}
+}
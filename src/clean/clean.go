@@ -0,0 +1,327 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package clean removes what rocker builds leave behind: the containers of failed
+// and interrupted builds, the intermediate images nothing refers to and, on request,
+// the cache
+package clean
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/grammarly/rocker/src/build"
+
+	"github.com/fsouza/go-dockerclient"
+)
+
+// buildIDLabel is the only label older versions of rocker left on the images they
+// committed, and only without --reproducible; build.ImageLabel is on all of them now
+const buildIDLabel = "rocker.builder.build-id"
+
+var (
+	// The containers of build steps are named rocker_<build id>_<n>
+	buildContainerName = regexp.MustCompile(`^rocker_.+_[0-9]+$`)
+
+	// MOUNT and EXPORT keep their data in containers between builds
+	volumeContainerName = regexp.MustCompile(`^rocker_(mount|exports)_[0-9a-f]+$`)
+)
+
+// Kinds of the removed things
+const (
+	Container = "container"
+	Image     = "image"
+	Cache     = "cache"
+)
+
+// DockerAPI is the part of the docker client clean needs
+type DockerAPI interface {
+	ListContainers(opts docker.ListContainersOptions) ([]docker.APIContainers, error)
+	RemoveContainer(opts docker.RemoveContainerOptions) error
+	ListImages(opts docker.ListImagesOptions) ([]docker.APIImages, error)
+	RemoveImage(name string) error
+}
+
+// Options tell what to clean
+type Options struct {
+	CacheDir string
+
+	// Cache removes the cache directory, the images only the cache refers to,
+	// and the containers of MOUNT and EXPORT
+	Cache bool
+
+	// DryRun only reports what would be removed
+	DryRun bool
+}
+
+// Item is a container, an image or the cache directory that was removed
+type Item struct {
+	Kind string
+	ID   string
+	Name string
+	Size int64
+}
+
+// Report is what was removed, what was left and why
+type Report struct {
+	Removed   []Item
+	Skipped   []Item
+	Errors    []error
+	Reclaimed int64
+}
+
+func (r *Report) remove(item Item) {
+	r.Removed = append(r.Removed, item)
+	r.Reclaimed += item.Size
+}
+
+// Run removes the leftovers of the builds; the failures to remove single things are
+// collected in the report, the error is returned when the docker daemon cannot list them
+func Run(client DockerAPI, opts Options) (*Report, error) {
+	r := &Report{}
+
+	if err := cleanContainers(client, opts, r); err != nil {
+		return r, err
+	}
+	if err := cleanImages(client, opts, r); err != nil {
+		return r, err
+	}
+	if opts.Cache {
+		cleanCache(opts, r)
+	}
+
+	return r, nil
+}
+
+// cleanContainers removes the stopped containers of the build steps; the running
+// ones may belong to a build that is in progress
+func cleanContainers(client DockerAPI, opts Options, r *Report) error {
+	containers, err := client.ListContainers(docker.ListContainersOptions{All: true, Size: true})
+	if err != nil {
+		return fmt.Errorf("Failed to list containers, error: %s", err)
+	}
+
+	for _, c := range containers {
+		name := containerName(c)
+		switch {
+		case volumeContainerName.MatchString(name):
+			if !opts.Cache {
+				continue
+			}
+		case !buildContainerName.MatchString(name):
+			continue
+		}
+
+		item := Item{Kind: Container, ID: c.ID, Name: name, Size: c.SizeRw}
+
+		if c.State == "running" || strings.HasPrefix(c.Status, "Up ") {
+			r.Skipped = append(r.Skipped, item)
+			continue
+		}
+
+		if !opts.DryRun {
+			err := client.RemoveContainer(docker.RemoveContainerOptions{ID: c.ID, RemoveVolumes: true})
+			if err != nil {
+				r.Errors = append(r.Errors, fmt.Errorf("Failed to remove container %s, error: %s", name, err))
+				continue
+			}
+		}
+		r.remove(item)
+	}
+
+	return nil
+}
+
+// cleanImages removes the untagged images rocker committed that have no children
+// and are not in the cache, along with their untagged parents, as docker does;
+// temporary images of an interrupted flatten go too
+func cleanImages(client DockerAPI, opts Options, r *Report) error {
+	images, err := client.ListImages(docker.ListImagesOptions{All: true})
+	if err != nil {
+		return fmt.Errorf("Failed to list images, error: %s", err)
+	}
+
+	cached := map[string]bool{}
+	if !opts.Cache {
+		if cached, err = cachedImages(opts.CacheDir); err != nil {
+			return err
+		}
+	}
+
+	g := newImageGraph(images)
+
+	for _, img := range images {
+		// Gone with a child already, or has children
+		if _, ok := g.images[img.ID]; !ok || len(g.children[img.ID]) > 0 || cached[img.ID] {
+			continue
+		}
+		if !(isIntermediate(img) || isFlattenLeftover(img)) {
+			continue
+		}
+
+		if !opts.DryRun {
+			if err := client.RemoveImage(img.ID); err != nil {
+				r.Errors = append(r.Errors, fmt.Errorf("Failed to remove image %.19s, error: %s", img.ID, err))
+				continue
+			}
+		}
+
+		for _, item := range g.remove(img.ID) {
+			r.remove(item)
+		}
+	}
+
+	return nil
+}
+
+// cleanCache removes the cache directory
+func cleanCache(opts Options, r *Report) {
+	size, err := dirSize(opts.CacheDir)
+	if os.IsNotExist(err) {
+		return
+	}
+	if err != nil {
+		r.Errors = append(r.Errors, fmt.Errorf("Failed to read cache %s, error: %s", opts.CacheDir, err))
+		return
+	}
+
+	if !opts.DryRun {
+		if err := os.RemoveAll(opts.CacheDir); err != nil {
+			r.Errors = append(r.Errors, fmt.Errorf("Failed to remove cache %s, error: %s", opts.CacheDir, err))
+			return
+		}
+	}
+	r.remove(Item{Kind: Cache, Name: opts.CacheDir, Size: size})
+}
+
+// cachedImages returns the images the cache refers to, it keeps the states
+// as <parent id>/<image id>.json
+func cachedImages(dir string) (map[string]bool, error) {
+	images := map[string]bool{}
+
+	files, err := filepath.Glob(filepath.Join(dir, "*", "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		images[strings.TrimSuffix(filepath.Base(file), ".json")] = true
+		images[filepath.Base(filepath.Dir(file))] = true
+	}
+
+	return images, nil
+}
+
+// imageGraph tells which images docker removes along with an image
+type imageGraph struct {
+	images   map[string]docker.APIImages
+	children map[string]map[string]bool
+}
+
+func newImageGraph(images []docker.APIImages) *imageGraph {
+	g := &imageGraph{
+		images:   map[string]docker.APIImages{},
+		children: map[string]map[string]bool{},
+	}
+	for _, img := range images {
+		g.images[img.ID] = img
+		if img.ParentID != "" {
+			if g.children[img.ParentID] == nil {
+				g.children[img.ParentID] = map[string]bool{}
+			}
+			g.children[img.ParentID][img.ID] = true
+		}
+	}
+	return g
+}
+
+// remove takes the image out of the graph along with the untagged parents
+// that are left without children
+func (g *imageGraph) remove(id string) (removed []Item) {
+	for id != "" {
+		img, ok := g.images[id]
+		if !ok || len(g.children[id]) > 0 {
+			break
+		}
+		if len(removed) > 0 && len(tags(img)) > 0 {
+			break
+		}
+
+		// The size the image adds to its parent
+		size := img.Size
+		if parent, ok := g.images[img.ParentID]; ok {
+			size -= parent.Size
+		}
+
+		removed = append(removed, Item{Kind: Image, ID: id, Name: strings.Join(tags(img), ", "), Size: size})
+		delete(g.images, id)
+		delete(g.children[img.ParentID], id)
+
+		id = img.ParentID
+	}
+	return removed
+}
+
+func isIntermediate(img docker.APIImages) bool {
+	_, ok := img.Labels[build.ImageLabel]
+	if !ok {
+		_, ok = img.Labels[buildIDLabel]
+	}
+	return ok && len(tags(img)) == 0
+}
+
+func isFlattenLeftover(img docker.APIImages) bool {
+	t := tags(img)
+	return len(t) == 1 && strings.HasPrefix(t[0], "rocker-flatten:")
+}
+
+// tags returns the names of the image, docker lists untagged images as <none>:<none>
+func tags(img docker.APIImages) []string {
+	result := []string{}
+	for _, tag := range img.RepoTags {
+		if tag != "<none>:<none>" {
+			result = append(result, tag)
+		}
+	}
+	sort.Strings(result)
+	return result
+}
+
+func containerName(c docker.APIContainers) string {
+	if len(c.Names) == 0 {
+		return ""
+	}
+	return strings.TrimPrefix(c.Names[0], "/")
+}
+
+func dirSize(dir string) (size int64, err error) {
+	if _, err := os.Stat(dir); err != nil {
+		return 0, err
+	}
+	err = filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size, err
+}
@@ -0,0 +1,198 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package clean
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/grammarly/rocker/src/build"
+
+	"github.com/fsouza/go-dockerclient"
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeDocker struct {
+	containers []docker.APIContainers
+	images     []docker.APIImages
+
+	removedContainers []string
+	removedImages     []string
+	failImages        map[string]bool
+}
+
+func (f *fakeDocker) ListContainers(opts docker.ListContainersOptions) ([]docker.APIContainers, error) {
+	return f.containers, nil
+}
+
+func (f *fakeDocker) RemoveContainer(opts docker.RemoveContainerOptions) error {
+	f.removedContainers = append(f.removedContainers, opts.ID)
+	return nil
+}
+
+func (f *fakeDocker) ListImages(opts docker.ListImagesOptions) ([]docker.APIImages, error) {
+	return f.images, nil
+}
+
+func (f *fakeDocker) RemoveImage(name string) error {
+	if f.failImages[name] {
+		return fmt.Errorf("image is used by a container")
+	}
+	f.removedImages = append(f.removedImages, name)
+	return nil
+}
+
+// rockerLabels are what a build with the default flags stamps on the images it commits
+var rockerLabels = map[string]string{
+	build.ImageLabel:          "true",
+	"rocker.builder.build-id": "42",
+	"rocker.builder.version":  "1.3.1",
+}
+
+func newFakeDocker() *fakeDocker {
+	return &fakeDocker{
+		containers: []docker.APIContainers{
+			{ID: "c1", Names: []string{"/rocker_42_1"}, State: "exited", SizeRw: 100},
+			{ID: "c2", Names: []string{"/rocker_43_1"}, State: "running", SizeRw: 100},
+			{ID: "c3", Names: []string{"/rocker_mount_a1b2c3"}, State: "created", SizeRw: 1000},
+			{ID: "c4", Names: []string{"/postgres"}, State: "exited"},
+		},
+		images: []docker.APIImages{
+			{ID: "base", RepoTags: []string{"ubuntu:16.04"}, Size: 100},
+			{ID: "i1", ParentID: "base", RepoTags: []string{"<none>:<none>"}, Labels: rockerLabels, Size: 110},
+			{ID: "i2", ParentID: "i1", Labels: rockerLabels, Size: 130},
+			{ID: "app", ParentID: "base", RepoTags: []string{"app:1"}, Labels: rockerLabels, Size: 150},
+			{ID: "cached", ParentID: "base", Labels: rockerLabels, Size: 200},
+			{ID: "other", ParentID: "base", Size: 300},
+			{ID: "flat", RepoTags: []string{"rocker-flatten:123456789012"}, Size: 50},
+		},
+	}
+}
+
+func makeCacheDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "rocker-clean-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(dir, "base"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "base", "cached.json"), []byte("{}"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func TestRun(t *testing.T) {
+	dir := makeCacheDir(t)
+	defer os.RemoveAll(dir)
+
+	f := newFakeDocker()
+	r, err := Run(f, Options{CacheDir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, []string{"c1"}, f.removedContainers)
+	assert.Equal(t, []string{"i2", "flat"}, f.removedImages)
+	assert.Len(t, r.Skipped, 1)
+	assert.Empty(t, r.Errors)
+
+	// i1 goes along with i2, each counts the size it adds to the parent
+	assert.Len(t, r.Removed, 4)
+	assert.Equal(t, int64(100+20+10+50), r.Reclaimed)
+
+	_, err = os.Stat(dir)
+	assert.Nil(t, err)
+}
+
+func TestRun_Cache(t *testing.T) {
+	dir := makeCacheDir(t)
+	defer os.RemoveAll(dir)
+
+	f := newFakeDocker()
+	r, err := Run(f, Options{CacheDir: dir, Cache: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, []string{"c1", "c3"}, f.removedContainers)
+	assert.Equal(t, []string{"i2", "cached", "flat"}, f.removedImages)
+	assert.Equal(t, Cache, r.Removed[len(r.Removed)-1].Kind)
+
+	_, err = os.Stat(dir)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestRun_DryRun(t *testing.T) {
+	dir := makeCacheDir(t)
+	defer os.RemoveAll(dir)
+
+	f := newFakeDocker()
+	f.failImages = map[string]bool{"i2": true}
+
+	r, err := Run(f, Options{CacheDir: dir, Cache: true, DryRun: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Empty(t, f.removedContainers)
+	assert.Empty(t, f.removedImages)
+	assert.Len(t, r.Removed, 7)
+
+	_, err = os.Stat(dir)
+	assert.Nil(t, err)
+}
+
+func TestRun_Errors(t *testing.T) {
+	f := newFakeDocker()
+	f.failImages = map[string]bool{"i2": true}
+
+	r, err := Run(f, Options{CacheDir: "/nonexistent"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, []string{"cached", "flat"}, f.removedImages)
+	assert.Len(t, r.Errors, 1)
+}
+
+func TestRun_ImageLabels(t *testing.T) {
+	for _, labels := range []map[string]string{
+		// --reproducible and --no-builder-labels leave only the tracking label
+		{build.ImageLabel: "true"},
+		// images of older versions only have the build id
+		{"rocker.builder.build-id": "42"},
+	} {
+		f := &fakeDocker{
+			images: []docker.APIImages{
+				{ID: "base", RepoTags: []string{"ubuntu:16.04"}, Size: 100},
+				{ID: "i1", ParentID: "base", RepoTags: []string{"<none>:<none>"}, Labels: labels, Size: 110},
+				{ID: "other", ParentID: "base", Size: 300},
+			},
+		}
+
+		if _, err := Run(f, Options{CacheDir: "/nonexistent"}); err != nil {
+			t.Fatal(err)
+		}
+
+		assert.Equal(t, []string{"i1"}, f.removedImages, "labels %v", labels)
+	}
+}
@@ -0,0 +1,109 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package clean
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/grammarly/rocker/src/build"
+	"github.com/grammarly/rocker/src/cliutil"
+	"github.com/grammarly/rocker/src/dockerclient"
+	"github.com/grammarly/rocker/src/util"
+
+	"github.com/codegangsta/cli"
+	"github.com/docker/docker/pkg/units"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// CommandSpec returns specifications of the clean command for codegangsta/cli
+func CommandSpec() cli.Command {
+	return cli.Command{
+		Name:   "clean",
+		Usage:  "removes the containers of failed builds and the intermediate images nothing refers to, and reports the reclaimed space",
+		Action: cleanCommand,
+		Flags: []cli.Flag{
+			cli.StringFlag{
+				Name:  "cache-dir",
+				Value: "~/.rocker_cache",
+				Usage: "Set the directory where the cache will be stored",
+			},
+			cli.BoolFlag{
+				Name:  "cache",
+				Usage: "also remove the cache, the images only the cache refers to and the containers of MOUNT and EXPORT",
+			},
+			cli.BoolFlag{
+				Name:  "dry-run",
+				Usage: "only print what would be removed",
+			},
+		},
+	}
+}
+
+// cleanCommand implements 'clean' command that removes what the builds left behind
+func cleanCommand(c *cli.Context) {
+	dockerClient, err := dockerclient.NewFromCli(c)
+	if err != nil {
+		cliutil.Exit(build.WithExitCode(build.ExitInfra, err))
+	}
+
+	cacheDir, err := util.MakeAbsolute(c.String("cache-dir"))
+	if err != nil {
+		cliutil.Exit(build.WithExitCode(build.ExitUser, err))
+	}
+
+	dryRun := c.Bool("dry-run")
+
+	report, err := Run(dockerClient, Options{
+		CacheDir: cacheDir,
+		Cache:    c.Bool("cache"),
+		DryRun:   dryRun,
+	})
+	if err != nil {
+		cliutil.Exit(build.WithExitCode(build.ExitInfra, err))
+	}
+
+	action := "Removed"
+	if dryRun {
+		action = "Would remove"
+	}
+
+	for _, item := range report.Removed {
+		name := item.Name
+		if name == "" {
+			name = fmt.Sprintf("%.19s", item.ID)
+		}
+		log.Infof("%s %s %s (%s)", action, item.Kind, name, units.HumanSize(float64(item.Size)))
+	}
+	for _, item := range report.Skipped {
+		log.Warnf("Skip %s %s, it is running", item.Kind, item.Name)
+	}
+	for _, err := range report.Errors {
+		log.Error(err)
+	}
+
+	if dryRun {
+		log.Infof("Would reclaim %s", units.HumanSize(float64(report.Reclaimed)))
+	} else {
+		log.Infof("Reclaimed %s", units.HumanSize(float64(report.Reclaimed)))
+	}
+
+	if len(report.Errors) > 0 {
+		os.Exit(build.ExitFailure)
+	}
+}
@@ -0,0 +1,131 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cliutil
+
+import (
+	"os"
+	"strings"
+
+	"github.com/grammarly/rocker/src/build"
+	"github.com/grammarly/rocker/src/dockerclient"
+	"github.com/grammarly/rocker/src/storage/s3"
+	"github.com/grammarly/rocker/src/util"
+
+	"github.com/codegangsta/cli"
+	"github.com/fsouza/go-dockerclient"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// InitAuth takes the registry credentials of --auth, or of ~/.docker/config.json
+// if it is not given, and registers the passwords as secrets
+func InitAuth(c *cli.Context) (auth *docker.AuthConfigurations) {
+	var err error
+	if c.IsSet("auth") {
+		// Obtain auth configuration from cli params
+		authParam := c.String("auth")
+		if strings.Contains(authParam, ":") {
+			userPass := strings.Split(authParam, ":")
+			auth = &docker.AuthConfigurations{
+				Configs: map[string]docker.AuthConfiguration{
+					"*": docker.AuthConfiguration{
+						Username: userPass[0],
+						Password: userPass[1],
+					},
+				},
+			}
+		}
+		RedactAuth(auth)
+		return
+	}
+	// Obtain auth configuration from .docker/config.json
+	if auth, err = docker.NewAuthConfigurationsFromDockerCfg(); err != nil && !os.IsNotExist(err) {
+		Exit(build.WithExitCode(build.ExitUser, err))
+	}
+	RedactAuth(auth)
+	return
+}
+
+// NewAuthProvider makes the chain of the registry credential sources: ECR tokens,
+// ROCKER_AUTH_* variables, the --auth-url service, then --auth or ~/.docker/config.json
+func NewAuthProvider(c *cli.Context, auth *docker.AuthConfigurations) dockerclient.AuthProvider {
+	providers := dockerclient.AuthProviders{
+		dockerclient.ECRAuthProvider{},
+		dockerclient.EnvAuthProvider{},
+	}
+
+	if url := c.GlobalString("auth-url"); url != "" {
+		Redactor.Add(c.GlobalString("auth-token"))
+		providers = append(providers, dockerclient.HTTPAuthProvider{
+			URL:   url,
+			Token: c.GlobalString("auth-token"),
+		})
+	}
+
+	providers = append(providers, dockerclient.ConfigAuthProvider{Auth: auth})
+
+	return &dockerclient.CachedAuthProvider{Provider: redactingAuthProvider{providers}}
+}
+
+// redactingAuthProvider registers the passwords it gives away as secrets
+type redactingAuthProvider struct {
+	provider dockerclient.AuthProvider
+}
+
+func (p redactingAuthProvider) GetCredentials(registry string) (dockerclient.Credentials, error) {
+	creds, err := p.provider.GetCredentials(registry)
+	if creds.Password != "" {
+		Redactor.Add(creds.Password)
+		Redactor.Add(creds.Username + ":" + creds.Password)
+	}
+	return creds, err
+}
+
+// RedactAuth registers the registry passwords as secrets
+func RedactAuth(auth *docker.AuthConfigurations) {
+	if auth == nil {
+		return
+	}
+	for _, config := range auth.Configs {
+		if config.Password != "" {
+			Redactor.Add(config.Password)
+			Redactor.Add(config.Username + ":" + config.Password)
+		}
+	}
+}
+
+// NewCommandClient makes the client for the commands that pull or push images
+// outside of a build
+func NewCommandClient(c *cli.Context, dockerClient *docker.Client, auth *docker.AuthConfigurations) *build.DockerClient {
+	cacheDir, err := util.MakeAbsolute(c.String("cache-dir"))
+	if err != nil {
+		Exit(build.WithExitCode(build.ExitUser, err))
+	}
+
+	options := build.DockerClientOptions{
+		Client:                   dockerClient,
+		Auth:                     auth,
+		AuthProvider:             NewAuthProvider(c, auth),
+		Log:                      log.StandardLogger(),
+		S3storage:                s3.New(dockerClient, cacheDir),
+		StdoutContainerFormatter: log.StandardLogger().Formatter,
+		StderrContainerFormatter: log.StandardLogger().Formatter,
+		PullRetryCount:           c.GlobalInt("pull-retry"),
+		PullMirror:               c.GlobalString("pull-mirror"),
+	}
+	return build.NewDockerClient(options)
+}
@@ -0,0 +1,116 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package cliutil holds what the commands of rocker share: the state of the
+// run, the exit codes, the registry credentials and the template sandbox
+package cliutil
+
+import (
+	"os"
+
+	"github.com/grammarly/rocker/src/build"
+	"github.com/grammarly/rocker/src/dockerclient"
+	"github.com/grammarly/rocker/src/features"
+	"github.com/grammarly/rocker/src/redact"
+	"github.com/grammarly/rocker/src/template"
+
+	"github.com/codegangsta/cli"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+var (
+	// Version of the running rocker, main sets it from its -ldflags
+	Version = "built locally"
+
+	// GitCommit of the running rocker, main sets it from its -ldflags
+	GitCommit = "none"
+
+	// BuildID identifies the current run in image labels, logs, artifact files and container names
+	BuildID string
+
+	// Features are the optional subsystems turned on for the current run
+	Features features.Set
+
+	// Redactor masks the secrets in all logs
+	Redactor = redact.New()
+
+	exitHooks []func()
+)
+
+// OnExit registers fn to run when Exit or Exitf terminate rocker, os.Exit
+// skips the deferred calls of the command
+func OnExit(fn func()) {
+	exitHooks = append(exitHooks, fn)
+}
+
+// Exit logs the error and exits with the code of its kind, see build.ExitCode
+func Exit(err error) {
+	log.Error(err)
+	runExitHooks()
+	os.Exit(build.ExitCode(err))
+}
+
+// Exitf logs the message and exits with the given code
+func Exitf(code int, format string, args ...interface{}) {
+	log.Errorf(format, args...)
+	runExitHooks()
+	os.Exit(code)
+}
+
+func runExitHooks() {
+	for _, fn := range exitHooks {
+		fn()
+	}
+	dockerclient.CloseSSHTunnels()
+}
+
+// ReadVars reads the variables of --vars files and --var values, the latter win
+func ReadVars(c *cli.Context) template.Vars {
+	vars, err := template.VarsFromFileMulti(c.StringSlice("vars"))
+	if err != nil {
+		Exit(build.WithExitCode(build.ExitUser, err))
+	}
+	cliVars, err := template.VarsFromStrings(c.StringSlice("var"))
+	if err != nil {
+		Exit(build.WithExitCode(build.ExitUser, err))
+	}
+	return vars.Merge(cliVars)
+}
+
+// TemplateSandbox restricts the templates of the Rockerfiles to the environment
+// variables of --template-env and the files of the directory, unless --unsafe-templates
+func TemplateSandbox(c *cli.Context, dir string) *template.Sandbox {
+	if c.GlobalBool("unsafe-templates") {
+		return nil
+	}
+	return &template.Sandbox{
+		Env:     c.GlobalStringSlice("template-env"),
+		Dir:     dir,
+		Timeout: c.GlobalDuration("template-timeout"),
+	}
+}
+
+// GlobalArgs returns the global flags rocker was run with, e.g. --json, which go
+// before the name of the command, to run rocker again with the same ones
+func GlobalArgs(command string) []string {
+	for i, arg := range os.Args[1:] {
+		if arg == command {
+			return append([]string{}, os.Args[1:i+1]...)
+		}
+	}
+	return []string{}
+}
@@ -0,0 +1,61 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cliutil
+
+import (
+	"os"
+	"testing"
+
+	"github.com/grammarly/rocker/src/redact"
+
+	"github.com/fsouza/go-dockerclient"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGlobalArgs(t *testing.T) {
+	args := os.Args
+	defer func() { os.Args = args }()
+
+	os.Args = []string{"rocker", "--json", "-vv", "workspace", "build", "app"}
+	assert.Equal(t, []string{"--json", "-vv"}, GlobalArgs("workspace"))
+
+	os.Args = []string{"rocker", "workspace", "build"}
+	assert.Equal(t, []string{}, GlobalArgs("workspace"))
+}
+
+func TestRedactAuth(t *testing.T) {
+	RedactAuth(&docker.AuthConfigurations{
+		Configs: map[string]docker.AuthConfiguration{
+			"quay.io": {Username: "bob", Password: "s3cret"},
+		},
+	})
+	RedactAuth(nil)
+
+	assert.Equal(t, "login "+redact.Mask+" and "+redact.Mask, Redactor.String("login bob:s3cret and s3cret"))
+}
+
+func TestOnExit(t *testing.T) {
+	hooks := exitHooks
+	defer func() { exitHooks = hooks }()
+
+	var calls []string
+	OnExit(func() { calls = append(calls, "first") })
+	OnExit(func() { calls = append(calls, "second") })
+
+	runExitHooks()
+	assert.Equal(t, []string{"first", "second"}, calls)
+}
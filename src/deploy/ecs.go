@@ -0,0 +1,147 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package deploy rolls out a freshly pushed image to ECS or Nomad
+// by updating the task definition or the job spec with its reference.
+package deploy
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ecs"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// ECSTarget is an ECS task definition family and optionally the service that runs it
+type ECSTarget struct {
+	Family    string
+	Container string
+	Cluster   string
+	Service   string
+}
+
+// ecsAPI is the part of the ECS API we need
+type ecsAPI interface {
+	DescribeTaskDefinition(*ecs.DescribeTaskDefinitionInput) (*ecs.DescribeTaskDefinitionOutput, error)
+	RegisterTaskDefinition(*ecs.RegisterTaskDefinitionInput) (*ecs.RegisterTaskDefinitionOutput, error)
+	UpdateService(*ecs.UpdateServiceInput) (*ecs.UpdateServiceOutput, error)
+}
+
+// ParseECSTarget parses family[:container], and the service in the form of cluster/service, if any
+func ParseECSTarget(task, service string) (t ECSTarget, err error) {
+	parts := strings.SplitN(task, ":", 2)
+	if parts[0] == "" {
+		return t, fmt.Errorf("Invalid ECS task %q, expected family[:container]", task)
+	}
+	t.Family = parts[0]
+	if len(parts) == 2 {
+		t.Container = parts[1]
+	}
+
+	if service != "" {
+		parts = strings.SplitN(service, "/", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return t, fmt.Errorf("Invalid ECS service %q, expected cluster/service", service)
+		}
+		t.Cluster, t.Service = parts[0], parts[1]
+	}
+
+	return t, nil
+}
+
+// UpdateECS registers a new revision of the task definition with the image
+// set for the container and points the service to it, if given. The region
+// and the credentials are taken from the environment, as with ECR.
+func UpdateECS(target ECSTarget, image, region string) (taskDefinitionArn string, err error) {
+	cfg := &aws.Config{}
+	if region != "" {
+		cfg.Region = aws.String(region)
+	}
+	if log.StandardLogger().Level >= log.DebugLevel {
+		cfg.LogLevel = aws.LogLevel(aws.LogDebugWithRequestErrors)
+	}
+
+	return updateECS(ecs.New(session.New(), cfg), target, image)
+}
+
+func updateECS(svc ecsAPI, target ECSTarget, image string) (taskDefinitionArn string, err error) {
+	res, err := svc.DescribeTaskDefinition(&ecs.DescribeTaskDefinitionInput{
+		TaskDefinition: aws.String(target.Family),
+	})
+	if err != nil {
+		return "", fmt.Errorf("Failed to get ECS task definition %s, error: %s", target.Family, err)
+	}
+
+	current := res.TaskDefinition
+
+	container, err := findContainer(current.ContainerDefinitions, target.Container)
+	if err != nil {
+		return "", fmt.Errorf("ECS task definition %s: %s", target.Family, err)
+	}
+	container.Image = aws.String(image)
+
+	registered, err := svc.RegisterTaskDefinition(&ecs.RegisterTaskDefinitionInput{
+		Family:               current.Family,
+		ContainerDefinitions: current.ContainerDefinitions,
+		Volumes:              current.Volumes,
+	})
+	if err != nil {
+		return "", fmt.Errorf("Failed to register ECS task definition %s, error: %s", target.Family, err)
+	}
+
+	taskDefinitionArn = aws.StringValue(registered.TaskDefinition.TaskDefinitionArn)
+
+	log.Infof("Registered ECS task definition %s with %s", taskDefinitionArn, image)
+
+	if target.Service == "" {
+		return taskDefinitionArn, nil
+	}
+
+	_, err = svc.UpdateService(&ecs.UpdateServiceInput{
+		Cluster:        aws.String(target.Cluster),
+		Service:        aws.String(target.Service),
+		TaskDefinition: aws.String(taskDefinitionArn),
+	})
+	if err != nil {
+		return "", fmt.Errorf("Failed to update ECS service %s/%s, error: %s", target.Cluster, target.Service, err)
+	}
+
+	log.Infof("Updated ECS service %s/%s", target.Cluster, target.Service)
+
+	return taskDefinitionArn, nil
+}
+
+// findContainer returns the container by name, or the only one if the name is not given
+func findContainer(containers []*ecs.ContainerDefinition, name string) (*ecs.ContainerDefinition, error) {
+	if name == "" {
+		if len(containers) != 1 {
+			return nil, fmt.Errorf("has %d containers, specify which one to update with family:container", len(containers))
+		}
+		return containers[0], nil
+	}
+
+	for _, c := range containers {
+		if aws.StringValue(c.Name) == name {
+			return c, nil
+		}
+	}
+
+	return nil, fmt.Errorf("has no container %s", name)
+}
@@ -0,0 +1,82 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package deploy
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecs"
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeECS struct {
+	registered *ecs.RegisterTaskDefinitionInput
+	updated    *ecs.UpdateServiceInput
+}
+
+func (f *fakeECS) DescribeTaskDefinition(in *ecs.DescribeTaskDefinitionInput) (*ecs.DescribeTaskDefinitionOutput, error) {
+	return &ecs.DescribeTaskDefinitionOutput{
+		TaskDefinition: &ecs.TaskDefinition{
+			Family: in.TaskDefinition,
+			ContainerDefinitions: []*ecs.ContainerDefinition{
+				{Name: aws.String("app"), Image: aws.String("acme/app:1")},
+				{Name: aws.String("proxy"), Image: aws.String("envoy")},
+			},
+		},
+	}, nil
+}
+
+func (f *fakeECS) RegisterTaskDefinition(in *ecs.RegisterTaskDefinitionInput) (*ecs.RegisterTaskDefinitionOutput, error) {
+	f.registered = in
+	return &ecs.RegisterTaskDefinitionOutput{
+		TaskDefinition: &ecs.TaskDefinition{TaskDefinitionArn: aws.String("arn:web:2")},
+	}, nil
+}
+
+func (f *fakeECS) UpdateService(in *ecs.UpdateServiceInput) (*ecs.UpdateServiceOutput, error) {
+	f.updated = in
+	return &ecs.UpdateServiceOutput{}, nil
+}
+
+func TestParseECSTarget(t *testing.T) {
+	target, err := ParseECSTarget("web:app", "prod/web")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, ECSTarget{Family: "web", Container: "app", Cluster: "prod", Service: "web"}, target)
+
+	_, err = ParseECSTarget("web", "web")
+	assert.Error(t, err)
+}
+
+func TestUpdateECS(t *testing.T) {
+	svc := &fakeECS{}
+
+	arn, err := updateECS(svc, ECSTarget{Family: "web", Container: "app", Cluster: "prod", Service: "web"}, "acme/app@sha256:abc")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, "arn:web:2", arn)
+	assert.Equal(t, "acme/app@sha256:abc", aws.StringValue(svc.registered.ContainerDefinitions[0].Image))
+	assert.Equal(t, "envoy", aws.StringValue(svc.registered.ContainerDefinitions[1].Image))
+	assert.Equal(t, "arn:web:2", aws.StringValue(svc.updated.TaskDefinition))
+
+	_, err = updateECS(&fakeECS{}, ECSTarget{Family: "web"}, "acme/app@sha256:abc")
+	assert.Error(t, err, "should ask which of the two containers to update")
+}
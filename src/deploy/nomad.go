@@ -0,0 +1,163 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package deploy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// DefaultNomadAddr is the address of the local Nomad agent
+const DefaultNomadAddr = "http://127.0.0.1:4646"
+
+// NomadTarget is a Nomad job and optionally the task in it to update
+type NomadTarget struct {
+	Job   string
+	Group string
+	Task  string
+}
+
+// ParseNomadTarget parses job[:group/task] or job[:task]
+func ParseNomadTarget(spec string) (t NomadTarget, err error) {
+	parts := strings.SplitN(spec, ":", 2)
+	if parts[0] == "" {
+		return t, fmt.Errorf("Invalid Nomad job %q, expected job[:group/task]", spec)
+	}
+	t.Job = parts[0]
+
+	if len(parts) == 2 {
+		if slash := strings.Index(parts[1], "/"); slash >= 0 {
+			t.Group, t.Task = parts[1][:slash], parts[1][slash+1:]
+		} else {
+			t.Task = parts[1]
+		}
+	}
+
+	return t, nil
+}
+
+// UpdateNomad sets the image in the config of the docker task of the job
+// and submits the job back, which makes Nomad roll it out. The token is
+// optional, it is the ACL token sent as X-Nomad-Token.
+func UpdateNomad(addr, token string, target NomadTarget, image string) error {
+	if addr == "" {
+		addr = DefaultNomadAddr
+	}
+	uri := fmt.Sprintf("%s/v1/job/%s", strings.TrimSuffix(addr, "/"), url.QueryEscape(target.Job))
+
+	job := map[string]interface{}{}
+	if err := nomadRequest("GET", uri, token, nil, &job); err != nil {
+		return err
+	}
+
+	config, err := findNomadTask(job, target)
+	if err != nil {
+		return fmt.Errorf("Nomad job %s: %s", target.Job, err)
+	}
+	config["image"] = image
+
+	var res struct {
+		EvalID string
+	}
+	if err := nomadRequest("POST", uri, token, map[string]interface{}{"Job": job}, &res); err != nil {
+		return err
+	}
+
+	log.Infof("Updated Nomad job %s with %s, evaluation %s", target.Job, image, res.EvalID)
+
+	return nil
+}
+
+// findNomadTask returns the config of the docker task that matches the target;
+// if the task is not given, the job should have exactly one docker task
+func findNomadTask(job map[string]interface{}, target NomadTarget) (map[string]interface{}, error) {
+	found := []map[string]interface{}{}
+
+	groups, _ := job["TaskGroups"].([]interface{})
+	for _, g := range groups {
+		group, _ := g.(map[string]interface{})
+		if target.Group != "" && group["Name"] != target.Group {
+			continue
+		}
+
+		tasks, _ := group["Tasks"].([]interface{})
+		for _, t := range tasks {
+			task, _ := t.(map[string]interface{})
+			if task["Driver"] != "docker" || (target.Task != "" && task["Name"] != target.Task) {
+				continue
+			}
+			if config, ok := task["Config"].(map[string]interface{}); ok {
+				found = append(found, config)
+			}
+		}
+	}
+
+	switch {
+	case len(found) == 0:
+		return nil, fmt.Errorf("no docker task matches %s", target.Task)
+	case len(found) > 1:
+		return nil, fmt.Errorf("%d docker tasks match, specify which one to update with job:group/task", len(found))
+	}
+
+	return found[0], nil
+}
+
+func nomadRequest(method, uri, token string, body, out interface{}) error {
+	var payload []byte
+	if body != nil {
+		var err error
+		if payload, err = json.Marshal(body); err != nil {
+			return err
+		}
+	}
+
+	req, err := http.NewRequest(method, uri, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	if token != "" {
+		req.Header.Set("X-Nomad-Token", token)
+	}
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("Request to %s failed with %s", uri, err)
+	}
+	defer res.Body.Close()
+
+	content, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return fmt.Errorf("Response from %s cannot be read due to error %s", uri, err)
+	}
+
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s %s status code %d: %s", method, uri, res.StatusCode, bytes.TrimSpace(content))
+	}
+
+	if err := json.Unmarshal(content, out); err != nil {
+		return fmt.Errorf("Response from %s cannot be unmarshalled due to error %s", uri, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,68 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package deploy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseNomadTarget(t *testing.T) {
+	target, err := ParseNomadTarget("web:api/server")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, NomadTarget{Job: "web", Group: "api", Task: "server"}, target)
+
+	target, err = ParseNomadTarget("web")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, NomadTarget{Job: "web"}, target)
+}
+
+func TestUpdateNomad(t *testing.T) {
+	var submitted map[string]interface{}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/v1/job/web", r.URL.Path)
+		assert.Equal(t, "secret", r.Header.Get("X-Nomad-Token"))
+
+		switch r.Method {
+		case "GET":
+			w.Write([]byte(`{"ID":"web","TaskGroups":[{"Name":"api","Tasks":[
+				{"Name":"server","Driver":"docker","Config":{"image":"acme/app:1","ports":["http"]}},
+				{"Name":"migrate","Driver":"exec","Config":{"command":"migrate"}}
+			]}]}`))
+		case "POST":
+			json.NewDecoder(r.Body).Decode(&submitted)
+			w.Write([]byte(`{"EvalID":"e1"}`))
+		}
+	}))
+	defer server.Close()
+
+	if err := UpdateNomad(server.URL, "secret", NomadTarget{Job: "web"}, "acme/app@sha256:abc"); err != nil {
+		t.Fatal(err)
+	}
+
+	task := submitted["Job"].(map[string]interface{})["TaskGroups"].([]interface{})[0].(map[string]interface{})["Tasks"].([]interface{})[0].(map[string]interface{})
+	assert.Equal(t, map[string]interface{}{"image": "acme/app@sha256:abc", "ports": []interface{}{"http"}}, task["Config"])
+}
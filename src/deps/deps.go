@@ -0,0 +1,170 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package deps implements the commands for the directory trees of many Rockerfiles:
+// deps prints which of them depend on the images of others and build-affected
+// builds the ones a change touches
+package deps
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/grammarly/rocker/src/build"
+	"github.com/grammarly/rocker/src/cliutil"
+	"github.com/grammarly/rocker/src/template"
+
+	"github.com/codegangsta/cli"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// CommandSpec returns specifications of the deps command for codegangsta/cli
+func CommandSpec() cli.Command {
+	return cli.Command{
+		Name:   "deps",
+		Usage:  "scans a directory tree for Rockerfiles and prints the JSON graph of which depend on the images of others",
+		Action: depsCommand,
+		Flags:  varsFlags(),
+	}
+}
+
+// BuildAffectedCommandSpec returns specifications of the build-affected command for codegangsta/cli
+func BuildAffectedCommandSpec() cli.Command {
+	return cli.Command{
+		Name:   "build-affected",
+		Usage:  "builds the Rockerfiles of the directory tree whose contexts have files changed since a git ref, and those depending on them; arguments after -- go to each build",
+		Action: buildAffectedCommand,
+		Flags: append([]cli.Flag{
+			cli.StringFlag{
+				Name:  "since",
+				Usage: "git ref to compare the working tree with, e.g. origin/master",
+			},
+		}, append(varsFlags(),
+			cli.BoolFlag{
+				Name:  "dry-run",
+				Usage: "only print the Rockerfiles that would be built",
+			},
+		)...),
+	}
+}
+
+// varsFlags are the flags of the variables to render the Rockerfiles with
+func varsFlags() []cli.Flag {
+	return []cli.Flag{
+		cli.StringSliceFlag{
+			Name:  "var",
+			Value: &cli.StringSlice{},
+			Usage: "set variables to render the Rockerfiles with, value is like \"key=value\"",
+		},
+		cli.StringSliceFlag{
+			Name:  "vars",
+			Value: &cli.StringSlice{},
+			Usage: "Load variables form a file, either JSON or YAML. Can pass multiple of this.",
+		},
+	}
+}
+
+// depsCommand implements 'deps' command that prints the dependency graph as JSON
+func depsCommand(c *cli.Context) {
+	root := "."
+	if len(c.Args()) > 0 {
+		root = c.Args()[0]
+	}
+
+	graph, err := build.NewDepsGraph(root, cliutil.ReadVars(c), template.Funs{}, cliutil.TemplateSandbox(c, root))
+	if err != nil {
+		cliutil.Exit(build.WithExitCode(build.ExitUser, err))
+	}
+
+	data, err := json.MarshalIndent(graph, "", "  ")
+	if err != nil {
+		cliutil.Exit(err)
+	}
+	fmt.Println(string(data))
+}
+
+// buildAffectedCommand implements 'build-affected' command that builds the Rockerfiles
+// affected by the changes since --since with rocker itself, in the order of their dependencies
+func buildAffectedCommand(c *cli.Context) {
+	since := c.String("since")
+	if since == "" {
+		cliutil.Exitf(build.ExitUser, "build-affected needs --since <git-ref>")
+	}
+
+	graph, err := build.NewDepsGraph(".", cliutil.ReadVars(c), template.Funs{}, cliutil.TemplateSandbox(c, "."))
+	if err != nil {
+		cliutil.Exit(build.WithExitCode(build.ExitUser, err))
+	}
+
+	changed, err := build.GitChangedFiles(".", since)
+	if err != nil {
+		cliutil.Exit(build.WithExitCode(build.ExitUser, err))
+	}
+
+	targets, skipped, err := build.Affected(graph, ".", changed)
+	if err != nil {
+		cliutil.Exit(build.WithExitCode(build.ExitUser, err))
+	}
+
+	for _, file := range skipped {
+		log.Infof("Skip %s, nothing changed in its context since %s", file, since)
+	}
+
+	buildArgs := []string{}
+	for _, file := range c.StringSlice("vars") {
+		buildArgs = append(buildArgs, "--vars", file)
+	}
+	for _, v := range c.StringSlice("var") {
+		buildArgs = append(buildArgs, "--var", v)
+	}
+	buildArgs = append(buildArgs, c.Args()...)
+
+	for i, target := range targets {
+		reason := fmt.Sprintf("%d changed files", len(target.Changed))
+		if len(target.Changed) == 0 {
+			reason = "depends on " + strings.Join(target.DependsOn, ", ")
+		}
+		log.Infof("Build %d of %d: %s, %s", i+1, len(targets), target.File, reason)
+
+		if c.Bool("dry-run") {
+			continue
+		}
+
+		args := cliutil.GlobalArgs(c.Command.Name)
+		args = append(args, "build", "-f", target.File)
+		args = append(args, buildArgs...)
+		args = append(args, filepath.Dir(target.File))
+
+		cmd := exec.Command(os.Args[0], args...)
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+
+		if err := cmd.Run(); err != nil {
+			cliutil.Exit(build.WithExitCode(build.ExitCode(err), fmt.Errorf("Build of %s failed, %d of %d Rockerfiles built, error: %s", target.File, i, len(targets), err)))
+		}
+	}
+
+	if c.Bool("dry-run") {
+		return
+	}
+
+	log.Infof("Built %d Rockerfiles, skipped %d", len(targets), len(skipped))
+}
@@ -0,0 +1,478 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package dockerclient
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/fsouza/go-dockerclient"
+	"github.com/grammarly/rocker/src/imagename"
+	"github.com/grammarly/rocker/src/spill"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Media types of the OCI image spec used for artifacts
+const (
+	MediaTypeOCIManifest = "application/vnd.oci.image.manifest.v1+json"
+	MediaTypeOCIEmpty    = "application/vnd.oci.empty.v1+json"
+
+	// DefaultArtifactType is set on artifacts that do not specify their type
+	DefaultArtifactType = "application/vnd.rocker.artifact.v1"
+)
+
+// OCIArtifact is a single file to be pushed to a registry as an OCI artifact
+type OCIArtifact struct {
+	// Name goes to the org.opencontainers.image.title annotation of the layer,
+	// clients such as oras use it as the file name on pull
+	Name         string
+	Content      []byte
+	MediaType    string
+	ArtifactType string
+
+	// Config is the config blob, the empty one is used if not given;
+	// artifact type is only set by default when there is no own config
+	Config          []byte
+	ConfigMediaType string
+
+	// Blob carries the content instead of Content when it may not fit
+	// the memory budget; pulled artifacts always have it
+	Blob *spill.Buffer
+
+	// Annotations go to the manifest of the artifact
+	Annotations map[string]string
+}
+
+// Size returns the size of the content
+func (a OCIArtifact) Size() int64 {
+	if a.Blob != nil {
+		return a.Blob.Size()
+	}
+	return int64(len(a.Content))
+}
+
+// Reader returns the reader of the content, either of Content or of Blob
+func (a OCIArtifact) Reader() *io.SectionReader {
+	if a.Blob != nil {
+		return a.Blob.Reader()
+	}
+	return io.NewSectionReader(bytes.NewReader(a.Content), 0, int64(len(a.Content)))
+}
+
+// Close releases the memory or the temp file of Blob
+func (a OCIArtifact) Close() error {
+	if a.Blob != nil {
+		return a.Blob.Close()
+	}
+	return nil
+}
+
+// ociDescriptor is the OCI content descriptor
+type ociDescriptor struct {
+	MediaType    string            `json:"mediaType"`
+	Digest       string            `json:"digest"`
+	Size         int64             `json:"size"`
+	ArtifactType string            `json:"artifactType,omitempty"`
+	Annotations  map[string]string `json:"annotations,omitempty"`
+}
+
+// ociManifest is the OCI image manifest, as used for artifacts
+type ociManifest struct {
+	SchemaVersion int               `json:"schemaVersion"`
+	MediaType     string            `json:"mediaType"`
+	ArtifactType  string            `json:"artifactType,omitempty"`
+	Config        ociDescriptor     `json:"config"`
+	Layers        []ociDescriptor   `json:"layers"`
+	Subject       *ociDescriptor    `json:"subject,omitempty"`
+	Annotations   map[string]string `json:"annotations,omitempty"`
+}
+
+// registrySession makes authorized requests to a single repository of a registry
+type registrySession struct {
+	base          string
+	authorization string
+	client        *http.Client
+}
+
+// RegistryPushArtifact pushes a file to the registry as an OCI artifact under the
+// given image name and returns the digest of the manifest. The artifact has the
+// empty config, unless given, and a single layer with the file, as described by the OCI image spec v1.1.
+func RegistryPushArtifact(image *imagename.ImageName, auth *docker.AuthConfigurations, artifact OCIArtifact) (digest string, err error) {
+	if image.GetTag() == "" {
+		return "", fmt.Errorf("Artifact %s should have a tag", image)
+	}
+
+	regAuth, err := GetAuthForRegistry(auth, image)
+	if err != nil {
+		return "", fmt.Errorf("Failed to get auth token for registry: %s, make sure you are properly logged in using `docker login` or have AWS credentials set in case of using ECR", image)
+	}
+
+	base, name := registryBase(image)
+
+	s, err := newRegistrySession(base, name, "pull,push", regAuth)
+	if err != nil {
+		return "", err
+	}
+
+	return s.pushArtifact(name, image.GetTag(), artifact, nil)
+}
+
+// RegistryPullArtifact fetches the file of an OCI artifact pushed with RegistryPushArtifact,
+// or by other tools that put the file into the first layer
+func RegistryPullArtifact(image *imagename.ImageName, auth *docker.AuthConfigurations) (artifact OCIArtifact, err error) {
+	regAuth, err := GetAuthForRegistry(auth, image)
+	if err != nil {
+		return artifact, fmt.Errorf("Failed to get auth token for registry: %s, error: %s", image, err)
+	}
+
+	base, name := registryBase(image)
+
+	s, err := newRegistrySession(base, name, "pull", regAuth)
+	if err != nil {
+		return artifact, err
+	}
+
+	return s.pullArtifact(name, image.GetTag())
+}
+
+// RegistryDeleteManifest deletes the manifest by digest from the registry,
+// which removes all the tags that point to it. Many registries do not allow
+// deletes at all.
+func RegistryDeleteManifest(image *imagename.ImageName, auth *docker.AuthConfigurations, digest string) error {
+	regAuth, err := GetAuthForRegistry(auth, image)
+	if err != nil {
+		return fmt.Errorf("Failed to get auth token for registry: %s, error: %s", image, err)
+	}
+
+	base, name := registryBase(image)
+
+	s, err := newRegistrySession(base, name, "pull,push,delete", regAuth)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.do("DELETE", fmt.Sprintf("%s%s/manifests/%s", base, name, digest), "", nil, http.StatusAccepted)
+	return err
+}
+
+// registryBase returns the API URL of the image's registry and the repository name in it
+func registryBase(image *imagename.ImageName) (base, name string) {
+	registry, name := image.Registry, image.Name
+	if registry == "" || registry == "docker.io" || registry == "index.docker.io" {
+		registry = "registry-1.docker.io"
+		if !strings.Contains(name, "/") {
+			name = "library/" + name
+		}
+	}
+	return fmt.Sprintf("https://%s/v2/", registry), name
+}
+
+// pushArtifact uploads the blobs of the artifact and then its manifest, under the tag
+// or by digest if the tag is empty; with the subject the artifact becomes its referrer
+func (s *registrySession) pushArtifact(name, tag string, artifact OCIArtifact, subject *ociDescriptor) (digest string, err error) {
+	if artifact.MediaType == "" {
+		artifact.MediaType = "application/octet-stream"
+	}
+
+	config, configMediaType := artifact.Config, artifact.ConfigMediaType
+	if config == nil {
+		config, configMediaType = []byte("{}"), MediaTypeOCIEmpty
+
+		if artifact.ArtifactType == "" {
+			artifact.ArtifactType = DefaultArtifactType
+		}
+	}
+
+	layer, err := describeReader(artifact.MediaType, artifact.Reader())
+	if err != nil {
+		return "", err
+	}
+
+	manifest := ociManifest{
+		SchemaVersion: 2,
+		MediaType:     MediaTypeOCIManifest,
+		ArtifactType:  artifact.ArtifactType,
+		Config:        describe(configMediaType, config),
+		Layers:        []ociDescriptor{layer},
+		Subject:       subject,
+		Annotations:   artifact.Annotations,
+	}
+	if artifact.Name != "" {
+		manifest.Layers[0].Annotations = map[string]string{
+			"org.opencontainers.image.title": artifact.Name,
+		}
+	}
+
+	if err := s.pushBlob(name, manifest.Config, io.NewSectionReader(bytes.NewReader(config), 0, int64(len(config)))); err != nil {
+		return "", err
+	}
+	if err := s.pushBlob(name, manifest.Layers[0], artifact.Reader()); err != nil {
+		return "", err
+	}
+
+	content, err := json.Marshal(manifest)
+	if err != nil {
+		return "", err
+	}
+
+	desc := describe(MediaTypeOCIManifest, content)
+	if tag == "" {
+		tag = desc.Digest
+	}
+
+	uri := fmt.Sprintf("%s%s/manifests/%s", s.base, name, tag)
+	res, err := s.do("PUT", uri, MediaTypeOCIManifest, content, http.StatusCreated)
+	if err != nil {
+		return "", err
+	}
+
+	// Registries that support the referrers API confirm the subject, the
+	// others need the referrers tag to be updated by the client
+	if subject != nil && res.Header.Get("OCI-Subject") == "" {
+		desc.ArtifactType, desc.Annotations = manifest.ArtifactType, manifest.Annotations
+		if err := s.addReferrer(name, *subject, desc); err != nil {
+			return "", err
+		}
+	}
+
+	return desc.Digest, nil
+}
+
+// pullArtifact downloads the manifest and then the first layer of the artifact
+func (s *registrySession) pullArtifact(name, tag string) (artifact OCIArtifact, err error) {
+	content, err := s.get(fmt.Sprintf("%s%s/manifests/%s", s.base, name, tag), MediaTypeOCIManifest)
+	if err != nil {
+		return artifact, err
+	}
+
+	manifest := ociManifest{}
+	if err := json.Unmarshal(content, &manifest); err != nil {
+		return artifact, fmt.Errorf("Failed to parse the manifest of %s:%s, error: %s", name, tag, err)
+	}
+	if len(manifest.Layers) == 0 {
+		return artifact, fmt.Errorf("Artifact %s:%s has no layers", name, tag)
+	}
+
+	layer := manifest.Layers[0]
+
+	body, err := s.open(fmt.Sprintf("%s%s/blobs/%s", s.base, name, layer.Digest), "")
+	if err != nil {
+		return artifact, err
+	}
+	defer body.Close()
+
+	// The layer may be large, e.g. a cache index, so it goes to the budget
+	// rather than to a byte slice
+	blob := spill.NewBuffer()
+	if _, err := io.Copy(blob, body); err != nil {
+		blob.Close()
+		return artifact, fmt.Errorf("Failed to read the layer of %s:%s, error: %s", name, tag, err)
+	}
+	desc, err := describeReader(layer.MediaType, blob.Reader())
+	if err != nil {
+		blob.Close()
+		return artifact, err
+	}
+	if desc.Digest != layer.Digest {
+		blob.Close()
+		return artifact, fmt.Errorf("Digest mismatch of the layer of %s:%s, expected %s, got %s", name, tag, layer.Digest, desc.Digest)
+	}
+
+	artifact.Blob = blob
+	artifact.Name = layer.Annotations["org.opencontainers.image.title"]
+	artifact.MediaType = layer.MediaType
+	artifact.ArtifactType = manifest.ArtifactType
+
+	return artifact, nil
+}
+
+// newRegistrySession authorizes for the actions on the repository, e.g. "pull,push", in
+// case the registry asks for a bearer token; otherwise basic auth is used if there is any
+func newRegistrySession(base, name, actions string, auth docker.AuthConfiguration) (s *registrySession, err error) {
+	s = &registrySession{
+		base:   base,
+		client: &http.Client{},
+	}
+
+	res, err := s.client.Get(base)
+	if err != nil {
+		return nil, fmt.Errorf("Request to %s failed with %s", base, err)
+	}
+	res.Body.Close()
+
+	if res.StatusCode != http.StatusUnauthorized {
+		return s, nil
+	}
+
+	b := parseBearer(res.Header.Get("Www-Authenticate"))
+	if b == nil {
+		if auth.Username != "" {
+			req, _ := http.NewRequest("GET", base, nil)
+			req.SetBasicAuth(auth.Username, auth.Password)
+			s.authorization = req.Header.Get("Authorization")
+		}
+		return s, nil
+	}
+
+	// The ping endpoint does not tell the scope, so ask for what we need
+	b.Scope = fmt.Sprintf("repository:%s:%s", name, actions)
+
+	token, err := getAuthToken(b, auth)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to authenticate to registry %s, error: %s", base, err)
+	}
+	s.authorization = "Bearer " + token
+
+	return s, nil
+}
+
+// pushBlob uploads the blob in a single request unless the registry already has it;
+// the content is streamed, so it is not read into memory
+func (s *registrySession) pushBlob(name string, desc ociDescriptor, content *io.SectionReader) error {
+	uri := fmt.Sprintf("%s%s/blobs/%s", s.base, name, desc.Digest)
+	if res, err := s.do("HEAD", uri, "", nil, 0); err == nil && res.StatusCode == http.StatusOK {
+		log.Debugf("Blob %s already exists in the registry", desc.Digest)
+		return nil
+	}
+
+	res, err := s.do("POST", fmt.Sprintf("%s%s/blobs/uploads/", s.base, name), "", nil, http.StatusAccepted)
+	if err != nil {
+		return err
+	}
+
+	location, err := url.Parse(res.Header.Get("Location"))
+	if err != nil {
+		return fmt.Errorf("Registry returned bad upload location %q, error: %s", res.Header.Get("Location"), err)
+	}
+	if base, _ := url.Parse(s.base); base != nil {
+		location = base.ResolveReference(location)
+	}
+
+	q := location.Query()
+	q.Set("digest", desc.Digest)
+	location.RawQuery = q.Encode()
+
+	log.Debugf("Upload blob %s of %d bytes", desc.Digest, desc.Size)
+
+	_, err = s.send("PUT", location.String(), "application/octet-stream", content, http.StatusCreated)
+	return err
+}
+
+// do makes the request and checks the response status, unless expect is 0
+func (s *registrySession) do(method, uri, contentType string, body []byte, expect int) (res *http.Response, err error) {
+	return s.send(method, uri, contentType, io.NewSectionReader(bytes.NewReader(body), 0, int64(len(body))), expect)
+}
+
+// send is do with the body read from the reader, from the start again on redirects
+func (s *registrySession) send(method, uri, contentType string, body *io.SectionReader, expect int) (res *http.Response, err error) {
+	req, err := http.NewRequest(method, uri, nil)
+	if err != nil {
+		return nil, err
+	}
+	if req.ContentLength = body.Size(); req.ContentLength > 0 {
+		req.GetBody = func() (io.ReadCloser, error) {
+			return ioutil.NopCloser(io.NewSectionReader(body, 0, body.Size())), nil
+		}
+		req.Body, _ = req.GetBody()
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if s.authorization != "" {
+		req.Header.Set("Authorization", s.authorization)
+	}
+
+	if res, err = s.client.Do(req); err != nil {
+		return nil, fmt.Errorf("Request to %s failed with %s", uri, err)
+	}
+	defer res.Body.Close()
+
+	if expect != 0 && res.StatusCode != expect {
+		msg, _ := ioutil.ReadAll(io.LimitReader(res.Body, 1024))
+		return nil, fmt.Errorf("%s %s status code %d: %s", method, uri, res.StatusCode, bytes.TrimSpace(msg))
+	}
+
+	return res, nil
+}
+
+// get reads the response of a GET request, which has to succeed
+func (s *registrySession) get(uri, accept string) ([]byte, error) {
+	body, err := s.open(uri, accept)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	return ioutil.ReadAll(body)
+}
+
+// open makes a GET request, which has to succeed, and returns the body of the response
+func (s *registrySession) open(uri, accept string) (io.ReadCloser, error) {
+	req, err := http.NewRequest("GET", uri, nil)
+	if err != nil {
+		return nil, err
+	}
+	if accept != "" {
+		req.Header.Set("Accept", accept)
+	}
+	if s.authorization != "" {
+		req.Header.Set("Authorization", s.authorization)
+	}
+
+	res, err := s.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("Request to %s failed with %s", uri, err)
+	}
+
+	if res.StatusCode != http.StatusOK {
+		defer res.Body.Close()
+		msg, _ := ioutil.ReadAll(io.LimitReader(res.Body, 1024))
+		return nil, fmt.Errorf("GET %s status code %d: %s", uri, res.StatusCode, bytes.TrimSpace(msg))
+	}
+
+	return res.Body, nil
+}
+
+// describeReader is describe of the content read from r
+func describeReader(mediaType string, r io.Reader) (ociDescriptor, error) {
+	h := sha256.New()
+	size, err := io.Copy(h, r)
+	if err != nil {
+		return ociDescriptor{}, fmt.Errorf("Failed to compute the digest of the artifact, error: %s", err)
+	}
+	return ociDescriptor{
+		MediaType: mediaType,
+		Digest:    fmt.Sprintf("sha256:%x", h.Sum(nil)),
+		Size:      size,
+	}, nil
+}
+
+func describe(mediaType string, content []byte) ociDescriptor {
+	return ociDescriptor{
+		MediaType: mediaType,
+		Digest:    fmt.Sprintf("sha256:%x", sha256.Sum256(content)),
+		Size:      int64(len(content)),
+	}
+}
@@ -0,0 +1,192 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package dockerclient
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/fsouza/go-dockerclient"
+	"github.com/grammarly/rocker/src/spill"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeArtifactRegistry accepts the pushes of the charts/app artifacts
+type fakeArtifactRegistry struct {
+	blobs    map[string][]byte
+	manifest []byte
+}
+
+func (reg *fakeArtifactRegistry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.Method == "GET" && r.URL.Path == "/v2/":
+		w.WriteHeader(http.StatusOK)
+	case r.Method == "HEAD" && strings.HasPrefix(r.URL.Path, "/v2/charts/app/blobs/"):
+		if _, ok := reg.blobs[strings.TrimPrefix(r.URL.Path, "/v2/charts/app/blobs/")]; ok {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		w.WriteHeader(http.StatusNotFound)
+	case r.Method == "POST" && r.URL.Path == "/v2/charts/app/blobs/uploads/":
+		w.Header().Set("Location", "/v2/charts/app/blobs/uploads/1?state=x")
+		w.WriteHeader(http.StatusAccepted)
+	case r.Method == "PUT" && r.URL.Path == "/v2/charts/app/blobs/uploads/1" && r.URL.Query().Get("state") == "x":
+		content, _ := ioutil.ReadAll(r.Body)
+		if int64(len(content)) != r.ContentLength {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		reg.blobs[r.URL.Query().Get("digest")] = content
+		w.WriteHeader(http.StatusCreated)
+	case r.Method == "PUT" && r.URL.Path == "/v2/charts/app/manifests/1.0.0" && r.Header.Get("Content-Type") == MediaTypeOCIManifest:
+		reg.manifest, _ = ioutil.ReadAll(r.Body)
+		w.WriteHeader(http.StatusCreated)
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+	}
+}
+
+func TestRegistrySession_PushArtifact(t *testing.T) {
+	reg := &fakeArtifactRegistry{blobs: map[string][]byte{}}
+
+	server := httptest.NewServer(reg)
+	defer server.Close()
+
+	s, err := newRegistrySession(server.URL+"/v2/", "charts/app", "pull,push", docker.AuthConfiguration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	digest, err := s.pushArtifact("charts/app", "1.0.0", OCIArtifact{
+		Name:      "app-1.0.0.tgz",
+		Content:   []byte("chart"),
+		MediaType: "application/vnd.cncf.helm.chart.content.v1.tar+gzip",
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := ociManifest{}
+	if err := json.Unmarshal(reg.manifest, &m); err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, describe(MediaTypeOCIManifest, reg.manifest).Digest, digest)
+	assert.Equal(t, DefaultArtifactType, m.ArtifactType)
+	assert.Equal(t, MediaTypeOCIEmpty, m.Config.MediaType)
+	assert.Equal(t, []byte("{}"), reg.blobs[m.Config.Digest])
+	assert.Len(t, m.Layers, 1)
+	assert.Equal(t, "application/vnd.cncf.helm.chart.content.v1.tar+gzip", m.Layers[0].MediaType)
+	assert.Equal(t, "app-1.0.0.tgz", m.Layers[0].Annotations["org.opencontainers.image.title"])
+	assert.Equal(t, []byte("chart"), reg.blobs[m.Layers[0].Digest])
+}
+
+func TestRegistrySession_PushArtifactBlob(t *testing.T) {
+	reg := &fakeArtifactRegistry{blobs: map[string][]byte{}}
+
+	server := httptest.NewServer(reg)
+	defer server.Close()
+
+	s, err := newRegistrySession(server.URL+"/v2/", "charts/app", "pull,push", docker.AuthConfiguration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Nothing fits the budget, so the blob is streamed from the temp file
+	blob := spill.NewBudget(0).NewBuffer()
+	defer blob.Close()
+
+	content := bytes.Repeat([]byte("chart"), 100000)
+	blob.Write(content)
+	assert.True(t, blob.Spilled())
+
+	artifact := OCIArtifact{Name: "app-1.0.0.tgz", Blob: blob}
+	assert.EqualValues(t, len(content), artifact.Size())
+
+	if _, err := s.pushArtifact("charts/app", "1.0.0", artifact, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	m := ociManifest{}
+	if err := json.Unmarshal(reg.manifest, &m); err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, describe("application/octet-stream", content), ociDescriptor{
+		MediaType: m.Layers[0].MediaType,
+		Digest:    m.Layers[0].Digest,
+		Size:      m.Layers[0].Size,
+	})
+	assert.Equal(t, content, reg.blobs[m.Layers[0].Digest])
+}
+
+func TestRegistrySession_PullArtifact(t *testing.T) {
+	layer := describe("application/vnd.rocker.cache.v1+json", []byte(`{"entries":[]}`))
+	layer.Annotations = map[string]string{"org.opencontainers.image.title": "cache.json"}
+
+	manifest, _ := json.Marshal(ociManifest{
+		SchemaVersion: 2,
+		MediaType:     MediaTypeOCIManifest,
+		ArtifactType:  "application/vnd.rocker.cache.v1",
+		Config:        describe(MediaTypeOCIEmpty, []byte("{}")),
+		Layers:        []ociDescriptor{layer},
+	})
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v2/":
+			w.WriteHeader(http.StatusOK)
+		case "/v2/app/cache/manifests/rocker-cache":
+			assert.Equal(t, MediaTypeOCIManifest, r.Header.Get("Accept"))
+			w.Write(manifest)
+		case "/v2/app/cache/blobs/" + layer.Digest:
+			w.Write([]byte(`{"entries":[]}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	s, err := newRegistrySession(server.URL+"/v2/", "app/cache", "pull", docker.AuthConfiguration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	artifact, err := s.pullArtifact("app/cache", "rocker-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer artifact.Close()
+
+	content, err := ioutil.ReadAll(artifact.Reader())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, "cache.json", artifact.Name)
+	assert.Equal(t, []byte(`{"entries":[]}`), content)
+	assert.Equal(t, "application/vnd.rocker.cache.v1+json", artifact.MediaType)
+	assert.Equal(t, "application/vnd.rocker.cache.v1", artifact.ArtifactType)
+
+	_, err = s.pullArtifact("app/cache", "missing")
+	assert.Error(t, err)
+}
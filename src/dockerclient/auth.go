@@ -21,76 +21,47 @@ import (
 	"fmt"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/grammarly/rocker/src/imagename"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/ecr"
 	"github.com/fsouza/go-dockerclient"
 )
 
 type ecrAuthCache struct {
-	tokens map[string]docker.AuthConfiguration
+	tokens map[string]Credentials
 	mu     sync.Mutex
 }
 
 var (
 	_ecrAuthCache = ecrAuthCache{
-		tokens: map[string]docker.AuthConfiguration{},
+		tokens: map[string]Credentials{},
 	}
 )
 
 // GetAuthForRegistry extracts desired docker.AuthConfiguration object from the
 // list of docker.AuthConfigurations by registry hostname
 func GetAuthForRegistry(auth *docker.AuthConfigurations, image *imagename.ImageName) (result docker.AuthConfiguration, err error) {
-
-	registry := image.Registry
-
-	// The default registry is "index.docker.io"
-	if registry == "" || registry == "registry-1.docker.io" {
-		registry = "index.docker.io"
-	}
-	// Optionally override auth took via aws-sdk (through ENV vars)
-	if image.IsECR() {
-		if awsRegAuth, err := GetECRAuth(registry, image.GetECRRegion()); err != nil && err != credentials.ErrNoValidProvidersFoundInChain {
-			return result, err
-		} else if awsRegAuth.Username != "" {
-			return awsRegAuth, nil
-		}
-	}
-
-	if auth == nil {
-		return
-	}
-
-	if result, ok := auth.Configs[registry]; ok {
-		return result, nil
-	}
-	if result, ok := auth.Configs["https://"+registry]; ok {
-		return result, nil
-	}
-	if result, ok := auth.Configs["https://"+registry+"/v1/"]; ok {
-		return result, nil
-	}
-	// not sure /v2/ is needed, but just in case
-	if result, ok := auth.Configs["https://"+registry+"/v2/"]; ok {
-		return result, nil
-	}
-	if result, ok := auth.Configs["*"]; ok {
-		return result, nil
-	}
-	return
+	creds, err := DefaultAuthProvider(auth).GetCredentials(AuthRegistry(image))
+	return creds.AuthConfiguration, err
 }
 
 // GetECRAuth requests AWS ECR API to get docker.AuthConfiguration token
 func GetECRAuth(registry, region string) (result docker.AuthConfiguration, err error) {
+	creds, err := getECRCredentials(registry, region)
+	return creds.AuthConfiguration, err
+}
+
+// getECRCredentials requests an ECR token, tokens are reused until they expire
+func getECRCredentials(registry, region string) (result Credentials, err error) {
 	_ecrAuthCache.mu.Lock()
 	defer _ecrAuthCache.mu.Unlock()
 
-	if token, ok := _ecrAuthCache.tokens[registry]; ok {
+	if token, ok := _ecrAuthCache.tokens[registry]; ok && !token.Expired(time.Now()) {
 		return token, nil
 	}
 
@@ -132,11 +103,14 @@ func GetECRAuth(registry, region string) (result docker.AuthConfiguration, err e
 		return result, fmt.Errorf("Cannot parse token got from ECR: %s", string(data))
 	}
 
-	result = docker.AuthConfiguration{
+	result.AuthConfiguration = docker.AuthConfiguration{
 		Username:      userpass[0],
 		Password:      userpass[1],
 		ServerAddress: *res.AuthorizationData[0].ProxyEndpoint,
 	}
+	if expires := res.AuthorizationData[0].ExpiresAt; expires != nil {
+		result.Expires = *expires
+	}
 
 	return
 }
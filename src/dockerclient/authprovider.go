@@ -0,0 +1,266 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package dockerclient
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/grammarly/rocker/src/imagename"
+
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/fsouza/go-dockerclient"
+)
+
+// Credentials are the registry credentials given by an AuthProvider
+type Credentials struct {
+	docker.AuthConfiguration
+
+	// Expires is when the credentials stop working, zero if they do not expire
+	Expires time.Time
+}
+
+// Empty tells if the provider had no credentials for the registry
+func (c Credentials) Empty() bool {
+	return c.Username == "" && c.Password == ""
+}
+
+// Expired tells if the credentials are no longer valid at the given time
+func (c Credentials) Expired(now time.Time) bool {
+	return !c.Expires.IsZero() && !now.Before(c.Expires)
+}
+
+// AuthProvider is a source of credentials for docker registries. The registry
+// is a hostname, "index.docker.io" for the Docker Hub. A provider that has
+// nothing for the registry returns empty credentials and no error
+type AuthProvider interface {
+	GetCredentials(registry string) (Credentials, error)
+}
+
+// AuthRegistry returns the hostname the credentials of the image are looked up by
+func AuthRegistry(image *imagename.ImageName) string {
+	// The default registry is "index.docker.io"
+	if image.Registry == "" || image.Registry == "registry-1.docker.io" {
+		return "index.docker.io"
+	}
+	return image.Registry
+}
+
+// AuthProviders asks the providers in order and returns the first credentials found
+type AuthProviders []AuthProvider
+
+// GetCredentials implements AuthProvider
+func (providers AuthProviders) GetCredentials(registry string) (Credentials, error) {
+	for _, p := range providers {
+		creds, err := p.GetCredentials(registry)
+		if err != nil || !creds.Empty() {
+			return creds, err
+		}
+	}
+	return Credentials{}, nil
+}
+
+// DefaultAuthProvider is what rocker uses unless told otherwise: AWS ECR
+// tokens for ECR registries, then the given configurations
+func DefaultAuthProvider(auth *docker.AuthConfigurations) AuthProvider {
+	return AuthProviders{ECRAuthProvider{}, ConfigAuthProvider{Auth: auth}}
+}
+
+// CachedAuthProvider remembers the credentials of the provider for every
+// registry until they expire, so slow sources are not asked on every pull and push
+type CachedAuthProvider struct {
+	Provider AuthProvider
+
+	mu    sync.Mutex
+	cache map[string]Credentials
+}
+
+// GetCredentials implements AuthProvider
+func (p *CachedAuthProvider) GetCredentials(registry string) (Credentials, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if creds, ok := p.cache[registry]; ok && !creds.Expired(time.Now()) {
+		return creds, nil
+	}
+
+	creds, err := p.Provider.GetCredentials(registry)
+	if err != nil {
+		return creds, err
+	}
+
+	if p.cache == nil {
+		p.cache = map[string]Credentials{}
+	}
+	p.cache[registry] = creds
+
+	return creds, nil
+}
+
+// ConfigAuthProvider takes credentials from docker auth configurations, such
+// as ~/.docker/config.json or the --auth flag; the "*" entry matches any registry
+type ConfigAuthProvider struct {
+	Auth *docker.AuthConfigurations
+}
+
+// GetCredentials implements AuthProvider
+func (p ConfigAuthProvider) GetCredentials(registry string) (Credentials, error) {
+	if p.Auth == nil {
+		return Credentials{}, nil
+	}
+
+	for _, key := range []string{
+		registry,
+		"https://" + registry,
+		"https://" + registry + "/v1/",
+		// not sure /v2/ is needed, but just in case
+		"https://" + registry + "/v2/",
+		"*",
+	} {
+		if result, ok := p.Auth.Configs[key]; ok {
+			return Credentials{AuthConfiguration: result}, nil
+		}
+	}
+
+	return Credentials{}, nil
+}
+
+var envAuthInvalid = regexp.MustCompile("[^A-Z0-9]+")
+
+// EnvAuthProvider takes credentials as user:password from the environment:
+// ROCKER_AUTH_<REGISTRY> for a registry, e.g. ROCKER_AUTH_QUAY_IO for quay.io,
+// and ROCKER_AUTH for any registry
+type EnvAuthProvider struct {
+	// Getenv reads the environment, os.Getenv if nil
+	Getenv func(string) string
+}
+
+// GetCredentials implements AuthProvider
+func (p EnvAuthProvider) GetCredentials(registry string) (Credentials, error) {
+	getenv := p.Getenv
+	if getenv == nil {
+		getenv = os.Getenv
+	}
+
+	for _, name := range []string{EnvAuthVariable(registry), "ROCKER_AUTH"} {
+		value := getenv(name)
+		if value == "" {
+			continue
+		}
+		userPass := strings.SplitN(value, ":", 2)
+		if len(userPass) != 2 {
+			return Credentials{}, fmt.Errorf("%s should be user:password", name)
+		}
+		return Credentials{AuthConfiguration: docker.AuthConfiguration{
+			Username:      userPass[0],
+			Password:      userPass[1],
+			ServerAddress: registry,
+		}}, nil
+	}
+
+	return Credentials{}, nil
+}
+
+// EnvAuthVariable returns the name of the environment variable EnvAuthProvider
+// reads the credentials of the registry from
+func EnvAuthVariable(registry string) string {
+	return "ROCKER_AUTH_" + strings.Trim(envAuthInvalid.ReplaceAllString(strings.ToUpper(registry), "_"), "_")
+}
+
+// ECRAuthProvider requests tokens of AWS ECR registries through the AWS SDK,
+// with the AWS credentials of the environment; other registries are skipped
+type ECRAuthProvider struct{}
+
+// GetCredentials implements AuthProvider
+func (p ECRAuthProvider) GetCredentials(registry string) (Credentials, error) {
+	image := imagename.ImageName{Registry: registry}
+	if !image.IsECR() {
+		return Credentials{}, nil
+	}
+
+	creds, err := getECRCredentials(registry, image.GetECRRegion())
+	if err == credentials.ErrNoValidProvidersFoundInChain {
+		return Credentials{}, nil
+	}
+	return creds, err
+}
+
+// HTTPAuthProvider fetches credentials from an HTTP credentials service, such
+// as a company vault: GET <URL>/<registry> with the bearer token has to return
+// {"username": "...", "password": "...", "expires_at": "<RFC 3339>"}, or 404
+// if there are no credentials for the registry. The expiry is optional
+type HTTPAuthProvider struct {
+	URL    string
+	Token  string
+	Client *http.Client
+}
+
+type httpAuthResponse struct {
+	Username  string    `json:"username"`
+	Password  string    `json:"password"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// GetCredentials implements AuthProvider
+func (p HTTPAuthProvider) GetCredentials(registry string) (creds Credentials, err error) {
+	client := p.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	req, err := http.NewRequest("GET", strings.TrimSuffix(p.URL, "/")+"/"+url.PathEscape(registry), nil)
+	if err != nil {
+		return creds, err
+	}
+	if p.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+p.Token)
+	}
+
+	res, err := client.Do(req)
+	if err != nil {
+		return creds, fmt.Errorf("Failed to get credentials for %s from %s, error: %s", registry, p.URL, err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode == http.StatusNotFound {
+		return creds, nil
+	}
+	if res.StatusCode != http.StatusOK {
+		return creds, fmt.Errorf("Failed to get credentials for %s from %s, status: %s", registry, p.URL, res.Status)
+	}
+
+	data := httpAuthResponse{}
+	if err := json.NewDecoder(res.Body).Decode(&data); err != nil {
+		return creds, fmt.Errorf("Failed to parse credentials for %s from %s, error: %s", registry, p.URL, err)
+	}
+
+	return Credentials{
+		AuthConfiguration: docker.AuthConfiguration{
+			Username:      data.Username,
+			Password:      data.Password,
+			ServerAddress: registry,
+		},
+		Expires: data.ExpiresAt,
+	}, nil
+}
@@ -0,0 +1,145 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package dockerclient
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/grammarly/rocker/src/imagename"
+
+	"github.com/fsouza/go-dockerclient"
+	"github.com/stretchr/testify/assert"
+)
+
+type countingAuthProvider struct {
+	creds Credentials
+	calls int
+}
+
+func (p *countingAuthProvider) GetCredentials(registry string) (Credentials, error) {
+	p.calls++
+	return p.creds, nil
+}
+
+func TestAuthRegistry(t *testing.T) {
+	assert.Equal(t, "index.docker.io", AuthRegistry(imagename.NewFromString("ubuntu")))
+	assert.Equal(t, "quay.io", AuthRegistry(imagename.NewFromString("quay.io/app:1")))
+}
+
+func TestConfigAuthProvider(t *testing.T) {
+	p := ConfigAuthProvider{Auth: &docker.AuthConfigurations{
+		Configs: map[string]docker.AuthConfiguration{
+			"https://quay.io": {Username: "quay", Password: "secret"},
+		},
+	}}
+
+	creds, err := p.GetCredentials("quay.io")
+	assert.NoError(t, err)
+	assert.Equal(t, "quay", creds.Username)
+
+	creds, err = p.GetCredentials("gcr.io")
+	assert.NoError(t, err)
+	assert.True(t, creds.Empty())
+}
+
+func TestEnvAuthProvider(t *testing.T) {
+	env := map[string]string{
+		"ROCKER_AUTH_QUAY_IO": "quay:secret",
+		"ROCKER_AUTH":         "any:thing",
+	}
+	p := EnvAuthProvider{Getenv: func(name string) string { return env[name] }}
+
+	assert.Equal(t, "ROCKER_AUTH_QUAY_IO", EnvAuthVariable("quay.io"))
+	assert.Equal(t, "ROCKER_AUTH_REGISTRY_LOCAL_5000", EnvAuthVariable("registry.local:5000"))
+
+	creds, err := p.GetCredentials("quay.io")
+	assert.NoError(t, err)
+	assert.Equal(t, "quay", creds.Username)
+	assert.Equal(t, "secret", creds.Password)
+
+	creds, err = p.GetCredentials("gcr.io")
+	assert.NoError(t, err)
+	assert.Equal(t, "any", creds.Username)
+
+	env["ROCKER_AUTH"] = "broken"
+	_, err = p.GetCredentials("gcr.io")
+	assert.EqualError(t, err, "ROCKER_AUTH should be user:password")
+}
+
+func TestHTTPAuthProvider(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if r.URL.Path != "/creds/quay.io" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		fmt.Fprint(w, `{"username":"quay","password":"secret","expires_at":"2030-01-02T03:04:05Z"}`)
+	}))
+	defer server.Close()
+
+	p := HTTPAuthProvider{URL: server.URL + "/creds/", Token: "token"}
+
+	creds, err := p.GetCredentials("quay.io")
+	assert.NoError(t, err)
+	assert.Equal(t, "quay", creds.Username)
+	assert.Equal(t, "secret", creds.Password)
+	assert.Equal(t, time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC), creds.Expires.UTC())
+
+	creds, err = p.GetCredentials("gcr.io")
+	assert.NoError(t, err)
+	assert.True(t, creds.Empty())
+
+	p.Token = "wrong"
+	_, err = p.GetCredentials("quay.io")
+	assert.Error(t, err)
+}
+
+func TestAuthProviders_FirstFound(t *testing.T) {
+	empty := &countingAuthProvider{}
+	found := &countingAuthProvider{creds: Credentials{AuthConfiguration: docker.AuthConfiguration{Username: "user"}}}
+	never := &countingAuthProvider{}
+
+	creds, err := AuthProviders{empty, found, never}.GetCredentials("quay.io")
+	assert.NoError(t, err)
+	assert.Equal(t, "user", creds.Username)
+	assert.Equal(t, 0, never.calls)
+}
+
+func TestCachedAuthProvider_Expiry(t *testing.T) {
+	inner := &countingAuthProvider{creds: Credentials{
+		AuthConfiguration: docker.AuthConfiguration{Username: "user"},
+		Expires:           time.Now().Add(time.Hour),
+	}}
+	p := &CachedAuthProvider{Provider: inner}
+
+	p.GetCredentials("quay.io")
+	p.GetCredentials("quay.io")
+	assert.Equal(t, 1, inner.calls)
+
+	// expired credentials are asked again
+	inner.creds.Expires = time.Now().Add(-time.Second)
+	p.GetCredentials("gcr.io")
+	p.GetCredentials("gcr.io")
+	assert.Equal(t, 3, inner.calls)
+}
@@ -0,0 +1,136 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package dockerclient
+
+import (
+	"fmt"
+
+	"github.com/fsouza/go-dockerclient"
+)
+
+const (
+	// MinAPIVersion is the oldest docker remote API rocker works with
+	MinAPIVersion = "1.21"
+
+	// MaxAPIVersion is the newest docker remote API rocker asks for, newer
+	// daemons keep serving it for compatibility
+	MaxAPIVersion = "1.41"
+)
+
+// Capability is a feature of the docker daemon that appeared in some version
+// of the remote API
+type Capability struct {
+	// Name is what needs the feature, as the errors tell it
+	Name       string
+	APIVersion string
+}
+
+// The features rocker uses that older daemons do not have
+var (
+	CapHealthcheck            = Capability{"HEALTHCHECK", "1.24"}
+	CapHealthcheckStartPeriod = Capability{"HEALTHCHECK --start-period", "1.29"}
+	CapShell                  = Capability{"SHELL", "1.25"}
+	CapSquash                 = Capability{"SQUASH", "1.22"}
+	CapReproducible           = Capability{"--reproducible", "1.22"}
+
+	// Capabilities lists all the features, so they can be reported
+	Capabilities = []Capability{CapHealthcheck, CapHealthcheckStartPeriod, CapShell, CapSquash, CapReproducible}
+)
+
+// DaemonCapabilities tell what the daemon supports by the API version
+// rocker negotiated with it
+type DaemonCapabilities struct {
+	// Version is the docker version of the daemon
+	Version string
+
+	// APIVersion is the version the client speaks, the newest one
+	// both rocker and the daemon support
+	APIVersion docker.APIVersion
+
+	// Podman tells that the daemon is Podman serving the docker API
+	Podman bool
+}
+
+// Has tells if the daemon supports the feature
+func (c *DaemonCapabilities) Has(capability Capability) bool {
+	need, err := docker.NewAPIVersion(capability.APIVersion)
+	if err != nil {
+		return false
+	}
+	return c.APIVersion.GreaterThanOrEqualTo(need)
+}
+
+// Require returns an error that explains why the feature cannot be used if
+// the daemon does not support it. Unknown capabilities (nil) allow everything
+func (c *DaemonCapabilities) Require(capability Capability) error {
+	if c == nil || c.Has(capability) {
+		return nil
+	}
+	return fmt.Errorf("%s needs docker with the remote API %s or newer, the daemon is docker %s with API %s; upgrade docker",
+		capability.Name, capability.APIVersion, c.Version, c.APIVersion)
+}
+
+// Missing returns the features the daemon does not support
+func (c *DaemonCapabilities) Missing() (missing []Capability) {
+	for _, capability := range Capabilities {
+		if !c.Has(capability) {
+			missing = append(missing, capability)
+		}
+	}
+	return missing
+}
+
+// Negotiate asks the daemon for its version and picks the API version to speak
+// with it. It fails if the daemon is older than MinAPIVersion or does not serve
+// the API versions rocker speaks anymore, so the build stops before it starts
+// rather than with a 404 in the middle of it
+func Negotiate(client interface {
+	Version() (*docker.Env, error)
+}) (*DaemonCapabilities, error) {
+	env, err := client.Version()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get the docker daemon version, error: %s", err)
+	}
+
+	version, apiVersion := env.Get("Version"), env.Get("ApiVersion")
+
+	have, err := docker.NewAPIVersion(apiVersion)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse the API version %q of docker %s, error: %s", apiVersion, version, err)
+	}
+
+	min, _ := docker.NewAPIVersion(MinAPIVersion)
+	if have.LessThan(min) {
+		return nil, fmt.Errorf("Docker %s with the remote API %s is too old, rocker needs API %s or newer; upgrade docker",
+			version, apiVersion, MinAPIVersion)
+	}
+
+	max, _ := docker.NewAPIVersion(MaxAPIVersion)
+	if have.GreaterThan(max) {
+		have = max
+	}
+
+	// Daemons tell the oldest version they still serve since API 1.25
+	if daemonMin := env.Get("MinAPIVersion"); daemonMin != "" {
+		if oldest, err := docker.NewAPIVersion(daemonMin); err == nil && have.LessThan(oldest) {
+			return nil, fmt.Errorf("Docker %s serves the remote API %s or newer, rocker speaks up to %s",
+				version, daemonMin, MaxAPIVersion)
+		}
+	}
+
+	return &DaemonCapabilities{Version: version, APIVersion: have, Podman: isPodman(env)}, nil
+}
@@ -0,0 +1,80 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package dockerclient
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/fsouza/go-dockerclient"
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeVersion struct {
+	env docker.Env
+	err error
+}
+
+func (f *fakeVersion) Version() (*docker.Env, error) {
+	return &f.env, f.err
+}
+
+func TestNegotiate(t *testing.T) {
+	caps, err := Negotiate(&fakeVersion{env: docker.Env{"Version=1.12.1", "ApiVersion=1.24"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "1.12.1", caps.Version)
+	assert.Equal(t, "1.24", caps.APIVersion.String())
+
+	// newer daemons speak the newest version rocker knows
+	caps, err = Negotiate(&fakeVersion{env: docker.Env{"Version=26.1.0", "ApiVersion=1.45", "MinAPIVersion=1.24"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, MaxAPIVersion, caps.APIVersion.String())
+}
+
+func TestNegotiate_Errors(t *testing.T) {
+	_, err := Negotiate(&fakeVersion{env: docker.Env{"Version=1.8.3", "ApiVersion=1.20"}})
+	assert.EqualError(t, err, "Docker 1.8.3 with the remote API 1.20 is too old, rocker needs API 1.21 or newer; upgrade docker")
+
+	_, err = Negotiate(&fakeVersion{env: docker.Env{"Version=99.0.0", "ApiVersion=1.60", "MinAPIVersion=1.50"}})
+	assert.EqualError(t, err, "Docker 99.0.0 serves the remote API 1.50 or newer, rocker speaks up to "+MaxAPIVersion)
+
+	_, err = Negotiate(&fakeVersion{env: docker.Env{"Version=1.12.1", "ApiVersion=bad"}})
+	assert.Error(t, err)
+
+	_, err = Negotiate(&fakeVersion{err: fmt.Errorf("connection refused")})
+	assert.EqualError(t, err, "Failed to get the docker daemon version, error: connection refused")
+}
+
+func TestDaemonCapabilities(t *testing.T) {
+	v, _ := docker.NewAPIVersion("1.24")
+	caps := &DaemonCapabilities{Version: "1.12.1", APIVersion: v}
+
+	assert.True(t, caps.Has(CapHealthcheck))
+	assert.False(t, caps.Has(CapShell))
+	assert.Nil(t, caps.Require(CapHealthcheck))
+	assert.EqualError(t, caps.Require(CapShell),
+		"SHELL needs docker with the remote API 1.25 or newer, the daemon is docker 1.12.1 with API 1.24; upgrade docker")
+	assert.Equal(t, []Capability{CapHealthcheckStartPeriod, CapShell}, caps.Missing())
+
+	// unknown capabilities do not stop anything
+	var unknown *DaemonCapabilities
+	assert.Nil(t, unknown.Require(CapShell))
+}
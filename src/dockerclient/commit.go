@@ -0,0 +1,142 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package dockerclient
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/fsouza/go-dockerclient"
+)
+
+// HealthConfig is the HEALTHCHECK part of the image config, which
+// the client library does not know about
+type HealthConfig struct {
+	// Test is ["NONE"], ["CMD", args...] or ["CMD-SHELL", command]
+	Test []string `json:",omitempty"`
+
+	// Zero values mean the daemon defaults
+	Interval    time.Duration `json:",omitempty"`
+	Timeout     time.Duration `json:",omitempty"`
+	StartPeriod time.Duration `json:",omitempty"`
+	Retries     int           `json:",omitempty"`
+}
+
+// CommitOptions are the commit parameters that the client library does not support
+type CommitOptions struct {
+	NoPause     bool
+	Healthcheck *HealthConfig
+	Shell       []string
+
+	// Changes are Dockerfile instructions applied to the image config, for
+	// the daemons that ignore the config in the body of the request
+	Changes []string
+}
+
+// commitConfig adds the fields unknown to the client library to the image config
+type commitConfig struct {
+	*docker.Config
+	Healthcheck *HealthConfig `json:",omitempty"`
+	Shell       []string      `json:",omitempty"`
+}
+
+// CommitContainerNoPause commits the container without pausing it first. This is
+// faster for big containers, but the image may catch files that are half written
+// by processes still running in the container. The client library does not expose
+// the pause parameter of the commit API, so the request is made here.
+func CommitContainerNoPause(client *docker.Client, opts docker.CommitContainerOptions) (*docker.Image, error) {
+	return CommitContainerWithOptions(client, opts, CommitOptions{NoPause: true})
+}
+
+// CommitContainerWithOptions commits the container with the parameters
+// that the client library does not support
+func CommitContainerWithOptions(client *docker.Client, opts docker.CommitContainerOptions, extra CommitOptions) (*docker.Image, error) {
+	endpoint, err := url.Parse(client.Endpoint())
+	if err != nil {
+		return nil, err
+	}
+
+	q := url.Values{}
+	q.Set("container", opts.Container)
+	q.Set("repo", opts.Repository)
+	q.Set("tag", opts.Tag)
+	q.Set("comment", opts.Message)
+	q.Set("author", opts.Author)
+	if extra.NoPause {
+		q.Set("pause", "0")
+	}
+	if len(extra.Changes) > 0 {
+		q.Set("changes", strings.Join(extra.Changes, "\n"))
+	}
+
+	httpClient := client.HTTPClient
+	base := strings.TrimRight(endpoint.String(), "/")
+
+	if endpoint.Scheme == "unix" {
+		socket := endpoint.Path
+		httpClient = &http.Client{
+			Transport: &http.Transport{
+				Dial: func(_, _ string) (net.Conn, error) {
+					return net.Dial("unix", socket)
+				},
+			},
+		}
+		base = "http://unix.sock"
+	}
+
+	config := opts.Run
+	if config == nil {
+		config = &docker.Config{}
+	}
+
+	body, err := json.Marshal(commitConfig{config, extra.Healthcheck, extra.Shell})
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest("POST", base+"/commit?"+q.Encode(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to commit container %s, error: %s", opts.Container, err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode == http.StatusNotFound {
+		return nil, &docker.NoSuchContainer{ID: opts.Container}
+	}
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return nil, fmt.Errorf("Failed to commit container %s, status code %d", opts.Container, res.StatusCode)
+	}
+
+	image := &docker.Image{}
+	if err := json.NewDecoder(res.Body).Decode(image); err != nil {
+		return nil, err
+	}
+
+	return image, nil
+}
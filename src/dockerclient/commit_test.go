@@ -0,0 +1,131 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package dockerclient
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/fsouza/go-dockerclient"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCommitContainerNoPause(t *testing.T) {
+	var config docker.Config
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "POST", r.Method)
+		assert.Equal(t, "/commit", r.URL.Path)
+		assert.Equal(t, "0", r.URL.Query().Get("pause"))
+		assert.Equal(t, "456", r.URL.Query().Get("container"))
+
+		if err := json.NewDecoder(r.Body).Decode(&config); err != nil {
+			t.Fatal(err)
+		}
+
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{"Id":"sha256:789"}`))
+	}))
+	defer server.Close()
+
+	client, err := docker.NewClient(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	image, err := CommitContainerNoPause(client, docker.CommitContainerOptions{
+		Container: "456",
+		Run:       &docker.Config{Cmd: []string{"/bin/sh"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, "sha256:789", image.ID)
+	assert.Equal(t, []string{"/bin/sh"}, config.Cmd)
+}
+
+func TestCommitContainerWithOptions_Healthcheck(t *testing.T) {
+	var body map[string]interface{}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "", r.URL.Query().Get("pause"))
+
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Fatal(err)
+		}
+
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{"Id":"sha256:789"}`))
+	}))
+	defer server.Close()
+
+	client, err := docker.NewClient(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = CommitContainerWithOptions(client, docker.CommitContainerOptions{
+		Container: "456",
+		Run:       &docker.Config{Cmd: []string{"/bin/sh"}},
+	}, CommitOptions{
+		Healthcheck: &HealthConfig{
+			Test:     []string{"CMD-SHELL", "true"},
+			Interval: time.Second,
+		},
+		Shell: []string{"/bin/bash", "-c"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, []interface{}{"/bin/sh"}, body["Cmd"])
+	assert.Equal(t, map[string]interface{}{
+		"Test":     []interface{}{"CMD-SHELL", "true"},
+		"Interval": float64(time.Second),
+	}, body["Healthcheck"])
+	assert.Equal(t, []interface{}{"/bin/bash", "-c"}, body["Shell"])
+}
+
+func TestCommitContainerWithOptions_Changes(t *testing.T) {
+	var changes string
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		changes = r.URL.Query().Get("changes")
+
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{"Id":"sha256:789"}`))
+	}))
+	defer server.Close()
+
+	client, err := docker.NewClient(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = CommitContainerWithOptions(client, docker.CommitContainerOptions{Container: "456"}, CommitOptions{
+		Changes: []string{`ENV PATH="/bin"`, `CMD ["/bin/sh"]`},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, "ENV PATH=\"/bin\"\nCMD [\"/bin/sh\"]", changes)
+}
@@ -0,0 +1,147 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package dockerclient
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/fsouza/go-dockerclient"
+)
+
+// CheckConnection pings the daemon with the timeout and, if it cannot be reached,
+// tells what is likely wrong with the connection options
+func CheckConnection(client *docker.Client, config *Config, timeoutMs int) error {
+	err := Ping(client, timeoutMs)
+	if err == nil {
+		return nil
+	}
+
+	msg := err.Error()
+	if strings.HasPrefix(config.Host, "ssh://") {
+		sshTunnelsMu.Lock()
+		if t, ok := sshTunnels[config.Host]; ok && t.LastError() != "" {
+			msg = t.LastError()
+		}
+		sshTunnelsMu.Unlock()
+	}
+
+	if hint := connectionHint(config, msg); hint != "" {
+		return fmt.Errorf("Cannot connect to the docker daemon at %s, error: %s; %s", config.Host, msg, hint)
+	}
+	return fmt.Errorf("Cannot connect to the docker daemon at %s, error: %s", config.Host, msg)
+}
+
+// IsRemote tells if the host is the daemon of another machine, so the paths
+// of this machine mean nothing to it
+func IsRemote(host string) bool {
+	u, err := url.Parse(host)
+	if err != nil {
+		return false
+	}
+	switch u.Scheme {
+	case "tcp", "http", "https", "ssh":
+	default:
+		return false
+	}
+	switch u.Hostname() {
+	case "localhost", "127.0.0.1", "::1":
+		return false
+	}
+	return true
+}
+
+// connectionHint guesses the cause of the connection error
+func connectionHint(config *Config, msg string) string {
+	has := func(substrings ...string) bool {
+		for _, sub := range substrings {
+			if strings.Contains(msg, sub) {
+				return true
+			}
+		}
+		return false
+	}
+
+	switch {
+	case strings.HasPrefix(config.Host, "ssh://"):
+		switch {
+		case has("Permission denied"):
+			return "make sure ssh accepts your key, e.g. add it with ssh-add or set it in ~/.ssh/config"
+		case has("Could not resolve hostname"):
+			return "check the host name in --host or DOCKER_HOST"
+		case has("command not found", "unknown command", "dial-stdio"):
+			return "the remote host needs docker 18.09 or newer in the PATH of the ssh session"
+		}
+		return fmt.Sprintf("check that `%s docker version` works", sshCommandLine(config.Host))
+
+	case strings.HasPrefix(config.Host, "unix://"):
+		switch {
+		case has("no such file"):
+			return "the docker daemon is not running or listens elsewhere, start it or set --host or DOCKER_HOST, e.g. unix://$XDG_RUNTIME_DIR/podman/podman.sock for Podman"
+		case has("permission denied"):
+			return "the user cannot access the socket, add it to the docker group"
+		}
+		return ""
+	}
+
+	switch {
+	case has("x509", "certificate", "tls: bad"):
+		return "the certificates do not match the daemon, check --tlscacert, --tlscert and --tlskey or DOCKER_CERT_PATH"
+	case has("server gave HTTP response to HTTPS client"):
+		return "the daemon does not use TLS, drop --tlsverify and DOCKER_TLS_VERIFY"
+	case has("malformed HTTP response", "HTTP request to an HTTPS server"):
+		return "the daemon expects TLS, pass --tlsverify or set DOCKER_TLS_VERIFY=1"
+	case has(docker.ErrConnectionRefused.Error(), "connection refused"):
+		return "nothing listens on that address, check the host and the port"
+	case has("timeout", "no route to host"):
+		return "the host does not answer, check the address and the firewall"
+	}
+	return ""
+}
+
+// checkTLSFiles tells which of the TLS files is missing, rather than letting
+// the client library fail with the bare error of reading it
+func checkTLSFiles(config *Config) error {
+	for _, f := range []struct{ flag, path string }{
+		{"--tlscacert", config.Tlscacert},
+		{"--tlscert", config.Tlscert},
+		{"--tlskey", config.Tlskey},
+	} {
+		if _, err := os.Stat(f.path); err != nil {
+			return fmt.Errorf("Cannot use TLS to connect to %s, %s: %s; give it with %s or DOCKER_CERT_PATH", config.Host, f.flag, err, f.flag)
+		}
+	}
+	return nil
+}
+
+// sshCommandLine is how to log in to the ssh:// host by hand
+func sshCommandLine(host string) string {
+	u, err := url.Parse(host)
+	if err != nil {
+		return "ssh " + strings.TrimPrefix(host, "ssh://")
+	}
+	cmd := "ssh "
+	if port := u.Port(); port != "" {
+		cmd += "-p " + port + " "
+	}
+	if user := u.User.Username(); user != "" {
+		cmd += user + "@"
+	}
+	return cmd + u.Hostname()
+}
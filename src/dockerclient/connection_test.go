@@ -0,0 +1,63 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package dockerclient
+
+import (
+	"testing"
+
+	"github.com/fsouza/go-dockerclient"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConnectionHint(t *testing.T) {
+	ssh := &Config{Host: "ssh://me@build:2222"}
+	assert.Contains(t, connectionHint(ssh, "ssh: me@build: Permission denied (publickey)."), "ssh-add")
+	assert.Equal(t, "check that `ssh -p 2222 me@build docker version` works", connectionHint(ssh, "EOF"))
+
+	unix := &Config{Host: "unix:///var/run/docker.sock"}
+	assert.Contains(t, connectionHint(unix, "dial unix /var/run/docker.sock: connect: permission denied"), "docker group")
+	assert.Contains(t, connectionHint(unix, "dial unix /var/run/docker.sock: connect: no such file or directory"), "not running")
+
+	tcp := &Config{Host: "tcp://build:2376"}
+	assert.Contains(t, connectionHint(tcp, "http: server gave HTTP response to HTTPS client"), "drop --tlsverify")
+	assert.Contains(t, connectionHint(tcp, "x509: certificate signed by unknown authority"), "--tlscacert")
+	assert.Contains(t, connectionHint(tcp, docker.ErrConnectionRefused.Error()), "check the host and the port")
+	assert.Equal(t, "", connectionHint(tcp, "something else"))
+}
+
+func TestNewFromConfig_TLSFiles(t *testing.T) {
+	_, err := NewFromConfig(&Config{
+		Host:      "tcp://build:2376",
+		Tlsverify: true,
+		Tlscacert: "/nonexistent/ca.pem",
+		Tlscert:   "/nonexistent/cert.pem",
+		Tlskey:    "/nonexistent/key.pem",
+	})
+	assert.Contains(t, err.Error(), "Cannot use TLS to connect to tcp://build:2376, --tlscacert: ")
+
+	_, err = NewFromConfig(&Config{Host: "ssh://build", Tlsverify: true})
+	assert.Contains(t, err.Error(), "--tlsverify cannot be used with the ssh:// host")
+}
+
+func TestIsRemote(t *testing.T) {
+	assert.True(t, IsRemote("tcp://build-02.example.com:2376"))
+	assert.True(t, IsRemote("ssh://me@build"))
+	assert.False(t, IsRemote("tcp://127.0.0.1:2375"))
+	assert.False(t, IsRemote("tcp://localhost:2375"))
+	assert.False(t, IsRemote("unix:///var/run/docker.sock"))
+	assert.False(t, IsRemote(""))
+}
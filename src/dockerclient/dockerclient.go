@@ -59,7 +59,7 @@ func NewConfig() *Config {
 	}
 	host := os.Getenv("DOCKER_HOST")
 	if host == "" {
-		host = DefaultEndpoint
+		host = DiscoverEndpoint()
 	}
 	// why NewConfigFromCli default value is not working
 	return &Config{
@@ -71,15 +71,26 @@ func NewConfig() *Config {
 	}
 }
 
-// NewConfigFromCli returns new config with NewConfig overridden cli options
+// NewConfigFromCli returns new config with NewConfig overridden cli options;
+// the TLS files default to DOCKER_CERT_PATH unless given explicitly
 func NewConfigFromCli(c *cli.Context) *Config {
 	config := NewConfig()
 	config.Host = globalCliString(c, "host")
+	// The default of --host may be missing when docker runs rootless or it is Podman
+	if config.Host == DefaultEndpoint {
+		config.Host = DiscoverEndpoint()
+	}
 	if c.GlobalIsSet("tlsverify") {
 		config.Tlsverify = c.GlobalBool("tlsverify")
-		config.Tlscacert = globalCliString(c, "tlscacert")
-		config.Tlscert = globalCliString(c, "tlscert")
-		config.Tlskey = globalCliString(c, "tlskey")
+	}
+	for name, path := range map[string]*string{
+		"tlscacert": &config.Tlscacert,
+		"tlscert":   &config.Tlscert,
+		"tlskey":    &config.Tlskey,
+	} {
+		if c.GlobalIsSet(name) {
+			*path = expandHome(globalCliString(c, name))
+		}
 	}
 	return config
 }
@@ -91,10 +102,53 @@ func New() (*docker.Client, error) {
 
 // NewFromConfig returns a new docker client connection with given config
 func NewFromConfig(config *Config) (*docker.Client, error) {
+	return newClient(config, "")
+}
+
+// NewVersionedFromConfig returns a new docker client connection with given config
+// that speaks the given version of the remote API
+func NewVersionedFromConfig(config *Config, apiVersion string) (*docker.Client, error) {
+	return newClient(config, apiVersion)
+}
+
+// newClient connects to unix://, tcp:// and ssh:// hosts, the latter through
+// a tunnel of ssh; empty apiVersion speaks the version of the daemon
+func newClient(config *Config, apiVersion string) (*docker.Client, error) {
+	host := config.Host
+
+	if strings.HasPrefix(host, "ssh://") {
+		if config.Tlsverify {
+			return nil, fmt.Errorf("--tlsverify cannot be used with the ssh:// host %s, ssh encrypts the connection already", host)
+		}
+		tunnel, err := sshTunnelFor(host)
+		if err != nil {
+			return nil, err
+		}
+		host = tunnel.Endpoint()
+	}
+
 	if config.Tlsverify {
-		return docker.NewTLSClient(config.Host, config.Tlscert, config.Tlskey, config.Tlscacert)
+		if err := checkTLSFiles(config); err != nil {
+			return nil, err
+		}
+		if apiVersion == "" {
+			return docker.NewTLSClient(host, config.Tlscert, config.Tlskey, config.Tlscacert)
+		}
+		return docker.NewVersionedTLSClient(host, config.Tlscert, config.Tlskey, config.Tlscacert, apiVersion)
+	}
+
+	if apiVersion == "" {
+		return docker.NewClient(host)
 	}
-	return docker.NewClient(config.Host)
+	return docker.NewVersionedClient(host, apiVersion)
+}
+
+// expandHome replaces the leading ~ of the path with the home directory
+func expandHome(path string) string {
+	if expanded, err := homedir.Expand(path); err == nil {
+		return expanded
+	}
+	return path
 }
 
 // NewFromCli returns a new docker client connection with config built from cli params
@@ -128,7 +182,7 @@ func GlobalCliParams() []cli.Flag {
 		cli.StringFlag{
 			Name:   "host, H",
 			Value:  DefaultEndpoint,
-			Usage:  "Daemon socket(s) to connect to",
+			Usage:  "Daemon to connect to: unix:///path/to/socket, tcp://host:port or ssh://[user@]host[:port]",
 			EnvVar: "DOCKER_HOST",
 		},
 		cli.BoolFlag{
@@ -138,17 +192,17 @@ func GlobalCliParams() []cli.Flag {
 		cli.StringFlag{
 			Name:  "tlscacert",
 			Value: "~/.docker/ca.pem",
-			Usage: "Trust certs signed only by this CA",
+			Usage: "Trust certs signed only by this CA, $DOCKER_CERT_PATH/ca.pem by default",
 		},
 		cli.StringFlag{
 			Name:  "tlscert",
 			Value: "~/.docker/cert.pem",
-			Usage: "Path to TLS certificate file",
+			Usage: "Path to TLS certificate file, $DOCKER_CERT_PATH/cert.pem by default",
 		},
 		cli.StringFlag{
 			Name:  "tlskey",
 			Value: "~/.docker/key.pem",
-			Usage: "Path to TLS key file",
+			Usage: "Path to TLS key file, $DOCKER_CERT_PATH/key.pem by default",
 		},
 	}
 }
@@ -180,8 +234,13 @@ func infoCommand(c *cli.Context) {
 		fmt.Printf("  TLS key: %s\n", config.Tlskey)
 	}
 
-	dockerClient, err := NewFromCli(c)
+	dockerClient, err := NewFromConfig(config)
 	if err != nil {
+		CloseSSHTunnels()
+		log.Fatal(err)
+	}
+	if err := CheckConnection(dockerClient, config, 5000); err != nil {
+		CloseSSHTunnels()
 		log.Fatal(err)
 	}
 
@@ -190,6 +249,7 @@ func infoCommand(c *cli.Context) {
 
 	version, err := dockerClient.Version()
 	if err != nil {
+		CloseSSHTunnels()
 		log.Fatal(err)
 	}
 
@@ -201,6 +261,7 @@ func infoCommand(c *cli.Context) {
 	if c.Bool("all") {
 		info, err := dockerClient.Info()
 		if err != nil {
+			CloseSSHTunnels()
 			log.Fatal(err)
 		}
 
@@ -0,0 +1,131 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package dockerclient
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/fsouza/go-dockerclient"
+	"github.com/grammarly/rocker/src/imagename"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// hubURL is the Docker Hub API, tests point it to a fake server
+var hubURL = "https://hub.docker.com"
+
+// IsDockerHub returns true if the image is hosted on Docker Hub
+func IsDockerHub(image *imagename.ImageName) bool {
+	switch image.Registry {
+	case "", "docker.io", "index.docker.io", "registry-1.docker.io":
+		return image.Storage != imagename.StorageS3
+	}
+	return false
+}
+
+// HubUpdateDescription sets the short and the full (markdown) descriptions
+// of the Docker Hub repository of the image; empty ones are left as is
+func HubUpdateDescription(image *imagename.ImageName, auth *docker.AuthConfigurations, short, full string) error {
+	if !IsDockerHub(image) {
+		return fmt.Errorf("%s is not a Docker Hub repository", image.NameWithRegistry())
+	}
+
+	regAuth, err := GetAuthForRegistry(auth, image)
+	if err != nil || regAuth.Username == "" {
+		return fmt.Errorf("No Docker Hub credentials to update the description of %s, make sure you are logged in using `docker login`", image.NameWithRegistry())
+	}
+
+	name := image.Name
+	if !strings.Contains(name, "/") {
+		name = "library/" + name
+	}
+
+	var login struct {
+		Token string `json:"token"`
+	}
+	credentials := map[string]string{"username": regAuth.Username, "password": regAuth.Password}
+	if err := hubRequest("POST", "/v2/users/login/", "", credentials, &login); err != nil {
+		return err
+	}
+
+	description := map[string]string{}
+	if short != "" {
+		description["description"] = short
+	}
+	if full != "" {
+		description["full_description"] = full
+	}
+	if len(description) == 0 {
+		return nil
+	}
+
+	if err := hubRequest("PATCH", "/v2/repositories/"+name+"/", login.Token, description, nil); err != nil {
+		return err
+	}
+
+	log.Infof("Updated the Docker Hub description of %s", name)
+
+	return nil
+}
+
+func hubRequest(method, path, token string, body, out interface{}) error {
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	uri := hubURL + path
+
+	req, err := http.NewRequest(method, uri, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", "JWT "+token)
+	}
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("Request to %s failed with %s", uri, err)
+	}
+	defer res.Body.Close()
+
+	content, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return fmt.Errorf("Response from %s cannot be read due to error %s", uri, err)
+	}
+
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s %s status code %d: %s", method, uri, res.StatusCode, bytes.TrimSpace(content))
+	}
+
+	if out == nil {
+		return nil
+	}
+
+	if err := json.Unmarshal(content, out); err != nil {
+		return fmt.Errorf("Response from %s cannot be unmarshalled due to error %s", uri, err)
+	}
+
+	return nil
+}
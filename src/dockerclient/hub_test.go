@@ -0,0 +1,73 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package dockerclient
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/fsouza/go-dockerclient"
+	"github.com/grammarly/rocker/src/imagename"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIsDockerHub(t *testing.T) {
+	assert.True(t, IsDockerHub(imagename.NewFromString("grammarly/rocker:1")))
+	assert.True(t, IsDockerHub(imagename.NewFromString("docker.io/grammarly/rocker:1")))
+	assert.False(t, IsDockerHub(imagename.NewFromString("ghcr.io/grammarly/rocker:1")))
+	assert.False(t, IsDockerHub(imagename.NewFromString("s3:grammarly/rocker:1")))
+}
+
+func TestHubUpdateDescription(t *testing.T) {
+	var patched map[string]string
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v2/users/login/":
+			creds := map[string]string{}
+			json.NewDecoder(r.Body).Decode(&creds)
+			assert.Equal(t, map[string]string{"username": "me", "password": "pat"}, creds)
+			w.Write([]byte(`{"token":"jwt"}`))
+		case "/v2/repositories/grammarly/rocker/":
+			assert.Equal(t, "PATCH", r.Method)
+			assert.Equal(t, "JWT jwt", r.Header.Get("Authorization"))
+			json.NewDecoder(r.Body).Decode(&patched)
+			w.Write([]byte(`{}`))
+		default:
+			t.Errorf("Unexpected request %s %s", r.Method, r.URL)
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	defer func(url string) { hubURL = url }(hubURL)
+	hubURL = server.URL
+
+	auth := &docker.AuthConfigurations{
+		Configs: map[string]docker.AuthConfiguration{
+			"*": {Username: "me", Password: "pat"},
+		},
+	}
+
+	if err := HubUpdateDescription(imagename.NewFromString("grammarly/rocker:1"), auth, "Docker build tool", "# rocker"); err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, map[string]string{"description": "Docker build tool", "full_description": "# rocker"}, patched)
+}
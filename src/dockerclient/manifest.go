@@ -0,0 +1,104 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package dockerclient
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/fsouza/go-dockerclient"
+	"github.com/grammarly/rocker/src/imagename"
+)
+
+// manifestAccept are the kinds of manifests a tag may point to
+var manifestAccept = MediaTypeManifest + ", " + MediaTypeOCIManifest + ", " + MediaTypeManifestList + ", " + MediaTypeOCIIndex
+
+// RegistryManifestDigest returns the digest of the manifest the tag of the image points to
+func RegistryManifestDigest(image *imagename.ImageName, auth *docker.AuthConfigurations) (digest string, err error) {
+	s, name, err := newPullSession(image, auth)
+	if err != nil {
+		return "", err
+	}
+
+	content, err := s.get(fmt.Sprintf("%s%s/manifests/%s", s.base, name, image.GetTag()), manifestAccept)
+	if err != nil {
+		return "", err
+	}
+
+	return describe("", content).Digest, nil
+}
+
+// RegistryImageCreated returns when the image the tag points to was created, as its
+// config tells; for a manifest list it is the time of the first image of the list
+func RegistryImageCreated(image *imagename.ImageName, auth *docker.AuthConfigurations) (created time.Time, err error) {
+	s, name, err := newPullSession(image, auth)
+	if err != nil {
+		return created, err
+	}
+	return s.imageCreated(name, image.GetTag())
+}
+
+func (s *registrySession) imageCreated(name, reference string) (created time.Time, err error) {
+	content, err := s.get(fmt.Sprintf("%s%s/manifests/%s", s.base, name, reference), manifestAccept)
+	if err != nil {
+		return created, err
+	}
+
+	var manifest struct {
+		Config    ociDescriptor   `json:"config"`
+		Manifests []ociDescriptor `json:"manifests"`
+	}
+	if err := json.Unmarshal(content, &manifest); err != nil {
+		return created, fmt.Errorf("Failed to parse the manifest of %s:%s, error: %s", name, reference, err)
+	}
+
+	if manifest.Config.Digest == "" {
+		if len(manifest.Manifests) == 0 {
+			return created, fmt.Errorf("Manifest of %s:%s has neither a config nor images", name, reference)
+		}
+		return s.imageCreated(name, manifest.Manifests[0].Digest)
+	}
+
+	if content, err = s.get(fmt.Sprintf("%s%s/blobs/%s", s.base, name, manifest.Config.Digest), ""); err != nil {
+		return created, err
+	}
+
+	var config struct {
+		Created time.Time `json:"created"`
+	}
+	if err := json.Unmarshal(content, &config); err != nil {
+		return created, fmt.Errorf("Failed to parse the config of %s:%s, error: %s", name, reference, err)
+	}
+
+	return config.Created, nil
+}
+
+// newPullSession opens the session to read from the repository of the image
+func newPullSession(image *imagename.ImageName, auth *docker.AuthConfigurations) (s *registrySession, name string, err error) {
+	regAuth, err := GetAuthForRegistry(auth, image)
+	if err != nil {
+		return nil, "", fmt.Errorf("Failed to get auth token for registry: %s, error: %s", image, err)
+	}
+
+	base, name := registryBase(image)
+
+	if s, err = newRegistrySession(base, name, "pull", regAuth); err != nil {
+		return nil, "", err
+	}
+	return s, name, nil
+}
@@ -0,0 +1,70 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package dockerclient
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/fsouza/go-dockerclient"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRegistrySession_ImageCreated(t *testing.T) {
+	config := []byte(`{"architecture":"amd64","created":"2026-10-01T02:00:00Z"}`)
+	configDigest := describe("", config).Digest
+
+	manifest := []byte(`{"schemaVersion":2,"mediaType":"` + MediaTypeManifest + `","config":{"digest":"` + configDigest + `"}}`)
+	list := []byte(`{"schemaVersion":2,"mediaType":"` + MediaTypeManifestList + `","manifests":[{"digest":"sha256:aaa"}]}`)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v2/":
+			w.WriteHeader(http.StatusOK)
+		case "/v2/acme/app/manifests/nightly-1", "/v2/acme/app/manifests/sha256:aaa":
+			assert.Equal(t, manifestAccept, r.Header.Get("Accept"))
+			w.Write(manifest)
+		case "/v2/acme/app/manifests/nightly-2":
+			w.Write(list)
+		case "/v2/acme/app/blobs/" + configDigest:
+			w.Write(config)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	s, err := newRegistrySession(server.URL+"/v2/", "acme/app", "pull", docker.AuthConfiguration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := time.Date(2026, 10, 1, 2, 0, 0, 0, time.UTC)
+
+	for _, tag := range []string{"nightly-1", "nightly-2"} {
+		created, err := s.imageCreated("acme/app", tag)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.True(t, expected.Equal(created), "%s created %s", tag, created)
+	}
+
+	_, err = s.imageCreated("acme/app", "missing")
+	assert.Error(t, err)
+}
@@ -0,0 +1,211 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package dockerclient
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/fsouza/go-dockerclient"
+	"github.com/grammarly/rocker/src/imagename"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Media types of the image manifests and the lists of them
+const (
+	MediaTypeManifest     = "application/vnd.docker.distribution.manifest.v2+json"
+	MediaTypeManifestList = "application/vnd.docker.distribution.manifest.list.v2+json"
+	MediaTypeOCIIndex     = "application/vnd.oci.image.index.v1+json"
+)
+
+// Platform is the OS and the CPU architecture an image is built for
+type Platform struct {
+	OS           string `json:"os"`
+	Architecture string `json:"architecture"`
+	Variant      string `json:"variant,omitempty"`
+}
+
+// ParsePlatform parses the platform in the os/arch[/variant] form, e.g. linux/arm64
+func ParsePlatform(s string) (p Platform, err error) {
+	parts := strings.Split(s, "/")
+	if len(parts) < 2 || len(parts) > 3 || parts[0] == "" || parts[1] == "" {
+		return p, fmt.Errorf("Invalid platform %q, expected os/arch[/variant], e.g. linux/arm64", s)
+	}
+	p.OS, p.Architecture = parts[0], parts[1]
+	if len(parts) == 3 {
+		p.Variant = parts[2]
+	}
+	return p, nil
+}
+
+// DaemonPlatform returns the platform of the images the daemon builds natively,
+// with the architecture that `docker info` reports translated to the one of the
+// image spec, e.g. x86_64 to amd64
+func DaemonPlatform(info *docker.DockerInfo) Platform {
+	p := Platform{OS: info.OSType, Architecture: info.Architecture}
+	if p.OS == "" {
+		p.OS = "linux"
+	}
+
+	switch p.Architecture {
+	case "x86_64":
+		p.Architecture = "amd64"
+	case "i386", "i686":
+		p.Architecture = "386"
+	case "aarch64", "arm64":
+		p.Architecture = "arm64"
+	case "armv7l":
+		p.Architecture, p.Variant = "arm", "v7"
+	case "armv6l":
+		p.Architecture, p.Variant = "arm", "v6"
+	}
+
+	return p
+}
+
+// ParseDaemon parses the value of --daemon, the docker host optionally preceded
+// by the platform it builds for, e.g. linux/arm64=ssh://builder@pi; the platform
+// is empty unless given
+func ParseDaemon(s string) (host string, platform Platform, err error) {
+	parts := strings.SplitN(s, "=", 2)
+	if len(parts) == 1 || strings.Contains(parts[0], ":") {
+		return s, platform, nil
+	}
+	if platform, err = ParsePlatform(parts[0]); err != nil {
+		return "", platform, err
+	}
+	if parts[1] == "" {
+		return "", platform, fmt.Errorf("Invalid --daemon %q, expected [os/arch=]host", s)
+	}
+	return parts[1], platform, nil
+}
+
+// String returns the platform in the os/arch[/variant] form
+func (p Platform) String() string {
+	if p.Variant != "" {
+		return p.OS + "/" + p.Architecture + "/" + p.Variant
+	}
+	return p.OS + "/" + p.Architecture
+}
+
+// Tag returns the platform in the form that can be a part of an image tag, e.g. linux-arm64
+func (p Platform) Tag() string {
+	return strings.Replace(p.String(), "/", "-", -1)
+}
+
+// ManifestListEntry is an image of the manifest list, pushed to the same repository
+type ManifestListEntry struct {
+	Digest   string
+	Platform Platform
+}
+
+type manifestListDescriptor struct {
+	MediaType string   `json:"mediaType"`
+	Digest    string   `json:"digest"`
+	Size      int64    `json:"size"`
+	Platform  Platform `json:"platform"`
+}
+
+type manifestList struct {
+	SchemaVersion int                      `json:"schemaVersion"`
+	MediaType     string                   `json:"mediaType"`
+	Manifests     []manifestListDescriptor `json:"manifests"`
+	Annotations   map[string]string        `json:"annotations,omitempty"`
+}
+
+// RegistryPushManifestList pushes the manifest list of the images that are already
+// in the repository of the given image name, and returns the digest of the list.
+// The list is an OCI index if all the images are OCI ones, a docker manifest list otherwise;
+// only the OCI index can have annotations, a docker list is pushed without them.
+func RegistryPushManifestList(image *imagename.ImageName, auth *docker.AuthConfigurations, entries []ManifestListEntry, annotations map[string]string) (digest string, err error) {
+	if image.GetTag() == "" {
+		return "", fmt.Errorf("Manifest list %s should have a tag", image)
+	}
+
+	regAuth, err := GetAuthForRegistry(auth, image)
+	if err != nil {
+		return "", fmt.Errorf("Failed to get auth token for registry: %s, error: %s", image, err)
+	}
+
+	base, name := registryBase(image)
+
+	s, err := newRegistrySession(base, name, "pull,push", regAuth)
+	if err != nil {
+		return "", err
+	}
+
+	return s.pushManifestList(name, image.GetTag(), entries, annotations)
+}
+
+// pushManifestList fetches the manifests of the entries to learn their media types
+// and sizes, and then puts the list that refers to them
+func (s *registrySession) pushManifestList(name, tag string, entries []ManifestListEntry, annotations map[string]string) (digest string, err error) {
+	list := manifestList{
+		SchemaVersion: 2,
+		MediaType:     MediaTypeOCIIndex,
+	}
+
+	for _, e := range entries {
+		uri := fmt.Sprintf("%s%s/manifests/%s", s.base, name, e.Digest)
+
+		content, err := s.get(uri, MediaTypeManifest+", "+MediaTypeOCIManifest)
+		if err != nil {
+			return "", fmt.Errorf("Failed to get the manifest of %s@%s, error: %s", name, e.Digest, err)
+		}
+
+		var manifest struct {
+			MediaType string `json:"mediaType"`
+		}
+		if err := json.Unmarshal(content, &manifest); err != nil {
+			return "", fmt.Errorf("Failed to parse the manifest of %s@%s, error: %s", name, e.Digest, err)
+		}
+		if manifest.MediaType == "" {
+			manifest.MediaType = MediaTypeOCIManifest
+		}
+		if manifest.MediaType != MediaTypeOCIManifest {
+			list.MediaType = MediaTypeManifestList
+		}
+
+		list.Manifests = append(list.Manifests, manifestListDescriptor{
+			MediaType: manifest.MediaType,
+			Digest:    e.Digest,
+			Size:      int64(len(content)),
+			Platform:  e.Platform,
+		})
+	}
+
+	if list.MediaType == MediaTypeOCIIndex {
+		list.Annotations = annotations
+	} else if len(annotations) > 0 {
+		log.Warnf("Manifest list %s:%s is a docker one, which cannot have annotations", name, tag)
+	}
+
+	content, err := json.Marshal(list)
+	if err != nil {
+		return "", err
+	}
+
+	uri := fmt.Sprintf("%s%s/manifests/%s", s.base, name, tag)
+	if _, err := s.do("PUT", uri, list.MediaType, content, http.StatusCreated); err != nil {
+		return "", err
+	}
+
+	return describe(list.MediaType, content).Digest, nil
+}
@@ -0,0 +1,125 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package dockerclient
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/fsouza/go-dockerclient"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParsePlatform(t *testing.T) {
+	p, err := ParsePlatform("linux/arm/v7")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, Platform{OS: "linux", Architecture: "arm", Variant: "v7"}, p)
+	assert.Equal(t, "linux/arm/v7", p.String())
+	assert.Equal(t, "linux-arm-v7", p.Tag())
+
+	_, err = ParsePlatform("arm64")
+	assert.Error(t, err)
+}
+
+func TestParseDaemon(t *testing.T) {
+	host, platform, err := ParseDaemon("linux/arm64=ssh://builder@pi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "ssh://builder@pi", host)
+	assert.Equal(t, "linux/arm64", platform.String())
+
+	host, platform, err = ParseDaemon("tcp://10.0.0.1:2376")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "tcp://10.0.0.1:2376", host)
+	assert.Equal(t, Platform{}, platform)
+
+	_, _, err = ParseDaemon("arm64=tcp://10.0.0.1:2376")
+	assert.Error(t, err)
+}
+
+func TestDaemonPlatform(t *testing.T) {
+	assert.Equal(t, "linux/amd64", DaemonPlatform(&docker.DockerInfo{OSType: "linux", Architecture: "x86_64"}).String())
+	assert.Equal(t, "linux/arm64", DaemonPlatform(&docker.DockerInfo{OSType: "linux", Architecture: "aarch64"}).String())
+	assert.Equal(t, "linux/arm/v7", DaemonPlatform(&docker.DockerInfo{Architecture: "armv7l"}).String())
+}
+
+func TestRegistrySession_PushManifestList(t *testing.T) {
+	amd64 := []byte(`{"schemaVersion":2,"mediaType":"` + MediaTypeManifest + `"}`)
+	arm64 := []byte(`{"schemaVersion":2,"mediaType":"` + MediaTypeManifest + `","layers":[]}`)
+
+	var (
+		contentType string
+		list        []byte
+	)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == "GET" && r.URL.Path == "/v2/":
+			w.WriteHeader(http.StatusOK)
+		case r.Method == "GET" && r.URL.Path == "/v2/acme/app/manifests/sha256:aaa":
+			w.Write(amd64)
+		case r.Method == "GET" && r.URL.Path == "/v2/acme/app/manifests/sha256:bbb":
+			w.Write(arm64)
+		case r.Method == "PUT" && r.URL.Path == "/v2/acme/app/manifests/1.0":
+			contentType = r.Header.Get("Content-Type")
+			list, _ = ioutil.ReadAll(r.Body)
+			w.WriteHeader(http.StatusCreated)
+		default:
+			t.Errorf("Unexpected request %s %s", r.Method, r.URL)
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+	defer server.Close()
+
+	s, err := newRegistrySession(server.URL+"/v2/", "acme/app", "pull,push", docker.AuthConfiguration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	digest, err := s.pushManifestList("acme/app", "1.0", []ManifestListEntry{
+		{Digest: "sha256:aaa", Platform: Platform{OS: "linux", Architecture: "amd64"}},
+		{Digest: "sha256:bbb", Platform: Platform{OS: "linux", Architecture: "arm64"}},
+	}, map[string]string{"org.opencontainers.image.revision": "abc"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := manifestList{}
+	if err := json.Unmarshal(list, &m); err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, MediaTypeManifestList, contentType)
+	assert.Equal(t, describe(MediaTypeManifestList, list).Digest, digest)
+	assert.Equal(t, MediaTypeManifestList, m.MediaType)
+	assert.Nil(t, m.Annotations, "a docker manifest list cannot have annotations")
+	assert.Len(t, m.Manifests, 2)
+	assert.Equal(t, manifestListDescriptor{
+		MediaType: MediaTypeManifest,
+		Digest:    "sha256:bbb",
+		Size:      int64(len(arm64)),
+		Platform:  Platform{OS: "linux", Architecture: "arm64"},
+	}, m.Manifests[1])
+}
@@ -0,0 +1,98 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package dockerclient
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fsouza/go-dockerclient"
+	"github.com/grammarly/rocker/src/imagename"
+)
+
+// RateLimit is the pull quota a registry reports in the headers, such as
+// Docker Hub's "RateLimit-Limit: 100;w=21600" and "RateLimit-Remaining: 76;w=21600"
+type RateLimit struct {
+	Limit     int
+	Remaining int
+	Window    time.Duration
+}
+
+// Known tells if the registry reported the quota
+func (r RateLimit) Known() bool {
+	return r.Limit > 0
+}
+
+// String returns the quota for humans, e.g. "76 of 100 pulls left per 6h0m0s"
+func (r RateLimit) String() string {
+	if !r.Known() {
+		return "unknown quota"
+	}
+	s := fmt.Sprintf("%d of %d pulls left", r.Remaining, r.Limit)
+	if r.Window > 0 {
+		s += " per " + r.Window.String()
+	}
+	return s
+}
+
+// RegistryRateLimit asks the registry for the pull quota with a HEAD of the image
+// manifest, which Docker Hub does not count as a pull
+func RegistryRateLimit(image *imagename.ImageName, auth *docker.AuthConfigurations) (RateLimit, error) {
+	regAuth, err := GetAuthForRegistry(auth, image)
+	if err != nil {
+		return RateLimit{}, fmt.Errorf("Failed to get auth token for registry: %s, error: %s", image, err)
+	}
+
+	base, name := registryBase(image)
+
+	s, err := newRegistrySession(base, name, "pull", regAuth)
+	if err != nil {
+		return RateLimit{}, err
+	}
+
+	res, err := s.do("HEAD", fmt.Sprintf("%s%s/manifests/%s", base, name, image.GetTag()), "", nil, 0)
+	if err != nil {
+		return RateLimit{}, err
+	}
+
+	return parseRateLimit(res.Header), nil
+}
+
+func parseRateLimit(h http.Header) (r RateLimit) {
+	var window int
+
+	r.Limit, window = parseRateLimitValue(h.Get("RateLimit-Limit"))
+	r.Remaining, _ = parseRateLimitValue(h.Get("RateLimit-Remaining"))
+	r.Window = time.Duration(window) * time.Second
+
+	return r
+}
+
+// parseRateLimitValue parses "100;w=21600" to the count and the window in seconds
+func parseRateLimitValue(value string) (n, window int) {
+	parts := strings.Split(value, ";")
+	n, _ = strconv.Atoi(strings.TrimSpace(parts[0]))
+	for _, p := range parts[1:] {
+		if kv := strings.SplitN(strings.TrimSpace(p), "=", 2); len(kv) == 2 && kv[0] == "w" {
+			window, _ = strconv.Atoi(kv[1])
+		}
+	}
+	return n, window
+}
@@ -0,0 +1,141 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package dockerclient
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/fsouza/go-dockerclient"
+	"github.com/grammarly/rocker/src/imagename"
+)
+
+// ociIndex is the OCI image index, as used for the referrers tag
+type ociIndex struct {
+	SchemaVersion int             `json:"schemaVersion"`
+	MediaType     string          `json:"mediaType"`
+	Manifests     []ociDescriptor `json:"manifests"`
+}
+
+// RegistryAttachArtifact pushes the artifact to the repository of the image with the
+// manifest of the image as its subject, so the referrers API lists it for the image,
+// e.g. an SBOM or a signature of it. The image may be given by tag or by digest; the
+// artifact is pushed by digest, which is returned.
+func RegistryAttachArtifact(image *imagename.ImageName, auth *docker.AuthConfigurations, artifact OCIArtifact) (digest string, err error) {
+	if image.GetTag() == "" {
+		return "", fmt.Errorf("Image %s should have a tag or a digest", image)
+	}
+
+	regAuth, err := GetAuthForRegistry(auth, image)
+	if err != nil {
+		return "", fmt.Errorf("Failed to get auth token for registry: %s, error: %s", image, err)
+	}
+
+	base, name := registryBase(image)
+
+	s, err := newRegistrySession(base, name, "pull,push", regAuth)
+	if err != nil {
+		return "", err
+	}
+
+	subject, err := s.describeManifest(name, image.GetTag())
+	if err != nil {
+		return "", err
+	}
+
+	return s.pushArtifact(name, "", artifact, &subject)
+}
+
+// ParseAnnotations parses the key=value pairs of --annotation
+func ParseAnnotations(values []string) (map[string]string, error) {
+	if len(values) == 0 {
+		return nil, nil
+	}
+
+	annotations := map[string]string{}
+	for _, kv := range values {
+		parts := strings.SplitN(kv, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("Invalid annotation %q, expected key=value", kv)
+		}
+		annotations[parts[0]] = parts[1]
+	}
+
+	return annotations, nil
+}
+
+// describeManifest returns the descriptor of the manifest the reference points to
+func (s *registrySession) describeManifest(name, reference string) (desc ociDescriptor, err error) {
+	content, err := s.get(fmt.Sprintf("%s%s/manifests/%s", s.base, name, reference), manifestAccept)
+	if err != nil {
+		return desc, fmt.Errorf("Failed to get the manifest of %s:%s, error: %s", name, reference, err)
+	}
+
+	var manifest struct {
+		MediaType string `json:"mediaType"`
+	}
+	if err := json.Unmarshal(content, &manifest); err != nil {
+		return desc, fmt.Errorf("Failed to parse the manifest of %s:%s, error: %s", name, reference, err)
+	}
+	if manifest.MediaType == "" {
+		manifest.MediaType = MediaTypeOCIManifest
+	}
+
+	return describe(manifest.MediaType, content), nil
+}
+
+// addReferrer adds the artifact to the index under the referrers tag of the subject,
+// sha256-<hex>, which stands for the referrers API on the registries that lack it
+func (s *registrySession) addReferrer(name string, subject, artifact ociDescriptor) error {
+	uri := fmt.Sprintf("%s%s/manifests/%s", s.base, name, strings.Replace(subject.Digest, ":", "-", 1))
+
+	index := ociIndex{
+		SchemaVersion: 2,
+		MediaType:     MediaTypeOCIIndex,
+		Manifests:     []ociDescriptor{},
+	}
+
+	res, err := s.do("HEAD", uri, "", nil, 0)
+	if err != nil {
+		return err
+	}
+	if res.StatusCode == http.StatusOK {
+		content, err := s.get(uri, MediaTypeOCIIndex)
+		if err != nil {
+			return err
+		}
+		if err := json.Unmarshal(content, &index); err != nil {
+			return fmt.Errorf("Failed to parse the referrers of %s@%s, error: %s", name, subject.Digest, err)
+		}
+	}
+
+	for _, m := range index.Manifests {
+		if m.Digest == artifact.Digest {
+			return nil
+		}
+	}
+	index.Manifests = append(index.Manifests, artifact)
+
+	content, err := json.Marshal(index)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.do("PUT", uri, MediaTypeOCIIndex, content, http.StatusCreated)
+	return err
+}
@@ -0,0 +1,151 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package dockerclient
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/fsouza/go-dockerclient"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeReferrersRegistry keeps the manifests pushed to acme/app, with the image
+// manifest at the 1.0 tag; it answers with OCI-Subject if it has the referrers API
+type fakeReferrersRegistry struct {
+	referrersAPI bool
+	manifests    map[string][]byte
+}
+
+func (reg *fakeReferrersRegistry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	const prefix = "/v2/acme/app/manifests/"
+
+	switch {
+	case r.Method == "GET" && r.URL.Path == "/v2/":
+		w.WriteHeader(http.StatusOK)
+	case r.Method == "HEAD" && strings.HasPrefix(r.URL.Path, "/v2/acme/app/blobs/"):
+		w.WriteHeader(http.StatusOK)
+	case (r.Method == "GET" || r.Method == "HEAD") && strings.HasPrefix(r.URL.Path, prefix):
+		content, ok := reg.manifests[strings.TrimPrefix(r.URL.Path, prefix)]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write(content)
+	case r.Method == "PUT" && strings.HasPrefix(r.URL.Path, prefix):
+		content, _ := ioutil.ReadAll(r.Body)
+		reg.manifests[strings.TrimPrefix(r.URL.Path, prefix)] = content
+		if reg.referrersAPI {
+			var m ociManifest
+			json.Unmarshal(content, &m)
+			if m.Subject != nil {
+				w.Header().Set("OCI-Subject", m.Subject.Digest)
+			}
+		}
+		w.WriteHeader(http.StatusCreated)
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+	}
+}
+
+func TestRegistrySession_AttachArtifact(t *testing.T) {
+	image := []byte(`{"schemaVersion":2,"mediaType":"` + MediaTypeManifest + `","layers":[]}`)
+	subject := describe(MediaTypeManifest, image)
+
+	for _, referrersAPI := range []bool{true, false} {
+		reg := &fakeReferrersRegistry{
+			referrersAPI: referrersAPI,
+			manifests:    map[string][]byte{"1.0": image},
+		}
+
+		server := httptest.NewServer(reg)
+
+		s, err := newRegistrySession(server.URL+"/v2/", "acme/app", "pull,push", docker.AuthConfiguration{})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		desc, err := s.describeManifest("acme/app", "1.0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, subject, desc)
+
+		// Attaching twice keeps a single entry in the referrers tag
+		for i := 0; i < 2; i++ {
+			digest, err := s.pushArtifact("acme/app", "", OCIArtifact{
+				Content:      []byte(`{"spdxVersion":"SPDX-2.3"}`),
+				MediaType:    "application/spdx+json",
+				ArtifactType: "application/spdx+json",
+				Annotations:  map[string]string{"org.opencontainers.image.created": "2026-10-16T00:00:00Z"},
+			}, &desc)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			m := ociManifest{}
+			if err := json.Unmarshal(reg.manifests[digest], &m); err != nil {
+				t.Fatal(err)
+			}
+			assert.Equal(t, &subject, m.Subject)
+			assert.Equal(t, "application/spdx+json", m.ArtifactType)
+			assert.Equal(t, "2026-10-16T00:00:00Z", m.Annotations["org.opencontainers.image.created"])
+
+			referrers, ok := reg.manifests[strings.Replace(subject.Digest, ":", "-", 1)]
+			if referrersAPI {
+				assert.False(t, ok, "the registry lists the referrers itself")
+				continue
+			}
+
+			index := ociIndex{}
+			if err := json.Unmarshal(referrers, &index); err != nil {
+				t.Fatal(err)
+			}
+			assert.Equal(t, MediaTypeOCIIndex, index.MediaType)
+			assert.Equal(t, []ociDescriptor{{
+				MediaType:    MediaTypeOCIManifest,
+				Digest:       digest,
+				Size:         int64(len(reg.manifests[digest])),
+				ArtifactType: "application/spdx+json",
+				Annotations:  map[string]string{"org.opencontainers.image.created": "2026-10-16T00:00:00Z"},
+			}}, index.Manifests)
+		}
+
+		server.Close()
+	}
+}
+
+func TestParseAnnotations(t *testing.T) {
+	annotations, err := ParseAnnotations([]string{"org.opencontainers.image.source=https://github.com/acme/app", "empty="})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, map[string]string{
+		"org.opencontainers.image.source": "https://github.com/acme/app",
+		"empty":                           "",
+	}, annotations)
+
+	_, err = ParseAnnotations([]string{"novalue"})
+	assert.EqualError(t, err, `Invalid annotation "novalue", expected key=value`)
+
+	annotations, err = ParseAnnotations(nil)
+	assert.NoError(t, err)
+	assert.Nil(t, annotations)
+}
@@ -23,6 +23,7 @@ import (
 	"net/http"
 	"net/url"
 	"strings"
+	"time"
 
 	"github.com/fsouza/go-dockerclient"
 	"github.com/grammarly/rocker/src/imagename"
@@ -113,8 +114,9 @@ func registryGet(uri string, auth docker.AuthConfiguration, obj interface{}) (er
 	}
 
 	var (
-		b       *bearer
-		authTry bool
+		b        *bearer
+		authTry  bool
+		retryTry bool
 	)
 
 	for {
@@ -126,13 +128,20 @@ func registryGet(uri string, auth docker.AuthConfiguration, obj interface{}) (er
 		b = parseBearer(res.Header.Get("Www-Authenticate"))
 		log.Debugf("Got HTTP %d for %s; tried auth: %t; has Bearer: %t, auth username: %q", res.StatusCode, uri, authTry, b != nil, auth.Username)
 
-		if res.StatusCode == 401 && !authTry && b != nil {
+		if res.StatusCode == 401 && !retryTry && b != nil {
+			// The cached token may be revoked before it expires, so ask for
+			// a fresh one once before giving up
+			if authTry {
+				registryTokens.invalidate(b, auth)
+				retryTry = true
+			}
+
 			token, err := getAuthToken(b, auth)
 			if err != nil {
 				return fmt.Errorf("Failed to authenticate to registry %s, error: %s", uri, err)
 			}
 
-			req.Header.Add("Authorization", "Bearer "+token)
+			req.Header.Set("Authorization", "Bearer "+token)
 
 			authTry = true
 			continue
@@ -158,9 +167,21 @@ func registryGet(uri string, auth docker.AuthConfiguration, obj interface{}) (er
 	return
 }
 
+// getAuthToken returns a token for the scope of the bearer challenge, the cached
+// one if it is still valid
 func getAuthToken(b *bearer, auth docker.AuthConfiguration) (token string, err error) {
+	return registryTokens.get(b, auth, func() (authToken, error) {
+		return requestAuthToken(b, auth)
+	})
+}
+
+// requestAuthToken asks the token server of the registry for a new token
+func requestAuthToken(b *bearer, auth docker.AuthConfiguration) (token authToken, err error) {
 	type authRespType struct {
-		Token string
+		Token       string    `json:"token"`
+		AccessToken string    `json:"access_token"`
+		ExpiresIn   int       `json:"expires_in"`
+		IssuedAt    time.Time `json:"issued_at"`
 	}
 
 	var (
@@ -174,7 +195,7 @@ func getAuthToken(b *bearer, auth docker.AuthConfiguration) (token string, err e
 
 	uri, err := url.Parse(b.Realm)
 	if err != nil {
-		return "", fmt.Errorf("Failed to parse real url %s, error %s", b.Realm, err)
+		return token, fmt.Errorf("Failed to parse real url %s, error %s", b.Realm, err)
 	}
 
 	// Add query params to the ream uri
@@ -184,7 +205,7 @@ func getAuthToken(b *bearer, auth docker.AuthConfiguration) (token string, err e
 	uri.RawQuery = q.Encode()
 
 	if req, err = http.NewRequest("GET", uri.String(), nil); err != nil {
-		return "", err
+		return token, err
 	}
 
 	if auth.Username != "" {
@@ -194,25 +215,31 @@ func getAuthToken(b *bearer, auth docker.AuthConfiguration) (token string, err e
 	log.Debugf("Getting auth token from %s", uri)
 
 	if res, err = client.Do(req); err != nil {
-		return "", fmt.Errorf("Failed to authenticate by realm url %s, error %s", uri, err)
+		return token, fmt.Errorf("Failed to authenticate by realm url %s, error %s", uri, err)
 	}
 	defer res.Body.Close()
 
 	if res.StatusCode != 200 {
 		// TODO: maybe more descriptive error
-		return "", fmt.Errorf("GET %s status code %d", uri, res.StatusCode)
+		return token, fmt.Errorf("GET %s status code %d", uri, res.StatusCode)
 	}
 
 	if body, err = ioutil.ReadAll(res.Body); err != nil {
-		return "", fmt.Errorf("Response from %s cannot be read due to error %s\n", uri, err)
+		return token, fmt.Errorf("Response from %s cannot be read due to error %s\n", uri, err)
 	}
 
 	if err := json.Unmarshal(body, authResp); err != nil {
-		return "", fmt.Errorf("Response from %s cannot be unmarshalled due to error %s, response: %s\n",
+		return token, fmt.Errorf("Response from %s cannot be unmarshalled due to error %s, response: %s\n",
 			uri, err, body)
 	}
 
-	return authResp.Token, nil
+	token.Token = authResp.Token
+	if token.Token == "" {
+		token.Token = authResp.AccessToken
+	}
+	token.Expires = tokenExpires(authResp.ExpiresIn, authResp.IssuedAt, time.Now())
+
+	return token, nil
 }
 
 func ecrImageExists(image *imagename.ImageName, auth docker.AuthConfiguration) (exists bool, err error) {
@@ -277,3 +304,44 @@ func parseBearer(hdr string) *bearer {
 
 	return b
 }
+
+// RegistryCheckAuth makes sure the registry accepts the credentials; registries
+// that do not ask for authorization at all are fine as well
+func RegistryCheckAuth(registry string, auth docker.AuthConfiguration) error {
+	base, _ := registryBase(&imagename.ImageName{Registry: registry})
+
+	res, err := http.Get(base)
+	if err != nil {
+		return fmt.Errorf("Request to %s failed with %s", base, err)
+	}
+	res.Body.Close()
+
+	if res.StatusCode == http.StatusOK {
+		return nil
+	}
+	if res.StatusCode != http.StatusUnauthorized {
+		return fmt.Errorf("GET %s status code %d", base, res.StatusCode)
+	}
+
+	// Token servers give an unscoped token for valid credentials only
+	if b := parseBearer(res.Header.Get("Www-Authenticate")); b != nil {
+		_, err := getAuthToken(b, auth)
+		return err
+	}
+
+	req, err := http.NewRequest("GET", base, nil)
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth(auth.Username, auth.Password)
+
+	if res, err = http.DefaultClient.Do(req); err != nil {
+		return fmt.Errorf("Request to %s failed with %s", base, err)
+	}
+	res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s status code %d", base, res.StatusCode)
+	}
+	return nil
+}
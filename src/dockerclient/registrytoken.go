@@ -0,0 +1,109 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package dockerclient
+
+import (
+	"sync"
+	"time"
+
+	"github.com/fsouza/go-dockerclient"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	// Token servers that do not tell the lifetime of a token give at least
+	// 60 seconds, see https://docs.docker.com/registry/spec/auth/token/
+	defaultTokenLifetime = 60 * time.Second
+
+	// Tokens are refreshed a bit before they expire, so a request sent with
+	// a cached token does not fail halfway
+	tokenRefreshMargin = 10 * time.Second
+)
+
+type authToken struct {
+	Token   string
+	Expires time.Time
+}
+
+// tokenCache keeps the bearer tokens of registries per realm, service, scope and
+// user, so all pulls and pushes of a build share them instead of asking the token
+// server on every request; some registries rate-limit their token endpoints
+type tokenCache struct {
+	mu     sync.Mutex
+	tokens map[tokenKey]authToken
+
+	// now is time.Now, replaced in tests
+	now func() time.Time
+}
+
+type tokenKey struct {
+	bearer
+	username string
+}
+
+var registryTokens = newTokenCache()
+
+func newTokenCache() *tokenCache {
+	return &tokenCache{
+		tokens: map[tokenKey]authToken{},
+		now:    time.Now,
+	}
+}
+
+// get returns the cached token for the scope unless it is about to expire,
+// in which case a new one is requested with the fetch function
+func (c *tokenCache) get(b *bearer, auth docker.AuthConfiguration, fetch func() (authToken, error)) (string, error) {
+	key := tokenKey{*b, auth.Username}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if t, ok := c.tokens[key]; ok && c.now().Add(tokenRefreshMargin).Before(t.Expires) {
+		log.Debugf("Using cached auth token for %s %s", b.Service, b.Scope)
+		return t.Token, nil
+	}
+
+	t, err := fetch()
+	if err != nil {
+		return "", err
+	}
+	c.tokens[key] = t
+
+	return t.Token, nil
+}
+
+// invalidate forgets the token of the scope, e.g. when the registry rejected it
+func (c *tokenCache) invalidate(b *bearer, auth docker.AuthConfiguration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.tokens, tokenKey{*b, auth.Username})
+}
+
+// tokenExpires tells when a token issued by the token server expires; the
+// lifetime is counted from the issue time if the server tells it
+func tokenExpires(expiresIn int, issuedAt time.Time, now time.Time) time.Time {
+	lifetime := defaultTokenLifetime
+	if expiresIn > 0 {
+		lifetime = time.Duration(expiresIn) * time.Second
+	}
+	if issuedAt.IsZero() || issuedAt.After(now) {
+		issuedAt = now
+	}
+	return issuedAt.Add(lifetime)
+}
@@ -0,0 +1,109 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package dockerclient
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/fsouza/go-dockerclient"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTokenCache_Refresh(t *testing.T) {
+	now := time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)
+	c := newTokenCache()
+	c.now = func() time.Time { return now }
+
+	calls := 0
+	fetch := func() (authToken, error) {
+		calls++
+		return authToken{Token: fmt.Sprintf("token%d", calls), Expires: now.Add(time.Minute)}, nil
+	}
+
+	b := &bearer{Realm: "https://auth", Service: "registry", Scope: "repository:app:pull"}
+	auth := docker.AuthConfiguration{Username: "user"}
+
+	token, _ := c.get(b, auth, fetch)
+	assert.Equal(t, "token1", token)
+	token, _ = c.get(b, auth, fetch)
+	assert.Equal(t, "token1", token)
+
+	// another scope or user gets its own token
+	c.get(&bearer{Realm: "https://auth", Service: "registry", Scope: "repository:app:push,pull"}, auth, fetch)
+	c.get(b, docker.AuthConfiguration{Username: "other"}, fetch)
+	assert.Equal(t, 3, calls)
+
+	// refreshed before it expires
+	now = now.Add(55 * time.Second)
+	token, _ = c.get(b, auth, fetch)
+	assert.Equal(t, "token4", token)
+
+	c.invalidate(b, auth)
+	token, _ = c.get(b, auth, fetch)
+	assert.Equal(t, "token5", token)
+}
+
+func TestTokenExpires(t *testing.T) {
+	now := time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	assert.Equal(t, now.Add(time.Minute), tokenExpires(0, time.Time{}, now))
+	assert.Equal(t, now.Add(time.Hour), tokenExpires(3600, time.Time{}, now))
+	assert.Equal(t, now.Add(50*time.Minute), tokenExpires(3600, now.Add(-10*time.Minute), now))
+	// clock skew of the token server
+	assert.Equal(t, now.Add(time.Hour), tokenExpires(3600, now.Add(time.Hour), now))
+}
+
+func TestRegistryGet_CachesToken(t *testing.T) {
+	registryTokens = newTokenCache()
+	defer func() { registryTokens = newTokenCache() }()
+
+	var (
+		tokenCalls int
+		server     *httptest.Server
+	)
+
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/token":
+			tokenCalls++
+			fmt.Fprintf(w, `{"token":"token%d","expires_in":300}`, tokenCalls)
+		default:
+			// the first token is revoked
+			if auth := r.Header.Get("Authorization"); auth == "" || auth == "Bearer token1" {
+				w.Header().Set("Www-Authenticate", fmt.Sprintf(`Bearer realm="%s/token",service="test",scope="repository:app:pull"`, server.URL))
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			fmt.Fprint(w, `{"name":"app","tags":["1"]}`)
+		}
+	}))
+	defer server.Close()
+
+	for i := 0; i < 3; i++ {
+		tg := tags{}
+		if err := registryGet(server.URL+"/v2/app/tags/list", docker.AuthConfiguration{}, &tg); err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, []string{"1"}, tg.Tags)
+	}
+
+	assert.Equal(t, 2, tokenCalls)
+}
@@ -0,0 +1,90 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package dockerclient
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/fsouza/go-dockerclient"
+)
+
+// PodmanEngine is the component Podman reports in the version of its docker API
+const PodmanEngine = "Podman Engine"
+
+// runtimeDir is the directory of the sockets of the daemons that run as the user
+func runtimeDir() string {
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" {
+		return dir
+	}
+	return fmt.Sprintf("/run/user/%d", os.Getuid())
+}
+
+// Endpoints returns the sockets where a daemon is looked for when no host is
+// given, in order: docker, rootless docker, rootless Podman and Podman
+func Endpoints() []string {
+	return []string{
+		DefaultEndpoint,
+		"unix://" + filepath.Join(runtimeDir(), "docker.sock"),
+		"unix://" + filepath.Join(runtimeDir(), "podman", "podman.sock"),
+		"unix:///run/podman/podman.sock",
+	}
+}
+
+// DiscoverEndpoint returns the first of Endpoints whose socket exists,
+// DefaultEndpoint if none does
+func DiscoverEndpoint() string {
+	for _, endpoint := range Endpoints() {
+		if _, err := os.Stat(strings.TrimPrefix(endpoint, "unix://")); err == nil {
+			return endpoint
+		}
+	}
+	return DefaultEndpoint
+}
+
+// IsRootless tells if the host is the socket of a daemon that runs as a user
+// rather than root: the rootless docker and Podman keep it in the runtime
+// directory of the user
+func IsRootless(host string) bool {
+	u, err := url.Parse(host)
+	if err != nil || u.Scheme != "unix" {
+		return false
+	}
+	for _, dir := range []string{runtimeDir(), "/run/user/"} {
+		if strings.HasPrefix(u.Path, strings.TrimSuffix(dir, "/")+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// isPodman tells if the version is the one of the docker API of Podman
+func isPodman(env *docker.Env) bool {
+	components := []struct{ Name string }{}
+	if err := env.GetJSON("Components", &components); err != nil {
+		return false
+	}
+	for _, c := range components {
+		if c.Name == PodmanEngine {
+			return true
+		}
+	}
+	return false
+}
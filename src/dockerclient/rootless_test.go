@@ -0,0 +1,78 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package dockerclient
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/fsouza/go-dockerclient"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIsRootless(t *testing.T) {
+	defer os.Setenv("XDG_RUNTIME_DIR", os.Getenv("XDG_RUNTIME_DIR"))
+	os.Setenv("XDG_RUNTIME_DIR", "/tmp/runtime-me")
+
+	assert.True(t, IsRootless("unix:///tmp/runtime-me/docker.sock"))
+	assert.True(t, IsRootless("unix:///run/user/1000/podman/podman.sock"))
+	assert.False(t, IsRootless("unix:///var/run/docker.sock"))
+	assert.False(t, IsRootless("unix:///run/podman/podman.sock"))
+	assert.False(t, IsRootless("tcp://127.0.0.1:2375"))
+}
+
+func TestDiscoverEndpoint(t *testing.T) {
+	if _, err := os.Stat("/var/run/docker.sock"); err == nil {
+		t.Skip("docker listens on the default socket")
+	}
+
+	tmpDir, err := ioutil.TempDir("", "rocker-rootless-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	defer os.Setenv("XDG_RUNTIME_DIR", os.Getenv("XDG_RUNTIME_DIR"))
+	os.Setenv("XDG_RUNTIME_DIR", tmpDir)
+
+	if _, err := os.Stat("/run/podman/podman.sock"); err != nil {
+		assert.Equal(t, DefaultEndpoint, DiscoverEndpoint())
+	}
+
+	socket := filepath.Join(tmpDir, "podman", "podman.sock")
+	if err := os.MkdirAll(filepath.Dir(socket), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(socket, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "unix://"+socket, DiscoverEndpoint())
+}
+
+func TestIsPodman(t *testing.T) {
+	env := &docker.Env{}
+	env.Set("Version", "4.9.3")
+	env.Set("Components", `[{"Name":"Podman Engine","Version":"4.9.3"}]`)
+	assert.True(t, isPodman(env))
+
+	env.Set("Components", `[{"Name":"Engine","Version":"24.0.7"}]`)
+	assert.False(t, isPodman(env))
+
+	assert.False(t, isPodman(&docker.Env{}))
+}
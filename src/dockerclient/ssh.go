@@ -0,0 +1,208 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package dockerclient
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// sshTunnels are the tunnels to the ssh:// hosts, one per host
+var (
+	sshTunnels   = map[string]*sshTunnel{}
+	sshTunnelsMu sync.Mutex
+)
+
+// sshTunnel serves a local unix socket and forwards every connection to it
+// to the docker daemon of a remote host through `ssh host docker system dial-stdio`,
+// the way the docker CLI connects to ssh:// hosts. The client library can only
+// talk to unix sockets and TCP, so it is given the socket of the tunnel
+type sshTunnel struct {
+	dir      string
+	listener net.Listener
+	command  []string
+
+	mu      sync.Mutex
+	lastErr string
+}
+
+// sshTunnelFor returns the tunnel to the ssh:// host, starting it once
+func sshTunnelFor(host string) (*sshTunnel, error) {
+	sshTunnelsMu.Lock()
+	defer sshTunnelsMu.Unlock()
+
+	if t, ok := sshTunnels[host]; ok {
+		return t, nil
+	}
+
+	args, err := sshArgs(host)
+	if err != nil {
+		return nil, err
+	}
+
+	t, err := newSSHTunnel(append([]string{"ssh"}, args...))
+	if err != nil {
+		return nil, err
+	}
+	sshTunnels[host] = t
+
+	return t, nil
+}
+
+// CloseSSHTunnels stops the tunnels to the ssh:// hosts and removes their sockets
+func CloseSSHTunnels() {
+	sshTunnelsMu.Lock()
+	defer sshTunnelsMu.Unlock()
+
+	for host, t := range sshTunnels {
+		t.Close()
+		delete(sshTunnels, host)
+	}
+}
+
+// sshArgs makes the arguments of ssh for ssh://[user@]host[:port]
+func sshArgs(host string) ([]string, error) {
+	u, err := url.Parse(host)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid docker host %q, error: %s", host, err)
+	}
+	if u.Scheme != "ssh" || u.Hostname() == "" {
+		return nil, fmt.Errorf("Invalid docker host %q, expected ssh://[user@]host[:port]", host)
+	}
+	if u.Path != "" && u.Path != "/" || u.RawQuery != "" {
+		return nil, fmt.Errorf("Invalid docker host %q, ssh:// hosts cannot have a path or parameters", host)
+	}
+	if _, hasPassword := u.User.Password(); hasPassword {
+		return nil, fmt.Errorf("Invalid docker host %q, passwords are not supported, use ssh keys", host)
+	}
+
+	args := []string{}
+	if user := u.User.Username(); user != "" {
+		args = append(args, "-l", user)
+	}
+	if port := u.Port(); port != "" {
+		args = append(args, "-p", port)
+	}
+	args = append(args, "--", u.Hostname(), "docker", "system", "dial-stdio")
+
+	return args, nil
+}
+
+// newSSHTunnel listens on a socket in a temporary directory and runs the command
+// for every connection, with the connection as its stdin and stdout
+func newSSHTunnel(command []string) (*sshTunnel, error) {
+	dir, err := ioutil.TempDir("", "rocker-ssh-")
+	if err != nil {
+		return nil, fmt.Errorf("Failed to make a directory for the ssh tunnel, error: %s", err)
+	}
+
+	listener, err := net.Listen("unix", filepath.Join(dir, "docker.sock"))
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, fmt.Errorf("Failed to listen for the ssh tunnel, error: %s", err)
+	}
+
+	t := &sshTunnel{dir: dir, listener: listener, command: command}
+	go t.serve()
+
+	return t, nil
+}
+
+// Endpoint is the address to give to the client library
+func (t *sshTunnel) Endpoint() string {
+	return "unix://" + t.listener.Addr().String()
+}
+
+// Close stops accepting connections and removes the socket; the connections
+// that are open end with their clients
+func (t *sshTunnel) Close() error {
+	err := t.listener.Close()
+	os.RemoveAll(t.dir)
+	return err
+}
+
+// LastError returns what the last failed ssh command printed, to explain
+// why the daemon cannot be reached
+func (t *sshTunnel) LastError() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.lastErr
+}
+
+func (t *sshTunnel) serve() {
+	for {
+		conn, err := t.listener.Accept()
+		if err != nil {
+			return
+		}
+		go t.forward(conn)
+	}
+}
+
+func (t *sshTunnel) forward(conn net.Conn) {
+	defer conn.Close()
+
+	var stderr bytes.Buffer
+
+	cmd := exec.Command(t.command[0], t.command[1:]...)
+	cmd.Stderr = &stderr
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		t.setError(err.Error())
+		return
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		t.setError(err.Error())
+		return
+	}
+	if err := cmd.Start(); err != nil {
+		t.setError(err.Error())
+		return
+	}
+
+	go func() {
+		io.Copy(stdin, conn)
+		stdin.Close()
+	}()
+	io.Copy(conn, stdout)
+
+	// The connection is closed by the deferred call, which ends the copy to stdin
+	if err := cmd.Wait(); err != nil {
+		msg := strings.TrimSpace(stderr.String())
+		if msg == "" {
+			msg = err.Error()
+		}
+		t.setError(msg)
+	}
+}
+
+func (t *sshTunnel) setError(msg string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.lastErr = msg
+}
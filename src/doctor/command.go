@@ -0,0 +1,105 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package doctor
+
+import (
+	"os"
+	"runtime"
+	"strings"
+
+	"github.com/grammarly/rocker/src/build"
+	"github.com/grammarly/rocker/src/cliutil"
+	"github.com/grammarly/rocker/src/dockerclient"
+	"github.com/grammarly/rocker/src/util"
+
+	"github.com/codegangsta/cli"
+)
+
+// CommandSpec returns specifications of the doctor command for codegangsta/cli
+func CommandSpec() cli.Command {
+	return cli.Command{
+		Name:   "doctor",
+		Usage:  "checks the docker daemon, disk space, emulation, registry credentials and the cache before a build",
+		Action: doctorCommand,
+		Flags: []cli.Flag{
+			cli.StringFlag{
+				Name:  "auth, a",
+				Value: "",
+				Usage: "Username and password in user:password format",
+			},
+			cli.StringFlag{
+				Name:  "cache-dir",
+				Value: "~/.rocker_cache",
+				Usage: "Set the directory where the cache will be stored",
+			},
+			cli.IntFlag{
+				Name:  "min-free-gb",
+				Value: 10,
+				Usage: "warn if there is less free disk space, in gigabytes",
+			},
+		},
+	}
+}
+
+// doctorCommand implements 'doctor' command that runs the checks and prints the results
+func doctorCommand(c *cli.Context) {
+	var (
+		results = []Result{}
+		minFree = uint64(c.Int("min-free-gb")) << 30
+		config  = dockerclient.NewConfigFromCli(c)
+	)
+
+	dockerClient, err := dockerclient.NewFromConfig(config)
+	if err != nil {
+		results = append(results, Result{
+			Check:   "docker daemon",
+			Status:  Failure,
+			Message: err.Error(),
+			Fix:     "check --host, DOCKER_HOST and the --tls* options",
+		})
+	} else {
+		daemon := CheckDaemon(dockerClient)
+		results = append(results, daemon)
+		if daemon.Status != Failure {
+			results = append(results, CheckDaemonFeatures(dockerClient))
+		}
+
+		// The daemon storage can be checked only if the daemon runs on this machine
+		if daemon.Status != Failure && strings.HasPrefix(config.Host, "unix://") {
+			if info, err := dockerClient.Info(); err == nil && info.DockerRootDir != "" {
+				results = append(results, CheckDiskSpace("docker", info.DockerRootDir, minFree))
+			}
+		}
+	}
+
+	cacheDir, err := util.MakeAbsolute(c.String("cache-dir"))
+	if err != nil {
+		cliutil.Exit(build.WithExitCode(build.ExitUser, err))
+	}
+	results = append(results, CheckCacheDir(cacheDir))
+	results = append(results, CheckDiskSpace("cache", cacheDir, minFree))
+
+	if runtime.GOOS == "linux" {
+		results = append(results, CheckBinfmt("/proc/sys/fs/binfmt_misc"))
+	}
+
+	results = append(results, CheckRegistryAuth(cliutil.InitAuth(c), dockerclient.RegistryCheckAuth)...)
+
+	if Print(os.Stdout, results) {
+		os.Exit(1)
+	}
+}
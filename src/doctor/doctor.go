@@ -0,0 +1,269 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package doctor checks the environment before a build, so problems with the
+// docker daemon, disk space or credentials show up before a long build fails halfway
+package doctor
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/grammarly/rocker/src/dockerclient"
+
+	"github.com/fsouza/go-dockerclient"
+)
+
+// MinAPIVersion is the oldest docker remote API rocker works with
+const MinAPIVersion = dockerclient.MinAPIVersion
+
+// Status is the outcome of a check
+type Status int
+
+// Outcomes of the checks, in the order of severity
+const (
+	OK Status = iota
+	Warning
+	Failure
+)
+
+// String returns the label the status is printed with
+func (s Status) String() string {
+	switch s {
+	case OK:
+		return "ok"
+	case Warning:
+		return "warn"
+	}
+	return "FAIL"
+}
+
+// Result is the outcome of a single check along with the suggested fix
+type Result struct {
+	Check   string
+	Status  Status
+	Message string
+	Fix     string
+}
+
+// DockerAPI is the part of the docker client the checks need
+type DockerAPI interface {
+	Version() (*docker.Env, error)
+	Info() (*docker.DockerInfo, error)
+}
+
+// AuthChecker verifies the credentials against the registry
+type AuthChecker func(registry string, auth docker.AuthConfiguration) error
+
+// Print writes the results and returns true if any of the checks failed
+func Print(w io.Writer, results []Result) (failed bool) {
+	for _, r := range results {
+		fmt.Fprintf(w, "[%-4s] %s: %s\n", r.Status, r.Check, r.Message)
+		if r.Status != OK && r.Fix != "" {
+			fmt.Fprintf(w, "       fix: %s\n", r.Fix)
+		}
+		if r.Status == Failure {
+			failed = true
+		}
+	}
+	return failed
+}
+
+// CheckDaemon makes sure the docker daemon is reachable and recent enough
+func CheckDaemon(client DockerAPI) Result {
+	r := Result{Check: "docker daemon"}
+
+	env, err := client.Version()
+	if err != nil {
+		r.Status = Failure
+		r.Message = fmt.Sprintf("not reachable, %s", err)
+		r.Fix = "start the docker daemon or point rocker to it with --host, DOCKER_HOST and the --tls* options"
+		return r
+	}
+
+	version, apiVersion := env.Get("Version"), env.Get("ApiVersion")
+	r.Message = fmt.Sprintf("version %s, API %s", version, apiVersion)
+
+	have, err := docker.NewAPIVersion(apiVersion)
+	if err != nil {
+		r.Status = Warning
+		r.Message = fmt.Sprintf("cannot parse the API version %q", apiVersion)
+		return r
+	}
+
+	min, _ := docker.NewAPIVersion(MinAPIVersion)
+	if have.LessThan(min) {
+		r.Status = Failure
+		r.Fix = fmt.Sprintf("upgrade docker, rocker needs the remote API %s or newer", MinAPIVersion)
+	}
+
+	return r
+}
+
+// CheckDaemonFeatures warns about the Rockerfile instructions that the daemon
+// is too old to support
+func CheckDaemonFeatures(client DockerAPI) Result {
+	r := Result{Check: "docker features"}
+
+	caps, err := dockerclient.Negotiate(client)
+	if err != nil {
+		r.Status = Failure
+		r.Message = err.Error()
+		return r
+	}
+
+	missing := caps.Missing()
+	if len(missing) == 0 {
+		r.Message = fmt.Sprintf("all supported, rocker speaks the remote API %s", caps.APIVersion)
+		return r
+	}
+
+	names := []string{}
+	for _, capability := range missing {
+		names = append(names, fmt.Sprintf("%s (API %s)", capability.Name, capability.APIVersion))
+	}
+
+	r.Status = Warning
+	r.Message = fmt.Sprintf("API %s does not support %s", caps.APIVersion, strings.Join(names, ", "))
+	r.Fix = "upgrade docker to use these instructions"
+	return r
+}
+
+// CheckDiskSpace warns if the filesystem of the path has less than minFree bytes available
+func CheckDiskSpace(name, path string, minFree uint64) Result {
+	r := Result{Check: "disk space (" + name + ")"}
+
+	free, err := freeSpace(path)
+	if err != nil {
+		r.Status = Warning
+		r.Message = fmt.Sprintf("cannot check %s, %s", path, err)
+		return r
+	}
+
+	r.Message = fmt.Sprintf("%s free in %s", humanSize(free), path)
+	if free < minFree {
+		r.Status = Warning
+		r.Fix = fmt.Sprintf("free some space in %s, e.g. remove unused images and containers; at least %s is recommended", path, humanSize(minFree))
+	}
+
+	return r
+}
+
+// CheckBinfmt tells which foreign architectures can be built for through binfmt_misc and qemu
+func CheckBinfmt(dir string) Result {
+	r := Result{Check: "cross-platform emulation"}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil && !os.IsNotExist(err) {
+		r.Status = Warning
+		r.Message = fmt.Sprintf("cannot read %s, %s", dir, err)
+		return r
+	}
+
+	arches := []string{}
+	for _, f := range files {
+		if strings.HasPrefix(f.Name(), "qemu-") {
+			arches = append(arches, strings.TrimPrefix(f.Name(), "qemu-"))
+		}
+	}
+	sort.Strings(arches)
+
+	if len(arches) == 0 {
+		r.Status = Warning
+		r.Message = "no qemu handlers registered, only images of the native platform can be run"
+		r.Fix = "docker run --privileged --rm tonistiigi/binfmt --install all"
+		return r
+	}
+
+	r.Message = "qemu handlers for " + strings.Join(arches, ", ")
+	return r
+}
+
+// CheckRegistryAuth verifies every set of credentials known to rocker
+func CheckRegistryAuth(auth *docker.AuthConfigurations, check AuthChecker) (results []Result) {
+	if auth == nil || len(auth.Configs) == 0 {
+		return []Result{{
+			Check:   "registry auth",
+			Status:  OK,
+			Message: "no credentials configured, only public images can be pulled",
+		}}
+	}
+
+	registries := []string{}
+	for registry := range auth.Configs {
+		registries = append(registries, registry)
+	}
+	sort.Strings(registries)
+
+	for _, registry := range registries {
+		host := registryHost(registry)
+		r := Result{Check: "registry auth (" + host + ")"}
+
+		if err := check(host, auth.Configs[registry]); err != nil {
+			r.Status = Failure
+			r.Message = err.Error()
+			r.Fix = fmt.Sprintf("docker login %s, or pass the right credentials with --auth", host)
+		} else {
+			r.Message = "credentials accepted"
+		}
+
+		results = append(results, r)
+	}
+
+	return results
+}
+
+// CheckCacheDir makes sure the cache directory can be created and written to
+func CheckCacheDir(dir string) Result {
+	r := Result{Check: "cache", Message: dir}
+
+	fix := fmt.Sprintf("make %s writable for the current user or pick another one with --cache-dir", dir)
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		r.Status, r.Message, r.Fix = Failure, err.Error(), fix
+		return r
+	}
+
+	f, err := ioutil.TempFile(dir, ".doctor")
+	if err != nil {
+		r.Status, r.Message, r.Fix = Failure, err.Error(), fix
+		return r
+	}
+	f.Close()
+	os.Remove(f.Name())
+
+	return r
+}
+
+// registryHost turns the key of the docker auth config, which may be an URL, into the registry host
+func registryHost(key string) string {
+	host := strings.TrimPrefix(strings.TrimPrefix(key, "https://"), "http://")
+	return strings.SplitN(host, "/", 2)[0]
+}
+
+func humanSize(size uint64) string {
+	units := []string{"B", "KB", "MB", "GB", "TB"}
+	f, i := float64(size), 0
+	for f >= 1024 && i < len(units)-1 {
+		f /= 1024
+		i++
+	}
+	return fmt.Sprintf("%.1f %s", f, units[i])
+}
@@ -0,0 +1,142 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package doctor
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/fsouza/go-dockerclient"
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeDocker struct {
+	version docker.Env
+	err     error
+}
+
+func (f *fakeDocker) Version() (*docker.Env, error) {
+	return &f.version, f.err
+}
+
+func (f *fakeDocker) Info() (*docker.DockerInfo, error) {
+	return &docker.DockerInfo{}, f.err
+}
+
+func TestCheckDaemon(t *testing.T) {
+	r := CheckDaemon(&fakeDocker{version: docker.Env{"Version=1.12.1", "ApiVersion=1.24"}})
+	assert.Equal(t, OK, r.Status)
+	assert.Equal(t, "version 1.12.1, API 1.24", r.Message)
+
+	r = CheckDaemon(&fakeDocker{version: docker.Env{"Version=1.8.3", "ApiVersion=1.20"}})
+	assert.Equal(t, Failure, r.Status)
+	assert.Contains(t, r.Fix, "upgrade docker")
+
+	r = CheckDaemon(&fakeDocker{err: fmt.Errorf("connection refused")})
+	assert.Equal(t, Failure, r.Status)
+	assert.Equal(t, "not reachable, connection refused", r.Message)
+}
+
+func TestCheckDaemonFeatures(t *testing.T) {
+	r := CheckDaemonFeatures(&fakeDocker{version: docker.Env{"Version=17.06.0", "ApiVersion=1.30"}})
+	assert.Equal(t, OK, r.Status)
+
+	r = CheckDaemonFeatures(&fakeDocker{version: docker.Env{"Version=1.12.1", "ApiVersion=1.24"}})
+	assert.Equal(t, Warning, r.Status)
+	assert.Equal(t, "API 1.24 does not support HEALTHCHECK --start-period (API 1.29), SHELL (API 1.25)", r.Message)
+}
+
+func TestCheckBinfmt(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rocker-doctor-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	r := CheckBinfmt(dir)
+	assert.Equal(t, Warning, r.Status)
+	assert.Contains(t, r.Fix, "binfmt")
+
+	for _, name := range []string{"register", "status", "qemu-arm", "qemu-aarch64"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	r = CheckBinfmt(dir)
+	assert.Equal(t, OK, r.Status)
+	assert.Equal(t, "qemu handlers for aarch64, arm", r.Message)
+}
+
+func TestCheckRegistryAuth(t *testing.T) {
+	auth := &docker.AuthConfigurations{
+		Configs: map[string]docker.AuthConfiguration{
+			"https://index.docker.io/v1/": {Username: "good"},
+			"quay.io":                     {Username: "bad"},
+		},
+	}
+
+	checked := []string{}
+	results := CheckRegistryAuth(auth, func(registry string, auth docker.AuthConfiguration) error {
+		checked = append(checked, registry)
+		if auth.Username == "bad" {
+			return fmt.Errorf("GET status code 401")
+		}
+		return nil
+	})
+
+	assert.Equal(t, []string{"index.docker.io", "quay.io"}, checked)
+	assert.Equal(t, OK, results[0].Status)
+	assert.Equal(t, Failure, results[1].Status)
+	assert.Equal(t, "docker login quay.io, or pass the right credentials with --auth", results[1].Fix)
+
+	results = CheckRegistryAuth(nil, nil)
+	assert.Len(t, results, 1)
+	assert.Equal(t, OK, results[0].Status)
+}
+
+func TestCheckCacheDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rocker-doctor-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	r := CheckCacheDir(filepath.Join(dir, "cache"))
+	assert.Equal(t, OK, r.Status)
+
+	files, _ := ioutil.ReadDir(filepath.Join(dir, "cache"))
+	assert.Len(t, files, 0)
+}
+
+func TestPrint(t *testing.T) {
+	buf := &bytes.Buffer{}
+
+	failed := Print(buf, []Result{
+		{Check: "docker daemon", Message: "version 1.12.1, API 1.24"},
+		{Check: "cache", Status: Failure, Message: "permission denied", Fix: "make it writable"},
+	})
+
+	assert.True(t, failed)
+	assert.Equal(t, "[ok  ] docker daemon: version 1.12.1, API 1.24\n"+
+		"[FAIL] cache: permission denied\n"+
+		"       fix: make it writable\n", buf.String())
+}
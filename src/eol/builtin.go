@@ -0,0 +1,51 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package eol
+
+// Builtin are the windows rocker knows without --eol-data: the end of the
+// standard support of the releases of the common base images
+var Builtin = []Window{
+	{Image: "ubuntu", Tags: []string{"14.04", "trusty"}, EOL: "2019-04-30", Replacement: "ubuntu:24.04"},
+	{Image: "ubuntu", Tags: []string{"16.04", "xenial"}, EOL: "2021-04-30", Replacement: "ubuntu:24.04"},
+	{Image: "ubuntu", Tags: []string{"18.04", "bionic"}, EOL: "2023-05-31", Replacement: "ubuntu:24.04"},
+	{Image: "ubuntu", Tags: []string{"20.04", "focal"}, EOL: "2025-05-31", Replacement: "ubuntu:24.04"},
+	{Image: "ubuntu", Tags: []string{"22.04", "jammy"}, EOL: "2027-06-01", Replacement: "ubuntu:24.04"},
+	{Image: "ubuntu", Tags: []string{"24.04", "noble"}, EOL: "2029-05-31"},
+
+	{Image: "debian", Tags: []string{"8", "jessie"}, EOL: "2020-06-30", Replacement: "debian:bookworm"},
+	{Image: "debian", Tags: []string{"9", "stretch"}, EOL: "2022-06-30", Replacement: "debian:bookworm"},
+	{Image: "debian", Tags: []string{"10", "buster"}, EOL: "2024-06-30", Replacement: "debian:bookworm"},
+	{Image: "debian", Tags: []string{"11", "bullseye"}, EOL: "2026-08-31", Replacement: "debian:bookworm"},
+	{Image: "debian", Tags: []string{"12", "bookworm"}, EOL: "2028-06-30"},
+
+	{Image: "alpine", Tags: []string{"3.12"}, EOL: "2022-05-01", Replacement: "alpine:3.22"},
+	{Image: "alpine", Tags: []string{"3.13"}, EOL: "2022-11-01", Replacement: "alpine:3.22"},
+	{Image: "alpine", Tags: []string{"3.14"}, EOL: "2023-05-01", Replacement: "alpine:3.22"},
+	{Image: "alpine", Tags: []string{"3.15"}, EOL: "2023-11-01", Replacement: "alpine:3.22"},
+	{Image: "alpine", Tags: []string{"3.16"}, EOL: "2024-05-23", Replacement: "alpine:3.22"},
+	{Image: "alpine", Tags: []string{"3.17"}, EOL: "2024-11-22", Replacement: "alpine:3.22"},
+	{Image: "alpine", Tags: []string{"3.18"}, EOL: "2025-05-09", Replacement: "alpine:3.22"},
+	{Image: "alpine", Tags: []string{"3.19"}, EOL: "2025-11-01", Replacement: "alpine:3.22"},
+	{Image: "alpine", Tags: []string{"3.20"}, EOL: "2026-04-01", Replacement: "alpine:3.22"},
+	{Image: "alpine", Tags: []string{"3.21"}, EOL: "2026-11-01", Replacement: "alpine:3.22"},
+	{Image: "alpine", Tags: []string{"3.22"}, EOL: "2027-05-01"},
+
+	{Image: "centos", Tags: []string{"6", "centos6"}, EOL: "2020-11-30", Replacement: "rockylinux:9"},
+	{Image: "centos", Tags: []string{"7", "centos7"}, EOL: "2024-06-30", Replacement: "rockylinux:9"},
+	{Image: "centos", Tags: []string{"8", "centos8"}, EOL: "2021-12-31", Replacement: "rockylinux:9"},
+	{Image: "centos", Tags: []string{"latest"}, Deprecated: "the centos image is not maintained anymore", Replacement: "rockylinux:9"},
+}
@@ -0,0 +1,238 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package eol knows the support windows of the popular base images, such as the
+// releases of debian, ubuntu and alpine, and tells when the FROM image of a build
+// reached its end of life, is about to, or uses a deprecated tag
+package eol
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/grammarly/rocker/src/imagename"
+
+	"github.com/go-yaml/yaml"
+)
+
+// DefaultWarnBefore is how long before the end of life a base image is reported
+const DefaultWarnBefore = 90 * 24 * time.Hour
+
+// The statuses of a warning
+const (
+	StatusEOL        = "eol"
+	StatusSoon       = "soon"
+	StatusDeprecated = "deprecated"
+)
+
+// Window is the support window of the tags of an image. EOL is the date the
+// support ends, in the form 2006-01-02; Deprecated is the message of a tag that
+// should not be used anymore, whether it has the end of life or not
+type Window struct {
+	Image       string   `yaml:"image" json:"image"`
+	Tags        []string `yaml:"tags" json:"tags"`
+	EOL         string   `yaml:"eol,omitempty" json:"eol,omitempty"`
+	Deprecated  string   `yaml:"deprecated,omitempty" json:"deprecated,omitempty"`
+	Replacement string   `yaml:"replacement,omitempty" json:"replacement,omitempty"`
+}
+
+// Warning is what Check finds about an image
+type Warning struct {
+	Image       string `json:"image"`
+	Status      string `json:"status"`
+	EOL         string `json:"eol,omitempty"`
+	DaysLeft    int    `json:"days_left"`
+	Message     string `json:"message,omitempty"`
+	Replacement string `json:"replacement,omitempty"`
+}
+
+// String returns the human readable representation of the warning
+func (w Warning) String() string {
+	var msg string
+	switch w.Status {
+	case StatusEOL:
+		msg = fmt.Sprintf("Base image %s reached its end of life on %s", w.Image, w.EOL)
+	case StatusSoon:
+		msg = fmt.Sprintf("Base image %s reaches its end of life on %s, in %d days", w.Image, w.EOL, w.DaysLeft)
+	default:
+		msg = fmt.Sprintf("Base image %s is deprecated", w.Image)
+	}
+	if w.Message != "" {
+		msg += ": " + w.Message
+	}
+	if w.Replacement != "" {
+		msg += fmt.Sprintf(", consider %s", w.Replacement)
+	}
+	return msg
+}
+
+// Checker finds the windows of the images; the windows of the sources given
+// first take precedence over the later ones and over the builtin ones
+type Checker struct {
+	Windows    []Window
+	WarnBefore time.Duration
+
+	now func() time.Time
+}
+
+// New makes a Checker of the builtin windows and of the given sources, which
+// are files or http(s) urls of YAML or JSON lists of windows
+func New(sources []string, warnBefore time.Duration) (*Checker, error) {
+	c := &Checker{
+		WarnBefore: warnBefore,
+		now:        time.Now,
+	}
+
+	for _, source := range sources {
+		windows, err := Load(source)
+		if err != nil {
+			return nil, err
+		}
+		c.Windows = append(c.Windows, windows...)
+	}
+	c.Windows = append(c.Windows, Builtin...)
+
+	return c, nil
+}
+
+// Load reads the windows from a file or an http(s) url
+func Load(source string) ([]Window, error) {
+	var (
+		content []byte
+		err     error
+	)
+
+	if strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://") {
+		content, err = fetch(source)
+	} else {
+		content, err = ioutil.ReadFile(source)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read EOL data %s, error: %s", source, err)
+	}
+
+	windows := []Window{}
+	if err := yaml.Unmarshal(content, &windows); err != nil {
+		return nil, fmt.Errorf("Failed to parse EOL data %s, error: %s", source, err)
+	}
+
+	for _, w := range windows {
+		if w.Image == "" || len(w.Tags) == 0 {
+			return nil, fmt.Errorf("EOL data %s: every entry needs image and tags", source)
+		}
+		if w.EOL == "" && w.Deprecated == "" {
+			return nil, fmt.Errorf("EOL data %s: %s needs eol or deprecated", source, w.Image)
+		}
+		if _, err := w.eol(); err != nil {
+			return nil, fmt.Errorf("EOL data %s: %s", source, err)
+		}
+	}
+
+	return windows, nil
+}
+
+func fetch(url string) ([]byte, error) {
+	client := &http.Client{Timeout: 10 * time.Second}
+
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected response %s", resp.Status)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+// Check returns the warning about the image, nil if its tag is not known to
+// be deprecated or out of support soon
+func (c *Checker) Check(name string) *Warning {
+	img := imagename.NewFromString(name)
+	repo := repository(img.NameWithRegistry())
+	tag := img.GetTag()
+
+	for _, w := range c.Windows {
+		if repository(w.Image) != repo || !w.matches(tag) {
+			continue
+		}
+
+		warning := &Warning{
+			Image:       img.String(),
+			Message:     w.Deprecated,
+			Replacement: w.Replacement,
+		}
+
+		eol, _ := w.eol()
+		if !eol.IsZero() {
+			left := eol.Sub(c.now())
+			warning.EOL = w.EOL
+			warning.DaysLeft = int(left.Hours() / 24)
+
+			switch {
+			case left <= 0:
+				warning.Status = StatusEOL
+				warning.DaysLeft = 0
+			case left <= c.WarnBefore:
+				warning.Status = StatusSoon
+			}
+		}
+
+		if warning.Status == "" && w.Deprecated != "" {
+			warning.Status = StatusDeprecated
+		}
+		if warning.Status == "" {
+			return nil
+		}
+		return warning
+	}
+
+	return nil
+}
+
+// matches tells if the tag is one of the tags of the window, or a variant of
+// it, such as 3.12.4 or 3.12-slim of 3.12
+func (w Window) matches(tag string) bool {
+	for _, t := range w.Tags {
+		if tag == t || strings.HasPrefix(tag, t+".") || strings.HasPrefix(tag, t+"-") {
+			return true
+		}
+	}
+	return false
+}
+
+func (w Window) eol() (time.Time, error) {
+	if w.EOL == "" {
+		return time.Time{}, nil
+	}
+	t, err := time.Parse("2006-01-02", w.EOL)
+	if err != nil {
+		return t, fmt.Errorf("%s: invalid eol %q, expected a date like 2006-01-02", w.Image, w.EOL)
+	}
+	return t, nil
+}
+
+// repository drops the docker hub prefixes, so ubuntu, library/ubuntu and
+// docker.io/library/ubuntu are the same
+func repository(name string) string {
+	name = strings.TrimPrefix(name, "docker.io/")
+	name = strings.TrimPrefix(name, "index.docker.io/")
+	return strings.TrimPrefix(name, "library/")
+}
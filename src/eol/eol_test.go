@@ -0,0 +1,104 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package eol
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestChecker_Check(t *testing.T) {
+	c, err := New(nil, DefaultWarnBefore)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.now = func() time.Time { return time.Date(2026, 10, 16, 0, 0, 0, 0, time.UTC) }
+
+	tests := []struct {
+		image  string
+		status string
+	}{
+		{"ubuntu:16.04", StatusEOL},
+		{"docker.io/library/ubuntu:xenial-20210416", StatusEOL},
+		{"debian:stretch-slim", StatusEOL},
+		{"alpine:3.21.3", StatusSoon},
+		{"alpine:3.22", ""},
+		{"alpine:3.2", ""},
+		{"ubuntu:24.04", ""},
+		{"ubuntu", ""},
+		{"quay.io/me/ubuntu:16.04", ""},
+		{"centos", StatusDeprecated},
+	}
+
+	for _, test := range tests {
+		w := c.Check(test.image)
+		if test.status == "" {
+			assert.Nil(t, w, test.image)
+			continue
+		}
+		if assert.NotNil(t, w, test.image) {
+			assert.Equal(t, test.status, w.Status, test.image)
+		}
+	}
+
+	w := c.Check("alpine:3.21")
+	assert.Equal(t, 16, w.DaysLeft)
+	assert.Equal(t, "Base image alpine:3.21 reaches its end of life on 2026-11-01, in 16 days, consider alpine:3.22", w.String())
+}
+
+func TestLoad(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "rocker-eol-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	file := filepath.Join(tmpDir, "eol.yml")
+	content := "- image: quay.io/me/base\n  tags: [\"1\"]\n  deprecated: use 2\n- image: ubuntu\n  tags: [\"24.04\"]\n  eol: 2026-01-01\n"
+	if err := ioutil.WriteFile(file, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `[{"image": "node", "tags": ["10"], "eol": "2021-04-30"}]`)
+	}))
+	defer ts.Close()
+
+	c, err := New([]string{file, ts.URL}, DefaultWarnBefore)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the given windows take precedence over the builtin ones
+	assert.Equal(t, StatusEOL, c.Check("ubuntu:24.04").Status)
+	assert.Equal(t, StatusDeprecated, c.Check("quay.io/me/base:1.4").Status)
+	assert.Equal(t, StatusEOL, c.Check("node:10-alpine").Status)
+
+	if err := ioutil.WriteFile(file, []byte("- image: ubuntu\n  tags: [\"24.04\"]\n  eol: soon\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	_, err = Load(file)
+	assert.Contains(t, err.Error(), "invalid eol \"soon\"")
+}
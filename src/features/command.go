@@ -0,0 +1,42 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package features
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/codegangsta/cli"
+)
+
+// CommandSpec returns specifications of the features command for codegangsta/cli;
+// enabled is read when the command runs, after the flags are parsed
+func CommandSpec(enabled *Set) cli.Command {
+	return cli.Command{
+		Name:  "features",
+		Usage: "lists the optional features, their stability and whether they are enabled",
+		Action: func(c *cli.Context) {
+			w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+			fmt.Fprintln(w, "NAME\tSTABILITY\tENABLED\tDESCRIPTION")
+			for _, f := range All() {
+				fmt.Fprintf(w, "%s\t%s\t%t\t%s\n", f.Name, f.Stability, enabled.Enabled(f.Name), f.Description)
+			}
+			w.Flush()
+		},
+	}
+}
@@ -0,0 +1,145 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package features keeps the registry of the optional rocker subsystems, so new
+// ones can ship disabled and be turned on with --enable-feature, ROCKER_FEATURES
+// or the features config file
+package features
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// Stability tells how much a feature can be relied on
+type Stability string
+
+// Stability levels, a feature goes from experimental to stable and may be deprecated later
+const (
+	Experimental Stability = "experimental"
+	Beta         Stability = "beta"
+	Stable       Stability = "stable"
+	Deprecated   Stability = "deprecated"
+)
+
+// Feature describes an optional subsystem
+type Feature struct {
+	Name        string
+	Stability   Stability
+	Description string
+}
+
+// DefaultConfigFile lists the features enabled for every run, one per line
+const DefaultConfigFile = "~/.rocker/features"
+
+var known = []Feature{
+	{
+		Name:        "prefetch",
+		Stability:   Beta,
+		Description: "pull FROM images in the background before the build reaches them, same as build --prefetch",
+	},
+	{
+		Name:        "parallel-stages",
+		Stability:   Experimental,
+		Description: "run the FROM sections that do not depend on each other in parallel, same as build --parallel-stages",
+	},
+}
+
+// All returns all known features sorted by name
+func All() []Feature {
+	all := append([]Feature{}, known...)
+	sort.Sort(byName(all))
+	return all
+}
+
+// Lookup finds the feature by name
+func Lookup(name string) (Feature, bool) {
+	for _, f := range known {
+		if f.Name == name {
+			return f, true
+		}
+	}
+	return Feature{}, false
+}
+
+// Set is the set of the enabled features
+type Set map[string]bool
+
+// Parse makes the set of the given feature names; every entry can also
+// be a comma separated list. Unknown features are an error.
+func Parse(names []string) (Set, error) {
+	set := Set{}
+	for _, entry := range names {
+		for _, name := range strings.Split(entry, ",") {
+			if name = strings.TrimSpace(name); name == "" {
+				continue
+			}
+			if _, ok := Lookup(name); !ok {
+				return nil, fmt.Errorf("Unknown feature %q, see `rocker features` for the list", name)
+			}
+			set[name] = true
+		}
+	}
+	return set, nil
+}
+
+// LoadFile reads the feature names from the config file, one per line;
+// empty lines and lines starting with # are skipped. A missing file is not an error.
+func LoadFile(path string) (names []string, err error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		names = append(names, line)
+	}
+
+	return names, scanner.Err()
+}
+
+// Enabled returns true if the feature is turned on
+func (s Set) Enabled(name string) bool {
+	return s[name]
+}
+
+// Names returns the enabled features sorted by name
+func (s Set) Names() []string {
+	names := []string{}
+	for name := range s {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+type byName []Feature
+
+func (a byName) Len() int           { return len(a) }
+func (a byName) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a byName) Less(i, j int) bool { return a[i].Name < a[j].Name }
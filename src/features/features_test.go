@@ -0,0 +1,58 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package features
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParse(t *testing.T) {
+	set, err := Parse([]string{"prefetch", " prefetch ,", ""})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.True(t, set.Enabled("prefetch"))
+	assert.False(t, set.Enabled("other"))
+	assert.Equal(t, []string{"prefetch"}, set.Names())
+
+	_, err = Parse([]string{"prefetch,time-machine"})
+	assert.EqualError(t, err, "Unknown feature \"time-machine\", see `rocker features` for the list")
+}
+
+func TestLoadFile(t *testing.T) {
+	names, err := LoadFile("/does/not/exist")
+	assert.NoError(t, err)
+	assert.Nil(t, names)
+
+	f, err := ioutil.TempFile("", "rocker-features-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+
+	f.WriteString("# enabled on the CI\nprefetch\n\n")
+	f.Close()
+
+	names, err = LoadFile(f.Name())
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"prefetch"}, names)
+}
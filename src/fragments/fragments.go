@@ -0,0 +1,100 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package fragments implements the get command, which fetches the Rockerfile
+// fragments of INCLUDE from the library registry and pins them in the lock file
+package fragments
+
+import (
+	"fmt"
+	"path/filepath"
+
+	"github.com/grammarly/rocker/src/build"
+	"github.com/grammarly/rocker/src/cliutil"
+	"github.com/grammarly/rocker/src/dockerclient"
+	"github.com/grammarly/rocker/src/imagename"
+
+	"github.com/codegangsta/cli"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// GetCommandSpec returns specifications of the get command for codegangsta/cli
+func GetCommandSpec() cli.Command {
+	return cli.Command{
+		Name:   "get",
+		Usage:  "fetches Rockerfile fragments, e.g. acme/base@v1, from the library registry for INCLUDE; without args fetches the ones of the lock file",
+		Action: getCommand,
+		Flags: []cli.Flag{
+			cli.StringFlag{
+				Name:   "library",
+				Usage:  "registry and namespace of the fragments, e.g. quay.io/acme-rockerfiles",
+				EnvVar: "ROCKER_LIBRARY",
+			},
+			cli.StringFlag{
+				Name:  "dir",
+				Value: ".",
+				Usage: "directory of the Rockerfile, the fragments go to its " + build.FragmentsDir,
+			},
+			cli.BoolFlag{
+				Name:  "update",
+				Usage: "fetch the fragments from --library again even if the lock file has them",
+			},
+			cli.StringFlag{
+				Name:  "auth, a",
+				Value: "",
+				Usage: "Username and password in user:password format",
+			},
+		},
+	}
+}
+
+// getCommand implements 'get' command that fetches the fragments of the args or of the lock file
+func getCommand(c *cli.Context) {
+	dir := filepath.Join(c.String("dir"), build.FragmentsDir)
+
+	refs := []build.FragmentRef{}
+	for _, arg := range c.Args() {
+		ref, err := build.ParseFragmentRef(arg)
+		if err != nil {
+			cliutil.Exit(build.WithExitCode(build.ExitUser, err))
+		}
+		refs = append(refs, ref)
+	}
+
+	if len(refs) == 0 {
+		lock, err := build.LoadFragmentLock(dir)
+		if err != nil {
+			cliutil.Exit(build.WithExitCode(build.ExitUser, err))
+		}
+		if refs = lock.Refs(); len(refs) == 0 {
+			cliutil.Exit(build.WithExitCode(build.ExitUser, fmt.Errorf("rocker get <fragment>@<version>, e.g. acme/base@v1")))
+		}
+	}
+
+	auth := cliutil.InitAuth(c)
+	pull := func(image string) (dockerclient.OCIArtifact, error) {
+		return dockerclient.RegistryPullArtifact(imagename.NewFromString(image), auth)
+	}
+
+	for _, ref := range refs {
+		locked, err := build.GetFragment(ref, c.String("library"), dir, c.Bool("update"), pull)
+		if err != nil {
+			cliutil.Exit(err)
+		}
+		log.Infof("Got %s %s", ref, locked.Checksum)
+	}
+}
@@ -0,0 +1,44 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package i18n
+
+// builtin are the catalogs shipped with rocker, by language
+var builtin = map[string]Catalog{
+	"uk": {
+		"Build ID %s":                                               "Ідентифікатор збірки %s",
+		"| Not cached":                                              "| Немає в кеші",
+		"| Not cached, --no-cache-for %s":                           "| Немає в кеші, --no-cache-for %s",
+		"| Reload cache":                                            "| Оновлення кешу",
+		"| Cached! Take image %.12s":                                "| Є в кеші! Беремо образ %s",
+		"| Removing container %.12s":                                "| Видалення контейнера %s",
+		"| Full output of the failed step is in %s":                 "| Повний вивід кроку, що завершився з помилкою, у %s",
+		"Container %.12s exited with code %d":                       "Контейнер %s завершився з кодом %d",
+		"Image not found: %s (also checked in the remote registry)": "Образ не знайдено: %s (перевірено також у віддаленому реєстрі)",
+		"Image not found locally: %s (offline mode, the remote registry is not checked)":                      "Образ не знайдено локально: %s (офлайн-режим, віддалений реєстр не перевіряється)",
+		"One or more build-args %v were not consumed, failing build.":                                         "Аргументи збірки %v не використано, збірку зупинено.",
+		"Cannot attach to a container on non tty input":                                                       "Неможливо під'єднатися до контейнера без термінала на вході",
+		"Context directory %s is not a directory.":                                                            "Контекст збірки %s не є каталогом.",
+		"Problem with opening directory %s, error: %s":                                                        "Не вдалося відкрити каталог %s, помилка: %s",
+		"Builds are not reproducible. %s":                                                                     "Збірки не відтворювані. %s",
+		"Nothing to deploy, the Rockerfile has no PUSH":                                                       "Нічого розгортати, у Rockerfile немає PUSH",
+		"--offline cannot be used with --%s":                                                                  "--offline не можна використовувати разом з --%s",
+		"--offline cannot be used with the remote context %s":                                                 "--offline не можна використовувати з віддаленим контекстом %s",
+		"Cannot update the description of %s, only Docker Hub is supported":                                   "Неможливо оновити опис %s, підтримується лише Docker Hub",
+		"Failed to update the description of %s, error: %s":                                                   "Не вдалося оновити опис %s, помилка: %s",
+		"You are using rocker %s, the latest release is %s, see https://github.com/grammarly/rocker/releases": "Ви використовуєте rocker %s, останній випуск %s, див. https://github.com/grammarly/rocker/releases",
+	},
+}
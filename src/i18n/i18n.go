@@ -0,0 +1,242 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package i18n translates the messages rocker prints for humans. The English
+// message formats are the keys of the catalogs, so the code keeps logging in
+// English, and the JSON output, which is meant for tooling, stays untouched.
+package i18n
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/go-yaml/yaml"
+)
+
+// DefaultLang is the language of the messages in the code
+const DefaultLang = "en"
+
+// DefaultDir is where the catalog files <lang>.yml are looked for
+const DefaultDir = "~/.rocker/locale"
+
+// Catalog maps the English message formats, as they are given to
+// Printf-like functions, to the translated formats; the translation
+// may reorder the arguments with explicit indexes, e.g. %[2]s
+type Catalog map[string]string
+
+var (
+	verb = regexp.MustCompile(`%(\[\d+\])?[-+# 0]*\d*(\.\d+)?[a-zA-Z%]`)
+
+	// Messages colored as a whole, see the theme package
+	colored = regexp.MustCompile(`(?s)^(\x1b\[[0-9;]*m)(.*)(\x1b\[0m)$`)
+)
+
+type entry struct {
+	pattern *regexp.Regexp
+	format  string
+}
+
+// Translator translates the formatted messages by the catalog
+type Translator struct {
+	Lang    string
+	entries []entry
+}
+
+// New makes a translator for the catalog; every translation
+// should not use more arguments than the original message has
+func New(lang string, catalog Catalog) (*Translator, error) {
+	t := &Translator{Lang: lang}
+
+	// Longer messages go first, so that a message that is a prefix
+	// of another one does not take over its translation
+	messages := make([]string, 0, len(catalog))
+	for message := range catalog {
+		messages = append(messages, message)
+	}
+	sort.Sort(byLength(messages))
+
+	for _, message := range messages {
+		translation := catalog[message]
+		pattern, args := compile(message)
+
+		format := verb.ReplaceAllStringFunc(translation, func(v string) string {
+			if v == "%%" {
+				return v
+			}
+			return "%" + verb.FindStringSubmatch(v)[1] + "s"
+		})
+
+		if used := countArgs(format); used > args {
+			return nil, fmt.Errorf("Translation %q of %q uses %d arguments, the message has %d", translation, message, used, args)
+		}
+
+		t.entries = append(t.entries, entry{pattern, format})
+	}
+
+	return t, nil
+}
+
+// Translate returns the translation of the formatted message,
+// or the message as is if the catalog has no translation for it
+func (t *Translator) Translate(message string) string {
+	if t == nil {
+		return message
+	}
+	if match := colored.FindStringSubmatch(message); match != nil {
+		return match[1] + t.Translate(match[2]) + match[3]
+	}
+	for _, e := range t.entries {
+		match := e.pattern.FindStringSubmatch(message)
+		if match == nil {
+			continue
+		}
+		args := make([]interface{}, len(match)-1)
+		for i, arg := range match[1:] {
+			args[i] = arg
+		}
+		return fmt.Sprintf(e.format, args...)
+	}
+	return message
+}
+
+type byLength []string
+
+func (a byLength) Len() int      { return len(a) }
+func (a byLength) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a byLength) Less(i, j int) bool {
+	if len(a[i]) != len(a[j]) {
+		return len(a[i]) > len(a[j])
+	}
+	return a[i] < a[j]
+}
+
+// compile makes a pattern that matches the messages formatted with
+// the given format, every formatted argument is captured
+func compile(format string) (*regexp.Regexp, int) {
+	var (
+		expr = "(?s)^"
+		args = 0
+		last = 0
+	)
+	for _, loc := range verb.FindAllStringIndex(format, -1) {
+		expr += regexp.QuoteMeta(format[last:loc[0]])
+		if format[loc[0]:loc[1]] == "%%" {
+			expr += "%"
+		} else {
+			expr += "(.*?)"
+			args++
+		}
+		last = loc[1]
+	}
+	expr += regexp.QuoteMeta(format[last:]) + "$"
+
+	return regexp.MustCompile(expr), args
+}
+
+// countArgs returns how many arguments the format consumes
+func countArgs(format string) int {
+	n, next := 0, 0
+	for _, match := range verb.FindAllStringSubmatch(format, -1) {
+		if match[0] == "%%" {
+			continue
+		}
+		if match[1] != "" {
+			fmt.Sscanf(match[1], "[%d]", &next)
+		} else {
+			next++
+		}
+		if next > n {
+			n = next
+		}
+	}
+	return n
+}
+
+// DetectLang returns the language given with --lang, or the one of the
+// locale from the environment, e.g. "uk" for LANG=uk_UA.UTF-8
+func DetectLang(lang string) string {
+	for _, value := range []string{lang, os.Getenv("LC_ALL"), os.Getenv("LC_MESSAGES"), os.Getenv("LANG")} {
+		if value == "" {
+			continue
+		}
+		value = strings.SplitN(value, ".", 2)[0]
+		value = strings.SplitN(value, "@", 2)[0]
+		if value == "C" || value == "POSIX" {
+			return DefaultLang
+		}
+		return strings.Replace(value, "-", "_", -1)
+	}
+	return DefaultLang
+}
+
+// Load makes a translator for the language, e.g. "uk_UA", out of the built-in
+// catalog and the file <lang>.yml in the directory, which takes precedence;
+// the catalogs of the base language ("uk") are used as well
+func Load(lang, dir string) (*Translator, error) {
+	catalog := Catalog{}
+
+	langs := []string{lang}
+	if base := strings.SplitN(lang, "_", 2)[0]; base != lang {
+		langs = []string{base, lang}
+	}
+
+	for _, l := range langs {
+		for message, translation := range builtin[l] {
+			catalog[message] = translation
+		}
+
+		if dir == "" {
+			continue
+		}
+
+		file := filepath.Join(dir, l+".yml")
+		data, err := ioutil.ReadFile(file)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		messages := Catalog{}
+		if err := yaml.Unmarshal(data, &messages); err != nil {
+			return nil, fmt.Errorf("Failed to parse message catalog %s, error: %s", file, err)
+		}
+		for message, translation := range messages {
+			catalog[message] = translation
+		}
+	}
+
+	return New(lang, catalog)
+}
+
+// Formatter wraps a logrus formatter and translates the messages of the entries
+type Formatter struct {
+	Formatter  logrus.Formatter
+	Translator *Translator
+}
+
+// Format implements logrus.Formatter
+func (f *Formatter) Format(entry *logrus.Entry) ([]byte, error) {
+	translated := *entry
+	translated.Message = f.Translator.Translate(entry.Message)
+	return f.Formatter.Format(&translated)
+}
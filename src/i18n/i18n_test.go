@@ -0,0 +1,105 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package i18n
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTranslator(t *testing.T) {
+	translator, err := New("de", Catalog{
+		"| Cached! Take image %.12s":          "| Im Cache! Nehme Image %s",
+		"Container %.12s exited with code %d": "Code %[2]d von Container %[1]s",
+		"100%% done":                          "100%% fertig",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, "| Im Cache! Nehme Image 0123456789ab", translator.Translate("| Cached! Take image 0123456789ab"))
+	assert.Equal(t, "Code 2 von Container 0123456789ab", translator.Translate("Container 0123456789ab exited with code 2"))
+	assert.Equal(t, "100% fertig", translator.Translate("100% done"))
+	assert.Equal(t, "\x1b[32m| Im Cache! Nehme Image abc\x1b[0m", translator.Translate("\x1b[32m| Cached! Take image abc\x1b[0m"))
+	assert.Equal(t, "Something else", translator.Translate("Something else"))
+
+	var none *Translator
+	assert.Equal(t, "Something else", none.Translate("Something else"))
+
+	_, err = New("de", Catalog{"Build ID %s": "Build %s %s"})
+	assert.Error(t, err, "translation uses more arguments than the message has")
+}
+
+func TestDetectLang(t *testing.T) {
+	for _, name := range []string{"LC_ALL", "LC_MESSAGES", "LANG"} {
+		defer os.Setenv(name, os.Getenv(name))
+		os.Unsetenv(name)
+	}
+
+	assert.Equal(t, "en", DetectLang(""))
+	assert.Equal(t, "de", DetectLang("de"))
+
+	os.Setenv("LANG", "uk_UA.UTF-8")
+	assert.Equal(t, "uk_UA", DetectLang(""))
+
+	os.Setenv("LC_ALL", "C")
+	assert.Equal(t, "en", DetectLang(""))
+	assert.Equal(t, "pt_BR", DetectLang("pt-BR"))
+}
+
+func TestLoad(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rocker-locale-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "uk_UA.yml"), []byte("\"Build ID %s\": \"Збірка %s\"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	translator, err := Load("uk_UA", dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The file overrides the built-in catalog of the base language
+	assert.Equal(t, "Збірка 1a2b", translator.Translate("Build ID 1a2b"))
+	assert.Equal(t, "| Немає в кеші", translator.Translate("| Not cached"))
+}
+
+func TestFormatter(t *testing.T) {
+	translator, err := Load("uk", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f := &Formatter{Formatter: &logrus.JSONFormatter{}, Translator: translator}
+	entry := &logrus.Entry{Message: "| Not cached", Data: logrus.Fields{}}
+
+	data, err := f.Format(entry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Contains(t, string(data), "Немає в кеші")
+	assert.Equal(t, "| Not cached", entry.Message, "the entry itself is not changed")
+}
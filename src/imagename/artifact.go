@@ -33,6 +33,9 @@ type Artifact struct {
 	ImageID     string     `yaml:"ImageID"`
 	Addressable string     `yaml:"Addressable"`
 	BuildTime   time.Time  `yaml:"BuildTime"`
+	BuildID     string     `yaml:"BuildID,omitempty"`
+	Logs        []string   `yaml:"Logs,omitempty"`
+	Platform    string     `yaml:"Platform,omitempty"`
 }
 
 // Artifacts is a collection of Artifact entities
@@ -0,0 +1,207 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package inspect implements the commands that read a Rockerfile without building
+// it: vars lists its variables, parse prints its instructions and graph its stages
+package inspect
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/grammarly/rocker/src/build"
+	"github.com/grammarly/rocker/src/cliutil"
+	"github.com/grammarly/rocker/src/template"
+
+	"github.com/codegangsta/cli"
+)
+
+// renderFlags are the flags of the commands that render the Rockerfile
+func renderFlags(fileUsage, output, outputUsage string) []cli.Flag {
+	return []cli.Flag{
+		cli.StringFlag{
+			Name:  "file, f",
+			Value: "Rockerfile",
+			Usage: fileUsage,
+		},
+		cli.StringSliceFlag{
+			Name:  "var",
+			Value: &cli.StringSlice{},
+			Usage: "set variables to render the Rockerfile with, value is like \"key=value\"",
+		},
+		cli.StringSliceFlag{
+			Name:  "vars",
+			Value: &cli.StringSlice{},
+			Usage: "Load variables form a file, either JSON or YAML. Can pass multiple of this.",
+		},
+		cli.StringFlag{
+			Name:  "output, o",
+			Value: output,
+			Usage: outputUsage,
+		},
+	}
+}
+
+// VarsCommandSpec returns specifications of the vars command for codegangsta/cli
+func VarsCommandSpec() cli.Command {
+	return cli.Command{
+		Name:   "vars",
+		Usage:  "lists the template variables and ARGs the Rockerfile references, their defaults and where they are used",
+		Action: varsCommand,
+		Flags: []cli.Flag{
+			cli.BoolFlag{
+				Name:  "markdown",
+				Usage: "print a markdown table, e.g. to put into the README of the project",
+			},
+		},
+	}
+}
+
+// ParseCommandSpec returns specifications of the parse command for codegangsta/cli
+func ParseCommandSpec() cli.Command {
+	return cli.Command{
+		Name:   "parse",
+		Usage:  "prints the instructions of the Rockerfile, with their args, flags and lines, and the variables it references",
+		Action: parseCommand,
+		Flags:  renderFlags("Rockerfile to parse, - for stdin", "json", "output format, only json is supported"),
+	}
+}
+
+// GraphCommandSpec returns specifications of the graph command for codegangsta/cli
+func GraphCommandSpec() cli.Command {
+	return cli.Command{
+		Name:   "graph",
+		Usage:  "prints the graph of the stages of the Rockerfile, the images and artifacts they use and the tags they produce, in Graphviz DOT or JSON",
+		Action: graphCommand,
+		Flags:  renderFlags("Rockerfile to read, - for stdin", "dot", "output format, dot or json"),
+	}
+}
+
+// varsCommand implements 'vars' command that lists the variables of the Rockerfile
+func varsCommand(c *cli.Context) {
+	file := "Rockerfile"
+	if len(c.Args()) > 0 {
+		file = c.Args()[0]
+	}
+
+	source, err := ioutil.ReadFile(file)
+	if err != nil {
+		cliutil.Exit(build.WithExitCode(build.ExitUser, err))
+	}
+
+	vars, err := build.RockerfileVariables(filepath.Base(file), string(source), template.Funs{})
+	if err != nil {
+		cliutil.Exit(build.WithExitCode(build.ExitUser, err))
+	}
+
+	yesNo := map[bool]string{true: "yes", false: "no"}
+
+	if c.Bool("markdown") {
+		fmt.Println("| Name | Kind | Default | Required | Used at |")
+		fmt.Println("|------|------|---------|----------|---------|")
+		for _, v := range vars {
+			def := "-"
+			if v.HasDefault {
+				def = "`" + v.Default + "`"
+			}
+			fmt.Printf("| `%s` | %s | %s | %s | %s |\n", v.Name, v.Kind, def, yesNo[v.Required], strings.Join(v.Used, ", "))
+		}
+		return
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tKIND\tDEFAULT\tREQUIRED\tUSED AT")
+	for _, v := range vars {
+		def := "-"
+		if v.HasDefault {
+			def = strconv.Quote(v.Default)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", v.Name, v.Kind, def, yesNo[v.Required], strings.Join(v.Used, ", "))
+	}
+	w.Flush()
+}
+
+// parseCommand implements 'parse' command that prints the instructions as JSON
+func parseCommand(c *cli.Context) {
+	if format := c.String("output"); format != "json" {
+		cliutil.Exitf(build.ExitUser, "Invalid --output %q, expected json", format)
+	}
+
+	parsed, err := readRockerfile(c).Parsed()
+	if err != nil {
+		cliutil.Exit(build.WithExitCode(build.ExitUser, err))
+	}
+
+	// Shell commands are full of && and <, which are fine as they are
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(parsed); err != nil {
+		cliutil.Exit(err)
+	}
+}
+
+// graphCommand implements 'graph' command that prints the stages as DOT or JSON
+func graphCommand(c *cli.Context) {
+	format := c.String("output")
+	if format != "dot" && format != "json" {
+		cliutil.Exitf(build.ExitUser, "Invalid --output %q, expected dot or json", format)
+	}
+
+	rockerfile := readRockerfile(c)
+	graph := build.NewGraph(rockerfile.Commands())
+
+	if format == "dot" {
+		if err := graph.WriteDot(os.Stdout, rockerfile.Name); err != nil {
+			cliutil.Exit(err)
+		}
+		return
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(graph); err != nil {
+		cliutil.Exit(err)
+	}
+}
+
+// readRockerfile reads the Rockerfile of --file, - for stdin, rendered with
+// the variables of --var and --vars
+func readRockerfile(c *cli.Context) *build.Rockerfile {
+	var (
+		vars       = cliutil.ReadVars(c)
+		rockerfile *build.Rockerfile
+		err        error
+	)
+
+	if file := c.String("file"); file == "-" {
+		rockerfile, err = build.NewRockerfile("Rockerfile", os.Stdin, vars, template.Funs{}, cliutil.TemplateSandbox(c, "."))
+	} else {
+		rockerfile, err = build.NewRockerfileFromFile(file, vars, template.Funs{}, cliutil.TemplateSandbox(c, filepath.Dir(file)))
+	}
+	if err != nil {
+		cliutil.Exit(build.WithExitCode(build.ExitUser, err))
+	}
+
+	return rockerfile
+}
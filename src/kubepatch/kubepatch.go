@@ -0,0 +1,273 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package kubepatch sets the image of a build in Kubernetes manifests
+// and kustomize overlays by a path of keys.
+package kubepatch
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/go-yaml/yaml"
+)
+
+// Spec tells which file and which value in it to set
+type Spec struct {
+	File string
+	Path string
+
+	// Field is what part of the image reference to set:
+	// "image" (name@digest), "name" or "digest"
+	Field string
+}
+
+var segmentRe = regexp.MustCompile(`^([^\[\]]+)((?:\[[^\[\]]+\])*)$`)
+
+// ParseSpec parses the spec in the form of file:path[=field], e.g.
+// deployment.yaml:spec.template.spec.containers[name=app].image
+// or kustomization.yaml:images[0].digest=digest
+func ParseSpec(spec string) (s Spec, err error) {
+	colon := strings.LastIndex(spec, ":")
+	if colon <= 0 || colon == len(spec)-1 {
+		return s, fmt.Errorf("Invalid spec %q, expected file:path[=field]", spec)
+	}
+
+	s.File, s.Path, s.Field = spec[:colon], spec[colon+1:], "image"
+
+	if eq := strings.Index(s.Path, "="); eq >= 0 && !strings.Contains(s.Path[eq:], "]") {
+		s.Path, s.Field = s.Path[:eq], s.Path[eq+1:]
+	}
+
+	switch s.Field {
+	case "image", "name", "digest":
+	default:
+		return s, fmt.Errorf("Invalid spec %q, field should be one of image, name or digest", spec)
+	}
+
+	if _, err := parsePath(s.Path); err != nil {
+		return s, err
+	}
+
+	return s, nil
+}
+
+// Value returns the part of the image reference the spec asks for,
+// given the name and the digest of the pushed image
+func (s Spec) Value(name, digest string) string {
+	switch s.Field {
+	case "name":
+		return name
+	case "digest":
+		return digest
+	default:
+		return name + "@" + digest
+	}
+}
+
+// PatchFile sets the value by the path in the file and writes it back
+func PatchFile(file, path, value string) error {
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+
+	if content, err = Patch(content, path, value); err != nil {
+		return fmt.Errorf("Failed to patch %s, error: %s", file, err)
+	}
+
+	return ioutil.WriteFile(file, content, 0644)
+}
+
+// Patch sets the value by the path in every YAML document of the content
+// that has the path; the last key may be missing, so it is added. It fails
+// if no document has the path.
+func Patch(content []byte, path, value string) ([]byte, error) {
+	segments, err := parsePath(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		docs    = splitDocuments(content)
+		result  = make([][]byte, len(docs))
+		patched = 0
+	)
+
+	for i, doc := range docs {
+		result[i] = doc
+
+		obj := yaml.MapSlice{}
+		if err := yaml.Unmarshal(doc, &obj); err != nil {
+			return nil, err
+		}
+
+		obj, ok := set(obj, segments, value)
+		if !ok {
+			continue
+		}
+
+		if result[i], err = yaml.Marshal(obj); err != nil {
+			return nil, err
+		}
+		patched++
+	}
+
+	if patched == 0 {
+		return nil, fmt.Errorf("no document has %s", path)
+	}
+
+	return bytes.Join(result, []byte("---\n")), nil
+}
+
+// segment is a key of a map followed by zero or more selectors of list items,
+// either by index [0] or by the value of a key [name=app]
+type segment struct {
+	key       string
+	selectors []string
+}
+
+func parsePath(path string) (segments []segment, err error) {
+	for _, part := range strings.Split(path, ".") {
+		m := segmentRe.FindStringSubmatch(part)
+		if m == nil {
+			return nil, fmt.Errorf("Invalid path %q", path)
+		}
+
+		s := segment{key: m[1]}
+		if m[2] != "" {
+			s.selectors = strings.Split(strings.Trim(m[2], "[]"), "][")
+		}
+		segments = append(segments, s)
+	}
+	return segments, nil
+}
+
+// set walks the path and sets the value, returns false if the path does not exist
+func set(obj yaml.MapSlice, segments []segment, value string) (yaml.MapSlice, bool) {
+	s := segments[0]
+
+	idx := -1
+	for i, item := range obj {
+		if fmt.Sprintf("%v", item.Key) == s.key {
+			idx = i
+			break
+		}
+	}
+
+	if len(segments) == 1 && len(s.selectors) == 0 {
+		if idx < 0 {
+			return append(obj, yaml.MapItem{Key: s.key, Value: value}), true
+		}
+		obj[idx].Value = value
+		return obj, true
+	}
+
+	if idx < 0 {
+		return obj, false
+	}
+
+	v, ok := setIn(obj[idx].Value, s.selectors, segments[1:], value)
+	if ok {
+		obj[idx].Value = v
+	}
+	return obj, ok
+}
+
+// setIn goes through the list selectors and then continues with the rest of the path
+func setIn(current interface{}, selectors []string, rest []segment, value string) (interface{}, bool) {
+	if len(selectors) == 0 {
+		if len(rest) == 0 {
+			return value, true
+		}
+		m, ok := current.(yaml.MapSlice)
+		if !ok {
+			return current, false
+		}
+		return set(m, rest, value)
+	}
+
+	list, ok := current.([]interface{})
+	if !ok {
+		return current, false
+	}
+
+	n := selectItem(list, selectors[0])
+	if n < 0 {
+		return current, false
+	}
+
+	v, ok := setIn(list[n], selectors[1:], rest, value)
+	if ok {
+		list[n] = v
+	}
+	return list, ok
+}
+
+// selectItem returns the index of the list item that matches the selector or -1
+func selectItem(list []interface{}, sel string) int {
+	if n, err := strconv.Atoi(sel); err == nil {
+		if n < 0 || n >= len(list) {
+			return -1
+		}
+		return n
+	}
+
+	kv := strings.SplitN(sel, "=", 2)
+	if len(kv) != 2 {
+		return -1
+	}
+
+	for n, item := range list {
+		m, ok := item.(yaml.MapSlice)
+		if !ok {
+			continue
+		}
+		for _, field := range m {
+			if fmt.Sprintf("%v", field.Key) == kv[0] && fmt.Sprintf("%v", field.Value) == kv[1] {
+				return n
+			}
+		}
+	}
+
+	return -1
+}
+
+// splitDocuments splits a multi-document YAML by the `---` lines
+func splitDocuments(content []byte) (docs [][]byte) {
+	current := []byte{}
+
+	for _, line := range bytes.SplitAfter(content, []byte("\n")) {
+		if string(bytes.TrimSpace(line)) == "---" {
+			if len(bytes.TrimSpace(current)) > 0 {
+				docs = append(docs, current)
+			}
+			current = []byte{}
+			continue
+		}
+		current = append(current, line...)
+	}
+
+	if len(bytes.TrimSpace(current)) > 0 {
+		docs = append(docs, current)
+	}
+
+	return docs
+}
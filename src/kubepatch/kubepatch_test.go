@@ -0,0 +1,95 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package kubepatch
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseSpec(t *testing.T) {
+	s, err := ParseSpec("deploy/app.yaml:spec.template.spec.containers[name=app].image")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, Spec{File: "deploy/app.yaml", Path: "spec.template.spec.containers[name=app].image", Field: "image"}, s)
+	assert.Equal(t, "acme/app@sha256:abc", s.Value("acme/app", "sha256:abc"))
+
+	s, err = ParseSpec("kustomization.yaml:images[0].digest=digest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, Spec{File: "kustomization.yaml", Path: "images[0].digest", Field: "digest"}, s)
+
+	for _, spec := range []string{"app.yaml", "app.yaml:", "app.yaml:spec.image=tag", "app.yaml:spec..image"} {
+		_, err := ParseSpec(spec)
+		assert.Error(t, err, spec)
+	}
+}
+
+func TestPatch(t *testing.T) {
+	content := `apiVersion: v1
+kind: Service
+metadata:
+  name: app
+---
+apiVersion: apps/v1
+kind: Deployment
+spec:
+  template:
+    spec:
+      containers:
+      - name: sidecar
+        image: envoy
+      - name: app
+        image: acme/app:latest
+`
+
+	result, err := Patch([]byte(content), "spec.template.spec.containers[name=app].image", "acme/app@sha256:abc")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, `apiVersion: v1
+kind: Service
+metadata:
+  name: app
+---
+apiVersion: apps/v1
+kind: Deployment
+spec:
+  template:
+    spec:
+      containers:
+      - name: sidecar
+        image: envoy
+      - name: app
+        image: acme/app@sha256:abc
+`, string(result))
+
+	_, err = Patch([]byte(content), "spec.template.spec.containers[name=web].image", "x")
+	assert.Error(t, err)
+}
+
+func TestPatch_AddsLastKey(t *testing.T) {
+	result, err := Patch([]byte("images:\n- name: acme/app\n"), "images[0].digest", "sha256:abc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "images:\n- name: acme/app\n  digest: sha256:abc\n", string(result))
+}
@@ -278,6 +278,28 @@ func parseMaybeJSON(rest string) (*Node, map[string]bool, error) {
 	return node, nil, nil
 }
 
+// parseHealthConfig parses the HEALTHCHECK arguments: the type (CMD or NONE)
+// goes to the first node, followed by the command parsed as the one of RUN
+func parseHealthConfig(rest string) (*Node, map[string]bool, error) {
+	parts := tockenWhitespace.Split(strings.TrimSpace(rest), 2)
+	if parts[0] == "" {
+		return nil, nil, nil
+	}
+
+	node := &Node{Value: parts[0]}
+	if len(parts) == 1 {
+		return node, nil, nil
+	}
+
+	cmd, attrs, err := parseMaybeJSON(parts[1])
+	if err != nil {
+		return nil, nil, err
+	}
+	node.Next = cmd
+
+	return node, attrs, nil
+}
+
 // parseMaybeJSONToList determines if the argument appears to be a JSON array. If
 // so, passes to parseJSON; if not, attempts to parse it as a whitespace
 // delimited string.
@@ -1,8 +1,9 @@
 // Package parser implements a parser and parse tree dumper for Dockerfiles.
 //
 // NOTICE: it was originally grabbed from the docker source and
-// 				 modified to support additional commands; see LICENSE in the current
-// 				 directory from the license and the copyright.
+//
+//	modified to support additional commands; see LICENSE in the current
+//	directory from the license and the copyright.
 package parser
 
 import (
@@ -24,7 +25,6 @@ import (
 // This data structure is frankly pretty lousy for handling complex languages,
 // but lucky for us the Dockerfile isn't very complicated. This structure
 // works a little more effectively than a "proper" parse tree for our needs.
-//
 type Node struct {
 	Value      string          // actual content
 	Next       *Node           // the next item in the current sexp
@@ -32,6 +32,8 @@ type Node struct {
 	Attributes map[string]bool // special attributes for this node
 	Original   string          // original line used before parsing
 	Flags      []string        // only top Node should have this set
+	StartLine  int             // the line number where the node begins
+	EndLine    int             // the line number where the node ends
 }
 
 var (
@@ -49,22 +51,25 @@ func init() {
 	// functions. Errors are propagated up by Parse() and the resulting AST can
 	// be incorporated directly into the existing AST as a next.
 	dispatch = map[string]func(string) (*Node, map[string]bool, error){
-		"user":       parseString,
-		"onbuild":    parseSubCommand,
-		"workdir":    parseString,
-		"env":        parseEnv,
-		"label":      parseLabel,
-		"maintainer": parseString,
-		"from":       parseString,
-		"add":        parseMaybeJSONToList,
-		"copy":       parseMaybeJSONToList,
-		"run":        parseMaybeJSON,
-		"cmd":        parseMaybeJSON,
-		"entrypoint": parseMaybeJSON,
-		"expose":     parseStringsWhitespaceDelimited,
-		"volume":     parseMaybeJSONToList,
-		"insert":     parseIgnore,
-		"arg":        parseString,
+		"user":        parseString,
+		"onbuild":     parseSubCommand,
+		"workdir":     parseString,
+		"env":         parseEnv,
+		"label":       parseLabel,
+		"maintainer":  parseString,
+		"from":        parseStringsWhitespaceDelimited,
+		"add":         parseMaybeJSONToList,
+		"copy":        parseMaybeJSONToList,
+		"run":         parseMaybeJSON,
+		"cmd":         parseMaybeJSON,
+		"entrypoint":  parseMaybeJSON,
+		"healthcheck": parseHealthConfig,
+		"shell":       parseMaybeJSON,
+		"stopsignal":  parseString,
+		"expose":      parseStringsWhitespaceDelimited,
+		"volume":      parseMaybeJSONToList,
+		"insert":      parseIgnore,
+		"arg":         parseString,
 
 		// Rockerfile extras
 		"mount":   parseMaybeJSONToList,
@@ -75,6 +80,13 @@ func init() {
 		"require": parseMaybeJSONToList,
 		"include": parseString,
 		"attach":  parseMaybeJSON,
+		"remove":  parseMaybeJSONToList,
+		"squash":  parseIgnore,
+		"context": parseStringsWhitespaceDelimited,
+		"publish": parseStringsWhitespaceDelimited,
+		"nocache": parseIgnore,
+
+		"helm_package": parseStringsWhitespaceDelimited,
 		"var": func(cmd string) (*Node, map[string]bool, error) {
 			return parseNameVal(cmd, "VAR")
 		},
@@ -118,8 +130,12 @@ func parseLine(line string) (string, *Node, error) {
 func Parse(rwc io.Reader) (*Node, error) {
 	root := &Node{}
 	scanner := bufio.NewScanner(rwc)
+	lineNo := 0
 
 	for scanner.Scan() {
+		lineNo++
+		startLine := lineNo
+
 		scannedLine := strings.TrimLeftFunc(scanner.Text(), unicode.IsSpace)
 		line, child, err := parseLine(scannedLine)
 		if err != nil {
@@ -128,6 +144,7 @@ func Parse(rwc io.Reader) (*Node, error) {
 
 		if line != "" && child == nil {
 			for scanner.Scan() {
+				lineNo++
 				newline := scanner.Text()
 
 				if stripComments(strings.TrimSpace(newline)) == "" {
@@ -152,6 +169,8 @@ func Parse(rwc io.Reader) (*Node, error) {
 		}
 
 		if child != nil {
+			child.StartLine = startLine
+			child.EndLine = lineNo
 			root.Children = append(root.Children, child)
 		}
 	}
@@ -5,6 +5,7 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 )
 
@@ -73,3 +74,20 @@ func TestTestData(t *testing.T) {
 		}
 	}
 }
+
+func TestParseLines(t *testing.T) {
+	ast, err := Parse(strings.NewReader("# comment\nFROM ubuntu\n\nRUN apt-get update && \\\n  # comment\n  apt-get install -y curl\nCMD [\"app\"]\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := [][2]int{{2, 2}, {4, 6}, {7, 7}}
+	if len(ast.Children) != len(expected) {
+		t.Fatalf("Expected %d nodes, got %d", len(expected), len(ast.Children))
+	}
+	for i, lines := range expected {
+		if n := ast.Children[i]; n.StartLine != lines[0] || n.EndLine != lines[1] {
+			t.Errorf("%s: expected lines %d-%d, got %d-%d", n.Value, lines[0], lines[1], n.StartLine, n.EndLine)
+		}
+	}
+}
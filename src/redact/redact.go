@@ -0,0 +1,147 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package redact hides the values of secrets in everything rocker prints
+package redact
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// Mask is printed in place of a secret
+const Mask = "******"
+
+// MinLength is the length of the shortest secret that is redacted; shorter
+// values would mask too much of unrelated output
+const MinLength = 4
+
+// Redactor replaces the registered secrets in the given text
+type Redactor struct {
+	mu       sync.RWMutex
+	secrets  map[string]bool
+	replacer *strings.Replacer
+}
+
+// New makes an empty redactor
+func New() *Redactor {
+	return &Redactor{secrets: map[string]bool{}}
+}
+
+// Add registers the secret. Besides the value itself, its base64, URL and
+// quoted forms are redacted, and every line of a multi-line value separately,
+// since output is often logged line by line.
+func (r *Redactor) Add(secret string) {
+	forms := []string{secret}
+
+	if lines := strings.Split(strings.Replace(secret, "\r\n", "\n", -1), "\n"); len(lines) > 1 {
+		for _, line := range lines {
+			forms = append(forms, strings.TrimSpace(line))
+		}
+	}
+
+	quoted := strconv.Quote(secret)
+	jsonQuoted, _ := json.Marshal(secret)
+
+	forms = append(forms,
+		base64.StdEncoding.EncodeToString([]byte(secret)),
+		base64.URLEncoding.EncodeToString([]byte(secret)),
+		strings.TrimRight(base64.StdEncoding.EncodeToString([]byte(secret)), "="),
+		url.QueryEscape(secret),
+		quoted[1:len(quoted)-1],
+		string(jsonQuoted[1:len(jsonQuoted)-1]),
+	)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, form := range forms {
+		if len(form) >= MinLength {
+			r.secrets[form] = true
+		}
+	}
+
+	// Longer forms go first, so a secret that contains another one is masked as a whole
+	all := []string{}
+	for form := range r.secrets {
+		all = append(all, form)
+	}
+	sort.Sort(byLength(all))
+
+	pairs := []string{}
+	for _, form := range all {
+		pairs = append(pairs, form, Mask)
+	}
+	r.replacer = strings.NewReplacer(pairs...)
+}
+
+// String returns the text with the secrets masked
+func (r *Redactor) String(s string) string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if r.replacer == nil {
+		return s
+	}
+	return r.replacer.Replace(s)
+}
+
+// Bytes returns the data with the secrets masked
+func (r *Redactor) Bytes(data []byte) []byte {
+	r.mu.RLock()
+	empty := r.replacer == nil
+	r.mu.RUnlock()
+
+	if empty {
+		return data
+	}
+
+	return []byte(r.String(string(data)))
+}
+
+// Formatter wraps a logrus formatter and masks the secrets in its output,
+// both in the text and JSON form
+type Formatter struct {
+	Formatter logrus.Formatter
+	Redactor  *Redactor
+}
+
+// Format implements logrus.Formatter
+func (f *Formatter) Format(entry *logrus.Entry) ([]byte, error) {
+	data, err := f.Formatter.Format(entry)
+	if err != nil {
+		return data, err
+	}
+	return f.Redactor.Bytes(data), nil
+}
+
+type byLength []string
+
+func (a byLength) Len() int      { return len(a) }
+func (a byLength) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a byLength) Less(i, j int) bool {
+	if len(a[i]) != len(a[j]) {
+		return len(a[i]) > len(a[j])
+	}
+	return a[i] < a[j]
+}
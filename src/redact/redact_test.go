@@ -0,0 +1,66 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package redact
+
+import (
+	"bytes"
+	"encoding/base64"
+	"net/url"
+	"testing"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRedactor_String(t *testing.T) {
+	r := New()
+	assert.Equal(t, "nothing to hide", r.String("nothing to hide"))
+
+	r.Add("s3cr3t/p@ss")
+	r.Add("abc")
+
+	assert.Equal(t, "login -p ****** ok", r.String("login -p s3cr3t/p@ss ok"))
+	assert.Equal(t, "abc is too short to redact", r.String("abc is too short to redact"))
+	assert.Equal(t, "Authorization: Basic ******", r.String("Authorization: Basic "+base64.StdEncoding.EncodeToString([]byte("s3cr3t/p@ss"))))
+	assert.Equal(t, "https://host/?token=******", r.String("https://host/?token="+url.QueryEscape("s3cr3t/p@ss")))
+}
+
+func TestRedactor_MultiLine(t *testing.T) {
+	r := New()
+	r.Add("-----BEGIN KEY-----\nMIIEpAIBAAKCAQEA\n-----END KEY-----")
+
+	assert.Equal(t, "key: ******", r.String("key: -----BEGIN KEY-----\nMIIEpAIBAAKCAQEA\n-----END KEY-----"))
+	assert.Equal(t, "| ******", r.String("| MIIEpAIBAAKCAQEA"))
+	assert.Equal(t, `RUN ["echo" "******"]`, r.String(`RUN ["echo" "-----BEGIN KEY-----\nMIIEpAIBAAKCAQEA\n-----END KEY-----"]`))
+}
+
+func TestFormatter(t *testing.T) {
+	r := New()
+	r.Add("hunter22")
+
+	buf := &bytes.Buffer{}
+	logger := &logrus.Logger{
+		Out:       buf,
+		Formatter: &Formatter{&logrus.JSONFormatter{}, r},
+		Level:     logrus.InfoLevel,
+	}
+
+	logger.WithField("password", "hunter22").Info("pushing with hunter22")
+
+	assert.NotContains(t, buf.String(), "hunter22")
+	assert.Contains(t, buf.String(), `"password":"******"`)
+}
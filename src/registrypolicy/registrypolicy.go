@@ -0,0 +1,269 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package registrypolicy restricts the registries a build may pull its base images
+// from and push to, and the namespaces the base images may come from, for the
+// regulated environments that must not use Docker Hub or other unapproved sources
+package registrypolicy
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/grammarly/rocker/src/imagename"
+
+	"github.com/go-yaml/yaml"
+)
+
+// DefaultFile is the policy of the organization that applies to every build
+// when it exists, see Load for the format
+const DefaultFile = "/etc/rocker/registry-policy.yml"
+
+// The modes of a policy: enforce fails the build before it starts, warn only
+// reports the images that are not allowed
+const (
+	ModeEnforce = "enforce"
+	ModeWarn    = "warn"
+)
+
+// DockerHub is how the policy names the Docker Hub registry
+const DockerHub = "docker.io"
+
+// Policy is the allowlist of the organization, of the form
+//
+//	mode: enforce
+//	registries:
+//	  - registry.corp.example.com
+//	  - quay.io
+//	namespaces:
+//	  - registry.corp.example.com/base
+//	  - quay.io/acme
+//	mirror: registry.corp.example.com
+//	contact: "#platform-security"
+//
+// Registries are the only ones FROM, COPY --from and PUSH may use; Docker Hub is
+// docker.io and an S3 bucket is s3.amazonaws.com/bucket. Namespaces, if given,
+// further restrict the base images to the repositories under them. Mirror is the
+// registry the Docker Hub images are mirrored to, suggested instead of them, and
+// contact is who approves more registries, both only go to the errors
+type Policy struct {
+	Mode       string   `yaml:"mode"`
+	Registries []string `yaml:"registries"`
+	Namespaces []string `yaml:"namespaces"`
+	Mirror     string   `yaml:"mirror"`
+	Contact    string   `yaml:"contact"`
+
+	// Source is the file or the url the policy is loaded from
+	Source string `yaml:"-"`
+}
+
+// The rules of a policy a violation can break, named after the keys of the file
+const (
+	RuleRegistries = "registries"
+	RuleNamespaces = "namespaces"
+)
+
+// Violation is an image the policy does not allow
+type Violation struct {
+	Instruction string
+	Image       string
+	Rule        string
+	Reason      string
+	Suggestion  string
+}
+
+// Error returns the human readable representation of the violation
+func (v *Violation) Error() string {
+	msg := fmt.Sprintf("%s %s: %s", v.Instruction, v.Image, v.Reason)
+	if v.Suggestion != "" {
+		msg += ", " + v.Suggestion
+	}
+	return msg
+}
+
+// Load reads the policy from a file or an http(s) url
+func Load(source string) (*Policy, error) {
+	var (
+		content []byte
+		err     error
+	)
+
+	if strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://") {
+		content, err = fetch(source)
+	} else {
+		content, err = ioutil.ReadFile(source)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read registry policy %s, error: %s", source, err)
+	}
+
+	p := &Policy{}
+	if err := yaml.Unmarshal(content, p); err != nil {
+		return nil, fmt.Errorf("Failed to parse registry policy %s, error: %s", source, err)
+	}
+	p.Source = source
+
+	switch p.Mode {
+	case "":
+		p.Mode = ModeEnforce
+	case ModeEnforce, ModeWarn:
+	default:
+		return nil, fmt.Errorf("Registry policy %s: mode should be %s or %s, got %q", source, ModeEnforce, ModeWarn, p.Mode)
+	}
+	if len(p.Registries) == 0 {
+		return nil, fmt.Errorf("Registry policy %s: no registries are approved", source)
+	}
+
+	for i, r := range p.Registries {
+		p.Registries[i] = normalizeRegistry(strings.TrimSuffix(r, "/"))
+	}
+	for i, ns := range p.Namespaces {
+		p.Namespaces[i] = strings.TrimSuffix(ns, "/")
+	}
+
+	return p, nil
+}
+
+func fetch(url string) ([]byte, error) {
+	resp, err := http.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET %s returned %s", url, resp.Status)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+// Name tells which policy it is in the messages: the file or the url it is
+// loaded from, if any
+func (p *Policy) Name() string {
+	if p.Source == "" {
+		return "registry policy"
+	}
+	return "registry policy " + p.Source
+}
+
+// Enforced tells if the build should fail on the violations
+func (p *Policy) Enforced() bool {
+	return p.Mode != ModeWarn
+}
+
+// CheckPull returns a violation if the image of FROM or COPY --from is not
+// in an approved registry or namespace
+func (p *Policy) CheckPull(instruction, name string) *Violation {
+	img := imagename.NewFromString(name)
+	registry := Registry(img)
+
+	if !p.approvedRegistry(registry) {
+		return &Violation{
+			Instruction: instruction,
+			Image:       name,
+			Rule:        RuleRegistries,
+			Reason:      fmt.Sprintf("%s is not an approved registry", registry),
+			Suggestion:  p.suggest(img, p.Registries),
+		}
+	}
+
+	if len(p.Namespaces) == 0 {
+		return nil
+	}
+	repository := Repository(img)
+	for _, ns := range p.Namespaces {
+		if repository == ns || strings.HasPrefix(repository, ns+"/") {
+			return nil
+		}
+	}
+
+	return &Violation{
+		Instruction: instruction,
+		Image:       name,
+		Rule:        RuleNamespaces,
+		Reason:      fmt.Sprintf("%s is not in an approved namespace", repository),
+		Suggestion:  p.suggest(img, p.Namespaces),
+	}
+}
+
+// CheckPush returns a violation if the image is pushed to a registry that is
+// not approved
+func (p *Policy) CheckPush(name string) *Violation {
+	img := imagename.NewFromString(name)
+	registry := Registry(img)
+
+	if p.approvedRegistry(registry) {
+		return nil
+	}
+	return &Violation{
+		Instruction: "PUSH",
+		Image:       name,
+		Rule:        RuleRegistries,
+		Reason:      fmt.Sprintf("%s is not an approved registry", registry),
+		Suggestion:  fmt.Sprintf("push to %s instead", strings.Join(p.Registries, " or ")),
+	}
+}
+
+func (p *Policy) approvedRegistry(registry string) bool {
+	for _, r := range p.Registries {
+		if r == registry {
+			return true
+		}
+	}
+	return false
+}
+
+// suggest tells where the image should come from instead, with the mirror
+// of a Docker Hub image if the policy has one
+func (p *Policy) suggest(img *imagename.ImageName, allowed []string) string {
+	msg := fmt.Sprintf("use an image of %s", strings.Join(allowed, " or "))
+	if p.Mirror != "" && Registry(img) == DockerHub {
+		mirrored := imagename.New(p.Mirror+"/"+strings.TrimPrefix(Repository(img), DockerHub+"/"), img.GetTag())
+		msg += fmt.Sprintf(", e.g. the mirror %s", mirrored)
+	}
+	return msg
+}
+
+// Registry returns the name of the registry of the image the way the policy names it
+func Registry(img *imagename.ImageName) string {
+	if img.Storage == imagename.StorageS3 {
+		return "s3.amazonaws.com/" + img.Registry
+	}
+	if img.Registry == "" {
+		return DockerHub
+	}
+	return normalizeRegistry(img.Registry)
+}
+
+// Repository returns the registry and the repository of the image, the official
+// images of Docker Hub are under docker.io/library
+func Repository(img *imagename.ImageName) string {
+	name := img.Name
+	if Registry(img) == DockerHub && !strings.Contains(name, "/") {
+		name = "library/" + name
+	}
+	return Registry(img) + "/" + name
+}
+
+func normalizeRegistry(registry string) string {
+	switch registry {
+	case "index.docker.io", "registry-1.docker.io", "registry.hub.docker.com":
+		return DockerHub
+	}
+	return registry
+}
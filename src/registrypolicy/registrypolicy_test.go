@@ -0,0 +1,107 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package registrypolicy
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func writePolicy(t *testing.T, content string) (file string, cleanup func()) {
+	dir, err := ioutil.TempDir("", "rocker-registry-policy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	file = filepath.Join(dir, "registry-policy.yml")
+	if err := ioutil.WriteFile(file, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return file, func() { os.RemoveAll(dir) }
+}
+
+func TestLoad(t *testing.T) {
+	file, cleanup := writePolicy(t, `
+registries:
+  - registry.corp.example.com/
+  - index.docker.io
+namespaces:
+  - registry.corp.example.com/base/
+`)
+	defer cleanup()
+
+	p, err := Load(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, ModeEnforce, p.Mode)
+	assert.True(t, p.Enforced())
+	assert.Equal(t, []string{"registry.corp.example.com", "docker.io"}, p.Registries)
+	assert.Equal(t, []string{"registry.corp.example.com/base"}, p.Namespaces)
+	assert.Equal(t, file, p.Source)
+}
+
+func TestLoad_Invalid(t *testing.T) {
+	file, cleanup := writePolicy(t, "mode: audit\nregistries: [quay.io]\n")
+	defer cleanup()
+
+	_, err := Load(file)
+	assert.EqualError(t, err, `Registry policy `+file+`: mode should be enforce or warn, got "audit"`)
+
+	file2, cleanup2 := writePolicy(t, "mode: warn\n")
+	defer cleanup2()
+
+	_, err = Load(file2)
+	assert.EqualError(t, err, "Registry policy "+file2+": no registries are approved")
+}
+
+func TestPolicy_CheckPull(t *testing.T) {
+	p := &Policy{
+		Mode:       ModeEnforce,
+		Registries: []string{"registry.corp.example.com", "quay.io"},
+		Namespaces: []string{"registry.corp.example.com/base", "quay.io/acme"},
+		Mirror:     "registry.corp.example.com/hub",
+	}
+
+	assert.Nil(t, p.CheckPull("FROM", "registry.corp.example.com/base/alpine:3.20"))
+	assert.Nil(t, p.CheckPull("FROM", "quay.io/acme:1.0"))
+	assert.Nil(t, p.CheckPull("COPY --from", "quay.io/acme/tools"))
+
+	v := p.CheckPull("FROM", "alpine:3.20")
+	assert.EqualError(t, v, "FROM alpine:3.20: docker.io is not an approved registry, "+
+		"use an image of registry.corp.example.com or quay.io, e.g. the mirror registry.corp.example.com/hub/library/alpine:3.20")
+
+	v = p.CheckPull("FROM", "quay.io/acmecorp/base")
+	assert.EqualError(t, v, "FROM quay.io/acmecorp/base: quay.io/acmecorp/base is not in an approved namespace, "+
+		"use an image of registry.corp.example.com/base or quay.io/acme")
+
+	// without namespaces any image of the approved registries is fine
+	p.Namespaces = nil
+	assert.Nil(t, p.CheckPull("FROM", "quay.io/someone/base"))
+}
+
+func TestPolicy_CheckPush(t *testing.T) {
+	p := &Policy{Registries: []string{"quay.io", "s3.amazonaws.com/releases"}}
+
+	assert.Nil(t, p.CheckPush("quay.io/acme/app:1.0"))
+	assert.Nil(t, p.CheckPush("s3.amazonaws.com/releases/app:1.0"))
+	assert.EqualError(t, p.CheckPush("acme/app:1.0"),
+		"PUSH acme/app:1.0: docker.io is not an approved registry, push to quay.io or s3.amazonaws.com/releases instead")
+}
@@ -0,0 +1,246 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package release
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	"github.com/grammarly/rocker/src/build"
+	"github.com/grammarly/rocker/src/cliutil"
+	"github.com/grammarly/rocker/src/dockerclient"
+	"github.com/grammarly/rocker/src/imagename"
+	"github.com/grammarly/rocker/src/rotate"
+	"github.com/grammarly/rocker/src/workspace"
+
+	"github.com/codegangsta/cli"
+	"github.com/fsouza/go-dockerclient"
+	"github.com/go-yaml/yaml"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// CommandSpec returns specifications of the release command for codegangsta/cli
+func CommandSpec() cli.Command {
+	return cli.Command{
+		Name:   "release",
+		Usage:  "runs the release pipeline of .rocker.yml: build, test, scan, sign, push, rotate and webhook",
+		Action: releaseCommand,
+		Flags: []cli.Flag{
+			cli.StringFlag{
+				Name:  "file, f",
+				Value: DefaultFile,
+				Usage: "the config with the release section",
+			},
+			cli.StringSliceFlag{
+				Name:  "skip",
+				Value: &cli.StringSlice{},
+				Usage: "a phase not to run, e.g. --skip sign --skip webhook",
+			},
+			cli.BoolFlag{
+				Name:  "resume",
+				Usage: "continue the last release that failed from the phase that failed",
+			},
+			cli.StringFlag{
+				Name:  "auth, a",
+				Value: "",
+				Usage: "Username and password in user:password format",
+			},
+			cli.StringFlag{
+				Name:  "cache-dir",
+				Value: "~/.rocker_cache",
+				Usage: "Set the directory where the cache will be stored",
+			},
+		},
+	}
+}
+
+// releaseCommand implements 'release' command that runs the release pipeline
+func releaseCommand(c *cli.Context) {
+	cfg, err := Load(c.String("file"))
+	if err != nil {
+		cliutil.Exit(build.WithExitCode(build.ExitUser, err))
+	}
+
+	skip := map[string]bool{}
+	if err := ValidatePhases(c.StringSlice("skip")); err != nil {
+		cliutil.Exit(build.WithExitCode(build.ExitUser, err))
+	}
+	for _, phase := range c.StringSlice("skip") {
+		skip[phase] = true
+	}
+
+	var routes []build.PushRoute
+	if cfg.Push.Routes != "" {
+		if routes, err = build.LoadPushRoutes(cfg.Push.Routes); err != nil {
+			cliutil.Exit(build.WithExitCode(build.ExitUser, err))
+		}
+	}
+	auth, err := build.AddPushRoutesAuth(cliutil.InitAuth(c), routes)
+	if err != nil {
+		cliutil.Exit(build.WithExitCode(build.ExitUser, err))
+	}
+	cliutil.RedactAuth(auth)
+
+	dockerClient, err := dockerclient.NewFromCli(c)
+	if err != nil {
+		cliutil.Exit(build.WithExitCode(build.ExitInfra, err))
+	}
+
+	tmpDir, err := ioutil.TempDir("", "rocker-release-")
+	if err != nil {
+		cliutil.Exit(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	runner := &cliRunner{
+		c:      c,
+		dir:    cfg.Dir,
+		tmpDir: tmpDir,
+		routes: routes,
+		auth:   auth,
+		client: cliutil.NewCommandClient(c, dockerClient, auth),
+	}
+
+	if err := cfg.Run(runner, Options{Skip: skip, Resume: c.Bool("resume")}); err != nil {
+		os.RemoveAll(tmpDir)
+		cliutil.Exit(err)
+	}
+}
+
+// cliRunner runs the phases of `rocker release` with rocker itself,
+// the shell and the docker daemon
+type cliRunner struct {
+	c      *cli.Context
+	dir    string
+	tmpDir string
+	routes []build.PushRoute
+	auth   *docker.AuthConfigurations
+	client *build.DockerClient
+	builds int
+}
+
+// Build implements Runner
+func (r *cliRunner) Build(phase BuildPhase) ([]imagename.Artifact, error) {
+	r.builds++
+
+	content, err := yaml.Marshal(phase.Vars.ToMapOfInterface())
+	if err != nil {
+		return nil, err
+	}
+	varsFile := filepath.Join(r.tmpDir, fmt.Sprintf("vars-%d.yml", r.builds))
+	if err := ioutil.WriteFile(varsFile, content, 0644); err != nil {
+		return nil, err
+	}
+	artifactsDir := filepath.Join(r.tmpDir, fmt.Sprintf("artifacts-%d", r.builds))
+
+	args := append(cliutil.GlobalArgs("release"),
+		"build",
+		"--file", phase.Rockerfile,
+		"--vars", varsFile,
+		"--artifacts-path", artifactsDir,
+		"--cache-dir", r.c.String("cache-dir"),
+	)
+	args = append(args, phase.Args...)
+	args = append(args, phase.Context)
+
+	cmd := exec.Command(os.Args[0], args...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("Build of %s failed, error: %s", phase.Rockerfile, err)
+	}
+
+	return workspace.ReadArtifacts(artifactsDir)
+}
+
+// Run implements Runner
+func (r *cliRunner) Run(command string) error {
+	log.Infof("| Run %s", command)
+
+	cmd := exec.Command("/bin/sh", "-c", command)
+	cmd.Dir = r.dir
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	return cmd.Run()
+}
+
+// Push implements Runner
+func (r *cliRunner) Push(images []imagename.Artifact) ([]imagename.Artifact, error) {
+	pushed := []imagename.Artifact{}
+
+	for _, image := range images {
+		targets, err := build.ResolvePushTargets(r.routes, image.Name.String())
+		if err != nil {
+			return nil, err
+		}
+
+		for _, target := range targets {
+			if err := r.client.TagImage(image.ImageID, target); err != nil {
+				return nil, err
+			}
+			digest, err := r.client.PushImage(context.Background(), target)
+			if err != nil {
+				return nil, err
+			}
+
+			artifact := image
+			artifact.Name = imagename.NewFromString(target)
+			artifact.Tag = artifact.Name.GetTag()
+			artifact.Pushed = true
+			artifact.SetDigest(digest)
+			pushed = append(pushed, artifact)
+		}
+	}
+
+	return pushed, nil
+}
+
+// Rotate implements Runner
+func (r *cliRunner) Rotate(images []imagename.Artifact, phase RotatePhase) error {
+	failed := false
+	rotated := map[string]bool{}
+
+	for _, image := range images {
+		repository, tag := image.Name.NameWithRegistry(), image.Name.GetTag()
+		if rotated[repository] || !rotate.Match(phase.Pattern, tag) {
+			continue
+		}
+		rotated[repository] = true
+
+		opts := rotate.Options{Keep: phase.Keep, Pattern: phase.Pattern, Current: tag}
+		report, err := rotate.Registry(rotate.DockerRegistry{Auth: r.auth}, repository, opts)
+		if err != nil {
+			return err
+		}
+		failed = rotate.PrintReport("in "+repository, report, false) || failed
+	}
+
+	if len(rotated) == 0 {
+		log.Infof("| No pushed tag matches %s, nothing to rotate", phase.Pattern)
+	}
+	if failed {
+		return fmt.Errorf("Failed to remove some of the old tags")
+	}
+	return nil
+}
@@ -0,0 +1,491 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package release runs the pipeline of `rocker release` that the release section
+// of .rocker.yml defines: the build of the images, their tests, scan and signature,
+// the push, the rotation of the old tags and the webhook that announces the release.
+package release
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+
+	"github.com/grammarly/rocker/src/imagename"
+	"github.com/grammarly/rocker/src/rotate"
+	rockertemplate "github.com/grammarly/rocker/src/template"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/go-yaml/yaml"
+)
+
+// DefaultFile is the name of the config looked up in the current directory
+const DefaultFile = ".rocker.yml"
+
+// DefaultStateFile keeps the progress of the release for --resume, next to the config
+const DefaultStateFile = ".rocker-release.yml"
+
+// The phases of the pipeline
+const (
+	PhaseBuild   = "build"
+	PhaseTest    = "test"
+	PhaseScan    = "scan"
+	PhaseSign    = "sign"
+	PhasePush    = "push"
+	PhaseRotate  = "rotate"
+	PhaseWebhook = "webhook"
+)
+
+// Phases lists the phases in the order they run
+var Phases = []string{PhaseBuild, PhaseTest, PhaseScan, PhaseSign, PhasePush, PhaseRotate, PhaseWebhook}
+
+// Config is the release section of .rocker.yml, of the form
+//
+//	release:
+//	  build:
+//	    rockerfile: Rockerfile
+//	    vars:
+//	      Version: 1.2.0
+//	    args: [--squash]
+//	  test:
+//	    rockerfile: Rockerfile.test
+//	  scan:
+//	    command: trivy image --exit-code 1 {{ .Image }}
+//	  sign:
+//	    command: cosign sign --key cosign.key {{ .Image }}
+//	  push:
+//	    routes: routes.yml
+//	  rotate:
+//	    pattern: "1.*"
+//	    keep: 5
+//	  webhook:
+//	    url: https://ci.acme.com/hooks/release
+//
+// A phase runs if it is configured and has no `skip: true`
+type Config struct {
+	// Dir is where the config is, the paths are relative to it
+	Dir string `yaml:"-"`
+	// StateFile keeps the progress for --resume, DefaultStateFile by default
+	StateFile string `yaml:"state_file"`
+
+	Build   BuildPhase   `yaml:"build"`
+	Test    BuildPhase   `yaml:"test"`
+	Scan    CommandPhase `yaml:"scan"`
+	Sign    CommandPhase `yaml:"sign"`
+	Push    PushPhase    `yaml:"push"`
+	Rotate  RotatePhase  `yaml:"rotate"`
+	Webhook WebhookPhase `yaml:"webhook"`
+
+	// checksum of the config file, a release is only resumed with the same config
+	checksum string
+}
+
+// BuildPhase is a `rocker build` of a Rockerfile: the one of the release, whose
+// PUSH instructions name the released images, or the one of the test, which
+// gets the image to test as the .Image variable
+type BuildPhase struct {
+	Skip bool `yaml:"skip"`
+	// Rockerfile is "Rockerfile" for the build, the test has none by default
+	Rockerfile string `yaml:"rockerfile"`
+	// Context is the context directory, the directory of the config by default
+	Context string              `yaml:"context"`
+	Vars    rockertemplate.Vars `yaml:"vars"`
+	// Args are more options of `rocker build`
+	Args []string `yaml:"args"`
+}
+
+// CommandPhase is a shell command run for every image; it is a template that
+// can refer to .Image, .Name, .Tag and .ImageID of the image
+type CommandPhase struct {
+	Skip    bool   `yaml:"skip"`
+	Command string `yaml:"command"`
+}
+
+// PushPhase pushes the images, to the targets of the push routes if given
+type PushPhase struct {
+	Skip bool `yaml:"skip"`
+	// Routes is a file of the rules of --push-routes
+	Routes string `yaml:"routes"`
+}
+
+// RotatePhase removes the old tags matching the pattern from the repositories
+// of the pushed images, as `rocker tag-rotate --push` does
+type RotatePhase struct {
+	Skip    bool   `yaml:"skip"`
+	Pattern string `yaml:"pattern"`
+	Keep    int    `yaml:"keep"`
+}
+
+// WebhookPhase posts the released images to the URL
+type WebhookPhase struct {
+	Skip    bool              `yaml:"skip"`
+	URL     string            `yaml:"url"`
+	Headers map[string]string `yaml:"headers"`
+}
+
+// WebhookPayload is the JSON body of the webhook
+type WebhookPayload struct {
+	Images []imagename.Artifact `json:"images"`
+}
+
+// Runner does the work of the phases that need docker and rocker itself
+type Runner interface {
+	// Build runs `rocker build` and returns the images its PUSH instructions name
+	Build(phase BuildPhase) ([]imagename.Artifact, error)
+	// Run runs a shell command in the directory of the config
+	Run(command string) error
+	// Push pushes the images to the targets of the push routes, or to their own
+	// names if there are no routes, and returns the pushed ones
+	Push(images []imagename.Artifact) ([]imagename.Artifact, error)
+	// Rotate removes the old tags matching the pattern from the repositories of the images
+	Rotate(images []imagename.Artifact, phase RotatePhase) error
+}
+
+// Options are the command line options of the pipeline
+type Options struct {
+	// Skip are the phases not to run
+	Skip map[string]bool
+	// Resume continues the last release that failed from the phase that failed
+	Resume bool
+}
+
+// State is the progress of the release kept in the state file
+type State struct {
+	// Checksum of the config, a release is not resumed if it changed
+	Checksum string               `yaml:"checksum"`
+	Done     []string             `yaml:"done"`
+	Built    []imagename.Artifact `yaml:"built"`
+	Pushed   []imagename.Artifact `yaml:"pushed"`
+}
+
+// Load reads the release section of the config file and fills in the defaults
+func Load(file string) (*Config, error) {
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	var f struct {
+		Release *Config `yaml:"release"`
+	}
+	if err := yaml.Unmarshal(content, &f); err != nil {
+		return nil, fmt.Errorf("Failed to parse %s, error: %s", file, err)
+	}
+	if f.Release == nil {
+		return nil, fmt.Errorf("%s has no release section", file)
+	}
+	c := f.Release
+
+	if c.Dir, err = filepath.Abs(filepath.Dir(file)); err != nil {
+		return nil, err
+	}
+	if c.StateFile == "" {
+		c.StateFile = DefaultStateFile
+	}
+	if c.Build.Rockerfile == "" {
+		c.Build.Rockerfile = "Rockerfile"
+	}
+
+	for _, phase := range []*BuildPhase{&c.Build, &c.Test} {
+		if phase.Context == "" {
+			phase.Context = "."
+		}
+		if phase.Rockerfile != "" {
+			phase.Rockerfile = c.path(phase.Rockerfile)
+		}
+		phase.Context = c.path(phase.Context)
+	}
+	if c.Push.Routes != "" {
+		c.Push.Routes = c.path(c.Push.Routes)
+	}
+	c.StateFile = c.path(c.StateFile)
+
+	if c.Rotate.Pattern != "" {
+		if err := rotate.ValidatePattern(c.Rotate.Pattern); err != nil {
+			return nil, err
+		}
+		if c.Rotate.Keep < 1 {
+			return nil, fmt.Errorf("rotate.keep in %s should be at least 1, the released tag is always kept", file)
+		}
+	}
+
+	c.checksum = fmt.Sprintf("%x", sha256.Sum256(content))
+
+	return c, nil
+}
+
+func (c *Config) path(p string) string {
+	if filepath.IsAbs(p) {
+		return p
+	}
+	return filepath.Join(c.Dir, filepath.FromSlash(p))
+}
+
+// Configured tells if the phase has what it needs to run
+func (c *Config) Configured(phase string) bool {
+	switch phase {
+	case PhaseBuild:
+		return !c.Build.Skip
+	case PhaseTest:
+		return !c.Test.Skip && c.Test.Rockerfile != ""
+	case PhaseScan:
+		return !c.Scan.Skip && c.Scan.Command != ""
+	case PhaseSign:
+		return !c.Sign.Skip && c.Sign.Command != ""
+	case PhasePush:
+		return !c.Push.Skip
+	case PhaseRotate:
+		return !c.Rotate.Skip && c.Rotate.Pattern != ""
+	case PhaseWebhook:
+		return !c.Webhook.Skip && c.Webhook.URL != ""
+	}
+	return false
+}
+
+// ValidatePhases checks the names given to --skip
+func ValidatePhases(names []string) error {
+	for _, name := range names {
+		known := false
+		for _, phase := range Phases {
+			known = known || name == phase
+		}
+		if !known {
+			return fmt.Errorf("Unknown phase %q, the phases are %s", name, strings.Join(Phases, ", "))
+		}
+	}
+	return nil
+}
+
+// Run runs the phases of the pipeline in order and keeps the progress in the state
+// file after each one; the file is removed when the release succeeds
+func (c *Config) Run(runner Runner, opts Options) error {
+	state := &State{Checksum: c.checksum}
+
+	if opts.Resume {
+		prev, err := c.readState()
+		switch {
+		case err != nil && os.IsNotExist(err):
+			log.Infof("Nothing to resume, the last release succeeded or did not start")
+		case err != nil:
+			log.Warnf("Cannot resume, release from the beginning: %s", err)
+		case prev.Checksum != c.checksum:
+			log.Warnf("Cannot resume, the config changed since the last release; release from the beginning")
+		default:
+			state = prev
+		}
+	}
+
+	done := map[string]bool{}
+	for _, phase := range state.Done {
+		done[phase] = true
+	}
+
+	for _, phase := range Phases {
+		if done[phase] {
+			log.Infof("Phase %s is done in the last release", phase)
+			continue
+		}
+		if opts.Skip[phase] || !c.Configured(phase) {
+			log.Infof("Skip phase %s", phase)
+			continue
+		}
+
+		log.Infof("Phase %s", phase)
+
+		if err := c.runPhase(phase, runner, state); err != nil {
+			log.Errorf("Phase %s failed, run `rocker release --resume` to continue from it", phase)
+			return err
+		}
+
+		state.Done = append(state.Done, phase)
+		if err := c.writeState(state); err != nil {
+			return err
+		}
+	}
+
+	if err := os.Remove(c.StateFile); err != nil && !os.IsNotExist(err) {
+		log.Warnf("Failed to remove %s, error: %s", c.StateFile, err)
+	}
+
+	return nil
+}
+
+func (c *Config) runPhase(phase string, runner Runner, state *State) (err error) {
+	if phase != PhaseBuild && len(state.Built) == 0 {
+		return fmt.Errorf("Nothing to %s, the build gave no images; the Rockerfile should PUSH the released images", phase)
+	}
+
+	switch phase {
+	case PhaseBuild:
+		if state.Built, err = runner.Build(c.Build); err != nil {
+			return err
+		}
+		if len(state.Built) == 0 {
+			return fmt.Errorf("The build gave no images; the Rockerfile should PUSH the released images")
+		}
+		state.Pushed = nil
+
+	case PhaseTest:
+		for _, image := range distinctImages(state.Built) {
+			test := c.Test
+			test.Vars = rockertemplate.Vars{}.Merge(c.Test.Vars, rockertemplate.Vars{"Image": image.Name.String()})
+			if _, err := runner.Build(test); err != nil {
+				return fmt.Errorf("Test of %s failed, error: %s", image.Name, err)
+			}
+		}
+
+	case PhaseScan, PhaseSign:
+		// An image is scanned once, but every name of it gets a signature
+		command, images := c.Scan.Command, distinctImages(state.Built)
+		if phase == PhaseSign {
+			command, images = c.Sign.Command, state.Built
+		}
+		for _, image := range images {
+			cmd, err := renderCommand(command, image)
+			if err != nil {
+				return err
+			}
+			if err := runner.Run(cmd); err != nil {
+				return fmt.Errorf("Failed to %s %s, error: %s", phase, image.Name, err)
+			}
+		}
+
+	case PhasePush:
+		if state.Pushed, err = runner.Push(state.Built); err != nil {
+			return err
+		}
+
+	case PhaseRotate:
+		if len(state.Pushed) == 0 {
+			log.Infof("| Nothing to rotate, no images were pushed")
+			return nil
+		}
+		return runner.Rotate(state.Pushed, c.Rotate)
+
+	case PhaseWebhook:
+		images := state.Pushed
+		if len(images) == 0 {
+			images = state.Built
+		}
+		return postWebhook(c.Webhook, WebhookPayload{Images: images})
+	}
+
+	return nil
+}
+
+// distinctImages returns the first of the artifacts of every image
+func distinctImages(artifacts []imagename.Artifact) []imagename.Artifact {
+	var (
+		result = []imagename.Artifact{}
+		seen   = map[string]bool{}
+	)
+	for _, a := range artifacts {
+		if a.ImageID != "" && seen[a.ImageID] {
+			continue
+		}
+		seen[a.ImageID] = true
+		result = append(result, a)
+	}
+	return result
+}
+
+// commandData is what the commands of the phases can refer to
+type commandData struct {
+	Image   string
+	Name    string
+	Tag     string
+	ImageID string
+}
+
+func renderCommand(command string, image imagename.Artifact) (string, error) {
+	tpl, err := template.New("").Parse(command)
+	if err != nil {
+		return "", fmt.Errorf("Failed to parse command %q, error: %s", command, err)
+	}
+
+	data := commandData{
+		Image:   image.Name.String(),
+		Name:    image.Name.NameWithRegistry(),
+		Tag:     image.Name.GetTag(),
+		ImageID: image.ImageID,
+	}
+
+	buf := &bytes.Buffer{}
+	if err := tpl.Execute(buf, data); err != nil {
+		return "", fmt.Errorf("Failed to render command %q for %s, error: %s", command, image.Name, err)
+	}
+	return buf.String(), nil
+}
+
+func postWebhook(w WebhookPhase, payload WebhookPayload) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", os.ExpandEnv(w.URL), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	// $VARS keep the tokens out of the config
+	for name, value := range w.Headers {
+		req.Header.Set(name, os.ExpandEnv(value))
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("Failed to call the webhook, error: %s", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("The webhook responded with %s", resp.Status)
+	}
+
+	log.Infof("| Posted %d images to the webhook", len(payload.Images))
+	return nil
+}
+
+func (c *Config) readState() (*State, error) {
+	content, err := ioutil.ReadFile(c.StateFile)
+	if err != nil {
+		return nil, err
+	}
+	state := &State{}
+	if err := yaml.Unmarshal(content, state); err != nil {
+		return nil, fmt.Errorf("Failed to parse %s, error: %s", c.StateFile, err)
+	}
+	return state, nil
+}
+
+func (c *Config) writeState(state *State) error {
+	content, err := yaml.Marshal(state)
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(c.StateFile, content, 0644); err != nil {
+		return fmt.Errorf("Failed to write the progress of the release to %s, error: %s", c.StateFile, err)
+	}
+	return nil
+}
@@ -0,0 +1,248 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package release
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/grammarly/rocker/src/imagename"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const config = `
+release:
+  build:
+    vars:
+      Version: 1.2.0
+    args: [--squash]
+  test:
+    rockerfile: Rockerfile.test
+  scan:
+    command: scan {{ .Image }}
+  sign:
+    command: sign {{ .Name }}:{{ .Tag }}
+  push:
+    routes: routes.yml
+  rotate:
+    pattern: "1.*"
+    keep: 3
+`
+
+func writeConfig(t *testing.T, content string) (dir, file string) {
+	dir, err := ioutil.TempDir("", "rocker-release-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	file = filepath.Join(dir, DefaultFile)
+	if err := ioutil.WriteFile(file, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return dir, file
+}
+
+// fakeRunner records what the phases ask for; a call fails if it is in fail
+type fakeRunner struct {
+	calls []string
+	fail  string
+}
+
+func (r *fakeRunner) call(name string) error {
+	r.calls = append(r.calls, name)
+	if name == r.fail {
+		return fmt.Errorf("%s failed", name)
+	}
+	return nil
+}
+
+func (r *fakeRunner) Build(phase BuildPhase) ([]imagename.Artifact, error) {
+	name := "build " + filepath.Base(phase.Rockerfile)
+	if image, ok := phase.Vars["Image"]; ok {
+		name += " " + image.(string)
+	}
+	if err := r.call(name); err != nil {
+		return nil, err
+	}
+	return []imagename.Artifact{
+		{Name: imagename.NewFromString("acme/app:1.2.0"), ImageID: "sha256:111"},
+		{Name: imagename.NewFromString("acme/app:latest"), ImageID: "sha256:111"},
+	}, nil
+}
+
+func (r *fakeRunner) Run(command string) error {
+	return r.call(command)
+}
+
+func (r *fakeRunner) Push(images []imagename.Artifact) ([]imagename.Artifact, error) {
+	if err := r.call("push"); err != nil {
+		return nil, err
+	}
+	return images, nil
+}
+
+func (r *fakeRunner) Rotate(images []imagename.Artifact, phase RotatePhase) error {
+	return r.call(fmt.Sprintf("rotate %s %d", phase.Pattern, phase.Keep))
+}
+
+func TestLoad(t *testing.T) {
+	dir, file := writeConfig(t, config)
+	defer os.RemoveAll(dir)
+
+	c, err := Load(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, filepath.Join(dir, "Rockerfile"), c.Build.Rockerfile)
+	assert.Equal(t, dir, c.Build.Context)
+	assert.Equal(t, filepath.Join(dir, "Rockerfile.test"), c.Test.Rockerfile)
+	assert.Equal(t, filepath.Join(dir, "routes.yml"), c.Push.Routes)
+	assert.Equal(t, filepath.Join(dir, DefaultStateFile), c.StateFile)
+	assert.Equal(t, []string{"--squash"}, c.Build.Args)
+
+	for _, phase := range Phases {
+		assert.Equal(t, phase != PhaseWebhook, c.Configured(phase), phase)
+	}
+}
+
+func TestLoad_Invalid(t *testing.T) {
+	tests := map[string]string{
+		"build: {}": "has no release section",
+		"release:\n  rotate:\n    pattern: '1.*'":            "should be at least 1",
+		"release:\n  rotate:\n    pattern: '['\n    keep: 2": "Invalid pattern",
+	}
+
+	for content, message := range tests {
+		dir, file := writeConfig(t, content)
+		_, err := Load(file)
+		os.RemoveAll(dir)
+
+		if assert.Error(t, err, content) {
+			assert.Contains(t, err.Error(), message)
+		}
+	}
+}
+
+func TestValidatePhases(t *testing.T) {
+	assert.NoError(t, ValidatePhases([]string{"sign", "webhook"}))
+	assert.Error(t, ValidatePhases([]string{"deploy"}))
+}
+
+func TestRun(t *testing.T) {
+	dir, file := writeConfig(t, config)
+	defer os.RemoveAll(dir)
+
+	c, err := Load(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := &fakeRunner{}
+	if err := c.Run(r, Options{Skip: map[string]bool{PhaseScan: true}}); err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, []string{
+		"build Rockerfile",
+		"build Rockerfile.test acme/app:1.2.0",
+		"sign acme/app:1.2.0",
+		"sign acme/app:latest",
+		"push",
+		"rotate 1.* 3",
+	}, r.calls)
+
+	_, err = os.Stat(c.StateFile)
+	assert.True(t, os.IsNotExist(err), "the state file is removed")
+}
+
+func TestRun_Resume(t *testing.T) {
+	dir, file := writeConfig(t, config)
+	defer os.RemoveAll(dir)
+
+	c, err := Load(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := &fakeRunner{fail: "push"}
+	assert.Error(t, c.Run(r, Options{}))
+
+	r = &fakeRunner{}
+	if err := c.Run(r, Options{Resume: true}); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []string{"push", "rotate 1.* 3"}, r.calls)
+
+	// without --resume the release starts over
+	r = &fakeRunner{fail: "scan acme/app:1.2.0"}
+	assert.Error(t, c.Run(r, Options{}))
+	r = &fakeRunner{}
+	if err := c.Run(r, Options{}); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "build Rockerfile", r.calls[0])
+}
+
+func TestRun_Webhook(t *testing.T) {
+	var payload WebhookPayload
+	var token string
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		token = req.Header.Get("Authorization")
+		if err := json.NewDecoder(req.Body).Decode(&payload); err != nil {
+			t.Fatal(err)
+		}
+	}))
+	defer server.Close()
+
+	os.Setenv("ROCKER_TEST_WEBHOOK_TOKEN", "secret")
+	defer os.Unsetenv("ROCKER_TEST_WEBHOOK_TOKEN")
+
+	dir, file := writeConfig(t, `
+release:
+  push:
+    skip: true
+  webhook:
+    url: `+server.URL+`
+    headers:
+      Authorization: Bearer $ROCKER_TEST_WEBHOOK_TOKEN
+`)
+	defer os.RemoveAll(dir)
+
+	c, err := Load(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := &fakeRunner{}
+	if err := c.Run(r, Options{}); err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, []string{"build Rockerfile"}, r.calls)
+	assert.Equal(t, "Bearer secret", token)
+	if assert.Len(t, payload.Images, 2) {
+		assert.Equal(t, "acme/app:1.2.0", payload.Images[0].Name.String())
+	}
+}
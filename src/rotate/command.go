@@ -0,0 +1,209 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package rotate
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/grammarly/rocker/src/build"
+	"github.com/grammarly/rocker/src/cliutil"
+	"github.com/grammarly/rocker/src/dockerclient"
+	"github.com/grammarly/rocker/src/imagename"
+
+	"github.com/codegangsta/cli"
+	"github.com/fsouza/go-dockerclient"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// CommandSpec returns specifications of the tag-rotate command for codegangsta/cli
+func CommandSpec() cli.Command {
+	return cli.Command{
+		Name:   "tag-rotate",
+		Usage:  "tags the image as <name:tag> and removes the oldest tags of the repository matching the pattern",
+		Action: tagRotateCommand,
+		Flags: []cli.Flag{
+			cli.StringFlag{
+				Name:  "image",
+				Usage: "the image to tag as <name:tag>, e.g. the one the build produced; if not given, <name:tag> has to exist",
+			},
+			cli.StringFlag{
+				Name:  "pattern",
+				Usage: "the tags to rotate, a glob such as 'nightly-*'; <name:tag> has to match it",
+			},
+			cli.IntFlag{
+				Name:  "keep",
+				Value: 5,
+				Usage: "how many of the newest matching tags to keep, <name:tag> included",
+			},
+			cli.BoolFlag{
+				Name:  "push",
+				Usage: "push <name:tag> and remove the old tags from the registry too",
+			},
+			cli.StringFlag{
+				Name:  "auth, a",
+				Value: "",
+				Usage: "Username and password in user:password format",
+			},
+			cli.StringFlag{
+				Name:  "cache-dir",
+				Value: "~/.rocker_cache",
+				Usage: "Set the directory where the cache will be stored",
+			},
+			cli.BoolFlag{
+				Name:  "dry-run",
+				Usage: "only print what would be tagged, pushed and removed",
+			},
+		},
+	}
+}
+
+// tagRotateCommand implements 'tag-rotate' command that tags the image and removes
+// the old tags locally and, with --push, in the registry
+func tagRotateCommand(c *cli.Context) {
+	args := c.Args()
+	if len(args) != 1 {
+		cliutil.Exitf(build.ExitUser, "rocker tag-rotate [--image <image>] --pattern <glob> <name:tag>")
+	}
+
+	name := imagename.NewFromString(args[0])
+	if !name.HasTag() {
+		cliutil.Exitf(build.ExitUser, "%s should have a tag", args[0])
+	}
+	if name.Storage == imagename.StorageS3 && c.Bool("push") {
+		cliutil.Exitf(build.ExitUser, "tag-rotate removes tags from docker registries only, got %s", name)
+	}
+
+	opts := Options{
+		Keep:    c.Int("keep"),
+		Pattern: c.String("pattern"),
+		Current: name.GetTag(),
+		DryRun:  c.Bool("dry-run"),
+	}
+	if opts.Pattern == "" {
+		cliutil.Exitf(build.ExitUser, "--pattern is required, e.g. --pattern 'nightly-*'")
+	}
+	if err := ValidatePattern(opts.Pattern); err != nil {
+		cliutil.Exit(build.WithExitCode(build.ExitUser, err))
+	}
+	if !Match(opts.Pattern, opts.Current) {
+		cliutil.Exitf(build.ExitUser, "Tag %s does not match --pattern %s", opts.Current, opts.Pattern)
+	}
+	if opts.Keep < 1 {
+		cliutil.Exitf(build.ExitUser, "--keep should be at least 1, the new tag is always kept")
+	}
+
+	dockerClient, err := dockerclient.NewFromCli(c)
+	if err != nil {
+		cliutil.Exit(build.WithExitCode(build.ExitInfra, err))
+	}
+
+	if image := c.String("image"); image != "" {
+		log.Infof("Tag %s as %s", image, name)
+		if !opts.DryRun {
+			err := dockerClient.TagImage(image, docker.TagImageOptions{Repo: name.NameWithRegistry(), Tag: name.GetTag(), Force: true})
+			if err != nil {
+				cliutil.Exit(fmt.Errorf("Failed to tag %s as %s, error: %s", image, name, err))
+			}
+		}
+	} else if _, err := dockerClient.InspectImage(name.String()); err != nil {
+		cliutil.Exitf(build.ExitUser, "Image %s is not found, give the image to tag with --image", name)
+	}
+
+	report, err := Local(dockerClient, name.NameWithRegistry(), opts)
+	if err != nil {
+		cliutil.Exit(build.WithExitCode(build.ExitInfra, err))
+	}
+	failed := PrintReport("locally", report, opts.DryRun)
+
+	if c.Bool("push") {
+		auth := cliutil.InitAuth(c)
+
+		log.Infof("Push %s", name)
+		if !opts.DryRun {
+			if _, err := cliutil.NewCommandClient(c, dockerClient, auth).PushImage(context.Background(), name.String()); err != nil {
+				cliutil.Exit(err)
+			}
+		}
+
+		report, err := Registry(DockerRegistry{Auth: auth}, name.NameWithRegistry(), opts)
+		if err != nil {
+			cliutil.Exit(build.WithExitCode(build.ExitInfra, err))
+		}
+		failed = PrintReport("in the registry", report, opts.DryRun) || failed
+	}
+
+	if failed {
+		os.Exit(build.ExitFailure)
+	}
+}
+
+// PrintReport logs what the rotation kept and removed, and tells if anything failed
+func PrintReport(where string, report *Report, dryRun bool) (failed bool) {
+	action := "Removed"
+	if dryRun {
+		action = "Would remove"
+	}
+
+	for _, tag := range report.Removed {
+		log.Infof("%s %s %s", action, tag.Name, where)
+	}
+	for _, tag := range report.Skipped {
+		log.Warnf("Skip %s, another tag that stays points to the same image %s", tag.Name, tag.ID)
+	}
+	for _, err := range report.Errors {
+		log.Error(err)
+	}
+	log.Infof("Kept %d tags %s, removed %d", len(report.Kept), where, len(report.Removed))
+
+	return len(report.Errors) > 0
+}
+
+// DockerRegistry is the RegistryAPI of the docker registries, with the credentials of rocker
+type DockerRegistry struct {
+	Auth *docker.AuthConfigurations
+}
+
+// ListTags implements RegistryAPI
+func (r DockerRegistry) ListTags(repository string) (tags []string, err error) {
+	images, err := dockerclient.RegistryListTags(imagename.New(repository, "*"), r.Auth)
+	if err != nil {
+		return nil, err
+	}
+	for _, image := range images {
+		tags = append(tags, image.GetTag())
+	}
+	return tags, nil
+}
+
+// Digest implements RegistryAPI
+func (r DockerRegistry) Digest(name string) (string, error) {
+	return dockerclient.RegistryManifestDigest(imagename.NewFromString(name), r.Auth)
+}
+
+// Created implements RegistryAPI
+func (r DockerRegistry) Created(name string) (time.Time, error) {
+	return dockerclient.RegistryImageCreated(imagename.NewFromString(name), r.Auth)
+}
+
+// Delete implements RegistryAPI
+func (r DockerRegistry) Delete(name, digest string) error {
+	return dockerclient.RegistryDeleteManifest(imagename.NewFromString(name), r.Auth, digest)
+}
@@ -0,0 +1,239 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package rotate keeps the newest tags of a repository that match a pattern and
+// removes the older ones, locally and in the registry, for the retention of
+// nightly and preview images
+package rotate
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"time"
+
+	"github.com/fsouza/go-dockerclient"
+	"github.com/grammarly/rocker/src/imagename"
+)
+
+// LocalAPI is the part of the docker client rotate needs
+type LocalAPI interface {
+	ListImages(opts docker.ListImagesOptions) ([]docker.APIImages, error)
+	RemoveImage(name string) error
+}
+
+// RegistryAPI is what rotate needs from the registry; the names are repository:tag
+type RegistryAPI interface {
+	ListTags(repository string) (tags []string, err error)
+	Digest(name string) (digest string, err error)
+	Created(name string) (created time.Time, err error)
+	Delete(name, digest string) error
+}
+
+// Options tell which tags to keep
+type Options struct {
+	// Keep is how many of the newest matching tags stay, Current included
+	Keep int
+
+	// Pattern is matched against the tags as path.Match does, e.g. nightly-*
+	Pattern string
+
+	// Current is the tag that was just made, e.g. nightly-20161016; it stays
+	// whatever the age of its image
+	Current string
+
+	// DryRun only reports what would be removed
+	DryRun bool
+}
+
+// Tag is a tag of the repository that matches the pattern
+type Tag struct {
+	Name    string
+	ID      string // the image ID locally, the manifest digest in the registry
+	Created time.Time
+}
+
+// Report is what was kept, removed and left because of other tags
+type Report struct {
+	Kept    []Tag
+	Removed []Tag
+
+	// Skipped are the registry tags to remove that point to the same manifest
+	// as a tag that stays, deleting the manifest would remove both
+	Skipped []Tag
+	Errors  []error
+}
+
+// ValidatePattern fails if the pattern is malformed
+func ValidatePattern(pattern string) error {
+	if _, err := path.Match(pattern, ""); err != nil {
+		return fmt.Errorf("Invalid pattern %q, error: %s", pattern, err)
+	}
+	return nil
+}
+
+// Match tells if the tag matches the pattern
+func Match(pattern, tag string) bool {
+	matched, _ := path.Match(pattern, tag)
+	return matched
+}
+
+// Local untags the local images of the repository whose tags match the pattern,
+// except for the newest ones; an image goes away with its last tag, as with docker rmi
+func Local(client LocalAPI, repository string, opts Options) (*Report, error) {
+	images, err := client.ListImages(docker.ListImagesOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("Failed to list images, error: %s", err)
+	}
+
+	repo := imagename.NewFromString(repository).NameWithRegistry()
+	tags := []Tag{}
+
+	for _, img := range images {
+		for _, name := range img.RepoTags {
+			image := imagename.NewFromString(name)
+			if image.NameWithRegistry() != repo || !Match(opts.Pattern, image.GetTag()) {
+				continue
+			}
+			tags = append(tags, Tag{Name: name, ID: img.ID, Created: time.Unix(img.Created, 0)})
+		}
+	}
+
+	r := &Report{}
+	r.Kept, r.Removed = split(tags, opts)
+
+	removed := r.Removed[:0]
+	for _, tag := range r.Removed {
+		if !opts.DryRun {
+			if err := client.RemoveImage(tag.Name); err != nil {
+				r.Errors = append(r.Errors, fmt.Errorf("Failed to remove %s, error: %s", tag.Name, err))
+				continue
+			}
+		}
+		removed = append(removed, tag)
+	}
+	r.Removed = removed
+
+	return r, nil
+}
+
+// Registry deletes the manifests of the repository tags that match the pattern,
+// except for the newest ones. A manifest that a remaining tag points to as well
+// is left, since the registry deletes manifests, not tags
+func Registry(registry RegistryAPI, repository string, opts Options) (*Report, error) {
+	names, err := registry.ListTags(repository)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to list the tags of %s, error: %s", repository, err)
+	}
+
+	var (
+		r    = &Report{}
+		tags = []Tag{}
+		// the digests the tags that do not match point to
+		others = map[string]bool{}
+	)
+
+	for _, tag := range names {
+		name := repository + ":" + tag
+
+		digest, err := registry.Digest(name)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to get the digest of %s, error: %s", name, err)
+		}
+
+		if !Match(opts.Pattern, tag) {
+			others[digest] = true
+			continue
+		}
+
+		created, err := registry.Created(name)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to get the creation time of %s, error: %s", name, err)
+		}
+		tags = append(tags, Tag{Name: name, ID: digest, Created: created})
+	}
+
+	var old []Tag
+	r.Kept, old = split(tags, opts)
+
+	for _, tag := range r.Kept {
+		others[tag.ID] = true
+	}
+
+	deleted := map[string]error{}
+
+	for _, tag := range old {
+		if others[tag.ID] {
+			r.Skipped = append(r.Skipped, tag)
+			continue
+		}
+
+		err, done := deleted[tag.ID]
+		if !done && !opts.DryRun {
+			err = registry.Delete(tag.Name, tag.ID)
+			deleted[tag.ID] = err
+		}
+		if err != nil {
+			if !done {
+				r.Errors = append(r.Errors, fmt.Errorf("Failed to delete %s@%s, error: %s", tag.Name, tag.ID, err))
+			}
+			continue
+		}
+		r.Removed = append(r.Removed, tag)
+	}
+
+	return r, nil
+}
+
+// split orders the tags from the newest, the current one first, and returns
+// the ones to keep and the ones to remove
+func split(tags []Tag, opts Options) (kept, old []Tag) {
+	sort.Sort(&byAge{tags: tags, current: opts.Current})
+
+	if len(tags) <= opts.Keep {
+		return tags, nil
+	}
+	return tags[:opts.Keep], tags[opts.Keep:]
+}
+
+// byAge sorts the tags from the newest, the current tag goes first
+type byAge struct {
+	tags    []Tag
+	current string
+}
+
+func (a *byAge) Len() int {
+	return len(a.tags)
+}
+
+func (a *byAge) Less(i, j int) bool {
+	ci, cj := a.isCurrent(a.tags[i]), a.isCurrent(a.tags[j])
+	if ci != cj {
+		return ci
+	}
+	if !a.tags[i].Created.Equal(a.tags[j].Created) {
+		return a.tags[i].Created.After(a.tags[j].Created)
+	}
+	return a.tags[i].Name > a.tags[j].Name
+}
+
+func (a *byAge) Swap(i, j int) {
+	a.tags[i], a.tags[j] = a.tags[j], a.tags[i]
+}
+
+func (a *byAge) isCurrent(tag Tag) bool {
+	return a.current != "" && imagename.NewFromString(tag.Name).GetTag() == a.current
+}
@@ -0,0 +1,159 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package rotate
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/fsouza/go-dockerclient"
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeDocker struct {
+	images  []docker.APIImages
+	removed []string
+}
+
+func (f *fakeDocker) ListImages(opts docker.ListImagesOptions) ([]docker.APIImages, error) {
+	return f.images, nil
+}
+
+func (f *fakeDocker) RemoveImage(name string) error {
+	f.removed = append(f.removed, name)
+	return nil
+}
+
+type fakeRegistry struct {
+	tags    map[string]string // tag to digest
+	created map[string]time.Time
+	deleted []string
+	fail    map[string]bool
+}
+
+func (f *fakeRegistry) ListTags(repository string) (tags []string, err error) {
+	for tag := range f.tags {
+		tags = append(tags, tag)
+	}
+	return tags, nil
+}
+
+func (f *fakeRegistry) Digest(name string) (string, error) {
+	return f.tags[name[len("quay.io/acme/app:"):]], nil
+}
+
+func (f *fakeRegistry) Created(name string) (time.Time, error) {
+	return f.created[f.tags[name[len("quay.io/acme/app:"):]]], nil
+}
+
+func (f *fakeRegistry) Delete(name, digest string) error {
+	if f.fail[digest] {
+		return fmt.Errorf("denied")
+	}
+	f.deleted = append(f.deleted, digest)
+	return nil
+}
+
+func day(n int) time.Time {
+	return time.Date(2016, 10, n, 2, 0, 0, 0, time.UTC)
+}
+
+func names(tags []Tag) (result []string) {
+	for _, t := range tags {
+		result = append(result, t.Name)
+	}
+	return result
+}
+
+func TestValidatePattern(t *testing.T) {
+	assert.NoError(t, ValidatePattern("nightly-*"))
+	assert.Error(t, ValidatePattern("nightly-["))
+	assert.True(t, Match("nightly-*", "nightly-20161016"))
+	assert.False(t, Match("nightly-*", "latest"))
+}
+
+func TestLocal(t *testing.T) {
+	f := &fakeDocker{images: []docker.APIImages{
+		{ID: "i1", RepoTags: []string{"quay.io/acme/app:nightly-1"}, Created: day(1).Unix()},
+		{ID: "i2", RepoTags: []string{"quay.io/acme/app:nightly-2", "quay.io/acme/app:latest"}, Created: day(2).Unix()},
+		{ID: "i3", RepoTags: []string{"quay.io/acme/app:nightly-3"}, Created: day(3).Unix()},
+		{ID: "i4", RepoTags: []string{"quay.io/acme/other:nightly-0"}, Created: day(4).Unix()},
+		// an old image that was just tagged
+		{ID: "i0", RepoTags: []string{"quay.io/acme/app:nightly-4"}, Created: day(0).Unix()},
+	}}
+
+	r, err := Local(f, "quay.io/acme/app", Options{Keep: 2, Pattern: "nightly-*", Current: "nightly-4"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, []string{"quay.io/acme/app:nightly-4", "quay.io/acme/app:nightly-3"}, names(r.Kept))
+	assert.Equal(t, []string{"quay.io/acme/app:nightly-2", "quay.io/acme/app:nightly-1"}, names(r.Removed))
+	assert.Equal(t, []string{"quay.io/acme/app:nightly-2", "quay.io/acme/app:nightly-1"}, f.removed)
+}
+
+func TestLocal_DryRun(t *testing.T) {
+	f := &fakeDocker{images: []docker.APIImages{
+		{ID: "i1", RepoTags: []string{"quay.io/acme/app:nightly-1"}, Created: day(1).Unix()},
+		{ID: "i2", RepoTags: []string{"quay.io/acme/app:nightly-2"}, Created: day(2).Unix()},
+	}}
+
+	r, err := Local(f, "quay.io/acme/app", Options{Keep: 1, Pattern: "nightly-*", DryRun: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, []string{"quay.io/acme/app:nightly-1"}, names(r.Removed))
+	assert.Empty(t, f.removed)
+}
+
+func TestRegistry(t *testing.T) {
+	f := &fakeRegistry{
+		tags: map[string]string{
+			"nightly-1": "sha256:1",
+			"nightly-2": "sha256:2",
+			"nightly-3": "sha256:3",
+			"nightly-4": "sha256:4",
+			"nightly-5": "sha256:5",
+			"preview-5": "sha256:5",
+			// the same image as nightly-1
+			"nightly-1b": "sha256:1",
+			// the latest points to an old image, so it is not deleted
+			"latest": "sha256:2",
+		},
+		created: map[string]time.Time{
+			"sha256:1": day(1),
+			"sha256:2": day(2),
+			"sha256:3": day(3),
+			"sha256:4": day(4),
+			"sha256:5": day(5),
+		},
+		fail: map[string]bool{"sha256:3": true},
+	}
+
+	r, err := Registry(f, "quay.io/acme/app", Options{Keep: 2, Pattern: "nightly-*"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, []string{"quay.io/acme/app:nightly-5", "quay.io/acme/app:nightly-4"}, names(r.Kept))
+	assert.Equal(t, []string{"quay.io/acme/app:nightly-1b", "quay.io/acme/app:nightly-1"}, names(r.Removed))
+	assert.Equal(t, []string{"quay.io/acme/app:nightly-2"}, names(r.Skipped))
+	assert.Equal(t, []string{"sha256:1"}, f.deleted)
+	assert.Len(t, r.Errors, 1)
+}
@@ -0,0 +1,97 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package selfupdate
+
+import (
+	"crypto/ecdsa"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/grammarly/rocker/src/build"
+	"github.com/grammarly/rocker/src/cliutil"
+
+	"github.com/codegangsta/cli"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// CommandSpec returns specifications of the self-update command for codegangsta/cli;
+// releaseKey is the builtin public key, the base64 of its DER form
+func CommandSpec(releaseKey string) cli.Command {
+	return cli.Command{
+		Name:  "self-update",
+		Usage: "replaces rocker with the latest release, after verifying the signature of the release binary",
+		Action: func(c *cli.Context) {
+			selfUpdateCommand(c, releaseKey)
+		},
+		Flags: []cli.Flag{
+			cli.StringFlag{
+				Name:   "key",
+				EnvVar: "ROCKER_RELEASE_KEY",
+				Usage:  "file with the public key to verify the release with, PEM or base64 DER; the key rocker is built with by default",
+			},
+			cli.BoolFlag{
+				Name:  "force",
+				Usage: "install the latest release even if it is not newer, e.g. over a build from source",
+			},
+		},
+	}
+}
+
+// selfUpdateCommand implements 'self-update' command that installs the latest release
+// of --check-update-url in place of the running rocker
+func selfUpdateCommand(c *cli.Context, releaseKey string) {
+	key, err := readKey(c.String("key"), releaseKey)
+	if err != nil {
+		cliutil.Exit(build.WithExitCode(build.ExitUser, err))
+	}
+
+	executable, err := os.Executable()
+	if err != nil {
+		cliutil.Exit(err)
+	}
+	if executable, err = filepath.EvalSymlinks(executable); err != nil {
+		cliutil.Exit(err)
+	}
+
+	result, err := New(c.GlobalString("check-update-url"), key).Update(cliutil.Version, executable, c.Bool("force"))
+	if err != nil {
+		cliutil.Exit(build.WithExitCode(build.ExitInfra, err))
+	}
+
+	if !result.Updated {
+		log.Infof("rocker %s is up to date, the latest release is %s", result.Current, result.Latest)
+		return
+	}
+	log.Infof("Updated rocker %s to %s at %s", result.Current, result.Latest, executable)
+}
+
+// readKey reads the key of --key or the builtin one
+func readKey(file, builtin string) (*ecdsa.PublicKey, error) {
+	if file == "" {
+		if builtin == "" {
+			return nil, nil
+		}
+		return ParsePublicKey([]byte(builtin))
+	}
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	return ParsePublicKey(data)
+}
@@ -0,0 +1,275 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package selfupdate replaces the running rocker with the latest release, after
+// checking the signature of the release binary with the public key of the project
+package selfupdate
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/grammarly/rocker/src/build"
+	"github.com/grammarly/rocker/src/versioncheck"
+
+	"github.com/wmark/semver"
+)
+
+// MaxDownloadSize limits the release files, so a broken mirror cannot fill the memory
+const MaxDownloadSize = 256 << 20
+
+// Updater installs the latest release described by URL in place of the executable
+type Updater struct {
+	// URL describes the latest release, see versioncheck.DefaultURL
+	URL string
+
+	// Key verifies the signatures of the release files
+	Key *ecdsa.PublicKey
+
+	Client *http.Client
+	OS     string
+	Arch   string
+}
+
+// Result tells what Update did
+type Result struct {
+	Current string
+	Latest  string
+	Updated bool
+}
+
+// New makes an Updater for the platform rocker runs on
+func New(url string, key *ecdsa.PublicKey) *Updater {
+	if url == "" {
+		url = versioncheck.DefaultURL
+	}
+	return &Updater{
+		URL:    url,
+		Key:    key,
+		Client: &http.Client{Timeout: 5 * time.Minute},
+		OS:     runtime.GOOS,
+		Arch:   runtime.GOARCH,
+	}
+}
+
+// AssetName returns the name of the release file for the platform,
+// the signature is the same file with the .sig extension
+func AssetName(version, goos, goarch string) string {
+	return fmt.Sprintf("rocker-%s-%s_%s.tar.gz", version, goos, goarch)
+}
+
+// Update replaces the executable with the latest release if it is newer than current,
+// or with force anyway; nothing is replaced unless the signature is valid, otherwise
+// the error has the ExitPolicy code
+func (u *Updater) Update(current, executable string, force bool) (result Result, err error) {
+	result.Current = current
+
+	if u.Key == nil {
+		return result, build.WithExitCode(build.ExitUser, fmt.Errorf("No public key to verify the release with, give one with --key"))
+	}
+
+	release, err := versioncheck.FetchRelease(u.Client, u.URL)
+	if err != nil {
+		return result, err
+	}
+	result.Latest = release.Version()
+
+	if !force {
+		newer, err := isNewer(current, result.Latest)
+		if err != nil || !newer {
+			return result, err
+		}
+	}
+
+	name := AssetName(release.TagName, u.OS, u.Arch)
+	asset, ok := release.Asset(name)
+	if !ok {
+		return result, fmt.Errorf("Release %s has no %s", release.TagName, name)
+	}
+	sigAsset, ok := release.Asset(name + ".sig")
+	if !ok {
+		return result, build.WithExitCode(build.ExitPolicy, fmt.Errorf("Release %s has no signature %s.sig, refusing to install it", release.TagName, name))
+	}
+
+	archive, err := u.download(asset.URL)
+	if err != nil {
+		return result, err
+	}
+	sig, err := u.download(sigAsset.URL)
+	if err != nil {
+		return result, err
+	}
+
+	if err := Verify(u.Key, archive, sig); err != nil {
+		return result, build.WithExitCode(build.ExitPolicy, fmt.Errorf("Refusing to install %s, error: %s", name, err))
+	}
+
+	binary, err := extract(archive, "rocker")
+	if err != nil {
+		return result, fmt.Errorf("Failed to unpack %s, error: %s", name, err)
+	}
+
+	if err := replace(executable, binary); err != nil {
+		return result, err
+	}
+
+	result.Updated = true
+	return result, nil
+}
+
+// Verify checks the ECDSA signature of the SHA-256 of data, in the ASN.1 form
+// `openssl dgst -sha256 -sign` makes
+func Verify(key *ecdsa.PublicKey, data, sig []byte) error {
+	var rs struct {
+		R, S *big.Int
+	}
+	if rest, err := asn1.Unmarshal(sig, &rs); err != nil || len(rest) > 0 {
+		return fmt.Errorf("malformed signature")
+	}
+	if rs.R == nil || rs.S == nil || rs.R.Sign() <= 0 || rs.S.Sign() <= 0 {
+		return fmt.Errorf("malformed signature")
+	}
+
+	digest := sha256.Sum256(data)
+	if !ecdsa.Verify(key, digest[:], rs.R, rs.S) {
+		return fmt.Errorf("signature does not match")
+	}
+	return nil
+}
+
+// ParsePublicKey reads an ECDSA public key, either PEM or the base64 of its DER
+// form, which fits into -ldflags
+func ParsePublicKey(data []byte) (*ecdsa.PublicKey, error) {
+	der := data
+	if block, _ := pem.Decode(data); block != nil {
+		der = block.Bytes
+	} else if decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data))); err == nil {
+		der = decoded
+	}
+
+	key, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse the public key, error: %s", err)
+	}
+	ecKey, ok := key.(*ecdsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("The public key is %T, expected an ECDSA one", key)
+	}
+	return ecKey, nil
+}
+
+func (u *Updater) download(url string) ([]byte, error) {
+	resp, err := u.Client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Failed to download %s, status: %s", url, resp.Status)
+	}
+
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, MaxDownloadSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("Failed to download %s, error: %s", url, err)
+	}
+	if len(data) > MaxDownloadSize {
+		return nil, fmt.Errorf("Failed to download %s, it is larger than %d bytes", url, MaxDownloadSize)
+	}
+	return data, nil
+}
+
+// isNewer tells if latest is a newer release than current
+func isNewer(current, latest string) (bool, error) {
+	cur, err := semver.NewVersion(current)
+	if err != nil {
+		return false, build.WithExitCode(build.ExitUser, fmt.Errorf("Cannot update a non-release build %q, pass --force to install the latest release", current))
+	}
+	lat, err := semver.NewVersion(latest)
+	if err != nil {
+		return false, fmt.Errorf("Failed to parse the latest release version %q, error: %s", latest, err)
+	}
+	return cur.Less(lat), nil
+}
+
+// extract returns the file of the tar.gz archive
+func extract(archive []byte, name string) ([]byte, error) {
+	gz, err := gzip.NewReader(bytes.NewReader(archive))
+	if err != nil {
+		return nil, err
+	}
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil, fmt.Errorf("no %s in the archive", name)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if hdr.Typeflag == tar.TypeReg && filepath.Clean(hdr.Name) == name {
+			return ioutil.ReadAll(tr)
+		}
+	}
+}
+
+// replace writes the binary next to the executable and renames it over, so the
+// executable is either the old or the new one even if rocker is interrupted
+func replace(executable string, binary []byte) error {
+	info, err := os.Stat(executable)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(executable), ".rocker-update-")
+	if err != nil {
+		return fmt.Errorf("Failed to write next to %s, error: %s", executable, err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(binary); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), info.Mode().Perm()|0111); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp.Name(), executable); err != nil {
+		return fmt.Errorf("Failed to replace %s, error: %s", executable, err)
+	}
+	return nil
+}
@@ -0,0 +1,237 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package selfupdate
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/grammarly/rocker/src/build"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeRelease struct {
+	tag     string
+	archive []byte
+	sig     []byte
+}
+
+func (r *fakeRelease) serve(t *testing.T) *httptest.Server {
+	var ts *httptest.Server
+	ts = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		name := AssetName(r.tag, "linux", "amd64")
+		switch req.URL.Path {
+		case "/latest":
+			fmt.Fprintf(w, `{"tag_name": %q, "assets": [
+				{"name": %q, "browser_download_url": "%s/archive"},
+				{"name": "%s.sig", "browser_download_url": "%s/sig"}
+			]}`, r.tag, name, ts.URL, name, ts.URL)
+		case "/archive":
+			w.Write(r.archive)
+		case "/sig":
+			w.Write(r.sig)
+		default:
+			http.NotFound(w, req)
+		}
+	}))
+	return ts
+}
+
+func makeArchive(t *testing.T, name string, content []byte) []byte {
+	buf := &bytes.Buffer{}
+	gz := gzip.NewWriter(buf)
+	tw := tar.NewWriter(gz)
+	if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0755, Size: int64(len(content)), Typeflag: tar.TypeReg}); err != nil {
+		t.Fatal(err)
+	}
+	tw.Write(content)
+	tw.Close()
+	gz.Close()
+	return buf.Bytes()
+}
+
+func sign(t *testing.T, key *ecdsa.PrivateKey, data []byte) []byte {
+	digest := sha256.Sum256(data)
+	r, s, err := ecdsa.Sign(rand.Reader, key, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig, err := asn1.Marshal(struct{ R, S *big.Int }{r, s})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sig
+}
+
+func newKey(t *testing.T) *ecdsa.PrivateKey {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func newExecutable(t *testing.T) (dir, file string) {
+	dir, err := ioutil.TempDir("", "rocker-selfupdate-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	file = filepath.Join(dir, "rocker")
+	if err := ioutil.WriteFile(file, []byte("old"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return dir, file
+}
+
+func newUpdater(url string, key *ecdsa.PublicKey) *Updater {
+	u := New(url+"/latest", key)
+	u.OS, u.Arch = "linux", "amd64"
+	return u
+}
+
+func TestUpdater_Update(t *testing.T) {
+	key := newKey(t)
+	archive := makeArchive(t, "rocker", []byte("new"))
+	r := &fakeRelease{tag: "1.4.0", archive: archive, sig: sign(t, key, archive)}
+	ts := r.serve(t)
+	defer ts.Close()
+
+	dir, executable := newExecutable(t)
+	defer os.RemoveAll(dir)
+
+	result, err := newUpdater(ts.URL, &key.PublicKey).Update("1.3.1", executable, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, Result{Current: "1.3.1", Latest: "1.4.0", Updated: true}, result)
+
+	content, err := ioutil.ReadFile(executable)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "new", string(content))
+
+	info, err := os.Stat(executable)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, os.FileMode(0755), info.Mode().Perm())
+
+	files, _ := ioutil.ReadDir(dir)
+	assert.Len(t, files, 1, "expected no temporary files to be left")
+}
+
+func TestUpdater_UpdateUpToDate(t *testing.T) {
+	key := newKey(t)
+	archive := makeArchive(t, "rocker", []byte("new"))
+	r := &fakeRelease{tag: "1.4.0", archive: archive, sig: sign(t, key, archive)}
+	ts := r.serve(t)
+	defer ts.Close()
+
+	dir, executable := newExecutable(t)
+	defer os.RemoveAll(dir)
+
+	result, err := newUpdater(ts.URL, &key.PublicKey).Update("1.4.0", executable, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.False(t, result.Updated)
+
+	_, err = newUpdater(ts.URL, &key.PublicKey).Update("built locally", executable, false)
+	assert.Equal(t, build.ExitUser, build.ExitCode(err))
+
+	content, _ := ioutil.ReadFile(executable)
+	assert.Equal(t, "old", string(content))
+
+	result, err = newUpdater(ts.URL, &key.PublicKey).Update("built locally", executable, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, result.Updated)
+}
+
+func TestUpdater_UpdateBadSignature(t *testing.T) {
+	key, other := newKey(t), newKey(t)
+	archive := makeArchive(t, "rocker", []byte("new"))
+
+	tests := []struct {
+		name string
+		sig  []byte
+	}{
+		{"signed with another key", sign(t, other, archive)},
+		{"signature of another file", sign(t, key, []byte("something else"))},
+		{"garbage", []byte("not a signature")},
+		{"no signature", nil},
+	}
+
+	for _, test := range tests {
+		r := &fakeRelease{tag: "1.4.0", archive: archive, sig: test.sig}
+		ts := r.serve(t)
+		dir, executable := newExecutable(t)
+
+		_, err := newUpdater(ts.URL, &key.PublicKey).Update("1.3.1", executable, false)
+		assert.Equal(t, build.ExitPolicy, build.ExitCode(err), test.name)
+
+		content, _ := ioutil.ReadFile(executable)
+		assert.Equal(t, "old", string(content), test.name)
+
+		ts.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestParsePublicKey(t *testing.T) {
+	key := newKey(t)
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, data := range [][]byte{
+		pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}),
+		[]byte(base64.StdEncoding.EncodeToString(der) + "\n"),
+		der,
+	} {
+		parsed, err := ParsePublicKey(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, 0, parsed.X.Cmp(key.PublicKey.X))
+		assert.Equal(t, 0, parsed.Y.Cmp(key.PublicKey.Y))
+	}
+
+	_, err = ParsePublicKey([]byte("nonsense"))
+	assert.Error(t, err)
+}
@@ -0,0 +1,241 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package spill implements the buffers that keep their content in memory while
+// the budget shared by the whole process allows it, and move it to a temp file
+// beyond the budget, so large payloads do not take the memory of small CI machines
+package spill
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// DefaultLimit is the budget unless --memory-budget is given
+const DefaultLimit = 64 << 20
+
+// minGrow is the smallest memory a buffer reserves at once
+const minGrow = 4 << 10
+
+// Default is the budget of the process, the buffers made with NewBuffer share it
+var Default = NewBudget(DefaultLimit)
+
+// Budget limits the memory that is held by the buffers together
+type Budget struct {
+	mu      sync.Mutex
+	limit   int64
+	inUse   int64
+	peak    int64
+	spilled int64
+	spills  int
+}
+
+// Stats tells how the budget was used
+type Stats struct {
+	// Limit is the budget
+	Limit int64
+	// InUse is the memory held by the open buffers
+	InUse int64
+	// Peak is the most memory the buffers have held at once
+	Peak int64
+	// Spilled is the number of bytes written to temp files
+	Spilled int64
+	// Spills is the number of buffers that went to temp files
+	Spills int
+}
+
+// NewBudget returns the budget of limit bytes; with 0 the buffers go to disk right away
+func NewBudget(limit int64) *Budget {
+	return &Budget{limit: limit}
+}
+
+// SetLimit changes the budget, the memory already held by the buffers is kept
+func (b *Budget) SetLimit(limit int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.limit = limit
+}
+
+// Stats returns the usage of the budget so far
+func (b *Budget) Stats() Stats {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return Stats{
+		Limit:   b.limit,
+		InUse:   b.inUse,
+		Peak:    b.peak,
+		Spilled: b.spilled,
+		Spills:  b.spills,
+	}
+}
+
+// NewBuffer returns an empty buffer that takes the memory from the budget
+func (b *Budget) NewBuffer() *Buffer {
+	return &Buffer{budget: b}
+}
+
+func (b *Budget) reserve(n int64) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.inUse+n > b.limit {
+		return false
+	}
+	if b.inUse += n; b.inUse > b.peak {
+		b.peak = b.inUse
+	}
+	return true
+}
+
+func (b *Budget) release(n int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.inUse -= n
+}
+
+func (b *Budget) addSpilled(n int64, spill bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.spilled += n
+	if spill {
+		b.spills++
+	}
+}
+
+// NewBuffer returns an empty buffer of the Default budget
+func NewBuffer() *Buffer {
+	return Default.NewBuffer()
+}
+
+// Buffer is written in full first and then read as many times as needed; it has
+// to be closed to give the memory back to the budget and to remove the temp file.
+// It is not safe for concurrent writes.
+type Buffer struct {
+	budget *Budget
+	mem    []byte
+	file   *os.File
+	size   int64
+}
+
+// Write implements io.Writer
+func (buf *Buffer) Write(p []byte) (int, error) {
+	if buf.file == nil {
+		if need := len(buf.mem) + len(p); need <= cap(buf.mem) || buf.grow(need) {
+			buf.mem = append(buf.mem, p...)
+			buf.size += int64(len(p))
+			return len(p), nil
+		}
+		if err := buf.spill(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := buf.file.Write(p)
+	buf.size += int64(n)
+	buf.budget.addSpilled(int64(n), false)
+
+	if err != nil {
+		return n, fmt.Errorf("Failed to write to the spill file %s, error: %s", buf.file.Name(), err)
+	}
+	return n, nil
+}
+
+// Size returns the number of bytes written
+func (buf *Buffer) Size() int64 {
+	return buf.size
+}
+
+// Spilled tells whether the content went to a temp file
+func (buf *Buffer) Spilled() bool {
+	return buf.file != nil
+}
+
+// Reader returns a reader of the whole content; the readers are independent,
+// so there can be several of them at once
+func (buf *Buffer) Reader() *io.SectionReader {
+	if buf.file != nil {
+		return io.NewSectionReader(buf.file, 0, buf.size)
+	}
+	return io.NewSectionReader(bytes.NewReader(buf.mem), 0, buf.size)
+}
+
+// Close gives the memory back to the budget and removes the temp file
+func (buf *Buffer) Close() error {
+	buf.budget.release(int64(cap(buf.mem)))
+	buf.mem = nil
+
+	if buf.file == nil {
+		return nil
+	}
+
+	name := buf.file.Name()
+	buf.file.Close()
+	buf.file = nil
+
+	return os.Remove(name)
+}
+
+// grow reserves the memory for at least need bytes, doubling the capacity when
+// the budget allows so small writes do not copy the content every time. The old
+// content is counted until it is copied, as both are held at that moment.
+func (buf *Buffer) grow(need int) bool {
+	newCap := 2 * cap(buf.mem)
+	if newCap < minGrow {
+		newCap = minGrow
+	}
+	if newCap < need || !buf.budget.reserve(int64(newCap)) {
+		if newCap = need; !buf.budget.reserve(int64(newCap)) {
+			return false
+		}
+	}
+
+	mem := make([]byte, len(buf.mem), newCap)
+	copy(mem, buf.mem)
+
+	buf.budget.release(int64(cap(buf.mem)))
+	buf.mem = mem
+
+	return true
+}
+
+// spill moves the content to a temp file and gives its memory back to the budget
+func (buf *Buffer) spill() error {
+	file, err := ioutil.TempFile("", "rocker-spill-")
+	if err != nil {
+		return fmt.Errorf("Failed to create a spill file, error: %s", err)
+	}
+
+	log.Debugf("Buffer of %d bytes exceeds the memory budget, move it to %s", len(buf.mem), file.Name())
+
+	if _, err := file.Write(buf.mem); err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return fmt.Errorf("Failed to write to the spill file %s, error: %s", file.Name(), err)
+	}
+
+	buf.budget.addSpilled(int64(len(buf.mem)), true)
+	buf.budget.release(int64(cap(buf.mem)))
+	buf.mem = nil
+	buf.file = file
+
+	return nil
+}
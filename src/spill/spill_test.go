@@ -0,0 +1,152 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package spill
+
+import (
+	"crypto/sha256"
+	"io"
+	"io/ioutil"
+	"os"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBufferInMemory(t *testing.T) {
+	budget := NewBudget(1 << 20)
+
+	buf := budget.NewBuffer()
+	io.WriteString(buf, "hello ")
+	io.WriteString(buf, "world")
+
+	assert.False(t, buf.Spilled())
+	assert.EqualValues(t, 11, buf.Size())
+
+	for i := 0; i < 2; i++ {
+		content, err := ioutil.ReadAll(buf.Reader())
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, "hello world", string(content))
+	}
+
+	assert.True(t, budget.Stats().InUse > 0)
+
+	if err := buf.Close(); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, Stats{Limit: 1 << 20, Peak: minGrow}, budget.Stats())
+}
+
+func TestBufferSpillsBeyondBudget(t *testing.T) {
+	const limit = 1 << 20
+
+	budget := NewBudget(limit)
+
+	// Several buffers at once share the budget
+	buffers := []*Buffer{budget.NewBuffer(), budget.NewBuffer(), budget.NewBuffer()}
+	sums := make([][]byte, len(buffers))
+
+	for i, buf := range buffers {
+		h := sha256.New()
+		chunk := make([]byte, 32<<10)
+		for j := 0; j < 128; j++ {
+			for k := range chunk {
+				chunk[k] = byte(i + j + k)
+			}
+			h.Write(chunk)
+			if _, err := buf.Write(chunk); err != nil {
+				t.Fatal(err)
+			}
+			assert.True(t, budget.Stats().InUse <= limit)
+		}
+		sums[i] = h.Sum(nil)
+	}
+
+	stats := budget.Stats()
+	assert.True(t, stats.Peak <= limit, "peak %d is over the budget", stats.Peak)
+	assert.Equal(t, 3, stats.Spills)
+	assert.EqualValues(t, 3*128*32<<10, stats.Spilled)
+
+	files := []string{}
+	for i, buf := range buffers {
+		assert.True(t, buf.Spilled())
+		assert.EqualValues(t, 128*32<<10, buf.Size())
+
+		h := sha256.New()
+		if _, err := io.Copy(h, buf.Reader()); err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, sums[i], h.Sum(nil))
+
+		files = append(files, buf.file.Name())
+		if err := buf.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	assert.EqualValues(t, 0, budget.Stats().InUse)
+	for _, file := range files {
+		_, err := os.Stat(file)
+		assert.True(t, os.IsNotExist(err), "%s is not removed", file)
+	}
+}
+
+func TestBufferMemoryBounded(t *testing.T) {
+	const (
+		limit = 1 << 20
+		total = 64 << 20
+	)
+
+	budget := NewBudget(limit)
+	chunk := make([]byte, 32<<10)
+
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+
+	buf := budget.NewBuffer()
+	defer buf.Close()
+
+	for written := 0; written < total; written += len(chunk) {
+		if _, err := buf.Write(chunk); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	runtime.ReadMemStats(&after)
+
+	assert.EqualValues(t, total, buf.Size())
+	assert.True(t, budget.Stats().Peak <= limit)
+
+	// The garbage of growing the buffer is not collected, so allow for a few times the budget
+	grown := int64(after.HeapAlloc) - int64(before.HeapAlloc)
+	assert.True(t, grown < 8*limit, "heap grew by %d bytes after writing %d bytes", grown, total)
+}
+
+func TestBudgetZero(t *testing.T) {
+	budget := NewBudget(0)
+
+	buf := budget.NewBuffer()
+	defer buf.Close()
+
+	io.WriteString(buf, "x")
+
+	assert.True(t, buf.Spilled())
+	assert.EqualValues(t, 0, budget.Stats().Peak)
+}
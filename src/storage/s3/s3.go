@@ -500,6 +500,49 @@ func (s *StorageS3) ListTags(imageName string) (images []*imagename.ImageName, e
 	return
 }
 
+// Open opens the object by the s3://bucket/key URL for reading
+func (s *StorageS3) Open(url string) (io.ReadCloser, error) {
+	parts := strings.SplitN(strings.TrimPrefix(url, "s3://"), "/", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return nil, fmt.Errorf("Invalid S3 url %s, expected s3://bucket/key", url)
+	}
+
+	log.Infof("| Download %s", url)
+
+	resp, err := s.s3.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(parts[0]),
+		Key:    aws.String(parts[1]),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get object %s from S3, error: %s", url, err)
+	}
+
+	return resp.Body, nil
+}
+
+// Upload writes the content to the object by the s3://bucket/key URL
+func (s *StorageS3) Upload(url string, r io.Reader) error {
+	parts := strings.SplitN(strings.TrimPrefix(url, "s3://"), "/", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return fmt.Errorf("Invalid S3 url %s, expected s3://bucket/key", url)
+	}
+
+	log.Debugf("Upload %s", url)
+
+	uploader := s3manager.NewUploaderWithClient(s.s3)
+
+	if _, err := uploader.Upload(&s3manager.UploadInput{
+		Bucket:      aws.String(parts[0]),
+		Key:         aws.String(parts[1]),
+		ContentType: aws.String("text/plain"),
+		Body:        r,
+	}); err != nil {
+		return fmt.Errorf("Failed to upload object %s to S3, error: %s", url, err)
+	}
+
+	return nil
+}
+
 // CacheGet returns cached digest of the image
 func (s *StorageS3) CacheGet(imageID string) (digest string, err error) {
 	fileName := filepath.Join(s.cacheRoot, cacheDir, imageID)
@@ -0,0 +1,64 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package telemetry sends anonymized usage reports to a configured endpoint.
+// It is only used when the user explicitly enables it.
+package telemetry
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Report is an anonymized summary of a single build. It must never contain
+// names, paths, arguments, hosts or anything else that identifies the user
+// or the project being built.
+type Report struct {
+	Version     string         `json:"version"`
+	OS          string         `json:"os"`
+	Arch        string         `json:"arch"`
+	Backend     string         `json:"backend"`
+	Directives  map[string]int `json:"directives"`
+	CacheHits   int            `json:"cache_hits"`
+	CacheMisses int            `json:"cache_misses"`
+	Success     bool           `json:"success"`
+	Duration    float64        `json:"duration_seconds"`
+}
+
+// Send posts the report to the endpoint as JSON
+func Send(endpoint string, r Report) error {
+	body, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+
+	client := &http.Client{Timeout: 3 * time.Second}
+
+	resp, err := client.Post(endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("Telemetry endpoint %s responded with %s", endpoint, resp.Status)
+	}
+
+	return nil
+}
@@ -0,0 +1,146 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package template
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// DefaultSandboxTimeout is how long a template may take to render in the sandbox
+const DefaultSandboxTimeout = 10 * time.Second
+
+// Sandbox restricts what the template of a Rockerfile that is not trusted can
+// reach, so it cannot leak the secrets of the machine that builds it: .Env has
+// only the allowed environment variables, readFile reads only the files of Dir
+// and the rendering fails after Timeout. A nil Sandbox restricts nothing
+type Sandbox struct {
+	// Env are the names of the environment variables the template can read
+	Env []string
+
+	// Dir is the directory readFile is confined to, usually the build context
+	Dir string
+
+	// Timeout limits the time of the rendering, zero means no limit
+	Timeout time.Duration
+}
+
+// environ returns the environment variables the template sees as .Env
+func (s *Sandbox) environ() Vars {
+	if s == nil {
+		return ParseKvPairs(os.Environ())
+	}
+	vars := Vars{}
+	for _, name := range s.Env {
+		if value, ok := os.LookupEnv(name); ok {
+			vars[name] = value
+		}
+	}
+	return vars
+}
+
+// readFile is the `readFile` helper, it returns the content of the file; a relative
+// name is taken from the directory of the sandbox or from the working directory
+func (s *Sandbox) readFile(name string) (string, error) {
+	if s == nil {
+		content, err := ioutil.ReadFile(name)
+		return string(content), err
+	}
+
+	dir, err := filepath.Abs(s.Dir)
+	if err != nil {
+		return "", err
+	}
+	file := name
+	if !filepath.IsAbs(file) {
+		file = filepath.Join(dir, file)
+	}
+
+	// Symlinks are followed, so that they cannot point outside of the directory
+	if dir, err = filepath.EvalSymlinks(dir); err != nil {
+		return "", err
+	}
+	if file, err = filepath.EvalSymlinks(file); err != nil {
+		return "", err
+	}
+	if rel, err := filepath.Rel(dir, file); err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("readFile %s: the file is outside of the context directory %s, render with --unsafe-templates to allow it", name, s.Dir)
+	}
+
+	content, err := ioutil.ReadFile(file)
+	return string(content), err
+}
+
+// execute renders the template within the time limit of the sandbox. The rendering
+// cannot be interrupted, so the one that runs out of time is left to finish in
+// the background and its output is discarded
+func (s *Sandbox) execute(tmpl *template.Template, w io.Writer, vars Vars) error {
+	if s == nil || s.Timeout <= 0 {
+		return tmpl.Execute(w, vars)
+	}
+
+	var buf bytes.Buffer
+	done := make(chan error, 1)
+	go func() {
+		done <- tmpl.Execute(&buf, vars)
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			return err
+		}
+		_, err = buf.WriteTo(w)
+		return err
+	case <-time.After(s.Timeout):
+		return fmt.Errorf("the template takes longer than %s to render", s.Timeout)
+	}
+}
+
+// warnHidden tells about the environment variables the template reads that are
+// set but hidden by the sandbox, since they silently render as <no value>
+func (s *Sandbox) warnHidden(name, source string, funs Funs) {
+	if s == nil {
+		return
+	}
+	vars, err := Variables(name, source, funs)
+	if err != nil {
+		return
+	}
+	env := s.environ()
+	for _, v := range vars {
+		if v.Kind != KindEnv {
+			continue
+		}
+		envName := strings.TrimPrefix(v.Name, "Env.")
+		if _, allowed := env[envName]; allowed {
+			continue
+		}
+		if _, set := os.LookupEnv(envName); set {
+			log.Warnf("Template %s reads .%s, which templates cannot see; allow it with --template-env %s or render with --unsafe-templates", name, v.Name, envName)
+		}
+	}
+}
@@ -0,0 +1,107 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package template
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func processSandboxed(tpl string, sandbox *Sandbox) (string, error) {
+	result, err := Process("test", strings.NewReader(tpl), Vars{}, Funs{}, sandbox)
+	if err != nil {
+		return "", err
+	}
+	return result.String(), nil
+}
+
+func TestSandbox_Env(t *testing.T) {
+	os.Setenv("ROCKER_TEST_ALLOWED", "yes")
+	os.Setenv("ROCKER_TEST_SECRET", "s3cr3t")
+	defer os.Unsetenv("ROCKER_TEST_ALLOWED")
+	defer os.Unsetenv("ROCKER_TEST_SECRET")
+
+	sandbox := &Sandbox{Env: []string{"ROCKER_TEST_ALLOWED"}}
+
+	result, err := processSandboxed("{{ .Env.ROCKER_TEST_ALLOWED }} {{ or .Env.ROCKER_TEST_SECRET \"hidden\" }}", sandbox)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "yes hidden", result)
+
+	result, err = processSandboxed("{{ .Env.ROCKER_TEST_SECRET }}", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "s3cr3t", result)
+}
+
+func TestSandbox_ReadFile(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "rocker-sandbox-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	dir := filepath.Join(tmpDir, "context")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "VERSION"), []byte("1.2.3"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(tmpDir, "secret"), []byte("s3cr3t"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Join(tmpDir, "secret"), filepath.Join(dir, "link")); err != nil {
+		t.Fatal(err)
+	}
+
+	sandbox := &Sandbox{Dir: dir}
+
+	result, err := processSandboxed(`{{ readFile "VERSION" }}`, sandbox)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "1.2.3", result)
+
+	for _, name := range []string{"../secret", filepath.Join(tmpDir, "secret"), "link"} {
+		_, err := processSandboxed(`{{ readFile "`+name+`" }}`, sandbox)
+		if assert.Error(t, err, name) {
+			assert.Contains(t, err.Error(), "outside of the context directory", name)
+		}
+	}
+
+	result, err = processSandboxed(`{{ readFile "`+filepath.Join(tmpDir, "secret")+`" }}`, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "s3cr3t", result)
+}
+
+func TestSandbox_Timeout(t *testing.T) {
+	_, err := processSandboxed(`{{ range seq 10000 }}{{ range seq 10000 }}{{ end }}{{ end }}`, &Sandbox{Timeout: 10 * time.Millisecond})
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "takes longer than 10ms to render")
+	}
+}
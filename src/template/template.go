@@ -23,7 +23,6 @@ import (
 	"github.com/grammarly/rocker/src/imagename"
 	"io"
 	"io/ioutil"
-	"os"
 	"reflect"
 	"sort"
 	"strconv"
@@ -40,8 +39,9 @@ import (
 type Funs map[string]interface{}
 
 // Process renders config through the template processor.
-// vars and additional functions are acceptable.
-func Process(name string, reader io.Reader, vars Vars, funs Funs) (*bytes.Buffer, error) {
+// vars and additional functions are acceptable; the sandbox restricts what
+// the template can reach, nil renders it unrestricted.
+func Process(name string, reader io.Reader, vars Vars, funs Funs, sandbox *Sandbox) (*bytes.Buffer, error) {
 
 	var buf bytes.Buffer
 	// read template
@@ -53,12 +53,27 @@ func Process(name string, reader io.Reader, vars Vars, funs Funs) (*bytes.Buffer
 	// Copy the vars struct because we don't want to modify the original struct
 	vars = Vars{}.Merge(vars)
 
-	// merge OS environment variables with the given Vars map
-	// todo: maybe, we need to make it configurable
-	vars["Env"] = ParseKvPairs(os.Environ())
+	// merge OS environment variables with the given Vars map,
+	// the sandbox lets only the allowed ones through
+	vars["Env"] = sandbox.environ()
 
-	// Populate functions
-	funcMap := map[string]interface{}{
+	tmpl, err := template.New(name).Funcs(funcMap(vars, funs, sandbox)).Parse(string(data))
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing template %s, error: %s", name, err)
+	}
+
+	sandbox.warnHidden(name, string(data), funs)
+
+	if err := sandbox.execute(tmpl, &buf, vars); err != nil {
+		return nil, fmt.Errorf("Error executing template %s, error: %s", name, err)
+	}
+
+	return &buf, nil
+}
+
+// funcMap returns the helpers available to the templates
+func funcMap(vars Vars, funs Funs, sandbox *Sandbox) map[string]interface{} {
+	helpers := map[string]interface{}{
 		"seq":    seq,
 		"dump":   dump,
 		"assert": assertFn,
@@ -67,6 +82,8 @@ func Process(name string, reader io.Reader, vars Vars, funs Funs) (*bytes.Buffer
 		"yaml":   yamlFn,
 		"image":  makeImageHelper(vars), // `image` helper needs to make a closure on Vars
 
+		"readFile": sandbox.readFile,
+
 		// strings functions
 		"compare":      strings.Compare,
 		"contains":     strings.Contains,
@@ -98,19 +115,9 @@ func Process(name string, reader io.Reader, vars Vars, funs Funs) (*bytes.Buffer
 		"trimSuffix":   strings.TrimSuffix,
 	}
 	for k, f := range funs {
-		funcMap[k] = f
-	}
-
-	tmpl, err := template.New(name).Funcs(funcMap).Parse(string(data))
-	if err != nil {
-		return nil, fmt.Errorf("Error parsing template %s, error: %s", name, err)
+		helpers[k] = f
 	}
-
-	if err := tmpl.Execute(&buf, vars); err != nil {
-		return nil, fmt.Errorf("Error executing template %s, error: %s", name, err)
-	}
-
-	return &buf, nil
+	return helpers
 }
 
 // seq produces a sequence slice of a given length. See README.md for more info.
@@ -58,7 +58,7 @@ var (
 )
 
 func TestProcess_Basic(t *testing.T) {
-	result, err := Process("test", strings.NewReader("this is a test {{.mykey}}"), configTemplateVars, map[string]interface{}{})
+	result, err := Process("test", strings.NewReader("this is a test {{.mykey}}"), configTemplateVars, map[string]interface{}{}, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -119,7 +119,7 @@ func TestProcess_AssertSuccess(t *testing.T) {
 
 func TestProcess_AssertFail(t *testing.T) {
 	tpl := "{{ assert .Version }}lololo"
-	_, err := Process("test", strings.NewReader(tpl), configTemplateVars, map[string]interface{}{})
+	_, err := Process("test", strings.NewReader(tpl), configTemplateVars, map[string]interface{}{}, nil)
 	errStr := "Error executing template test, error: template: test:1:3: executing \"test\" at <assert .Version>: error calling assert: Assertion failed"
 	assert.Equal(t, errStr, err.Error())
 }
@@ -214,7 +214,7 @@ func TestProcess_Image_Advanced(t *testing.T) {
 }
 
 func processTemplate(t *testing.T, tpl string) string {
-	result, err := Process("test", strings.NewReader(tpl), configTemplateVars, map[string]interface{}{})
+	result, err := Process("test", strings.NewReader(tpl), configTemplateVars, map[string]interface{}{}, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -222,6 +222,6 @@ func processTemplate(t *testing.T, tpl string) string {
 }
 
 func processTemplateReturnError(t *testing.T, tpl string) error {
-	_, err := Process("test", strings.NewReader(tpl), configTemplateVars, map[string]interface{}{})
+	_, err := Process("test", strings.NewReader(tpl), configTemplateVars, map[string]interface{}{}, nil)
 	return err
 }
@@ -0,0 +1,222 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package template
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"text/template"
+	"text/template/parse"
+)
+
+// Kinds of the variables a Rockerfile may reference
+const (
+	KindVar = "var"
+	KindEnv = "env"
+	KindArg = "arg"
+)
+
+// Variable describes a variable referenced by a Rockerfile, as found by
+// Variables; Used is the list of name:line positions where it is referenced
+type Variable struct {
+	Name       string
+	Kind       string
+	Default    string
+	HasDefault bool
+	Required   bool
+	Used       []string
+
+	asserted    bool
+	conditional bool
+	plain       bool
+}
+
+// Variables finds the template variables referenced by the source. A variable
+// is required if it is checked with `assert`, or it is printed but never
+// tested with if/with and has no default given with `or .Name "default"`.
+func Variables(name, source string, funs Funs) ([]*Variable, error) {
+	tmpl, err := template.New(name).Funcs(funcMap(Vars{}, funs, nil)).Parse(source)
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing template %s, error: %s", name, err)
+	}
+
+	w := &varsWalker{found: map[string]*Variable{}}
+	for _, t := range tmpl.Templates() {
+		if t.Tree == nil {
+			continue
+		}
+		w.tree = t.Tree
+		w.walk(t.Tree.Root, true)
+	}
+
+	result := []*Variable{}
+	for _, v := range w.found {
+		v.Required = v.asserted || (v.plain && !v.conditional && !v.HasDefault)
+		result = append(result, v)
+	}
+	sort.Sort(byName(result))
+
+	return result, nil
+}
+
+type byName []*Variable
+
+func (a byName) Len() int           { return len(a) }
+func (a byName) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a byName) Less(i, j int) bool { return a[i].Name < a[j].Name }
+
+// The ways a variable can be referenced
+type usage int
+
+const (
+	usagePlain usage = iota
+	usageCondition
+	usageAssert
+)
+
+type varsWalker struct {
+	tree  *parse.Tree
+	found map[string]*Variable
+}
+
+// walk visits the nodes; root tells if the dot is the top level
+// data, it is not inside of range and with
+func (w *varsWalker) walk(node parse.Node, root bool) {
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return
+		}
+		for _, child := range n.Nodes {
+			w.walk(child, root)
+		}
+	case *parse.ActionNode:
+		w.pipe(n.Pipe, root, usagePlain)
+	case *parse.IfNode:
+		w.pipe(n.Pipe, root, usageCondition)
+		w.walk(n.List, root)
+		w.walk(n.ElseList, root)
+	case *parse.RangeNode:
+		w.pipe(n.Pipe, root, usageCondition)
+		w.walk(n.List, false)
+		w.walk(n.ElseList, root)
+	case *parse.WithNode:
+		w.pipe(n.Pipe, root, usageCondition)
+		w.walk(n.List, false)
+		w.walk(n.ElseList, root)
+	case *parse.TemplateNode:
+		w.pipe(n.Pipe, root, usagePlain)
+	}
+}
+
+func (w *varsWalker) pipe(pipe *parse.PipeNode, root bool, u usage) {
+	if pipe == nil {
+		return
+	}
+	for _, cmd := range pipe.Cmds {
+		w.command(cmd, root, u)
+	}
+}
+
+func (w *varsWalker) command(cmd *parse.CommandNode, root bool, u usage) {
+	args := cmd.Args
+
+	if len(args) > 0 {
+		if ident, ok := args[0].(*parse.IdentifierNode); ok {
+			switch ident.Ident {
+			case "assert":
+				u = usageAssert
+			case "or":
+				// or .Name "default"
+				if last, ok := args[len(args)-1].(*parse.StringNode); ok {
+					for _, arg := range args[1 : len(args)-1] {
+						if v := w.reference(arg, root, usageCondition); v != nil {
+							v.Default, v.HasDefault = last.Text, true
+						}
+					}
+					return
+				}
+				u = usageCondition
+			}
+			args = args[1:]
+		}
+	}
+
+	for _, arg := range args {
+		w.reference(arg, root, u)
+	}
+}
+
+// reference records the variable the node refers to, if any
+func (w *varsWalker) reference(node parse.Node, root bool, u usage) *Variable {
+	var ident []string
+
+	switch n := node.(type) {
+	case *parse.FieldNode:
+		if !root {
+			return nil
+		}
+		ident = n.Ident
+	case *parse.VariableNode:
+		// $.Name refers to the top level data from anywhere
+		if len(n.Ident) < 2 || n.Ident[0] != "$" {
+			return nil
+		}
+		ident = n.Ident[1:]
+	case *parse.ChainNode:
+		return w.reference(n.Node, root, u)
+	case *parse.PipeNode:
+		w.pipe(n, root, u)
+		return nil
+	default:
+		return nil
+	}
+
+	name, kind := ident[0], KindVar
+	if name == "Env" {
+		if len(ident) < 2 {
+			return nil
+		}
+		name, kind = "Env."+ident[1], KindEnv
+	}
+
+	v, ok := w.found[name]
+	if !ok {
+		v = &Variable{Name: name, Kind: kind}
+		w.found[name] = v
+	}
+
+	switch u {
+	case usagePlain:
+		v.plain = true
+	case usageCondition:
+		v.conditional = true
+	case usageAssert:
+		v.asserted = true
+	}
+
+	location, _ := w.tree.ErrorContext(node)
+	if i := strings.LastIndex(location, ":"); i > 0 {
+		location = location[:i]
+	}
+	if len(v.Used) == 0 || v.Used[len(v.Used)-1] != location {
+		v.Used = append(v.Used, location)
+	}
+
+	return v
+}
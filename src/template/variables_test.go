@@ -0,0 +1,61 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package template
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVariables(t *testing.T) {
+	source := `FROM {{ or .BaseImage "ubuntu:16.04" }}
+{{ assert .Version }}
+ENV VERSION={{ .Version }} BRANCH={{ .Env.GIT_BRANCH }}
+{{ if .Debug }}RUN apt-get install -y gdb{{ end }}
+{{ range .Packages }}RUN install {{ .Name }} {{ $.Arch }}{{ end }}
+TAG {{ .Image }}:{{ .Version }}
+`
+	vars, err := Variables("Rockerfile", source, Funs{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	found := map[string]*Variable{}
+	names := []string{}
+	for _, v := range vars {
+		found[v.Name] = v
+		names = append(names, v.Name)
+	}
+
+	assert.Equal(t, []string{"Arch", "BaseImage", "Debug", "Env.GIT_BRANCH", "Image", "Packages", "Version"}, names)
+
+	assert.Equal(t, "ubuntu:16.04", found["BaseImage"].Default)
+	assert.True(t, found["BaseImage"].HasDefault)
+	assert.False(t, found["BaseImage"].Required)
+
+	assert.True(t, found["Version"].Required)
+	assert.Equal(t, []string{"Rockerfile:2", "Rockerfile:3", "Rockerfile:6"}, found["Version"].Used)
+
+	assert.False(t, found["Debug"].Required)
+	assert.False(t, found["Packages"].Required)
+	assert.True(t, found["Image"].Required)
+	assert.True(t, found["Arch"].Required)
+
+	assert.Equal(t, KindEnv, found["Env.GIT_BRANCH"].Kind)
+	assert.Equal(t, KindVar, found["Image"].Kind)
+}
@@ -12,16 +12,9 @@ import (
 	"strings"
 	"time"
 
-	log "github.com/Sirupsen/logrus"
-)
+	"github.com/grammarly/rocker/src/theme"
 
-const (
-	nocolor = 0
-	red     = 31
-	green   = 32
-	yellow  = 33
-	blue    = 34
-	gray    = 37
+	log "github.com/Sirupsen/logrus"
 )
 
 var (
@@ -96,28 +89,28 @@ func (f *TextFormatter) Format(entry *log.Entry) ([]byte, error) {
 }
 
 func (f *TextFormatter) printColored(b *bytes.Buffer, entry *log.Entry, keys []string) {
-	var levelColor int
+	var levelStyle theme.Style
 	switch entry.Level {
 	case log.DebugLevel:
-		levelColor = gray
+		levelStyle = theme.Current.Debug
 	case log.WarnLevel:
-		levelColor = yellow
+		levelStyle = theme.Current.Warning
 	case log.ErrorLevel, log.FatalLevel, log.PanicLevel:
-		levelColor = red
+		levelStyle = theme.Current.Error
 	default:
-		levelColor = blue
+		levelStyle = theme.Current.Info
 	}
 
 	levelText := strings.ToUpper(entry.Level.String())[0:4]
 
 	if !f.FullTimestamp {
-		fmt.Fprintf(b, "\x1b[%dm%s\x1b[0m[%04d] %-44s ", levelColor, levelText, miniTS(), entry.Message)
+		fmt.Fprintf(b, "%s[%04d] %-44s ", levelStyle.Wrap(levelText), miniTS(), entry.Message)
 	} else {
-		fmt.Fprintf(b, "\x1b[%dm%s\x1b[0m[%s] %-44s ", levelColor, levelText, entry.Time.Format(f.TimestampFormat), entry.Message)
+		fmt.Fprintf(b, "%s[%s] %-44s ", levelStyle.Wrap(levelText), entry.Time.Format(f.TimestampFormat), entry.Message)
 	}
 	for _, k := range keys {
 		v := entry.Data[k]
-		fmt.Fprintf(b, " \x1b[%dm%s\x1b[0m=%+v", levelColor, k, v)
+		fmt.Fprintf(b, " %s=%+v", levelStyle.Wrap(k), v)
 	}
 }
 
@@ -0,0 +1,230 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package theme defines the colors of the rocker output and when to use them
+package theme
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/fatih/color"
+	"github.com/go-yaml/yaml"
+)
+
+// Values of the --color option
+const (
+	ColorAuto   = "auto"
+	ColorAlways = "always"
+	ColorNever  = "never"
+)
+
+// UseColors tells if the output should be colored in the given --color mode;
+// in the auto mode colors are used on a terminal unless NO_COLOR is set
+func UseColors(mode string, isTerminal bool) (bool, error) {
+	switch mode {
+	case ColorAlways:
+		return true, nil
+	case ColorNever:
+		return false, nil
+	case ColorAuto, "":
+		return isTerminal && os.Getenv("NO_COLOR") == "", nil
+	}
+	return false, fmt.Errorf("Invalid --color value %q, expected auto, always or never", mode)
+}
+
+// Style is a set of SGR attributes, an empty style leaves the text as is
+type Style []color.Attribute
+
+// Sprint formats the text with the style, unless colors are disabled
+func (s Style) Sprint(a ...interface{}) string {
+	if len(s) == 0 {
+		return fmt.Sprint(a...)
+	}
+	return color.New(s...).SprintFunc()(a...)
+}
+
+// Sprintf formats the text with the style, unless colors are disabled
+func (s Style) Sprintf(format string, a ...interface{}) string {
+	return s.Sprint(fmt.Sprintf(format, a...))
+}
+
+// Wrap surrounds the text with the escape sequences of the style regardless
+// of the global color setting; formatters that decide on colors themselves use it
+func (s Style) Wrap(text string) string {
+	if len(s) == 0 {
+		return text
+	}
+	codes := make([]string, len(s))
+	for i, attr := range s {
+		codes[i] = strconv.Itoa(int(attr))
+	}
+	return "\x1b[" + strings.Join(codes, ";") + "m" + text + "\x1b[0m"
+}
+
+// Theme is the set of styles of the rocker output
+type Theme struct {
+	Debug     Style
+	Info      Style
+	Warning   Style
+	Error     Style
+	Step      Style
+	Cached    Style
+	NotCached Style
+	Stderr    Style
+}
+
+// Themes are the built-in themes
+var Themes = map[string]Theme{
+	"default": {
+		Debug:     Style{color.FgWhite},
+		Info:      Style{color.FgBlue},
+		Warning:   Style{color.FgYellow},
+		Error:     Style{color.FgRed},
+		Step:      Style{color.FgWhite, color.Bold},
+		Cached:    Style{color.FgGreen},
+		NotCached: Style{color.FgYellow},
+		Stderr:    Style{color.FgRed},
+	},
+	// Avoids telling things apart by red and green
+	"colorblind": {
+		Debug:     Style{color.FgWhite},
+		Info:      Style{color.FgCyan},
+		Warning:   Style{color.FgYellow, color.Bold},
+		Error:     Style{color.FgMagenta, color.Bold},
+		Step:      Style{color.FgWhite, color.Bold},
+		Cached:    Style{color.FgBlue, color.Bold},
+		NotCached: Style{color.FgYellow},
+		Stderr:    Style{color.FgMagenta},
+	},
+	// Keeps the output plain but still marks the important lines
+	"mono": {
+		Step:   Style{color.Bold},
+		Error:  Style{color.Bold},
+		Stderr: Style{color.Underline},
+	},
+}
+
+// Current is the theme of the output
+var Current = Themes["default"]
+
+var attributes = map[string]color.Attribute{
+	"bold":      color.Bold,
+	"faint":     color.Faint,
+	"italic":    color.Italic,
+	"underline": color.Underline,
+	"reverse":   color.ReverseVideo,
+	"black":     color.FgBlack,
+	"red":       color.FgRed,
+	"green":     color.FgGreen,
+	"yellow":    color.FgYellow,
+	"blue":      color.FgBlue,
+	"magenta":   color.FgMagenta,
+	"cyan":      color.FgCyan,
+	"white":     color.FgWhite,
+}
+
+// ParseStyle parses a style like "bold yellow" or "on-blue white"; "none" is
+// the empty style. Numbers are taken as SGR codes as is.
+func ParseStyle(spec string) (Style, error) {
+	style := Style{}
+	for _, word := range strings.Fields(strings.ToLower(spec)) {
+		if word == "none" {
+			continue
+		}
+		if code, err := strconv.Atoi(word); err == nil {
+			style = append(style, color.Attribute(code))
+			continue
+		}
+		bg := strings.HasPrefix(word, "on-")
+		attr, ok := attributes[strings.TrimPrefix(word, "on-")]
+		if !ok || (bg && (attr < color.FgBlack || attr > color.FgWhite)) {
+			return nil, fmt.Errorf("Unknown color %q in style %q", word, spec)
+		}
+		if bg {
+			attr += color.BgBlack - color.FgBlack
+		}
+		style = append(style, attr)
+	}
+	return style, nil
+}
+
+// Load returns the built-in theme by name, or reads it from the YAML file.
+// The file may base on a built-in theme and override some styles:
+//
+//	base: colorblind
+//	cached: bold cyan
+//	stderr: none
+func Load(nameOrFile string) (Theme, error) {
+	if theme, ok := Themes[nameOrFile]; ok {
+		return theme, nil
+	}
+
+	data, err := ioutil.ReadFile(nameOrFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return Theme{}, fmt.Errorf("Unknown theme %q, expected one of default, colorblind, mono or a file", nameOrFile)
+		}
+		return Theme{}, err
+	}
+
+	spec := map[string]string{}
+	if err := yaml.Unmarshal(data, &spec); err != nil {
+		return Theme{}, fmt.Errorf("Failed to parse theme file %s, error: %s", nameOrFile, err)
+	}
+
+	base := "default"
+	if name, ok := spec["base"]; ok {
+		base = name
+		delete(spec, "base")
+	}
+	theme, ok := Themes[base]
+	if !ok {
+		return Theme{}, fmt.Errorf("Unknown base theme %q in %s", base, nameOrFile)
+	}
+
+	for key, value := range spec {
+		style, err := ParseStyle(value)
+		if err != nil {
+			return Theme{}, fmt.Errorf("%s: %s", nameOrFile, err)
+		}
+		switch strings.ToLower(key) {
+		case "debug":
+			theme.Debug = style
+		case "info":
+			theme.Info = style
+		case "warning":
+			theme.Warning = style
+		case "error":
+			theme.Error = style
+		case "step":
+			theme.Step = style
+		case "cached":
+			theme.Cached = style
+		case "not-cached":
+			theme.NotCached = style
+		case "stderr":
+			theme.Stderr = style
+		default:
+			return Theme{}, fmt.Errorf("%s: unknown style %q", nameOrFile, key)
+		}
+	}
+
+	return theme, nil
+}
@@ -0,0 +1,106 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package theme
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/fatih/color"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUseColors(t *testing.T) {
+	defer os.Setenv("NO_COLOR", os.Getenv("NO_COLOR"))
+	os.Setenv("NO_COLOR", "")
+
+	for _, tc := range []struct {
+		mode     string
+		terminal bool
+		result   bool
+	}{
+		{"auto", true, true},
+		{"auto", false, false},
+		{"always", false, true},
+		{"never", true, false},
+	} {
+		result, err := UseColors(tc.mode, tc.terminal)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, tc.result, result, "mode %s, terminal %t", tc.mode, tc.terminal)
+	}
+
+	os.Setenv("NO_COLOR", "1")
+
+	result, _ := UseColors("auto", true)
+	assert.False(t, result, "NO_COLOR disables colors in the auto mode")
+
+	result, _ = UseColors("always", true)
+	assert.True(t, result, "--color=always wins over NO_COLOR")
+
+	_, err := UseColors("yes", true)
+	assert.Error(t, err)
+}
+
+func TestParseStyle(t *testing.T) {
+	style, err := ParseStyle("Bold yellow on-blue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, Style{color.Bold, color.FgYellow, color.BgBlue}, style)
+	assert.Equal(t, "\x1b[1;33;44mtext\x1b[0m", style.Wrap("text"))
+
+	style, err = ParseStyle("none")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "text", style.Wrap("text"))
+
+	for _, spec := range []string{"orange", "on-bold"} {
+		_, err := ParseStyle(spec)
+		assert.Error(t, err, spec)
+	}
+}
+
+func TestLoad(t *testing.T) {
+	theme, err := Load("colorblind")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, Themes["colorblind"], theme)
+
+	f, err := ioutil.TempFile("", "rocker-theme-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+
+	f.WriteString("base: colorblind\ncached: bold cyan\nstderr: none\n")
+	f.Close()
+
+	if theme, err = Load(f.Name()); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, Style{color.Bold, color.FgCyan}, theme.Cached)
+	assert.Equal(t, Style{}, theme.Stderr)
+	assert.Equal(t, Themes["colorblind"].Error, theme.Error)
+
+	_, err = Load("solarized")
+	assert.Error(t, err)
+}
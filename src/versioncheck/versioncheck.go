@@ -0,0 +1,178 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package versioncheck checks whether there is a newer rocker release available
+package versioncheck
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/wmark/semver"
+)
+
+// DefaultURL is the GitHub API endpoint that describes the latest rocker release
+const DefaultURL = "https://api.github.com/repos/grammarly/rocker/releases/latest"
+
+// Checker asks the release endpoint for the latest version at most once per Interval
+// and remembers the answer in StateFile
+type Checker struct {
+	URL       string
+	StateFile string
+	Interval  time.Duration
+	Client    *http.Client
+
+	now func() time.Time
+}
+
+// state is what is stored in the StateFile between runs
+type state struct {
+	Checked time.Time `json:"checked"`
+	Latest  string    `json:"latest"`
+}
+
+// Release is the subset of the GitHub release response we are interested in;
+// mirrors for airgapped environments should serve the same format
+type Release struct {
+	TagName string  `json:"tag_name"`
+	Assets  []Asset `json:"assets"`
+}
+
+// Asset is a file attached to the release
+type Asset struct {
+	Name string `json:"name"`
+	URL  string `json:"browser_download_url"`
+}
+
+// Version returns the version of the release without the "v" prefix
+func (r *Release) Version() string {
+	return strings.TrimPrefix(r.TagName, "v")
+}
+
+// Asset finds the file of the release by name
+func (r *Release) Asset(name string) (Asset, bool) {
+	for _, a := range r.Assets {
+		if a.Name == name {
+			return a, true
+		}
+	}
+	return Asset{}, false
+}
+
+// FetchRelease gets the description of the release from the endpoint
+func FetchRelease(client *http.Client, url string) (*Release, error) {
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Failed to check the latest release at %s, status: %s", url, resp.Status)
+	}
+
+	r := &Release{}
+	if err := json.NewDecoder(resp.Body).Decode(r); err != nil {
+		return nil, fmt.Errorf("Failed to decode the release info from %s, error: %s", url, err)
+	}
+
+	return r, nil
+}
+
+// New makes a Checker with the defaults, url may be empty
+func New(url, stateFile string) *Checker {
+	if url == "" {
+		url = DefaultURL
+	}
+	return &Checker{
+		URL:       url,
+		StateFile: stateFile,
+		Interval:  24 * time.Hour,
+		Client:    &http.Client{Timeout: 3 * time.Second},
+		now:       time.Now,
+	}
+}
+
+// Check returns the latest known release version and whether the current one
+// is significantly outdated, which is being at least one minor version behind
+func (c *Checker) Check(current string) (latest string, outdated bool, err error) {
+	cur, err := semver.NewVersion(current)
+	if err != nil {
+		return "", false, fmt.Errorf("Cannot check version of a non-release build %q", current)
+	}
+
+	s, _ := c.readState()
+
+	if s.Latest == "" || c.now().Sub(s.Checked) >= c.Interval {
+		if s.Latest, err = c.fetchLatest(); err != nil {
+			return "", false, err
+		}
+		s.Checked = c.now()
+		if err := c.writeState(s); err != nil {
+			return "", false, err
+		}
+	}
+
+	latestMinor, err := semver.NewVersion(minorOf(s.Latest))
+	if err != nil {
+		return "", false, fmt.Errorf("Failed to parse the latest release version %q, error: %s", s.Latest, err)
+	}
+
+	return s.Latest, cur.Less(latestMinor), nil
+}
+
+func (c *Checker) fetchLatest() (string, error) {
+	r, err := FetchRelease(c.Client, c.URL)
+	if err != nil {
+		return "", err
+	}
+	return r.Version(), nil
+}
+
+func (c *Checker) readState() (s state, err error) {
+	data, err := ioutil.ReadFile(c.StateFile)
+	if err != nil {
+		return s, err
+	}
+	err = json.Unmarshal(data, &s)
+	return s, err
+}
+
+func (c *Checker) writeState(s state) error {
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(c.StateFile), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(c.StateFile, data, 0644)
+}
+
+// minorOf drops the patch part of the version, so "1.3.1" becomes "1.3.0"
+func minorOf(version string) string {
+	parts := strings.SplitN(strings.TrimPrefix(version, "v"), ".", 3)
+	if len(parts) < 2 {
+		return version
+	}
+	return parts[0] + "." + parts[1] + ".0"
+}
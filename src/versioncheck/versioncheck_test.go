@@ -0,0 +1,83 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package versioncheck
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestChecker_Check(t *testing.T) {
+	requests := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		fmt.Fprint(w, `{"tag_name": "1.3.1"}`)
+	}))
+	defer ts.Close()
+
+	tmpDir, err := ioutil.TempDir("", "rocker-versioncheck-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	now := time.Now()
+	c := New(ts.URL, filepath.Join(tmpDir, "version_check.json"))
+	c.now = func() time.Time { return now }
+
+	tests := []struct {
+		current  string
+		outdated bool
+	}{
+		{"1.3.1", false},
+		{"1.3.0", false},
+		{"1.2.9", true},
+		{"0.9.0", true},
+		{"1.4.0", false},
+	}
+
+	for _, test := range tests {
+		latest, outdated, err := c.Check(test.current)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, "1.3.1", latest)
+		assert.Equal(t, test.outdated, outdated, "current version %s", test.current)
+	}
+
+	assert.Equal(t, 1, requests, "expected the answer to be remembered")
+
+	now = now.Add(25 * time.Hour)
+	if _, _, err := c.Check("1.3.1"); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 2, requests, "expected to check again after a day")
+}
+
+func TestChecker_CheckNonRelease(t *testing.T) {
+	c := New("http://127.0.0.1:0", "/nonexistent")
+	_, _, err := c.Check("built locally")
+	assert.Error(t, err)
+}
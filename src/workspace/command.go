@@ -0,0 +1,191 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package workspace
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/grammarly/rocker/src/build"
+	"github.com/grammarly/rocker/src/cliutil"
+	"github.com/grammarly/rocker/src/imagename"
+
+	"github.com/codegangsta/cli"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// CommandSpec returns specifications of the workspace command for codegangsta/cli
+func CommandSpec() cli.Command {
+	return cli.Command{
+		Name:  "workspace",
+		Usage: "works with the projects listed in the rocker.work manifest",
+		Subcommands: []cli.Command{
+			{
+				Name:   "build",
+				Usage:  "builds the projects of the workspace, all or those matching the name patterns given as arguments; arguments after -- go to each build",
+				Action: buildCommand,
+				Flags: []cli.Flag{
+					cli.StringFlag{
+						Name:  "file, f",
+						Value: DefaultFile,
+						Usage: "workspace manifest",
+					},
+					cli.StringFlag{
+						Name:  "cache-dir",
+						Usage: "cache directory shared by the builds, overrides cache_dir of the manifest",
+					},
+					cli.BoolFlag{
+						Name:  "keep-going",
+						Usage: "build the rest of the projects after one fails",
+					},
+					cli.BoolFlag{
+						Name:  "dry-run",
+						Usage: "only print the build commands",
+					},
+				},
+			},
+		},
+	}
+}
+
+// buildCommand implements 'workspace build' command that builds the projects one
+// by one with rocker itself and prints the summary
+func buildCommand(c *cli.Context) {
+	w, err := Load(c.String("file"))
+	if err != nil {
+		cliutil.Exit(build.WithExitCode(build.ExitUser, err))
+	}
+	if dir := c.String("cache-dir"); dir != "" {
+		w.CacheDir = dir
+	}
+
+	// Project patterns go first, the rest is passed to each build
+	var (
+		patterns = []string{}
+		extra    = []string{}
+	)
+	for i, arg := range c.Args() {
+		if arg == "--" {
+			extra = c.Args()[i+1:]
+			break
+		}
+		if strings.HasPrefix(arg, "-") {
+			extra = c.Args()[i:]
+			break
+		}
+		patterns = append(patterns, arg)
+	}
+
+	projects, err := w.Select(patterns)
+	if err != nil {
+		cliutil.Exit(build.WithExitCode(build.ExitUser, err))
+	}
+
+	tmpDir, err := ioutil.TempDir("", "rocker-workspace-")
+	if err != nil {
+		cliutil.Exit(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	type result struct {
+		project   *Project
+		status    string
+		duration  time.Duration
+		artifacts []imagename.Artifact
+	}
+
+	var (
+		results = []*result{}
+		failed  = 0
+	)
+
+	for i, p := range projects {
+		r := &result{project: p, status: "not built"}
+		results = append(results, r)
+
+		if failed > 0 && !c.Bool("keep-going") {
+			continue
+		}
+
+		artifactsDir := filepath.Join(tmpDir, strconv.Itoa(i))
+
+		args, err := w.BuildArgs(p, tmpDir, artifactsDir, extra)
+		if err != nil {
+			cliutil.Exit(build.WithExitCode(build.ExitUser, err))
+		}
+
+		log.Infof("Build %d of %d: %s", i+1, len(projects), p.Name)
+
+		if c.Bool("dry-run") {
+			fmt.Println(strings.Join(append([]string{os.Args[0]}, append(cliutil.GlobalArgs("workspace"), args...)...), " "))
+			r.status = "dry run"
+			continue
+		}
+
+		cmd := exec.Command(os.Args[0], append(cliutil.GlobalArgs("workspace"), args...)...)
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+
+		started := time.Now()
+		err = cmd.Run()
+		r.duration = time.Since(started)
+
+		if err != nil {
+			log.Errorf("Build of %s failed, error: %s", p.Name, err)
+			r.status = "failed"
+			failed++
+			continue
+		}
+		r.status = "ok"
+
+		if r.artifacts, err = ReadArtifacts(artifactsDir); err != nil {
+			log.Errorf("Failed to read the artifacts of %s, error: %s", p.Name, err)
+		}
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "PROJECT\tSTATUS\tTIME\tIMAGES")
+	for _, r := range results {
+		images := []string{}
+		for _, a := range r.artifacts {
+			name := a.Name.String()
+			if a.Pushed {
+				name += " (pushed)"
+			}
+			images = append(images, name)
+		}
+		duration := ""
+		if r.duration > 0 {
+			duration = r.duration.Round(time.Second).String()
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", r.project.Name, r.status, duration, strings.Join(images, ", "))
+	}
+	tw.Flush()
+
+	if failed > 0 {
+		log.Errorf("%d of %d projects failed to build", failed, len(projects))
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,234 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package workspace reads the rocker.work manifest that lists the projects
+// of a repository, so they can be built together by `rocker workspace build`.
+package workspace
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/grammarly/rocker/src/imagename"
+	"github.com/grammarly/rocker/src/template"
+
+	"github.com/go-yaml/yaml"
+)
+
+// DefaultFile is the name of the manifest looked up in the current directory
+const DefaultFile = "rocker.work"
+
+// Workspace is the manifest of the form
+//
+//	cache_dir: ~/.rocker_cache
+//	vars:
+//	  Registry: registry.acme.com
+//	projects:
+//	  - name: api
+//	    path: services/api
+//	    vars:
+//	      Version: 1.2.0
+//	    push: true
+//	  - path: services/web
+//	    rockerfile: Rockerfile.prod
+//	    push_routes: routes.yml
+type Workspace struct {
+	// Dir is where the manifest is, the paths of the projects are relative to it
+	Dir      string        `yaml:"-"`
+	CacheDir string        `yaml:"cache_dir"`
+	Vars     template.Vars `yaml:"vars"`
+	Projects []*Project    `yaml:"projects"`
+}
+
+// Project is a Rockerfile of the workspace and how to build it
+type Project struct {
+	Name string `yaml:"name"`
+	// Path is the context directory of the build
+	Path string `yaml:"path"`
+	// Rockerfile is relative to the path, "Rockerfile" by default
+	Rockerfile string `yaml:"rockerfile"`
+	// Vars override the variables of the workspace
+	Vars template.Vars `yaml:"vars"`
+	// Push enables the PUSH instructions of the Rockerfile
+	Push bool `yaml:"push"`
+	// PushRoutes is the file of the rules routing the pushes to other registries
+	PushRoutes string `yaml:"push_routes"`
+}
+
+// Load reads the manifest and fills in the defaults: the name of a project
+// is its path unless given, and the Rockerfile is "Rockerfile"
+func Load(file string) (*Workspace, error) {
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	w := &Workspace{}
+	if err := yaml.Unmarshal(content, w); err != nil {
+		return nil, fmt.Errorf("Failed to parse workspace %s, error: %s", file, err)
+	}
+
+	if w.Dir, err = filepath.Abs(filepath.Dir(file)); err != nil {
+		return nil, err
+	}
+
+	if len(w.Projects) == 0 {
+		return nil, fmt.Errorf("Workspace %s has no projects", file)
+	}
+
+	names := map[string]bool{}
+
+	for i, p := range w.Projects {
+		if p == nil || p.Path == "" {
+			return nil, fmt.Errorf("Project %d in %s has no path", i+1, file)
+		}
+		if p.Name == "" {
+			p.Name = filepath.ToSlash(filepath.Clean(p.Path))
+		}
+		if p.Rockerfile == "" {
+			p.Rockerfile = "Rockerfile"
+		}
+		if names[p.Name] {
+			return nil, fmt.Errorf("Duplicate project %s in %s", p.Name, file)
+		}
+		names[p.Name] = true
+	}
+
+	return w, nil
+}
+
+// Select returns the projects whose names match any of the glob patterns,
+// in the order of the manifest; all of them if no patterns are given.
+// A pattern that matches nothing is an error, most likely a typo.
+func (w *Workspace) Select(patterns []string) ([]*Project, error) {
+	if len(patterns) == 0 {
+		return w.Projects, nil
+	}
+
+	selected := []*Project{}
+
+	for _, pattern := range patterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("Invalid project pattern %q", pattern)
+		}
+	}
+
+	matched := map[string]bool{}
+
+	for _, p := range w.Projects {
+		for _, pattern := range patterns {
+			if ok, _ := path.Match(pattern, p.Name); ok {
+				selected = append(selected, p)
+				matched[pattern] = true
+				break
+			}
+		}
+	}
+
+	for _, pattern := range patterns {
+		if !matched[pattern] {
+			return nil, fmt.Errorf("No project of the workspace matches %s", pattern)
+		}
+	}
+
+	return selected, nil
+}
+
+// BuildArgs returns the arguments of `rocker build` for the project, with the
+// extra ones given before the context directory; the variables are written to
+// a file in tmpDir, so they keep their YAML types
+func (w *Workspace) BuildArgs(p *Project, tmpDir, artifactsDir string, extra []string) ([]string, error) {
+	vars := template.Vars{}.Merge(w.Vars, p.Vars)
+
+	content, err := yaml.Marshal(vars.ToMapOfInterface())
+	if err != nil {
+		return nil, err
+	}
+
+	varsFile := filepath.Join(tmpDir, strings.Replace(p.Name, "/", "_", -1)+".vars.yml")
+	if err := ioutil.WriteFile(varsFile, content, 0644); err != nil {
+		return nil, err
+	}
+
+	dir := filepath.Join(w.Dir, filepath.FromSlash(p.Path))
+
+	args := []string{
+		"build",
+		"--file", filepath.Join(dir, filepath.FromSlash(p.Rockerfile)),
+		"--vars", varsFile,
+		"--artifacts-path", artifactsDir,
+	}
+	if w.CacheDir != "" {
+		args = append(args, "--cache-dir", w.CacheDir)
+	}
+	if p.Push {
+		args = append(args, "--push")
+	}
+	if p.PushRoutes != "" {
+		args = append(args, "--push-routes", filepath.Join(w.Dir, filepath.FromSlash(p.PushRoutes)))
+	}
+
+	args = append(args, extra...)
+
+	return append(args, dir), nil
+}
+
+// ReadArtifacts reads the artifact files that a build wrote to the directory,
+// sorted by the image name
+func ReadArtifacts(dir string) ([]imagename.Artifact, error) {
+	artifacts := []imagename.Artifact{}
+
+	files, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return artifacts, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for _, file := range files {
+		if file.IsDir() || filepath.Ext(file.Name()) != ".yml" {
+			continue
+		}
+
+		content, err := ioutil.ReadFile(filepath.Join(dir, file.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		var a imagename.Artifacts
+		if err := yaml.Unmarshal(content, &a); err != nil {
+			return nil, fmt.Errorf("Failed to parse artifact file %s, error: %s", file.Name(), err)
+		}
+
+		artifacts = append(artifacts, a.RockerArtifacts...)
+	}
+
+	sort.Sort(byName(artifacts))
+
+	return artifacts, nil
+}
+
+type byName []imagename.Artifact
+
+func (a byName) Len() int           { return len(a) }
+func (a byName) Less(i, j int) bool { return a[i].Name.String() < a[j].Name.String() }
+func (a byName) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
@@ -0,0 +1,191 @@
+/*-
+ * Copyright 2015 Grammarly, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package workspace
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/grammarly/rocker/src/template"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const manifest = `
+cache_dir: /cache
+vars:
+  Registry: registry.acme.com
+  Version: "1.0"
+projects:
+  - name: api
+    path: services/api
+    vars:
+      Version: 1.2
+    push: true
+  - path: services/web/
+    rockerfile: Rockerfile.prod
+    push_routes: routes.yml
+  - name: tools-lint
+    path: tools/lint
+`
+
+func writeManifest(t *testing.T, content string) (dir, file string) {
+	dir, err := ioutil.TempDir("", "rocker-workspace-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	file = filepath.Join(dir, DefaultFile)
+	if err := ioutil.WriteFile(file, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return dir, file
+}
+
+func TestLoad(t *testing.T) {
+	dir, file := writeManifest(t, manifest)
+	defer os.RemoveAll(dir)
+
+	w, err := Load(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, dir, w.Dir)
+	assert.Equal(t, "/cache", w.CacheDir)
+	assert.Len(t, w.Projects, 3)
+	assert.Equal(t, "services/web", w.Projects[1].Name)
+	assert.Equal(t, "Rockerfile", w.Projects[0].Rockerfile)
+	assert.Equal(t, "Rockerfile.prod", w.Projects[1].Rockerfile)
+}
+
+func TestLoad_Invalid(t *testing.T) {
+	tests := map[string]string{
+		"projects: []":                                    "has no projects",
+		"projects:\n  - name: api":                        "Project 1 in",
+		"projects:\n  - path: api\n  - path: ./api":       "Duplicate project api",
+		"projects:\n  - path: api\n    push: [not, bool]": "Failed to parse workspace",
+	}
+
+	for content, message := range tests {
+		dir, file := writeManifest(t, content)
+		_, err := Load(file)
+		os.RemoveAll(dir)
+
+		if assert.Error(t, err, content) {
+			assert.Contains(t, err.Error(), message)
+		}
+	}
+}
+
+func TestSelect(t *testing.T) {
+	w := &Workspace{Projects: []*Project{{Name: "api"}, {Name: "services/web"}, {Name: "tools-lint"}}}
+
+	names := func(projects []*Project) []string {
+		result := []string{}
+		for _, p := range projects {
+			result = append(result, p.Name)
+		}
+		return result
+	}
+
+	projects, err := w.Select(nil)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"api", "services/web", "tools-lint"}, names(projects))
+
+	projects, err = w.Select([]string{"tools-*", "api"})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"api", "tools-lint"}, names(projects))
+
+	_, err = w.Select([]string{"api", "nope*"})
+	assert.EqualError(t, err, "No project of the workspace matches nope*")
+}
+
+func TestBuildArgs(t *testing.T) {
+	dir, file := writeManifest(t, manifest)
+	defer os.RemoveAll(dir)
+
+	w, err := Load(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	args, err := w.BuildArgs(w.Projects[0], dir, "/artifacts", []string{"--no-cache"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	varsFile := filepath.Join(dir, "api.vars.yml")
+	assert.Equal(t, []string{
+		"build",
+		"--file", filepath.Join(dir, "services/api/Rockerfile"),
+		"--vars", varsFile,
+		"--artifacts-path", "/artifacts",
+		"--cache-dir", "/cache",
+		"--push",
+		"--no-cache",
+		filepath.Join(dir, "services/api"),
+	}, args)
+
+	vars, err := template.VarsFromFile(varsFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "registry.acme.com", vars["Registry"])
+	assert.Equal(t, 1.2, vars["Version"])
+
+	args, err = w.BuildArgs(w.Projects[1], dir, "/artifacts", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Contains(t, args, filepath.Join(dir, "routes.yml"))
+	assert.Contains(t, args, filepath.Join(dir, "services/web/Rockerfile.prod"))
+}
+
+func TestReadArtifacts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rocker-workspace-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		"web.yml": "RockerArtifacts:\n- Name: acme/web:1.0\n  Pushed: true\n  ImageID: sha256:2\n",
+		"api.yml": "RockerArtifacts:\n- Name: acme/api:1.0\n  Pushed: false\n  ImageID: sha256:1\n",
+		"notes":   "not an artifact",
+	}
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	artifacts, err := ReadArtifacts(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Len(t, artifacts, 2)
+	assert.Equal(t, "acme/api:1.0", artifacts[0].Name.String())
+	assert.Equal(t, "sha256:1", artifacts[0].ImageID)
+	assert.True(t, artifacts[1].Pushed)
+
+	artifacts, err = ReadArtifacts(filepath.Join(dir, "missing"))
+	assert.NoError(t, err)
+	assert.Empty(t, artifacts)
+}